@@ -0,0 +1,1106 @@
+// Package apiclient is a typed Go client for the file upload server. It
+// follows the OpenAPI document the server publishes at /openapi.json
+// (server/openapi.json in this repository); every exported method maps to one
+// operationId there, which openapi_test.go checks along with the fields of
+// the types.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one server. The zero HTTPClient means http.DefaultClient.
+// Token, if set, is sent as a bearer token: a principal token, or the admin
+// token for the admin operations. UserAgent, if set, names the program in
+// the User-Agent of every request; the server records it with uploads.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Token      string
+	UserAgent  string
+}
+
+// New returns a client for a server such as "http://127.0.0.1:8080".
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// Error is returned for every non-success response. Code and Retryable come
+// from the ErrorResponse body; responses that have none, such as those of a
+// proxy, leave Code empty and keep the body as Message. Hints is set for 413
+// and 507 responses, RetryAfter for responses carrying a Retry-After header.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Retryable  bool
+	Details    json.RawMessage
+	Hints      *LimitHints
+	RetryAfter int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// RegisterFile implements registerFile. Chunks listed in ExistingChunks or
+// HoleChunks of the result are already stored and need not be uploaded.
+func (c *Client) RegisterFile(ctx context.Context, info FileInfo) (*Registration, error) {
+	var registration Registration
+	if err := c.doJSON(ctx, "POST", "/register_file", info, &registration, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &registration, nil
+}
+
+// UploadChunk implements uploadChunk. Chunk-Hash and Content-Digest are
+// computed from data, and a receipt whose hash differs from them is an error.
+func (c *Client) UploadChunk(ctx context.Context, fileID string, chunkNumber int, data []byte) (*ChunkReceipt, error) {
+	sum := sha256.Sum256(data)
+	request, err := c.newRequest(ctx, "POST", fmt.Sprintf("/upload_chunk/%s/%d", url.PathEscape(fileID), chunkNumber), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Chunk-Hash", fmt.Sprintf("%x", sum))
+	request.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	var receipt ChunkReceipt
+	if err := c.do(request, &receipt, http.StatusOK); err != nil {
+		return nil, err
+	}
+	if receipt.Hash != "" && receipt.Hash != fmt.Sprintf("%x", sum) {
+		return &receipt, fmt.Errorf("server stored chunk %d with hash %s, sent %x", chunkNumber, receipt.Hash, sum)
+	}
+	return &receipt, nil
+}
+
+// CompleteUpload implements completeUpload. A committed file yields its
+// upload report; members of an upload group that are only staged yield the
+// group state instead.
+func (c *Client) CompleteUpload(ctx context.Context, fileID string) (*UploadReport, *UploadGroup, error) {
+	request, err := c.newRequest(ctx, "GET", "/complete_upload/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.send(request, http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		var group UploadGroup
+		if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+			return nil, nil, err
+		}
+		return nil, &group, nil
+	}
+	var report UploadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, nil, err
+	}
+	return &report, nil, nil
+}
+
+// UploadSmall implements uploadSmall: it stores data, which may not exceed
+// the server's -small-upload-limit, as name in one request. File-Hash is
+// computed from data; attributes may be nil.
+func (c *Client) UploadSmall(ctx context.Context, name string, data []byte, tags map[string]string, attributes *FileAttributes) (*UploadReport, error) {
+	query := url.Values{"name": {name}}
+	for key, value := range tags {
+		query.Add("tag", key+"="+value)
+	}
+	request, err := c.newRequest(ctx, "POST", "/upload_small?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("File-Hash", fmt.Sprintf("%x", sha256.Sum256(data)))
+	if attributes != nil {
+		encoded, err := json.Marshal(attributes)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("File-Attributes", string(encoded))
+	}
+	var report UploadReport
+	if err := c.do(request, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// UploadTar implements uploadTar: every regular file of the tar archive,
+// which may be gzip compressed, read from archive is stored under prefix
+// with tags. The archive is streamed as it is read.
+func (c *Client) UploadTar(ctx context.Context, prefix string, tags map[string]string, archive io.Reader) (*TarUpload, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	for key, value := range tags {
+		query.Add("tag", key+"="+value)
+	}
+	request, err := c.newRequest(ctx, "POST", "/upload_tar?"+query.Encode(), archive)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-tar")
+	var result TarUpload
+	if err := c.do(request, &result, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Probe implements probe, or probeBurst when burst is not nil: the server
+// reads and discards the burst, which may not exceed its maximum chunk size.
+func (c *Client) Probe(ctx context.Context, burst []byte) (*ProbeResult, error) {
+	method := "GET"
+	var body io.Reader
+	if burst != nil {
+		method, body = "POST", bytes.NewReader(burst)
+	}
+	request, err := c.newRequest(ctx, method, "/probe", body)
+	if err != nil {
+		return nil, err
+	}
+	var result ProbeResult
+	if err := c.do(request, &result, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetCapabilities implements getCapabilities.
+func (c *Client) GetCapabilities(ctx context.Context) (*Capabilities, error) {
+	request, err := c.newRequest(ctx, "GET", "/capabilities", nil)
+	if err != nil {
+		return nil, err
+	}
+	var capabilities Capabilities
+	if err := c.do(request, &capabilities, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &capabilities, nil
+}
+
+// GetOpenAPI implements getOpenAPI, returning the OpenAPI document the
+// server publishes.
+func (c *Client) GetOpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var document json.RawMessage
+	if err := c.doJSON(ctx, "GET", "/openapi.json", nil, &document, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// CreateUpload implements createUploadV2: the chunks in MissingChunks of
+// the result are sent with UploadChunkV2, the others are already stored.
+func (c *Client) CreateUpload(ctx context.Context, manifest UploadManifest) (*UploadSession, error) {
+	var session UploadSession
+	if err := c.doJSON(ctx, "POST", "/v2/uploads", manifest, &session, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetUpload implements getUploadV2.
+func (c *Client) GetUpload(ctx context.Context, uploadID string) (*UploadSession, error) {
+	var session UploadSession
+	if err := c.doJSON(ctx, "GET", "/v2/uploads/"+url.PathEscape(uploadID), nil, &session, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// UploadChunkV2 implements uploadChunkV2. Chunks of uploads created from a
+// manifest are checked against it; Chunk-Hash is sent for the others.
+func (c *Client) UploadChunkV2(ctx context.Context, uploadID string, chunkNumber int, data []byte) (*ChunkReceipt, error) {
+	sum := sha256.Sum256(data)
+	request, err := c.newRequest(ctx, "PUT", fmt.Sprintf("/v2/uploads/%s/chunks/%d", url.PathEscape(uploadID), chunkNumber), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Chunk-Hash", fmt.Sprintf("%x", sum))
+	var receipt ChunkReceipt
+	if err := c.do(request, &receipt, http.StatusOK); err != nil {
+		return nil, err
+	}
+	if receipt.Hash != "" && receipt.Hash != fmt.Sprintf("%x", sum) {
+		return &receipt, fmt.Errorf("server stored chunk %d with hash %s, sent %x", chunkNumber, receipt.Hash, sum)
+	}
+	return &receipt, nil
+}
+
+// CompleteUploadV2 implements completeUploadV2 for uploads outside groups.
+func (c *Client) CompleteUploadV2(ctx context.Context, uploadID string) (*UploadReport, error) {
+	var report UploadReport
+	if err := c.doJSON(ctx, "POST", "/v2/uploads/"+url.PathEscape(uploadID)+"/complete", nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CancelUploadV2 implements cancelUploadV2. Chunks sent for the upload
+// afterwards fail with a 410 Error.
+func (c *Client) CancelUploadV2(ctx context.Context, uploadID string) error {
+	return c.doJSON(ctx, "DELETE", "/v2/uploads/"+url.PathEscape(uploadID), nil, nil, http.StatusNoContent)
+}
+
+// CreateSession implements createSession: the token authenticates as the
+// caller until ExpiresAt.
+func (c *Client) CreateSession(ctx context.Context) (*SessionToken, error) {
+	var session SessionToken
+	if err := c.doJSON(ctx, "POST", "/v2/session", nil, &session, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// DeleteSession implements deleteSession, revoking the session token the
+// client authenticates with.
+func (c *Client) DeleteSession(ctx context.Context) error {
+	return c.doJSON(ctx, "DELETE", "/v2/session", nil, nil, http.StatusNoContent)
+}
+
+// GetSession implements getSession: the session token the client
+// authenticates with, without the token itself.
+func (c *Client) GetSession(ctx context.Context) (*SessionToken, error) {
+	var session SessionToken
+	if err := c.doJSON(ctx, "GET", "/v2/session", nil, &session, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Login implements login. The session is set as a cookie, which later
+// requests only send if HTTPClient has a cookie jar.
+func (c *Client) Login(ctx context.Context, username, password string) (*LoginSession, error) {
+	var session LoginSession
+	if err := c.doJSON(ctx, "POST", "/login", LoginRequest{Username: username, Password: password}, &session, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetLoginSession implements getLoginSession.
+func (c *Client) GetLoginSession(ctx context.Context) (*LoginSession, error) {
+	var session LoginSession
+	if err := c.doJSON(ctx, "GET", "/login", nil, &session, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Logout implements logout, ending the session of the cookie.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.doJSON(ctx, "POST", "/logout", nil, nil, http.StatusNoContent)
+}
+
+// ResumeUpload implements resumeUpload: the chunks still to send are those
+// not in ReceivedChunks of the result, after which CompleteUpload finishes
+// the upload.
+func (c *Client) ResumeUpload(ctx context.Context, resumptionToken string) (*ResumptionStatus, error) {
+	var status ResumptionStatus
+	request := map[string]string{"resumptionToken": resumptionToken}
+	if err := c.doJSON(ctx, "POST", "/resume_upload", request, &status, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// CancelUpload implements cancelUpload. Chunks sent for the upload afterwards
+// fail with a 410 Error.
+func (c *Client) CancelUpload(ctx context.Context, fileID string) error {
+	return c.doJSON(ctx, "DELETE", "/upload/"+url.PathEscape(fileID), nil, nil, http.StatusNoContent)
+}
+
+// ListFiles implements listFiles. Each tag is "key=value" or "key", and only
+// files carrying every one of them are listed.
+func (c *Client) ListFiles(ctx context.Context, prefix string, tags ...string) ([]FileMetadata, error) {
+	query := url.Values{"prefix": {prefix}}
+	if len(tags) > 0 {
+		query["tag"] = tags
+	}
+	var files []FileMetadata
+	if err := c.doJSON(ctx, "GET", "/files?"+query.Encode(), nil, &files, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// SearchFiles implements searchFiles. A limit of 0 uses the server's default.
+func (c *Client) SearchFiles(ctx context.Context, query string, offset, limit int) (*SearchResponse, error) {
+	values := url.Values{"q": {query}, "offset": {strconv.Itoa(offset)}}
+	if limit > 0 {
+		values.Set("limit", strconv.Itoa(limit))
+	}
+	var response SearchResponse
+	if err := c.doJSON(ctx, "GET", "/search?"+values.Encode(), nil, &response, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// ListEvents implements listEvents: the events after the event ID since,
+// oldest first. Passing the ID of the last event returned polls for new
+// ones; since 0 returns the most recent events.
+func (c *Client) ListEvents(ctx context.Context, since int64, eventType string) ([]Event, error) {
+	values := url.Values{}
+	if since > 0 {
+		values.Set("since", strconv.FormatInt(since, 10))
+	}
+	if eventType != "" {
+		values.Set("type", eventType)
+	}
+	var events []Event
+	if err := c.doJSON(ctx, "GET", "/events?"+values.Encode(), nil, &events, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetFile implements getFile.
+func (c *Client) GetFile(ctx context.Context, fileID string) (*FileMetadata, error) {
+	var metadata FileMetadata
+	if err := c.doJSON(ctx, "GET", "/files/"+url.PathEscape(fileID), nil, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// DeleteFile implements deleteFile. Unless the server keeps no trash, the
+// file can be brought back with RestoreFile.
+func (c *Client) DeleteFile(ctx context.Context, fileID string) error {
+	return c.doJSON(ctx, "DELETE", "/files/"+url.PathEscape(fileID), nil, nil, http.StatusNoContent)
+}
+
+// RestoreFile implements restoreFile.
+func (c *Client) RestoreFile(ctx context.Context, fileID string) (*FileMetadata, error) {
+	var metadata FileMetadata
+	if err := c.doJSON(ctx, "POST", "/files/"+url.PathEscape(fileID)+"/restore", nil, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// CopyFile implements copyFile.
+func (c *Client) CopyFile(ctx context.Context, fileID string, request CopyRequest) (*FileMetadata, error) {
+	var metadata FileMetadata
+	if err := c.doJSON(ctx, "POST", "/files/"+url.PathEscape(fileID)+"/copy", request, &metadata, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// MoveFile implements moveFile.
+func (c *Client) MoveFile(ctx context.Context, fileID string, request CopyRequest) (*FileMetadata, error) {
+	var metadata FileMetadata
+	if err := c.doJSON(ctx, "POST", "/files/"+url.PathEscape(fileID)+"/move", request, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// GetFileTags implements getFileTags.
+func (c *Client) GetFileTags(ctx context.Context, fileID string) (map[string]string, error) {
+	var tags map[string]string
+	if err := c.doJSON(ctx, "GET", "/files/"+url.PathEscape(fileID)+"/tags", nil, &tags, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// ReplaceFileTags implements replaceFileTags.
+func (c *Client) ReplaceFileTags(ctx context.Context, fileID string, tags map[string]string) (map[string]string, error) {
+	var updated map[string]string
+	if err := c.doJSON(ctx, "PUT", "/files/"+url.PathEscape(fileID)+"/tags", tags, &updated, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// UpdateFileTags implements updateFileTags. A nil value removes its tag.
+func (c *Client) UpdateFileTags(ctx context.Context, fileID string, tags map[string]*string) (map[string]string, error) {
+	var updated map[string]string
+	if err := c.doJSON(ctx, "PATCH", "/files/"+url.PathEscape(fileID)+"/tags", tags, &updated, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// GetFileACL implements getFileAcl.
+func (c *Client) GetFileACL(ctx context.Context, fileID string) (*FileACL, error) {
+	var acl FileACL
+	if err := c.doJSON(ctx, "GET", "/files/"+url.PathEscape(fileID)+"/acl", nil, &acl, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// GrantAccess implements grantFileAccess, replacing earlier grants to the
+// principal ("*" for everyone).
+func (c *Client) GrantAccess(ctx context.Context, fileID, principal string, permissions ...string) (*FileACL, error) {
+	var acl FileACL
+	path := "/files/" + url.PathEscape(fileID) + "/acl/" + url.PathEscape(principal)
+	if err := c.doJSON(ctx, "PUT", path, ACLEntry{Permissions: permissions}, &acl, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// RevokeAccess implements revokeFileAccess.
+func (c *Client) RevokeAccess(ctx context.Context, fileID, principal string) (*FileACL, error) {
+	var acl FileACL
+	path := "/files/" + url.PathEscape(fileID) + "/acl/" + url.PathEscape(principal)
+	if err := c.doJSON(ctx, "DELETE", path, nil, &acl, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// GetBlockChecksums implements getBlockChecksums; blockSize 0 uses the
+// server default.
+func (c *Client) GetBlockChecksums(ctx context.Context, fileID string, blockSize int) (*BlockList, error) {
+	path := "/files/" + url.PathEscape(fileID) + "/blocks"
+	if blockSize > 0 {
+		path += "?blockSize=" + strconv.Itoa(blockSize)
+	}
+	var blocks BlockList
+	if err := c.doJSON(ctx, "GET", path, nil, &blocks, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &blocks, nil
+}
+
+// CheckFileIntegrity implements checkFileIntegrity. A failed check is not an
+// error; it is reported with Passed false.
+func (c *Client) CheckFileIntegrity(ctx context.Context, fileID string) (*IntegrityReport, error) {
+	var report IntegrityReport
+	if err := c.doJSON(ctx, "GET", "/files/"+url.PathEscape(fileID)+"/integrity", nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetFilePeers implements getFilePeers.
+func (c *Client) GetFilePeers(ctx context.Context, fileID string) (*PeerSwarm, error) {
+	var swarm PeerSwarm
+	if err := c.doJSON(ctx, "GET", "/files/"+url.PathEscape(fileID)+"/peers", nil, &swarm, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &swarm, nil
+}
+
+// AnnounceFilePeer implements announceFilePeer; the answer's PeerURL
+// withdraws the announcement.
+func (c *Client) AnnounceFilePeer(ctx context.Context, fileID string, announcement PeerAnnouncement) (*PeerSwarm, error) {
+	var swarm PeerSwarm
+	if err := c.doJSON(ctx, "POST", "/files/"+url.PathEscape(fileID)+"/peers", announcement, &swarm, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &swarm, nil
+}
+
+// WithdrawFilePeer implements withdrawFilePeer.
+func (c *Client) WithdrawFilePeer(ctx context.Context, fileID, peerURL string) error {
+	return c.doJSON(ctx, "DELETE", "/files/"+url.PathEscape(fileID)+"/peers?url="+url.QueryEscape(peerURL), nil, nil, http.StatusNoContent)
+}
+
+// GetFileManifest implements getFileManifest; chunkSize 0 cuts the file at the
+// chunk size it was uploaded with.
+func (c *Client) GetFileManifest(ctx context.Context, fileID string, chunkSize int) (*ChunkManifest, error) {
+	path := "/files/" + url.PathEscape(fileID) + "/manifest"
+	if chunkSize > 0 {
+		path += "?chunkSize=" + strconv.Itoa(chunkSize)
+	}
+	var manifest ChunkManifest
+	if err := c.doJSON(ctx, "GET", path, nil, &manifest, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// DownloadFile implements downloadFile. rangeHeader is an optional HTTP Range
+// value such as "bytes=100-"; the caller must close the returned body.
+func (c *Client) DownloadFile(ctx context.Context, fileID, rangeHeader string) (*http.Response, error) {
+	request, err := c.newRequest(ctx, "GET", "/download/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		request.Header.Set("Range", rangeHeader)
+	}
+	request.Header.Set("Want-Repr-Digest", "sha-256=10")
+	return c.send(request, http.StatusOK, http.StatusPartialContent)
+}
+
+// DownloadSharedFile implements downloadSharedFile: it fetches the signed
+// URL of a link, which needs no token. rangeHeader is as for DownloadFile;
+// the caller must close the returned body.
+func (c *Client) DownloadSharedFile(ctx context.Context, link DownloadLink, rangeHeader string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+link.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		request.Header.Set("User-Agent", c.UserAgent)
+	}
+	if rangeHeader != "" {
+		request.Header.Set("Range", rangeHeader)
+	}
+	return c.send(request, http.StatusOK, http.StatusPartialContent)
+}
+
+// GetThumbnail implements getThumbnail; size 0 asks for the smallest
+// thumbnail. The caller must close the response body, an image/jpeg or
+// image/png.
+func (c *Client) GetThumbnail(ctx context.Context, fileID string, size int) (*http.Response, error) {
+	path := "/files/" + url.PathEscape(fileID) + "/thumbnail"
+	if size > 0 {
+		path += "?size=" + strconv.Itoa(size)
+	}
+	request, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(request, http.StatusOK)
+}
+
+// DownloadArchive implements downloadArchive; format is "zip" or "tar.gz".
+// The caller must close the returned body.
+func (c *Client) DownloadArchive(ctx context.Context, fileIDs []string, format string) (io.ReadCloser, error) {
+	query := url.Values{"ids": {strings.Join(fileIDs, ",")}}
+	if format != "" {
+		query.Set("format", format)
+	}
+	request, err := c.newRequest(ctx, "GET", "/download_archive?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(request, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// UploadRange implements uploadRange: it sends data as the piece of the file
+// starting at offset first. An empty data only queries the progress. It
+// returns the number of contiguous bytes the server has received and, once
+// the piece completed the upload, the stored file's metadata (nil for group
+// members that are only staged).
+func (c *Client) UploadRange(ctx context.Context, fileID string, first, total int64, data []byte) (int64, *FileMetadata, error) {
+	request, err := c.newRequest(ctx, "PUT", "/files/"+url.PathEscape(fileID), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) == 0 {
+		request.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	} else {
+		sum := sha256.Sum256(data)
+		request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, first+int64(len(data))-1, total))
+		request.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	resp, err := c.send(request, http.StatusOK, http.StatusAccepted, http.StatusPermanentRedirect)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPermanentRedirect:
+		var last int64 = -1
+		if received := resp.Header.Get("Range"); received != "" {
+			if _, err := fmt.Sscanf(received, "bytes=0-%d", &last); err != nil {
+				return 0, nil, fmt.Errorf("invalid Range header %q", received)
+			}
+		}
+		return last + 1, nil, nil
+	case http.StatusAccepted:
+		return total, nil, nil
+	}
+	var metadata FileMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return 0, nil, err
+	}
+	return total, &metadata, nil
+}
+
+// PatchRange is data written over a stored file at Offset by PatchFile.
+type PatchRange struct {
+	Offset int64
+	Data   []byte
+}
+
+// PatchFile implements patchFile: it writes the ranges over the stored file
+// and sets its size to size, or keeps it (unless a range extends the file)
+// when size is negative. Ranges must be in ascending order and must not
+// overlap; with no ranges, size truncates the file. A non-empty ifMatch is
+// the hash the stored file must still have.
+func (c *Client) PatchFile(ctx context.Context, fileID, ifMatch string, size int64, ranges ...PatchRange) (*FileMetadata, error) {
+	total := "*"
+	if size >= 0 {
+		total = strconv.FormatInt(size, 10)
+	}
+	contentRange := func(patch PatchRange) string {
+		return fmt.Sprintf("bytes %d-%d/%s", patch.Offset, patch.Offset+int64(len(patch.Data))-1, total)
+	}
+	var body bytes.Buffer
+	contentType, single := "application/octet-stream", ""
+	switch len(ranges) {
+	case 0:
+		single = "bytes */" + total
+	case 1:
+		body.Write(ranges[0].Data)
+		single = contentRange(ranges[0])
+	default:
+		parts := multipart.NewWriter(&body)
+		for _, patch := range ranges {
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {contentRange(patch)},
+			})
+			if err != nil {
+				return nil, err
+			}
+			part.Write(patch.Data)
+		}
+		parts.Close()
+		contentType = "multipart/byteranges; boundary=" + parts.Boundary()
+	}
+	request, err := c.newRequest(ctx, "PATCH", "/files/"+url.PathEscape(fileID), &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if single != "" {
+		request.Header.Set("Content-Range", single)
+	}
+	if ifMatch != "" {
+		request.Header.Set("If-Match", strconv.Quote(ifMatch))
+	}
+	var metadata FileMetadata
+	if err := c.do(request, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// AppendFile implements appendFile: data is added to the end of the stored
+// file. A non-negative offset is the size the stored file must have, so
+// that a retried append is not stored twice; otherwise the server answers
+// 409 with the size in the AppendDetails of the error.
+func (c *Client) AppendFile(ctx context.Context, fileID string, offset int64, data []byte) (*FileMetadata, error) {
+	request, err := c.newRequest(ctx, "POST", "/files/"+url.PathEscape(fileID)+"/append", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	if offset >= 0 {
+		request.Header.Set("Append-Offset", strconv.FormatInt(offset, 10))
+	}
+	var metadata FileMetadata
+	if err := c.do(request, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// DeltaUpload implements deltaUpload. delta must be encoded as described in
+// the OpenAPI document.
+func (c *Client) DeltaUpload(ctx context.Context, fileID string, fileSize int64, fileHash, baseHash string, blockSize int, delta io.Reader) (*FileMetadata, error) {
+	request, err := c.newRequest(ctx, "POST", "/delta_upload/"+url.PathEscape(fileID), delta)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("File-Hash", fileHash)
+	request.Header.Set("File-Size", strconv.FormatInt(fileSize, 10))
+	request.Header.Set("Base-Hash", baseHash)
+	request.Header.Set("Block-Size", strconv.Itoa(blockSize))
+	var metadata FileMetadata
+	if err := c.do(request, &metadata, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// RegisterGroup implements registerGroup.
+func (c *Client) RegisterGroup(ctx context.Context, registration GroupRegistration) (*UploadGroup, error) {
+	var group UploadGroup
+	if err := c.doJSON(ctx, "POST", "/register_group", registration, &group, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetGroup implements getGroup.
+func (c *Client) GetGroup(ctx context.Context, groupID string) (*UploadGroup, error) {
+	var group UploadGroup
+	if err := c.doJSON(ctx, "GET", "/groups/"+url.PathEscape(groupID), nil, &group, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetCompressionDictionary implements getCompressionDictionary: it returns
+// the zstd dictionary offered with a group.
+func (c *Client) GetCompressionDictionary(ctx context.Context, id uint32) ([]byte, error) {
+	request, err := c.newRequest(ctx, "GET", "/dictionaries/"+strconv.FormatUint(uint64(id), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(request, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// AbortGroup implements abortGroup.
+func (c *Client) AbortGroup(ctx context.Context, groupID string) (*UploadGroup, error) {
+	var group UploadGroup
+	if err := c.doJSON(ctx, "DELETE", "/groups/"+url.PathEscape(groupID), nil, &group, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// StartFetch implements startFetch.
+func (c *Client) StartFetch(ctx context.Context, request FetchRequest) (*FetchJob, error) {
+	var job FetchJob
+	if err := c.doJSON(ctx, "POST", "/fetch", request, &job, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetFetchJob implements getFetchJob.
+func (c *Client) GetFetchJob(ctx context.Context, jobID string) (*FetchJob, error) {
+	var job FetchJob
+	if err := c.doJSON(ctx, "GET", "/fetch/"+url.PathEscape(jobID), nil, &job, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelFetch implements cancelFetch.
+func (c *Client) CancelFetch(ctx context.Context, jobID string) (*FetchJob, error) {
+	var job FetchJob
+	if err := c.doJSON(ctx, "DELETE", "/fetch/"+url.PathEscape(jobID), nil, &job, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// AuditFilter selects the entries GetAuditLog returns; zero fields match
+// every entry. UserAgent matches entries whose User-Agent contains it, and
+// Limit 0 uses the server's default.
+type AuditFilter struct {
+	Action    string
+	FileID    string
+	Actor     string
+	UserAgent string
+	Since     time.Time
+	Limit     int
+}
+
+// GetAuditLog implements getAuditLog: the most recent matching entries,
+// oldest first. Like the other admin operations it needs the admin token.
+func (c *Client) GetAuditLog(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{"action": filter.Action, "fileId": filter.FileID, "actor": filter.Actor, "userAgent": filter.UserAgent} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339Nano))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var entries []AuditEntry
+	if err := c.doJSON(ctx, "GET", "/admin/audit?"+query.Encode(), nil, &entries, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListQuarantine implements listQuarantine; a non-empty fileID lists only
+// the chunks of that upload.
+func (c *Client) ListQuarantine(ctx context.Context, fileID string) ([]QuarantineRecord, error) {
+	path := "/admin/quarantine"
+	if fileID != "" {
+		path += "?fileId=" + url.QueryEscape(fileID)
+	}
+	var records []QuarantineRecord
+	if err := c.doJSON(ctx, "GET", path, nil, &records, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetQuarantineRecord implements getQuarantineRecord.
+func (c *Client) GetQuarantineRecord(ctx context.Context, id string) (*QuarantineRecord, error) {
+	var record QuarantineRecord
+	if err := c.doJSON(ctx, "GET", "/admin/quarantine/"+url.PathEscape(id), nil, &record, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// GetQuarantineData implements getQuarantineData, returning the rejected
+// chunk as received. The caller must close the returned body.
+func (c *Client) GetQuarantineData(ctx context.Context, id string) (io.ReadCloser, error) {
+	request, err := c.newRequest(ctx, "GET", "/admin/quarantine/"+url.PathEscape(id)+"/data", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(request, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteQuarantineRecord implements deleteQuarantineRecord.
+func (c *Client) DeleteQuarantineRecord(ctx context.Context, id string) error {
+	return c.doJSON(ctx, "DELETE", "/admin/quarantine/"+url.PathEscape(id), nil, nil, http.StatusNoContent)
+}
+
+// ListTrash implements listTrash.
+func (c *Client) ListTrash(ctx context.Context) ([]TrashedFile, error) {
+	var files []TrashedFile
+	if err := c.doJSON(ctx, "GET", "/admin/trash", nil, &files, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// PurgeTrashedFile implements purgeTrashedFile; the file can no longer be
+// restored.
+func (c *Client) PurgeTrashedFile(ctx context.Context, fileID string) error {
+	return c.doJSON(ctx, "DELETE", "/admin/trash/"+url.PathEscape(fileID), nil, nil, http.StatusNoContent)
+}
+
+// GetStorage implements getStorage.
+func (c *Client) GetStorage(ctx context.Context) (*StorageReport, error) {
+	var report StorageReport
+	if err := c.doJSON(ctx, "GET", "/admin/storage", nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetScrubStatus implements getScrubStatus.
+func (c *Client) GetScrubStatus(ctx context.Context) (*ScrubStatus, error) {
+	var status ScrubStatus
+	if err := c.doJSON(ctx, "GET", "/admin/scrub", nil, &status, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// CheckGarbage implements checkGarbage: what CollectGarbage would do, with
+// nothing changed.
+func (c *Client) CheckGarbage(ctx context.Context) (*GCReport, error) {
+	var report GCReport
+	if err := c.doJSON(ctx, "GET", "/admin/gc", nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CollectGarbage implements collectGarbage.
+func (c *Client) CollectGarbage(ctx context.Context) (*GCReport, error) {
+	var report GCReport
+	if err := c.doJSON(ctx, "POST", "/admin/gc", nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetKeyStatus implements getKeyStatus.
+func (c *Client) GetKeyStatus(ctx context.Context) (*KeyStatus, error) {
+	var status KeyStatus
+	if err := c.doJSON(ctx, "GET", "/admin/keys", nil, &status, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RotateKeys implements rotateKeys. The rotation runs in the background;
+// GetKeyStatus follows its progress.
+func (c *Client) RotateKeys(ctx context.Context) (*KeyRotationStatus, error) {
+	var status KeyRotationStatus
+	if err := c.doJSON(ctx, "POST", "/admin/keys/rotate", nil, &status, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GetUsage implements getUsage. from and to are YYYY-MM-DD days, "" for the
+// server's defaults, and a non-empty principal reports only that one.
+func (c *Client) GetUsage(ctx context.Context, from, to, principal string) (*UsageReport, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{"from": from, "to": to, "principal": principal} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	var report UsageReport
+	if err := c.doJSON(ctx, "GET", "/admin/usage?"+query.Encode(), nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ListDownloadLinks implements listDownloadLinks; a non-empty fileID lists
+// only the links to that file.
+func (c *Client) ListDownloadLinks(ctx context.Context, fileID string) ([]DownloadLink, error) {
+	path := "/admin/links"
+	if fileID != "" {
+		path += "?fileId=" + url.QueryEscape(fileID)
+	}
+	var links []DownloadLink
+	if err := c.doJSON(ctx, "GET", path, nil, &links, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// CreateDownloadLink implements createDownloadLink.
+func (c *Client) CreateDownloadLink(ctx context.Context, request LinkRequest) (*DownloadLink, error) {
+	var link DownloadLink
+	if err := c.doJSON(ctx, "POST", "/admin/links", request, &link, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// RevokeDownloadLink implements revokeDownloadLink.
+func (c *Client) RevokeDownloadLink(ctx context.Context, id string) error {
+	return c.doJSON(ctx, "DELETE", "/admin/links/"+url.PathEscape(id), nil, nil, http.StatusNoContent)
+}
+
+// ListRoles implements listRoles.
+func (c *Client) ListRoles(ctx context.Context) ([]RoleAssignment, error) {
+	var assignments []RoleAssignment
+	if err := c.doJSON(ctx, "GET", "/admin/roles", nil, &assignments, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+// AssignRole implements assignRole; role is "admin", "uploader", "reader" or
+// "none".
+func (c *Client) AssignRole(ctx context.Context, principal, role string) (*RoleAssignment, error) {
+	var assignment RoleAssignment
+	request := map[string]string{"role": role}
+	if err := c.doJSON(ctx, "PUT", "/admin/roles/"+url.PathEscape(principal), request, &assignment, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// RemoveRole implements removeRole; the roles file, or its "*" entry,
+// applies to the principal again.
+func (c *Client) RemoveRole(ctx context.Context, principal string) error {
+	return c.doJSON(ctx, "DELETE", "/admin/roles/"+url.PathEscape(principal), nil, nil, http.StatusNoContent)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err == nil && c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if err == nil && c.UserAgent != "" {
+		request.Header.Set("User-Agent", c.UserAgent)
+	}
+	return request, err
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out interface{}, expected ...int) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(request, out, expected...)
+}
+
+func (c *Client) do(request *http.Request, out interface{}, expected ...int) error {
+	resp, err := c.send(request, expected...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send performs the request and turns unexpected statuses into *Error.
+func (c *Client) send(request *http.Request, expected ...int) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	apiErr.RetryAfter, _ = strconv.Atoi(resp.Header.Get("Retry-After"))
+	if envelope, ok := DecodeError(body); ok {
+		apiErr.Code = envelope.Code
+		apiErr.Message = envelope.Message
+		apiErr.Retryable = envelope.Retryable
+		apiErr.Details = envelope.Details
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge || resp.StatusCode == http.StatusInsufficientStorage {
+		var hints LimitHints
+		if json.Unmarshal(apiErr.Details, &hints) == nil {
+			hints.Error = apiErr.Message
+			apiErr.Hints = &hints
+		}
+	}
+	return nil, apiErr
+}
@@ -0,0 +1,28 @@
+package apiclient
+
+// Error codes the server sends in ErrorResponse.Code. The full list is in
+// the ErrorResponse schema of server/openapi.json; these are the ones an
+// uploader usually acts on.
+const (
+	CodeChunkHashMismatch   = "CHUNK_HASH_MISMATCH"
+	CodeDigestMismatch      = "DIGEST_MISMATCH"
+	CodeChunkTruncated      = "CHUNK_TRUNCATED"
+	CodeFileHashMismatch    = "FILE_HASH_MISMATCH"
+	CodeFileTooLarge        = "FILE_TOO_LARGE"
+	CodeChunkTooLarge       = "CHUNK_TOO_LARGE"
+	CodeBodyTooLarge        = "BODY_TOO_LARGE"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	CodeTransferCapExceeded = "TRANSFER_CAP_EXCEEDED"
+	CodeTooManyRequests     = "TOO_MANY_REQUESTS"
+	CodeServerBusy          = "SERVER_BUSY"
+	CodeUploadNotFound      = "UPLOAD_NOT_FOUND"
+	CodeUploadCancelled     = "UPLOAD_CANCELLED"
+	CodeResumptionExpired   = "RESUMPTION_EXPIRED"
+	CodeDeadlineExceeded    = "DEADLINE_EXCEEDED"
+	CodeGroupClosed         = "GROUP_CLOSED"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeAccessDenied        = "ACCESS_DENIED"
+	CodeFileInUse           = "FILE_IN_USE"
+	CodeFetchFailed         = "FETCH_FAILED"
+	CodeConflict            = "CONFLICT"
+)
@@ -0,0 +1,186 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openAPISpec is the part of server/openapi.json the client is checked
+// against.
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPISchema struct {
+	Ref        string                     `json:"$ref"`
+	Properties map[string]json.RawMessage `json:"properties"`
+	AllOf      []openAPISchema            `json:"allOf"`
+}
+
+// implementsOperations matches the doc comments of methods, "X implements
+// <operationId>" or "X implements <operationId>, or <operationId> ...".
+var implementsOperations = regexp.MustCompile(`^\w+ implements (\w+)(?:, or (\w+))?`)
+
+// TestClientFollowsOpenAPI keeps the hand-written client in step with the
+// spec: every operation has a method saying it implements it, no method
+// names an operation the spec lacks, and every object schema has a type of
+// the same name whose JSON fields are exactly its properties.
+func TestClientFollowsOpenAPI(t *testing.T) {
+	data, err := ioutil.ReadFile("../server/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	operations := make(map[string]bool)
+	for _, item := range spec.Paths {
+		for _, raw := range item {
+			var operation struct {
+				OperationID string `json:"operationId"`
+			}
+			if json.Unmarshal(raw, &operation) == nil && operation.OperationID != "" {
+				operations[operation.OperationID] = true
+			}
+		}
+	}
+
+	fset := token.NewFileSet()
+	packages, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	implemented := make(map[string]bool)
+	types := make(map[string]ast.Expr)
+	for _, file := range packages["apiclient"].Files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				match := implementsOperations.FindStringSubmatch(decl.Doc.Text())
+				if decl.Recv == nil || match == nil {
+					continue
+				}
+				for _, name := range match[1:] {
+					if name != "" && !operations[name] {
+						t.Errorf("%s implements %s, which is not an operation of the spec", decl.Name.Name, name)
+					}
+					implemented[name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok {
+						types[spec.Name.Name] = spec.Type
+					}
+				}
+			}
+		}
+	}
+	for _, operation := range sortedKeys(operations) {
+		if !implemented[operation] {
+			t.Errorf("no method implements %s", operation)
+		}
+	}
+
+	schemaNames := make(map[string]bool)
+	for name := range spec.Components.Schemas {
+		schemaNames[name] = true
+	}
+	for _, name := range sortedKeys(schemaNames) {
+		want := schemaProperties(spec.Components.Schemas, spec.Components.Schemas[name])
+		if len(want) == 0 {
+			continue
+		}
+		if _, ok := types[name]; !ok {
+			t.Errorf("schema %s has no type", name)
+			continue
+		}
+		got := jsonFields(types, name)
+		for _, property := range sortedKeys(want) {
+			if !got[property] {
+				t.Errorf("type %s has no field for property %s", name, property)
+			}
+		}
+		for _, field := range sortedKeys(got) {
+			if !want[field] {
+				t.Errorf("type %s has field %s, which schema %s lacks", name, field, name)
+			}
+		}
+	}
+}
+
+// schemaProperties returns the properties of a schema, including those of
+// the schemas it is composed of with allOf.
+func schemaProperties(schemas map[string]openAPISchema, schema openAPISchema) map[string]bool {
+	if schema.Ref != "" {
+		return schemaProperties(schemas, schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")])
+	}
+	properties := make(map[string]bool)
+	for name := range schema.Properties {
+		properties[name] = true
+	}
+	for _, part := range schema.AllOf {
+		for name := range schemaProperties(schemas, part) {
+			properties[name] = true
+		}
+	}
+	return properties
+}
+
+// jsonFields returns the names a struct type has in JSON, including those
+// of the structs it embeds; fields tagged "-" have none.
+func jsonFields(types map[string]ast.Expr, name string) map[string]bool {
+	fields := make(map[string]bool)
+	structType, ok := types[name].(*ast.StructType)
+	if !ok {
+		return fields
+	}
+	for _, field := range structType.Fields.List {
+		tag := ""
+		if field.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+		}
+		jsonName := strings.Split(tag, ",")[0]
+		if len(field.Names) == 0 && jsonName == "" {
+			if embedded, ok := field.Type.(*ast.Ident); ok {
+				for name := range jsonFields(types, embedded.Name) {
+					fields[name] = true
+				}
+			}
+			continue
+		}
+		for _, fieldName := range field.Names {
+			switch {
+			case jsonName == "-":
+			case jsonName != "":
+				fields[jsonName] = true
+			case fieldName.IsExported():
+				fields[fieldName.Name] = true
+			}
+		}
+	}
+	return fields
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
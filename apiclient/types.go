@@ -0,0 +1,660 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types below mirror components/schemas in server/openapi.json.
+
+type FileInfo struct {
+	FileName  string `json:"fileName"`
+	FileSize  int64  `json:"fileSize"`
+	FileHash  string `json:"fileHash"`
+	ChunkSize int    `json:"chunkSize,omitempty"`
+	// ChunkHashes lists the hex SHA-256 of every chunk; it needs ChunkSize.
+	ChunkHashes []string          `json:"chunkHashes,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// HashAlgorithm is "sha256" (the default) or "sha256-tree", which needs
+	// HashSegmentSize.
+	HashAlgorithm   string `json:"hashAlgorithm,omitempty"`
+	HashSegmentSize int64  `json:"hashSegmentSize,omitempty"`
+	// Deadline is when the server aborts the upload if it is not complete
+	// by then; the server may set an earlier one.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Holes are the ranges of a sparse file that are holes; the server
+	// stores the chunks lying in them without receiving them.
+	Holes []FileHole `json:"holes,omitempty"`
+	// Attributes are restored on download and in tar.gz archives.
+	Attributes *FileAttributes `json:"attributes,omitempty"`
+}
+
+type FileHole struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+type FileAttributes struct {
+	ModTime *time.Time `json:"modTime,omitempty"`
+	// Mode holds the Unix permission bits, including setuid, setgid and
+	// sticky.
+	Mode  uint32 `json:"mode,omitempty"`
+	UID   *int   `json:"uid,omitempty"`
+	GID   *int   `json:"gid,omitempty"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Xattrs are the extended attributes by name, with base64 values.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+type FileMetadata struct {
+	ID          string            `json:"id"`
+	FileName    string            `json:"fileName"`
+	FileSize    int64             `json:"fileSize"`
+	FileHash    string            `json:"fileHash"`
+	ChunkSize   int               `json:"chunkSize"`
+	TotalChunks int               `json:"totalChunks"`
+	Encrypted   bool              `json:"encrypted,omitempty"`
+	GroupID     string            `json:"groupId,omitempty"`
+	FileMD5     string            `json:"fileMd5,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	ACL         []ACLEntry        `json:"acl,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+
+	HashAlgorithm   string `json:"hashAlgorithm,omitempty"`
+	HashSegmentSize int64  `json:"hashSegmentSize,omitempty"`
+
+	Integrity  *IntegrityStatus `json:"integrity,omitempty"`
+	Processing []ProcessingStep `json:"processing,omitempty"`
+	Media      *MediaInfo       `json:"media,omitempty"`
+	// Deadline is set on uploads in progress that the server aborts if
+	// they are not complete by then.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Client is the program that registered the file, from the User-Agent
+	// of the registration.
+	Client *ClientInfo `json:"client,omitempty"`
+	// Sparse files were registered with holes, which the server keeps as
+	// holes.
+	Sparse bool `json:"sparse,omitempty"`
+	// Attributes are those of the client's file, as far as it sent them.
+	Attributes *FileAttributes `json:"attributes,omitempty"`
+}
+
+type ClientInfo struct {
+	UserAgent string `json:"userAgent"`
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	OS        string `json:"os,omitempty"`
+}
+
+type IntegrityStatus struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Passed    bool      `json:"passed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type ProcessingStep struct {
+	Name       string            `json:"name"`
+	Processor  string            `json:"processor"`
+	Status     string            `json:"status"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Output     map[string]string `json:"output,omitempty"`
+}
+
+type MediaInfo struct {
+	Format      string  `json:"format,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Orientation int     `json:"orientation,omitempty"`
+	TakenAt     string  `json:"takenAt,omitempty"`
+	CameraMake  string  `json:"cameraMake,omitempty"`
+	CameraModel string  `json:"cameraModel,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	VideoCodec  string  `json:"videoCodec,omitempty"`
+	AudioCodec  string  `json:"audioCodec,omitempty"`
+}
+
+type SearchResult struct {
+	FileMetadata
+	Score float64 `json:"score"`
+}
+
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Results []SearchResult `json:"results"`
+}
+
+type Event struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	FileID   string    `json:"fileId,omitempty"`
+	FileName string    `json:"fileName,omitempty"`
+	GroupID  string    `json:"groupId,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+type Registration struct {
+	FileMetadata
+	ExistingChunks []int `json:"existingChunks,omitempty"`
+	// HoleChunks lie in holes of the file; they need not be uploaded
+	// either.
+	HoleChunks []int `json:"holeChunks,omitempty"`
+	// RecommendedChunkSize is the chunk size the server's policy picks for
+	// the file, from the rule described by ChunkSizeRule.
+	RecommendedChunkSize int    `json:"recommendedChunkSize"`
+	ChunkSizeRule        string `json:"chunkSizeRule"`
+	// ResumptionToken continues the upload through ResumeUpload, from any
+	// machine, until ResumptionExpiresAt.
+	ResumptionToken     string    `json:"resumptionToken"`
+	ResumptionExpiresAt time.Time `json:"resumptionExpiresAt"`
+}
+
+// ResumptionStatus lists the chunks the server has of the upload of a
+// resumption token; File is set instead once the upload is complete.
+type ResumptionStatus struct {
+	FileID         string        `json:"fileId"`
+	FileName       string        `json:"fileName"`
+	FileSize       int64         `json:"fileSize"`
+	FileHash       string        `json:"fileHash"`
+	ChunkSize      int           `json:"chunkSize"`
+	TotalChunks    int           `json:"totalChunks"`
+	ReceivedChunks []int         `json:"receivedChunks"`
+	Complete       bool          `json:"complete"`
+	File           *FileMetadata `json:"file,omitempty"`
+	ExpiresAt      time.Time     `json:"expiresAt"`
+}
+
+type ACLEntry struct {
+	Principal   string   `json:"principal"`
+	Permissions []string `json:"permissions"`
+}
+
+type FileACL struct {
+	Owner   string     `json:"owner,omitempty"`
+	Entries []ACLEntry `json:"entries"`
+}
+
+type ErrorResponse struct {
+	Code      string          `json:"code"`
+	Message   string          `json:"message"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Retryable bool            `json:"retryable"`
+}
+
+// Problem is the body of errors of version 2 of the API, RFC 9457 problem
+// details with the members of ErrorResponse; Detail is its Message.
+type Problem struct {
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Status    int             `json:"status"`
+	Detail    string          `json:"detail"`
+	Instance  string          `json:"instance,omitempty"`
+	Code      string          `json:"code"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Retryable bool            `json:"retryable"`
+}
+
+// DecodeError reads the body of an error response of either version of the
+// API, reporting false for bodies that are neither, such as those of
+// proxies.
+func DecodeError(body []byte) (ErrorResponse, bool) {
+	var decoded struct {
+		ErrorResponse
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(body, &decoded) != nil || decoded.Code == "" {
+		return ErrorResponse{}, false
+	}
+	if decoded.Message == "" {
+		decoded.Message = decoded.Detail
+	}
+	return decoded.ErrorResponse, true
+}
+
+// LimitHints are the details of 413 and 507 errors; Error repeats the
+// message of the ErrorResponse.
+type LimitHints struct {
+	Error              string `json:"-"`
+	MaxFileSize        int64  `json:"maxFileSize,omitempty"`
+	MaxChunkSize       int    `json:"maxChunkSize,omitempty"`
+	SuggestedChunkSize int    `json:"suggestedChunkSize,omitempty"`
+	MaxBodySize        int64  `json:"maxBodySize,omitempty"`
+	RequiredBytes      int64  `json:"requiredBytes,omitempty"`
+	AvailableBytes     int64  `json:"availableBytes,omitempty"`
+	RetryAfter         int    `json:"retryAfter,omitempty"`
+}
+
+// AppendDetails are the details of a 409 answering an append whose offset
+// is not the size of the stored file.
+type AppendDetails struct {
+	FileSize int64 `json:"fileSize"`
+}
+
+// TransferCapHints are the details of TRANSFER_CAP_EXCEEDED errors.
+type TransferCapHints struct {
+	MonthlyCapBytes  int64     `json:"monthlyCapBytes"`
+	MonthToDateBytes int64     `json:"monthToDateBytes"`
+	ResetsAt         time.Time `json:"resetsAt"`
+}
+
+// InUseDetails are the details of FILE_IN_USE errors.
+type InUseDetails struct {
+	ActiveDownloads int `json:"activeDownloads"`
+}
+
+type BlockChecksum struct {
+	Index  int64  `json:"index"`
+	Size   int    `json:"size"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type BlockList struct {
+	FileID    string          `json:"fileId"`
+	FileHash  string          `json:"fileHash"`
+	BlockSize int             `json:"blockSize"`
+	Blocks    []BlockChecksum `json:"blocks"`
+}
+
+type IntegrityReport struct {
+	FileID         string    `json:"fileId"`
+	FileName       string    `json:"fileName"`
+	HashAlgorithm  string    `json:"hashAlgorithm"`
+	ExpectedHash   string    `json:"expectedHash"`
+	ActualHash     string    `json:"actualHash,omitempty"`
+	ExpectedSize   int64     `json:"expectedSize"`
+	CheckedBytes   int64     `json:"checkedBytes"`
+	Passed         bool      `json:"passed"`
+	Error          string    `json:"error,omitempty"`
+	CheckedAt      time.Time `json:"checkedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+	Throughput     float64   `json:"throughputBytesPerSecond"`
+}
+
+type PeerAnnouncement struct {
+	URL    string `json:"url,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Pieces []int  `json:"pieces,omitempty"`
+}
+
+type PeerPiece struct {
+	Number int      `json:"number"`
+	Offset int64    `json:"offset"`
+	Size   int      `json:"size"`
+	Hash   string   `json:"hash"`
+	Peers  []string `json:"peers"`
+}
+
+type PeerSwarm struct {
+	FileID                  string      `json:"fileId"`
+	PeerURL                 string      `json:"peerUrl,omitempty"`
+	FileHash                string      `json:"fileHash"`
+	FileSize                int64       `json:"fileSize"`
+	PieceSize               int         `json:"pieceSize"`
+	PeerCount               int         `json:"peerCount"`
+	AnnounceIntervalSeconds float64     `json:"announceIntervalSeconds"`
+	Pieces                  []PeerPiece `json:"pieces"`
+}
+
+type ChunkManifest struct {
+	FileID        string          `json:"fileId"`
+	FileName      string          `json:"fileName"`
+	FileSize      int64           `json:"fileSize"`
+	FileHash      string          `json:"fileHash"`
+	HashAlgorithm string          `json:"hashAlgorithm"`
+	ChunkSize     int             `json:"chunkSize"`
+	ChunkCount    int             `json:"chunkCount"`
+	MerkleTree    string          `json:"merkleTree"`
+	MerkleRoot    string          `json:"merkleRoot"`
+	Chunks        []ManifestChunk `json:"chunks"`
+}
+
+type ManifestChunk struct {
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+type GroupRegistration struct {
+	Files          []FileInfo `json:"files"`
+	TimeoutSeconds int        `json:"timeoutSeconds,omitempty"`
+	Compression    string     `json:"compression,omitempty"`
+}
+
+type UploadGroup struct {
+	ID                    string                 `json:"id"`
+	FileIDs               []string               `json:"fileIds"`
+	ExpiresAt             time.Time              `json:"expiresAt"`
+	State                 string                 `json:"state"`
+	Reason                string                 `json:"reason,omitempty"`
+	Staged                int                    `json:"staged"`
+	Files                 []FileMetadata         `json:"files,omitempty"`
+	CompressionDictionary *CompressionDictionary `json:"compressionDictionary,omitempty"`
+}
+
+type CompressionDictionary struct {
+	ID        uint32    `json:"id"`
+	Owner     string    `json:"owner,omitempty"`
+	Samples   int       `json:"samples"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url"`
+}
+
+type CopyRequest struct {
+	FileName string `json:"fileName,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+}
+
+type FetchRequest struct {
+	URL       string            `json:"url"`
+	FileName  string            `json:"fileName,omitempty"`
+	FileHash  string            `json:"fileHash,omitempty"`
+	ChunkSize int               `json:"chunkSize,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+type FetchJob struct {
+	ID           string        `json:"id"`
+	URL          string        `json:"url"`
+	State        string        `json:"state"`
+	BytesFetched int64         `json:"bytesFetched"`
+	TotalBytes   int64         `json:"totalBytes,omitempty"`
+	StartedAt    time.Time     `json:"startedAt"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+	ErrorCode    string        `json:"errorCode,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	File         *FileMetadata `json:"file,omitempty"`
+}
+
+// ChunkReceipt acknowledges a stored chunk. Hash is the SHA-256 the server
+// computed over it, empty when the server defers chunk verification.
+type ChunkReceipt struct {
+	ChunkNumber    int    `json:"chunkNumber"`
+	Hash           string `json:"hash,omitempty"`
+	Size           int64  `json:"size"`
+	Verified       bool   `json:"verified"`
+	ChunksReceived int    `json:"chunksReceived"`
+	TotalChunks    int    `json:"totalChunks,omitempty"`
+}
+
+// UploadReport is returned when a completion commits a file.
+type UploadReport struct {
+	ID               string      `json:"id"`
+	FileName         string      `json:"fileName"`
+	Path             string      `json:"path"`
+	URL              string      `json:"url"`
+	TotalBytes       int64       `json:"totalBytes"`
+	ElapsedSeconds   float64     `json:"elapsedSeconds"`
+	Throughput       float64     `json:"throughputBytesPerSecond"`
+	Retransmits      map[int]int `json:"retransmits"`
+	TotalRetransmits int         `json:"totalRetransmits"`
+}
+
+// TarUpload lists the files stored from an archive by UploadTar, in archive
+// order, and the entries that were not stored.
+type TarUpload struct {
+	Files      []FileMetadata `json:"files"`
+	Skipped    []SkippedEntry `json:"skipped,omitempty"`
+	TotalBytes int64          `json:"totalBytes"`
+}
+
+// SkippedEntry is an archive entry UploadTar did not store.
+type SkippedEntry struct {
+	Name  string `json:"name"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// ProbeResult is the answer of Probe.
+type ProbeResult struct {
+	ClientTime       string    `json:"clientTime,omitempty"`
+	ServerTime       time.Time `json:"serverTime"`
+	ReceivedBytes    int64     `json:"receivedBytes"`
+	ReadSeconds      float64   `json:"readSeconds"`
+	MinChunkSize     int       `json:"minChunkSize"`
+	MaxChunkSize     int       `json:"maxChunkSize"`
+	SmallUploadLimit int64     `json:"smallUploadLimit"`
+	Compression      bool      `json:"compression"`
+}
+
+// Capabilities is the answer of GetCapabilities. MaxFileSize is 0 when
+// files of any size are accepted.
+type Capabilities struct {
+	APIVersions        []string `json:"apiVersions"`
+	HashAlgorithms     []string `json:"hashAlgorithms"`
+	MinHashSegmentSize int64    `json:"minHashSegmentSize"`
+	MaxHashSegmentSize int64    `json:"maxHashSegmentSize"`
+	DigestAlgorithms   []string `json:"digestAlgorithms"`
+	ChunkEncodings     []string `json:"chunkEncodings"`
+	ResponseEncodings  []string `json:"responseEncodings"`
+	MaxFileSize        int64    `json:"maxFileSize"`
+	MinChunkSize       int      `json:"minChunkSize"`
+	MaxChunkSize       int      `json:"maxChunkSize"`
+	SmallUploadLimit   int64    `json:"smallUploadLimit"`
+	MaxJSONBody        int64    `json:"maxJSONBody"`
+	AuthModes          []string `json:"authModes"`
+	Features           []string `json:"features"`
+}
+
+// UploadManifest is the body of CreateUpload: the registration of a file and
+// the hex SHA-256 of every chunk of ChunkSize bytes, in order.
+type UploadManifest struct {
+	FileInfo
+	Chunks []string `json:"chunks"`
+}
+
+// UploadSession is the state of an upload of version 2 of the API. Complete
+// uploads miss no chunks; their metadata is in File.
+type UploadSession struct {
+	ID                  string        `json:"id"`
+	FileName            string        `json:"fileName"`
+	FileSize            int64         `json:"fileSize"`
+	ChunkSize           int           `json:"chunkSize"`
+	TotalChunks         int           `json:"totalChunks"`
+	MissingChunks       []int         `json:"missingChunks"`
+	Complete            bool          `json:"complete"`
+	File                *FileMetadata `json:"file,omitempty"`
+	ResumptionToken     string        `json:"resumptionToken,omitempty"`
+	ResumptionExpiresAt *time.Time    `json:"resumptionExpiresAt,omitempty"`
+}
+
+// SessionToken is the answer of CreateSession and GetSession; Token is only
+// set when it is issued.
+type SessionToken struct {
+	Token     string    `json:"token,omitempty"`
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LoginRequest is the body of Login; the user name is checked against the
+// directory server.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginSession is the session of a login, also set as a cookie. Role is
+// "admin", "uploader", "reader" or "none".
+type LoginSession struct {
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RoleAssignment gives Principal its Role; Source is "store" for roles
+// assigned with AssignRole and "file" for those of the roles file.
+type RoleAssignment struct {
+	Principal string `json:"principal"`
+	Role      string `json:"role"`
+	Source    string `json:"source"`
+}
+
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	FileID    string    `json:"fileId,omitempty"`
+	FileName  string    `json:"fileName,omitempty"`
+	GroupID   string    `json:"groupId,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Chunks    int       `json:"chunks,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// QuarantineRecord describes a chunk that failed hash verification; its
+// bytes are available with GetQuarantineData when DataKept is set.
+type QuarantineRecord struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	FileID       string    `json:"fileId"`
+	ChunkNumber  int       `json:"chunkNumber"`
+	ExpectedHash string    `json:"expectedHash"`
+	ActualHash   string    `json:"actualHash,omitempty"`
+	Size         int64     `json:"size"`
+	ClientIP     string    `json:"clientIp,omitempty"`
+	Reason       string    `json:"reason"`
+	DataKept     bool      `json:"dataKept"`
+}
+
+// TrashedFile is a deleted file the server keeps until PurgeAt.
+type TrashedFile struct {
+	FileMetadata
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+type LinkRequest struct {
+	FileID           string `json:"fileId"`
+	ExpiresInSeconds int64  `json:"expiresInSeconds,omitempty"`
+	MaxDownloads     int    `json:"maxDownloads,omitempty"`
+}
+
+// DownloadLink is a signed link to a file; URL, relative to the server, is
+// what DownloadSharedFile fetches.
+type DownloadLink struct {
+	ID           string    `json:"id"`
+	FileID       string    `json:"fileId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	URL          string    `json:"url,omitempty"`
+}
+
+type StorageBackend struct {
+	Name           string `json:"name"`
+	Path           string `json:"path"`
+	UsedBytes      int64  `json:"usedBytes"`
+	TotalBytes     int64  `json:"totalBytes,omitempty"`
+	AvailableBytes int64  `json:"availableBytes,omitempty"`
+}
+
+type StorageReport struct {
+	Backends          []StorageBackend `json:"backends"`
+	MetadataStore     string           `json:"metadataStore"`
+	MinFreeBytes      int64            `json:"minFreeBytes"`
+	BelowWatermark    bool             `json:"belowWatermark"`
+	UploadsInProgress int              `json:"uploadsInProgress"`
+}
+
+type ScrubStatus struct {
+	Enabled            bool           `json:"enabled"`
+	IntervalSeconds    float64        `json:"intervalSeconds"`
+	RateBytesPerSecond int64          `json:"rateBytesPerSecond"`
+	Running            bool           `json:"running"`
+	CurrentFileID      string         `json:"currentFileId,omitempty"`
+	FilesChecked       int64          `json:"filesChecked"`
+	BytesChecked       int64          `json:"bytesChecked"`
+	FailuresDetected   int64          `json:"failuresDetected"`
+	LastCheckAt        *time.Time     `json:"lastCheckAt,omitempty"`
+	CorruptFiles       []FileMetadata `json:"corruptFiles"`
+}
+
+// GCIssue is something a garbage collection found. Repair is "delete",
+// "rename" (to RenameTo) or "" for issues that are only reported.
+type GCIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	FileID   string `json:"fileId,omitempty"`
+	Size     int64  `json:"size"`
+	Repair   string `json:"repair"`
+	RenameTo string `json:"renameTo,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+type GCReport struct {
+	DryRun           bool      `json:"dryRun"`
+	CheckedAt        time.Time `json:"checkedAt"`
+	Issues           []GCIssue `json:"issues"`
+	ReclaimableBytes int64     `json:"reclaimableBytes"`
+	FreedBytes       int64     `json:"freedBytes"`
+	SkippedRecent    int       `json:"skippedRecent"`
+}
+
+type KeyStatus struct {
+	Enabled      bool              `json:"enabled"`
+	CurrentKeyID string            `json:"currentKeyId"`
+	Keys         []MasterKeyUsage  `json:"keys"`
+	Rotation     KeyRotationStatus `json:"rotation"`
+}
+
+type MasterKeyUsage struct {
+	ID           string `json:"id"`
+	Current      bool   `json:"current,omitempty"`
+	Unknown      bool   `json:"unknown,omitempty"`
+	Files        int    `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	TrashedFiles int    `json:"trashedFiles"`
+}
+
+type KeyRotationStatus struct {
+	Running       bool       `json:"running"`
+	KeyID         string     `json:"keyId"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	CurrentFileID string     `json:"currentFileId,omitempty"`
+	Total         int        `json:"total"`
+	Rotated       int        `json:"rotated"`
+	Busy          int        `json:"busy"`
+	Failed        int        `json:"failed"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+// UsageDay is the traffic of a principal on Date, a YYYY-MM-DD day.
+type UsageDay struct {
+	Date         string `json:"date"`
+	IngressBytes int64  `json:"ingressBytes"`
+	EgressBytes  int64  `json:"egressBytes"`
+	Requests     int64  `json:"requests"`
+}
+
+type PrincipalUsage struct {
+	Principal        string     `json:"principal"`
+	IngressBytes     int64      `json:"ingressBytes"`
+	EgressBytes      int64      `json:"egressBytes"`
+	Requests         int64      `json:"requests"`
+	MonthToDateBytes int64      `json:"monthToDateBytes"`
+	MonthlyCapBytes  int64      `json:"monthlyCapBytes,omitempty"`
+	CapExceeded      bool       `json:"capExceeded"`
+	Days             []UsageDay `json:"days"`
+}
+
+type UsageReport struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Principals []PrincipalUsage `json:"principals"`
+}
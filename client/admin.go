@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// gcIssue and gcReport mirror the answer of /admin/gc.
+type gcIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	FileID   string `json:"fileId"`
+	Size     int64  `json:"size"`
+	Repair   string `json:"repair"`
+	RenameTo string `json:"renameTo"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error"`
+}
+
+type gcReport struct {
+	DryRun           bool      `json:"dryRun"`
+	Issues           []gcIssue `json:"issues"`
+	ReclaimableBytes int64     `json:"reclaimableBytes"`
+	FreedBytes       int64     `json:"freedBytes"`
+	SkippedRecent    int       `json:"skippedRecent"`
+}
+
+// runAdmin runs the admin commands, which need a profile with the server's
+// admin token.
+func runAdmin(args []string) {
+	if len(args) == 0 || args[0] != "gc" {
+		fmt.Println("Usage: send_file admin gc [-dry-run] <server_ip> <server_port>")
+		failUsage()
+	}
+	runGC(args[1:])
+}
+
+func runGC(args []string) {
+	flags := flag.NewFlagSet("admin gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what the server would delete or repair")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file admin gc [-dry-run] <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 0)
+	if len(args) != 2 {
+		flags.Usage()
+		failUsage()
+	}
+
+	report, err := collectServerGarbage(args[0], args[1], *dryRun)
+	if err != nil {
+		fail("Error collecting garbage", err)
+	}
+	failed := 0
+	for _, issue := range report.Issues {
+		action := issue.Repair
+		switch {
+		case action == "":
+			action = "report"
+		case issue.Error != "":
+			action += " failed: " + issue.Error
+			failed++
+		case issue.Repaired:
+			action += "d"
+		}
+		if issue.RenameTo != "" {
+			action += " to " + issue.RenameTo
+		}
+		fmt.Printf("%-16s %s (%d bytes): %s\n", issue.Kind, issue.Path, issue.Size, action)
+	}
+	if report.DryRun {
+		fmt.Printf("Dry run: %d issue(s), %d bytes to reclaim, %d recent entries skipped\n", len(report.Issues), report.ReclaimableBytes, report.SkippedRecent)
+		return
+	}
+	fmt.Printf("Garbage collected: %d issue(s), %d bytes freed, %d recent entries skipped\n", len(report.Issues), report.FreedBytes, report.SkippedRecent)
+	if failed > 0 {
+		failWith(exitCodeFailure, fmt.Sprintf("Error: %d repair(s) failed", failed))
+	}
+}
+
+// collectServerGarbage asks the server what its garbage collector finds,
+// and unless dryRun has it repair that.
+func collectServerGarbage(serverIP, serverPort string, dryRun bool) (*gcReport, error) {
+	method := "POST"
+	if dryRun {
+		method = "GET"
+	}
+	request, err := http.NewRequest(method, serverURL(serverIP, serverPort)+"/admin/gc", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var report gcReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
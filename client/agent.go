@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// agentJobRetention is how long the agent reports an upload after it
+	// finished.
+	agentJobRetention = time.Hour
+	// agentRetryDelay is how long an upload that failed waits before it is
+	// tried again, doubled with every further failure up to
+	// agentMaxRetryDelay.
+	agentRetryDelay    = 30 * time.Second
+	agentMaxRetryDelay = time.Hour
+)
+
+// chunkSent is told the size of every chunk the server acknowledges; the
+// agent counts them toward the progress of the upload in progress.
+var chunkSent = func(size int) {}
+
+// agentJob is an upload queued with the agent, as its control API reports
+// it and its queue file keeps it. State is queued, running, retrying (failed,
+// and tried again at NextAttemptAt), completed or failed.
+type agentJob struct {
+	ID            string     `json:"id"`
+	Path          string     `json:"path"`
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	BytesSent     int64      `json:"bytesSent"`
+	TotalBytes    int64      `json:"totalBytes"`
+	Attempts      int        `json:"attempts"`
+	QueuedAt      time.Time  `json:"queuedAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	FileID        string     `json:"fileId,omitempty"`
+	ErrorCode     string     `json:"errorCode,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// agentQueue is the queue file of the agent.
+type agentQueue struct {
+	NextID  int         `json:"nextId"`
+	Uploads []*agentJob `json:"uploads"`
+}
+
+// uploadAgent uploads the files queued through its control API one at a
+// time, in the order they were queued.
+type uploadAgent struct {
+	serverIP, serverPort string
+	// addressFromProfile takes the server address from the profile again
+	// whenever the config is reloaded.
+	addressFromProfile   bool
+	maxConcurrentUploads int
+	// maxAttempts fails an upload for good after this many attempts; 0
+	// retries it until it succeeds.
+	maxAttempts int
+	// queuePath is the file the queue is saved to on every change, empty
+	// to keep it in memory only.
+	queuePath string
+
+	mu      sync.Mutex
+	jobs    []*agentJob
+	nextID  int
+	running *agentJob
+	// reloadPending reloads the config before the next upload starts.
+	reloadPending bool
+	stopping      bool
+	wake          chan struct{}
+}
+
+func runAgent(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "address of the control API; anyone who can reach it can make the agent upload any file it can read")
+	socket := flags.String("socket", "", "serve the control API on this Unix socket, only accessible to the agent's user, instead of -listen")
+	queuePath := flags.String("queue", defaultAgentQueuePath(), "file keeping the queue, so that queued and retrying uploads survive restarts; empty keeps it in memory")
+	maxAttempts := flags.Int("max-attempts", 5, "attempts at an upload before it fails for good, 0 for no limit")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file agent [-listen <address> | -socket <path>] <server_ip> <server_port> [maxParallelUploads]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 0)
+	if len(args) != 2 && len(args) != 3 {
+		flags.Usage()
+		failUsage()
+	}
+	maxConcurrentUploads := 4
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 {
+			failWith(exitCodeUsage, "Error: Invalid number for max concurrent uploads")
+		}
+		maxConcurrentUploads = n
+	}
+
+	a := &uploadAgent{
+		serverIP:             args[0],
+		serverPort:           args[1],
+		addressFromProfile:   profile != nil,
+		maxConcurrentUploads: maxConcurrentUploads,
+		maxAttempts:          *maxAttempts,
+		queuePath:            *queuePath,
+		jobs:                 []*agentJob{},
+		wake:                 make(chan struct{}, 1),
+	}
+	if err := a.load(); err != nil {
+		fail("Error loading agent queue", err)
+	}
+	chunkSent = a.countSent
+
+	listener, err := listenControl(*listen, *socket)
+	if err != nil {
+		fail("Error starting control API", err)
+	}
+	server := &http.Server{Handler: a.handler()}
+	go server.Serve(listener)
+	fmt.Printf("Agent uploading to %s, control API on %s\n", serverURL(a.serverIP, a.serverPort), listener.Addr())
+
+	done := make(chan struct{})
+	go a.work(done)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				a.requestReload()
+				continue
+			}
+			if a.stop() {
+				failWith(exitCodeFailure, "Agent stopped during an upload")
+			}
+			server.Close()
+		}
+	}
+}
+
+func defaultAgentQueuePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fileupload", "agent-queue.json")
+}
+
+// load restores the queue saved by the previous run of the agent. Uploads
+// that were running when it stopped are queued again.
+func (a *uploadAgent) load() error {
+	if a.queuePath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.queuePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var queue agentQueue
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return fmt.Errorf("parsing %s: %w", a.queuePath, err)
+	}
+	a.nextID = queue.NextID
+	pending := 0
+	for _, job := range queue.Uploads {
+		switch job.State {
+		case "running":
+			job.State = "queued"
+			pending++
+		case "queued", "retrying":
+			pending++
+		}
+		a.jobs = append(a.jobs, job)
+	}
+	a.prune()
+	if pending > 0 {
+		fmt.Printf("Continuing %d queued upload(s) from %s\n", pending, a.queuePath)
+	}
+	return nil
+}
+
+// save writes the queue atomically; the caller holds a.mu. Failing to save
+// is only reported, as the uploads can go on regardless.
+func (a *uploadAgent) save() {
+	if a.queuePath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(agentQueue{NextID: a.nextID, Uploads: a.jobs}, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.queuePath), 0700)
+	}
+	if err == nil {
+		tmp := a.queuePath + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, a.queuePath)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error saving agent queue: %v\n", err)
+	}
+}
+
+// listenControl listens on the Unix socket if there is one, replacing a
+// socket left behind by an agent that did not stop cleanly.
+func listenControl(address, socket string) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// stop makes the agent exit once the upload in progress, if any, finished.
+// Uploads still queued stay in the queue file for the next start. A second
+// stop reports true, so that the agent exits right away.
+func (a *uploadAgent) stop() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopping {
+		return true
+	}
+	a.stopping = true
+	if a.running != nil {
+		fmt.Printf("Stopping after upload %s; stop again to exit right away\n", a.running.ID)
+	}
+	a.signal()
+	return false
+}
+
+func (a *uploadAgent) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *uploadAgent) work(done chan struct{}) {
+	defer close(done)
+	for {
+		job := a.next()
+		if job == nil {
+			return
+		}
+		a.run(job)
+	}
+}
+
+// next waits for the next upload that is queued or due to be retried and
+// marks it running, reloading the config first if that was asked for during
+// the previous upload. It returns nil once the agent stops.
+func (a *uploadAgent) next() *agentJob {
+	for {
+		a.mu.Lock()
+		if a.reloadPending {
+			a.reloadPending = false
+			a.reloadLocked()
+		}
+		if a.stopping {
+			pending := 0
+			for _, job := range a.jobs {
+				if job.State == "queued" || job.State == "retrying" {
+					pending++
+				}
+			}
+			a.mu.Unlock()
+			switch {
+			case pending == 0:
+			case a.queuePath != "":
+				fmt.Printf("Agent stopped, %d queued upload(s) continue when it starts again\n", pending)
+			default:
+				fmt.Printf("Agent stopped, dropping %d queued upload(s)\n", pending)
+			}
+			return nil
+		}
+		now := time.Now()
+		var retryAt *time.Time
+		for _, job := range a.jobs {
+			if job.State == "retrying" && job.NextAttemptAt.After(now) {
+				if retryAt == nil || job.NextAttemptAt.Before(*retryAt) {
+					retryAt = job.NextAttemptAt
+				}
+				continue
+			}
+			if job.State == "queued" || job.State == "retrying" {
+				job.State, job.StartedAt, job.NextAttemptAt = "running", &now, nil
+				job.Attempts++
+				job.BytesSent = 0
+				a.running = job
+				a.save()
+				a.mu.Unlock()
+				return job
+			}
+		}
+		a.mu.Unlock()
+		if retryAt == nil {
+			<-a.wake
+			continue
+		}
+		timer := time.NewTimer(time.Until(*retryAt))
+		select {
+		case <-a.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (a *uploadAgent) run(job *agentJob) {
+	a.mu.Lock()
+	serverIP, serverPort := a.serverIP, a.serverPort
+	a.mu.Unlock()
+	fmt.Printf("Uploading %s as %s (upload %s)\n", job.Path, job.Name, job.ID)
+	fileID, err := uploadFile(job.Path, job.Name, serverIP, serverPort, a.maxConcurrentUploads)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	defer a.save()
+	now := time.Now()
+	a.running = nil
+	if err != nil {
+		job.Error, job.ErrorCode = err.Error(), errorCode(err)
+		// A file that is gone will not come back by waiting.
+		if errors.Is(err, os.ErrNotExist) || a.maxAttempts > 0 && job.Attempts >= a.maxAttempts {
+			job.State, job.FinishedAt = "failed", &now
+			fmt.Printf("Upload %s of %s failed after %d attempt(s): %v\n", job.ID, job.Path, job.Attempts, err)
+			return
+		}
+		retryAt := now.Add(agentRetryBackoff(job.Attempts))
+		job.State, job.NextAttemptAt = "retrying", &retryAt
+		fmt.Printf("Upload %s of %s failed, retrying at %s: %v\n", job.ID, job.Path, retryAt.Format(time.RFC3339), err)
+		return
+	}
+	job.State, job.FileID, job.FinishedAt = "completed", fileID, &now
+	job.Error, job.ErrorCode = "", ""
+	fmt.Printf("Upload %s of %s completed as %s\n", job.ID, job.Path, fileID)
+}
+
+// agentRetryBackoff is the wait after the given number of failed attempts.
+func agentRetryBackoff(attempts int) time.Duration {
+	wait := agentRetryDelay
+	for i := 1; i < attempts && wait < agentMaxRetryDelay; i++ {
+		wait *= 2
+	}
+	if wait > agentMaxRetryDelay {
+		wait = agentMaxRetryDelay
+	}
+	return wait
+}
+
+func (a *uploadAgent) countSent(size int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running != nil {
+		a.running.BytesSent += int64(size)
+	}
+}
+
+// queue adds an upload of path, stored as name or the file's base name.
+func (a *uploadAgent) queue(path, name string) (*agentJob, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %q is not absolute", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if name == "" {
+		name = filepath.Base(path)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopping {
+		return nil, errors.New("agent is stopping")
+	}
+	a.prune()
+	a.nextID++
+	job := &agentJob{ID: strconv.Itoa(a.nextID), Path: path, Name: name, State: "queued", TotalBytes: info.Size(), QueuedAt: time.Now()}
+	a.jobs = append(a.jobs, job)
+	a.save()
+	a.signal()
+	fmt.Printf("Queued upload %s of %s\n", job.ID, path)
+	return job, nil
+}
+
+// prune forgets uploads that finished more than agentJobRetention ago; the
+// caller holds a.mu.
+func (a *uploadAgent) prune() {
+	kept := a.jobs[:0]
+	for _, job := range a.jobs {
+		if job.FinishedAt == nil || time.Since(*job.FinishedAt) < agentJobRetention {
+			kept = append(kept, job)
+		}
+	}
+	a.jobs = kept
+}
+
+// requestReload reloads the config right away while no upload is running,
+// and otherwise before the next upload starts, so that an upload never sees
+// two configs. It reports whether the config was reloaded now.
+func (a *uploadAgent) requestReload() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running != nil {
+		a.reloadPending = true
+		fmt.Printf("Reloading config after upload %s\n", a.running.ID)
+		return false, nil
+	}
+	return true, a.reloadLocked()
+}
+
+func (a *uploadAgent) reloadLocked() error {
+	if err := a.reload(); err != nil {
+		fmt.Printf("Error reloading config, keeping the previous one: %v\n", err)
+		return err
+	}
+	fmt.Printf("Reloaded config, uploading to %s\n", serverURL(a.serverIP, a.serverPort))
+	return nil
+}
+
+// reload reads the config file again and applies its profile, as well as
+// its chunk size and schedule where no flag overrides them, like the client
+// does when it starts. The previous settings stay if the config is invalid.
+func (a *uploadAgent) reload() error {
+	previousProfile, previousScheme := profile, serverScheme
+	previousTransport, previousTLS := http.DefaultTransport, defaultTransport.TLSClientConfig
+	previousChunkSize, previousSchedule := defaultChunkSize, transferSchedule
+	restore := func() {
+		profile, serverScheme = previousProfile, previousScheme
+		http.DefaultTransport, defaultTransport.TLSClientConfig = previousTransport, previousTLS
+		defaultChunkSize, transferSchedule = previousChunkSize, previousSchedule
+	}
+
+	profile, serverScheme = nil, "http"
+	http.DefaultTransport, defaultTransport.TLSClientConfig = defaultTransport, nil
+	if err := loadProfile(); err != nil {
+		restore()
+		return err
+	}
+	serverIP, serverPort := a.serverIP, a.serverPort
+	if a.addressFromProfile {
+		if profile == nil {
+			restore()
+			return fmt.Errorf("%s selects no profile any more", configPath)
+		}
+		serverIP, serverPort, _ = profileAddress(profile.Address)
+	}
+	if requestedChunkSize > 0 {
+		defaultChunkSize = requestedChunkSize
+	}
+	if !flagGiven("schedule") {
+		transferSchedule = nil
+		if profile != nil && profile.Schedule != "" {
+			schedule, err := parseSchedule(profile.Schedule)
+			if err != nil {
+				restore()
+				return fmt.Errorf("invalid schedule: %w", err)
+			}
+			transferSchedule = schedule
+		}
+	}
+	http.DefaultTransport = tracedTransport(userAgentTransport{agent: userAgent(), next: http.DefaultTransport})
+	// Connections made with the previous TLS settings are not reused.
+	defaultTransport.CloseIdleConnections()
+	a.serverIP, a.serverPort = serverIP, serverPort
+	return nil
+}
+
+// flagGiven reports whether a client flag was set on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// handler serves the control API:
+//
+//	POST /uploads {"path": ..., "name": ...}  queue an upload, 202 with the job
+//	GET  /uploads                             every upload, oldest first
+//	GET  /uploads/<id>                        one upload
+//	POST /reload                              reload the config file
+func (a *uploadAgent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			a.mu.Lock()
+			a.prune()
+			body, err := json.Marshal(a.jobs)
+			a.mu.Unlock()
+			writeAgentJSON(w, http.StatusOK, json.RawMessage(body), err)
+		case http.MethodPost:
+			var request struct {
+				Path string `json:"path"`
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil || request.Path == "" {
+				writeAgentError(w, http.StatusBadRequest, "INVALID_REQUEST", `Expected {"path": <absolute file path>, "name": <remote name, optional>}`)
+				return
+			}
+			job, err := a.queue(request.Path, request.Name)
+			if err != nil {
+				writeAgentError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return
+			}
+			a.writeJob(w, http.StatusAccepted, job)
+		default:
+			writeAgentError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Use GET or POST")
+		}
+	})
+	mux.HandleFunc("/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAgentError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Use GET")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+		a.mu.Lock()
+		var found *agentJob
+		for _, job := range a.jobs {
+			if job.ID == id {
+				found = job
+			}
+		}
+		a.mu.Unlock()
+		if found == nil {
+			writeAgentError(w, http.StatusNotFound, "UPLOAD_NOT_FOUND", "No upload "+id)
+			return
+		}
+		a.writeJob(w, http.StatusOK, found)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAgentError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Use POST")
+			return
+		}
+		reloaded, err := a.requestReload()
+		switch {
+		case err != nil:
+			writeAgentError(w, http.StatusInternalServerError, "RELOAD_FAILED", err.Error())
+		case !reloaded:
+			writeAgentJSON(w, http.StatusAccepted, map[string]string{"status": "pending"}, nil)
+		default:
+			a.mu.Lock()
+			server := serverURL(a.serverIP, a.serverPort)
+			a.mu.Unlock()
+			writeAgentJSON(w, http.StatusOK, map[string]string{"status": "reloaded", "server": server}, nil)
+		}
+	})
+	return mux
+}
+
+// writeJob writes a snapshot of job, which the worker updates under a.mu.
+func (a *uploadAgent) writeJob(w http.ResponseWriter, status int, job *agentJob) {
+	a.mu.Lock()
+	body, err := json.Marshal(job)
+	a.mu.Unlock()
+	writeAgentJSON(w, status, json.RawMessage(body), err)
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, value interface{}, err error) {
+	if err != nil {
+		writeAgentError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeAgentError answers like the server does, with a code and a message.
+func writeAgentError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAgentQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	queuePath := filepath.Join(dir, "queue", "agent-queue.json")
+	first := &uploadAgent{queuePath: queuePath, wake: make(chan struct{}, 1)}
+	var paths []string
+	for _, name := range []string{"a.log", "b.log", "c.log", "d.log", "e.log"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		if _, err := first.queue(path, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The agent stops with an upload running, one waiting to be retried,
+	// one queued and two finished, one of them long ago.
+	now := time.Now()
+	retryAt, finished, longAgo := now.Add(time.Minute), now.Add(-time.Minute), now.Add(-2*agentJobRetention)
+	first.mu.Lock()
+	first.jobs[0].State, first.jobs[0].Attempts, first.jobs[0].BytesSent, first.jobs[0].StartedAt = "running", 2, 1000, &now
+	first.jobs[1].State, first.jobs[1].Attempts, first.jobs[1].NextAttemptAt, first.jobs[1].ErrorCode = "retrying", 3, &retryAt, "SERVER_BUSY"
+	first.jobs[3].State, first.jobs[3].Attempts, first.jobs[3].FinishedAt, first.jobs[3].FileID = "completed", 1, &finished, "file-d"
+	first.jobs[4].State, first.jobs[4].Attempts, first.jobs[4].FinishedAt = "failed", 5, &longAgo
+	first.save()
+	first.mu.Unlock()
+
+	second := &uploadAgent{queuePath: queuePath, wake: make(chan struct{}, 1)}
+	if err := second.load(); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		id, state string
+		attempts  int
+	}{
+		{"1", "queued", 2},
+		{"2", "retrying", 3},
+		{"3", "queued", 0},
+		{"4", "completed", 1},
+	}
+	if len(second.jobs) != len(want) {
+		t.Fatalf("reloaded %d uploads, want %d", len(second.jobs), len(want))
+	}
+	for i, job := range second.jobs {
+		if job.ID != want[i].id || job.State != want[i].state || job.Attempts != want[i].attempts || job.Path != paths[i] {
+			t.Errorf("upload %d reloaded as %+v, want %+v", i, *job, want[i])
+		}
+	}
+	if job := second.jobs[1]; job.NextAttemptAt == nil || !job.NextAttemptAt.Equal(retryAt) || job.ErrorCode != "SERVER_BUSY" {
+		t.Errorf("retrying upload reloaded as %+v", *job)
+	}
+	if job := second.jobs[3]; job.FileID != "file-d" || job.FinishedAt == nil {
+		t.Errorf("completed upload reloaded as %+v", *job)
+	}
+
+	// The interrupted upload runs first and counts as another attempt; the
+	// one waiting to be retried keeps waiting.
+	if job := second.next(); job.ID != "1" || job.Attempts != 3 || job.BytesSent != 0 {
+		t.Errorf("next upload %+v", *job)
+	}
+	second.mu.Lock()
+	second.running.State = "completed"
+	second.running = nil
+	second.mu.Unlock()
+	if job := second.next(); job.ID != "3" || job.Attempts != 1 {
+		t.Errorf("next upload %+v", *job)
+	}
+	if job, err := second.queue(paths[2], "again.log"); err != nil || job.ID != "6" {
+		t.Errorf("queued after the reload: %+v, %v", job, err)
+	}
+}
+
+func TestAgentRetryBackoff(t *testing.T) {
+	if wait := agentRetryBackoff(1); wait != agentRetryDelay {
+		t.Errorf("after the first failure: %v, want %v", wait, agentRetryDelay)
+	}
+	if wait := agentRetryBackoff(2); wait != 2*agentRetryDelay {
+		t.Errorf("after the second failure: %v, want %v", wait, 2*agentRetryDelay)
+	}
+	previous := time.Duration(0)
+	for attempts := 0; attempts <= 200; attempts++ {
+		wait := agentRetryBackoff(attempts)
+		if wait < previous {
+			t.Errorf("after %d failures: %v, less than %v after one fewer", attempts, wait, previous)
+		}
+		if wait <= 0 || wait > agentMaxRetryDelay {
+			t.Errorf("after %d failures: %v, want at most %v", attempts, wait, agentMaxRetryDelay)
+		}
+		previous = wait
+	}
+	for _, attempts := range []int{200, 1 << 20, int(^uint(0) >> 1)} {
+		if wait := agentRetryBackoff(attempts); wait != agentMaxRetryDelay {
+			t.Errorf("after %d failures: %v, want the cap of %v", attempts, wait, agentMaxRetryDelay)
+		}
+	}
+}
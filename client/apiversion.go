@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// clientAPIVersions lists the versions of the upload protocol the client
+// speaks, oldest first.
+var clientAPIVersions = []string{"1", "2"}
+
+// requestedAPIVersion is the -api-version flag; "" picks the newest version
+// both the client and the server speak.
+var requestedAPIVersion string
+
+// apiVersion is the version of the upload protocol uploads use. Servers
+// without /capabilities speak version 1.
+var apiVersion = "1"
+
+// sessionRenewal is how long before it expires a session token is no longer
+// sent, so that requests fall back to the token of the profile rather than
+// fail in the middle of an upload.
+const sessionRenewal = time.Minute
+
+// negotiateAPIVersion picks the version of the upload protocol from those
+// the server speaks, failing when the version asked for with -api-version is
+// not one of them.
+func negotiateAPIVersion(serverVersions []string) error {
+	if requestedAPIVersion != "" {
+		if !hasString(clientAPIVersions, requestedAPIVersion) {
+			return fmt.Errorf("the client speaks API versions %s, not %s", listOrNone(clientAPIVersions), requestedAPIVersion)
+		}
+		if serverVersions != nil && !hasString(serverVersions, requestedAPIVersion) {
+			return fmt.Errorf("the server speaks API versions %s, not %s", listOrNone(serverVersions), requestedAPIVersion)
+		}
+		apiVersion = requestedAPIVersion
+		return nil
+	}
+	for _, version := range clientAPIVersions {
+		if hasString(serverVersions, version) {
+			apiVersion = version
+		}
+	}
+	return nil
+}
+
+// startAPISession trades the token of the profile for a session token of
+// version 2, which requests send in its place until shortly before it
+// expires. Without a profile token or on failure requests keep sending the
+// profile's.
+func startAPISession(serverIP, serverPort string) {
+	if apiVersion != "2" || profileTransport == nil {
+		return
+	}
+	session, err := apiclient.New(serverURL(serverIP, serverPort)).CreateSession(context.Background())
+	if err != nil {
+		fmt.Println("Error starting session, sending the profile's token instead:", err)
+		return
+	}
+	profileTransport.setSession(session.Token, session.ExpiresAt)
+	fmt.Printf("Started session as %s (%s) until %s\n", session.Principal, session.Role, session.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+// endAPISession revokes the session token of startAPISession, if any.
+func endAPISession(serverIP, serverPort string) {
+	if profileTransport == nil || !profileTransport.inSession() {
+		return
+	}
+	if err := apiclient.New(serverURL(serverIP, serverPort)).DeleteSession(context.Background()); err != nil {
+		fmt.Println("Error ending session:", err)
+	}
+	profileTransport.setSession("", time.Time{})
+}
+
+// sessionToken is the session token a tokenTransport sends instead of the
+// profile's token.
+type sessionToken struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (t *tokenTransport) setSession(token string, expiresAt time.Time) {
+	t.session.mu.Lock()
+	defer t.session.mu.Unlock()
+	t.session.token, t.session.expiresAt = token, expiresAt
+}
+
+func (t *tokenTransport) inSession() bool {
+	return t.bearer() != t.token
+}
+
+// bearer is the session token while it is valid for longer than
+// sessionRenewal, the profile's token otherwise.
+func (t *tokenTransport) bearer() string {
+	t.session.mu.Lock()
+	defer t.session.mu.Unlock()
+	if t.session.token != "" && time.Until(t.session.expiresAt) > sessionRenewal {
+		return t.session.token
+	}
+	return t.token
+}
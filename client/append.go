@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// appendPieceSize is the size of the pieces a local file is appended in
+// when no chunk size is requested; the server refuses appends larger than
+// its maximum chunk size.
+const appendPieceSize = 4 << 20
+
+// runAppend ships the bytes a local file has beyond the stored file to the
+// end of it, for logs that only grow. With -follow it keeps doing so as the
+// local file grows.
+func runAppend(args []string) {
+	flags := flag.NewFlagSet("append", flag.ExitOnError)
+	follow := flags.Bool("follow", false, "keep appending as the local file grows")
+	interval := flags.Duration("interval", time.Second, "how often -follow checks the local file")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file append [flags] <file_id> <local_file> <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 2)
+	if len(args) != 4 || *interval <= 0 {
+		flags.Usage()
+		failUsage()
+	}
+	pieceSize := appendPieceSize
+	if requestedChunkSize > 0 {
+		pieceSize = requestedChunkSize
+	}
+	client := apiclient.New(serverURL(args[2], args[3]))
+	metadata, err := client.GetFile(context.Background(), args[0])
+	if err != nil {
+		fail("Error reading file info", err)
+	}
+	size := metadata.FileSize
+	for {
+		if size, err = appendNewBytes(client, args[0], args[1], size, pieceSize); err != nil {
+			fail("Error appending to file", err)
+		}
+		if !*follow {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// appendNewBytes appends the bytes of the local file from offset on, in
+// pieces of at most pieceSize, and returns the size of the stored file. An
+// append refused because the stored file has another size resumes from it.
+func appendNewBytes(client *apiclient.Client, fileID, path string, offset int64, pieceSize int) (int64, error) {
+	file, err := openSource(path)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		return offset, fmt.Errorf("%s has %d bytes, fewer than the %d stored; was it truncated or rotated?", path, info.Size(), offset)
+	}
+	buffer := make([]byte, pieceSize)
+	for offset < info.Size() {
+		n, err := file.ReadAt(buffer, offset)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		metadata, err := client.AppendFile(context.Background(), fileID, offset, buffer[:n])
+		var apiErr *apiclient.Error
+		if errors.As(err, &apiErr) && apiErr.Code == apiclient.CodeConflict {
+			var details apiclient.AppendDetails
+			if json.Unmarshal(apiErr.Details, &details) == nil && details.FileSize <= info.Size() {
+				fmt.Printf("Stored file has %d bytes, resuming from there\n", details.FileSize)
+				offset = details.FileSize
+				continue
+			}
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset = metadata.FileSize
+		fmt.Printf("Appended %d bytes to %s: %d bytes, %s %s\n", n, metadata.ID, metadata.FileSize, hashName(metadata.HashAlgorithm), metadata.FileHash)
+	}
+	return offset, nil
+}
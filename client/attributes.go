@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// preserveOwner and preserveXattrs send the owner and the extended
+// attributes of uploaded files and restore them on download. The
+// modification time and mode are always sent and restored.
+var preserveOwner, preserveXattrs bool
+
+// maxXattrsSize is the most names and values of extended attributes the
+// server takes for one file.
+const maxXattrsSize = 64 * 1024
+
+// fileAttributes are the attributes of a file besides its content.
+type fileAttributes struct {
+	ModTime *time.Time `json:"modTime,omitempty"`
+	Mode    uint32     `json:"mode,omitempty"`
+	UID     *int       `json:"uid,omitempty"`
+	GID     *int       `json:"gid,omitempty"`
+	User    string     `json:"user,omitempty"`
+	Group   string     `json:"group,omitempty"`
+	// Xattrs are the extended attributes by name, with base64 values.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+// captureAttributes returns the attributes of the file at path to register
+// with it.
+func captureAttributes(path string, info os.FileInfo) *fileAttributes {
+	modTime := info.ModTime().UTC()
+	attributes := &fileAttributes{ModTime: &modTime, Mode: unixMode(info.Mode())}
+	if preserveOwner {
+		fileOwner(info, attributes)
+	}
+	if preserveXattrs {
+		xattrs, err := fileXattrs(path)
+		if err != nil {
+			fmt.Printf("Error reading extended attributes, sending none: %v\n", err)
+		}
+		attributes.Xattrs = encodeXattrs(xattrs)
+	}
+	return attributes
+}
+
+// encodeXattrs encodes the values of extended attributes, leaving out those
+// beyond what the server takes.
+func encodeXattrs(xattrs map[string][]byte) map[string]string {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	encoded := make(map[string]string, len(xattrs))
+	size := 0
+	for _, name := range names {
+		size += len(name) + len(xattrs[name])
+		if size > maxXattrsSize {
+			fmt.Printf("Extended attributes take more than %d bytes, leaving out %s and after\n", maxXattrsSize, name)
+			break
+		}
+		encoded[name] = base64.StdEncoding.EncodeToString(xattrs[name])
+	}
+	return encoded
+}
+
+// restoreAttributes gives a downloaded file the attributes it was uploaded
+// with. Failures are only reported, as the content is in place either way.
+func restoreAttributes(path string, attributes *fileAttributes) {
+	if attributes == nil {
+		return
+	}
+	// The owner goes first: changing it clears the setuid and setgid bits.
+	if preserveOwner && (attributes.UID != nil || attributes.GID != nil || attributes.User != "" || attributes.Group != "") {
+		if err := setOwner(path, attributes); err != nil {
+			fmt.Printf("Warning: could not restore the owner of %s: %v\n", path, err)
+		}
+	}
+	if attributes.Mode != 0 {
+		if err := os.Chmod(path, fileMode(attributes.Mode)); err != nil {
+			fmt.Printf("Warning: could not restore the mode of %s: %v\n", path, err)
+		}
+	}
+	if preserveXattrs {
+		for name, value := range attributes.Xattrs {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err == nil {
+				err = setXattr(path, name, decoded)
+			}
+			if err != nil {
+				fmt.Printf("Warning: could not restore extended attribute %s of %s: %v\n", name, path, err)
+			}
+		}
+	}
+	if attributes.ModTime != nil {
+		if err := os.Chtimes(path, time.Now(), *attributes.ModTime); err != nil {
+			fmt.Printf("Warning: could not restore the modification time of %s: %v\n", path, err)
+		}
+	}
+}
+
+// unixMode converts the permission bits of an os.FileMode to Unix ones.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fileMode converts Unix permission bits to an os.FileMode.
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
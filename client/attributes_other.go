@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// fileOwner leaves the owner out: Windows files have security descriptors
+// rather than a user and group id.
+func fileOwner(info os.FileInfo, attributes *fileAttributes) {}
+
+func setOwner(path string, attributes *fileAttributes) error {
+	return fmt.Errorf("owners cannot be restored on %s", runtime.GOOS)
+}
+
+func fileXattrs(path string) (map[string][]byte, error) {
+	return nil, fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
+
+func setXattr(path, name string, value []byte) error {
+	return fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,90 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner fills in the owner of the file by id and, where the ids have
+// them, by name.
+func fileOwner(info os.FileInfo, attributes *fileAttributes) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	uid, gid := int(stat.Uid), int(stat.Gid)
+	attributes.UID, attributes.GID = &uid, &gid
+	if owner, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		attributes.User = owner.Username
+	}
+	if group, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		attributes.Group = group.Name
+	}
+}
+
+// setOwner changes the owner of the file like tar does: to the user and
+// group of the same names where they exist, to the same ids otherwise.
+func setOwner(path string, attributes *fileAttributes) error {
+	uid, gid := -1, -1
+	if attributes.UID != nil {
+		uid = *attributes.UID
+	}
+	if attributes.GID != nil {
+		gid = *attributes.GID
+	}
+	if attributes.User != "" {
+		if owner, err := user.Lookup(attributes.User); err == nil {
+			uid, _ = strconv.Atoi(owner.Uid)
+		}
+	}
+	if attributes.Group != "" {
+		if group, err := user.LookupGroup(attributes.Group); err == nil {
+			gid, _ = strconv.Atoi(group.Gid)
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// fileXattrs reads the extended attributes of the file, none where the file
+// system has no support for them.
+func fileXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"fileUpload/apiclient"
+	"fileUpload/upload"
+)
+
+// benchResult collects the measurements of one bench run. Latencies are
+// recorded per request kind so that slow completions do not hide in the
+// chunk numbers.
+type benchResult struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	bytes     int64
+	files     int
+}
+
+func (b *benchResult) record(kind string, started time.Time, err error) {
+	elapsed := time.Since(started)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latencies[kind] = append(b.latencies[kind], elapsed)
+	if err != nil {
+		b.errors[kind]++
+	}
+}
+
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	files := flags.Int("files", 20, "number of synthetic files to upload")
+	size := flags.Int64("size", 8<<20, "size of every synthetic file in bytes")
+	concurrency := flags.Int("concurrency", 4, "files uploaded at the same time")
+	chunkParallel := flags.Int("chunk-parallel", 4, "chunks of one file sent at the same time")
+	chunkSize := flags.Int("chunk-size", defaultChunkSize, "requested chunk size in bytes, 0 lets the server choose")
+	keep := flags.Bool("keep", false, "keep the uploaded files instead of deleting them afterwards")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file bench [flags] <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 0)
+	if len(args) != 2 || *files < 1 || *size < 1 || *concurrency < 1 || *chunkParallel < 1 {
+		flags.Usage()
+		failUsage()
+	}
+
+	client := apiclient.New(serverURL(args[0], args[1]))
+	transport := baseTransport().Clone()
+	transport.MaxIdleConnsPerHost = *concurrency * *chunkParallel
+	client.HTTPClient = &http.Client{Transport: transport}
+	client.UserAgent = userAgent()
+	if profile != nil {
+		client.Token = profile.Token
+	}
+	result := &benchResult{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+
+	fmt.Printf("Uploading %d files of %d bytes, %d at a time with %d parallel chunks each\n", *files, *size, *concurrency, *chunkParallel)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var uploadedMu sync.Mutex
+	var uploaded []string
+	started := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				data := syntheticFile(int64(i), *size)
+				fileStarted := time.Now()
+				fileID, err := benchUpload(client, result, fmt.Sprintf("bench/file_%d.bin", i), data, *chunkSize, *chunkParallel)
+				result.record("file", fileStarted, err)
+				if err != nil {
+					fmt.Printf("File %d failed: %v\n", i, err)
+					continue
+				}
+				result.mu.Lock()
+				result.bytes += int64(len(data))
+				result.files++
+				result.mu.Unlock()
+				uploadedMu.Lock()
+				uploaded = append(uploaded, fileID)
+				uploadedMu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < *files; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	printBenchReport(result, elapsed)
+	if !*keep {
+		for _, fileID := range uploaded {
+			if err := client.DeleteFile(context.Background(), fileID); err != nil {
+				fmt.Printf("Error deleting %s: %v\n", fileID, err)
+			}
+		}
+	}
+	if result.files < *files {
+		failWith(exitCodeFailure, fmt.Sprintf("%d of %d files failed", *files-result.files, *files))
+	}
+}
+
+// syntheticFile returns reproducible pseudo-random content, so repeated runs
+// upload the same bytes without touching the local disk.
+func syntheticFile(seed, size int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func benchUpload(client *apiclient.Client, result *benchResult, name string, data []byte, chunkSize, chunkParallel int) (string, error) {
+	ctx := context.Background()
+	started := time.Now()
+	metadata, err := client.RegisterFile(ctx, apiclient.FileInfo{
+		FileName:  name,
+		FileSize:  int64(len(data)),
+		FileHash:  fmt.Sprintf("%x", sha256.Sum256(data)),
+		ChunkSize: chunkSize,
+	})
+	result.record("register", started, err)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := make(chan int)
+	var wg sync.WaitGroup
+	var firstErr error
+	var once sync.Once
+	for w := 0; w < chunkParallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range chunks {
+				offset, length := upload.ChunkRange(n, metadata.ChunkSize, int64(len(data)))
+				if err := benchChunk(client, result, metadata.ID, n, data[offset:offset+length]); err != nil {
+					once.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+	for n := 1; n <= metadata.TotalChunks; n++ {
+		chunks <- n
+	}
+	close(chunks)
+	wg.Wait()
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	started = time.Now()
+	_, _, err = client.CompleteUpload(ctx, metadata.ID)
+	result.record("complete", started, err)
+	return metadata.ID, err
+}
+
+// benchChunk sends one chunk, retrying when the server is busy. Every
+// attempt, including the rejected ones, counts towards the chunk latencies
+// and error rate.
+func benchChunk(client *apiclient.Client, result *benchResult, fileID string, chunkNumber int, data []byte) error {
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		_, err := client.UploadChunk(context.Background(), fileID, chunkNumber, data)
+		result.record("chunk", started, err)
+		var apiErr *apiclient.Error
+		if err == nil || attempt >= maxBusyRetries || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+		retryAfter := time.Duration(apiErr.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		time.Sleep(busyBackoff(attempt, retryAfter))
+	}
+}
+
+func printBenchReport(result *benchResult, elapsed time.Duration) {
+	fmt.Printf("\nUploaded %d files, %d bytes in %v\n", result.files, result.bytes, elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.2f MiB/s, %.2f files/s\n",
+		float64(result.bytes)/(1<<20)/elapsed.Seconds(), float64(result.files)/elapsed.Seconds())
+	fmt.Printf("\n%-10s %8s %8s %10s %10s %10s %10s\n", "request", "count", "errors", "p50", "p90", "p99", "max")
+	for _, kind := range []string{"register", "chunk", "complete", "file"} {
+		latencies := result.latencies[kind]
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("%-10s %8d %7.2f%% %10v %10v %10v %10v\n", kind, len(latencies),
+			100*float64(result.errors[kind])/float64(len(latencies)),
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+}
+
+// percentile uses the nearest-rank method on sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Microsecond)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+func runCancel(args []string) {
+	args = profileArgs(args, 1)
+	if len(args) != 3 {
+		fmt.Println("Usage: send_file cancel <file_id|file_path> <server_ip> <server_port>")
+		failUsage()
+	}
+	target, serverIP, serverPort := args[0], args[1], args[2]
+
+	// A file with saved progress (-resumable) is cancelled by the ID in its
+	// progress file, which is removed afterwards so the next run starts over.
+	fileID, statePath := target, ""
+	if data, err := ioutil.ReadFile(uploadStatePath(target)); err == nil {
+		var state uploadState
+		if err := json.Unmarshal(data, &state); err != nil {
+			fail("Error reading upload progress of "+target, err)
+		}
+		fileID, statePath = state.FileID, uploadStatePath(target)
+	}
+
+	if err := cancelUpload(serverIP, serverPort, fileID); err != nil {
+		fail("Error cancelling upload", err)
+	}
+	if statePath != "" {
+		os.Remove(statePath)
+	}
+	fmt.Printf("Upload %s cancelled\n", fileID)
+}
+
+func cancelUpload(serverIP, serverPort, fileID string) error {
+	request, err := http.NewRequest("DELETE", fmt.Sprintf("%s/upload/%s", serverURL(serverIP, serverPort), fileID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return readServerError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"fileUpload/apiclient"
+	"fileUpload/upload"
+)
+
+// runCapabilities prints what a server supports, as GET /capabilities
+// reports it.
+func runCapabilities(args []string) {
+	args = profileArgs(args, 0)
+	if len(args) != 2 {
+		fmt.Println("Usage: send_file capabilities <server_ip> <server_port>")
+		failUsage()
+	}
+	capabilities, err := apiclient.New(serverURL(args[0], args[1])).GetCapabilities(context.Background())
+	if err != nil {
+		fail("Error reading server capabilities", err)
+	}
+	maxFileSize := "no limit"
+	if capabilities.MaxFileSize > 0 {
+		maxFileSize = fmt.Sprintf("%d bytes", capabilities.MaxFileSize)
+	}
+	fmt.Printf("API versions: %s\n", listOrNone(capabilities.APIVersions))
+	fmt.Printf("Hash algorithms: %s (tree hash segments of %d to %d bytes)\n", listOrNone(capabilities.HashAlgorithms), capabilities.MinHashSegmentSize, capabilities.MaxHashSegmentSize)
+	fmt.Printf("Digest algorithms: %s\n", listOrNone(capabilities.DigestAlgorithms))
+	fmt.Printf("Chunk encodings: %s\n", listOrNone(capabilities.ChunkEncodings))
+	fmt.Printf("Response encodings: %s\n", listOrNone(capabilities.ResponseEncodings))
+	fmt.Printf("Max file size: %s\n", maxFileSize)
+	fmt.Printf("Chunk size: %d to %d bytes\n", capabilities.MinChunkSize, capabilities.MaxChunkSize)
+	fmt.Printf("Small upload limit: %d bytes\n", capabilities.SmallUploadLimit)
+	fmt.Printf("Auth modes: %s\n", listOrNone(capabilities.AuthModes))
+	fmt.Printf("Features: %s\n", listOrNone(capabilities.Features))
+}
+
+// negotiateCapabilities picks the version of the upload protocol and turns
+// off the options the server cannot serve before uploading, instead of
+// letting every upload find out on its own. Servers without /capabilities
+// are assumed to support the options.
+func negotiateCapabilities(serverIP, serverPort string) {
+	capabilities, err := apiclient.New(serverURL(serverIP, serverPort)).GetCapabilities(context.Background())
+	var serverVersions []string
+	if err == nil {
+		serverVersions = capabilities.APIVersions
+	}
+	if err := negotiateAPIVersion(serverVersions); err != nil {
+		failWith(exitCodeUsage, "Error: "+err.Error())
+	}
+	startAPISession(serverIP, serverPort)
+	if err != nil {
+		return
+	}
+	if capabilities.SmallUploadLimit < smallUploadLimit {
+		smallUploadLimit = capabilities.SmallUploadLimit
+	}
+	if treeHash && !hasString(capabilities.HashAlgorithms, upload.HashSHA256Tree) {
+		fmt.Println("Server does not accept tree hashes, hashing files with SHA-256")
+		treeHash = false
+	}
+	if compressChunks && !hasString(capabilities.ChunkEncodings, "zstd") {
+		fmt.Println("Server does not accept compressed chunks, sending them as they are")
+		compressChunks = false
+	}
+	if dedupUploads && !hasString(capabilities.Features, "dedup-chunks") {
+		fmt.Println("Server does not deduplicate chunks, sending all of them")
+		dedupUploads = false
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fileUpload/apiclient"
+	"fileUpload/upload"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type FileInfo struct {
+	FileName  string `json:"fileName"`
+	FileSize  int64  `json:"fileSize"`
+	FileHash  string `json:"fileHash"`
+	ChunkSize int    `json:"chunkSize,omitempty"`
+	// ChunkHashes is only sent with -dedup.
+	ChunkHashes     []string          `json:"chunkHashes,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	HashAlgorithm   string            `json:"hashAlgorithm,omitempty"`
+	HashSegmentSize int64             `json:"hashSegmentSize,omitempty"`
+	// Deadline is only sent with -timeout.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Holes are only sent for sparse files.
+	Holes []fileHole `json:"holes,omitempty"`
+	// Attributes always include the modification time and mode; the owner
+	// and extended attributes only with -preserve-owner and
+	// -preserve-xattrs.
+	Attributes *fileAttributes `json:"attributes,omitempty"`
+}
+
+type FileMetadata struct {
+	ID        string `json:"id"`
+	FileName  string `json:"fileName"`
+	FileSize  int64  `json:"fileSize"`
+	FileHash  string `json:"fileHash"`
+	ChunkSize int    `json:"chunkSize"`
+	// HashAlgorithm and HashSegmentSize tell how FileHash was computed;
+	// see fileHashAs.
+	HashAlgorithm   string `json:"hashAlgorithm,omitempty"`
+	HashSegmentSize int64  `json:"hashSegmentSize,omitempty"`
+	// Attributes are restored on download.
+	Attributes *fileAttributes `json:"attributes,omitempty"`
+}
+
+type RegistrationResponse struct {
+	ID          string `json:"id"`
+	ChunkSize   int    `json:"chunkSize"`
+	TotalChunks int    `json:"totalChunks"`
+	// ExistingChunks are chunks the server copied from files it stores.
+	ExistingChunks []int `json:"existingChunks"`
+	// HoleChunks are chunks in holes of the file, which the server stored
+	// without the client sending them.
+	HoleChunks []int `json:"holeChunks"`
+	// RecommendedChunkSize is what the server's chunk policy picks for the
+	// file, whatever chunk size was requested.
+	RecommendedChunkSize int    `json:"recommendedChunkSize"`
+	ChunkSizeRule        string `json:"chunkSizeRule"`
+	// ResumptionToken continues the upload with -resume-token until
+	// ResumptionExpiresAt.
+	ResumptionToken     string    `json:"resumptionToken"`
+	ResumptionExpiresAt time.Time `json:"resumptionExpiresAt"`
+}
+
+// contentMD5 makes every chunk carry Content-MD5 and Digest headers in
+// addition to Chunk-Hash, so proxies and generic tooling can verify payloads.
+var contentMD5 bool
+
+func main() {
+	flag.BoolVar(&contentMD5, "content-md5", false, "send Content-MD5 and Digest headers with every chunk")
+	flag.StringVar(&pauseFile, "pause-file", "", "pause sending chunks while this file exists")
+	flag.IntVar(&readAhead, "read-ahead", readAhead, "number of chunks read from disk ahead of those being sent")
+	flag.BoolVar(&treeHash, "tree-hash", false, "hash files in segments on every CPU core (sha256-tree) instead of with a single SHA-256")
+	flag.IntVar(&sendWindow, "window", 0, "send chunks through a sliding window of this many chunks in flight instead of <maxParallelUploads> independent uploads")
+	flag.Var(uploadTags, "tag", "tag uploaded files with key=value (repeatable)")
+	flag.BoolVar(&sparseUploads, "sparse", true, "register the holes of sparse files so that the chunks in them are not sent")
+	flag.BoolVar(&preserveOwner, "preserve-owner", false, "send the owner of uploaded files and restore it on download (as root)")
+	flag.BoolVar(&preserveXattrs, "preserve-xattrs", false, "send the extended attributes of uploaded files and restore them on download")
+	flag.BoolVar(&compressChunks, "compress", false, "compress the chunks of group uploads with zstd, using the compression dictionary the server trained for the account")
+	flag.Int64Var(&smallUploadLimit, "small-upload-limit", smallUploadLimit, "send files up to this many bytes whole in one request instead of registering them and sending chunks, if the server allows; 0 always uses chunks")
+	flag.BoolVar(&autoTune, "auto-tune", false, "probe the server's round trip time and throughput first and choose the chunk size, the parallel uploads (up to <maxParallelUploads>) and -compress from them")
+	flag.BoolVar(&dedupUploads, "dedup", false, "send chunk hashes at registration and skip the chunks the server already stores")
+	flag.StringVar(&requestedAPIVersion, "api-version", "", "version of the upload protocol to speak, 1 or 2; empty picks the newest the server speaks")
+	flag.BoolVar(&resumable, "resumable", false, "save upload progress in <file>.upload.json and continue from it when run again")
+	flag.StringVar(&resumeToken, "resume-token", "", "continue the upload of this resumption token, printed at registration, instead of registering the file again")
+	flag.BoolVar(&dryRun, "dry-run", false, "hash the file and print the registration and chunks an upload would send, without sending anything")
+	flag.StringVar(&verifyFileID, "verify", "", "compare the file with the stored file of this ID by size and hash instead of uploading it")
+	flag.IntVar(&requestedChunkSize, "chunk-size", 0, "requested chunk size in bytes, 0 uses the profile's or lets the server choose")
+	flag.StringVar(&scheduleSpec, "schedule", "", "bandwidth schedule, e.g. \"22:00-06:00=unlimited,*=1MB\"; overrides the profile's")
+	flag.BoolVar(&peerDownloads, "peers", false, "download fetches pieces from other clients seeding the file (servers with -peer-assist), checking each against the server's hash")
+	flag.StringVar(&peerURL, "peer-url", "", "URL other clients reach seed under; by default http://<address the server sees>:<listen port>")
+	flag.BoolVar(&jsonErrors, "json-errors", false, "print the error the client exits with as a JSON object on stderr; exit codes tell failure kinds apart either way")
+	flag.StringVar(&hashCachePath, "hash-cache", hashCachePath, "file caching the hashes of files of 1 MiB or more by path, size and modification time; empty disables the cache")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector URL, such as http://localhost:4318, upload spans are exported to and propagated to the server from; empty disables tracing")
+	flag.DurationVar(&lockedRetry, "retry-locked", 0, "keep trying to open a file another program holds locked for up to this long, e.g. 2m (Windows)")
+	flag.BoolVar(&backupSemantics, "backup-semantics", false, "open files with backup semantics and SeBackupPrivilege, reading them whatever their permissions if the account may back them up (Windows)")
+	flag.DurationVar(&runTimeout, "timeout", 0, "give up when the whole run takes longer, e.g. 30m; uploads are registered with the same deadline so the server removes what was sent, 0 for no limit")
+	showVersion := flag.Bool("version", false, "print the version and platform the client sends as its User-Agent, and exit")
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "client config file with server profiles")
+	flag.StringVar(&profileName, "profile", "", "server profile from the config file; its address replaces <server_ip> <server_port>")
+	flag.Usage = func() {
+		fmt.Println("Usage: send_file [flags] <file_path> <server_ip> <server_port> <maxParallelUploads>")
+		fmt.Println("       send_file -dry-run [flags] <file_path> [<server_ip> <server_port> <maxParallelUploads>]")
+		fmt.Println("       send_file -verify <file_id> [flags] <file_path> <server_ip> <server_port>")
+		fmt.Println("       send_file [flags] download|download-dir|seed|manifest|fetch|copy|move|delta|patch|append|sync|watch|group|bench|cancel|self-update|agent|admin ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if *showVersion {
+		fmt.Println(userAgent())
+		return
+	}
+	if err := loadProfile(); err != nil {
+		fail("Error loading profile", err)
+	}
+	http.DefaultTransport = userAgentTransport{agent: userAgent(), next: http.DefaultTransport}
+	if err := setupTracing(); err != nil {
+		fail("Error setting up tracing", err)
+	}
+	defer stopTracing()
+	startTimeout()
+	if requestedChunkSize > 0 {
+		defaultChunkSize = requestedChunkSize
+	}
+	if scheduleSpec == "" && profile != nil {
+		scheduleSpec = profile.Schedule
+	}
+	if scheduleSpec != "" {
+		schedule, err := parseSchedule(scheduleSpec)
+		if err != nil {
+			fail("Error: invalid schedule", err)
+		}
+		transferSchedule = schedule
+	}
+	handlePauseSignal()
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "download":
+			runDownload(args[1:])
+			return
+		case "download-dir":
+			runDownloadDir(args[1:])
+			return
+		case "upload-dir":
+			runUploadDir(args[1:])
+			return
+		case "probe":
+			runProbe(args[1:])
+			return
+		case "capabilities":
+			runCapabilities(args[1:])
+			return
+		case "admin":
+			runAdmin(args[1:])
+			return
+		case "seed":
+			runSeed(args[1:])
+			return
+		case "manifest":
+			runManifest(args[1:])
+			return
+		case "fetch":
+			runFetch(args[1:])
+			return
+		case "copy":
+			runCopy(args[1:])
+			return
+		case "move":
+			runMove(args[1:])
+			return
+		case "delta":
+			runDelta(args[1:])
+			return
+		case "patch":
+			runPatch(args[1:])
+			return
+		case "append":
+			runAppend(args[1:])
+			return
+		case "sync":
+			runSync(args[1:])
+			return
+		case "watch":
+			runWatch(args[1:])
+			return
+		case "group":
+			runGroup(args[1:])
+			return
+		case "bench":
+			runBench(args[1:])
+			return
+		case "cancel":
+			runCancel(args[1:])
+			return
+		case "self-update":
+			runSelfUpdate(args[1:])
+			return
+		case "agent":
+			runAgent(args[1:])
+			return
+		}
+	}
+	args = profileArgs(args, 1)
+	switch {
+	case verifyFileID != "" && len(args) == 3:
+		match, err := verifyFile(verifyFileID, args[0], args[1], args[2])
+		if err != nil {
+			fail("Error verifying file", err)
+		}
+		if !match {
+			failWith(exitCodeHashMismatch, "Local file differs from the stored file")
+		}
+		fmt.Println("Local file matches the stored file")
+		return
+	case dryRun && verifyFileID == "" && len(args) >= 1 && len(args) <= 4:
+		if err := runDryRun(args); err != nil {
+			fail("Error planning upload", err)
+		}
+		return
+	}
+	if len(args) != 4 || verifyFileID != "" {
+		flag.Usage()
+		failUsage()
+	}
+
+	filePath, serverIP, serverPort := args[0], args[1], args[2]
+	maxConcurrentUploads, err := strconv.Atoi(args[3])
+	if err != nil {
+		failWith(exitCodeUsage, "Error: Invalid number for max concurrent uploads")
+	}
+	negotiateCapabilities(serverIP, serverPort)
+	defer endAPISession(serverIP, serverPort)
+	maxConcurrentUploads = applyAutoTune(serverIP, serverPort, maxConcurrentUploads)
+	if _, err := uploadFile(filePath, filepath.Base(filePath), serverIP, serverPort, maxConcurrentUploads); err != nil {
+		fail("Error uploading file", err)
+	}
+}
+
+// uploadFile registers, sends and completes one file, storing it on the
+// server under remoteName, and returns the ID the server assigned.
+func uploadFile(filePath, remoteName, serverIP, serverPort string, maxConcurrentUploads int) (fileID string, err error) {
+	endSpan := startSpan("upload", attribute.String("file.name", remoteName))
+	defer func() { endSpan(err) }()
+	file, err := openSource(filePath)
+	if err != nil {
+		return "", fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("getting file info: %w", err)
+	}
+	if fileInfo.Size() == 0 {
+		return "", fmt.Errorf("file is empty")
+	}
+	if useSmallUpload(fileInfo.Size()) {
+		fileID, err := uploadSmallFile(file, filePath, remoteName, fileInfo, serverIP, serverPort)
+		if err != errSmallUploadRefused {
+			return fileID, err
+		}
+	}
+
+	algorithm, segmentSize := uploadHashMode()
+	endHash := startSpan("hash", attribute.Int64("file.size", fileInfo.Size()), attribute.String("hash.algorithm", hashName(algorithm)))
+	fileHash, err := fileHashAs(file, algorithm, segmentSize)
+	endHash(err)
+	if err != nil {
+		return "", fmt.Errorf("calculating file hash: %w", err)
+	}
+
+	fileMetadata := FileInfo{
+		FileName:        remoteName,
+		FileSize:        fileInfo.Size(),
+		FileHash:        fmt.Sprintf("%x", fileHash),
+		ChunkSize:       defaultChunkSize,
+		Tags:            uploadTags,
+		HashAlgorithm:   algorithm,
+		HashSegmentSize: segmentSize,
+		Deadline:        runDeadline(),
+		Holes:           sparseHoles(file, fileInfo.Size()),
+		Attributes:      captureAttributes(filePath, fileInfo),
+	}
+
+	var regResponse *RegistrationResponse
+	var state *uploadState
+	if resumable {
+		state = loadUploadState(filePath, remoteName, fileMetadata.FileSize, fileMetadata.FileHash)
+	}
+	if state != nil {
+		status, err := uploadSessionStatus(serverIP, serverPort, state.FileID, state.FileSize)
+		switch {
+		case err == nil && status == http.StatusOK:
+			fmt.Println("File was already uploaded")
+			state.remove()
+			return state.FileID, nil
+		case err == nil && status == http.StatusPermanentRedirect:
+			fmt.Printf("Resuming upload %s, %d chunks already sent\n", state.FileID, len(state.SentChunks))
+			regResponse = &RegistrationResponse{ID: state.FileID, ChunkSize: state.ChunkSize}
+		default:
+			fmt.Println("Saved upload is no longer known to the server, starting over")
+			state.remove()
+			state = nil
+		}
+	}
+
+	if regResponse == nil && resumeToken != "" {
+		resumed, received, done := resumeFromToken(serverIP, serverPort, fileMetadata)
+		if done {
+			fmt.Println("File was already uploaded")
+			return resumed.ID, nil
+		}
+		if resumed != nil {
+			regResponse = resumed
+			state = skipExistingChunks(state, received)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if regResponse == nil {
+			if dedupUploads {
+				if err := addChunkHashes(file, &fileMetadata); err != nil {
+					return "", fmt.Errorf("hashing chunks: %w", err)
+				}
+			}
+			endRegister := startSpan("register", attribute.Int("upload.chunk_size", fileMetadata.ChunkSize))
+			regResponse, err = registerFile(serverIP, serverPort, fileMetadata)
+			endRegister(err)
+			if err == nil && resumable {
+				state = newUploadState(filePath, regResponse.ID, remoteName, fileMetadata.FileSize, fileMetadata.FileHash, regResponse.ChunkSize)
+			}
+			if err == nil {
+				state = skipExistingChunks(state, regResponse.ExistingChunks)
+				state = skipHoleChunks(state, regResponse.HoleChunks)
+				if regResponse.RecommendedChunkSize != 0 && regResponse.RecommendedChunkSize != regResponse.ChunkSize {
+					fmt.Printf("Using %d byte chunks; the server recommends %d for this file (%s)\n",
+						regResponse.ChunkSize, regResponse.RecommendedChunkSize, regResponse.ChunkSizeRule)
+				}
+				if regResponse.ResumptionToken != "" {
+					fmt.Printf("Resumption token, valid until %s: %s\n", regResponse.ResumptionExpiresAt.Local().Format(time.RFC3339), regResponse.ResumptionToken)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error registering file: %v\n", err)
+		} else if err = sendChunksTraced(file, serverIP, serverPort, regResponse, maxConcurrentUploads, state); err != nil {
+			fmt.Printf("Error sending file chunks: %v\n", err)
+		} else {
+			break
+		}
+
+		chunkSize := fileMetadata.ChunkSize
+		if regResponse != nil {
+			chunkSize = regResponse.ChunkSize
+		}
+		newChunkSize, retry := adjustChunkSize(err, fileMetadata.FileSize, chunkSize)
+		if !retry || attempt >= maxLimitRetries {
+			printLimitGuidance(err, fileMetadata.FileSize)
+			if state != nil && state.path != "" {
+				fmt.Printf("Progress saved in %s; run the same command again to resume\n", state.path)
+			}
+			if regResponse != nil && regResponse.ResumptionToken != "" {
+				fmt.Println("Continue the upload from any machine with -resume-token", regResponse.ResumptionToken)
+			}
+			return "", err
+		}
+		fmt.Printf("Retrying upload with a chunk size of %d bytes\n", newChunkSize)
+		fileMetadata.ChunkSize = newChunkSize
+		regResponse = nil
+		state.remove()
+		state = nil
+	}
+
+	endComplete := startSpan("complete", attribute.String("upload.id", regResponse.ID))
+	err = completeUpload(serverIP, serverPort, regResponse.ID)
+	endComplete(err)
+	if err != nil {
+		return "", err
+	}
+	state.remove()
+	return regResponse.ID, nil
+}
+
+// sendChunksTraced sends the chunks of an upload in a span of their own,
+// which the request of every chunk is a child of.
+func sendChunksTraced(file *os.File, serverIP, serverPort string, registration *RegistrationResponse, maxConcurrentUploads int, state *uploadState) error {
+	endSpan := startSpan("send chunks", attribute.String("upload.id", registration.ID), attribute.Int("upload.chunk_size", registration.ChunkSize))
+	err := sendFileChunks(file, serverIP, serverPort, registration.ID, registration.ChunkSize, maxConcurrentUploads, state)
+	endSpan(err)
+	return err
+}
+
+func calculateHash(file *os.File) ([]byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return upload.Hash(file)
+}
+
+// treeHash makes uploads register a sha256-tree hash, whose segments are
+// hashed on every core at once; a single SHA-256 of a 50 GB file takes
+// minutes.
+var treeHash bool
+
+// uploadHashMode is the hash algorithm and segment size uploads register.
+func uploadHashMode() (string, int64) {
+	if treeHash {
+		return upload.HashSHA256Tree, upload.DefaultSegmentSize
+	}
+	return "", 0
+}
+
+// fileHashAs hashes file the way a stored file's hashAlgorithm says, so that
+// it can be compared with its fileHash. Hashes of large files come from the
+// hash cache while the file is unchanged.
+func fileHashAs(file *os.File, algorithm string, segmentSize int64) ([]byte, error) {
+	return cachedFileHash(file, algorithm, segmentSize)
+}
+
+func hashFileAs(file *os.File, algorithm string, segmentSize int64) ([]byte, error) {
+	switch algorithm {
+	case "", upload.HashSHA256:
+		return calculateHash(file)
+	case upload.HashSHA256Tree:
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return upload.TreeHash(file, info.Size(), segmentSize, 0)
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+}
+
+// hashName labels a hash algorithm in output, "" being plain SHA-256.
+func hashName(algorithm string) string {
+	if algorithm == "" {
+		return upload.HashSHA256
+	}
+	return algorithm
+}
+
+func registerFile(serverIP, serverPort string, metadata FileInfo) (*RegistrationResponse, error) {
+	if apiVersion == "2" && len(metadata.ChunkHashes) > 0 {
+		return registerManifest(serverIP, serverPort, metadata)
+	}
+	url := fmt.Sprintf("%s/register_file", serverURL(serverIP, serverPort))
+	if apiVersion == "2" {
+		url = fmt.Sprintf("%s/v2/register_file", serverURL(serverIP, serverPort))
+	}
+	jsonData, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+
+	var regResponse RegistrationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&regResponse); err != nil {
+		return nil, err
+	}
+
+	return &regResponse, nil
+}
+
+// registerManifest registers an upload of version 2 from the hashes of its
+// chunks, which the server checks every chunk against. The chunks the
+// server does not report missing are those it already stores.
+func registerManifest(serverIP, serverPort string, metadata FileInfo) (*RegistrationResponse, error) {
+	manifest := struct {
+		FileInfo
+		Chunks []string `json:"chunks"`
+	}{metadata, metadata.ChunkHashes}
+	manifest.ChunkHashes = nil
+	jsonData, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(serverURL(serverIP, serverPort)+"/v2/uploads", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, readServerError(resp)
+	}
+
+	var session apiclient.UploadSession
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, err
+	}
+	missing := make(map[int]bool, len(session.MissingChunks))
+	for _, chunkNumber := range session.MissingChunks {
+		missing[chunkNumber] = true
+	}
+	regResponse := &RegistrationResponse{ID: session.ID, ChunkSize: session.ChunkSize, TotalChunks: session.TotalChunks, ResumptionToken: session.ResumptionToken}
+	if session.ResumptionExpiresAt != nil {
+		regResponse.ResumptionExpiresAt = *session.ResumptionExpiresAt
+	}
+	for chunkNumber := 1; chunkNumber <= session.TotalChunks; chunkNumber++ {
+		if !missing[chunkNumber] {
+			regResponse.ExistingChunks = append(regResponse.ExistingChunks, chunkNumber)
+		}
+	}
+	return regResponse, nil
+}
+
+// sendFileChunks sends every chunk not yet marked as sent in state (which may
+// be nil), recording each acknowledged chunk there. With -window the chunks
+// go through the sliding window instead of maxConcurrentUploads goroutines.
+func sendFileChunks(file *os.File, serverIP, serverPort, fileID string, chunkSize, maxConcurrentUploads int, state *uploadState) error {
+	if sendWindow > 0 {
+		return sendWindowedChunks(file, serverIP, serverPort, fileID, chunkSize, state)
+	}
+	reader := startChunkReader(file, chunkSize, state)
+	defer reader.close()
+	var wg sync.WaitGroup
+	var errorOnce sync.Once
+	var sendErr error
+
+	for i := 0; i < maxConcurrentUploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range reader.chunks {
+				fmt.Printf("Preparing to send chunk %d (hash: %s)\n", chunk.number, chunk.hash)
+				waitWhilePaused()
+				err := sendChunk(serverIP, serverPort, fileID, chunk.number, chunk.data, chunk.hash)
+				chunk.release()
+				if err != nil {
+					errorOnce.Do(func() { sendErr = fmt.Errorf("error sending chunk %d: %w", chunk.number, err) })
+					reader.close()
+					return
+				}
+				state.markSent(chunk.number)
+			}
+		}()
+	}
+	wg.Wait()
+	if sendErr != nil {
+		return sendErr
+	}
+	return reader.err
+}
+
+// sendChunk uploads one chunk, waiting and retrying while the server reports
+// it is saturated with 429 Too Many Requests, and resending it a few times
+// when the server turns it away with another retryable error, such as
+// CHUNK_HASH_MISMATCH for a chunk damaged in transit. Errors that are not
+// retryable, such as QUOTA_EXCEEDED, end the upload.
+func sendChunk(serverIP, serverPort, fileID string, chunkNumber int, chunkData []byte, chunkHash string) error {
+	resends := 0
+	for attempt := 1; ; attempt++ {
+		err := sendChunkOnce(serverIP, serverPort, fileID, chunkNumber, chunkData, chunkHash)
+		if err == nil {
+			chunkSent(len(chunkData))
+			return nil
+		}
+		var busy *serverBusyError
+		if errors.As(err, &busy) {
+			if attempt >= maxBusyRetries {
+				return err
+			}
+			wait := busyBackoff(attempt, busy.retryAfter)
+			fmt.Printf("Server busy, retrying chunk %d in %s\n", chunkNumber, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+			continue
+		}
+		wait, resend := resendableChunkError(err)
+		if !resend || resends >= maxChunkResends {
+			return err
+		}
+		resends++
+		fmt.Printf("Chunk %d rejected with %s, sending it again\n", chunkNumber, errorCode(err))
+		time.Sleep(wait)
+	}
+}
+
+func sendChunkOnce(serverIP, serverPort, fileID string, chunkNumber int, chunkData []byte, chunkHash string) error {
+	method, url := "POST", fmt.Sprintf("%s/upload_chunk/%s/%d", serverURL(serverIP, serverPort), fileID, chunkNumber)
+	if apiVersion == "2" {
+		method, url = "PUT", fmt.Sprintf("%s/v2/uploads/%s/chunks/%d", serverURL(serverIP, serverPort), fileID, chunkNumber)
+	}
+	fmt.Printf("Preparing to send request to URL: %s\n", url)
+
+	// A compressed body carries Content-Digest and Content-MD5 of what is
+	// sent, and Repr-Digest and Digest of the chunk.
+	body, compressed := encodeChunk(chunkData)
+	request, err := http.NewRequest(method, url, throttle(bytes.NewReader(body)))
+	if err != nil {
+		fmt.Printf("Error creating request: %v\n", err)
+		return err
+	}
+	request.ContentLength = int64(len(body))
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Chunk-Hash", chunkHash)
+	shaSum := sha256.Sum256(chunkData)
+	bodySum := shaSum
+	if compressed {
+		request.Header.Set("Content-Encoding", "zstd")
+		request.Header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(shaSum[:])+":")
+		bodySum = sha256.Sum256(body)
+	}
+	request.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(bodySum[:])+":")
+	if contentMD5 {
+		md5Sum := md5.Sum(chunkData)
+		bodyMD5 := md5.Sum(body)
+		request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(bodyMD5[:]))
+		request.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(shaSum[:])+",MD5="+base64.StdEncoding.EncodeToString(md5Sum[:]))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(request)
+	if err != nil {
+		fmt.Printf("Error sending request: %v\n", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Request sent, response status: %s\n", resp.Status)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newServerBusyError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := readServerError(resp)
+		fmt.Printf("Server rejected chunk %d: %v\n", chunkNumber, err)
+		return err
+	}
+	return checkChunkReceipt(resp, chunkNumber, chunkHash)
+}
+
+// checkChunkReceipt compares the hash the server computed over a chunk with
+// the one sent. Servers that defer verification report no hash, and older
+// servers send no receipt at all.
+func checkChunkReceipt(resp *http.Response, chunkNumber int, chunkHash string) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	var receipt apiclient.ChunkReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		return fmt.Errorf("reading chunk receipt: %w", err)
+	}
+	if receipt.ChunkNumber != chunkNumber || (receipt.Hash != "" && receipt.Hash != chunkHash) {
+		return fmt.Errorf("server stored chunk %d with hash %s, sent chunk %d with hash %s", receipt.ChunkNumber, receipt.Hash, chunkNumber, chunkHash)
+	}
+	fmt.Printf("Chunk %d acknowledged, %d of %d chunks received\n", chunkNumber, receipt.ChunksReceived, receipt.TotalChunks)
+	return nil
+}
+
+func completeUpload(serverIP, serverPort, fileID string) error {
+	url := fmt.Sprintf("%s/complete_upload/%s", serverURL(serverIP, serverPort), fileID)
+	request, err := http.NewRequest("GET", url, nil)
+	if apiVersion == "2" {
+		request, err = http.NewRequest("POST", fmt.Sprintf("%s/v2/uploads/%s/complete", serverURL(serverIP, serverPort), fileID), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("completing upload: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("completing upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		fmt.Println("File staged, waiting for the rest of its upload group")
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("during upload completion: %w", readServerError(resp))
+	}
+	var report apiclient.UploadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("reading completion report: %w", err)
+	}
+	fmt.Println("File upload completed successfully")
+	fmt.Printf("Stored %d bytes in %.1fs (%.2f MiB/s), %d chunk retransmits, available at %s\n",
+		report.TotalBytes, report.ElapsedSeconds, report.Throughput/(1<<20), report.TotalRetransmits, report.URL)
+	return nil
+}
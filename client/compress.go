@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressChunks asks the server for a compression dictionary when
+// registering an upload group and sends the members' chunks compressed
+// with zstd, using the dictionary if the server has one.
+var compressChunks bool
+
+// CompressionDictionary mirrors the dictionary offered with a group.
+type CompressionDictionary struct {
+	ID      uint32 `json:"id"`
+	Samples int    `json:"samples"`
+	Size    int    `json:"size"`
+	URL     string `json:"url"`
+}
+
+var (
+	// chunkEncoder compresses chunks while a group is uploaded, nil
+	// otherwise.
+	chunkEncoder *zstd.Encoder
+	// chunkBytesIn and chunkBytesOut count the bytes of compressed chunks
+	// before and after compression.
+	chunkBytesIn, chunkBytesOut int64
+)
+
+// startChunkCompression prepares the encoder for the chunks of a group,
+// fetching the dictionary the server offered for it, if any.
+func startChunkCompression(serverIP, serverPort string, dictionary *CompressionDictionary) error {
+	var options []zstd.EOption
+	if dictionary != nil {
+		data, err := fetchDictionary(serverIP, serverPort, dictionary)
+		if err != nil {
+			return fmt.Errorf("fetching compression dictionary %d: %w", dictionary.ID, err)
+		}
+		options = append(options, zstd.WithEncoderDict(data))
+		fmt.Printf("Compressing chunks with dictionary %d trained from %d files\n", dictionary.ID, dictionary.Samples)
+	} else {
+		fmt.Println("Compressing chunks without a dictionary, the server has none for this account yet")
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return err
+	}
+	chunkEncoder = encoder
+	return nil
+}
+
+// stopChunkCompression reports how well the chunks compressed.
+func stopChunkCompression() {
+	if chunkEncoder == nil {
+		return
+	}
+	chunkEncoder.Close()
+	chunkEncoder = nil
+	in, out := atomic.LoadInt64(&chunkBytesIn), atomic.LoadInt64(&chunkBytesOut)
+	if in > 0 {
+		fmt.Printf("Sent %d bytes of chunks as %d bytes (%.1f%%)\n", in, out, 100*float64(out)/float64(in))
+	}
+}
+
+func fetchDictionary(serverIP, serverPort string, dictionary *CompressionDictionary) ([]byte, error) {
+	resp, err := http.Get(serverURL(serverIP, serverPort) + dictionary.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// encodeChunk compresses a chunk while a group is uploaded. Chunks that do
+// not get smaller are sent as they are.
+func encodeChunk(chunkData []byte) ([]byte, bool) {
+	encoder := chunkEncoder
+	if encoder == nil {
+		return chunkData, false
+	}
+	encoded := encoder.EncodeAll(chunkData, nil)
+	atomic.AddInt64(&chunkBytesIn, int64(len(chunkData)))
+	if len(encoded) >= len(chunkData) {
+		atomic.AddInt64(&chunkBytesOut, int64(len(chunkData)))
+		return chunkData, false
+	}
+	atomic.AddInt64(&chunkBytesOut, int64(len(encoded)))
+	return encoded, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"fileUpload/apiclient"
+)
+
+// runCopy has the server store a copy of a file under a new ID, without the
+// bytes passing through the client.
+func runCopy(args []string) {
+	fileID, client, request := parseCopyArgs("copy", args)
+	metadata, err := client.CopyFile(context.Background(), fileID, request)
+	if err != nil {
+		fail("Error copying file", err)
+	}
+	fmt.Printf("Copied %s to %s as %s\n", fileID, metadata.ID, metadata.FileName)
+}
+
+// runMove renames a stored file or hands it to another owner.
+func runMove(args []string) {
+	fileID, client, request := parseCopyArgs("move", args)
+	if request.FileName == "" && request.Owner == "" {
+		fmt.Println("move needs -name or -owner")
+		failUsage()
+	}
+	metadata, err := client.MoveFile(context.Background(), fileID, request)
+	if err != nil {
+		fail("Error moving file", err)
+	}
+	fmt.Printf("Moved %s to %s\n", metadata.ID, metadata.FileName)
+}
+
+func parseCopyArgs(command string, args []string) (string, *apiclient.Client, apiclient.CopyRequest) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	name := flags.String("name", "", "new file name (default: the current one)")
+	owner := flags.String("owner", "", "principal to give the file to")
+	flags.Usage = func() {
+		fmt.Printf("Usage: send_file %s [flags] <file_id> <server_ip> <server_port>\n", command)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 1)
+	if len(args) != 3 {
+		flags.Usage()
+		failUsage()
+	}
+	client := apiclient.New(serverURL(args[1], args[2]))
+	return args[0], client, apiclient.CopyRequest{FileName: *name, Owner: *owner}
+}
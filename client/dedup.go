@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dedupUploads lists the hash of every chunk at registration, so the server
+// can copy the chunks it already stores in other files and the client only
+// sends the rest.
+var dedupUploads bool
+
+// dedupChunkSize is requested for deduplicated uploads when no chunk size is
+// set: chunks of different files only match when they are cut the same way.
+const dedupChunkSize = 1 << 20
+
+// addChunkHashes fills in the chunk hashes of a registration.
+func addChunkHashes(file *os.File, metadata *FileInfo) error {
+	if metadata.ChunkSize == 0 {
+		metadata.ChunkSize = dedupChunkSize
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	metadata.ChunkHashes = nil
+	for remaining := metadata.FileSize; remaining > 0; remaining -= int64(metadata.ChunkSize) {
+		hash := sha256.New()
+		if _, err := io.CopyN(hash, file, int64(metadata.ChunkSize)); err != nil && err != io.EOF {
+			return err
+		}
+		metadata.ChunkHashes = append(metadata.ChunkHashes, fmt.Sprintf("%x", hash.Sum(nil)))
+	}
+	return nil
+}
+
+// skipExistingChunks marks the chunks the server already has as sent, in
+// state or, for uploads that are not resumable, in a state kept in memory.
+func skipExistingChunks(state *uploadState, existing []int) *uploadState {
+	if len(existing) == 0 {
+		return state
+	}
+	fmt.Printf("Server already has %d chunk(s), skipping them\n", len(existing))
+	return markChunksSent(state, existing)
+}
+
+// skipHoleChunks marks the chunks the server stored from the holes of the
+// file as sent, like skipExistingChunks.
+func skipHoleChunks(state *uploadState, holeChunks []int) *uploadState {
+	if len(holeChunks) == 0 {
+		return state
+	}
+	fmt.Printf("%d chunk(s) lie in holes of the file, skipping them\n", len(holeChunks))
+	return markChunksSent(state, holeChunks)
+}
+
+func markChunksSent(state *uploadState, chunks []int) *uploadState {
+	if state == nil {
+		state = &uploadState{sent: make(map[int]bool)}
+	}
+	for _, chunkNumber := range chunks {
+		state.markSent(chunkNumber)
+	}
+	return state
+}
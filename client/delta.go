@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+type BlockChecksum struct {
+	Index  int64  `json:"index"`
+	Size   int    `json:"size"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type BlockList struct {
+	FileID    string          `json:"fileId"`
+	FileHash  string          `json:"fileHash"`
+	BlockSize int             `json:"blockSize"`
+	Blocks    []BlockChecksum `json:"blocks"`
+}
+
+const (
+	deltaBlockSize      = 64 * 1024
+	maxDeltaLiteralSize = 1024 * 1024
+
+	deltaOpBlock   = 'B'
+	deltaOpLiteral = 'D'
+)
+
+func runDelta(args []string) {
+	args = profileArgs(args, 2)
+	if len(args) != 4 {
+		fmt.Println("Usage: send_file delta <file_path> <file_id> <server_ip> <server_port>")
+		failUsage()
+	}
+	filePath, fileID, serverIP, serverPort := args[0], args[1], args[2], args[3]
+	if err := deltaUploadFile(filePath, fileID, serverIP, serverPort); err != nil {
+		fail("Error sending delta", err)
+	}
+}
+
+// deltaUploadFile replaces the stored file fileID with the contents of
+// filePath, sending only the blocks that differ from the stored version.
+func deltaUploadFile(filePath, fileID, serverIP, serverPort string) error {
+	file, err := openSource(filePath)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+	fileHash, err := calculateHash(file)
+	if err != nil {
+		return fmt.Errorf("calculating file hash: %w", err)
+	}
+
+	blocks, err := fetchBlockList(serverIP, serverPort, fileID)
+	if err != nil {
+		return fmt.Errorf("fetching block checksums: %w", err)
+	}
+	if blocks.FileHash == fmt.Sprintf("%x", fileHash) {
+		fmt.Println("File is unchanged, nothing to upload")
+		return nil
+	}
+
+	if err := sendDelta(file, fileInfo.Size(), fmt.Sprintf("%x", fileHash), serverIP, serverPort, blocks); err != nil {
+		return err
+	}
+	fmt.Println("Delta upload completed successfully")
+	return nil
+}
+
+func fetchBlockList(serverIP, serverPort, fileID string) (*BlockList, error) {
+	url := fmt.Sprintf("%s/files/%s/blocks?blockSize=%d", serverURL(serverIP, serverPort), fileID, deltaBlockSize)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var blocks BlockList
+	if err := json.NewDecoder(resp.Body).Decode(&blocks); err != nil {
+		return nil, err
+	}
+	return &blocks, nil
+}
+
+func sendDelta(file *os.File, fileSize int64, fileHash, serverIP, serverPort string, blocks *BlockList) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	stats := &deltaStats{}
+	go func() {
+		writer.CloseWithError(computeDelta(bufio.NewReaderSize(file, 1024*1024), blocks, writer, stats))
+	}()
+
+	url := fmt.Sprintf("%s/delta_upload/%s", serverURL(serverIP, serverPort), blocks.FileID)
+	waitWhilePaused()
+	request, err := http.NewRequest("POST", url, throttle(reader))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("File-Hash", fileHash)
+	request.Header.Set("File-Size", strconv.FormatInt(fileSize, 10))
+	request.Header.Set("Base-Hash", blocks.FileHash)
+	request.Header.Set("Block-Size", strconv.Itoa(blocks.BlockSize))
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readServerError(resp)
+	}
+	fmt.Printf("Reused %d block(s), sent %d literal byte(s) of %d\n", stats.matchedBlocks, stats.literalBytes, fileSize)
+	return nil
+}
+
+type deltaStats struct {
+	matchedBlocks int
+	literalBytes  int64
+}
+
+// computeDelta scans src with a rolling checksum and writes a delta stream to
+// dst: every window matching a block of the server's version becomes a block
+// reference, everything else is sent as literal data.
+func computeDelta(src *bufio.Reader, blocks *BlockList, dst io.Writer, stats *deltaStats) error {
+	blockSize := blocks.BlockSize
+	byWeak := make(map[uint32][]BlockChecksum)
+	for _, block := range blocks.Blocks {
+		byWeak[block.Weak] = append(byWeak[block.Weak], block)
+	}
+
+	var literal []byte
+	flushLiteral := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		header := make([]byte, 5)
+		header[0] = deltaOpLiteral
+		binary.BigEndian.PutUint32(header[1:], uint32(len(literal)))
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+		if _, err := dst.Write(literal); err != nil {
+			return err
+		}
+		stats.literalBytes += int64(len(literal))
+		literal = literal[:0]
+		return nil
+	}
+	match := func(window []byte, weak uint32) (BlockChecksum, bool) {
+		candidates := byWeak[weak]
+		if len(candidates) == 0 {
+			return BlockChecksum{}, false
+		}
+		strong := fmt.Sprintf("%x", sha256.Sum256(window))
+		for _, block := range candidates {
+			if block.Size == len(window) && block.Strong == strong {
+				return block, true
+			}
+		}
+		return BlockChecksum{}, false
+	}
+
+	window := make([]byte, 0, 2*blockSize)
+	fill := func() error {
+		for len(window) < blockSize {
+			c, err := src.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			window = append(window, c)
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	weak := rollingChecksum{}
+	weak.init(window)
+	for len(window) == blockSize {
+		if block, ok := match(window, weak.sum()); ok {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			record := make([]byte, 9)
+			record[0] = deltaOpBlock
+			binary.BigEndian.PutUint64(record[1:], uint64(block.Index))
+			if _, err := dst.Write(record); err != nil {
+				return err
+			}
+			stats.matchedBlocks++
+			window = window[:0]
+			if err := fill(); err != nil {
+				return err
+			}
+			weak.init(window)
+			continue
+		}
+
+		next, err := src.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		literal = append(literal, window[0])
+		if len(literal) >= maxDeltaLiteralSize {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+		weak.roll(window[0], next)
+		window = append(window[1:], next)
+	}
+
+	// The tail can still match the (shorter) last block of the server's version.
+	if len(window) > 0 {
+		if block, ok := match(window, weakChecksum(window)); ok {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			record := make([]byte, 9)
+			record[0] = deltaOpBlock
+			binary.BigEndian.PutUint64(record[1:], uint64(block.Index))
+			if _, err := dst.Write(record); err != nil {
+				return err
+			}
+			stats.matchedBlocks++
+		} else {
+			literal = append(literal, window...)
+		}
+	}
+	return flushLiteral()
+}
+
+// rollingChecksum is the rsync weak checksum, updated one byte at a time.
+type rollingChecksum struct {
+	a, b, length uint32
+}
+
+func (r *rollingChecksum) init(window []byte) {
+	r.a, r.b, r.length = 0, 0, uint32(len(window))
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += (r.length - uint32(i)) * uint32(c)
+	}
+}
+
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.length*uint32(out) + r.a
+}
+
+func (r *rollingChecksum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+func weakChecksum(block []byte) uint32 {
+	var r rollingChecksum
+	r.init(block)
+	return r.sum()
+}
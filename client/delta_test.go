@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestRollingChecksum(t *testing.T) {
+	buffer := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(buffer)
+	// Runs of 0xff and 0x00 push the sums through their wrap-around.
+	for i := 1000; i < 2000; i++ {
+		buffer[i] = 0xff
+	}
+	for i := 3000; i < 3500; i++ {
+		buffer[i] = 0
+	}
+	for _, size := range []int{1, 2, 16, 1024, 4096} {
+		var r rollingChecksum
+		r.init(buffer[:size])
+		for start := 0; start+size <= len(buffer); start++ {
+			if start > 0 {
+				r.roll(buffer[start-1], buffer[start+size-1])
+			}
+			if got, want := r.sum(), weakChecksum(buffer[start:start+size]); got != want {
+				t.Fatalf("window of %d at %d: rolled %08x, want %08x", size, start, got, want)
+			}
+		}
+	}
+}
+
+// testBlockList lists the blocks of base as GET /files/{id}/blocks does.
+func testBlockList(base []byte, blockSize int) *BlockList {
+	list := &BlockList{BlockSize: blockSize}
+	for index := 0; index*blockSize < len(base); index++ {
+		block := base[index*blockSize:]
+		if len(block) > blockSize {
+			block = block[:blockSize]
+		}
+		list.Blocks = append(list.Blocks, BlockChecksum{
+			Index:  int64(index),
+			Size:   len(block),
+			Weak:   weakChecksum(block),
+			Strong: fmt.Sprintf("%x", sha256.Sum256(block)),
+		})
+	}
+	return list
+}
+
+// applyTestDelta rebuilds a file from base and a delta stream the way the
+// server does.
+func applyTestDelta(base []byte, blockSize int, delta []byte) ([]byte, error) {
+	var rebuilt []byte
+	stream := bytes.NewReader(delta)
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(stream, header[:1]); err == io.EOF {
+			return rebuilt, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch header[0] {
+		case deltaOpBlock:
+			if _, err := io.ReadFull(stream, header[1:9]); err != nil {
+				return nil, err
+			}
+			offset := int64(binary.BigEndian.Uint64(header[1:9])) * int64(blockSize)
+			if offset < 0 || offset >= int64(len(base)) {
+				return nil, fmt.Errorf("block at %d is out of range", offset)
+			}
+			end := offset + int64(blockSize)
+			if end > int64(len(base)) {
+				end = int64(len(base))
+			}
+			rebuilt = append(rebuilt, base[offset:end]...)
+		case deltaOpLiteral:
+			if _, err := io.ReadFull(stream, header[1:5]); err != nil {
+				return nil, err
+			}
+			length := binary.BigEndian.Uint32(header[1:5])
+			if length == 0 || length > maxDeltaLiteralSize {
+				return nil, fmt.Errorf("literal of %d bytes", length)
+			}
+			literal := make([]byte, length)
+			if _, err := io.ReadFull(stream, literal); err != nil {
+				return nil, err
+			}
+			rebuilt = append(rebuilt, literal...)
+		default:
+			return nil, fmt.Errorf("unknown delta record %q", header[0])
+		}
+	}
+}
+
+func TestComputeDelta(t *testing.T) {
+	const blockSize = 1024
+	rng := rand.New(rand.NewSource(2))
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		rng.Read(data)
+		return data
+	}
+	base := random(40*blockSize + 300)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	for _, test := range []struct {
+		name    string
+		edited  []byte
+		literal int
+	}{
+		{"unchanged", base, 0},
+		{"insert", join(base[:10*blockSize+17], random(500), base[10*blockSize+17:]), 500 + blockSize},
+		{"delete", join(base[:5*blockSize+100], base[7*blockSize+900:]), 2 * blockSize},
+		{"append", join(base, random(3000)), 3000 + blockSize},
+		{"prepend", join(random(77), base), 77},
+		{"overwrite", join(base[:20*blockSize], random(blockSize), base[21*blockSize:]), blockSize},
+		{"truncate", base[:30*blockSize+5], blockSize},
+		{"several edits", join(random(10), base[:3*blockSize], base[4*blockSize:25*blockSize], random(9000), base[25*blockSize:39*blockSize]), 10 + 9000 + 2*blockSize},
+		{"unrelated", random(6 * maxDeltaLiteralSize / 4), 6 * maxDeltaLiteralSize / 4},
+		{"empty", nil, 0},
+	} {
+		var delta bytes.Buffer
+		var stats deltaStats
+		if err := computeDelta(bufio.NewReader(bytes.NewReader(test.edited)), testBlockList(base, blockSize), &delta, &stats); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		rebuilt, err := applyTestDelta(base, blockSize, delta.Bytes())
+		if err != nil {
+			t.Errorf("%s: applying the delta: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(rebuilt, test.edited) {
+			t.Errorf("%s: rebuilt %d bytes that differ from the %d edited", test.name, len(rebuilt), len(test.edited))
+		}
+		// Only what changed, and the blocks it touched, is sent literally.
+		if stats.literalBytes > int64(test.literal) {
+			t.Errorf("%s: %d literal bytes, want at most %d", test.name, stats.literalBytes, test.literal)
+		}
+		if matched := int64(stats.matchedBlocks) * blockSize; matched+stats.literalBytes < int64(len(test.edited)) {
+			t.Errorf("%s: %d matched blocks and %d literal bytes do not cover %d bytes", test.name, stats.matchedBlocks, stats.literalBytes, len(test.edited))
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// downloadState is persisted next to the partial file so an interrupted
+// download can continue where it stopped instead of starting over.
+type downloadState struct {
+	FileID   string      `json:"fileId"`
+	FileSize int64       `json:"fileSize"`
+	FileHash string      `json:"fileHash"`
+	Ranges   []byteRange `json:"ranges"`
+}
+
+// byteRange is a half-open [Start, End) interval of bytes already on disk.
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+const downloadSaveInterval = 1024 * 1024
+
+func runDownload(args []string) {
+	args = profileArgs(args, 1)
+	if len(args) != 3 && len(args) != 4 {
+		fmt.Println("Usage: send_file download <file_id> <server_ip> <server_port> [output_path]")
+		failUsage()
+	}
+	fileID, serverIP, serverPort := args[0], args[1], args[2]
+
+	metadata, err := fetchFileMetadata(serverIP, serverPort, fileID)
+	if err != nil {
+		fail("Error fetching file metadata", err)
+	}
+
+	outputPath := filepath.Base(filepath.FromSlash(metadata.FileName))
+	if len(args) == 4 {
+		outputPath = args[3]
+	}
+
+	if err := downloadFile(serverIP, serverPort, metadata, outputPath); err != nil {
+		fail("Error downloading file", err)
+	}
+	fmt.Printf("File downloaded successfully to %s\n", outputPath)
+}
+
+func fetchFileMetadata(serverIP, serverPort, fileID string) (*FileMetadata, error) {
+	url := fmt.Sprintf("%s/files/%s", serverURL(serverIP, serverPort), fileID)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+
+	var metadata FileMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func downloadFile(serverIP, serverPort string, metadata *FileMetadata, outputPath string) error {
+	partPath := outputPath + ".part"
+	statePath := partPath + ".json"
+
+	state := loadDownloadState(statePath, metadata)
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if peerDownloads {
+		downloadFromPeers(serverIP, serverPort, metadata, file, state, statePath)
+	}
+	for _, gap := range missingRanges(state.Ranges, metadata.FileSize) {
+		fmt.Printf("Downloading bytes %d-%d\n", gap.Start, gap.End-1)
+		if err := downloadRange(serverIP, serverPort, metadata.ID, file, gap, state, statePath); err != nil {
+			return err
+		}
+	}
+
+	if err := file.Truncate(metadata.FileSize); err != nil {
+		return err
+	}
+	hash, err := fileHashAs(file, metadata.HashAlgorithm, metadata.HashSegmentSize)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", hash) != metadata.FileHash {
+		os.Remove(statePath)
+		return fmt.Errorf("downloaded file %w, partial data discarded", errHashMismatch)
+	}
+
+	file.Close()
+	if err := os.Rename(partPath, outputPath); err != nil {
+		return err
+	}
+	os.Remove(statePath)
+	restoreAttributes(outputPath, metadata.Attributes)
+	return nil
+}
+
+// loadDownloadState restores progress from a previous run. State left over
+// from a different file (or a different version of it) is discarded.
+func loadDownloadState(statePath string, metadata *FileMetadata) *downloadState {
+	fresh := &downloadState{FileID: metadata.ID, FileSize: metadata.FileSize, FileHash: metadata.FileHash}
+
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return fresh
+	}
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Printf("Ignoring unreadable download state: %v\n", err)
+		return fresh
+	}
+	if state.FileID != metadata.ID || state.FileSize != metadata.FileSize || state.FileHash != metadata.FileHash {
+		fmt.Println("Download state belongs to a different file, starting over")
+		return fresh
+	}
+	fmt.Printf("Resuming download, %d byte range(s) already present\n", len(state.Ranges))
+	return &state
+}
+
+func saveDownloadState(statePath string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, data, 0644)
+}
+
+func downloadRange(serverIP, serverPort, fileID string, file *os.File, gap byteRange, state *downloadState, statePath string) error {
+	url := fmt.Sprintf("%s/download/%s", serverURL(serverIP, serverPort), fileID)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", gap.Start, gap.End-1))
+	request.Header.Set("Want-Repr-Digest", "sha-256=10")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkReprDigest(resp, state.FileHash); err != nil {
+		return err
+	}
+
+	offset := gap.Start
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the Range header and is sending the whole file.
+		offset = 0
+		state.Ranges = nil
+	default:
+		return readServerError(resp)
+	}
+
+	buffer := make([]byte, 32*1024)
+	start, unsaved := offset, int64(0)
+	for {
+		n, readErr := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, err := file.WriteAt(buffer[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			unsaved += int64(n)
+			if unsaved >= downloadSaveInterval {
+				state.Ranges = addRange(state.Ranges, byteRange{start, offset})
+				if err := saveDownloadState(statePath, state); err != nil {
+					return err
+				}
+				unsaved = 0
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			state.Ranges = addRange(state.Ranges, byteRange{start, offset})
+			saveDownloadState(statePath, state)
+			return readErr
+		}
+	}
+
+	state.Ranges = addRange(state.Ranges, byteRange{start, offset})
+	return saveDownloadState(statePath, state)
+}
+
+// addRange inserts r into ranges, merging overlapping or adjacent intervals.
+func addRange(ranges []byteRange, r byteRange) []byteRange {
+	if r.End <= r.Start {
+		return ranges
+	}
+	ranges = append(ranges, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.End {
+			if next.End > last.End {
+				last.End = next.End
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// missingRanges returns the gaps in ranges (assumed sorted and merged) over
+// [0, size).
+func missingRanges(ranges []byteRange, size int64) []byteRange {
+	var gaps []byteRange
+	var pos int64
+	for _, r := range ranges {
+		if r.Start > pos {
+			gaps = append(gaps, byteRange{pos, r.Start})
+		}
+		if r.End > pos {
+			pos = r.End
+		}
+	}
+	if pos < size {
+		gaps = append(gaps, byteRange{pos, size})
+	}
+	return gaps
+}
+
+// checkReprDigest compares the RFC 9530 Repr-Digest of the response, when the
+// server sends one, with the hash from the file metadata. A mismatch means the
+// stored file changed since the download started.
+func checkReprDigest(resp *http.Response, fileHash string) error {
+	for _, member := range strings.Split(resp.Header.Get("Repr-Digest"), ",") {
+		alg, item, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || alg != "sha-256" || len(item) < 2 {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(strings.Trim(item, ":"))
+		if err != nil {
+			continue
+		}
+		if hex.EncodeToString(digest) != fileHash {
+			return fmt.Errorf("file changed on the server during download (Repr-Digest mismatch)")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runDownloadDir downloads every file stored under a directory prefix, such
+// as a directory uploaded with sync, recreating the tree under the output
+// directory.
+func runDownloadDir(args []string) {
+	args = profileArgs(args, 1)
+	if len(args) != 3 && len(args) != 4 {
+		fmt.Println("Usage: send_file download-dir <remote_prefix> <server_ip> <server_port> [output_dir]")
+		failUsage()
+	}
+	prefix, serverIP, serverPort := args[0], args[1], args[2]
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	outputDir := path.Base(prefix)
+	if len(args) == 4 {
+		outputDir = args[3]
+	}
+
+	if err := downloadDirectory(serverIP, serverPort, prefix, outputDir); err != nil {
+		fail("Error downloading directory", err)
+	}
+}
+
+// downloadDirectory downloads the newest copy of every file under prefix to
+// its path relative to prefix under outputDir. Files already there with the
+// stored content are skipped, so an interrupted run can be repeated.
+func downloadDirectory(serverIP, serverPort, prefix, outputDir string) error {
+	remoteFiles, err := listRemoteFiles(serverIP, serverPort, prefix)
+	if err != nil {
+		return fmt.Errorf("listing remote files: %w", err)
+	}
+	if len(remoteFiles) == 0 {
+		return fmt.Errorf("no files under %s", prefix)
+	}
+
+	// The listing is sorted by name and ID, so for names uploaded more than
+	// once the newest copy wins.
+	var names []string
+	newest := make(map[string]FileMetadata)
+	for _, metadata := range remoteFiles {
+		if _, ok := newest[metadata.FileName]; !ok {
+			names = append(names, metadata.FileName)
+		}
+		newest[metadata.FileName] = metadata
+	}
+
+	var downloaded, unchanged, failed int
+	for _, name := range names {
+		metadata := newest[name]
+		rel, ok := localPath(strings.TrimPrefix(name, prefix))
+		if !ok {
+			fmt.Printf("Skipping %s, which has no safe local path\n", name)
+			failed++
+			continue
+		}
+		outputPath := filepath.Join(outputDir, rel)
+		if info, err := os.Stat(outputPath); err == nil {
+			changed, err := fileDiffers(localFile{Path: outputPath, Size: info.Size()}, metadata)
+			if err == nil && !changed {
+				unchanged++
+				continue
+			}
+		}
+		fmt.Printf("download  %s\n", name)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			fmt.Printf("Error creating directory for %s: %v\n", outputPath, err)
+			failed++
+			continue
+		}
+		if err := downloadFile(serverIP, serverPort, &metadata, outputPath); err != nil {
+			fmt.Printf("Error downloading %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		downloaded++
+	}
+
+	fmt.Printf("Download finished: %d downloaded, %d unchanged, %d failed\n", downloaded, unchanged, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed to download", failed)
+	}
+	return nil
+}
+
+// localPath converts a relative remote name to a local path, refusing names
+// that would leave the output directory.
+func localPath(name string) (string, bool) {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(name) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(name, "\\") {
+		return "", false
+	}
+	local := filepath.FromSlash(clean)
+	return local, filepath.VolumeName(local) == ""
+}
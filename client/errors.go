@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// maxChunkResends bounds how often a chunk rejected with a retryable error,
+// such as CHUNK_HASH_MISMATCH after corruption in transit, is sent again.
+const maxChunkResends = 3
+
+// serverError is a non-success response. Code and Retryable come from the
+// server's JSON error body; responses without one, from a proxy or an older
+// server, keep the body as the message and have no code.
+type serverError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Retryable  bool
+	Details    json.RawMessage
+	RetryAfter int
+}
+
+func (e *serverError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("server returned status %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("server returned status %d", e.StatusCode)
+}
+
+// readServerError reads a non-success response into a *serverError, or a
+// *limitError for 413 and 507 responses.
+func readServerError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	serverErr := &serverError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	serverErr.RetryAfter, _ = strconv.Atoi(resp.Header.Get("Retry-After"))
+	if envelope, ok := apiclient.DecodeError(body); ok {
+		serverErr.Code = envelope.Code
+		serverErr.Message = envelope.Message
+		serverErr.Retryable = envelope.Retryable
+		serverErr.Details = envelope.Details
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge || resp.StatusCode == http.StatusInsufficientStorage {
+		return newLimitError(serverErr)
+	}
+	return serverErr
+}
+
+// errorCode returns the code of a server error wrapped in err, or "".
+func errorCode(err error) string {
+	var serverErr *serverError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	return ""
+}
+
+// resendableChunkError reports whether a chunk turned away with err is worth
+// sending again right away, and how long to wait first.
+func resendableChunkError(err error) (time.Duration, bool) {
+	var serverErr *serverError
+	if !errors.As(err, &serverErr) || !serverErr.Retryable {
+		return 0, false
+	}
+	return time.Duration(serverErr.RetryAfter) * time.Second, true
+}
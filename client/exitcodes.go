@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"fileUpload/apiclient"
+)
+
+// Exit codes of the client, so that scripts wrapping it can tell failures
+// apart without parsing its output.
+const (
+	exitCodeFailure      = 1 // anything below does not cover, such as a local I/O error
+	exitCodeUsage        = 2 // invalid arguments or flags, as with the flag package
+	exitCodeNetwork      = 3 // the server could not be reached or the connection broke
+	exitCodeAuth         = 4 // the server refused the credentials or the permission
+	exitCodeHashMismatch = 5 // data does not match the hash it should have
+	exitCodeQuota        = 6 // a quota, size limit or transfer cap was exceeded
+	exitCodeServer       = 7 // the server answered with any other error
+	exitCodeTimeout      = 8 // the run took longer than -timeout or the upload passed its deadline
+)
+
+// Kinds of failure, in the same order as the exit codes.
+var failureKinds = map[int]string{
+	exitCodeFailure:      "failure",
+	exitCodeUsage:        "usage",
+	exitCodeNetwork:      "network",
+	exitCodeAuth:         "auth",
+	exitCodeHashMismatch: "hash_mismatch",
+	exitCodeQuota:        "quota",
+	exitCodeServer:       "server",
+	exitCodeTimeout:      "timeout",
+}
+
+// jsonErrors prints the failure the client exits with as one JSON object on
+// stderr instead of a message on stdout.
+var jsonErrors bool
+
+// errHashMismatch is wrapped by errors about local data that does not match
+// its expected hash.
+var errHashMismatch = errors.New("hash mismatch")
+
+// clientFailure is what -json-errors prints. Status, Code, Retryable and
+// Details are those of the server's error response, when there is one.
+type clientFailure struct {
+	Kind      string          `json:"kind"`
+	ExitCode  int             `json:"exitCode"`
+	Message   string          `json:"message"`
+	Status    int             `json:"status,omitempty"`
+	Code      string          `json:"code,omitempty"`
+	Retryable bool            `json:"retryable,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+// fail reports err, prefixed with message, and exits with the code of its
+// kind.
+func fail(message string, err error) {
+	failure := clientFailure{ExitCode: exitCode(err), Message: fmt.Sprintf("%s: %v", message, err)}
+	if serverErr, ok := asServerError(err); ok {
+		failure.Status = serverErr.StatusCode
+		failure.Code = serverErr.Code
+		failure.Retryable = serverErr.Retryable
+		failure.Details = serverErr.Details
+	}
+	exit(failure)
+}
+
+// failWith reports message and exits with exitCode.
+func failWith(exitCode int, message string) {
+	exit(clientFailure{ExitCode: exitCode, Message: message})
+}
+
+// failUsage exits after the usage of a command was printed.
+func failUsage() {
+	if jsonErrors {
+		failWith(exitCodeUsage, "invalid arguments")
+	}
+	os.Exit(exitCodeUsage)
+}
+
+func exit(failure clientFailure) {
+	failure.Kind = failureKinds[failure.ExitCode]
+	if jsonErrors {
+		json.NewEncoder(os.Stderr).Encode(map[string]clientFailure{"error": failure})
+	} else {
+		fmt.Println(failure.Message)
+	}
+	stopTracing()
+	os.Exit(failure.ExitCode)
+}
+
+// exitCode is the exit code for failing with err.
+func exitCode(err error) int {
+	var busyErr *serverBusyError
+	var netErr net.Error
+	if errors.Is(err, errHashMismatch) {
+		return exitCodeHashMismatch
+	}
+	if serverErr, ok := asServerError(err); ok {
+		return serverErrorExitCode(serverErr)
+	}
+	switch {
+	case errors.As(err, &busyErr):
+		return exitCodeServer
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return exitCodeNetwork
+	}
+	return exitCodeFailure
+}
+
+// asServerError finds the server's error response in err, whether the
+// client read it itself or through apiclient.
+func asServerError(err error) (*serverError, bool) {
+	var serverErr *serverError
+	if errors.As(err, &serverErr) {
+		return serverErr, true
+	}
+	var apiErr *apiclient.Error
+	if errors.As(err, &apiErr) {
+		return &serverError{
+			StatusCode: apiErr.StatusCode,
+			Code:       apiErr.Code,
+			Message:    apiErr.Message,
+			Retryable:  apiErr.Retryable,
+			Details:    apiErr.Details,
+			RetryAfter: apiErr.RetryAfter,
+		}, true
+	}
+	return nil, false
+}
+
+func serverErrorExitCode(serverErr *serverError) int {
+	switch serverErr.Code {
+	case apiclient.CodeChunkHashMismatch, apiclient.CodeDigestMismatch, apiclient.CodeFileHashMismatch:
+		return exitCodeHashMismatch
+	case apiclient.CodeQuotaExceeded, apiclient.CodeTransferCapExceeded, apiclient.CodeFileTooLarge, apiclient.CodeChunkTooLarge:
+		return exitCodeQuota
+	case apiclient.CodeUnauthorized, apiclient.CodeAccessDenied:
+		return exitCodeAuth
+	case apiclient.CodeDeadlineExceeded:
+		return exitCodeTimeout
+	}
+	switch serverErr.StatusCode {
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return exitCodeQuota
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitCodeAuth
+	}
+	return exitCodeServer
+}
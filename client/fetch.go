@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// fetchPollInterval is how often fetch asks the server for the progress of
+// its job.
+const fetchPollInterval = time.Second
+
+// runFetch has the server download a URL itself and store it, printing the
+// job's progress until it is done. Ctrl+C cancels the job.
+func runFetch(args []string) {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	name := flags.String("name", "", "name to store the file under (default: the last segment of the URL's path)")
+	hash := flags.String("hash", "", "SHA-256 the fetched content must have")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file fetch [flags] <url> <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 1)
+	if len(args) != 3 {
+		flags.Usage()
+		failUsage()
+	}
+
+	client := apiclient.New(serverURL(args[1], args[2]))
+	request := apiclient.FetchRequest{URL: args[0], FileName: *name, FileHash: *hash, ChunkSize: requestedChunkSize, Tags: uploadTags}
+	job, err := client.StartFetch(context.Background(), request)
+	if err != nil {
+		fail("Error starting fetch", err)
+	}
+	fmt.Printf("Server is fetching %s as job %s\n", job.URL, job.ID)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for job.State == "running" {
+		select {
+		case <-interrupt:
+			if _, err := client.CancelFetch(context.Background(), job.ID); err != nil {
+				fail("Error cancelling fetch", err)
+			}
+			failWith(exitCodeFailure, "Fetch cancelled")
+		case <-time.After(fetchPollInterval):
+		}
+		job, err = client.GetFetchJob(context.Background(), job.ID)
+		if err != nil {
+			fail("Error getting fetch progress", err)
+		}
+		if job.TotalBytes > 0 {
+			fmt.Printf("Fetched %d of %d bytes\n", job.BytesFetched, job.TotalBytes)
+		} else {
+			fmt.Printf("Fetched %d bytes\n", job.BytesFetched)
+		}
+	}
+
+	if job.State != "completed" || job.File == nil {
+		exit(clientFailure{
+			ExitCode: serverErrorExitCode(&serverError{Code: job.ErrorCode}),
+			Message:  fmt.Sprintf("Fetch %s: %s", job.State, job.Error),
+			Code:     job.ErrorCode,
+		})
+	}
+	fmt.Printf("Stored %s, %d bytes, sha256 %s, available at /download/%s\n",
+		job.File.FileName, job.File.FileSize, job.File.FileHash, job.File.ID)
+}
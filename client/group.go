@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type GroupRegistration struct {
+	Files          []FileInfo `json:"files"`
+	TimeoutSeconds int        `json:"timeoutSeconds,omitempty"`
+	Compression    string     `json:"compression,omitempty"`
+}
+
+type GroupResponse struct {
+	ID                    string                 `json:"id"`
+	State                 string                 `json:"state"`
+	Reason                string                 `json:"reason,omitempty"`
+	Files                 []FileMetadata         `json:"files"`
+	CompressionDictionary *CompressionDictionary `json:"compressionDictionary,omitempty"`
+}
+
+func runGroup(args []string) {
+	args = profileArgs(args, 0)
+	if len(args) < 4 {
+		fmt.Println("Usage: send_file group <server_ip> <server_port> <maxParallelUploads> <file_path>...")
+		failUsage()
+	}
+	serverIP, serverPort := args[0], args[1]
+	maxConcurrentUploads, err := strconv.Atoi(args[2])
+	if err != nil {
+		failWith(exitCodeUsage, "Error: Invalid number for max concurrent uploads")
+	}
+	negotiateCapabilities(serverIP, serverPort)
+	defer endAPISession(serverIP, serverPort)
+	maxConcurrentUploads = applyAutoTune(serverIP, serverPort, maxConcurrentUploads)
+
+	groupID, err := uploadGroup(args[3:], serverIP, serverPort, maxConcurrentUploads)
+	if err != nil {
+		fail("Error uploading group", err)
+	}
+	fmt.Printf("Upload group %s committed\n", groupID)
+}
+
+// uploadGroup uploads files as one all-or-nothing group. If any member fails
+// the group is aborted so the server discards what was already staged.
+func uploadGroup(filePaths []string, serverIP, serverPort string, maxConcurrentUploads int) (string, error) {
+	var registration GroupRegistration
+	var largest int64
+	files := make([]*os.File, 0, len(filePaths))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, filePath := range filePaths {
+		file, err := openSource(filePath)
+		if err != nil {
+			return "", fmt.Errorf("opening file: %w", err)
+		}
+		files = append(files, file)
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return "", fmt.Errorf("getting file info: %w", err)
+		}
+		algorithm, segmentSize := uploadHashMode()
+		fileHash, err := fileHashAs(file, algorithm, segmentSize)
+		if err != nil {
+			return "", fmt.Errorf("calculating file hash: %w", err)
+		}
+		if fileInfo.Size() > largest {
+			largest = fileInfo.Size()
+		}
+		registration.Files = append(registration.Files, FileInfo{
+			FileName:        filepath.Base(filePath),
+			FileSize:        fileInfo.Size(),
+			FileHash:        fmt.Sprintf("%x", fileHash),
+			ChunkSize:       defaultChunkSize,
+			Tags:            uploadTags,
+			HashAlgorithm:   algorithm,
+			HashSegmentSize: segmentSize,
+			Deadline:        runDeadline(),
+			Attributes:      captureAttributes(filePath, fileInfo),
+		})
+	}
+
+	if compressChunks {
+		registration.Compression = "zstd"
+	}
+	group, err := registerGroup(serverIP, serverPort, registration)
+	if err != nil {
+		printLimitGuidance(err, largest)
+		return "", fmt.Errorf("registering group: %w", err)
+	}
+	fmt.Printf("Registered upload group %s with %d file(s)\n", group.ID, len(group.Files))
+	if compressChunks {
+		if err := startChunkCompression(serverIP, serverPort, group.CompressionDictionary); err != nil {
+			fmt.Printf("Error setting up compression, sending chunks as they are: %v\n", err)
+		}
+		defer stopChunkCompression()
+	}
+
+	for i, member := range group.Files {
+		err := sendFileChunks(files[i], serverIP, serverPort, member.ID, member.ChunkSize, maxConcurrentUploads, nil)
+		if err == nil {
+			err = completeUpload(serverIP, serverPort, member.ID)
+		}
+		if err != nil {
+			abortGroup(serverIP, serverPort, group.ID)
+			return "", fmt.Errorf("uploading %s: %w", filePaths[i], err)
+		}
+	}
+	return group.ID, nil
+}
+
+func registerGroup(serverIP, serverPort string, registration GroupRegistration) (*GroupResponse, error) {
+	url := fmt.Sprintf("%s/register_group", serverURL(serverIP, serverPort))
+	jsonData, err := json.Marshal(registration)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var group GroupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return nil, err
+	}
+	if len(group.Files) != len(registration.Files) {
+		return nil, fmt.Errorf("server registered %d of %d files", len(group.Files), len(registration.Files))
+	}
+	return &group, nil
+}
+
+func abortGroup(serverIP, serverPort, groupID string) {
+	url := fmt.Sprintf("%s/groups/%s", serverURL(serverIP, serverPort), groupID)
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		fmt.Printf("Error aborting upload group: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	fmt.Printf("Upload group %s aborted\n", groupID)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hashCachePath is the file -hash-cache keeps the hashes of large files in,
+// so that uploading or syncing an unchanged file again does not read it
+// twice; "" disables the cache.
+var hashCachePath = defaultHashCachePath()
+
+const (
+	// hashCacheMinSize is the smallest file whose hash is cached; smaller
+	// files hash about as fast as the cache is written.
+	hashCacheMinSize = 1 << 20
+	// hashCacheMaxEntries bounds the cache; the entries used longest ago
+	// are dropped first.
+	hashCacheMaxEntries = 10000
+	// hashCacheRacyWindow is how recently modified a file may be and still
+	// be cached. A file written again within the file system's timestamp
+	// granularity could keep its size and modification time.
+	hashCacheRacyWindow = 2 * time.Second
+)
+
+// hashCacheEntry is the hash of a file as it was when it had Size and
+// ModTime.
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+	UsedAt  time.Time `json:"usedAt"`
+}
+
+var (
+	// hashCache maps "<algorithm>/<segment size>/<absolute path>" to entries.
+	hashCache       map[string]hashCacheEntry
+	hashCacheLoaded bool
+	hashCacheMutex  = &sync.Mutex{}
+)
+
+func defaultHashCachePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fileupload", "hashcache.json")
+}
+
+// cachedFileHash hashes file like hashFileAs, or returns the hash recorded
+// for it while its size and modification time have not changed since.
+func cachedFileHash(file *os.File, algorithm string, segmentSize int64) ([]byte, error) {
+	before, err := file.Stat()
+	if err != nil || hashCachePath == "" || before.Size() < hashCacheMinSize {
+		return hashFileAs(file, algorithm, segmentSize)
+	}
+	path, err := filepath.Abs(file.Name())
+	if err != nil {
+		return hashFileAs(file, algorithm, segmentSize)
+	}
+	key := fmt.Sprintf("%s/%d/%s", hashName(algorithm), segmentSize, path)
+	if hash, ok := lookupHashCache(key, before); ok {
+		return hash, nil
+	}
+	hash, err := hashFileAs(file, algorithm, segmentSize)
+	if err != nil {
+		return nil, err
+	}
+	after, err := file.Stat()
+	if err == nil && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) &&
+		time.Since(after.ModTime()) > hashCacheRacyWindow {
+		if err := storeHashCache(key, after, hash); err != nil {
+			fmt.Println("Error saving hash cache:", err)
+		}
+	}
+	return hash, nil
+}
+
+func lookupHashCache(key string, info os.FileInfo) ([]byte, bool) {
+	hashCacheMutex.Lock()
+	defer hashCacheMutex.Unlock()
+	loadHashCache()
+	entry, ok := hashCache[key]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	hash, err := hex.DecodeString(entry.Hash)
+	if err != nil {
+		return nil, false
+	}
+	// Refreshing UsedAt is only saved with the next new entry; losing it
+	// merely makes the entry a little more likely to be dropped.
+	entry.UsedAt = time.Now()
+	hashCache[key] = entry
+	return hash, true
+}
+
+func storeHashCache(key string, info os.FileInfo, hash []byte) error {
+	hashCacheMutex.Lock()
+	defer hashCacheMutex.Unlock()
+	loadHashCache()
+	hashCache[key] = hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hex.EncodeToString(hash), UsedAt: time.Now()}
+	if len(hashCache) > hashCacheMaxEntries {
+		keys := make([]string, 0, len(hashCache))
+		for key := range hashCache {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return hashCache[keys[i]].UsedAt.Before(hashCache[keys[j]].UsedAt) })
+		for _, key := range keys[:len(keys)-hashCacheMaxEntries] {
+			delete(hashCache, key)
+		}
+	}
+	return saveHashCache()
+}
+
+// loadHashCache reads the cache the first time it is needed. A missing or
+// unreadable cache starts empty.
+func loadHashCache() {
+	if hashCacheLoaded {
+		return
+	}
+	hashCacheLoaded = true
+	hashCache = make(map[string]hashCacheEntry)
+	data, err := ioutil.ReadFile(hashCachePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &hashCache); err != nil {
+		fmt.Printf("Ignoring unreadable hash cache %s: %v\n", hashCachePath, err)
+		hashCache = make(map[string]hashCacheEntry)
+	}
+}
+
+// saveHashCache writes the cache atomically. Clients running at the same
+// time each write a temporary file of their own, and the last one wins.
+func saveHashCache() error {
+	data, err := json.Marshal(hashCache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hashCachePath), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", hashCachePath, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hashCachePath)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// LimitHints mirrors the details the server sends with 413 and 507 errors;
+// Error is the message of the error.
+type LimitHints struct {
+	Error              string `json:"-"`
+	MaxFileSize        int64  `json:"maxFileSize,omitempty"`
+	MaxChunkSize       int    `json:"maxChunkSize,omitempty"`
+	SuggestedChunkSize int    `json:"suggestedChunkSize,omitempty"`
+	RequiredBytes      int64  `json:"requiredBytes,omitempty"`
+	AvailableBytes     int64  `json:"availableBytes,omitempty"`
+	RetryAfter         int    `json:"retryAfter,omitempty"`
+}
+
+// limitError is returned when the server (or a proxy in front of it) rejects
+// a request because of a size or storage limit.
+type limitError struct {
+	*serverError
+	Hints LimitHints
+}
+
+func (e *limitError) Unwrap() error {
+	return e.serverError
+}
+
+const maxLimitRetries = 3
+
+const (
+	maxBusyRetries = 10
+	maxBusyWait    = 30 * time.Second
+)
+
+// serverBusyError is returned for 429 Too Many Requests responses.
+type serverBusyError struct {
+	retryAfter time.Duration
+}
+
+func (e *serverBusyError) Error() string {
+	return fmt.Sprintf("server is busy, retry after %s", e.retryAfter)
+}
+
+// busyBackoff grows the wait linearly with the attempt, capped at
+// maxBusyWait, plus up to 50% jitter so that parallel senders spread out.
+func busyBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	wait := retryAfter * time.Duration(attempt)
+	if wait > maxBusyWait {
+		wait = maxBusyWait
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/2+1))
+}
+
+func newServerBusyError(resp *http.Response) *serverBusyError {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		seconds = 1
+	}
+	return &serverBusyError{retryAfter: time.Duration(seconds) * time.Second}
+}
+
+// newLimitError keeps the hints of a 413 or 507 error. Responses from
+// proxies carry no hints, so only the status and Retry-After are kept.
+func newLimitError(serverErr *serverError) *limitError {
+	limitErr := &limitError{serverError: serverErr}
+	if serverErr.Code == "" {
+		serverErr.Message = ""
+	} else if err := json.Unmarshal(serverErr.Details, &limitErr.Hints); err != nil {
+		limitErr.Hints = LimitHints{}
+	}
+	limitErr.Hints.Error = serverErr.Message
+	if limitErr.Hints.RetryAfter == 0 {
+		limitErr.Hints.RetryAfter = serverErr.RetryAfter
+	}
+	return limitErr
+}
+
+// adjustChunkSize decides whether an upload rejected by a limit can be retried
+// with a smaller chunk size and returns that size.
+func adjustChunkSize(err error, fileSize int64, chunkSize int) (int, bool) {
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.StatusCode != http.StatusRequestEntityTooLarge || limitErr.Code == apiclient.CodeFileTooLarge {
+		return 0, false
+	}
+	if limitErr.Hints.MaxFileSize > 0 && fileSize > limitErr.Hints.MaxFileSize {
+		return 0, false
+	}
+	suggested := limitErr.Hints.SuggestedChunkSize
+	if suggested == 0 || suggested >= chunkSize {
+		suggested = chunkSize / 2
+	}
+	if suggested <= 0 {
+		return 0, false
+	}
+	return suggested, true
+}
+
+// printLimitGuidance explains a limit rejection in terms the user can act on.
+func printLimitGuidance(err error, fileSize int64) {
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) {
+		return
+	}
+	hints := limitErr.Hints
+	switch limitErr.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		if hints.MaxFileSize > 0 && fileSize > hints.MaxFileSize {
+			fmt.Printf("The file is %d bytes but the server accepts at most %d bytes; split or compress it before uploading.\n", fileSize, hints.MaxFileSize)
+		} else if hints.MaxChunkSize > 0 {
+			fmt.Printf("The server accepts chunks of at most %d bytes.\n", hints.MaxChunkSize)
+		} else {
+			fmt.Println("A proxy in front of the server rejected the request size; lower its body size limit or ask the server for smaller chunks.")
+		}
+	case http.StatusInsufficientStorage:
+		if hints.AvailableBytes > 0 {
+			fmt.Printf("The server has %d bytes free but needs %d bytes for this file.\n", hints.AvailableBytes, hints.RequiredBytes)
+		} else {
+			fmt.Println("The server is out of storage space.")
+		}
+		if hints.RetryAfter > 0 {
+			fmt.Printf("Try again in %d seconds or free up space on the server.\n", hints.RetryAfter)
+		}
+	}
+}
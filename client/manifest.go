@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"fileUpload/upload"
+)
+
+// chunkManifest is the server's answer to /files/{id}/manifest.
+type chunkManifest struct {
+	FileID     string `json:"fileId"`
+	FileName   string `json:"fileName"`
+	FileSize   int64  `json:"fileSize"`
+	ChunkSize  int    `json:"chunkSize"`
+	ChunkCount int    `json:"chunkCount"`
+	MerkleTree string `json:"merkleTree"`
+	MerkleRoot string `json:"merkleRoot"`
+	Chunks     []struct {
+		Number int    `json:"number"`
+		Offset int64  `json:"offset"`
+		Size   int    `json:"size"`
+		Hash   string `json:"hash"`
+	} `json:"chunks"`
+}
+
+func fetchChunkManifest(serverIP, serverPort, fileID string) (*chunkManifest, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/files/%s/manifest", serverURL(serverIP, serverPort), url.PathEscape(fileID)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var manifest chunkManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// runManifest checks a copy of a stored file obtained some other way chunk by
+// chunk against the server's manifest, and exits with exitCodeHashMismatch naming the chunks that
+// differ.
+func runManifest(args []string) {
+	args = profileArgs(args, 2)
+	if len(args) != 4 {
+		fmt.Println("Usage: send_file manifest <file_id> <file_path> <server_ip> <server_port>")
+		failUsage()
+	}
+	fileID, filePath, serverIP, serverPort := args[0], args[1], args[2], args[3]
+
+	manifest, err := fetchChunkManifest(serverIP, serverPort, fileID)
+	if err != nil {
+		fail("Error fetching manifest", err)
+	}
+	if manifest.MerkleTree != upload.MerkleTreeRFC6962 {
+		failWith(exitCodeFailure, fmt.Sprintf("Error: unknown Merkle tree %q", manifest.MerkleTree))
+	}
+	leaves := make([][]byte, len(manifest.Chunks))
+	for i, chunk := range manifest.Chunks {
+		leaves[i], _ = hex.DecodeString(chunk.Hash)
+	}
+	if hex.EncodeToString(upload.MerkleRoot(leaves)) != manifest.MerkleRoot {
+		failWith(exitCodeHashMismatch, "Error: the manifest's chunk hashes do not match its Merkle root")
+	}
+	fmt.Printf("Manifest: %s, %d bytes in %d chunks of %d bytes, root %s\n",
+		manifest.FileName, manifest.FileSize, manifest.ChunkCount, manifest.ChunkSize, manifest.MerkleRoot)
+
+	file, err := openSource(filePath)
+	if err != nil {
+		fail("Error opening file", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		fail("Error getting file info", err)
+	}
+
+	bad := 0
+	for _, chunk := range manifest.Chunks {
+		hasher := sha256.New()
+		n, err := io.Copy(hasher, io.NewSectionReader(file, chunk.Offset, int64(chunk.Size)))
+		if err != nil {
+			fail(fmt.Sprintf("Error reading chunk %d", chunk.Number), err)
+		}
+		if n != int64(chunk.Size) || hex.EncodeToString(hasher.Sum(nil)) != chunk.Hash {
+			fmt.Printf("  chunk %6d  offset %12d  %9d bytes  differs\n", chunk.Number, chunk.Offset, chunk.Size)
+			bad++
+		}
+	}
+	if fileInfo.Size() != manifest.FileSize {
+		failWith(exitCodeHashMismatch, fmt.Sprintf("Local file is %d bytes, the stored file %d", fileInfo.Size(), manifest.FileSize))
+	}
+	if bad > 0 {
+		failWith(exitCodeHashMismatch, fmt.Sprintf("%d of %d chunks differ from the stored file", bad, len(manifest.Chunks)))
+	}
+	fmt.Println("All chunks match the stored file")
+}
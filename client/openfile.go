@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// lockedRetry is how long opening a file that another program holds
+	// locked is retried before giving up; 0 gives up right away.
+	lockedRetry time.Duration
+	// backupSemantics opens files on Windows the way backup programs do,
+	// bypassing their permissions where the account may back them up.
+	backupSemantics bool
+)
+
+// maxLockedRetryWait caps the wait between attempts at opening a locked file.
+const maxLockedRetryWait = 5 * time.Second
+
+// openSource opens a local file to read from. On Windows it does not deny
+// other programs any access, so that files they have open for writing can
+// be read, and it retries for up to lockedRetry while a program has the file
+// open without sharing it.
+func openSource(path string) (*os.File, error) {
+	deadline := time.Now().Add(lockedRetry)
+	wait := 250 * time.Millisecond
+	for {
+		file, err := openShared(path)
+		if err == nil || !isLockedError(err) {
+			return file, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w (locked by another program; -retry-locked waits for it)", err)
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		fmt.Printf("%s is locked by another program, retrying in %s\n", path, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		if wait *= 2; wait > maxLockedRetryWait {
+			wait = maxLockedRetryWait
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+var backupPrivilege sync.Once
+
+// openShared opens path for reading while letting other programs read,
+// write, rename and delete it, with backup semantics if asked for.
+func openShared(path string) (*os.File, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	var flags uint32 = windows.FILE_ATTRIBUTE_NORMAL
+	if backupSemantics {
+		backupPrivilege.Do(enableBackupPrivilege)
+		flags |= windows.FILE_FLAG_BACKUP_SEMANTICS
+	}
+	handle, err := windows.CreateFile(name, windows.GENERIC_READ,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, flags, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+// isLockedError reports whether another program has the file open without
+// sharing it, or has locked it.
+func isLockedError(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
+
+// enableBackupPrivilege turns on SeBackupPrivilege for the process, which
+// lets backup semantics read files regardless of their permissions. Accounts
+// without the privilege, anyone but administrators, Backup Operators and
+// LocalSystem, keep opening files with their own permissions.
+func enableBackupPrivilege() {
+	var token windows.Token
+	if err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ADJUST_PRIVILEGES|windows.TOKEN_QUERY, &token); err != nil {
+		return
+	}
+	defer token.Close()
+	privileges := windows.Tokenprivileges{PrivilegeCount: 1}
+	name, _ := windows.UTF16PtrFromString("SeBackupPrivilege")
+	if err := windows.LookupPrivilegeValue(nil, name, &privileges.Privileges[0].Luid); err != nil {
+		return
+	}
+	privileges.Privileges[0].Attributes = windows.SE_PRIVILEGE_ENABLED
+	windows.AdjustTokenPrivileges(token, false, &privileges, 0, nil, nil)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"fileUpload/apiclient"
+)
+
+// runPatch writes the contents of a local file over part of a stored file,
+// or only truncates it, without sending the rest of the file again.
+func runPatch(args []string) {
+	flags := flag.NewFlagSet("patch", flag.ExitOnError)
+	offset := flags.Int64("offset", -1, "offset in the stored file to write the data at")
+	size := flags.Int64("size", -1, "size of the patched file, which truncates it (default: the current size, or the end of the data if it extends the file)")
+	ifMatch := flags.String("if-match", "", "only patch the stored file if it still has this hash")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file patch -offset <n> [flags] <file_id> <data_file> <server_ip> <server_port>")
+		fmt.Println("       send_file patch -size <n> [flags] <file_id> <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	var ranges []apiclient.PatchRange
+	want := 3
+	if *offset >= 0 {
+		want = 4
+	}
+	args = profileArgs(flags.Args(), want-2)
+	if len(args) != want || (*offset < 0 && *size < 0) {
+		flags.Usage()
+		failUsage()
+	}
+	if *offset >= 0 {
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			fail("Error reading data file", err)
+		}
+		if len(data) == 0 {
+			failWith(exitCodeUsage, "Error: the data file is empty")
+		}
+		ranges = append(ranges, apiclient.PatchRange{Offset: *offset, Data: data})
+	}
+	client := apiclient.New(serverURL(args[want-2], args[want-1]))
+	metadata, err := client.PatchFile(context.Background(), args[0], *ifMatch, *size, ranges...)
+	if err != nil {
+		fail("Error patching file", err)
+	}
+	fmt.Printf("Patched %s: %d bytes, %s %s\n", metadata.ID, metadata.FileSize, hashName(metadata.HashAlgorithm), metadata.FileHash)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// pauseFile suspends chunk sending for as long as the file exists, so a
+	// script (or a touch/rm by hand) can hold an upload on a metered link.
+	pauseFile string
+	// pausedBySignal is toggled by SIGUSR1 where the platform has it.
+	pausedBySignal int32
+	// resumable keeps the progress of every upload in <file>.upload.json, so
+	// that running the same command again continues an interrupted upload.
+	resumable bool
+)
+
+const pausePollInterval = 500 * time.Millisecond
+
+func uploadPaused() bool {
+	if atomic.LoadInt32(&pausedBySignal) == 1 {
+		return true
+	}
+	if pauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(pauseFile)
+	return err == nil
+}
+
+// togglePause flips the signal-controlled pause state.
+func togglePause() {
+	if atomic.CompareAndSwapInt32(&pausedBySignal, 0, 1) {
+		fmt.Println("Pausing upload, send SIGUSR1 again to resume")
+		return
+	}
+	atomic.StoreInt32(&pausedBySignal, 0)
+	fmt.Println("Resuming upload")
+}
+
+var pauseNotice, scheduleNotice sync.Once
+
+// waitWhilePaused blocks a chunk sender until the upload is no longer paused.
+// Chunks already on the wire finish; only new ones wait.
+func waitWhilePaused() {
+	for uploadPaused() {
+		pauseNotice.Do(func() {
+			fmt.Println("Upload paused; remove the pause file or send SIGUSR1 to continue")
+		})
+		time.Sleep(pausePollInterval)
+	}
+	for transferSchedule.paused() {
+		scheduleNotice.Do(func() {
+			fmt.Println("Outside the transfer windows of the schedule; waiting for the next one")
+		})
+		time.Sleep(pausePollInterval)
+	}
+}
+
+// uploadState is the persisted progress of one upload.
+type uploadState struct {
+	FileID     string `json:"fileId"`
+	RemoteName string `json:"remoteName"`
+	FileSize   int64  `json:"fileSize"`
+	FileHash   string `json:"fileHash"`
+	ChunkSize  int    `json:"chunkSize"`
+	SentChunks []int  `json:"sentChunks"`
+
+	path string
+	mu   sync.Mutex
+	sent map[int]bool
+}
+
+func uploadStatePath(filePath string) string {
+	return filePath + ".upload.json"
+}
+
+// loadUploadState returns the saved progress of uploading filePath under
+// remoteName, or nil if there is none for this exact content.
+func loadUploadState(filePath, remoteName string, fileSize int64, fileHash string) *uploadState {
+	data, err := ioutil.ReadFile(uploadStatePath(filePath))
+	if err != nil {
+		return nil
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	if state.RemoteName != remoteName || state.FileSize != fileSize || state.FileHash != fileHash {
+		return nil
+	}
+	state.path = uploadStatePath(filePath)
+	state.sent = make(map[int]bool)
+	for _, chunkNumber := range state.SentChunks {
+		state.sent[chunkNumber] = true
+	}
+	return &state
+}
+
+func newUploadState(filePath, fileID, remoteName string, fileSize int64, fileHash string, chunkSize int) *uploadState {
+	state := &uploadState{
+		FileID:     fileID,
+		RemoteName: remoteName,
+		FileSize:   fileSize,
+		FileHash:   fileHash,
+		ChunkSize:  chunkSize,
+		SentChunks: []int{},
+		path:       uploadStatePath(filePath),
+		sent:       make(map[int]bool),
+	}
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving upload state: %v\n", err)
+	}
+	return state
+}
+
+// isSent is safe to call on a nil state, which means nothing was sent yet.
+func (s *uploadState) isSent(chunkNumber int) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent[chunkNumber]
+}
+
+func (s *uploadState) markSent(chunkNumber int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[chunkNumber] = true
+	s.SentChunks = append(s.SentChunks, chunkNumber)
+	if err := s.save(); err != nil {
+		fmt.Printf("Error saving upload state: %v\n", err)
+	}
+}
+
+// save writes the state atomically; the caller must hold s.mu once the
+// state is shared between senders.
+// save writes the state to its file; states kept in memory have none.
+func (s *uploadState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *uploadState) remove() {
+	if s != nil && s.path != "" {
+		os.Remove(s.path)
+	}
+}
+
+// uploadSessionStatus asks the server about an upload with the resumable PUT
+// protocol's status query: 308 means the session is still open, 200 that the
+// file is already stored.
+func uploadSessionStatus(serverIP, serverPort, fileID string, fileSize int64) (int, error) {
+	url := fmt.Sprintf("%s/files/%s", serverURL(serverIP, serverPort), fileID)
+	request, err := http.NewRequest("PUT", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
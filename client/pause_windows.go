@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// handlePauseSignal is a no-op: Windows has no SIGUSR1, use -pause-file.
+func handlePauseSignal() {}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// peerDownloads makes downloads fetch pieces from other clients seeding
+	// the file before asking the server for the rest.
+	peerDownloads bool
+	// peerURL is the URL seed announces instead of the address the server
+	// sees, e.g. behind NAT.
+	peerURL string
+)
+
+const (
+	// peerFetchers is how many pieces are fetched from peers at once.
+	peerFetchers = 4
+	// peerTimeout bounds a piece request to a peer.
+	peerTimeout = 30 * time.Second
+)
+
+// peerClient talks to other clients. It does not carry the profile's token,
+// which is only for the server.
+var peerClient = &http.Client{
+	Timeout:   peerTimeout,
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+}
+
+// peerSwarm is the server's answer to /files/{id}/peers.
+type peerSwarm struct {
+	FileID                  string      `json:"fileId"`
+	PeerURL                 string      `json:"peerUrl"`
+	FileHash                string      `json:"fileHash"`
+	FileSize                int64       `json:"fileSize"`
+	PieceSize               int         `json:"pieceSize"`
+	PeerCount               int         `json:"peerCount"`
+	AnnounceIntervalSeconds float64     `json:"announceIntervalSeconds"`
+	Pieces                  []peerPiece `json:"pieces"`
+}
+
+type peerPiece struct {
+	Number int      `json:"number"`
+	Offset int64    `json:"offset"`
+	Size   int      `json:"size"`
+	Hash   string   `json:"hash"`
+	Peers  []string `json:"peers"`
+}
+
+func (p peerPiece) bytes() byteRange {
+	return byteRange{p.Offset, p.Offset + int64(p.Size)}
+}
+
+func peersURL(serverIP, serverPort, fileID string) string {
+	return fmt.Sprintf("%s/files/%s/peers", serverURL(serverIP, serverPort), url.PathEscape(fileID))
+}
+
+func fetchPeerSwarm(serverIP, serverPort, fileID string) (*peerSwarm, error) {
+	resp, err := http.Get(peersURL(serverIP, serverPort, fileID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var swarm peerSwarm
+	if err := json.NewDecoder(resp.Body).Decode(&swarm); err != nil {
+		return nil, err
+	}
+	return &swarm, nil
+}
+
+// downloadFromPeers fetches the missing pieces that have peers from them,
+// recording each piece in state once its hash matches the server's. Pieces
+// no peer delivers intact are left for the server.
+func downloadFromPeers(serverIP, serverPort string, metadata *FileMetadata, file *os.File, state *downloadState, statePath string) {
+	swarm, err := fetchPeerSwarm(serverIP, serverPort, metadata.ID)
+	if err != nil {
+		fmt.Printf("Not using peers: %v\n", err)
+		return
+	}
+	if swarm.FileHash != metadata.FileHash {
+		fmt.Println("Not using peers: the file changed on the server")
+		return
+	}
+	gaps := missingRanges(state.Ranges, metadata.FileSize)
+	pieces := make(chan peerPiece)
+	go func() {
+		defer close(pieces)
+		for _, piece := range swarm.Pieces {
+			if len(piece.Peers) > 0 && rangeMissing(gaps, piece.bytes()) {
+				pieces <- piece
+			}
+		}
+	}()
+	if swarm.PeerCount > 0 {
+		fmt.Printf("Fetching pieces from %d peer(s)\n", swarm.PeerCount)
+	}
+
+	var wg sync.WaitGroup
+	var stateMutex sync.Mutex
+	var fetched int64
+	for i := 0; i < peerFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for piece := range pieces {
+				data, ok := fetchPieceFromPeers(metadata.ID, piece)
+				if !ok {
+					continue
+				}
+				if _, err := file.WriteAt(data, piece.Offset); err != nil {
+					fmt.Printf("Error writing piece %d: %v\n", piece.Number, err)
+					continue
+				}
+				stateMutex.Lock()
+				state.Ranges = addRange(state.Ranges, piece.bytes())
+				fetched += int64(piece.Size)
+				if err := saveDownloadState(statePath, state); err != nil {
+					fmt.Printf("Error saving download state: %v\n", err)
+				}
+				stateMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if fetched > 0 {
+		fmt.Printf("Fetched %d of %d bytes from peers\n", fetched, metadata.FileSize)
+	}
+}
+
+// fetchPieceFromPeers asks the piece's peers in turn until one sends bytes
+// with the piece's hash.
+func fetchPieceFromPeers(fileID string, piece peerPiece) ([]byte, bool) {
+	for _, peer := range piece.Peers {
+		data, err := fetchPiece(peer, fileID, piece)
+		if err != nil {
+			fmt.Printf("Piece %d from %s: %v\n", piece.Number, peer, err)
+			continue
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+func fetchPiece(peer, fileID string, piece peerPiece) ([]byte, error) {
+	resp, err := peerClient.Get(fmt.Sprintf("%s/pieces/%s/%d", strings.TrimRight(peer, "/"), url.PathEscape(fileID), piece.Number))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(piece.Size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != piece.Size || fmt.Sprintf("%x", sha256.Sum256(data)) != piece.Hash {
+		return nil, fmt.Errorf("hash mismatch, discarded")
+	}
+	return data, nil
+}
+
+// rangeMissing reports whether r lies within one of gaps.
+func rangeMissing(gaps []byteRange, r byteRange) bool {
+	for _, gap := range gaps {
+		if gap.Start <= r.Start && r.End <= gap.End {
+			return true
+		}
+	}
+	return false
+}
+
+func runSeed(args []string) {
+	args = profileArgs(args, 2)
+	if len(args) != 4 && len(args) != 5 {
+		fmt.Println("Usage: send_file seed <file_id> <file_path> <server_ip> <server_port> [listen_address]")
+		failUsage()
+	}
+	fileID, filePath, serverIP, serverPort := args[0], args[1], args[2], args[3]
+	listenAddress := ":7070"
+	if len(args) == 5 {
+		listenAddress = args[4]
+	}
+
+	match, err := verifyFile(fileID, filePath, serverIP, serverPort)
+	if err != nil {
+		fail("Error verifying file", err)
+	}
+	if !match {
+		failWith(exitCodeHashMismatch, "Local file differs from the stored file, not seeding it")
+	}
+	file, err := openSource(filePath)
+	if err != nil {
+		fail("Error opening file", err)
+	}
+	defer file.Close()
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		fail("Error listening on "+listenAddress, err)
+	}
+	announcement := map[string]interface{}{"port": listener.Addr().(*net.TCPAddr).Port}
+	if peerURL != "" {
+		announcement = map[string]interface{}{"url": peerURL}
+	}
+	swarm, err := announcePeer(serverIP, serverPort, fileID, announcement)
+	if err != nil {
+		fail("Error announcing file", err)
+	}
+	fmt.Printf("Seeding %s as %s; press Ctrl+C to stop\n", fileID, swarm.PeerURL)
+
+	server := &http.Server{Handler: pieceHandler(file, swarm), ReadHeaderTimeout: peerTimeout}
+	go server.Serve(listener)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	interval := time.Duration(swarm.AnnounceIntervalSeconds * float64(time.Second))
+	for {
+		select {
+		case <-interrupt:
+			if err := withdrawPeer(serverIP, serverPort, fileID, swarm.PeerURL); err != nil {
+				fmt.Printf("Error withdrawing announcement: %v\n", err)
+			}
+			server.Close()
+			fmt.Println("Stopped seeding")
+			return
+		case <-time.After(interval):
+			announced, err := announcePeer(serverIP, serverPort, fileID, announcement)
+			if err != nil {
+				fmt.Printf("Error announcing file: %v\n", err)
+				continue
+			}
+			if announced.FileHash != swarm.FileHash {
+				withdrawPeer(serverIP, serverPort, fileID, swarm.PeerURL)
+				server.Close()
+				failWith(exitCodeFailure, "The file changed on the server, stopping")
+			}
+		}
+	}
+}
+
+// pieceHandler serves GET /pieces/<file id>/<piece number> from the local
+// copy of the file.
+func pieceHandler(file *os.File, swarm *peerSwarm) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		if r.Method != "GET" || len(parts) != 4 || parts[1] != "pieces" || parts[2] != swarm.FileID {
+			http.NotFound(w, r)
+			return
+		}
+		number, err := strconv.Atoi(parts[3])
+		if err != nil || number < 1 || number > len(swarm.Pieces) {
+			http.NotFound(w, r)
+			return
+		}
+		piece := swarm.Pieces[number-1]
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(piece.Size))
+		if _, err := io.Copy(w, io.NewSectionReader(file, piece.Offset, int64(piece.Size))); err != nil {
+			fmt.Printf("Error serving piece %d to %s: %v\n", number, r.RemoteAddr, err)
+			return
+		}
+		fmt.Printf("Served piece %d to %s\n", number, r.RemoteAddr)
+	})
+}
+
+func announcePeer(serverIP, serverPort, fileID string, announcement map[string]interface{}) (*peerSwarm, error) {
+	body, err := json.Marshal(announcement)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(peersURL(serverIP, serverPort, fileID), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var swarm peerSwarm
+	if err := json.NewDecoder(resp.Body).Decode(&swarm); err != nil {
+		return nil, err
+	}
+	return &swarm, nil
+}
+
+func withdrawPeer(serverIP, serverPort, fileID, announcedURL string) error {
+	request, err := http.NewRequest("DELETE", peersURL(serverIP, serverPort, fileID)+"?url="+url.QueryEscape(announcedURL), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return readServerError(resp)
+	}
+	return nil
+}
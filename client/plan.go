@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+var (
+	// dryRun prints what an upload would send without contacting the server.
+	dryRun bool
+	// verifyFileID compares a local file with a stored one instead of
+	// uploading it.
+	verifyFileID string
+	// requestedChunkSize overrides the chunk size of the profile.
+	requestedChunkSize int
+)
+
+// plannedChunkSize is what a dry run plans with when neither -chunk-size nor
+// the profile asks for one: the largest chunk the server hands out by
+// default. The real size is only known once the server registers the file.
+const plannedChunkSize = 4 * 1024 * 1024
+
+// runDryRun prints the registration, chunks and completion that uploading
+// args[0] would send, hashing every chunk as the upload would. The server
+// address, if given, only goes into the printed URLs.
+func runDryRun(args []string) error {
+	filePath := args[0]
+	target := "<server>"
+	if len(args) >= 3 {
+		target = serverURL(args[1], args[2])
+	}
+	file, err := openSource(filePath)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+	if fileInfo.Size() == 0 {
+		return fmt.Errorf("file is empty")
+	}
+	algorithm, segmentSize := uploadHashMode()
+	fileHash, err := fileHashAs(file, algorithm, segmentSize)
+	if err != nil {
+		return fmt.Errorf("calculating file hash: %w", err)
+	}
+	remoteName := filepath.Base(filePath)
+	hash := hex.EncodeToString(fileHash)
+
+	fileID := "<id>"
+	chunkSize := defaultChunkSize
+	note := "requested"
+	var state *uploadState
+	if resumable {
+		state = loadUploadState(filePath, remoteName, fileInfo.Size(), hash)
+	}
+	switch {
+	case state != nil:
+		fileID, chunkSize, note = state.FileID, state.ChunkSize, "from the saved upload, which would be resumed if the server still has it"
+	case chunkSize == 0:
+		chunkSize, note = plannedChunkSize, "assumed; the server picks the chunk size at registration"
+	}
+	if int64(chunkSize) > fileInfo.Size() {
+		chunkSize = int(fileInfo.Size())
+	}
+	totalChunks := int((fileInfo.Size() + int64(chunkSize) - 1) / int64(chunkSize))
+
+	fmt.Println("Dry run, nothing is sent")
+	fmt.Printf("File:     %s as %q, %d bytes, %s %s\n", filePath, remoteName, fileInfo.Size(), hashName(algorithm), hash)
+	if state == nil {
+		fmt.Printf("Register: POST %s/register_file\n", target)
+	}
+	fmt.Printf("Chunks:   %d of %d bytes (%s)\n", totalChunks, chunkSize, note)
+	buffer := make([]byte, chunkSize)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	pending := 0
+	for chunkNumber := 1; chunkNumber <= totalChunks; chunkNumber++ {
+		n, err := io.ReadFull(file, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("reading chunk %d: %w", chunkNumber, err)
+		}
+		status := "send"
+		if state.isSent(chunkNumber) {
+			status = "already sent"
+		} else {
+			pending++
+		}
+		chunkHash := sha256.Sum256(buffer[:n])
+		fmt.Printf("  %6d  offset %12d  %9d bytes  sha256 %x  %s\n",
+			chunkNumber, int64(chunkNumber-1)*int64(chunkSize), n, chunkHash, status)
+	}
+	fmt.Printf("Send:     POST %s/upload_chunk/%s/{n} for %d chunks\n", target, fileID, pending)
+	fmt.Printf("Complete: POST %s/complete_upload/%s\n", target, fileID)
+	return nil
+}
+
+// verifyFile compares the size and hash of a local file with the metadata
+// the server keeps for fileID, transferring no file data. It reports whether
+// they match.
+func verifyFile(fileID, filePath, serverIP, serverPort string) (bool, error) {
+	file, err := openSource(filePath)
+	if err != nil {
+		return false, fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("getting file info: %w", err)
+	}
+	metadata, err := fetchFileMetadata(serverIP, serverPort, fileID)
+	if err != nil {
+		return false, fmt.Errorf("fetching file metadata: %w", err)
+	}
+	fmt.Printf("Remote: %s, %d bytes, %s %s\n", metadata.FileName, metadata.FileSize, hashName(metadata.HashAlgorithm), metadata.FileHash)
+	if fileInfo.Size() != metadata.FileSize {
+		fmt.Printf("Local:  %s, %d bytes\n", filePath, fileInfo.Size())
+		return false, nil
+	}
+	fileHash, err := fileHashAs(file, metadata.HashAlgorithm, metadata.HashSegmentSize)
+	if err != nil {
+		return false, fmt.Errorf("calculating file hash: %w", err)
+	}
+	hash := hex.EncodeToString(fileHash)
+	fmt.Printf("Local:  %s, %d bytes, %s %s\n", filePath, fileInfo.Size(), hashName(metadata.HashAlgorithm), hash)
+	return hash == metadata.FileHash, nil
+}
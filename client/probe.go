@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// autoTune probes the server before uploading and picks the chunk size,
+// parallelism and compression from the measured round trip time and
+// throughput, unless the chunk size is set with -chunk-size or the profile
+// or fixed by -dedup.
+var autoTune bool
+
+const (
+	probeRounds    = 5
+	probeBursts    = 2
+	probeBurstSize = 1 << 20
+	// tunedChunkTime is how long sending one tuned chunk should take: long
+	// enough for per-chunk overhead not to matter, short enough for a retry
+	// to be cheap.
+	tunedChunkTime  = time.Second
+	maxTunedUploads = 16
+	// Chunks of upload groups are compressed on links slower than this, in
+	// bytes per second, where the time saved outweighs the CPU spent.
+	compressBelow = 8 << 20
+)
+
+// probeMeasurement is what a probe found out about the path to a server.
+type probeMeasurement struct {
+	RTT        time.Duration
+	Throughput float64
+	Server     apiclient.ProbeResult
+}
+
+// runProbe prints the measurements of a probe and the settings -auto-tune
+// would choose from them.
+func runProbe(args []string) {
+	args = profileArgs(args, 0)
+	if len(args) != 2 {
+		fmt.Println("Usage: send_file probe <server_ip> <server_port>")
+		failUsage()
+	}
+	measurement, err := probeServer(args[0], args[1])
+	if err != nil {
+		fail("Error probing server", err)
+	}
+	chunkSize, uploads, compress := measurement.tune(maxTunedUploads)
+	fmt.Printf("Round trip time: %s\n", measurement.RTT.Round(100*time.Microsecond))
+	fmt.Printf("Throughput: %.2f MiB/s\n", measurement.Throughput/(1<<20))
+	fmt.Printf("Suggested: -chunk-size %d, %d parallel uploads, compression %s\n", chunkSize, uploads, onOff(compress))
+}
+
+// probeServer measures the round trip time as the fastest of a few small
+// requests and the throughput as the best of a few bursts, after taking off
+// the round trip each of them needs.
+func probeServer(serverIP, serverPort string) (*probeMeasurement, error) {
+	client := apiclient.New(serverURL(serverIP, serverPort))
+	measurement := &probeMeasurement{}
+	for i := 0; i < probeRounds; i++ {
+		start := time.Now()
+		result, err := client.Probe(context.Background(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if rtt := time.Since(start); i == 0 || rtt < measurement.RTT {
+			measurement.RTT = rtt
+		}
+		measurement.Server = *result
+	}
+
+	burst := make([]byte, probeBurstSize)
+	if limit := measurement.Server.MaxChunkSize; limit > 0 && limit < len(burst) {
+		burst = burst[:limit]
+	}
+	// Random bytes, so that no compressing proxy on the way flatters the link.
+	rand.Read(burst)
+	for i := 0; i < probeBursts; i++ {
+		start := time.Now()
+		result, err := client.Probe(context.Background(), burst)
+		if err != nil {
+			return nil, err
+		}
+		elapsed := time.Since(start) - measurement.RTT
+		if read := time.Duration(result.ReadSeconds * float64(time.Second)); elapsed < read {
+			elapsed = read
+		}
+		if elapsed < time.Millisecond {
+			elapsed = time.Millisecond
+		}
+		if throughput := float64(result.ReceivedBytes) / elapsed.Seconds(); throughput > measurement.Throughput {
+			measurement.Throughput = throughput
+		}
+	}
+	return measurement, nil
+}
+
+// tune picks a chunk size that takes about tunedChunkTime to send, enough
+// parallel uploads, at most maxUploads, to keep the link busy while each of
+// them waits a round trip for its acknowledgement, and compression on slow
+// links the server offers it on.
+func (m *probeMeasurement) tune(maxUploads int) (int, int, bool) {
+	chunkSize := 128 << 10
+	target := m.Throughput * tunedChunkTime.Seconds()
+	for float64(chunkSize*2) <= target {
+		chunkSize *= 2
+	}
+	if chunkSize < m.Server.MinChunkSize {
+		chunkSize = m.Server.MinChunkSize
+	}
+	if m.Server.MaxChunkSize > 0 && chunkSize > m.Server.MaxChunkSize {
+		chunkSize = m.Server.MaxChunkSize
+	}
+
+	chunkTime := time.Duration(float64(chunkSize) / m.Throughput * float64(time.Second))
+	uploads := 1
+	if chunkTime > 0 {
+		uploads += int((m.RTT + chunkTime - 1) / chunkTime)
+	}
+	if uploads > maxUploads {
+		uploads = maxUploads
+	}
+	return chunkSize, uploads, m.Server.Compression && m.Throughput < compressBelow
+}
+
+// applyAutoTune probes the server with -auto-tune and applies what it
+// found, returning the number of parallel uploads to use, at most
+// maxConcurrentUploads. A failed probe keeps the settings as they are.
+func applyAutoTune(serverIP, serverPort string, maxConcurrentUploads int) int {
+	if !autoTune {
+		return maxConcurrentUploads
+	}
+	measurement, err := probeServer(serverIP, serverPort)
+	if err != nil {
+		fmt.Println("Error probing server, keeping the configured settings:", err)
+		return maxConcurrentUploads
+	}
+	chunkSize, uploads, compress := measurement.tune(maxConcurrentUploads)
+	// Deduplicated uploads keep their fixed chunk size, so that chunks keep
+	// matching those of earlier uploads.
+	chunkNote := "configured"
+	if defaultChunkSize == 0 && !dedupUploads {
+		defaultChunkSize, chunkNote = chunkSize, "tuned"
+	}
+	compressChunks = compressChunks || compress
+	fmt.Printf("Probed server: %s round trip, %.2f MiB/s; using %d byte chunks (%s), %d parallel uploads, compression %s\n",
+		measurement.RTT.Round(100*time.Microsecond), measurement.Throughput/(1<<20), defaultChunkSize, chunkNote, uploads, onOff(compressChunks))
+	return uploads
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clientConfig is ~/.fileupload/config.yaml:
+//
+//	default: staging
+//	profiles:
+//	  staging:
+//	    address: https://staging.example.com:8443
+//	    token: s3cret
+//	    tls:
+//	      ca_file: ~/.fileupload/staging-ca.pem
+//	    chunk_size: 4194304
+//	  local:
+//	    address: 127.0.0.1:8080
+type clientConfig struct {
+	Default  string                   `yaml:"default"`
+	Profiles map[string]serverProfile `yaml:"profiles"`
+}
+
+type serverProfile struct {
+	// Address is host:port for plain HTTP, or an http:// or https:// URL.
+	Address   string     `yaml:"address"`
+	Token     string     `yaml:"token"`
+	TLS       tlsProfile `yaml:"tls"`
+	ChunkSize int        `yaml:"chunk_size"`
+	// Schedule is a bandwidth schedule like -schedule.
+	Schedule string `yaml:"schedule"`
+}
+
+type tlsProfile struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+var (
+	configPath  string
+	profileName string
+
+	// profile is the selected profile, nil when the server is given on the
+	// command line as usual.
+	profile *serverProfile
+	// serverScheme is "https" for profiles with an https:// address.
+	serverScheme = "http"
+	// defaultChunkSize is requested at registration; 0 lets the server choose.
+	defaultChunkSize int
+	// scheduleSpec is the bandwidth schedule of -schedule or the profile.
+	scheduleSpec string
+)
+
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fileupload", "config.yaml")
+}
+
+// loadProfile selects -profile, or the default profile of the config file if
+// it names one, and applies its token and TLS settings to every request.
+func loadProfile() error {
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) && profileName == "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	var config clientConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", configPath, err)
+	}
+	name := profileName
+	if name == "" {
+		name = config.Default
+	}
+	if name == "" {
+		return nil
+	}
+	selected, ok := config.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %q not found in %s", name, configPath)
+	}
+	if selected.Address == "" {
+		return fmt.Errorf("profile %q has no address", name)
+	}
+	if err := applyProfile(&selected); err != nil {
+		return fmt.Errorf("profile %q: %w", name, err)
+	}
+	profile = &selected
+	return nil
+}
+
+func applyProfile(selected *serverProfile) error {
+	if _, _, err := profileAddress(selected.Address); err != nil {
+		return err
+	}
+	defaultChunkSize = selected.ChunkSize
+
+	transport := baseTransport()
+	tlsConfig := &tls.Config{
+		ServerName:         selected.TLS.ServerName,
+		InsecureSkipVerify: selected.TLS.InsecureSkipVerify,
+	}
+	if selected.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(expandHome(selected.TLS.CAFile))
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", selected.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if selected.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(expandHome(selected.TLS.CertFile), expandHome(selected.TLS.KeyFile))
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	if selected.Token != "" {
+		profileTransport = &tokenTransport{token: selected.Token, base: transport}
+		http.DefaultTransport = profileTransport
+	}
+	return nil
+}
+
+// profileAddress splits a profile address into host and port, noting the
+// scheme in serverScheme.
+func profileAddress(address string) (string, string, error) {
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		// Not a URL: host:port for plain HTTP.
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid address %q", address)
+		}
+		return host, port, nil
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", "", fmt.Errorf("unsupported scheme in %q", address)
+	}
+	serverScheme = parsed.Scheme
+	port := parsed.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[parsed.Scheme]
+	}
+	return parsed.Hostname(), port, nil
+}
+
+// profileArgs inserts the server address of the selected profile into the
+// positional arguments of a command at index at, where <server_ip>
+// <server_port> would otherwise be given.
+func profileArgs(args []string, at int) []string {
+	if profile == nil || len(args) < at {
+		return args
+	}
+	host, port, _ := profileAddress(profile.Address)
+	withAddress := append([]string{}, args[:at]...)
+	withAddress = append(withAddress, host, port)
+	return append(withAddress, args[at:]...)
+}
+
+func serverURL(serverIP, serverPort string) string {
+	return fmt.Sprintf("%s://%s", serverScheme, net.JoinHostPort(serverIP, serverPort))
+}
+
+// defaultTransport is the transport the client started with, before it was
+// wrapped in the token of a profile, the User-Agent and tracing.
+var defaultTransport = http.DefaultTransport.(*http.Transport)
+
+// baseTransport is the transport under every request of the client, below
+// the token of a profile, the User-Agent and tracing.
+func baseTransport() *http.Transport {
+	return defaultTransport
+}
+
+// profileTransport is the tokenTransport of the selected profile, nil when
+// it has no token.
+var profileTransport *tokenTransport
+
+// tokenTransport authenticates every request with the bearer token of the
+// selected profile, or the session token it was traded for with version 2 of
+// the API.
+type tokenTransport struct {
+	token   string
+	session sessionToken
+	base    *http.Transport
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.bearer())
+	return t.base.RoundTrip(r)
+}
+
+func expandHome(path string) string {
+	if len(path) > 1 && path[:2] == "~/" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
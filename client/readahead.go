@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// readAhead is how many chunks are read and hashed ahead of the senders. A
+// single reader goroutine keeps this many chunks ready while others are in
+// flight, so a slow disk or network filesystem overlaps with the network
+// instead of adding to it, and only the chunks in flight and the read-ahead
+// are held in memory.
+var readAhead = 2
+
+// readChunk is a chunk read from the file, waiting to be sent.
+type readChunk struct {
+	number int
+	data   []byte
+	hash   string
+	buffer *[]byte
+}
+
+// chunkBuffers recycles chunk buffers once their chunk has been sent.
+var chunkBuffers sync.Pool
+
+func getChunkBuffer(size int) *[]byte {
+	if buffer, ok := chunkBuffers.Get().(*[]byte); ok && cap(*buffer) >= size {
+		return buffer
+	}
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+// release returns the chunk's buffer to the pool; data must not be used
+// afterwards.
+func (c readChunk) release() {
+	chunkBuffers.Put(c.buffer)
+}
+
+// chunkReader reads the chunks not yet sent, in order, on its own goroutine.
+type chunkReader struct {
+	chunks <-chan readChunk
+	stop   chan struct{}
+	once   sync.Once
+	// err is the read error, if any; it is only valid once chunks is closed.
+	err error
+}
+
+func startChunkReader(file *os.File, chunkSize int, state *uploadState) *chunkReader {
+	depth := readAhead
+	if depth < 0 {
+		depth = 0
+	}
+	chunks := make(chan readChunk, depth)
+	reader := &chunkReader{chunks: chunks, stop: make(chan struct{})}
+	go func() {
+		defer close(chunks)
+		for chunkNumber := 1; ; chunkNumber++ {
+			if state.isSent(chunkNumber) {
+				continue
+			}
+			buffer := getChunkBuffer(chunkSize)
+			bytesRead, err := file.ReadAt((*buffer)[:chunkSize], int64(chunkNumber-1)*int64(chunkSize))
+			if err != nil && err != io.EOF {
+				fmt.Printf("Error reading file: %v\n", err)
+				reader.err = err
+				return
+			}
+			if bytesRead == 0 {
+				fmt.Println("Reached end of file")
+				return
+			}
+			chunk := readChunk{number: chunkNumber, data: (*buffer)[:bytesRead], buffer: buffer}
+			chunk.hash = fmt.Sprintf("%x", sha256.Sum256(chunk.data))
+			select {
+			case chunks <- chunk:
+			case <-reader.stop:
+				return
+			}
+			if bytesRead < chunkSize {
+				fmt.Println("Reached end of file")
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// close stops reading ahead, e.g. after a chunk failed. Chunks already read
+// are still delivered.
+func (r *chunkReader) close() {
+	r.once.Do(func() { close(r.stop) })
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// resumeToken continues the upload a registration returned it for, instead
+// of registering the file again; unlike -resumable it needs nothing from the
+// machine that started the upload.
+var resumeToken string
+
+// ResumptionStatus is what the server knows of the upload of a resumption
+// token.
+type ResumptionStatus struct {
+	FileID         string `json:"fileId"`
+	FileSize       int64  `json:"fileSize"`
+	FileHash       string `json:"fileHash"`
+	ChunkSize      int    `json:"chunkSize"`
+	TotalChunks    int    `json:"totalChunks"`
+	ReceivedChunks []int  `json:"receivedChunks"`
+	Complete       bool   `json:"complete"`
+}
+
+func resumeUpload(serverIP, serverPort, token string) (*ResumptionStatus, error) {
+	jsonData, err := json.Marshal(map[string]string{"resumptionToken": token})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(fmt.Sprintf("%s/resume_upload", serverURL(serverIP, serverPort)), "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var status ResumptionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// resumeFromToken returns the registration to continue with -resume-token,
+// or nil to register the file anew. done reports that the file is already
+// stored.
+func resumeFromToken(serverIP, serverPort string, fileMetadata FileInfo) (regResponse *RegistrationResponse, received []int, done bool) {
+	status, err := resumeUpload(serverIP, serverPort, resumeToken)
+	switch {
+	case err != nil:
+		fmt.Printf("Cannot resume from the token, starting over: %v\n", err)
+	case status.FileSize != fileMetadata.FileSize || status.FileHash != fileMetadata.FileHash:
+		fmt.Println("The resumption token is for a different file, starting over")
+	case status.Complete:
+		return &RegistrationResponse{ID: status.FileID, ChunkSize: status.ChunkSize}, nil, true
+	default:
+		fmt.Printf("Resuming upload %s from the token\n", status.FileID)
+		return &RegistrationResponse{ID: status.FileID, ChunkSize: status.ChunkSize, TotalChunks: status.TotalChunks, ResumptionToken: resumeToken}, status.ReceivedChunks, false
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferSchedule limits how fast uploads may send depending on the time of
+// day, e.g. "22:00-06:00=unlimited,*=1MB": full speed at night and 1 MB/s
+// otherwise. Rules are checked in order and the first whose window contains
+// the current local time applies; "*" matches any time. A rate of "off"
+// stops sending until a window with a rate begins, and times no rule covers
+// are unlimited. The rate is looked up again for every few kilobytes sent, so
+// a window that starts or ends during an upload takes effect immediately.
+var transferSchedule *bandwidthSchedule
+
+// scheduleSlice is the most sent between two looks at the schedule.
+const scheduleSlice = 32 * 1024
+
+type bandwidthRule struct {
+	always     bool
+	start, end int // minutes after midnight
+	// rate is in bytes per second; 0 is unlimited and -1 forbids sending.
+	rate int64
+}
+
+type bandwidthSchedule struct {
+	rules []bandwidthRule
+
+	mu sync.Mutex
+	// next is when the bytes already granted have been sent at the current
+	// rate, shared by every upload of the process.
+	next time.Time
+}
+
+func parseSchedule(spec string) (*bandwidthSchedule, error) {
+	schedule := &bandwidthSchedule{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		window, rate, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: expected <window>=<rate>", part)
+		}
+		var rule bandwidthRule
+		var err error
+		if window = strings.TrimSpace(window); window == "*" {
+			rule.always = true
+		} else if rule.start, rule.end, err = parseWindow(window); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", part, err)
+		}
+		if rule.rate, err = parseRate(strings.TrimSpace(rate)); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", part, err)
+		}
+		schedule.rules = append(schedule.rules, rule)
+	}
+	if len(schedule.rules) == 0 {
+		return nil, fmt.Errorf("no rules in %q", spec)
+	}
+	return schedule, nil
+}
+
+// parseWindow parses HH:MM-HH:MM; windows ending before they start wrap
+// around midnight.
+func parseWindow(window string) (int, int, error) {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("window %q: expected HH:MM-HH:MM", window)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// parseRate accepts "unlimited", "off" or bytes per second with an optional
+// K, M or G suffix (powers of 1024) and an optional trailing "B" or "B/s".
+func parseRate(rate string) (int64, error) {
+	switch strings.ToLower(rate) {
+	case "unlimited":
+		return 0, nil
+	case "off":
+		return -1, nil
+	}
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(rate), "/S"), "B")
+	multiplier := int64(1)
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// rateAt returns the rate of the first rule covering t.
+func (s *bandwidthSchedule) rateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, rule := range s.rules {
+		if rule.always || rule.contains(minute) {
+			return rule.rate
+		}
+	}
+	return 0
+}
+
+func (r bandwidthRule) contains(minute int) bool {
+	if r.start <= r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+// paused reports whether the schedule forbids sending right now; it is safe
+// to call without a schedule.
+func (s *bandwidthSchedule) paused() bool {
+	return s != nil && s.rateAt(time.Now()) < 0
+}
+
+// wait blocks until n more bytes may be sent.
+func (s *bandwidthSchedule) wait(n int) {
+	for s.paused() {
+		time.Sleep(pausePollInterval)
+	}
+	rate := s.rateAt(time.Now())
+	if rate <= 0 {
+		return
+	}
+	s.mu.Lock()
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	delay := s.next.Sub(now)
+	s.next = s.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	s.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledReader sends a request body no faster than the schedule allows.
+type throttledReader struct {
+	reader   io.Reader
+	schedule *bandwidthSchedule
+}
+
+// throttle wraps a request body in the schedule, if there is one.
+func throttle(reader io.Reader) io.Reader {
+	if transferSchedule == nil {
+		return reader
+	}
+	return &throttledReader{reader: reader, schedule: transferSchedule}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > scheduleSlice {
+		p = p[:scheduleSlice]
+	}
+	t.schedule.wait(len(p))
+	return t.reader.Read(p)
+}
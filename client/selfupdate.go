@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxReleaseManifest bounds the release manifest and its signature.
+const maxReleaseManifest = 1 << 20
+
+// updateConfig is the update section of the config file, which every
+// profile shares:
+//
+//	update:
+//	  url: https://releases.example.com/file-upload/release.json
+//	  public_key: <base64 Ed25519 public key>
+type updateConfig struct {
+	URL       string `yaml:"url"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// releaseManifest is what the release URL serves, signed by the Ed25519
+// signature at <release URL>.sig: the current version, until when the
+// manifest may be trusted and, per "<GOOS>/<GOARCH>", where its binary is
+// and its SHA-256. Binary URLs may be relative to the release URL.
+// ExpiresAt keeps a replayed old manifest from being accepted forever; the
+// release process signs the manifest again before it expires.
+type releaseManifest struct {
+	Version   string                   `json:"version"`
+	ExpiresAt time.Time                `json:"expiresAt"`
+	Binaries  map[string]releaseBinary `json:"binaries"`
+}
+
+type releaseBinary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// runSelfUpdate replaces the running binary with the release the configured
+// release URL announces, once the manifest's signature and the binary's
+// checksum are verified and the new binary runs. Only newer releases are
+// installed unless -allow-downgrade is given, so that a replayed manifest of
+// an older release cannot roll clients back to it.
+func runSelfUpdate(args []string) {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := flags.Bool("check", false, "only report whether a newer version is released")
+	allowDowngrade := flags.Bool("allow-downgrade", false, "also install a release that is not newer than the running version, such as one rolled back to")
+	releaseURL := flags.String("url", "", "URL of the release manifest (default: update.url of the config file)")
+	publicKey := flags.String("public-key", "", "base64 Ed25519 key the manifest must be signed with (default: update.public_key of the config file)")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file self-update [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		failUsage()
+	}
+
+	config, err := loadUpdateConfig()
+	if err != nil {
+		fail("Error reading update settings", err)
+	}
+	if *releaseURL != "" {
+		config.URL = *releaseURL
+	}
+	if *publicKey != "" {
+		config.PublicKey = *publicKey
+	}
+	if config.URL == "" || config.PublicKey == "" {
+		failWith(exitCodeUsage, "Error: self-update needs a release URL and public key, from -url and -public-key or the update section of "+configPath)
+	}
+
+	manifest, err := fetchReleaseManifest(config)
+	if err != nil {
+		fail("Error checking for updates", err)
+	}
+	current := version()
+	install, err := installableRelease(manifest.Version, current, *allowDowngrade)
+	if err != nil {
+		failWith(exitCodeFailure, "Error: "+err.Error())
+	}
+	if !install {
+		if manifest.Version == current {
+			fmt.Println("Already up to date:", current)
+		} else {
+			fmt.Printf("Release %s is not newer than the running %s, keeping it; run with -allow-downgrade to install it anyway\n", manifest.Version, current)
+		}
+		return
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := manifest.Binaries[platform]
+	if !ok {
+		failWith(exitCodeFailure, fmt.Sprintf("Error: release %s has no binary for %s", manifest.Version, platform))
+	}
+	if *check {
+		fmt.Printf("Version %s is available (running %s)\n", manifest.Version, current)
+		return
+	}
+	binaryURL, err := resolveReleaseURL(config.URL, binary.URL)
+	if err != nil {
+		fail("Error reading release manifest", err)
+	}
+	if err := installRelease(binaryURL, binary.SHA256); err != nil {
+		fail("Error updating", err)
+	}
+	fmt.Printf("Updated from %s to %s\n", current, manifest.Version)
+}
+
+// loadUpdateConfig reads the update section of the config file, if there
+// is one.
+func loadUpdateConfig() (updateConfig, error) {
+	var config struct {
+		Update updateConfig `yaml:"update"`
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config.Update, nil
+	}
+	if err != nil {
+		return config.Update, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config.Update, fmt.Errorf("parsing %s: %w", configPath, err)
+	}
+	return config.Update, nil
+}
+
+// fetchReleaseManifest downloads the manifest and its signature and parses
+// the manifest only once the signature is verified.
+func fetchReleaseManifest(config updateConfig) (*releaseManifest, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.PublicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be a base64 encoded %d byte Ed25519 key", ed25519.PublicKeySize)
+	}
+	data, err := fetchReleaseFile(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := fetchReleaseFile(config.URL + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), data, signature) {
+		return nil, fmt.Errorf("signature of %s does not match the public key", config.URL)
+	}
+	var manifest releaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing release manifest: %w", err)
+	}
+	if manifest.Version == "" {
+		return nil, fmt.Errorf("release manifest has no version")
+	}
+	if manifest.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("release manifest has no expiresAt")
+	}
+	if time.Now().After(manifest.ExpiresAt) {
+		return nil, fmt.Errorf("release manifest expired at %s; it may be an old manifest replayed", manifest.ExpiresAt.Format(time.RFC3339))
+	}
+	return &manifest, nil
+}
+
+// installableRelease reports whether a release may replace the running
+// version: the same version never does, and older ones only with
+// allowDowngrade. Releases that cannot be ordered against it fail unless
+// allowDowngrade is set.
+func installableRelease(release, current string, allowDowngrade bool) (bool, error) {
+	if release == current {
+		return false, nil
+	}
+	if allowDowngrade {
+		return true, nil
+	}
+	order, ok := compareVersions(release, current)
+	if !ok {
+		return false, fmt.Errorf("cannot tell whether release %s is newer than the running %s; run with -allow-downgrade to install it anyway", release, current)
+	}
+	return order > 0, nil
+}
+
+// compareVersions orders release versions such as 1.4.0, v1.4.0 and
+// 1.5.0-rc.1 as semantic versions, returning -1, 0 or 1 as a is older than,
+// the same as or newer than b. Versions that are not of this form, such as
+// the revisions of development builds, cannot be ordered.
+func compareVersions(a, b string) (int, bool) {
+	aCore, aPre, aOK := parseVersion(a)
+	bCore, bPre, bOK := parseVersion(b)
+	if !aOK || !bOK {
+		return 0, false
+	}
+	for i := 0; i < len(aCore) || i < len(bCore); i++ {
+		var x, y int
+		if i < len(aCore) {
+			x = aCore[i]
+		}
+		if i < len(bCore) {
+			y = bCore[i]
+		}
+		if x != y {
+			return compareInts(x, y), true
+		}
+	}
+	// A pre-release comes before its release.
+	switch {
+	case aPre == bPre:
+		return 0, true
+	case aPre == "":
+		return 1, true
+	case bPre == "":
+		return -1, true
+	}
+	aFields, bFields := strings.Split(aPre, "."), strings.Split(bPre, ".")
+	for i := 0; i < len(aFields) && i < len(bFields); i++ {
+		if aFields[i] == bFields[i] {
+			continue
+		}
+		x, xErr := strconv.Atoi(aFields[i])
+		y, yErr := strconv.Atoi(bFields[i])
+		switch {
+		case xErr == nil && yErr == nil:
+			return compareInts(x, y), true
+		case xErr == nil:
+			return -1, true
+		case yErr == nil:
+			return 1, true
+		case aFields[i] < bFields[i]:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	return compareInts(len(aFields), len(bFields)), true
+}
+
+// parseVersion splits a version into its numeric components and its
+// pre-release, dropping a leading v and any build metadata.
+func parseVersion(v string) ([]int, string, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	core, pre := v, ""
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		core, pre = v[:i], v[i+1:]
+		if pre == "" {
+			return nil, "", false
+		}
+	}
+	parts := strings.Split(core, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || strings.HasPrefix(part, "+") {
+			return nil, "", false
+		}
+		numbers[i] = n
+	}
+	return numbers, pre, true
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func fetchReleaseFile(fileURL string) ([]byte, error) {
+	resp, err := http.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", fileURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxReleaseManifest))
+}
+
+func resolveReleaseURL(base, reference string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := baseURL.Parse(reference)
+	if err != nil {
+		return "", err
+	}
+	return resolved.String(), nil
+}
+
+// installRelease downloads the binary next to the running one, checks its
+// SHA-256, makes sure it runs, and puts it in place of the running binary.
+func installRelease(binaryURL, expectedHash string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return err
+	}
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	// The new binary is written to the same directory, so that renaming it
+	// over the running one cannot cross file systems.
+	download, err := ioutil.TempFile(filepath.Dir(executable), "."+filepath.Base(executable)+".update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(download.Name())
+	defer download.Close()
+	resp, err := http.Get(binaryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", binaryURL, resp.Status)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(download, hasher), resp.Body); err != nil {
+		return fmt.Errorf("downloading %s: %w", binaryURL, err)
+	}
+	if actual := fmt.Sprintf("%x", hasher.Sum(nil)); actual != strings.ToLower(expectedHash) {
+		return fmt.Errorf("%s has SHA-256 %s, not %s as the release manifest says: %w", binaryURL, actual, expectedHash, errHashMismatch)
+	}
+	if err := download.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(download.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+	if output, err := exec.Command(download.Name(), "-version").CombinedOutput(); err != nil {
+		return fmt.Errorf("new binary does not run: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if err := os.Rename(download.Name(), executable); err == nil {
+		return nil
+	}
+	// Windows cannot replace a running executable, but can rename it; the
+	// old binary is left as <name>.old until the next update.
+	old := executable + ".old"
+	os.Remove(old)
+	if err := os.Rename(executable, old); err != nil {
+		return err
+	}
+	if err := os.Rename(download.Name(), executable); err != nil {
+		os.Rename(old, executable)
+		return err
+	}
+	return nil
+}
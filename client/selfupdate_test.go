@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		order int
+		ok    bool
+	}{
+		{"1.4.0", "1.4.0", 0, true},
+		{"v1.4.0", "1.4.0", 0, true},
+		{"1.4.0", "v1.4.0", 0, true},
+		{"1.5.0", "1.4.9", 1, true},
+		{"1.4.10", "1.4.9", 1, true},
+		{"2.0.0", "10.0.0", -1, true},
+		{"1.4", "1.4.0", 0, true},
+		{"1.4", "1.4.1", -1, true},
+		{"1.4.0.1", "1.4", 1, true},
+		{"1", "0.9.9", 1, true},
+		{"1.5.0-rc.1", "1.5.0", -1, true},
+		{"1.5.0", "1.5.0-rc.1", 1, true},
+		{"1.5.0-rc.1", "1.4.9", 1, true},
+		{"1.5.0-rc.2", "1.5.0-rc.10", -1, true},
+		{"1.5.0-rc.1", "1.5.0-rc.1.1", -1, true},
+		{"1.5.0-1", "1.5.0-alpha", -1, true},
+		{"1.5.0-alpha", "1.5.0-beta", -1, true},
+		{"v1.5.0-rc.1", "1.5.0-rc.1", 0, true},
+		{"1.5.0+build.7", "1.5.0", 0, true},
+		{"1.5.0-rc.1+build.7", "1.5.0", -1, true},
+		{"1.4.0", "", 0, false},
+		{"1.4.0", "abc1234", 0, false},
+		{"1.4.0", "devel", 0, false},
+		{"1.4.x", "1.4.0", 0, false},
+		{"1..0", "1.0", 0, false},
+		{"1.4.0-", "1.4.0", 0, false},
+		{"-1.4.0", "1.4.0", 0, false},
+		{"1.-4.0", "1.4.0", 0, false},
+		{"1.+4.0", "1.4.0", 0, false},
+		{"vv1.4.0", "1.4.0", 0, false},
+	} {
+		order, ok := compareVersions(test.a, test.b)
+		if order != test.order || ok != test.ok {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d, %v", test.a, test.b, order, ok, test.order, test.ok)
+		}
+		if reverse, _ := compareVersions(test.b, test.a); test.ok && reverse != -test.order {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, reverse, -test.order)
+		}
+	}
+}
+
+func TestInstallableRelease(t *testing.T) {
+	for _, test := range []struct {
+		release, current string
+		allowDowngrade   bool
+		install, fails   bool
+	}{
+		{"1.5.0", "1.4.0", false, true, false},
+		{"1.5.0", "1.5.0-rc.2", false, true, false},
+		{"1.4.0", "1.4.0", false, false, false},
+		{"1.4.0", "1.4.0", true, false, false},
+		{"1.3.9", "1.4.0", false, false, false},
+		{"1.5.0-rc.1", "1.5.0", false, false, false},
+		{"v1.4.0", "1.4.0", false, false, false},
+		{"1.3.9", "1.4.0", true, true, false},
+		{"1.5.0", "abc1234", false, false, true},
+		{"1.5.0", "abc1234", true, true, false},
+	} {
+		install, err := installableRelease(test.release, test.current, test.allowDowngrade)
+		if install != test.install || (err != nil) != test.fails {
+			t.Errorf("installableRelease(%q, %q, %v) = %v, %v", test.release, test.current, test.allowDowngrade, install, err)
+		}
+	}
+}
+
+func TestFetchReleaseManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	var manifest, signature []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release.json":
+			w.Write(manifest)
+		case "/release.json.sig":
+			w.Write(signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	config := updateConfig{URL: server.URL + "/release.json", PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+	publish := func(release map[string]interface{}, key ed25519.PrivateKey) {
+		manifest, _ = json.Marshal(release)
+		signature = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+	}
+	binaries := map[string]interface{}{"linux/amd64": map[string]string{"url": "send_file-linux-amd64", "sha256": strings.Repeat("ab", 32)}}
+
+	publish(map[string]interface{}{"version": "1.5.0", "expiresAt": time.Now().Add(time.Hour), "binaries": binaries}, privateKey)
+	fetched, err := fetchReleaseManifest(config)
+	if err != nil || fetched.Version != "1.5.0" || fetched.Binaries["linux/amd64"].URL != "send_file-linux-amd64" {
+		t.Fatalf("fetching a current manifest: %+v, %v", fetched, err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		release map[string]interface{}
+		key     ed25519.PrivateKey
+		err     string
+	}{
+		{"expired", map[string]interface{}{"version": "1.5.0", "expiresAt": time.Now().Add(-time.Minute), "binaries": binaries}, privateKey, "expired"},
+		{"without expiry", map[string]interface{}{"version": "1.5.0", "binaries": binaries}, privateKey, "no expiresAt"},
+		{"without version", map[string]interface{}{"expiresAt": time.Now().Add(time.Hour), "binaries": binaries}, privateKey, "no version"},
+		{"signed with another key", map[string]interface{}{"version": "1.5.0", "expiresAt": time.Now().Add(time.Hour), "binaries": binaries}, otherKey, "signature"},
+	} {
+		publish(test.release, test.key)
+		if fetched, err := fetchReleaseManifest(config); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %+v, %v", test.name, fetched, err)
+		}
+	}
+
+	// A replayed manifest that is still valid but announces an older release
+	// is fetched, and then refused unless downgrades are allowed.
+	publish(map[string]interface{}{"version": "1.3.0", "expiresAt": time.Now().Add(time.Hour), "binaries": binaries}, privateKey)
+	fetched, err = fetchReleaseManifest(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if install, err := installableRelease(fetched.Version, "1.4.0", false); install || err != nil {
+		t.Errorf("older release: install %v, %v", install, err)
+	}
+	if install, _ := installableRelease(fetched.Version, "1.4.0", true); !install {
+		t.Error("older release refused with -allow-downgrade")
+	}
+
+	signature = []byte("not base64")
+	if _, err := fetchReleaseManifest(config); err == nil {
+		t.Error("fetched a manifest with a garbled signature")
+	}
+	if _, err := fetchReleaseManifest(updateConfig{URL: config.URL, PublicKey: "c2hvcnQ="}); err == nil {
+		t.Error("fetched a manifest with a short public key")
+	}
+}
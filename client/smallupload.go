@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"fileUpload/apiclient"
+)
+
+// smallUploadLimit is the largest file sent whole with POST /upload_small
+// instead of being registered, sent in chunks and completed; 0 always
+// uses chunks.
+var smallUploadLimit int64 = 1 << 20
+
+// smallUploadsUnsupported is set once the server answered that it has no
+// /upload_small, so that the remaining files of a run go straight to chunks.
+var smallUploadsUnsupported int32
+
+// errSmallUploadRefused means the server would not take the file in one
+// request and it should be uploaded in chunks instead.
+var errSmallUploadRefused = errors.New("single request upload refused")
+
+// useSmallUpload reports whether a file of size is sent in one request.
+// Uploads that are saved for resuming or deduplicated need a registration.
+func useSmallUpload(size int64) bool {
+	return smallUploadLimit > 0 && size <= smallUploadLimit && !resumable && resumeToken == "" && !dedupUploads &&
+		atomic.LoadInt32(&smallUploadsUnsupported) == 0
+}
+
+// uploadSmallFile sends file whole with POST /upload_small and returns the
+// ID it was stored under.
+func uploadSmallFile(file *os.File, filePath, remoteName string, fileInfo os.FileInfo, serverIP, serverPort string) (string, error) {
+	data := make([]byte, fileInfo.Size())
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, fileInfo.Size()), data); err != nil {
+		return "", fmt.Errorf("reading file: %w", err)
+	}
+
+	query := url.Values{"name": {remoteName}}
+	for key, value := range uploadTags {
+		query.Add("tag", key+"="+value)
+	}
+	request, err := http.NewRequest("POST", serverURL(serverIP, serverPort)+"/upload_small?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("File-Hash", fmt.Sprintf("%x", sha256.Sum256(data)))
+	if attributes := captureAttributes(filePath, fileInfo); attributes != nil {
+		encoded, err := json.Marshal(attributes)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("File-Attributes", string(encoded))
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("uploading file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		atomic.StoreInt32(&smallUploadsUnsupported, 1)
+		return "", errSmallUploadRefused
+	case http.StatusRequestEntityTooLarge:
+		return "", errSmallUploadRefused
+	default:
+		return "", fmt.Errorf("uploading file: %w", readServerError(resp))
+	}
+	var report apiclient.UploadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return "", fmt.Errorf("reading upload report: %w", err)
+	}
+	fmt.Println("File upload completed successfully")
+	fmt.Printf("Stored %d bytes in one request, available at %s\n", report.TotalBytes, report.URL)
+	return report.ID, nil
+}
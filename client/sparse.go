@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sparseUploads registers the holes of sparse files, such as VM disk images,
+// so that the server stores the chunks lying in them as holes instead of
+// receiving their zeros.
+var sparseUploads = true
+
+// minHoleSize is the smallest hole worth registering: no chunk is smaller
+// than the server's minimum chunk size.
+const minHoleSize = 100 * 1024
+
+// fileHole is a range of a file that reads as zeros without being stored.
+type fileHole struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// sparseHoles returns the holes of file that could cover a chunk, none where
+// the file system cannot tell or with -sparse=false.
+func sparseHoles(file *os.File, size int64) []fileHole {
+	if !sparseUploads {
+		return nil
+	}
+	holes, err := fileHoles(file, size)
+	if err != nil {
+		fmt.Printf("Error looking for holes, sending the whole file: %v\n", err)
+		return nil
+	}
+	kept := holes[:0]
+	var total int64
+	for _, hole := range holes {
+		if hole.Length >= minHoleSize {
+			kept = append(kept, hole)
+			total += hole.Length
+		}
+	}
+	if len(kept) > 0 {
+		fmt.Printf("File has %d hole(s) of %d bytes in all\n", len(kept), total)
+	}
+	return kept
+}
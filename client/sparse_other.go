@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "os"
+
+// fileHoles finds no holes where SEEK_HOLE is not available.
+func fileHoles(file *os.File, size int64) ([]fileHole, error) {
+	return nil, nil
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileHoles lists the holes of file with SEEK_DATA and SEEK_HOLE. File
+// systems without holes report the whole file as data.
+func fileHoles(file *os.File, size int64) ([]fileHole, error) {
+	defer file.Seek(0, io.SeekStart)
+	var holes []fileHole
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) || err == nil && data > size {
+			data = size
+		} else if err != nil {
+			return nil, err
+		}
+		if data > offset {
+			holes = append(holes, fileHole{Offset: offset, Length: data - offset})
+		}
+		if data >= size {
+			break
+		}
+		if offset, err = file.Seek(data, unix.SEEK_HOLE); err != nil {
+			return nil, err
+		}
+	}
+	return holes, nil
+}
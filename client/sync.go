@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// localFile is a regular file found under the synced directory.
+type localFile struct {
+	Path string
+	Size int64
+}
+
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be uploaded or deleted")
+	deleteRemote := flags.Bool("delete", false, "delete remote files that no longer exist locally")
+	prefix := flags.String("prefix", "", "remote name prefix for synced files (default: <dir name>/)")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file sync [flags] <dir> <server_ip> <server_port> [maxParallelUploads]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 1)
+	if len(args) != 3 && len(args) != 4 {
+		flags.Usage()
+		failUsage()
+	}
+
+	dir, serverIP, serverPort := args[0], args[1], args[2]
+	maxConcurrentUploads := 4
+	if len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n <= 0 {
+			failWith(exitCodeUsage, "Error: Invalid number for max concurrent uploads")
+		}
+		maxConcurrentUploads = n
+	}
+	remotePrefix := *prefix
+	if remotePrefix == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			fail("Error resolving directory", err)
+		}
+		remotePrefix = filepath.Base(abs) + "/"
+	}
+
+	if !*dryRun {
+		negotiateCapabilities(serverIP, serverPort)
+		defer endAPISession(serverIP, serverPort)
+		maxConcurrentUploads = applyAutoTune(serverIP, serverPort, maxConcurrentUploads)
+	}
+	if err := syncDirectory(dir, remotePrefix, serverIP, serverPort, maxConcurrentUploads, *dryRun, *deleteRemote); err != nil {
+		fail("Error syncing directory", err)
+	}
+}
+
+func syncDirectory(dir, remotePrefix, serverIP, serverPort string, maxConcurrentUploads int, dryRun, deleteRemote bool) error {
+	local, err := scanDirectory(dir, remotePrefix)
+	if err != nil {
+		return err
+	}
+	remoteFiles, err := listRemoteFiles(serverIP, serverPort, remotePrefix)
+	if err != nil {
+		return fmt.Errorf("listing remote files: %w", err)
+	}
+
+	// The listing is sorted by name and ID, so for names uploaded more than
+	// once the newest copy wins.
+	remote := make(map[string]FileMetadata)
+	for _, metadata := range remoteFiles {
+		remote[metadata.FileName] = metadata
+	}
+
+	names := make([]string, 0, len(local))
+	for remoteName := range local {
+		names = append(names, remoteName)
+	}
+	sort.Strings(names)
+
+	var uploaded, updated, deleted, unchanged, failed int
+	for _, remoteName := range names {
+		file := local[remoteName]
+		existing, ok := remote[remoteName]
+		if !ok {
+			fmt.Printf("upload  %s\n", remoteName)
+			if dryRun {
+				continue
+			}
+			if _, err := uploadFile(file.Path, remoteName, serverIP, serverPort, maxConcurrentUploads); err != nil {
+				fmt.Printf("Error uploading %s: %v\n", file.Path, err)
+				failed++
+				continue
+			}
+			uploaded++
+			continue
+		}
+
+		changed, err := fileDiffers(file, existing)
+		if err != nil {
+			fmt.Printf("Error hashing %s: %v\n", file.Path, err)
+			failed++
+			continue
+		}
+		if !changed {
+			unchanged++
+			continue
+		}
+		fmt.Printf("update  %s\n", remoteName)
+		if dryRun {
+			continue
+		}
+		if err := deltaUploadFile(file.Path, existing.ID, serverIP, serverPort); err != nil {
+			fmt.Printf("Error updating %s: %v\n", file.Path, err)
+			failed++
+			continue
+		}
+		updated++
+	}
+
+	if deleteRemote {
+		for _, metadata := range remoteFiles {
+			if _, ok := local[metadata.FileName]; ok && remote[metadata.FileName].ID == metadata.ID {
+				continue
+			}
+			fmt.Printf("delete  %s (%s)\n", metadata.FileName, metadata.ID)
+			if dryRun {
+				continue
+			}
+			if err := deleteRemoteFile(serverIP, serverPort, metadata.ID); err != nil {
+				fmt.Printf("Error deleting %s: %v\n", metadata.FileName, err)
+				failed++
+				continue
+			}
+			deleted++
+		}
+	}
+
+	if dryRun {
+		fmt.Println("Dry run, nothing was changed")
+		return nil
+	}
+	fmt.Printf("Sync finished: %d uploaded, %d updated, %d deleted, %d unchanged, %d failed\n", uploaded, updated, deleted, unchanged, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed to sync", failed)
+	}
+	return nil
+}
+
+// scanDirectory maps remote names to the regular, non-empty files under dir.
+func scanDirectory(dir, remotePrefix string) (map[string]localFile, error) {
+	files := make(map[string]localFile)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 {
+			fmt.Printf("Skipping empty file %s\n", path)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[remotePrefix+filepath.ToSlash(rel)] = localFile{Path: path, Size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// fileDiffers compares sizes first and only hashes the file when they match.
+func fileDiffers(file localFile, remote FileMetadata) (bool, error) {
+	if file.Size != remote.FileSize {
+		return true, nil
+	}
+	f, err := openSource(file.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hash, err := fileHashAs(f, remote.HashAlgorithm, remote.HashSegmentSize)
+	if err != nil {
+		return false, err
+	}
+	return fmt.Sprintf("%x", hash) != remote.FileHash, nil
+}
+
+func listRemoteFiles(serverIP, serverPort, prefix string) ([]FileMetadata, error) {
+	requestURL := fmt.Sprintf("%s/files?prefix=%s", serverURL(serverIP, serverPort), url.QueryEscape(prefix))
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var files []FileMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func deleteRemoteFile(serverIP, serverPort, fileID string) error {
+	url := fmt.Sprintf("%s/files/%s", serverURL(serverIP, serverPort), fileID)
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readServerError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// runTimeout is how long the whole run may take before the client gives
+	// up; 0 for no limit.
+	runTimeout time.Duration
+	// runStarted is when the run began, what runTimeout counts from.
+	runStarted = time.Now()
+)
+
+// startTimeout makes the client exit with exitCodeTimeout once runTimeout
+// has passed, whatever it is doing.
+func startTimeout() {
+	if runTimeout <= 0 {
+		return
+	}
+	time.AfterFunc(runTimeout-time.Since(runStarted), func() {
+		failWith(exitCodeTimeout, fmt.Sprintf("Error: gave up after -timeout %s; the server removes the unfinished upload at its deadline", runTimeout))
+	})
+}
+
+// runDeadline is the deadline registrations ask the server for, so that an
+// upload the client gave up on does not stay behind half sent; nil without
+// -timeout.
+func runDeadline() *time.Time {
+	if runTimeout <= 0 {
+		return nil
+	}
+	deadline := runStarted.Add(runTimeout).UTC()
+	return &deadline
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// otlpEndpoint is the URL of an OTLP/HTTP collector, such as
+	// http://localhost:4318, the spans of uploads are exported to; empty
+	// disables tracing.
+	otlpEndpoint string
+
+	tracer = otel.Tracer("fileUpload/client")
+	// stopTracing exports the spans not sent yet; the client calls it
+	// before it exits.
+	stopTracing = func() {}
+	// tracedTransport wraps a transport so that its requests are spans, once
+	// setupTracing ran; until then it returns the transport as is.
+	tracedTransport = func(next http.RoundTripper) http.RoundTripper { return next }
+
+	// traceContext holds the span of the upload phase in progress, which
+	// requests made without a span of their own are children of.
+	traceContext = context.Background()
+	traceMutex   = &sync.Mutex{}
+)
+
+// setupTracing exports spans to otlpEndpoint and makes every request of the
+// default transport a span that sends its trace context to the server in a
+// traceparent header.
+func setupTracing() error {
+	if otlpEndpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(otlpEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("invalid OTLP endpoint %q, expected a URL such as http://localhost:4318", otlpEndpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "file-upload-client"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracedTransport = func(next http.RoundTripper) http.RoundTripper {
+		return tracingTransport{otelhttp.NewTransport(next,
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return r.Method + " /" + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+			}))}
+	}
+	http.DefaultTransport = tracedTransport(http.DefaultTransport)
+	stopTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			fmt.Println("Error exporting spans:", err)
+		}
+	}
+	return nil
+}
+
+// tracingTransport makes requests without a span children of the upload
+// phase in progress.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(r.Context()).IsValid() {
+		traceMutex.Lock()
+		span := trace.SpanFromContext(traceContext)
+		traceMutex.Unlock()
+		r = r.WithContext(trace.ContextWithSpan(r.Context(), span))
+	}
+	return t.next.RoundTrip(r)
+}
+
+// startSpan starts a span, a child of the one in progress, that requests
+// are made under until the returned function ends it with the error the
+// span's work failed with, if any.
+func startSpan(name string, attributes ...attribute.KeyValue) func(error) {
+	traceMutex.Lock()
+	parent := traceContext
+	ctx, span := tracer.Start(parent, name, trace.WithAttributes(attributes...))
+	traceContext = ctx
+	traceMutex.Unlock()
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		traceMutex.Lock()
+		traceContext = parent
+		traceMutex.Unlock()
+	}
+}
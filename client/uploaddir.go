@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+
+	"fileUpload/apiclient"
+)
+
+// runUploadDir uploads a directory in one request, as a tar archive the
+// server unpacks into a stored file per regular file.
+func runUploadDir(args []string) {
+	flags := flag.NewFlagSet("upload-dir", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "remote name prefix for the uploaded files (default: <dir name>/)")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file upload-dir [flags] <dir> <server_ip> <server_port>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 1)
+	if len(args) != 3 {
+		flags.Usage()
+		failUsage()
+	}
+	dir, serverIP, serverPort := args[0], args[1], args[2]
+	remotePrefix := *prefix
+	if remotePrefix == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			fail("Error resolving directory", err)
+		}
+		remotePrefix = filepath.Base(abs) + "/"
+	}
+
+	if err := uploadDirectory(dir, remotePrefix, serverIP, serverPort); err != nil {
+		fail("Error uploading directory", err)
+	}
+}
+
+// uploadDirectory streams the regular, non-empty files under dir to
+// POST /upload_tar as a tar.gz archive, built as it is sent.
+func uploadDirectory(dir, remotePrefix, serverIP, serverPort string) error {
+	local, err := scanDirectory(dir, "")
+	if err != nil {
+		return err
+	}
+	if len(local) == 0 {
+		return fmt.Errorf("no files under %s", dir)
+	}
+	names := make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeDirectoryTar(writer, names, local))
+	}()
+	query := url.Values{"prefix": {remotePrefix}}
+	for key, value := range uploadTags {
+		query.Add("tag", key+"="+value)
+	}
+	resp, err := http.Post(serverURL(serverIP, serverPort)+"/upload_tar?"+query.Encode(), "application/gzip", reader)
+	reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readServerError(resp)
+	}
+
+	var result apiclient.TarUpload
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("reading upload result: %w", err)
+	}
+	for _, file := range result.Files {
+		fmt.Printf("stored  %s (%s)\n", file.FileName, file.ID)
+	}
+	for _, entry := range result.Skipped {
+		fmt.Printf("skipped %s: %s\n", entry.Name, entry.Error)
+	}
+	fmt.Printf("Upload finished: %d files, %d bytes stored, %d skipped\n", len(result.Files), result.TotalBytes, len(result.Skipped))
+	if len(result.Skipped) > 0 {
+		return fmt.Errorf("%d file(s) were not stored", len(result.Skipped))
+	}
+	return nil
+}
+
+// writeDirectoryTar writes the files as a tar.gz archive, each with the
+// attributes an upload would register.
+func writeDirectoryTar(w io.Writer, names []string, files map[string]localFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		if err := writeTarFile(tw, name, files[name]); err != nil {
+			return fmt.Errorf("adding %s: %w", files[name].Path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, local localFile) error {
+	file, err := openSource(local.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	attributes := captureAttributes(local.Path, info)
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(attributes.Mode),
+		Size:    info.Size(),
+		ModTime: *attributes.ModTime,
+		Uname:   attributes.User,
+		Gname:   attributes.Group,
+	}
+	if attributes.UID != nil {
+		header.Uid = *attributes.UID
+	}
+	if attributes.GID != nil {
+		header.Gid = *attributes.GID
+	}
+	for xattr, value := range attributes.Xattrs {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords["SCHILY.xattr."+xattr] = string(decoded)
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// A file growing while it is read is cut at the size in the header, one
+	// shrinking fails the archive.
+	_, err = io.CopyN(tw, file, info.Size())
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// clientVersion is the release of the client, set when building it with
+// -ldflags "-X main.clientVersion=1.4.0". Builds without it report the
+// module version or VCS revision they were built from.
+var clientVersion string
+
+// version returns clientVersion, or what the build info tells instead.
+func version() string {
+	if clientVersion != "" {
+		return clientVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	switch {
+	case revision == "":
+		return "dev"
+	case modified:
+		return revision + "-dirty"
+	}
+	return revision
+}
+
+// userAgent names the client, its version and platform in the form the
+// server records with every upload, e.g.
+// "file-upload-client/1.4.0 (linux/amd64; go1.20.3)".
+func userAgent() string {
+	return fmt.Sprintf("file-upload-client/%s (%s/%s; %s)", version(), runtime.GOOS, runtime.GOARCH, runtime.Version())
+}
+
+// userAgentTransport sends userAgent with every request that does not name
+// an agent of its own.
+type userAgentTransport struct {
+	agent string
+	next  http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("User-Agent") == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("User-Agent", t.agent)
+	}
+	return t.next.RoundTrip(r)
+}
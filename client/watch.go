@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchStateFile is the default state file, kept in the watched directory.
+const watchStateFile = ".fileupload-watch.json"
+
+// patternList collects a repeatable -include or -exclude flag.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	*p = append(*p, pattern)
+	return nil
+}
+
+// matches reports whether a pattern matches the slash-separated path relative
+// to the watched directory or its last element.
+func (p patternList) matches(rel string) bool {
+	for _, pattern := range p {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchState remembers what was uploaded for every remote name, so that
+// restarting the watcher does not upload unchanged files again.
+type watchState struct {
+	Files map[string]watchedFile `json:"files"`
+
+	path string
+}
+
+type watchedFile struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+func loadWatchState(path string) (*watchState, error) {
+	state := &watchState{Files: make(map[string]watchedFile), path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]watchedFile)
+	}
+	return state, nil
+}
+
+// save writes the state atomically.
+func (s *watchState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func runWatch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	debounce := flags.Duration("debounce", 2*time.Second, "wait until a file has not changed for this long before uploading it")
+	prefix := flags.String("prefix", "", "remote name prefix for uploaded files (default: <dir name>/)")
+	statePath := flags.String("state", "", "state file recording uploaded files (default: <dir>/"+watchStateFile+")")
+	var include, exclude patternList
+	flags.Var(&include, "include", "only upload files matching this pattern (repeatable)")
+	flags.Var(&exclude, "exclude", "never upload files or enter directories matching this pattern (repeatable)")
+	flags.Usage = func() {
+		fmt.Println("Usage: send_file watch [flags] <dir> <server_ip> <server_port> [maxParallelUploads]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = profileArgs(flags.Args(), 1)
+	if len(args) != 3 && len(args) != 4 {
+		flags.Usage()
+		failUsage()
+	}
+
+	dir, serverIP, serverPort := args[0], args[1], args[2]
+	maxConcurrentUploads := 4
+	if len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n <= 0 {
+			failWith(exitCodeUsage, "Error: Invalid number for max concurrent uploads")
+		}
+		maxConcurrentUploads = n
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		fail("Error resolving directory", err)
+	}
+	remotePrefix := *prefix
+	if remotePrefix == "" {
+		remotePrefix = filepath.Base(abs) + "/"
+	}
+	if *statePath == "" {
+		*statePath = filepath.Join(abs, watchStateFile)
+	}
+	state, err := loadWatchState(*statePath)
+	if err != nil {
+		fail("Error loading watch state", err)
+	}
+
+	w := &dirWatcher{
+		dir:                  abs,
+		remotePrefix:         remotePrefix,
+		serverIP:             serverIP,
+		serverPort:           serverPort,
+		maxConcurrentUploads: maxConcurrentUploads,
+		debounce:             *debounce,
+		include:              include,
+		exclude:              exclude,
+		state:                state,
+		timers:               make(map[string]*time.Timer),
+		ready:                make(chan string, 64),
+	}
+	if err := w.run(); err != nil {
+		fail("Error watching directory", err)
+	}
+}
+
+// dirWatcher uploads new and modified files under dir. Events for a file are
+// debounced so that a file being written is uploaded once it settles, and
+// uploads happen one file at a time in the order files settle.
+type dirWatcher struct {
+	dir                  string
+	remotePrefix         string
+	serverIP, serverPort string
+	maxConcurrentUploads int
+	debounce             time.Duration
+	include, exclude     patternList
+	state                *watchState
+
+	watcher *fsnotify.Watcher
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	ready   chan string
+}
+
+func (w *dirWatcher) run() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	w.watcher = watcher
+
+	go func() {
+		for path := range w.ready {
+			w.upload(path)
+		}
+	}()
+
+	// Watch before the initial scan so nothing written in between is missed;
+	// files seen twice are skipped by the state.
+	if err := w.addTree(w.dir, false); err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s, uploading to %s as %s...\n", w.dir, serverURL(w.serverIP, w.serverPort), w.remotePrefix)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("Watch error: %v\n", err)
+		}
+	}
+}
+
+func (w *dirWatcher) handle(event fsnotify.Event) {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		// Removed and renamed-away files stay on the server.
+		return
+	}
+	info, err := os.Lstat(event.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if event.Has(fsnotify.Create) {
+			// Files may have been created in the new directory before its
+			// watch was added, so they are scheduled as well.
+			if err := w.addTree(event.Name, true); err != nil {
+				fmt.Printf("Error watching %s: %v\n", event.Name, err)
+			}
+		}
+		return
+	}
+	w.schedule(event.Name)
+}
+
+// addTree watches root and every directory below it and queues the files it
+// contains, after the debounce delay if they may still be being written.
+func (w *dirWatcher) addTree(root string, debounce bool) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := w.relative(path)
+		if entry.IsDir() {
+			if path != w.dir && w.exclude.matches(rel) {
+				return filepath.SkipDir
+			}
+			return w.watcher.Add(path)
+		}
+		if debounce {
+			w.schedule(path)
+		} else {
+			w.ready <- path
+		}
+		return nil
+	})
+}
+
+// schedule queues path once no event has arrived for it for the debounce
+// delay.
+func (w *dirWatcher) schedule(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.timers[path]; ok {
+		timer.Reset(w.debounce)
+		return
+	}
+	w.timers[path] = time.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		delete(w.timers, path)
+		w.mu.Unlock()
+		w.ready <- path
+	})
+}
+
+func (w *dirWatcher) relative(path string) string {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// wanted filters out the state file, the client's own progress files and
+// files the patterns exclude.
+func (w *dirWatcher) wanted(path string) bool {
+	if path == w.state.path || path == w.state.path+".tmp" ||
+		strings.HasSuffix(path, ".upload.json") || strings.HasSuffix(path, ".upload.json.tmp") {
+		return false
+	}
+	rel := w.relative(path)
+	if w.exclude.matches(rel) {
+		return false
+	}
+	return len(w.include) == 0 || w.include.matches(rel)
+}
+
+// upload sends path unless the state shows it unchanged: files whose size and
+// modification time match are skipped without hashing, and files with a
+// matching hash are skipped too. Files uploaded before are updated in place
+// with a delta upload.
+func (w *dirWatcher) upload(path string) {
+	if !w.wanted(path) {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if info.Size() == 0 {
+		fmt.Printf("Skipping empty file %s\n", path)
+		return
+	}
+	remoteName := w.remotePrefix + w.relative(path)
+	previous, uploaded := w.state.Files[remoteName]
+	if uploaded && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+		return
+	}
+	file, err := openSource(path)
+	if err != nil {
+		fmt.Printf("Error opening %s: %v\n", path, err)
+		return
+	}
+	hash, err := calculateHash(file)
+	file.Close()
+	if err != nil {
+		fmt.Printf("Error hashing %s: %v\n", path, err)
+		return
+	}
+	current := watchedFile{ID: previous.ID, Size: info.Size(), ModTime: info.ModTime(), Hash: fmt.Sprintf("%x", hash)}
+
+	if !uploaded || previous.Hash != current.Hash {
+		uploadedID, err := w.send(path, remoteName, previous.ID)
+		if err != nil {
+			// The next change of the file, or the next start, tries again.
+			fmt.Printf("Error uploading %s: %v\n", path, err)
+			return
+		}
+		current.ID = uploadedID
+	}
+	w.state.Files[remoteName] = current
+	if err := w.state.save(); err != nil {
+		fmt.Printf("Error saving watch state: %v\n", err)
+	}
+}
+
+// send updates the stored file fileID with a delta upload, or uploads path
+// as a new file if there is none or the delta is refused.
+func (w *dirWatcher) send(path, remoteName, fileID string) (string, error) {
+	if fileID != "" {
+		fmt.Printf("update  %s\n", remoteName)
+		err := deltaUploadFile(path, fileID, w.serverIP, w.serverPort)
+		if err == nil {
+			return fileID, nil
+		}
+		fmt.Printf("Error updating %s, uploading it again: %v\n", remoteName, err)
+	}
+	fmt.Printf("upload  %s\n", remoteName)
+	return uploadFile(path, remoteName, w.serverIP, w.serverPort, w.maxConcurrentUploads)
+}
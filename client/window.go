@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sendWindow switches sendFileChunks to a sliding window of this many chunks:
+// a chunk is only sent while it is within sendWindow of the oldest chunk not
+// yet acknowledged, so the server receives chunks nearly in order while the
+// window keeps enough requests in flight to fill a long, fast link. 0 keeps
+// the plain parallel sender.
+var sendWindow int
+
+type chunkAck struct {
+	chunkNumber int
+	err         error
+}
+
+// sendWindowedChunks sends every chunk not yet marked as sent in state
+// through the sliding window, recording each acknowledged chunk there.
+func sendWindowedChunks(file *os.File, serverIP, serverPort, fileID string, chunkSize int, state *uploadState) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	totalChunks := int((fileInfo.Size() + int64(chunkSize) - 1) / int64(chunkSize))
+	// Every request in the window needs its own connection; without idle
+	// connections to reuse, each one would start a new TCP handshake.
+	if transport := baseTransport(); transport.MaxIdleConnsPerHost < sendWindow {
+		transport.MaxIdleConnsPerHost = sendWindow
+	}
+
+	reader := startChunkReader(file, chunkSize, state)
+	defer reader.close()
+	acks := make(chan chunkAck)
+	acked := make(map[int]bool)
+	base, next, inFlight := 1, 1, 0
+	var sendErr error
+	for {
+		for acked[base] {
+			delete(acked, base)
+			base++
+		}
+		if sendErr == nil && next <= totalChunks && next < base+sendWindow {
+			chunkNumber := next
+			next++
+			if state.isSent(chunkNumber) {
+				acked[chunkNumber] = true
+				continue
+			}
+			chunk, ok := <-reader.chunks
+			if !ok {
+				sendErr = reader.err
+				if sendErr == nil {
+					sendErr = fmt.Errorf("chunk %d is past the end of the file", chunkNumber)
+				}
+				continue
+			}
+			fmt.Printf("Preparing to send chunk %d (hash: %s), window %d-%d\n", chunk.number, chunk.hash, base, base+sendWindow-1)
+
+			waitWhilePaused()
+			inFlight++
+			go func() {
+				err := sendChunk(serverIP, serverPort, fileID, chunk.number, chunk.data, chunk.hash)
+				chunk.release()
+				acks <- chunkAck{chunk.number, err}
+			}()
+			continue
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		ack := <-acks
+		inFlight--
+		if ack.err != nil {
+			if sendErr == nil {
+				sendErr = fmt.Errorf("error sending chunk %d: %w", ack.chunkNumber, ack.err)
+			}
+			continue
+		}
+		state.markSent(ack.chunkNumber)
+		acked[ack.chunkNumber] = true
+	}
+	return sendErr
+}
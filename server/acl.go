@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Permissions that can be granted on a stored file. The owner holds all of
+// them and is the only one who can change the ACL.
+const (
+	permissionRead   = "read"
+	permissionWrite  = "write"
+	permissionDelete = "delete"
+)
+
+// everyone is the ACL principal matching every request, including anonymous
+// ones.
+const everyone = "*"
+
+// ACLEntry grants permissions on a file to a principal.
+type ACLEntry struct {
+	Principal   string   `json:"principal"`
+	Permissions []string `json:"permissions"`
+}
+
+// principalTokens maps bearer tokens to principal names. Requests without a
+// known token are anonymous; files they upload have no owner and stay
+// accessible to everyone, as before ACLs existed.
+var principalTokens = make(map[string]string)
+
+// loadPrincipals reads "<principal> <token>" lines; blank lines and lines
+// starting with # are ignored.
+func loadPrincipals(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || fields[0] == everyone {
+			return fmt.Errorf("line %d: expected \"<principal> <token>\"", line)
+		}
+		principalTokens[fields[1]] = fields[0]
+	}
+	return scanner.Err()
+}
+
+// requestPrincipal returns the principal authenticated by the bearer token of
+// r, or "" for anonymous requests. admin reports the admin role, which passes
+// every ACL check.
+func requestPrincipal(r *http.Request) (principal string, admin bool) {
+	principal, role := requestIdentity(r)
+	return principal, role == roleAdmin
+}
+
+// requestIdentity returns the principal of r and its role. The admin token
+// is admin. Requests without a bearer token may carry a login session, whose
+// principal keeps the role its LDAP groups granted unless one is assigned to
+// it. Session tokens from POST /v2/session do the same. With -oidc-issuer,
+// tokens that are neither in the principals file nor session tokens are
+// validated as tokens of the issuer. Requests with unknown tokens are
+// anonymous.
+func requestIdentity(r *http.Request) (principal, role string) {
+	token := bearerToken(r)
+	if token == "" {
+		if session, ok := requestSession(r); ok {
+			if role, ok := assignedRole(session.Principal); ok {
+				return session.Principal, role
+			}
+			role, _ := parseRole(session.Role)
+			return session.Principal, role
+		}
+		return "", principalRole("")
+	}
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return "", roleAdmin
+	}
+	principal, ok := principalTokens[token]
+	if !ok {
+		if session, valid := parseSessionToken(token); valid {
+			if role, assigned := assignedRole(session.Principal); assigned {
+				return session.Principal, role
+			}
+			role, _ := parseRole(session.Role)
+			return session.Principal, role
+		}
+	}
+	if !ok && oidc != nil {
+		var fresh bool
+		var err error
+		principal, fresh, err = oidc.principal(token)
+		if err != nil && fresh {
+			fmt.Printf("Rejected OIDC token from %s: %v\n", r.RemoteAddr, err)
+		}
+	}
+	return principal, principalRole(principal)
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func fileAllows(metadata FileMetadata, principal, permission string) bool {
+	if metadata.Owner == "" || (principal != "" && principal == metadata.Owner) {
+		return true
+	}
+	for _, entry := range metadata.ACL {
+		if entry.Principal != everyone && (principal == "" || entry.Principal != principal) {
+			continue
+		}
+		for _, granted := range entry.Permissions {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func canAccess(r *http.Request, metadata FileMetadata, permission string) bool {
+	principal, admin := requestPrincipal(r)
+	return admin || fileAllows(metadata, principal, permission)
+}
+
+// authorizeFile answers the request with 403 unless its principal holds
+// permission on the file.
+func authorizeFile(w http.ResponseWriter, r *http.Request, metadata FileMetadata, permission string) bool {
+	if canAccess(r, metadata, permission) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, codeAccessDenied, "Access denied")
+	return false
+}
+
+// fileACLHandler manages the shares of a stored file:
+//
+//	GET    /files/{id}/acl              owner and entries
+//	PUT    /files/{id}/acl/{principal}  grant {"permissions": [...]}, replacing earlier grants
+//	DELETE /files/{id}/acl/{principal}  revoke every grant
+//
+// Only the owner (or the admin token) may use them.
+func fileACLHandler(w http.ResponseWriter, r *http.Request, fileID, principal string) {
+	var grant ACLEntry
+	switch {
+	case r.Method == "GET" && principal == "", r.Method == "DELETE" && principal != "":
+	case r.Method == "PUT" && principal != "":
+		if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid grant: "+err.Error())
+			return
+		}
+		for _, permission := range grant.Permissions {
+			if permission != permissionRead && permission != permissionWrite && permission != permissionDelete {
+				writeError(w, http.StatusBadRequest, codeInvalidRequest, "Unknown permission: "+permission)
+				return
+			}
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET on /acl and PUT or DELETE on /acl/{principal} are allowed")
+		return
+	}
+
+	requester, admin := requestPrincipal(r)
+	mayManage := func(metadata FileMetadata) bool {
+		return admin || (metadata.Owner != "" && requester == metadata.Owner)
+	}
+	var metadata FileMetadata
+	var found bool
+	var err error
+	if r.Method == "GET" {
+		metadata, found, err = fileStore.Lookup(fileID)
+		if err == nil && found && !mayManage(metadata) {
+			err = errAccessDenied
+		}
+	} else {
+		found, err = fileStore.Update(fileID, func(stored *FileMetadata) (bool, error) {
+			if !mayManage(*stored) {
+				return false, errAccessDenied
+			}
+			stored.ACL = withoutPrincipal(stored.ACL, principal)
+			if len(grant.Permissions) > 0 {
+				stored.ACL = append(stored.ACL, ACLEntry{Principal: principal, Permissions: grant.Permissions})
+			}
+			metadata = *stored
+			return false, nil
+		})
+	}
+	switch {
+	case err == errAccessDenied:
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Only the owner can manage access to a file")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	case !found:
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if r.Method != "GET" {
+		audit(r, AuditEntry{Action: "acl_" + strings.ToLower(r.Method), FileID: fileID, FileName: metadata.FileName, Detail: "principal " + principal})
+	}
+	writeJSON(w, fileACL{Owner: metadata.Owner, Entries: aclEntries(metadata)})
+}
+
+type fileACL struct {
+	Owner   string     `json:"owner,omitempty"`
+	Entries []ACLEntry `json:"entries"`
+}
+
+func aclEntries(metadata FileMetadata) []ACLEntry {
+	if metadata.ACL == nil {
+		return []ACLEntry{}
+	}
+	return metadata.ACL
+}
+
+func withoutPrincipal(entries []ACLEntry, principal string) []ACLEntry {
+	var kept []ACLEntry
+	for _, entry := range entries {
+		if entry.Principal != principal {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// AppendDetails are the details of an append refused because Append-Offset
+// is not the size of the file, which the client can resume from.
+type AppendDetails struct {
+	FileSize int64 `json:"fileSize"`
+}
+
+// appendState is the state of the hashes of a stored file, saved so that an
+// append only hashes the appended bytes. It is kept in the file's metadata
+// as AppendState, and only used while it still gives FileHash and FileMD5.
+type appendState struct {
+	Hash []byte `json:"hash"`
+	MD5  []byte `json:"md5"`
+}
+
+var errAppendTruncated = errors.New("request body is shorter than Content-Length")
+
+// appendFileHandler serves POST /files/{id}/append: the body is added to
+// the end of a stored file, which keeps its ID, for logs shipped as they
+// grow. Each append is at most a chunk large. With "Append-Offset: <n>" it
+// is refused with 409 unless the file has n bytes, so that a retried append
+// is not stored twice. Appending needs the write permission.
+func appendFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, codeLengthRequired, "Content-Length is required for appends")
+		return
+	}
+	if r.ContentLength == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Nothing to append")
+		return
+	}
+	if r.ContentLength > int64(maxChunkSize) {
+		chunkTooLarge(w, maxChunkSize)
+		return
+	}
+	expectedSize := int64(-1)
+	if value := r.Header.Get("Append-Offset"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid Append-Offset")
+			return
+		}
+		expectedSize = size
+	}
+
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionWrite) {
+		return
+	}
+	// Plain files kept whole are appended to where they are; downloads of
+	// the previous version keep reading up to its size. Others are written
+	// again: the last chunk of an encrypted file would have to be sealed
+	// again under running downloads, and a hard-linked file is shared with
+	// its copies.
+	inPlace := false
+	if info, err := os.Stat(finalFilePath(metadata)); err == nil && !metadata.Encrypted {
+		inPlace = linkCount(info) == 1
+	}
+	endChange, readers := beginChange(fileID, inPlace)
+	if endChange == nil {
+		writeInUse(w, readers)
+		return
+	}
+	defer endChange()
+	// The file may have changed before the change began.
+	if metadata, ok, err = lookupFileInfo(fileID); err != nil || !ok {
+		writeError(w, http.StatusConflict, codeFileChanged, "Stored file changed before the append")
+		return
+	}
+	if expectedSize >= 0 && expectedSize != metadata.FileSize {
+		writeErrorDetails(w, http.StatusConflict, codeConflict,
+			fmt.Sprintf("File has %d bytes, not %d", metadata.FileSize, expectedSize), AppendDetails{FileSize: metadata.FileSize})
+		return
+	}
+	updated := metadata
+	updated.FileSize += r.ContentLength
+	if maxFileSize > 0 && updated.FileSize > maxFileSize {
+		writeLimitError(w, http.StatusRequestEntityTooLarge, codeFileTooLarge, LimitHints{
+			Error:       fmt.Sprintf("file size %d exceeds the maximum of %d bytes", updated.FileSize, maxFileSize),
+			MaxFileSize: maxFileSize,
+		})
+		return
+	}
+
+	hasher, md5Hasher, err := appendHashers(metadata)
+	if err != nil {
+		fmt.Println("Error hashing stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading stored file")
+		return
+	}
+	transfer := newTransferHashes(r.Header)
+	body := io.TeeReader(io.LimitReader(r.Body, r.ContentLength), io.MultiWriter(hasher, md5Hasher, transfer.writer()))
+	var digestErr error
+	verify := func() error {
+		digestErr = verifyTransferDigests(r.Header, transfer.sums())
+		return digestErr
+	}
+	if inPlace {
+		err = appendInPlace(metadata, body, r.ContentLength, verify)
+	} else {
+		err = appendRewrite(metadata, &updated, body, verify)
+	}
+	if err != nil && err == digestErr {
+		writeError(w, http.StatusBadRequest, codeDigestMismatch, err.Error())
+		return
+	}
+	if err == errAppendTruncated {
+		writeError(w, http.StatusBadRequest, codeChunkTruncated, "Request body is shorter than Content-Length")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error appending to stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error appending to stored file")
+		return
+	}
+
+	updated.FileHash = fmt.Sprintf("%x", hasher.Sum(nil))
+	updated.FileMD5 = base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil))
+	updated.AppendState = saveAppendState(hasher, md5Hasher)
+	if updated.ChunkSize > 0 {
+		updated.TotalChunks = int(math.Ceil(float64(updated.FileSize) / float64(updated.ChunkSize)))
+	}
+	updated.Integrity, updated.Processing, updated.Media = nil, nil, nil
+	if err := updateFileInfoDB(updated); err != nil {
+		if inPlace {
+			os.Truncate(finalFilePath(metadata), metadata.FileSize)
+		}
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	indexStoredFile(updated)
+	generateThumbnails(updated)
+	extractMediaInfo(updated)
+	indexFileText(updated)
+	postProcess(updated)
+	queueErasureCoding(updated)
+	audit(r, AuditEntry{Action: "append", FileID: updated.ID, FileName: updated.FileName, Size: updated.FileSize,
+		Detail: fmt.Sprintf("%d bytes appended", r.ContentLength)})
+
+	response, err := json.Marshal(updated.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf("%q", updated.FileHash))
+	w.Write(response)
+}
+
+// appendInPlace writes size bytes from body at the end of a plain stored
+// file and keeps them if verify accepts them. Bytes past the recorded size,
+// left by an append that failed, are dropped first; the appended bytes are
+// dropped again on error.
+func appendInPlace(metadata FileMetadata, body io.Reader, size int64, verify func() error) error {
+	file, err := os.OpenFile(finalFilePath(metadata), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = file.Truncate(metadata.FileSize)
+	if err == nil {
+		_, err = file.Seek(metadata.FileSize, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.CopyN(file, body, size)
+		if err == io.EOF {
+			err = errAppendTruncated
+		}
+	}
+	if err == nil {
+		err = verify()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Truncate(metadata.FileSize)
+	}
+	return err
+}
+
+// appendRewrite writes the stored file and the appended bytes to a staged
+// file, under a new data key if the file is encrypted, which replaces the
+// stored file if verify accepts the appended bytes.
+func appendRewrite(metadata FileMetadata, updated *FileMetadata, body io.Reader, verify func() error) error {
+	if updated.Encrypted {
+		var err error
+		if updated.WrappedKey, err = newWrappedDataKey(); err != nil {
+			return fmt.Errorf("generating data key: %v", err)
+		}
+	}
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+	stagedPath := finalFilePath(*updated) + ".append"
+	defer os.Remove(stagedPath)
+	stored, err := writeStoredFile(stagedPath, *updated, io.MultiReader(content, body), "")
+	if err != nil {
+		return err
+	}
+	if stored.Size != updated.FileSize {
+		return errAppendTruncated
+	}
+	if err := verify(); err != nil {
+		return err
+	}
+	return os.Rename(stagedPath, finalFilePath(*updated))
+}
+
+// appendHashers returns the hashes of a stored file so far, restored from
+// its AppendState or, without one that matches, computed by reading it.
+func appendHashers(metadata FileMetadata) (hash.Hash, hash.Hash, error) {
+	hasher, md5Hasher := newFileHasher(metadata), md5.New()
+	var state appendState
+	if data, err := base64.StdEncoding.DecodeString(metadata.AppendState); err == nil && json.Unmarshal(data, &state) == nil &&
+		hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Hash) == nil &&
+		md5Hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.MD5) == nil &&
+		fmt.Sprintf("%x", hasher.Sum(nil)) == metadata.FileHash &&
+		base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil)) == metadata.FileMD5 {
+		return hasher, md5Hasher, nil
+	}
+	hasher, md5Hasher = newFileHasher(metadata), md5.New()
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeFile()
+	if _, err := copyPooled(io.MultiWriter(hasher, md5Hasher), content); err != nil {
+		return nil, nil, err
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != metadata.FileHash {
+		return nil, nil, errStoredHashMismatch
+	}
+	return hasher, md5Hasher, nil
+}
+
+func saveAppendState(hasher, md5Hasher hash.Hash) string {
+	hashState, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	md5State, err := md5Hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	data, _ := json.Marshal(appendState{Hash: hashState, MD5: md5State})
+	return base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// archiveEntry describes one stored file inside a download archive. The list
+// of entries is also written to the archive as manifest.json.
+type archiveEntry struct {
+	ID       string `json:"id"`
+	FileName string `json:"fileName"`
+	Path     string `json:"path"`
+	FileSize int64  `json:"fileSize"`
+	FileHash string `json:"fileHash"`
+	// HashAlgorithm and HashSegmentSize tell how FileHash was computed.
+	HashAlgorithm   string `json:"hashAlgorithm,omitempty"`
+	HashSegmentSize int64  `json:"hashSegmentSize,omitempty"`
+	// Attributes keep what the zip format has no room for, such as the
+	// owner and extended attributes.
+	Attributes *FileAttributes `json:"attributes,omitempty"`
+
+	metadata FileMetadata
+}
+
+const archiveManifestName = "manifest.json"
+
+// downloadArchiveHandler streams several stored files, given by id or as the
+// directory they are stored under, as a single zip or tar.gz archive. The
+// archive is written straight to the response; nothing is staged on disk.
+func downloadArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received archive download request for:", r.URL.String())
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if len(ids) > 0 && prefix != "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Give either file ids or a prefix")
+		return
+	}
+	if prefix != "" {
+		var err error
+		if ids, err = directoryFileIDs(r, prefix); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+			return
+		}
+		if len(ids) == 0 {
+			writeError(w, http.StatusNotFound, codeFileNotFound, "No files under "+prefix)
+			return
+		}
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "No file ids given")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar.gz" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Unsupported archive format: "+format)
+		return
+	}
+
+	entries, err := archiveEntries(r, ids)
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeFileNotFound, err.Error())
+		return
+	}
+
+	fileName := "files_" + generateUniqueID() + "." + format
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZipArchive(w, entries)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGzArchive(w, entries)
+	}
+	if err != nil {
+		// Headers are already sent, so the client only sees a truncated archive.
+		fmt.Println("Error streaming archive:", err)
+	}
+}
+
+// directoryFileIDs returns the files r can read under the directory prefix,
+// such as a directory stored with sync, sorted by name. Of a name uploaded
+// more than once only the newest copy is kept, as sync does.
+func directoryFileIDs(r *http.Request, prefix string) ([]string, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		return nil, err
+	}
+	newest := make(map[string]FileMetadata)
+	for _, metadata := range fileInfos {
+		if !strings.HasPrefix(metadata.FileName, prefix) || !canAccess(r, metadata, permissionRead) {
+			continue
+		}
+		if current, ok := newest[metadata.FileName]; !ok || metadata.ID > current.ID {
+			newest[metadata.FileName] = metadata
+		}
+	}
+	names := make([]string, 0, len(newest))
+	for name := range newest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = newest[name].ID
+	}
+	return ids, nil
+}
+
+// archiveEntries resolves ids to stored files readable by r and picks a
+// unique path for each one inside the archive.
+func archiveEntries(r *http.Request, ids []string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	usedPaths := make(map[string]bool)
+	for _, id := range ids {
+		metadata, ok, err := lookupFileInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || !canAccess(r, metadata, permissionRead) {
+			return nil, fmt.Errorf("File not found: %s", id)
+		}
+
+		path := metadata.FileName
+		if usedPaths[path] {
+			path = metadata.ID + "_" + metadata.FileName
+		}
+		usedPaths[path] = true
+
+		entries = append(entries, archiveEntry{
+			ID:       metadata.ID,
+			FileName: metadata.FileName,
+			Path:     path,
+			FileSize: metadata.FileSize,
+			FileHash: metadata.FileHash,
+
+			HashAlgorithm:   metadata.HashAlgorithm,
+			HashSegmentSize: metadata.HashSegmentSize,
+			Attributes:      metadata.Attributes,
+			metadata:        metadata,
+		})
+	}
+	return entries, nil
+}
+
+func writeZipArchive(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		entryWriter, err := zw.CreateHeader(zipFileHeader(entry.Path, entry.metadata))
+		if err != nil {
+			return err
+		}
+		if err := copyStoredFile(entryWriter, entry); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestWriter, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     archiveManifestName,
+		Method:   zip.Deflate,
+		Modified: timeNow(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := manifestWriter.Write(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeTarGzArchive(w io.Writer, entries []archiveEntry) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(tarFileHeader(entry.Path, entry.metadata)); err != nil {
+			return err
+		}
+		if err := copyStoredFile(tw, entry); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    archiveManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: timeNow(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyStoredFile copies exactly entry.FileSize bytes of the stored file so the
+// size announced in the archive header always matches the data written.
+func copyStoredFile(w io.Writer, entry archiveEntry) error {
+	file, err := openDownload(entry.metadata)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	content, err := storedFileReader(file, entry.metadata)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(content, entry.FileSize))
+	if err != nil {
+		return err
+	}
+	if n != entry.FileSize {
+		return fmt.Errorf("stored file %s is shorter than recorded size", entry.ID)
+	}
+	return nil
+}
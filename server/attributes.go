@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	maxXattrNameLen = 255
+	// maxXattrsSize bounds the names and values of a file's extended
+	// attributes together, the limit of ext4 for one file.
+	maxXattrsSize = 64 * 1024
+)
+
+// FileAttributes are the attributes of the client's file besides its
+// content, which downloads and archives restore.
+type FileAttributes struct {
+	ModTime *time.Time `json:"modTime,omitempty"`
+	// Mode holds the Unix permission bits, including setuid, setgid and
+	// sticky.
+	Mode  uint32 `json:"mode,omitempty"`
+	UID   *int   `json:"uid,omitempty"`
+	GID   *int   `json:"gid,omitempty"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Xattrs are the extended attributes by name, with base64 values.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+// checkAttributes refuses modes beyond the permission bits, negative ids
+// and extended attributes that are not base64 or too large.
+func checkAttributes(attributes *FileAttributes) error {
+	if attributes == nil {
+		return nil
+	}
+	if attributes.Mode > 07777 {
+		return fmt.Errorf("Mode %o has bits beyond the permissions", attributes.Mode)
+	}
+	if attributes.UID != nil && *attributes.UID < 0 || attributes.GID != nil && *attributes.GID < 0 {
+		return fmt.Errorf("User and group ids cannot be negative")
+	}
+	size := 0
+	for name, value := range attributes.Xattrs {
+		if name == "" || len(name) > maxXattrNameLen {
+			return fmt.Errorf("Extended attribute names must have 1 to %d bytes", maxXattrNameLen)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("Value of extended attribute %s is not base64", name)
+		}
+		size += len(name) + len(decoded)
+	}
+	if size > maxXattrsSize {
+		return fmt.Errorf("Extended attributes take more than %d bytes", maxXattrsSize)
+	}
+	return nil
+}
+
+// archiveModTime is the modification time an archive gives the file: the
+// client's, when it sent one.
+func archiveModTime(metadata FileMetadata) time.Time {
+	if metadata.Attributes != nil && metadata.Attributes.ModTime != nil {
+		return *metadata.Attributes.ModTime
+	}
+	return timeNow()
+}
+
+// archiveMode is the permission bits an archive gives the file.
+func archiveMode(metadata FileMetadata) uint32 {
+	if metadata.Attributes != nil && metadata.Attributes.Mode != 0 {
+		return metadata.Attributes.Mode
+	}
+	return 0644
+}
+
+// zipFileHeader describes the file in a zip archive, which only keeps its
+// modification time and mode.
+func zipFileHeader(path string, metadata FileMetadata) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:               path,
+		Method:             zip.Deflate,
+		Modified:           archiveModTime(metadata),
+		UncompressedSize64: uint64(metadata.FileSize),
+	}
+	header.SetMode(fileMode(archiveMode(metadata)))
+	return header
+}
+
+// tarFileHeader describes the file in a tar archive with all of its
+// attributes, the extended ones as SCHILY.xattr records as GNU tar and
+// bsdtar read them.
+func tarFileHeader(path string, metadata FileMetadata) *tar.Header {
+	header := &tar.Header{
+		Name:    path,
+		Mode:    int64(archiveMode(metadata)),
+		Size:    metadata.FileSize,
+		ModTime: archiveModTime(metadata),
+	}
+	attributes := metadata.Attributes
+	if attributes == nil {
+		return header
+	}
+	if attributes.UID != nil {
+		header.Uid = *attributes.UID
+	}
+	if attributes.GID != nil {
+		header.Gid = *attributes.GID
+	}
+	header.Uname, header.Gname = attributes.User, attributes.Group
+	for name, value := range attributes.Xattrs {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords["SCHILY.xattr."+name] = string(decoded)
+	}
+	if header.PAXRecords != nil {
+		header.Format = tar.FormatPAX
+	}
+	return header
+}
+
+// tarAttributes reads the attributes of a file from its tar header, the
+// reverse of tarFileHeader. Tar has no way to leave the owner out, so a
+// user or group of id 0 without a name counts as none.
+func tarAttributes(header *tar.Header) *FileAttributes {
+	modTime := header.ModTime.UTC()
+	attributes := &FileAttributes{
+		ModTime: &modTime,
+		Mode:    uint32(header.Mode & 07777),
+		User:    header.Uname,
+		Group:   header.Gname,
+	}
+	if uid := header.Uid; uid != 0 || header.Uname != "" {
+		attributes.UID = &uid
+	}
+	if gid := header.Gid; gid != 0 || header.Gname != "" {
+		attributes.GID = &gid
+	}
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, "SCHILY.xattr."); name != key {
+			if attributes.Xattrs == nil {
+				attributes.Xattrs = make(map[string]string)
+			}
+			attributes.Xattrs[name] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	return attributes
+}
+
+// fileMode converts Unix permission bits to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
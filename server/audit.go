@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log: who did what, when, to which file.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	FileID   string    `json:"fileId,omitempty"`
+	FileName string    `json:"fileName,omitempty"`
+	GroupID  string    `json:"groupId,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Chunks   int       `json:"chunks,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	// UserAgent is the User-Agent of the request, which names the client
+	// build that made it.
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+var (
+	// auditLogPath enables the append-only audit log of all mutations. When
+	// the file grows past auditMaxSize it is rotated to <path>.1, <path>.2, ...
+	// keeping auditKeep old files.
+	auditLogPath string
+	auditMaxSize int64 = 10 << 20
+	auditKeep          = 5
+	auditMutex         = &sync.Mutex{}
+
+	// adminToken protects the /admin/ endpoints; they are disabled without it.
+	adminToken string
+)
+
+// requestActor identifies who made a request. Uploads are anonymous, so the
+// client address is the best available identity.
+func requestActor(r *http.Request) string {
+	if r == nil {
+		return "server"
+	}
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// audit appends an entry for a mutation made by r, or by the server itself
+// when r is nil. Failing to write the log does not fail the request.
+func audit(r *http.Request, entry AuditEntry) {
+	if auditLogPath == "" {
+		return
+	}
+	entry.Time = timeNow().UTC()
+	entry.Actor = requestActor(r)
+	if r != nil {
+		entry.UserAgent = requestUserAgent(r)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error encoding audit entry:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if info, err := os.Stat(auditLogPath); err == nil && info.Size()+int64(len(line)) > auditMaxSize {
+		rotateAuditLog()
+	}
+	logFile, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Println("Error opening audit log:", err)
+		return
+	}
+	defer logFile.Close()
+	if _, err := logFile.Write(line); err != nil {
+		fmt.Println("Error writing audit log:", err)
+	}
+}
+
+// rotateAuditLog shifts <path>.n to <path>.n+1, dropping the oldest; the
+// caller must hold auditMutex.
+func rotateAuditLog() {
+	os.Remove(fmt.Sprintf("%s.%d", auditLogPath, auditKeep))
+	for n := auditKeep - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", auditLogPath, n), fmt.Sprintf("%s.%d", auditLogPath, n+1))
+	}
+	if auditKeep > 0 {
+		os.Rename(auditLogPath, auditLogPath+".1")
+	} else {
+		os.Remove(auditLogPath)
+	}
+}
+
+// requireAdmin checks that an /admin/ request comes from the admin role: the
+// admin token, an admin login session or an admin principal. It answers the
+// request if not.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	principal, role := requestIdentity(r)
+	if role == roleAdmin {
+		return true
+	}
+	if adminToken == "" && ldapURL == "" && !anyAdmin() {
+		writeError(w, http.StatusNotFound, codeNotFound, "Admin endpoints are disabled")
+		return false
+	}
+	if principal != "" {
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Requires the admin role")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid admin token")
+	return false
+}
+
+// auditHandler serves GET /admin/audit. Entries are returned oldest first
+// and can be filtered with ?action=, ?fileId=, ?actor=, ?since=<RFC 3339>
+// and ?userAgent=, which matches part of it such as a client version;
+// ?limit= (default 1000) keeps the most recent matches.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	if auditLogPath == "" {
+		writeError(w, http.StatusNotFound, codeNotFound, "Audit log is disabled")
+		return
+	}
+
+	query := r.URL.Query()
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid since, expected RFC 3339")
+			return
+		}
+	}
+	limit := 1000
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+			return
+		}
+	}
+
+	entries := []AuditEntry{}
+	auditMutex.Lock()
+	for n := auditKeep; n >= 0; n-- {
+		path := auditLogPath
+		if n > 0 {
+			path = fmt.Sprintf("%s.%d", auditLogPath, n)
+		}
+		entries = appendAuditEntries(entries, path, func(entry AuditEntry) bool {
+			return entry.Time.After(since) &&
+				(query.Get("action") == "" || entry.Action == query.Get("action")) &&
+				(query.Get("fileId") == "" || entry.FileID == query.Get("fileId")) &&
+				(query.Get("actor") == "" || entry.Actor == query.Get("actor")) &&
+				strings.Contains(entry.UserAgent, query.Get("userAgent"))
+		})
+	}
+	auditMutex.Unlock()
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	response, err := json.Marshal(entries)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func appendAuditEntries(entries []AuditEntry, path string, match func(AuditEntry) bool) []AuditEntry {
+	logFile, err := os.Open(path)
+	if err != nil {
+		return entries
+	}
+	defer logFile.Close()
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
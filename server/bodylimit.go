@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// maxJSONBody is the largest body accepted by endpoints that take JSON
+	// or no body at all.
+	maxJSONBody int64 = 1 << 20
+	// maxRegistrationBody is the largest registration with -dedup-chunks,
+	// which may list the hash of every chunk: about a million of them.
+	maxRegistrationBody int64 = 64 << 20
+)
+
+// bodyLimit is the largest body r may have and the error code to refuse a
+// larger one with, 0 for no limit. Chunks and probe bursts are bound by the
+// largest chunk size, single request uploads by -small-upload-limit,
+// requests writing file data by the largest file size, and every other
+// request is expected to carry JSON at most. Tar uploads hold any number of
+// files, each of which is checked against the largest file size as it
+// comes.
+func bodyLimit(r *http.Request) (int64, string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "upload_chunk", parts[0] == "probe", parts[0] == "files" && len(parts) == 3 && parts[2] == "append":
+		return int64(maxChunkSize), codeChunkTooLarge
+	case parts[0] == "delta_upload", parts[0] == "files" && len(parts) == 2 && (r.Method == "PUT" || r.Method == "PATCH"):
+		return maxFileSize, codeFileTooLarge
+	case parts[0] == "upload_small" && smallUploadLimit > 0:
+		return smallUploadLimit, codeFileTooLarge
+	case parts[0] == "upload_tar":
+		return 0, ""
+	case dedupChunks && (parts[0] == "register_file" || parts[0] == "register_group"):
+		return maxRegistrationBody, codeBodyTooLarge
+	}
+	return maxJSONBody, codeBodyTooLarge
+}
+
+// withBodyLimit answers requests whose Content-Length exceeds the limit of
+// their endpoint with 413 before a handler reads anything, and cuts bodies
+// of unknown length off at the limit, so that no request can make the
+// server buffer or store more than its endpoint allows.
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, code := bodyLimit(r)
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			hints := LimitHints{Error: fmt.Sprintf("request body of %d bytes exceeds the maximum of %d bytes", r.ContentLength, limit), MaxBodySize: limit}
+			switch code {
+			case codeChunkTooLarge:
+				hints.MaxChunkSize, hints.SuggestedChunkSize = int(limit), int(limit)
+			case codeFileTooLarge:
+				hints.MaxFileSize = limit
+			}
+			writeLimitError(w, http.StatusRequestEntityTooLarge, code, hints)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the buffer used for copies that do not go through whole
+// chunks. The 32 KiB default of io.Copy turns a multi-GB copy into hundreds
+// of thousands of small reads and writes.
+const copyBufferSize = 1 << 20
+
+// bufferPool recycles the chunk-sized and copy buffers of assembly and stored
+// file writes, so completing large uploads does not allocate a fresh buffer
+// for every chunk.
+var bufferPool sync.Pool
+
+// getBuffer returns a pooled buffer of size bytes.
+func getBuffer(size int) *[]byte {
+	if pooled, ok := bufferPool.Get().(*[]byte); ok {
+		if cap(*pooled) >= size {
+			*pooled = (*pooled)[:size]
+			return pooled
+		}
+		bufferPool.Put(pooled)
+	}
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+func putBuffer(buffer *[]byte) {
+	if buffer != nil {
+		bufferPool.Put(buffer)
+	}
+}
+
+// copyPooled is io.Copy with a pooled copyBufferSize buffer. Like io.Copy it
+// lets *os.File use copy_file_range or sendfile where the kernel can.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := getBuffer(copyBufferSize)
+	defer putBuffer(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
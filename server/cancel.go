@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cancelRetention is how long a cancelled upload is remembered, so that
+// chunks still in flight get 410 Gone instead of looking like chunks of an
+// unknown upload.
+const cancelRetention = time.Hour
+
+var (
+	// cancelledUploads maps cancelled uploads to the error code requests
+	// for them get: UPLOAD_CANCELLED, or DEADLINE_EXCEEDED for uploads the
+	// server aborted.
+	cancelledUploads = make(map[string]string)
+	cancelMutex      = &sync.Mutex{}
+)
+
+// cancelUploadHandler serves DELETE /upload/{id}: it drops an upload in
+// progress and its chunks. Cancelling an upload that was already cancelled
+// succeeds again; members of an upload group are cancelled with their group
+// through DELETE /groups/{id}.
+func cancelUploadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received cancel request for:", r.URL.Path)
+	if r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only DELETE method is allowed")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 || !validFileID(parts[2]) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid URL")
+		return
+	}
+	fileID := parts[2]
+
+	metadataMutex.Lock()
+	metadata, ok := filesMetadata[fileID]
+	switch {
+	case !ok:
+		metadataMutex.Unlock()
+		if uploadCancelled(fileID) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+		return
+	case !canAccess(r, metadata, permissionDelete):
+		metadataMutex.Unlock()
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Access denied")
+		return
+	case metadata.GroupID != "":
+		metadataMutex.Unlock()
+		writeError(w, http.StatusConflict, codeConflict, "Upload belongs to group "+metadata.GroupID+", cancel the group instead")
+		return
+	case completingUploads[fileID]:
+		metadataMutex.Unlock()
+		writeError(w, http.StatusConflict, codeCompletionInProgress, "Upload is being completed")
+		return
+	}
+	delete(filesMetadata, fileID)
+	markCancelled(fileID, codeUploadCancelled)
+	metadataMutex.Unlock()
+
+	os.RemoveAll(uploadTmpDir(fileID))
+	forgetTransfer(fileID)
+	fmt.Println("Cancelled upload:", fileID)
+	audit(r, AuditEntry{Action: "cancel", FileID: fileID, FileName: metadata.FileName, Size: metadata.FileSize})
+	publishEvent(r, eventUploadFailed, metadata, "cancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func markCancelled(fileID, code string) {
+	cancelMutex.Lock()
+	cancelledUploads[fileID] = code
+	cancelMutex.Unlock()
+	time.AfterFunc(cancelRetention, func() {
+		cancelMutex.Lock()
+		delete(cancelledUploads, fileID)
+		cancelMutex.Unlock()
+	})
+}
+
+func uploadCancelled(fileID string) bool {
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+	return cancelledUploads[fileID] != ""
+}
+
+// rejectCancelled answers requests for a cancelled upload with 410 Gone and
+// reports whether it did.
+func rejectCancelled(w http.ResponseWriter, fileID string) bool {
+	cancelMutex.Lock()
+	code := cancelledUploads[fileID]
+	cancelMutex.Unlock()
+	switch code {
+	case "":
+		return false
+	case codeDeadlineExceeded:
+		writeError(w, http.StatusGone, code, "Upload was aborted at its deadline")
+	default:
+		writeError(w, http.StatusGone, code, "Upload was cancelled")
+	}
+	return true
+}
+
+// discardIfCancelled removes what a request still in flight while its upload
+// was cancelled stored after the cleanup, and answers it like rejectCancelled.
+func discardIfCancelled(w http.ResponseWriter, fileID string) bool {
+	if !uploadCancelled(fileID) {
+		return false
+	}
+	os.RemoveAll(uploadTmpDir(fileID))
+	return rejectCancelled(w, fileID)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+)
+
+// apiVersions lists the versions of the upload protocol the server speaks,
+// oldest first.
+var apiVersions = []string{"1", "2"}
+
+// Capabilities is the answer of GET /capabilities: what a client may rely on
+// when talking to this server, so that it can pick features instead of
+// finding out about them from errors.
+type Capabilities struct {
+	APIVersions []string `json:"apiVersions"`
+	// HashAlgorithms are the hashAlgorithm values a registration may use for
+	// its fileHash, DigestAlgorithms the algorithms checked in Digest,
+	// Content-Digest and Repr-Digest headers and offered in Want-Digest.
+	HashAlgorithms     []string `json:"hashAlgorithms"`
+	MinHashSegmentSize int64    `json:"minHashSegmentSize"`
+	MaxHashSegmentSize int64    `json:"maxHashSegmentSize"`
+	DigestAlgorithms   []string `json:"digestAlgorithms"`
+	// ChunkEncodings are the Content-Encoding values chunks of upload groups
+	// registered with compression may be sent with, ResponseEncodings those
+	// JSON responses are compressed with for clients accepting them.
+	ChunkEncodings    []string `json:"chunkEncodings"`
+	ResponseEncodings []string `json:"responseEncodings"`
+	// MaxFileSize is 0 when files of any size are accepted, and
+	// SmallUploadLimit 0 when /upload_small is disabled.
+	MaxFileSize      int64 `json:"maxFileSize"`
+	MinChunkSize     int   `json:"minChunkSize"`
+	MaxChunkSize     int   `json:"maxChunkSize"`
+	SmallUploadLimit int64 `json:"smallUploadLimit"`
+	MaxJSONBody      int64 `json:"maxJSONBody"`
+	// AuthModes are the ways a request can be authorized; see
+	// capabilityAuthModes.
+	AuthModes []string `json:"authModes"`
+	// Features are the optional endpoints and registration fields enabled on
+	// this server.
+	Features []string `json:"features"`
+}
+
+// capabilitiesHandler serves GET /capabilities. Like /openapi.json it needs
+// no role, since clients read it to find out how to authenticate.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	writeJSON(w, serverCapabilities())
+}
+
+func serverCapabilities() Capabilities {
+	capabilities := Capabilities{
+		APIVersions:        apiVersions,
+		HashAlgorithms:     []string{hashSHA256, hashSHA256Tree},
+		MinHashSegmentSize: minHashSegmentSize,
+		MaxHashSegmentSize: maxHashSegmentSize,
+		DigestAlgorithms:   []string{"sha-256", "sha-512", "md5"},
+		ChunkEncodings:     []string{},
+		ResponseEncodings:  []string{},
+		MaxFileSize:        maxFileSize,
+		MinChunkSize:       minChunkSize,
+		MaxChunkSize:       maxChunkSize,
+		SmallUploadLimit:   smallUploadLimit,
+		MaxJSONBody:        maxJSONBody,
+		AuthModes:          capabilityAuthModes(),
+		Features:           capabilityFeatures(),
+	}
+	if compressionDictionaries {
+		capabilities.ChunkEncodings = append(capabilities.ChunkEncodings, "zstd")
+	}
+	if compressJSON {
+		capabilities.ResponseEncodings = append(capabilities.ResponseEncodings, "gzip", "deflate")
+	}
+	return capabilities
+}
+
+// capabilityAuthModes lists how requests can be authorized: anonymously
+// when anonymous principals have a role, with bearer tokens of the
+// principals file, the admin token or OIDC tokens, with login sessions
+// checked against LDAP, and with session tokens of /v2/session and signed
+// download links.
+func capabilityAuthModes() []string {
+	modes := []string{}
+	if principalRole("") != roleNone {
+		modes = append(modes, "anonymous")
+	}
+	if len(principalTokens) > 0 {
+		modes = append(modes, "token")
+	}
+	if adminToken != "" {
+		modes = append(modes, "admin-token")
+	}
+	if oidc != nil {
+		modes = append(modes, "oidc")
+	}
+	if ldapURL != "" {
+		modes = append(modes, "ldap-session")
+	}
+	return append(modes, "session-token", "signed-link")
+}
+
+// capabilityFeatures lists the optional features enabled with flags.
+func capabilityFeatures() []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"small-upload", smallUploadLimit > 0},
+		{"compression-dictionaries", compressionDictionaries},
+		{"dedup-chunks", dedupChunks},
+		{"content-search", indexContent},
+		{"events", eventBufferSize > 0},
+		{"fetch", fetchEnabled},
+		{"peer-assist", peerAssist},
+		{"trash", trashRetention > 0},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
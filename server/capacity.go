@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// minFreeSpace is the watermark of free bytes registration keeps on the
+	// data directory's filesystem: uploads that would leave less are refused
+	// once the eviction hooks cannot make room.
+	minFreeSpace int64
+	// uploadExpiry is how long an upload session may go without a chunk
+	// before the expired uploads hook may evict it; 0 keeps them forever.
+	uploadExpiry = 24 * time.Hour
+)
+
+// An evictionHook frees space when the disk runs short, removing only data
+// that has expired. It is asked for needed bytes and reports how many it
+// freed.
+type evictionHook struct {
+	name  string
+	evict func(needed int64) int64
+}
+
+var (
+	evictionHooks = []evictionHook{{name: "expired_uploads", evict: evictExpiredUploads}}
+	// evictionMutex keeps concurrent registrations from evicting at once.
+	evictionMutex = &sync.Mutex{}
+)
+
+// registerEvictionHook adds a hook run after the ones registered before it.
+func registerEvictionHook(name string, evict func(needed int64) int64) {
+	evictionHooks = append(evictionHooks, evictionHook{name: name, evict: evict})
+}
+
+// relieveDiskPressure runs the eviction hooks in order until required bytes
+// are available in the data directory, and returns what is available then.
+func relieveDiskPressure(required int64) (int64, error) {
+	evictionMutex.Lock()
+	defer evictionMutex.Unlock()
+	available, err := availableDiskSpace(dataDir)
+	for _, hook := range evictionHooks {
+		if err != nil || available >= required {
+			break
+		}
+		if freed := hook.evict(required - available); freed > 0 {
+			fmt.Printf("Eviction hook %s freed %d bytes\n", hook.name, freed)
+		}
+		available, err = availableDiskSpace(dataDir)
+	}
+	return available, err
+}
+
+// uploadActivity is when a chunk was last stored for an upload, or when it
+// was registered if no chunk arrived yet. In-place uploads add no files to
+// their directory after the first chunk, so their chunk manifest counts too.
+func uploadActivity(fileID string) (time.Time, bool) {
+	if info, err := os.Stat(uploadTmpDir(fileID)); err == nil {
+		last := info.ModTime()
+		if manifest, err := os.Stat(chunkManifestPath(fileID)); err == nil && manifest.ModTime().After(last) {
+			last = manifest.ModTime()
+		}
+		return last, true
+	}
+	transferMutex.Lock()
+	defer transferMutex.Unlock()
+	if stats, ok := transfers[fileID]; ok {
+		return stats.started, true
+	}
+	return time.Time{}, false
+}
+
+// evictExpiredUploads drops upload sessions idle for longer than uploadExpiry
+// together with their chunks and removes chunk directories no session refers
+// to any more (those of group members after a restart). Group members expire with their group and
+// uploads being completed are kept.
+func evictExpiredUploads(needed int64) int64 {
+	if uploadExpiry <= 0 {
+		return 0
+	}
+	cutoff := timeNow().Add(-uploadExpiry)
+	var freed int64
+
+	metadataMutex.Lock()
+	var expired []FileMetadata
+	for id, metadata := range filesMetadata {
+		if metadata.GroupID != "" || completingUploads[id] {
+			continue
+		}
+		if last, ok := uploadActivity(id); ok && last.Before(cutoff) {
+			expired = append(expired, metadata)
+			delete(filesMetadata, id)
+		}
+	}
+	metadataMutex.Unlock()
+	for _, metadata := range expired {
+		freed += directorySize(uploadTmpDir(metadata.ID))
+		os.RemoveAll(uploadTmpDir(metadata.ID))
+		forgetTransfer(metadata.ID)
+		audit(nil, AuditEntry{Action: "evict_upload", FileID: metadata.ID, FileName: metadata.FileName, Size: metadata.FileSize, Detail: "upload expired"})
+		publishEvent(nil, eventUploadFailed, metadata, "upload expired")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dataDir, "tmp"))
+	if err != nil {
+		return freed
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !entry.ModTime().Before(cutoff) {
+			continue
+		}
+		metadataMutex.Lock()
+		_, active := filesMetadata[entry.Name()]
+		metadataMutex.Unlock()
+		if active {
+			continue
+		}
+		path := filepath.Join(dataDir, "tmp", entry.Name())
+		freed += directorySize(path)
+		os.RemoveAll(path)
+		audit(nil, AuditEntry{Action: "evict_upload", FileID: entry.Name(), Detail: "orphaned chunks"})
+	}
+	return freed
+}
+
+func directorySize(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// StorageBackend reports one place the server keeps data and the filesystem
+// it lives on.
+type StorageBackend struct {
+	Name           string `json:"name"`
+	Path           string `json:"path"`
+	UsedBytes      int64  `json:"usedBytes"`
+	TotalBytes     int64  `json:"totalBytes,omitempty"`
+	AvailableBytes int64  `json:"availableBytes,omitempty"`
+}
+
+// StorageReport is the body of GET /admin/storage.
+type StorageReport struct {
+	Backends          []StorageBackend `json:"backends"`
+	MetadataStore     string           `json:"metadataStore"`
+	MinFreeBytes      int64            `json:"minFreeBytes"`
+	BelowWatermark    bool             `json:"belowWatermark"`
+	UploadsInProgress int              `json:"uploadsInProgress"`
+}
+
+// storageHandler serves GET /admin/storage.
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	report := StorageReport{MetadataStore: "json", MinFreeBytes: minFreeSpace}
+	if _, ok := fileStore.(*postgresStore); ok {
+		report.MetadataStore = "postgres"
+	}
+
+	var storedBytes, metadataBytes int64
+	entries, _ := ioutil.ReadDir(dataDir)
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), "final_"):
+			storedBytes += entry.Size()
+		case entry.Name() == fileInfoDB:
+			metadataBytes = entry.Size()
+		}
+	}
+	backends := []StorageBackend{
+		{Name: "files", Path: dataDir, UsedBytes: storedBytes},
+		{Name: "uploads", Path: filepath.Join(dataDir, "tmp"), UsedBytes: directorySize(filepath.Join(dataDir, "tmp"))},
+		{Name: "quarantine", Path: quarantineDir(), UsedBytes: directorySize(quarantineDir())},
+		{Name: "trash", Path: trashDir(), UsedBytes: directorySize(trashDir())},
+		{Name: "thumbnails", Path: thumbnailDir(), UsedBytes: directorySize(thumbnailDir())},
+	}
+	backends = append(backends, erasureBackends()...)
+	if report.MetadataStore == "json" {
+		backends = append(backends, StorageBackend{Name: "metadata", Path: filepath.Join(dataDir, fileInfoDB), UsedBytes: metadataBytes})
+	}
+	if auditLogPath != "" {
+		backends = append(backends, StorageBackend{Name: "audit", Path: auditLogPath, UsedBytes: auditLogUsage()})
+	}
+	for i := range backends {
+		path := backends[i].Path
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			path = filepath.Dir(path)
+		}
+		if total, available, err := diskSpace(path); err == nil {
+			backends[i].TotalBytes, backends[i].AvailableBytes = total, available
+		}
+	}
+	report.Backends = backends
+	if available, err := availableDiskSpace(dataDir); err == nil {
+		report.BelowWatermark = available < minFreeSpace
+	}
+	metadataMutex.Lock()
+	report.UploadsInProgress = len(filesMetadata)
+	metadataMutex.Unlock()
+	writeJSON(w, report)
+}
+
+// auditLogUsage sums the audit log and its rotated files.
+func auditLogUsage() int64 {
+	var total int64
+	matches, _ := filepath.Glob(auditLogPath + "*")
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+// chunkRule recommends ChunkSize for files of at least MinSize bytes whose
+// content type, guessed from the file name, matches Type: an exact type such
+// as "application/zip", a family such as "video/*", or "*".
+type chunkRule struct {
+	Type      string
+	MinSize   int64
+	ChunkSize int
+}
+
+func (rule chunkRule) matches(contentType string, fileSize int64) bool {
+	return fileSize >= rule.MinSize && contentTypeMatches(rule.Type, contentType)
+}
+
+// contentTypeMatches reports whether contentType matches pattern: an exact
+// type such as "application/zip", a family such as "video/*", or "*".
+func contentTypeMatches(pattern, contentType string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))
+	}
+	return contentType == pattern
+}
+
+// fileContentType guesses the content type of a file from its name.
+func fileContentType(fileName string) string {
+	contentType, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(fileName))))
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+func (rule chunkRule) String() string {
+	return fmt.Sprintf("%s from %d bytes", rule.Type, rule.MinSize)
+}
+
+// defaultChunkPolicy grows chunks with the file: small files need few
+// requests anyway, while large ones spend less on per-request overhead with
+// large chunks. Video is usually streamed from disk in large sequential
+// reads, so it gets the largest chunks earlier.
+var defaultChunkPolicy = []chunkRule{
+	{"video/*", 256 << 20, 4 << 20},
+	{"*", 1 << 30, 4 << 20},
+	{"*", 64 << 20, 2 << 20},
+	{"*", 8 << 20, 1 << 20},
+	{"*", 0, 256 << 10},
+}
+
+// chunkPolicy is consulted before defaultChunkPolicy; -chunk-policy sets it.
+var chunkPolicy []chunkRule
+
+// loadChunkPolicy reads a -chunk-policy file: one "<type> <min size> <chunk
+// size>" rule per line, such as "video/* 1GB 4MB", first match wins. Sizes
+// take the units of size: search terms. Blank lines and lines starting with #
+// are ignored.
+func loadChunkPolicy(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var rules []chunkRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: expected <type> <min size> <chunk size>", line)
+		}
+		if fields[0] != "*" && !strings.Contains(fields[0], "/") {
+			return fmt.Errorf("line %d: invalid content type %q", line, fields[0])
+		}
+		minSize, err := parseByteSize(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		chunkSize, err := parseByteSize(fields[2])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if chunkSize < minChunkSize || chunkSize > int64(maxChunkSize) {
+			return fmt.Errorf("line %d: chunk size must be between %d and %d bytes", line, minChunkSize, maxChunkSize)
+		}
+		rules = append(rules, chunkRule{Type: strings.ToLower(fields[0]), MinSize: minSize, ChunkSize: int(chunkSize)})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	chunkPolicy = rules
+	return nil
+}
+
+// recommendChunkSize returns the chunk size the policy recommends for a file
+// and the rule it came from. Files no -chunk-policy rule matches fall back to
+// defaultChunkPolicy.
+func recommendChunkSize(fileName string, fileSize int64) (int, chunkRule) {
+	contentType := fileContentType(fileName)
+	rule := defaultChunkPolicy[len(defaultChunkPolicy)-1]
+	for _, candidate := range append(append([]chunkRule{}, chunkPolicy...), defaultChunkPolicy...) {
+		if candidate.matches(contentType, fileSize) {
+			rule = candidate
+			break
+		}
+	}
+	// -max-chunk-size may be lower than the built-in sizes.
+	size := min(rule.ChunkSize, maxChunkSize)
+	if int64(size) > fileSize {
+		size = int(fileSize)
+	}
+	return size, rule
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxChunkNumber bounds the chunk number of an upload before its registration
+// is looked up: 1.6 TiB in chunks of the minimum size.
+const maxChunkNumber = 1 << 24
+
+// chunkRequest is what a POST /upload_chunk/{id}/{n} request names.
+type chunkRequest struct {
+	FileID      string
+	ChunkNumber int
+	ChunkHash   string
+}
+
+// parseChunkRequest validates the path and the Chunk-Hash header of a chunk
+// upload. It does no I/O and never panics, so it is the one place malformed
+// requests are turned away and the fuzz targets exercise it directly.
+func parseChunkRequest(path string, header http.Header) (chunkRequest, error) {
+	var request chunkRequest
+	if !strings.HasPrefix(path, "/upload_chunk/") {
+		return request, errors.New("Invalid URL")
+	}
+	fileID, chunkNumber, ok := strings.Cut(strings.TrimPrefix(path, "/upload_chunk/"), "/")
+	if !ok || strings.Contains(chunkNumber, "/") {
+		return request, errors.New("Invalid URL")
+	}
+	if !validFileID(fileID) {
+		return request, errors.New("Invalid file ID")
+	}
+	number, err := parseChunkNumber(chunkNumber)
+	if err != nil {
+		return request, err
+	}
+	chunkHash := header.Get("Chunk-Hash")
+	if chunkHash == "" {
+		return request, errors.New("Chunk hash is missing")
+	}
+	if !validChunkHash(chunkHash) {
+		return request, errors.New("Chunk hash must be a hex encoded SHA-256")
+	}
+	request.FileID, request.ChunkNumber, request.ChunkHash = fileID, number, strings.ToLower(chunkHash)
+	return request, nil
+}
+
+// parseChunkNumber accepts only plain decimal digits without leading zeros,
+// unlike strconv.Atoi, which also takes a sign.
+func parseChunkNumber(value string) (int, error) {
+	errInvalid := fmt.Errorf("Chunk number must be between 1 and %d", maxChunkNumber)
+	if value == "" || value[0] == '0' || len(value) > len(strconv.Itoa(maxChunkNumber)) {
+		return 0, errInvalid
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, errInvalid
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 || number > maxChunkNumber {
+		return 0, errInvalid
+	}
+	return number, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testChunkHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func FuzzParseChunkRequest(f *testing.F) {
+	for _, seed := range []struct{ path, hash string }{
+		{"/upload_chunk/0a1b-2c3d/1", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/16777216", strings.ToUpper(testChunkHash)},
+		{"/upload_chunk/0a1b-2c3d/16777217", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/0", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/01", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/-1", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/+1", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/1/", testChunkHash},
+		{"/upload_chunk/../1", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/99999999999999999999", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d", testChunkHash},
+		{"/upload_chunk/0a1b-2c3d/1", ""},
+		{"/upload_chunk/0a1b-2c3d/1", testChunkHash[:63] + "g"},
+		{"/upload_chunk//1", testChunkHash},
+	} {
+		f.Add(seed.path, seed.hash)
+	}
+	f.Fuzz(func(t *testing.T, path, hash string) {
+		request, err := parseChunkRequest(path, http.Header{"Chunk-Hash": {hash}})
+		if err != nil {
+			return
+		}
+		if !validFileID(request.FileID) {
+			t.Errorf("accepted file ID %q", request.FileID)
+		}
+		if request.ChunkNumber < 1 || request.ChunkNumber > maxChunkNumber {
+			t.Errorf("accepted chunk number %d", request.ChunkNumber)
+		}
+		if !validChunkHash(request.ChunkHash) || request.ChunkHash != strings.ToLower(request.ChunkHash) {
+			t.Errorf("accepted chunk hash %q", request.ChunkHash)
+		}
+		if want := fmt.Sprintf("/upload_chunk/%s/%d", request.FileID, request.ChunkNumber); path != want {
+			t.Errorf("accepted %q, which does not read back as %q", path, want)
+		}
+	})
+}
+
+func FuzzParseContentRange(f *testing.F) {
+	for _, seed := range []string{
+		"bytes 0-99/100", "bytes */100", "bytes 100-99/100", "bytes -1-5/10",
+		"bytes 0-/1", "bytes 0-9223372036854775807/9223372036854775807", "bytes 1-2", "0-1/2",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		first, last, total, err := parseContentRange(value)
+		if err != nil {
+			return
+		}
+		if total < 0 {
+			t.Errorf("%q: negative total %d", value, total)
+		}
+		if first == -1 && last == -1 {
+			return
+		}
+		if first < 0 || last < first {
+			t.Errorf("%q: accepted range %d-%d", value, first, last)
+		}
+	})
+}
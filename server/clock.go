@@ -0,0 +1,16 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// timeNow is the server's clock, and idRandom the source of the random part
+// of IDs. The end-to-end tests swap in a fake clock and a seeded generator,
+// so IDs, expiries and timings are the same on every run. Connection
+// deadlines and keys are not affected.
+var (
+	timeNow            = time.Now
+	idRandom io.Reader = rand.Reader
+)
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Several servers can share the load behind one load balancer. Every upload
+// and stored file belongs to the node its ID hashes to on a consistent hash
+// ring, which keeps its chunks, assembles it and serves it; any other node
+// that receives a request for it proxies the request there.
+
+// routedHeader marks proxied requests so that they are never forwarded again,
+// even if the nodes disagree about the ring.
+const routedHeader = "X-Routed-By"
+
+// virtualNodes is how many points every node gets on the ring; more points
+// spread the IDs more evenly.
+const virtualNodes = 64
+
+var (
+	// selfNode is the URL peers reach this server at, one of clusterNodes.
+	selfNode     string
+	clusterNodes []string
+	ring         []ringPoint
+	nodeProxies  = make(map[string]*httputil.ReverseProxy)
+)
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// routedPrefixes are the endpoints whose path continues with the ID of an
+// upload, stored file, group, download link or fetch job.
+var routedPrefixes = []string{
+	"/upload_chunk/", "/upload/", "/complete_upload/", "/files/", "/download/",
+	"/delta_upload/", "/groups/", "/shared/", "/fetch/", "/v2/uploads/",
+}
+
+// setupCluster builds the ring from the -nodes list, which must contain
+// -node. Nodes forward the downloads of shared links to the node storing
+// the file with the admin token, so every node needs the same one.
+func setupCluster(self, nodes string) error {
+	if adminToken == "" {
+		return errors.New("-nodes requires -admin-token, with which nodes forward shared link downloads to each other")
+	}
+	selfNode = strings.TrimRight(self, "/")
+	for _, node := range splitList(nodes) {
+		node = strings.TrimRight(node, "/")
+		target, err := url.Parse(node)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return fmt.Errorf("invalid node URL %q", node)
+		}
+		clusterNodes = append(clusterNodes, node)
+		if node != selfNode {
+			nodeProxies[node] = newNodeProxy(node, target)
+		}
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	if !containsNode(selfNode) {
+		return fmt.Errorf("-node %q must be one of -nodes", selfNode)
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return nil
+}
+
+func containsNode(node string) bool {
+	for _, n := range clusterNodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func newNodeProxy(node string, target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(routedHeader, selfNode)
+		// CORS is answered by the node the browser talks to.
+		r.Header.Del("Origin")
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		fmt.Printf("Error proxying %s to %s: %v\n", r.URL.Path, node, err)
+		writeError(w, http.StatusBadGateway, codeNodeUnavailable, "Owning node is unavailable")
+	}
+	return proxy
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ownerNode returns the node that owns id: the first ring point at or after
+// its hash.
+func ownerNode(id string) string {
+	hash := ringHash(id)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+// ownedLocally is always true when clustering is off.
+func ownedLocally(id string) bool {
+	return len(ring) == 0 || ownerNode(id) == selfNode
+}
+
+// generateLocalID returns a new ID owned by this node, so that uploads,
+// groups and links are kept where they were registered.
+func generateLocalID() string {
+	for {
+		if id := generateUniqueID(); ownedLocally(id) {
+			return id
+		}
+	}
+}
+
+// proxyToOwner forwards r to the node owning id, returning false when this
+// node owns it or r was already forwarded.
+func proxyToOwner(w http.ResponseWriter, r *http.Request, id string) bool {
+	if ownedLocally(id) || r.Header.Get(routedHeader) != "" {
+		return false
+	}
+	forwardToOwner(w, r, id)
+	return true
+}
+
+// forwardToOwner proxies r to the node owning id, which must not be this one.
+func forwardToOwner(w http.ResponseWriter, r *http.Request, id string) {
+	owner := ownerNode(id)
+	fmt.Printf("Routing %s %s to %s\n", r.Method, r.URL.Path, owner)
+	nodeProxies[owner].ServeHTTP(w, r)
+}
+
+// withClusterRouting sends requests for uploads and files owned by another
+// node to that node.
+func withClusterRouting(next http.Handler) http.Handler {
+	if len(ring) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range routedPrefixes {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				continue
+			}
+			id := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)[0]
+			if id != "" && proxyToOwner(w, r, id) {
+				return
+			}
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressJSON enables gzip and deflate compression of JSON responses for
+// clients that accept it.
+var compressJSON = true
+
+// compressMinSize is the smallest response worth compressing; shorter ones
+// are sent as they are.
+const compressMinSize = 1024
+
+// withCompression compresses the JSON responses of a handler (listings,
+// metadata, status and admin reports) with the encoding the client prefers.
+// Other content types, such as downloads and quarantined chunk data, pass
+// through untouched. Compressed responses carry a weak ETag, as their bytes
+// differ from the uncompressed ones; conditional requests still match because
+// If-None-Match is compared weakly.
+func withCompression(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !compressJSON {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == "HEAD" {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next(cw, r)
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip when both are equally acceptable, or "" for neither.
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding == "*" {
+			coding = "gzip"
+		}
+		if (coding != "gzip" && coding != "deflate") || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it: only 200 responses with a JSON body of at least
+// compressMinSize bytes are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	decided bool
+	buffer  []byte
+	encoder io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided || c.status != 0 {
+		return
+	}
+	c.status = status
+	if status == http.StatusNotModified {
+		c.weakenETag()
+	}
+	if status != http.StatusOK || !c.compressible() {
+		c.passThrough()
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.decided {
+		if c.encoder != nil {
+			return c.encoder.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+	c.buffer = append(c.buffer, p...)
+	if len(c.buffer) >= compressMinSize {
+		if err := c.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *compressWriter) compressible() bool {
+	header := c.Header()
+	return strings.HasPrefix(header.Get("Content-Type"), "application/json") && header.Get("Content-Encoding") == ""
+}
+
+func (c *compressWriter) weakenETag() {
+	if etag := c.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		c.Header().Set("ETag", "W/"+etag)
+	}
+}
+
+// passThrough sends the response as the handler wrote it.
+func (c *compressWriter) passThrough() {
+	c.decided = true
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+func (c *compressWriter) startCompression() error {
+	c.decided = true
+	header := c.Header()
+	header.Set("Content-Encoding", c.encoding)
+	header.Del("Content-Length")
+	c.weakenETag()
+	c.ResponseWriter.WriteHeader(c.status)
+	if c.encoding == "gzip" {
+		c.encoder = gzip.NewWriter(c.ResponseWriter)
+	} else {
+		c.encoder, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+	}
+	buffered := c.buffer
+	c.buffer = nil
+	_, err := c.encoder.Write(buffered)
+	return err
+}
+
+// close sends what is still held back uncompressed, or finishes the
+// compressed stream.
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 {
+			c.status = http.StatusOK
+		}
+		c.passThrough()
+		c.ResponseWriter.Write(c.buffer)
+		return
+	}
+	if c.encoder != nil {
+		c.encoder.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// maxConcurrentChunks caps chunk uploads in flight across all files and
+	// maxConcurrentChunksPerFile those for a single file ID; 0 disables a limit.
+	maxConcurrentChunks        int
+	maxConcurrentChunksPerFile int
+
+	chunkSlots        chan struct{}
+	fileChunkCounts   = make(map[string]int)
+	fileChunkCountsMu = &sync.Mutex{}
+)
+
+// chunkRetryAfter is the Retry-After hint, in seconds, sent with 429s.
+const chunkRetryAfter = 1
+
+// limitChunkConcurrency is a semaphore middleware for the chunk endpoint.
+// Requests beyond the limits are turned away immediately with 429 instead of
+// queueing, so a flood of parallel clients cannot exhaust a small host.
+func limitChunkConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	if maxConcurrentChunks > 0 && chunkSlots == nil {
+		chunkSlots = make(chan struct{}, maxConcurrentChunks)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if chunkSlots != nil {
+			select {
+			case chunkSlots <- struct{}{}:
+				defer func() { <-chunkSlots }()
+			default:
+				tooManyChunks(w, "server is handling too many chunk uploads")
+				return
+			}
+		}
+
+		if maxConcurrentChunksPerFile > 0 {
+			fileID := ""
+			if parts := strings.Split(r.URL.Path, "/"); len(parts) > 2 {
+				fileID = parts[2]
+			}
+			if !acquireFileSlot(fileID) {
+				tooManyChunks(w, "too many concurrent chunk uploads for file "+fileID)
+				return
+			}
+			defer releaseFileSlot(fileID)
+		}
+
+		next(w, r)
+	}
+}
+
+func acquireFileSlot(fileID string) bool {
+	fileChunkCountsMu.Lock()
+	defer fileChunkCountsMu.Unlock()
+	if fileChunkCounts[fileID] >= maxConcurrentChunksPerFile {
+		return false
+	}
+	fileChunkCounts[fileID]++
+	return true
+}
+
+func releaseFileSlot(fileID string) {
+	fileChunkCountsMu.Lock()
+	defer fileChunkCountsMu.Unlock()
+	if fileChunkCounts[fileID] <= 1 {
+		delete(fileChunkCounts, fileID)
+		return
+	}
+	fileChunkCounts[fileID]--
+}
+
+func tooManyChunks(w http.ResponseWriter, message string) {
+	fmt.Println("Rejecting chunk upload:", message)
+	w.Header().Set("Retry-After", strconv.Itoa(chunkRetryAfter))
+	writeError(w, http.StatusTooManyRequests, codeTooManyRequests, message)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// CopyRequest is the body of POST /files/{id}/copy and /move. FileName is
+// the new name, the current one when empty. Owner hands the file to another
+// principal: a copy may only be given away by an admin, and a file only be
+// moved to another owner by its owner or an admin. An empty Owner keeps the
+// caller as the owner of a copy and the owner of a moved file.
+type CopyRequest struct {
+	FileName string `json:"fileName,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+}
+
+var errOwnerChange = errors.New("only the owner or an admin can change the owner")
+
+// copyFileHandler serves POST /files/{id}/copy: the stored file under a new
+// ID and possibly name and owner, without sending the bytes again. Unless
+// either file is encrypted, the copy is a hard link to the stored file when
+// the file system allows it. Copying needs the read permission.
+func copyFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	request, ok := decodeCopyRequest(w, r)
+	if !ok {
+		return
+	}
+	source, found, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, source, permissionRead) {
+		return
+	}
+	principal, admin := requestPrincipal(r)
+	owner := principal
+	if request.Owner != "" && request.Owner != principal {
+		if !admin {
+			writeError(w, http.StatusForbidden, codeAccessDenied, "Only an admin can give a copy to another owner")
+			return
+		}
+		owner = request.Owner
+	}
+
+	copied := source
+	if request.FileName != "" {
+		copied.FileName = request.FileName
+	}
+	copied.Tags = make(map[string]string, len(source.Tags))
+	for key, value := range source.Tags {
+		copied.Tags[key] = value
+	}
+	copied, err = prepareUpload(copied, owner)
+	if err != nil {
+		fmt.Println("Error preparing copy:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error preparing copy")
+		return
+	}
+	if !checkRegistrationLimits(w, copied) {
+		return
+	}
+	if err := copyStoredContent(source, copied); err != nil {
+		fmt.Println("Error copying stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error copying stored file")
+		return
+	}
+	if err := updateFileInfoDB(copied); err != nil {
+		os.Remove(finalFilePath(copied))
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	indexStoredFile(copied)
+	generateThumbnails(copied)
+	extractMediaInfo(copied)
+	indexFileText(copied)
+	postProcess(copied)
+	queueErasureCoding(copied)
+	audit(r, AuditEntry{Action: "copy", FileID: copied.ID, FileName: copied.FileName, Size: copied.FileSize, Detail: "copy of " + source.ID})
+
+	response, err := json.Marshal(copied.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/files/"+copied.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(response)
+}
+
+// copyStoredContent stores the content of source as copied. Encrypted files
+// are sealed with a key and nonces of their own, so they are decrypted and
+// sealed again; others are linked, or copied when that fails.
+func copyStoredContent(source, copied FileMetadata) error {
+	if !source.Encrypted && !copied.Encrypted {
+		if err := os.Link(finalFilePath(source), finalFilePath(copied)); err == nil {
+			return nil
+		}
+	}
+	file, err := openStoredFile(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content, err := storedFileReader(file, source)
+	if err != nil {
+		return err
+	}
+	_, err = writeStoredFile(finalFilePath(copied), copied, content, source.FileHash)
+	return err
+}
+
+// moveFileHandler serves POST /files/{id}/move, which renames a stored file
+// and may hand it to another owner, keeping its ID. Renaming needs the write
+// permission. A new owner drops the file's ACL, which were the old owner's
+// shares.
+func moveFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	request, ok := decodeCopyRequest(w, r)
+	if !ok {
+		return
+	}
+	if request.FileName == "" && request.Owner == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "A move needs a fileName or an owner")
+		return
+	}
+	principal, admin := requestPrincipal(r)
+	var moved, previous FileMetadata
+	renamed := false
+	found, err := fileStore.Update(fileID, func(stored *FileMetadata) (bool, error) {
+		previous = *stored
+		if !canAccess(r, previous, permissionWrite) {
+			return false, errAccessDenied
+		}
+		moved = previous
+		if request.Owner != "" && request.Owner != previous.Owner {
+			if !admin && (principal == "" || principal != previous.Owner) {
+				return false, errOwnerChange
+			}
+			moved.Owner, moved.ACL = request.Owner, nil
+		}
+		if request.FileName != "" {
+			moved.FileName = request.FileName
+		}
+		if finalFilePath(moved) != finalFilePath(previous) {
+			// Downloads starting during the rename are refused; those
+			// already streaming keep reading the renamed file.
+			endChange, _ := beginChange(fileID, true)
+			if endChange == nil {
+				return false, errFileInUse
+			}
+			defer endChange()
+			if err := os.Rename(finalFilePath(previous), finalFilePath(moved)); err != nil && !(os.IsNotExist(err) && erasureCoded(moved)) {
+				fmt.Println("Error renaming stored file:", err)
+				return false, errors.New("Error renaming stored file")
+			}
+			renamed = true
+		}
+		*stored = moved
+		return false, nil
+	})
+	switch {
+	case err == errAccessDenied:
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Access denied")
+		return
+	case err == errOwnerChange:
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Only the owner or an admin can change the owner")
+		return
+	case err == errFileInUse:
+		writeInUse(w, 0)
+		return
+	case err != nil:
+		if renamed {
+			os.Rename(finalFilePath(moved), finalFilePath(previous))
+		}
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	case !found:
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	detail := fmt.Sprintf("from %s", previous.FileName)
+	if moved.Owner != previous.Owner {
+		detail += fmt.Sprintf(", owner %s to %s", previous.Owner, moved.Owner)
+	}
+	audit(r, AuditEntry{Action: "move", FileID: moved.ID, FileName: moved.FileName, Size: moved.FileSize, Detail: detail})
+	writeMetadataResponse(w, moved)
+}
+
+func decodeCopyRequest(w http.ResponseWriter, r *http.Request) (CopyRequest, bool) {
+	var request CopyRequest
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return request, false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		return request, false
+	}
+	if request.FileName != "" && !validFileName(request.FileName) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid file name")
+		return request, false
+	}
+	if request.Owner == everyone {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Owner must be a principal")
+		return request, false
+	}
+	return request, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// corsOrigins lists the origins browsers may call the API from; "*"
+	// allows any origin and an empty list disables CORS entirely.
+	corsOrigins []string
+	corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	corsHeaders = []string{
+		"Content-Type", "Range", "Content-Range", "Chunk-Hash",
+		"Content-Digest", "Content-MD5", "Digest", "Want-Repr-Digest", "Want-Content-Digest",
+		"File-Hash", "File-Size", "Base-Hash", "Block-Size", "If-Match", "Append-Offset", "Last-Event-ID", "Authorization",
+	}
+	corsMaxAge = 600
+)
+
+// corsExposedHeaders are the response headers uploaders need to read; browsers
+// hide everything else from scripts on cross-origin responses.
+var corsExposedHeaders = []string{
+	"Content-Disposition", "Content-Range", "Accept-Ranges", "Range", "Retry-After",
+	"File-Hash", "Repr-Digest", "Content-Digest", "Content-MD5", "Digest", "ETag",
+}
+
+// splitList parses a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight
+// requests itself, so handlers never see OPTIONS requests.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !corsOriginAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// uploadTimeout is the longest an upload may take from its registration to
+// its completion before the server aborts it; 0 leaves uploads without a
+// deadline of their own open until they expire.
+var uploadTimeout time.Duration
+
+// checkDeadline refuses a registration whose deadline has already passed.
+func checkDeadline(w http.ResponseWriter, metadata FileMetadata) bool {
+	if metadata.Deadline != nil && !metadata.Deadline.After(timeNow()) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Deadline must be in the future")
+		return false
+	}
+	return true
+}
+
+// uploadDeadline is the deadline of an upload registered now: the one the
+// client asked for, unless uploadTimeout ends it sooner.
+func uploadDeadline(requested *time.Time) *time.Time {
+	if uploadTimeout > 0 {
+		limit := timeNow().Add(uploadTimeout).UTC().Truncate(time.Second)
+		if requested == nil || limit.Before(*requested) {
+			return &limit
+		}
+	}
+	return requested
+}
+
+// scheduleDeadline aborts the upload when its deadline passes. Deadlines that
+// passed while the server was down abort restored uploads right away.
+func scheduleDeadline(metadata FileMetadata) {
+	if metadata.Deadline == nil {
+		return
+	}
+	time.AfterFunc(metadata.Deadline.Sub(timeNow()), func() {
+		abortOverdueUpload(metadata.ID)
+	})
+}
+
+// abortOverdueUpload drops an upload still in progress at its deadline and
+// its chunks, like a cancellation: later requests for it get 410 Gone with
+// DEADLINE_EXCEEDED. Group members take their whole group down, and an
+// upload being completed is checked again a minute later.
+func abortOverdueUpload(fileID string) {
+	if _, stored, err := lookupFileInfo(fileID); err != nil || stored {
+		return
+	}
+	metadataMutex.Lock()
+	metadata, ok := filesMetadata[fileID]
+	switch {
+	case !ok:
+		metadataMutex.Unlock()
+		return
+	case completingUploads[fileID]:
+		metadataMutex.Unlock()
+		time.AfterFunc(time.Minute, func() { abortOverdueUpload(fileID) })
+		return
+	case metadata.GroupID != "":
+		metadataMutex.Unlock()
+		rollbackGroup(metadata.GroupID, "deadline of file "+fileID+" exceeded")
+		return
+	}
+	delete(filesMetadata, fileID)
+	markCancelled(fileID, codeDeadlineExceeded)
+	metadataMutex.Unlock()
+
+	os.RemoveAll(uploadTmpDir(fileID))
+	forgetTransfer(fileID)
+	fmt.Println("Aborted upload past its deadline:", fileID)
+	audit(nil, AuditEntry{Action: "deadline_exceeded", FileID: fileID, FileName: metadata.FileName, Size: metadata.FileSize})
+	publishEvent(nil, eventUploadFailed, metadata, "deadline exceeded")
+}
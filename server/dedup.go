@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupChunks lets a registration list the SHA-256 of every chunk, so that
+// chunks the server already stores in a file the uploader may read are
+// copied into the new upload instead of being sent again.
+var dedupChunks bool
+
+const chunkIndexFile = "chunkIndex.json"
+
+// indexedFile lists the plaintext chunk hashes of a stored file, in order.
+type indexedFile struct {
+	ChunkSize int      `json:"chunkSize"`
+	Hashes    []string `json:"hashes"`
+}
+
+// chunkLocation is where a chunk starts in the plaintext of a stored file.
+type chunkLocation struct {
+	fileID string
+	offset int64
+}
+
+var (
+	indexedFiles    = make(map[string]indexedFile)
+	chunkLocations  = make(map[string]chunkLocation)
+	chunkIndexMutex = &sync.Mutex{}
+)
+
+// registration is the body of POST /register_file.
+type registration struct {
+	FileMetadata
+	ChunkHashes []string `json:"chunkHashes,omitempty"`
+	// Holes are the ranges of the file that are holes, whose chunks the
+	// client need not send.
+	Holes []FileHole `json:"holes,omitempty"`
+}
+
+// registrationResponse tells the client which chunks it can skip, and which
+// chunk size the chunk policy recommends for the file, which differs from
+// ChunkSize when the client requested its own.
+type registrationResponse struct {
+	FileMetadata
+	ExistingChunks       []int  `json:"existingChunks,omitempty"`
+	HoleChunks           []int  `json:"holeChunks,omitempty"`
+	RecommendedChunkSize int    `json:"recommendedChunkSize"`
+	ChunkSizeRule        string `json:"chunkSizeRule"`
+	// ResumptionToken lets a client holding nothing else continue the
+	// upload through POST /resume_upload until ResumptionExpiresAt.
+	ResumptionToken     string    `json:"resumptionToken"`
+	ResumptionExpiresAt time.Time `json:"resumptionExpiresAt"`
+}
+
+// loadChunkIndex reads the chunk index and, in the background, indexes the
+// stored files it does not cover yet, such as those stored while -dedup-chunks
+// was off.
+func loadChunkIndex() error {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, chunkIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &indexedFiles); err != nil {
+			return err
+		}
+	}
+	chunkIndexMutex.Lock()
+	rebuildChunkLocationsLocked()
+	chunkIndexMutex.Unlock()
+
+	go func() {
+		stored, err := fileStore.List()
+		if err != nil {
+			fmt.Println("Error listing files to index:", err)
+			return
+		}
+		added := 0
+		for _, metadata := range stored {
+			chunkIndexMutex.Lock()
+			_, ok := indexedFiles[metadata.ID]
+			chunkIndexMutex.Unlock()
+			if ok {
+				continue
+			}
+			indexed, err := hashStoredChunks(metadata)
+			if err != nil {
+				fmt.Printf("Error indexing chunks of %s: %v\n", metadata.ID, err)
+				continue
+			}
+			chunkIndexMutex.Lock()
+			addIndexedFileLocked(metadata.ID, indexed)
+			chunkIndexMutex.Unlock()
+			added++
+		}
+		if added > 0 {
+			chunkIndexMutex.Lock()
+			defer chunkIndexMutex.Unlock()
+			if err := saveChunkIndexLocked(); err != nil {
+				fmt.Println("Error saving chunk index:", err)
+			}
+			fmt.Printf("Indexed the chunks of %d stored files\n", added)
+		}
+	}()
+	return nil
+}
+
+func saveChunkIndexLocked() error {
+	data, err := json.Marshal(indexedFiles)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, chunkIndexFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// addIndexedFileLocked indexes a stored file, replacing what was indexed for
+// it before, e.g. after a delta update.
+func addIndexedFileLocked(fileID string, indexed indexedFile) {
+	_, replaced := indexedFiles[fileID]
+	indexedFiles[fileID] = indexed
+	if replaced {
+		rebuildChunkLocationsLocked()
+		return
+	}
+	addChunkLocationsLocked(fileID, indexed)
+}
+
+func addChunkLocationsLocked(fileID string, indexed indexedFile) {
+	for i, hash := range indexed.Hashes {
+		if _, ok := chunkLocations[hash]; !ok {
+			chunkLocations[hash] = chunkLocation{fileID: fileID, offset: int64(i) * int64(indexed.ChunkSize)}
+		}
+	}
+}
+
+func rebuildChunkLocationsLocked() {
+	chunkLocations = make(map[string]chunkLocation)
+	for fileID, indexed := range indexedFiles {
+		addChunkLocationsLocked(fileID, indexed)
+	}
+}
+
+// indexStoredFile adds the chunks of a newly stored file to the index. The
+// file is hashed again in the background, so the index only ever describes
+// data that is actually on disk.
+func indexStoredFile(metadata FileMetadata) {
+	if !dedupChunks {
+		return
+	}
+	go func() {
+		indexed, err := hashStoredChunks(metadata)
+		if err != nil {
+			fmt.Printf("Error indexing chunks of %s: %v\n", metadata.ID, err)
+			return
+		}
+		chunkIndexMutex.Lock()
+		defer chunkIndexMutex.Unlock()
+		addIndexedFileLocked(metadata.ID, indexed)
+		if err := saveChunkIndexLocked(); err != nil {
+			fmt.Println("Error saving chunk index:", err)
+		}
+	}()
+}
+
+// forgetIndexedFile drops a file that was removed or changed since it was
+// indexed.
+func forgetIndexedFile(fileID string) {
+	chunkIndexMutex.Lock()
+	defer chunkIndexMutex.Unlock()
+	if _, ok := indexedFiles[fileID]; !ok {
+		return
+	}
+	delete(indexedFiles, fileID)
+	rebuildChunkLocationsLocked()
+	if err := saveChunkIndexLocked(); err != nil {
+		fmt.Println("Error saving chunk index:", err)
+	}
+}
+
+func hashStoredChunks(metadata FileMetadata) (indexedFile, error) {
+	indexed := indexedFile{ChunkSize: metadata.ChunkSize}
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		return indexed, err
+	}
+	defer file.Close()
+	reader, err := storedFileReader(file, metadata)
+	if err != nil {
+		return indexed, err
+	}
+	for remaining := metadata.FileSize; remaining > 0; remaining -= int64(metadata.ChunkSize) {
+		hash := sha256.New()
+		if _, err := io.CopyN(hash, reader, int64(metadata.ChunkSize)); err != nil && err != io.EOF {
+			return indexed, err
+		}
+		indexed.Hashes = append(indexed.Hashes, fmt.Sprintf("%x", hash.Sum(nil)))
+	}
+	return indexed, nil
+}
+
+// checkChunkHashes validates the chunk hashes of a registration: one per
+// chunk of the requested chunk size, which must be given explicitly since the
+// hashes depend on it.
+func checkChunkHashes(w http.ResponseWriter, metadata FileMetadata, hashes []string) bool {
+	if len(hashes) == 0 {
+		return true
+	}
+	if metadata.ChunkSize == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "chunkHashes require a chunkSize")
+		return false
+	}
+	chunks := (metadata.FileSize + int64(metadata.ChunkSize) - 1) / int64(metadata.ChunkSize)
+	if int64(len(hashes)) != chunks {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Expected %d chunk hashes, got %d", chunks, len(hashes)))
+		return false
+	}
+	for _, hash := range hashes {
+		if !validChunkHash(hash) {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Chunk hashes must be hex encoded SHA-256")
+			return false
+		}
+	}
+	return true
+}
+
+// dedupSource is a stored file chunks are copied from.
+type dedupSource struct {
+	file    storedFile
+	reader  io.ReadSeeker
+	allowed bool
+}
+
+// reuseChunks copies the chunks of a new upload that the index knows from
+// files the requester may read into the upload, and returns their numbers.
+// Every copied chunk is hashed again first; a chunk that cannot be copied is
+// left for the client to send.
+func reuseChunks(r *http.Request, metadata FileMetadata, hashes []string) []int {
+	sources := make(map[string]*dedupSource)
+	defer func() {
+		for _, source := range sources {
+			if source.file != nil {
+				source.file.Close()
+			}
+		}
+	}()
+
+	var reused []int
+	for i, hash := range hashes {
+		chunkNumber := i + 1
+		hash = strings.ToLower(hash)
+		chunkIndexMutex.Lock()
+		location, ok := chunkLocations[hash]
+		chunkIndexMutex.Unlock()
+		if !ok {
+			continue
+		}
+		source, ok := sources[location.fileID]
+		if !ok {
+			source = openDedupSource(r, location.fileID)
+			sources[location.fileID] = source
+		}
+		if !source.allowed {
+			continue
+		}
+
+		size := expectedChunkSize(metadata, chunkNumber)
+		buffer := getBuffer(int(size))
+		data := (*buffer)[:size]
+		_, err := source.reader.Seek(location.offset, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(source.reader, data)
+		}
+		if err != nil || fmt.Sprintf("%x", sha256.Sum256(data)) != hash {
+			putBuffer(buffer)
+			fmt.Printf("Chunk index entry for %s is stale, dropping the file from the index\n", location.fileID)
+			forgetIndexedFile(location.fileID)
+			source.allowed = false
+			continue
+		}
+		err = storeReusedChunk(metadata, chunkNumber, data, hash)
+		putBuffer(buffer)
+		if err != nil {
+			fmt.Printf("Error storing reused chunk %d of %s: %v\n", chunkNumber, metadata.ID, err)
+			continue
+		}
+		reused = append(reused, chunkNumber)
+	}
+	return reused
+}
+
+func openDedupSource(r *http.Request, fileID string) *dedupSource {
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		return &dedupSource{}
+	}
+	if !ok {
+		forgetIndexedFile(fileID)
+		return &dedupSource{}
+	}
+	if !canAccess(r, metadata, permissionRead) {
+		return &dedupSource{}
+	}
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		forgetIndexedFile(fileID)
+		return &dedupSource{}
+	}
+	reader, err := storedFileReader(file, metadata)
+	if err != nil {
+		file.Close()
+		return &dedupSource{}
+	}
+	return &dedupSource{file: file, reader: reader, allowed: true}
+}
+
+// storeReusedChunk stores a verified chunk the way a chunk request would.
+func storeReusedChunk(metadata FileMetadata, chunkNumber int, data []byte, hash string) error {
+	if usesInPlace(metadata.ID) {
+		return writeChunkInPlace(metadata, chunkNumber, data, hash)
+	}
+	stored := data
+	if metadata.Encrypted {
+		aead, err := chunkAEAD(metadata)
+		if err != nil {
+			return err
+		}
+		if stored, err = sealChunk(aead, metadata.ID, chunkNumber, data); err != nil {
+			return err
+		}
+	}
+	chunkFile, err := createChunkTemp(metadata.ID, chunkNumber)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(chunkFile.Name())
+	_, err = chunkFile.Write(stored)
+	if closeErr := chunkFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if deferChunkVerification {
+		if err := recordChunkHash(metadata.ID, chunkNumber, hash); err != nil {
+			return err
+		}
+	}
+	return os.Rename(chunkFile.Name(), chunkFilePath(metadata.ID, chunkNumber))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BlockChecksum describes one fixed-size block of a stored file. Weak is the
+// rsync rolling checksum, Strong the SHA-256 of the block.
+type BlockChecksum struct {
+	Index  int64  `json:"index"`
+	Size   int    `json:"size"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type BlockList struct {
+	FileID    string          `json:"fileId"`
+	FileHash  string          `json:"fileHash"`
+	BlockSize int             `json:"blockSize"`
+	Blocks    []BlockChecksum `json:"blocks"`
+}
+
+const (
+	defaultDeltaBlockSize = 64 * 1024
+	minDeltaBlockSize     = 1024
+	maxDeltaBlockSize     = 16 * 1024 * 1024
+	maxDeltaLiteralSize   = 16 * 1024 * 1024
+
+	// Delta stream records: a block copied from the stored version, or
+	// literal bytes sent by the client.
+	deltaOpBlock   = 'B'
+	deltaOpLiteral = 'D'
+)
+
+// fileBlocksHandler serves GET /files/{id}/blocks?blockSize=N.
+func fileBlocksHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	blockSize := defaultDeltaBlockSize
+	if value := r.URL.Query().Get("blockSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minDeltaBlockSize || size > maxDeltaBlockSize {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid block size")
+			return
+		}
+		blockSize = size
+	}
+
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+	defer file.Close()
+	content, err := storedFileReader(file, metadata)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+
+	list := BlockList{FileID: metadata.ID, FileHash: metadata.FileHash, BlockSize: blockSize}
+	buffer := make([]byte, blockSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(content, buffer)
+		if n > 0 {
+			list.Blocks = append(list.Blocks, BlockChecksum{
+				Index:  index,
+				Size:   n,
+				Weak:   weakChecksum(buffer[:n]),
+				Strong: fmt.Sprintf("%x", sha256.Sum256(buffer[:n])),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading stored file")
+			return
+		}
+	}
+
+	response, err := json.Marshal(list)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// weakChecksum is the rsync rolling checksum; the client computes the same
+// value incrementally while scanning the new version of the file.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	length := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (length - uint32(i)) * uint32(c)
+	}
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+// deltaUploadHandler rebuilds a new version of a stored file from a delta
+// stream: block references into the current version interleaved with literal
+// data. The new version replaces the old one under the same ID.
+func deltaUploadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received delta upload request for:", r.URL.Path)
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid URL")
+		return
+	}
+	fileID := parts[2]
+
+	fileHash := r.Header.Get("File-Hash")
+	baseHash := r.Header.Get("Base-Hash")
+	fileSize, sizeErr := strconv.ParseInt(r.Header.Get("File-Size"), 10, 64)
+	blockSize, blockErr := strconv.Atoi(r.Header.Get("Block-Size"))
+	if fileHash == "" || baseHash == "" || sizeErr != nil || fileSize <= 0 || blockErr != nil ||
+		blockSize < minDeltaBlockSize || blockSize > maxDeltaBlockSize {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "File-Hash, Base-Hash, File-Size and Block-Size headers are required")
+		return
+	}
+
+	base, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, base, permissionWrite) {
+		return
+	}
+	if base.FileHash != baseHash {
+		writeError(w, http.StatusConflict, codeFileChanged, "Stored file changed since block checksums were fetched")
+		return
+	}
+
+	baseFile, err := openStoredFile(base)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+	defer baseFile.Close()
+	baseContent, err := storedFileReader(baseFile, base)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+
+	updated := base
+	updated.FileSize = fileSize
+	updated.FileHash = fileHash
+	// Delta clients send the plain SHA-256 of the new content.
+	updated.HashAlgorithm, updated.HashSegmentSize = "", 0
+	updated.Integrity, updated.Processing, updated.Media, updated.AppendState = nil, nil, nil, ""
+	updated.ChunkSize, _ = recommendChunkSize(updated.FileName, fileSize)
+	updated.TotalChunks = int(math.Ceil(float64(fileSize) / float64(updated.ChunkSize)))
+	if updated.Encrypted {
+		// A rewritten file gets a data key of its own, so that no key
+		// protects more than one version of the file.
+		if updated.WrappedKey, err = newWrappedDataKey(); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error generating data key")
+			return
+		}
+	}
+
+	// The delta is decoded and stored concurrently through a pipe; closing
+	// either end with an error stops the other side. The new version is
+	// staged next to the stored file and only replaces it once no download
+	// is streaming it.
+	stagedPath := finalFilePath(updated) + ".delta"
+	defer os.Remove(stagedPath)
+	var content storedContent
+	reader, writer := io.Pipe()
+	var g errgroup.Group
+	g.Go(func() error {
+		err := applyDelta(writer, r.Body, baseContent, base.FileSize, blockSize, fileSize)
+		writer.CloseWithError(err)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		content, err = writeStoredFile(stagedPath, updated, reader, fileHash)
+		reader.CloseWithError(err)
+		return err
+	})
+	err = g.Wait()
+	if err == errStoredHashMismatch {
+		fmt.Println("Delta result hash mismatch for:", fileID)
+		writeError(w, http.StatusBadRequest, codeFileHashMismatch, "Reconstructed file hash mismatch")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error applying delta:", err)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Error applying delta: "+err.Error())
+		return
+	}
+
+	updated.FileMD5 = content.MD5
+	endChange, readers := beginChange(fileID, false)
+	if endChange == nil {
+		writeInUse(w, readers)
+		return
+	}
+	defer endChange()
+	if err := os.Rename(stagedPath, finalFilePath(updated)); err != nil {
+		fmt.Println("Error replacing stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error replacing stored file")
+		return
+	}
+	if err := updateFileInfoDB(updated); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	indexStoredFile(updated)
+	generateThumbnails(updated)
+	extractMediaInfo(updated)
+	indexFileText(updated)
+	postProcess(updated)
+	queueErasureCoding(updated)
+	audit(r, AuditEntry{Action: "delta_update", FileID: updated.ID, FileName: updated.FileName, Size: updated.FileSize, Chunks: updated.TotalChunks})
+
+	response, err := json.Marshal(updated.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// applyDelta decodes the delta stream and writes the reconstructed file to dst.
+func applyDelta(dst io.Writer, delta io.Reader, base io.ReadSeeker, baseSize int64, blockSize int, fileSize int64) error {
+	var written int64
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(delta, header[:1]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var n int64
+		var err error
+		switch header[0] {
+		case deltaOpBlock:
+			if _, err := io.ReadFull(delta, header[1:9]); err != nil {
+				return err
+			}
+			index := int64(binary.BigEndian.Uint64(header[1:9]))
+			offset := index * int64(blockSize)
+			if index < 0 || offset >= baseSize {
+				return fmt.Errorf("block %d is out of range", index)
+			}
+			if _, err := base.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			n, err = io.Copy(dst, io.LimitReader(base, int64(blockSize)))
+		case deltaOpLiteral:
+			if _, err := io.ReadFull(delta, header[1:5]); err != nil {
+				return err
+			}
+			length := int64(binary.BigEndian.Uint32(header[1:5]))
+			if length > maxDeltaLiteralSize {
+				return fmt.Errorf("literal of %d bytes is too large", length)
+			}
+			n, err = io.CopyN(dst, delta, length)
+		default:
+			return fmt.Errorf("unknown delta record %q", header[0])
+		}
+		if err != nil {
+			return err
+		}
+		written += n
+		if written > fileSize {
+			return fmt.Errorf("delta produces more than %d bytes", fileSize)
+		}
+	}
+}
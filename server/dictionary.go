@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Many small, similar files compress poorly one at a time, as each starts
+// without context. With -compression-dictionaries the server trains a zstd
+// dictionary per owner from the small files the owner stored and offers it
+// to upload groups registered with "compression": "zstd"; their chunks may
+// then arrive compressed with it. Chunks compressed without a dictionary are
+// accepted either way.
+const (
+	dictionariesDir = "dictionaries"
+	dictionaryIndex = "index.json"
+	// dictMaxFileSize is the largest stored file used as a training sample.
+	dictMaxFileSize = 128 * 1024
+	// dictMinSamples files are needed to train a dictionary, and as many
+	// stored since to train it again.
+	dictMinSamples = 32
+	dictMaxSamples = 2000
+	dictMaxSize    = 64 * 1024
+	// dictKeepPerOwner keeps the previous dictionary for groups that were
+	// offered it before it was replaced.
+	dictKeepPerOwner = 2
+	// Dictionary IDs below 32768 are reserved by the zstd format.
+	dictMinID = 32768
+)
+
+var compressionDictionaries bool
+
+// CompressionDictionary describes a zstd dictionary trained for an owner.
+type CompressionDictionary struct {
+	ID        uint32    `json:"id"`
+	Owner     string    `json:"owner,omitempty"`
+	Samples   int       `json:"samples"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url"`
+}
+
+// dictionaryRecord is an entry of the dictionary index. LastSample is the
+// newest file trained on, so that only files stored since count towards
+// training again.
+type dictionaryRecord struct {
+	CompressionDictionary
+	LastSample string `json:"lastSample"`
+}
+
+var (
+	dictionaries       = make(map[uint32]*dictionaryRecord)
+	dictionaryDecoders = make(map[uint32]*zstd.Decoder)
+	// dictionaryTraining marks the owners a dictionary is being trained for.
+	dictionaryTraining = make(map[string]bool)
+	dictionaryMutex    = &sync.Mutex{}
+
+	plainDecoder     *zstd.Decoder
+	plainDecoderOnce sync.Once
+)
+
+func dictionaryPath(id uint32) string {
+	return filepath.Join(dataDir, dictionariesDir, fmt.Sprintf("%d.dict", id))
+}
+
+// loadDictionaries reads the dictionary index, skipping dictionaries whose
+// file is gone.
+func loadDictionaries() error {
+	if err := os.MkdirAll(filepath.Join(dataDir, dictionariesDir), 0700); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, dictionariesDir, dictionaryIndex))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []dictionaryRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("%s: %v", dictionaryIndex, err)
+	}
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+	for i := range records {
+		if _, err := os.Stat(dictionaryPath(records[i].ID)); err != nil {
+			fmt.Printf("Dropping compression dictionary %d: %v\n", records[i].ID, err)
+			continue
+		}
+		dictionaries[records[i].ID] = &records[i]
+	}
+	return nil
+}
+
+// saveDictionaryIndexLocked writes the dictionary index; the caller must
+// hold dictionaryMutex.
+func saveDictionaryIndexLocked() error {
+	records := make([]dictionaryRecord, 0, len(dictionaries))
+	for _, record := range dictionaries {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, dictionariesDir, dictionaryIndex)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ownerDictionariesLocked returns the owner's dictionaries, newest first.
+func ownerDictionariesLocked(owner string) []*dictionaryRecord {
+	var owned []*dictionaryRecord
+	for _, record := range dictionaries {
+		if record.Owner == owner {
+			owned = append(owned, record)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].CreatedAt.After(owned[j].CreatedAt) })
+	return owned
+}
+
+// groupDictionary returns the owner's newest dictionary for a group that
+// asked for compression, nil if there is none yet.
+func groupDictionary(owner string) *CompressionDictionary {
+	if !compressionDictionaries {
+		return nil
+	}
+	trainDictionaryLater(owner)
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+	owned := ownerDictionariesLocked(owner)
+	if len(owned) == 0 {
+		return nil
+	}
+	latest := owned[0].CompressionDictionary
+	return &latest
+}
+
+// trainDictionaryLater trains a new dictionary for the owner in the
+// background, if enough small files were stored since the last one. It runs
+// when groups are registered with compression and when they are committed,
+// so that the owner's next batch gets the dictionary.
+func trainDictionaryLater(owner string) {
+	if !compressionDictionaries {
+		return
+	}
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+	if dictionaryTraining[owner] {
+		return
+	}
+	lastSample := ""
+	if owned := ownerDictionariesLocked(owner); len(owned) > 0 {
+		lastSample = owned[0].LastSample
+	}
+	dictionaryTraining[owner] = true
+	go func() {
+		if err := trainDictionary(owner, lastSample); err != nil {
+			fmt.Printf("Error training compression dictionary for %q: %v\n", owner, err)
+		}
+		dictionaryMutex.Lock()
+		delete(dictionaryTraining, owner)
+		dictionaryMutex.Unlock()
+	}()
+}
+
+// trainingSamples returns the owner's newest small files, if at least
+// dictMinSamples of them were stored after lastSample. Encrypted files are
+// left out, as the dictionary is kept in the clear.
+func trainingSamples(owner, lastSample string) ([]FileMetadata, error) {
+	files, err := fileStore.List()
+	if err != nil {
+		return nil, err
+	}
+	var samples []FileMetadata
+	newer := 0
+	for id, metadata := range files {
+		if metadata.Owner != owner || metadata.Encrypted || metadata.FileSize == 0 || metadata.FileSize > dictMaxFileSize || !ownedLocally(id) {
+			continue
+		}
+		samples = append(samples, metadata)
+		if id > lastSample {
+			newer++
+		}
+	}
+	if newer < dictMinSamples {
+		return nil, nil
+	}
+	// IDs are UUIDv7, so they sort by the time of registration.
+	sort.Slice(samples, func(i, j int) bool { return samples[i].ID > samples[j].ID })
+	if len(samples) > dictMaxSamples {
+		samples = samples[:dictMaxSamples]
+	}
+	return samples, nil
+}
+
+// trainDictionary trains a new dictionary for the owner when enough small
+// files were stored since lastSample, replacing the oldest one beyond
+// dictKeepPerOwner.
+func trainDictionary(owner, lastSample string) error {
+	samples, err := trainingSamples(owner, lastSample)
+	if err != nil || len(samples) == 0 {
+		return err
+	}
+	var contents [][]byte
+	for _, metadata := range samples {
+		content, closeFile, err := openStoredContent(metadata)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(content, dictMaxFileSize))
+		closeFile()
+		if err == nil && len(data) > 0 {
+			contents = append(contents, data)
+		}
+	}
+	if len(contents) < dictMinSamples {
+		return nil
+	}
+
+	id, err := newDictionaryID()
+	if err != nil {
+		return err
+	}
+	data, err := dict.BuildZstdDict(contents, dict.Options{MaxDictSize: dictMaxSize, HashBytes: 6, ZstdDictID: id, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		return err
+	}
+	path := dictionaryPath(id)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	record := &dictionaryRecord{
+		CompressionDictionary: CompressionDictionary{
+			ID:        id,
+			Owner:     owner,
+			Samples:   len(contents),
+			Size:      len(data),
+			CreatedAt: timeNow(),
+			URL:       "/dictionaries/" + strconv.FormatUint(uint64(id), 10),
+		},
+		LastSample: samples[0].ID,
+	}
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+	dictionaries[id] = record
+	for owned := ownerDictionariesLocked(owner); len(owned) > dictKeepPerOwner; owned = owned[:len(owned)-1] {
+		old := owned[len(owned)-1]
+		delete(dictionaries, old.ID)
+		delete(dictionaryDecoders, old.ID)
+		os.Remove(dictionaryPath(old.ID))
+	}
+	audit(nil, AuditEntry{Action: "train_dictionary", Size: int64(len(data)), Detail: fmt.Sprintf("dictionary %d for %q from %d files", id, owner, len(contents))})
+	fmt.Printf("Trained compression dictionary %d for %q from %d files\n", id, owner, len(contents))
+	return saveDictionaryIndexLocked()
+}
+
+// newDictionaryID picks an unused dictionary ID outside the reserved range.
+func newDictionaryID() (uint32, error) {
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(idRandom, buf[:]); err != nil {
+			return 0, err
+		}
+		id := dictMinID + binary.BigEndian.Uint32(buf[:])%(1<<31-dictMinID)
+		dictionaryMutex.Lock()
+		_, taken := dictionaries[id]
+		dictionaryMutex.Unlock()
+		if !taken {
+			return id, nil
+		}
+	}
+}
+
+// chunkDecoder returns the decoder for frames compressed with the
+// dictionary id, 0 for none, if the owner may use it. Decoders hold at most
+// the largest chunk in memory, so a small body cannot expand without bound.
+func chunkDecoder(id uint32, owner string) (*zstd.Decoder, error) {
+	if id == 0 {
+		var err error
+		plainDecoderOnce.Do(func() {
+			plainDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxChunkSize)))
+		})
+		return plainDecoder, err
+	}
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+	record, ok := dictionaries[id]
+	if !ok || record.Owner != owner {
+		return nil, nil
+	}
+	if decoder, ok := dictionaryDecoders[id]; ok {
+		return decoder, nil
+	}
+	data, err := ioutil.ReadFile(dictionaryPath(id))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxChunkSize)), zstd.WithDecoderDicts(data))
+	if err != nil {
+		return nil, err
+	}
+	dictionaryDecoders[id] = decoder
+	return decoder, nil
+}
+
+// decodeChunk replaces a chunk body sent with Content-Encoding: zstd by the
+// chunk itself, so that it is checked and stored as if it had been sent as
+// is. Content-Length, Content-Digest and Content-MD5 describe the body as
+// sent; Chunk-Hash, Repr-Digest and Digest the chunk.
+func decodeChunk(w http.ResponseWriter, r *http.Request, metadata FileMetadata) bool {
+	encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+	if encoding != "zstd" {
+		writeError(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "Chunks may only be sent with Content-Encoding zstd")
+		return false
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, codeLengthRequired, "Content-Length is required for chunk uploads")
+		return false
+	}
+	if r.ContentLength > int64(metadata.ChunkSize) {
+		chunkTooLarge(w, metadata.ChunkSize)
+		return false
+	}
+	encoded, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeChunkTruncated, "Error reading chunk")
+		return false
+	}
+	if !checkChunkBody(w, r, int64(len(encoded))) {
+		return false
+	}
+
+	sent := http.Header{}
+	for _, field := range []string{"Content-MD5", "Content-Digest"} {
+		if value := r.Header.Get(field); value != "" {
+			sent.Set(field, value)
+		}
+		r.Header.Del(field)
+	}
+	hashes := newTransferHashes(sent)
+	hashes.writer().Write(encoded)
+	if err := verifyTransferDigests(sent, hashes.sums()); err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestMismatch, err.Error())
+		return false
+	}
+
+	var header zstd.Header
+	if err := header.Decode(encoded); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Chunk is not zstd compressed: "+err.Error())
+		return false
+	}
+	if header.HasFCS && header.FrameContentSize > uint64(metadata.ChunkSize) {
+		chunkTooLarge(w, metadata.ChunkSize)
+		return false
+	}
+	decoder, err := chunkDecoder(header.DictionaryID, metadata.Owner)
+	if err != nil {
+		fmt.Printf("Error loading compression dictionary %d: %v\n", header.DictionaryID, err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error loading compression dictionary")
+		return false
+	}
+	if decoder == nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unknown compression dictionary %d", header.DictionaryID))
+		return false
+	}
+	chunk, err := decoder.DecodeAll(encoded, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Error decompressing chunk: "+err.Error())
+		return false
+	}
+	if len(chunk) > metadata.ChunkSize {
+		chunkTooLarge(w, metadata.ChunkSize)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(chunk))
+	r.ContentLength = int64(len(chunk))
+	r.Header.Del("Content-Encoding")
+	return true
+}
+
+// dictionaryHandler serves GET /dictionaries/{id}, the dictionary itself, to
+// its owner and admins.
+func dictionaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/dictionaries/"), 10, 32)
+	principal, admin := requestPrincipal(r)
+	dictionaryMutex.Lock()
+	record, ok := dictionaries[uint32(id)]
+	dictionaryMutex.Unlock()
+	if err != nil || !ok || (!admin && record.Owner != principal) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Dictionary not found")
+		return
+	}
+	file, err := os.Open(dictionaryPath(record.ID))
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "Dictionary not found")
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", record.ID))
+	http.ServeContent(w, r, "", record.CreatedAt, file)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// newDigestHash creates a hash for an algorithm name as used by RFC 3230
+// (lower-cased) and RFC 9530 Digest Fields.
+func newDigestHash(alg string) hash.Hash {
+	switch alg {
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// transferHashes holds every digest a chunk request asks the server to check.
+// SHA-256 is always computed because Chunk-Hash relies on it.
+type transferHashes map[string]hash.Hash
+
+func newTransferHashes(header http.Header) transferHashes {
+	hashes := transferHashes{"sha-256": sha256.New()}
+	add := func(alg string) {
+		if _, ok := hashes[alg]; !ok {
+			if h := newDigestHash(alg); h != nil {
+				hashes[alg] = h
+			}
+		}
+	}
+	if header.Get("Content-MD5") != "" {
+		add("md5")
+	}
+	for alg := range parseDigestHeader(header.Get("Digest")) {
+		add(alg)
+	}
+	for _, field := range []string{"Content-Digest", "Repr-Digest"} {
+		for alg := range parseDigestFields(header.Get(field)) {
+			add(alg)
+		}
+	}
+	return hashes
+}
+
+func (t transferHashes) writer() io.Writer {
+	writers := make([]io.Writer, 0, len(t))
+	for _, h := range t {
+		writers = append(writers, h)
+	}
+	return io.MultiWriter(writers...)
+}
+
+func (t transferHashes) sums() map[string][]byte {
+	sums := make(map[string][]byte, len(t))
+	for alg, h := range t {
+		sums[alg] = h.Sum(nil)
+	}
+	return sums
+}
+
+// parseDigestHeader parses an RFC 3230 Digest header such as
+// "SHA-256=base64, MD5=base64" into lower-cased algorithm names and decoded
+// values. Malformed entries are skipped.
+func parseDigestHeader(value string) map[string][]byte {
+	digests := make(map[string][]byte)
+	for _, entry := range strings.Split(value, ",") {
+		alg, encoded, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		digests[strings.ToLower(alg)] = decoded
+	}
+	return digests
+}
+
+// parseDigestFields parses an RFC 9530 Content-Digest or Repr-Digest field,
+// a structured dictionary like "sha-256=:base64:, sha-512=:base64:".
+// Parameters and malformed members are ignored.
+func parseDigestFields(value string) map[string][]byte {
+	digests := make(map[string][]byte)
+	for _, member := range strings.Split(value, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		alg, item, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || len(item) < 2 || item[0] != ':' || item[len(item)-1] != ':' {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(item[1 : len(item)-1])
+		if err != nil {
+			continue
+		}
+		digests[alg] = decoded
+	}
+	return digests
+}
+
+// parseWantDigest parses Want-Repr-Digest / Want-Content-Digest preferences
+// ("sha-256=10, sha-512=3") into algorithm weights.
+func parseWantDigest(value string) map[string]int {
+	weights := make(map[string]int)
+	for _, member := range strings.Split(value, ",") {
+		alg, weight, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || n < 0 || n > 10 {
+			continue
+		}
+		weights[alg] = n
+	}
+	return weights
+}
+
+func formatDigestFields(digests map[string][]byte) string {
+	var members []string
+	for _, alg := range []string{"sha-256", "sha-512"} {
+		if digest, ok := digests[alg]; ok {
+			members = append(members, alg+"=:"+base64.StdEncoding.EncodeToString(digest)+":")
+		}
+	}
+	return strings.Join(members, ", ")
+}
+
+// verifyTransferDigests checks the optional standard integrity headers a
+// client or proxy may have attached to a chunk: Content-MD5, Digest
+// (RFC 3230) and Content-Digest/Repr-Digest (RFC 9530). A chunk is stored
+// as-is, so its content and representation digests are the same. Algorithms
+// the server does not know are ignored, as both RFCs allow.
+func verifyTransferDigests(header http.Header, sums map[string][]byte) error {
+	if contentMD5 := header.Get("Content-MD5"); contentMD5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil {
+			return fmt.Errorf("malformed Content-MD5 header")
+		}
+		if !bytes.Equal(expected, sums["md5"]) {
+			return fmt.Errorf("Content-MD5 mismatch")
+		}
+	}
+	for alg, expected := range parseDigestHeader(header.Get("Digest")) {
+		if actual, ok := sums[alg]; ok && !bytes.Equal(expected, actual) {
+			return fmt.Errorf("Digest %s mismatch", alg)
+		}
+	}
+	for _, field := range []string{"Content-Digest", "Repr-Digest"} {
+		for alg, expected := range parseDigestFields(header.Get(field)) {
+			if actual, ok := sums[alg]; ok && !bytes.Equal(expected, actual) {
+				return fmt.Errorf("%s %s mismatch", field, alg)
+			}
+		}
+	}
+	return nil
+}
+
+// setDownloadDigests advertises the digests of a stored file so
+// intermediaries and generic tools can check what they received.
+// Repr-Digest describes the whole file and is valid on ranged responses too;
+// Content-Digest, Content-MD5 and Digest describe the body and are only sent
+// when the whole file is. The stored SHA-256 is offered even when
+// Want-Repr-Digest prefers something else, which RFC 9530 permits. A tree
+// hash is no SHA-256 of the content, so only the MD5 is offered for those.
+func setDownloadDigests(w http.ResponseWriter, r *http.Request, metadata FileMetadata) {
+	if !metadata.plainHash() {
+		if r.Header.Get("Range") == "" && metadata.FileMD5 != "" {
+			w.Header().Set("Content-MD5", metadata.FileMD5)
+			w.Header().Set("Digest", "MD5="+metadata.FileMD5)
+		}
+		return
+	}
+	sha, err := hex.DecodeString(metadata.FileHash)
+	if err != nil {
+		return
+	}
+	if weight, ok := parseWantDigest(r.Header.Get("Want-Repr-Digest"))["sha-256"]; !ok || weight > 0 {
+		w.Header().Set("Repr-Digest", formatDigestFields(map[string][]byte{"sha-256": sha}))
+	}
+	if r.Header.Get("Range") != "" {
+		return
+	}
+
+	if weight, ok := parseWantDigest(r.Header.Get("Want-Content-Digest"))["sha-256"]; !ok || weight > 0 {
+		w.Header().Set("Content-Digest", formatDigestFields(map[string][]byte{"sha-256": sha}))
+	}
+	digests := []string{"SHA-256=" + base64.StdEncoding.EncodeToString(sha)}
+	if metadata.FileMD5 != "" {
+		w.Header().Set("Content-MD5", metadata.FileMD5)
+		digests = append(digests, "MD5="+metadata.FileMD5)
+	}
+	w.Header().Set("Digest", strings.Join(digests, ","))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+func availableDiskSpace(path string) (int64, error) {
+	_, available, err := diskSpace(path)
+	return available, err
+}
+
+// diskSpace returns the size of the filesystem holding path and the space
+// available to unprivileged users on it.
+func diskSpace(path string) (total, available int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+var errNoDiskSpace = errors.New("free disk space is not available on windows")
+
+func availableDiskSpace(path string) (int64, error) {
+	return 0, errNoDiskSpace
+}
+
+func diskSpace(path string) (total, available int64, err error) {
+	return 0, 0, errNoDiskSpace
+}
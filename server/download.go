@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func fileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received file metadata request for:", r.URL.Path)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		listFilesHandler(w, r)
+		return
+	}
+	if (len(parts) == 4 || len(parts) == 5) && parts[3] == "acl" {
+		principal := ""
+		if len(parts) == 5 {
+			principal = parts[4]
+		}
+		fileACLHandler(w, r, parts[2], principal)
+		return
+	}
+	if len(parts) == 4 && parts[3] == "thumbnail" {
+		thumbnailHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "tags" {
+		fileTagsHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "restore" {
+		restoreFileHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "integrity" {
+		fileIntegrityHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "peers" {
+		filePeersHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "blocks" {
+		fileBlocksHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "manifest" {
+		fileManifestHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "copy" {
+		copyFileHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "move" {
+		moveFileHandler(w, r, parts[2])
+		return
+	}
+	if len(parts) == 4 && parts[3] == "append" {
+		limitChunkConcurrency(func(w http.ResponseWriter, r *http.Request) {
+			appendFileHandler(w, r, parts[2])
+		})(w, r)
+		return
+	}
+	if len(parts) > 3 {
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+		return
+	}
+	if r.Method == "DELETE" {
+		deleteFileHandler(w, r, parts[2])
+		return
+	}
+	if r.Method == "PUT" {
+		limitChunkConcurrency(putFileHandler)(w, r)
+		return
+	}
+	if r.Method == "PATCH" {
+		patchFileHandler(w, r, parts[2])
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, PUT, PATCH and DELETE methods are allowed")
+		return
+	}
+
+	metadata, ok, err := lookupFileInfo(parts[2])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+
+	response, err := json.Marshal(metadata.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	if notModified(w, r, responseETag(response), storedModTime(metadata)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Downloads can be handed to the reverse proxy in front of the server, which
+// then streams the file from disk itself, handling Range and conditional
+// requests too. Encrypted and erasure coded files are always served by the
+// server, since only it can decrypt or rebuild them.
+const (
+	sendfileAccelRedirect = "x-accel-redirect"
+	sendfileXSendfile     = "x-sendfile"
+)
+
+var (
+	// sendfileMode is "", sendfileAccelRedirect (nginx) or sendfileXSendfile
+	// (Apache mod_xsendfile, lighttpd).
+	sendfileMode string
+	// sendfilePrefix is the internal nginx location that maps to dataDir.
+	sendfilePrefix = "/protected/"
+)
+
+// offloadDownload answers with the headers of the download and tells the
+// proxy where to find the bytes: an internal URI under sendfilePrefix for
+// nginx, the absolute path of the stored file for X-Sendfile.
+func offloadDownload(w http.ResponseWriter, r *http.Request, metadata FileMetadata) {
+	storedPath := finalFilePath(metadata)
+	if _, err := os.Stat(storedPath); err != nil {
+		fmt.Println("Error opening stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(metadata.FileName)))
+	w.Header().Set("File-Hash", metadata.FileHash)
+	w.Header().Set("ETag", fmt.Sprintf("%q", metadata.FileHash))
+	setDownloadDigests(w, r, metadata)
+	if sendfileMode == sendfileXSendfile {
+		absolute, err := filepath.Abs(storedPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+			return
+		}
+		w.Header().Set("X-Sendfile", absolute)
+	} else {
+		w.Header().Set("X-Accel-Redirect", sendfilePrefix+url.PathEscape(filepath.Base(storedPath)))
+	}
+	fmt.Printf("Handing download of %s to the proxy\n", metadata.ID)
+}
+
+// responseETag is a strong validator for a JSON response: the hash of its
+// body, so it changes with anything in it, including ACL changes that leave
+// the stored file alone.
+func responseETag(body []byte) string {
+	return fmt.Sprintf("\"%x\"", sha256.Sum256(body))
+}
+
+// notModified sets ETag and, unless modTime is zero, Last-Modified, and
+// answers the request with 304 Not Modified when the client's copy is
+// current. If-None-Match takes precedence over If-Modified-Since, as in
+// RFC 9110. Responses differ between principals, so caches must key them by
+// Authorization.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Authorization")
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	current := false
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				current = true
+			}
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		current = !modTime.Truncate(time.Second).After(since)
+	}
+	if current {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return current
+}
+
+// downloadHandler streams a completed file. http.ServeContent takes care of
+// Range and If-Range requests so interrupted downloads can be resumed, and of
+// conditional requests so unchanged files are not fetched again.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received download request for:", r.URL.Path)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and HEAD methods are allowed")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid URL")
+		return
+	}
+
+	metadata, ok, err := lookupFileInfo(parts[2])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+	serveStoredFile(w, r, metadata)
+}
+
+// serveStoredFile answers a GET or HEAD request with the content of a
+// stored file.
+func serveStoredFile(w http.ResponseWriter, r *http.Request, metadata FileMetadata) {
+	if sendfileMode != "" && !metadata.Encrypted && !erasureCoded(metadata) {
+		offloadDownload(w, r, metadata)
+		return
+	}
+	file, err := openDownload(metadata)
+	if err == errFileChanging {
+		writeInUse(w, 0)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error opening stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading stored file")
+		return
+	}
+
+	content, err := storedFileReader(file, metadata)
+	if err != nil {
+		fmt.Println("Error opening stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(metadata.FileName)))
+	w.Header().Set("File-Hash", metadata.FileHash)
+	// The content hash identifies the bytes served; http.ServeContent answers
+	// If-None-Match and If-Modified-Since (with Last-Modified from the stored
+	// file) as well as If-Range with it.
+	w.Header().Set("ETag", fmt.Sprintf("%q", metadata.FileHash))
+	setDownloadDigests(w, r, metadata)
+	http.ServeContent(w, r, metadata.FileName, stat.ModTime(), content)
+}
@@ -0,0 +1,2326 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The end-to-end tests drive the server's full handler, middleware included,
+// over HTTP. Each test server gets its own data directory, a fake clock and
+// a seeded ID generator, so runs are reproducible. The server keeps its state
+// in package globals, so these tests must not run in parallel.
+
+// testEpoch is where fake clocks start.
+var testEpoch = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakeClock only moves when a test advances it.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+// seededReader is a deterministic idRandom, safe for concurrent uploads.
+type seededReader struct {
+	mutex sync.Mutex
+	rng   *rand.Rand
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rng.Read(p)
+}
+
+type testServer struct {
+	*httptest.Server
+	t     *testing.T
+	clock *fakeClock
+}
+
+// newTestServer starts a server with an empty data directory whose IDs come
+// from seed.
+func newTestServer(t *testing.T, seed int64) *testServer {
+	t.Helper()
+	savedDataDir, savedNow, savedRandom, savedKey := dataDir, timeNow, idRandom, linkKey
+	dataDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadLinkKey(); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: testEpoch}
+	timeNow = clock.Now
+	idRandom = &seededReader{rng: rand.New(rand.NewSource(seed))}
+	metadataMutex.Lock()
+	filesMetadata = make(map[string]FileMetadata)
+	metadataMutex.Unlock()
+	invalidateSearchIndex()
+
+	server := &testServer{Server: httptest.NewServer(newHandler(http.NewServeMux())), t: t, clock: clock}
+	t.Cleanup(func() {
+		server.Close()
+		dataDir, timeNow, idRandom, linkKey = savedDataDir, savedNow, savedRandom, savedKey
+	})
+	return server
+}
+
+// do sends a request and decodes a JSON response into out, if given. It
+// returns the status, and the error code of error responses; requests that
+// fail without a response are reported and return 0. As it never stops the
+// test, goroutines may use it.
+func (s *testServer) do(method, path string, body []byte, header http.Header, out interface{}) (int, string) {
+	s.t.Helper()
+	request, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		s.t.Error(err)
+		return 0, ""
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	resp, err := s.Client().Do(request)
+	if err != nil {
+		s.t.Errorf("%s %s: %v", method, path, err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Errorf("%s %s: %v", method, path, err)
+		return 0, ""
+	}
+	if resp.StatusCode >= 400 {
+		var errorResponse ErrorResponse
+		json.Unmarshal(data, &errorResponse)
+		return resp.StatusCode, errorResponse.Code
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			s.t.Errorf("%s %s: decoding %q: %v", method, path, data, err)
+			return 0, ""
+		}
+	}
+	return resp.StatusCode, ""
+}
+
+func registrationBody(name string, content []byte, chunkSize int) []byte {
+	body, _ := json.Marshal(FileMetadata{FileName: name, FileSize: int64(len(content)), FileHash: sha256Hex(content), ChunkSize: chunkSize})
+	return body
+}
+
+func (s *testServer) register(name string, content []byte, chunkSize int) registrationResponse {
+	s.t.Helper()
+	var registration registrationResponse
+	if status, code := s.do("POST", "/register_file", registrationBody(name, content, chunkSize), nil, &registration); status != http.StatusOK {
+		s.t.Fatalf("registering %s: %d %s", name, status, code)
+	}
+	return registration
+}
+
+// sendChunk uploads chunk chunkNumber of content, declaring hash as its
+// Chunk-Hash, or the real hash if hash is "".
+func (s *testServer) sendChunk(metadata FileMetadata, content []byte, chunkNumber int, hash string) (int, string) {
+	s.t.Helper()
+	start := (chunkNumber - 1) * metadata.ChunkSize
+	end := start + metadata.ChunkSize
+	if end > len(content) {
+		end = len(content)
+	}
+	chunk := content[start:end]
+	if hash == "" {
+		hash = sha256Hex(chunk)
+	}
+	return s.do("POST", fmt.Sprintf("/upload_chunk/%s/%d", metadata.ID, chunkNumber), chunk, http.Header{"Chunk-Hash": {hash}}, nil)
+}
+
+func (s *testServer) complete(fileID string) (UploadReport, int, string) {
+	s.t.Helper()
+	var report UploadReport
+	status, code := s.do("POST", "/complete_upload/"+fileID, nil, nil, &report)
+	return report, status, code
+}
+
+// restart replaces the server with a new one on the same data directory,
+// as after the process was restarted.
+func (s *testServer) restart() {
+	s.Close()
+	metadataMutex.Lock()
+	filesMetadata = make(map[string]FileMetadata)
+	metadataMutex.Unlock()
+	invalidateSearchIndex()
+	s.Server = httptest.NewServer(newHandler(http.NewServeMux()))
+}
+
+func (s *testServer) download(fileID string) []byte {
+	s.t.Helper()
+	resp, err := s.Client().Get(s.URL + "/download/" + fileID)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("downloading %s: %s %s", fileID, resp.Status, data)
+	}
+	return data
+}
+
+// upload stores content as a file named name and returns its metadata.
+func (s *testServer) upload(name string, content []byte) FileMetadata {
+	s.t.Helper()
+	registration := s.register(name, content, minChunkSize)
+	for chunkNumber := 1; chunkNumber <= registration.TotalChunks; chunkNumber++ {
+		if status, code := s.sendChunk(registration.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			s.t.Fatalf("uploading chunk %d of %s: %d %s", chunkNumber, name, status, code)
+		}
+	}
+	if _, status, code := s.complete(registration.ID); status != http.StatusOK {
+		s.t.Fatalf("completing %s: %d %s", name, status, code)
+	}
+	var metadata FileMetadata
+	if status, code := s.do("GET", "/files/"+registration.ID, nil, nil, &metadata); status != http.StatusOK {
+		s.t.Fatalf("reading metadata of %s: %d %s", name, status, code)
+	}
+	return metadata
+}
+
+// waitFor polls condition, which background work of the server makes true,
+// for up to five seconds of real time.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func sha256Hex(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// testContent returns size reproducible pseudo-random bytes.
+func testContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func TestE2EUploadAndDownload(t *testing.T) {
+	server := newTestServer(t, 1)
+	content := testContent(1, 10<<20+12345)
+
+	registration := server.register("e2e/large.bin", content, 0)
+	// The default chunk policy gives files from 8 MiB 1 MiB chunks.
+	if registration.ChunkSize != 1<<20 || registration.RecommendedChunkSize != 1<<20 || registration.TotalChunks != 11 {
+		t.Fatalf("chunk size %d (recommended %d), %d chunks; want 1 MiB and 11 chunks",
+			registration.ChunkSize, registration.RecommendedChunkSize, registration.TotalChunks)
+	}
+	if registration.ChunkSizeRule != "* from 8388608 bytes" {
+		t.Errorf("chunk size rule %q", registration.ChunkSizeRule)
+	}
+	// Chunks may arrive in any order.
+	for chunkNumber := registration.TotalChunks; chunkNumber >= 1; chunkNumber-- {
+		if status, code := server.sendChunk(registration.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	server.clock.Advance(4 * time.Second)
+	report, status, code := server.complete(registration.ID)
+	if status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+	if report.ID != registration.ID || report.TotalBytes != int64(len(content)) || report.ElapsedSeconds != 4 {
+		t.Errorf("report %+v; want %d bytes in 4 seconds", report, len(content))
+	}
+	if !bytes.Equal(server.download(registration.ID), content) {
+		t.Error("downloaded content differs from the upload")
+	}
+
+	var files []FileMetadata
+	if status, code := server.do("GET", "/files", nil, nil, &files); status != http.StatusOK {
+		t.Fatalf("listing: %d %s", status, code)
+	}
+	if len(files) != 1 || files[0].ID != registration.ID || files[0].FileHash != sha256Hex(content) {
+		t.Errorf("listed %+v", files)
+	}
+}
+
+func TestE2EDeterministicIDs(t *testing.T) {
+	content := testContent(2, 1000)
+	var ids [2][]string
+	for run := range ids {
+		server := newTestServer(t, 42)
+		for i := 0; i < 3; i++ {
+			ids[run] = append(ids[run], server.register(fmt.Sprintf("id%d.bin", i), content, 0).ID)
+			server.clock.Advance(time.Millisecond)
+		}
+	}
+	for i := range ids[0] {
+		if ids[0][i] != ids[1][i] {
+			t.Errorf("registration %d got ID %s, then %s with the same seed and clock", i, ids[0][i], ids[1][i])
+		}
+	}
+	// UUIDv7 IDs start with the millisecond timestamp of the clock.
+	if want := fmt.Sprintf("%012x", testEpoch.UnixMilli()); ids[0][0][:8]+ids[0][0][9:13] != want {
+		t.Errorf("ID %s does not start with the fake clock's time %s", ids[0][0], want)
+	}
+	if other := newTestServer(t, 43).register("id0.bin", content, 0).ID; other == ids[0][0] {
+		t.Errorf("seeds 42 and 43 both gave ID %s", other)
+	}
+}
+
+func TestE2EResume(t *testing.T) {
+	server := newTestServer(t, 3)
+	content := testContent(3, 5*minChunkSize+100)
+	registration := server.register("resume.bin", content, minChunkSize)
+	if registration.ResumptionToken == "" || !registration.ResumptionExpiresAt.Equal(testEpoch.Add(resumptionLifetime)) {
+		t.Fatalf("resumption token %q expiring at %v", registration.ResumptionToken, registration.ResumptionExpiresAt)
+	}
+	for _, chunkNumber := range []int{1, 2, 4} {
+		if status, code := server.sendChunk(registration.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+
+	// A client holding only the token learns what is left to send.
+	tokenBody, _ := json.Marshal(map[string]string{"resumptionToken": registration.ResumptionToken})
+	var resumed ResumptionStatus
+	if status, code := server.do("POST", "/resume_upload", tokenBody, nil, &resumed); status != http.StatusOK {
+		t.Fatalf("resuming: %d %s", status, code)
+	}
+	if resumed.FileID != registration.ID || resumed.ChunkSize != minChunkSize || resumed.Complete ||
+		fmt.Sprint(resumed.ReceivedChunks) != "[1 2 4]" {
+		t.Fatalf("resumption status %+v; want chunks [1 2 4] of %s", resumed, registration.ID)
+	}
+	for _, chunkNumber := range []int{3, 5, 6} {
+		if status, code := server.sendChunk(registration.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	if _, status, code := server.complete(registration.ID); status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+	if status, _ := server.do("POST", "/resume_upload", tokenBody, nil, &resumed); status != http.StatusOK || !resumed.Complete || resumed.File == nil {
+		t.Errorf("after completion: status %d, %+v", status, resumed)
+	}
+
+	tampered, _ := json.Marshal(map[string]string{"resumptionToken": "x" + registration.ResumptionToken})
+	if status, code := server.do("POST", "/resume_upload", tampered, nil, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("tampered token: %d %s", status, code)
+	}
+	server.clock.Advance(resumptionLifetime)
+	if status, code := server.do("POST", "/resume_upload", tokenBody, nil, nil); status != http.StatusGone || code != codeResumptionExpired {
+		t.Errorf("expired token: %d %s", status, code)
+	}
+}
+
+func TestE2EMismatch(t *testing.T) {
+	server := newTestServer(t, 4)
+	content := testContent(4, 2*minChunkSize)
+
+	registration := server.register("chunk-mismatch.bin", content, minChunkSize)
+	if status, code := server.sendChunk(registration.FileMetadata, content, 1, sha256Hex([]byte("other"))); status != http.StatusBadRequest || code != codeChunkHashMismatch {
+		t.Errorf("chunk with a wrong hash: %d %s", status, code)
+	}
+	if status, code := server.sendChunk(registration.FileMetadata, content, 1, ""); status != http.StatusOK {
+		t.Errorf("resent chunk: %d %s", status, code)
+	}
+
+	// The chunks are intact, but the file is not the registered one.
+	body, _ := json.Marshal(FileMetadata{FileName: "file-mismatch.bin", FileSize: int64(len(content)), FileHash: sha256Hex([]byte("other")), ChunkSize: minChunkSize})
+	var wrong registrationResponse
+	if status, code := server.do("POST", "/register_file", body, nil, &wrong); status != http.StatusOK {
+		t.Fatalf("registering: %d %s", status, code)
+	}
+	for chunkNumber := 1; chunkNumber <= wrong.TotalChunks; chunkNumber++ {
+		if status, code := server.sendChunk(wrong.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	if _, status, code := server.complete(wrong.ID); status != http.StatusBadRequest || code != codeFileHashMismatch {
+		t.Errorf("completing a file with the wrong hash: %d %s", status, code)
+	}
+	if status, code := server.do("GET", "/download/"+wrong.ID, nil, nil, nil); status != http.StatusNotFound {
+		t.Errorf("downloading the rejected file: %d %s", status, code)
+	}
+}
+
+// TestE2EChunkVerifiedBeforeWrite sends a chunk with a wrong hash both
+// verified in memory and spilled to a temporary file: neither leaves a chunk
+// file in the upload's directory, and the quarantine keeps the rejected bytes.
+func TestE2EChunkVerifiedBeforeWrite(t *testing.T) {
+	server := newTestServer(t, 19)
+	content := testContent(19, 2*minChunkSize)
+	saved := bufferedChunkLimit
+	t.Cleanup(func() { bufferedChunkLimit = saved })
+
+	for _, limit := range []int64{saved, 0} {
+		bufferedChunkLimit = limit
+		registration := server.register(fmt.Sprintf("verified-%d.bin", limit), content, minChunkSize)
+		if status, code := server.sendChunk(registration.FileMetadata, content, 1, sha256Hex([]byte("other"))); status != http.StatusBadRequest || code != codeChunkHashMismatch {
+			t.Errorf("limit %d: chunk with a wrong hash: %d %s", limit, status, code)
+		}
+		if parts, _ := filepath.Glob(filepath.Join(uploadTmpDir(registration.ID), "part_*")); len(parts) != 0 {
+			t.Errorf("limit %d: rejected chunk left %v in the upload directory", limit, parts)
+		}
+		if _, status, code := server.complete(registration.ID); status == http.StatusOK {
+			t.Errorf("limit %d: completed an upload missing its rejected chunk: %d %s", limit, status, code)
+		}
+	}
+
+	records, err := readQuarantineRecords()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("quarantine records: %d, %v", len(records), err)
+	}
+	for _, record := range records {
+		data, err := ioutil.ReadFile(filepath.Join(quarantineDir(), record.ID+".bin"))
+		if !record.DataKept || err != nil || !bytes.Equal(data, content[:minChunkSize]) {
+			t.Errorf("quarantined chunk of %s: kept %v, %d bytes, %v", record.FileID, record.DataKept, len(data), err)
+		}
+	}
+	if entries, _ := filepath.Glob(filepath.Join(quarantineDir(), "*.tmp")); len(entries) != 0 {
+		t.Errorf("spilled chunks left in the quarantine: %v", entries)
+	}
+}
+
+func TestE2EEncryptedChunkResent(t *testing.T) {
+	server := newTestServer(t, 21)
+	content := testContent(21, 2*minChunkSize)
+	savedKeys, savedKeyID, savedDefer := masterKeys, currentKeyID, deferChunkVerification
+	t.Cleanup(func() { masterKeys, currentKeyID, deferChunkVerification = savedKeys, savedKeyID, savedDefer })
+	masterKeys, currentKeyID = map[string][]byte{"": testContent(22, dataKeySize)}, ""
+	deferChunkVerification = true
+
+	// A chunk stored with the wrong bytes fails at completion and is sent
+	// again with the right ones, under the same data key.
+	registration := server.register("encrypted.bin", content, minChunkSize)
+	hash := sha256Hex(content[:minChunkSize])
+	wrong := testContent(23, minChunkSize)
+	if status, code := server.sendChunk(registration.FileMetadata, wrong, 1, hash); status != http.StatusOK {
+		t.Fatalf("chunk with the wrong bytes: %d %s", status, code)
+	}
+	first, err := ioutil.ReadFile(chunkFilePath(registration.ID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, code := server.sendChunk(registration.FileMetadata, content, 2, ""); status != http.StatusOK {
+		t.Fatalf("chunk 2: %d %s", status, code)
+	}
+	if _, status, code := server.complete(registration.ID); status != http.StatusBadRequest || code != codeChunkHashMismatch {
+		t.Fatalf("completion with the wrong chunk: %d %s", status, code)
+	}
+	if status, code := server.sendChunk(registration.FileMetadata, content, 1, hash); status != http.StatusOK {
+		t.Fatalf("chunk sent again: %d %s", status, code)
+	}
+	second, err := ioutil.ReadFile(chunkFilePath(registration.ID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != minChunkSize+gcmNonceSize+gcmTagSize {
+		t.Errorf("sealed chunk takes %d bytes", len(second))
+	}
+	// Under a reused nonce both ciphertexts are XORed with the same keystream.
+	reused := true
+	for i := 0; i < 64; i++ {
+		if first[gcmNonceSize+i]^wrong[i] != second[gcmNonceSize+i]^content[i] {
+			reused = false
+		}
+	}
+	if bytes.Equal(first[:gcmNonceSize], second[:gcmNonceSize]) || reused {
+		t.Error("chunk sent again with other bytes was sealed under the same nonce")
+	}
+
+	if _, status, code := server.complete(registration.ID); status != http.StatusOK {
+		t.Fatalf("complete: %d %s", status, code)
+	}
+	if got := server.download(registration.ID); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes that differ from the upload", len(got))
+	}
+}
+
+func TestE2EUnregisteredChunks(t *testing.T) {
+	server := newTestServer(t, 5)
+	content := testContent(5, 2*minChunkSize)
+
+	unknown := FileMetadata{ID: "0a1b-2c3d", ChunkSize: minChunkSize}
+	if status, code := server.sendChunk(unknown, content, 1, ""); status != http.StatusNotFound || code != codeUploadNotFound {
+		t.Errorf("chunk of an unregistered ID: %d %s", status, code)
+	}
+	if _, err := os.Stat(uploadTmpDir(unknown.ID)); !os.IsNotExist(err) {
+		t.Errorf("chunk of an unregistered ID was written: %v", err)
+	}
+
+	registration := server.register("chunk-numbers.bin", content, minChunkSize)
+	chunk := content[:minChunkSize]
+	path := fmt.Sprintf("/upload_chunk/%s/%d", registration.ID, registration.TotalChunks+1)
+	if status, code := server.do("POST", path, chunk, http.Header{"Chunk-Hash": {sha256Hex(chunk)}}, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("chunk number past totalChunks: %d %s", status, code)
+	}
+	if _, err := os.Stat(chunkFilePath(registration.ID, registration.TotalChunks+1)); !os.IsNotExist(err) {
+		t.Errorf("chunk past totalChunks was written: %v", err)
+	}
+}
+
+func TestE2ESparseUpload(t *testing.T) {
+	server := newTestServer(t, 6)
+	content := testContent(6, 5*minChunkSize)
+	// Chunks 2 and 3 lie in a hole; the hole in chunk 5 only covers part of
+	// it, so that chunk is still sent.
+	holes := []FileHole{{Offset: minChunkSize, Length: 2 * minChunkSize}, {Offset: 4*minChunkSize + 100, Length: minChunkSize - 100}}
+	for _, hole := range holes {
+		copy(content[hole.Offset:hole.Offset+hole.Length], make([]byte, hole.Length))
+	}
+
+	overlapping := registration{FileMetadata: FileMetadata{FileName: "overlapping.img", FileSize: int64(len(content)), FileHash: sha256Hex(content), ChunkSize: minChunkSize},
+		Holes: []FileHole{{Offset: 0, Length: 2 * minChunkSize}, {Offset: minChunkSize, Length: minChunkSize}}}
+	body, _ := json.Marshal(overlapping)
+	if status, code := server.do("POST", "/register_file", body, nil, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("overlapping holes: %d %s", status, code)
+	}
+
+	request := registration{FileMetadata: overlapping.FileMetadata, Holes: holes}
+	request.FileName = "disk.img"
+	body, _ = json.Marshal(request)
+	var registered registrationResponse
+	if status, code := server.do("POST", "/register_file", body, nil, &registered); status != http.StatusOK {
+		t.Fatalf("registering: %d %s", status, code)
+	}
+	if fmt.Sprint(registered.HoleChunks) != "[2 3]" || !registered.Sparse {
+		t.Fatalf("hole chunks %v, sparse %v; want [2 3], true", registered.HoleChunks, registered.Sparse)
+	}
+	for _, chunkNumber := range []int{1, 4, 5} {
+		if status, code := server.sendChunk(registered.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	if _, status, code := server.complete(registered.ID); status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+	if !bytes.Equal(server.download(registered.ID), content) {
+		t.Error("sparse file downloaded differently")
+	}
+}
+
+func TestE2EFileAttributes(t *testing.T) {
+	server := newTestServer(t, 7)
+	content := testContent(7, 2*minChunkSize)
+	modTime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	uid, gid := 1000, 100
+	metadata := FileMetadata{FileName: "backup.bin", FileSize: int64(len(content)), FileHash: sha256Hex(content), ChunkSize: minChunkSize,
+		Attributes: &FileAttributes{ModTime: &modTime, Mode: 010000}}
+	body, _ := json.Marshal(metadata)
+	if status, code := server.do("POST", "/register_file", body, nil, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("file type bits in mode: %d %s", status, code)
+	}
+
+	metadata.Attributes = &FileAttributes{ModTime: &modTime, Mode: 04750, UID: &uid, GID: &gid, User: "alice", Group: "users",
+		Xattrs: map[string]string{"user.comment": "aGVsbG8="}}
+	body, _ = json.Marshal(metadata)
+	var registered registrationResponse
+	if status, code := server.do("POST", "/register_file", body, nil, &registered); status != http.StatusOK {
+		t.Fatalf("registering: %d %s", status, code)
+	}
+	for chunkNumber := 1; chunkNumber <= registered.TotalChunks; chunkNumber++ {
+		if status, code := server.sendChunk(registered.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	if _, status, code := server.complete(registered.ID); status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+
+	var stored FileMetadata
+	if status, code := server.do("GET", "/files/"+registered.ID, nil, nil, &stored); status != http.StatusOK {
+		t.Fatalf("fetching metadata: %d %s", status, code)
+	}
+	got, _ := json.Marshal(stored.Attributes)
+	if want, _ := json.Marshal(metadata.Attributes); !bytes.Equal(got, want) {
+		t.Errorf("stored attributes %s, want %s", got, want)
+	}
+
+	resp, err := server.Client().Get(server.URL + "/download_archive?format=tar.gz&ids=" + registered.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := tar.NewReader(gz).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "backup.bin" || header.Mode != 04750 || !header.ModTime.Equal(modTime) || header.Uid != uid || header.Gid != gid ||
+		header.Uname != "alice" || header.Gname != "users" || header.PAXRecords["SCHILY.xattr.user.comment"] != "hello" {
+		t.Errorf("tar header %+v", header)
+	}
+}
+
+func TestE2EDirectoryArchive(t *testing.T) {
+	server := newTestServer(t, 8)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"photos/a.jpg", testContent(81, 1000)},
+		{"photos/trip/b.jpg", testContent(82, 2000)},
+		{"photos/a.jpg", testContent(83, 3000)},
+		{"photos2/c.jpg", testContent(84, 4000)},
+	}
+	for _, file := range files {
+		registered := server.register(file.name, file.content, 0)
+		if status, code := server.sendChunk(registered.FileMetadata, file.content, 1, ""); status != http.StatusOK {
+			t.Fatalf("chunk of %s: %d %s", file.name, status, code)
+		}
+		if _, status, code := server.complete(registered.ID); status != http.StatusOK {
+			t.Fatalf("completing %s: %d %s", file.name, status, code)
+		}
+	}
+
+	if status, code := server.do("GET", "/download_archive?prefix=missing", nil, nil, nil); status != http.StatusNotFound || code != codeFileNotFound {
+		t.Errorf("empty directory: %d %s", status, code)
+	}
+	resp, err := server.Client().Get(server.URL + "/download_archive?format=tar.gz&prefix=photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(gz)
+	got := make(map[string]int64)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[header.Name] = header.Size
+	}
+	// Only the newest copy of a.jpg is archived, and photos2 is another
+	// directory.
+	want := map[string]int64{"photos/a.jpg": 3000, "photos/trip/b.jpg": 2000, archiveManifestName: got[archiveManifestName]}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestE2EGarbageCollection(t *testing.T) {
+	server := newTestServer(t, 9)
+	savedToken := adminToken
+	adminToken = "gc-token"
+	t.Cleanup(func() { adminToken = savedToken })
+	admin := http.Header{"Authorization": {"Bearer gc-token"}}
+
+	content := testContent(9, minChunkSize)
+	registered := server.register("kept.bin", content, 0)
+	if status, code := server.sendChunk(registered.FileMetadata, content, 1, ""); status != http.StatusOK {
+		t.Fatalf("chunk: %d %s", status, code)
+	}
+	if _, status, code := server.complete(registered.ID); status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+
+	// The stored file ends up under another name, next to a stored file and
+	// an upload directory nothing refers to. All of them are older than the
+	// grace period, except for one more orphan.
+	stored := finalFilePath(registered.FileMetadata)
+	misplaced := filepath.Join(dataDir, "final_"+registered.ID+"_renamed.bin")
+	orphan := filepath.Join(dataDir, "final_0000orphan_lost.bin")
+	recent := filepath.Join(dataDir, "final_0000recent_new.bin")
+	orphanUpload := uploadTmpDir("0000upload")
+	if err := os.Rename(stored, misplaced); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{orphan, recent, filepath.Join(orphanUpload, "part_1")} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := testEpoch.Add(-2 * gcGracePeriod)
+	for _, path := range []string{misplaced, orphan, orphanUpload} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kinds := func(report GCReport) string {
+		var found []string
+		for _, issue := range report.Issues {
+			found = append(found, fmt.Sprintf("%s:%s:%v", issue.Kind, filepath.Base(issue.Path), issue.Repaired))
+		}
+		sort.Strings(found)
+		return fmt.Sprint(found)
+	}
+
+	var report GCReport
+	if status, code := server.do("GET", "/admin/gc", nil, admin, &report); status != http.StatusOK {
+		t.Fatalf("dry run: %d %s", status, code)
+	}
+	want := "[misplaced_file:final_" + registered.ID + "_renamed.bin:false orphan_file:final_0000orphan_lost.bin:false orphan_upload:0000upload:false]"
+	if got := kinds(report); !report.DryRun || got != want || report.SkippedRecent != 1 {
+		t.Errorf("dry run found %s, skipped %d; want %s, 1", got, report.SkippedRecent, want)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("dry run changed the data directory: %v", err)
+	}
+
+	if status, code := server.do("POST", "/admin/gc", nil, admin, &report); status != http.StatusOK {
+		t.Fatalf("collecting garbage: %d %s", status, code)
+	}
+	if got := kinds(report); report.DryRun || got != strings.ReplaceAll(want, "false", "true") {
+		t.Errorf("collection did %s", got)
+	}
+	for _, path := range []string{orphan, orphanUpload} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is still there", path)
+		}
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent file was removed: %v", err)
+	}
+	if !bytes.Equal(server.download(registered.ID), content) {
+		t.Error("misplaced file was not put back")
+	}
+}
+
+func TestE2EUploadSnapshotRecovery(t *testing.T) {
+	server := newTestServer(t, 10)
+	var err error
+	walFile, err = os.OpenFile(filepath.Join(dataDir, uploadsWAL), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := func() {
+		walMutex.Lock()
+		if walFile != nil {
+			walFile.Close()
+			walFile = nil
+		}
+		walMutex.Unlock()
+	}
+	t.Cleanup(crash)
+
+	content := testContent(10, 3*minChunkSize)
+	registered := server.register("snapshot.bin", content, minChunkSize)
+	if status, code := server.sendChunk(registered.FileMetadata, content, 1, ""); status != http.StatusOK {
+		t.Fatalf("chunk 1: %d %s", status, code)
+	}
+	if err := takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// The retransmission and chunk 2 are only in the log, and the session
+	// file is lost with the crash.
+	server.clock.Advance(10 * time.Second)
+	for _, chunkNumber := range []int{1, 2} {
+		if status, code := server.sendChunk(registered.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+		}
+	}
+	crash()
+	os.Remove(sessionPath(registered.ID))
+	metadataMutex.Lock()
+	delete(filesMetadata, registered.ID)
+	metadataMutex.Unlock()
+	forgetTransfer(registered.ID)
+
+	if restored, err := restoreSessions(); err != nil || restored != 0 {
+		t.Fatalf("restored %d sessions: %v", restored, err)
+	}
+	if recovered, err := loadSnapshot(); err != nil || recovered != 1 {
+		t.Fatalf("recovered %d sessions from the snapshot: %v", recovered, err)
+	}
+	if err := replayWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sessionPath(registered.ID)); err != nil {
+		t.Errorf("session was not written again: %v", err)
+	}
+
+	server.clock.Advance(10 * time.Second)
+	if status, code := server.sendChunk(registered.FileMetadata, content, 3, ""); status != http.StatusOK {
+		t.Fatalf("chunk 3: %d %s", status, code)
+	}
+	report, status, code := server.complete(registered.ID)
+	if status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+	if report.TotalRetransmits != 1 || report.Retransmits[1] != 1 || report.ElapsedSeconds != 20 {
+		t.Errorf("report after recovery has retransmits %v over %vs, want chunk 1 once over 20s", report.Retransmits, report.ElapsedSeconds)
+	}
+	if !bytes.Equal(server.download(registered.ID), content) {
+		t.Error("recovered upload downloaded differently")
+	}
+}
+
+// smallRecord is one of many small, similar files, such as log records.
+func smallRecord(i int) []byte {
+	var record bytes.Buffer
+	for line := 0; line < 40; line++ {
+		fmt.Fprintf(&record, "{\"timestamp\": \"2024-01-02T03:%02d:%02dZ\", \"level\": \"info\", \"service\": \"checkout\", \"request\": %d, \"message\": \"order %d accepted for delivery\"}\n", i%60, line, i*100+line, i*7+line)
+	}
+	return record.Bytes()
+}
+
+func TestE2ECompressionDictionary(t *testing.T) {
+	server := newTestServer(t, 11)
+	compressionDictionaries = true
+	t.Cleanup(func() {
+		compressionDictionaries = false
+		dictionaryMutex.Lock()
+		// Committing the group may have started training again.
+		for len(dictionaryTraining) > 0 {
+			dictionaryMutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			dictionaryMutex.Lock()
+		}
+		dictionaries = make(map[uint32]*dictionaryRecord)
+		dictionaryDecoders = make(map[uint32]*zstd.Decoder)
+		dictionaryMutex.Unlock()
+	})
+	if err := loadDictionaries(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < dictMinSamples+8; i++ {
+		content := smallRecord(i)
+		registered := server.register(fmt.Sprintf("record-%d.json", i), content, 0)
+		if status, code := server.sendChunk(registered.FileMetadata, content, 1, ""); status != http.StatusOK {
+			t.Fatalf("chunk of record %d: %d %s", i, status, code)
+		}
+		if _, status, code := server.complete(registered.ID); status != http.StatusOK {
+			t.Fatalf("completing record %d: %d %s", i, status, code)
+		}
+	}
+
+	registerGroup := func(content []byte) GroupResponse {
+		body, _ := json.Marshal(GroupRegistration{Files: []FileMetadata{{FileName: "batch.json", FileSize: int64(len(content)), FileHash: sha256Hex(content)}}, Compression: "zstd"})
+		var group GroupResponse
+		if status, code := server.do("POST", "/register_group", body, nil, &group); status != http.StatusOK {
+			t.Fatalf("registering group: %d %s", status, code)
+		}
+		return group
+	}
+	content := smallRecord(1000)
+	if group := registerGroup(content); group.CompressionDictionary != nil {
+		t.Fatalf("first group was offered dictionary %d before one was trained", group.CompressionDictionary.ID)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		dictionaryMutex.Lock()
+		trained, training := len(dictionaries), dictionaryTraining[""]
+		dictionaryMutex.Unlock()
+		if trained > 0 && !training {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no dictionary was trained")
+		}
+	}
+
+	group := registerGroup(content)
+	offered := group.CompressionDictionary
+	if offered == nil || offered.Samples != dictMinSamples+8 {
+		t.Fatalf("group was offered %+v, want a dictionary of %d files", offered, dictMinSamples+8)
+	}
+	resp, err := server.Client().Get(server.URL + offered.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(data) != offered.Size {
+		t.Fatalf("fetching dictionary: %s, %d bytes", resp.Status, len(data))
+	}
+
+	plain, _ := zstd.NewWriter(nil)
+	withDictionary, err := zstd.NewWriter(nil, zstd.WithEncoderDict(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := withDictionary.EncodeAll(content, nil)
+	if without := plain.EncodeAll(content, nil); len(compressed) >= len(without) {
+		t.Errorf("compressed to %d bytes with the dictionary, %d without", len(compressed), len(without))
+	}
+
+	member := group.Files[0]
+	chunkPath := fmt.Sprintf("/upload_chunk/%s/1", member.ID)
+	header := http.Header{"Chunk-Hash": {sha256Hex(content)}, "Content-Encoding": {"gzip"}}
+	if status, _ := server.do("POST", chunkPath, compressed, header, nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("gzip chunk got %d, want 415", status)
+	}
+	header.Set("Content-Encoding", "zstd")
+	if status, code := server.do("POST", chunkPath, compressed, header, nil); status != http.StatusOK {
+		t.Fatalf("compressed chunk: %d %s", status, code)
+	}
+	if _, status, code := server.complete(member.ID); status != http.StatusOK {
+		t.Fatalf("completing member: %d %s", status, code)
+	}
+	if !bytes.Equal(server.download(member.ID), content) {
+		t.Error("compressed chunk was stored differently")
+	}
+}
+
+func TestE2ESmallUpload(t *testing.T) {
+	server := newTestServer(t, 12)
+	content := testContent(12, 1500)
+	header := http.Header{
+		"File-Hash":       {sha256Hex(content)},
+		"File-Attributes": {`{"mode":420}`},
+	}
+
+	var report UploadReport
+	if status, code := server.do("POST", "/upload_small?name=notes/small.txt&tag=kind=note", content, header, &report); status != http.StatusOK {
+		t.Fatalf("uploading: %d %s", status, code)
+	}
+	if report.TotalBytes != int64(len(content)) || report.URL != "/download/"+report.ID {
+		t.Errorf("report %+v", report)
+	}
+	if !bytes.Equal(server.download(report.ID), content) {
+		t.Error("downloaded content differs from the upload")
+	}
+	var metadata FileMetadata
+	if status, code := server.do("GET", "/files/"+report.ID, nil, nil, &metadata); status != http.StatusOK {
+		t.Fatalf("reading metadata: %d %s", status, code)
+	}
+	if metadata.FileName != "notes/small.txt" || metadata.FileHash != sha256Hex(content) || metadata.TotalChunks != 1 ||
+		metadata.Tags["kind"] != "note" || metadata.Attributes == nil || metadata.Attributes.Mode != 0644 {
+		t.Errorf("metadata %+v", metadata)
+	}
+
+	// A body that does not match File-Hash is not stored.
+	header.Set("File-Hash", sha256Hex(content[1:]))
+	if status, code := server.do("POST", "/upload_small?name=bad.txt", content, header, nil); status != http.StatusBadRequest || code != codeFileHashMismatch {
+		t.Errorf("mismatched upload: %d %s", status, code)
+	}
+	if status, code := server.do("POST", "/upload_small?name=bad.txt", content, nil, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("upload without File-Hash: %d %s", status, code)
+	}
+	var files []FileMetadata
+	server.do("GET", "/files", nil, nil, &files)
+	if len(files) != 1 {
+		t.Errorf("%d files stored; want 1", len(files))
+	}
+
+	saved := smallUploadLimit
+	defer func() { smallUploadLimit = saved }()
+	smallUploadLimit = 1024
+	large := http.Header{"File-Hash": {sha256Hex(content)}}
+	if status, code := server.do("POST", "/upload_small?name=large.txt", content, large, nil); status != http.StatusRequestEntityTooLarge || code != codeFileTooLarge {
+		t.Errorf("upload over the limit: %d %s", status, code)
+	}
+	smallUploadLimit = 0
+	if status, code := server.do("POST", "/upload_small?name=small.txt", content, large, nil); status != http.StatusNotFound {
+		t.Errorf("upload with the endpoint disabled: %d %s", status, code)
+	}
+}
+
+func TestE2ETarUpload(t *testing.T) {
+	server := newTestServer(t, 13)
+	modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	notes, photo := testContent(131, 3000), testContent(132, 200000)
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+	entries := []struct {
+		header  tar.Header
+		content []byte
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "./docs/", Mode: 0755}, nil},
+		{tar.Header{Name: "./docs/notes.txt", Mode: 0600, ModTime: modTime, PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "hello"}}, notes},
+		{tar.Header{Name: "./docs/empty.txt", Mode: 0644}, nil},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "./docs/link", Linkname: "notes.txt"}, nil},
+		{tar.Header{Name: "../escape.txt", Mode: 0644}, notes},
+		{tar.Header{Name: "photo.jpg", Mode: 0644, ModTime: modTime}, photo},
+	}
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.content)
+	}
+	tw.Close()
+	gz.Close()
+
+	var result TarUpload
+	if status, code := server.do("POST", "/upload_tar?prefix=backup&tag=source=tar", buffer.Bytes(), nil, &result); status != http.StatusOK {
+		t.Fatalf("uploading: %d %s", status, code)
+	}
+	if len(result.Files) != 2 || result.Files[0].FileName != "backup/docs/notes.txt" || result.Files[1].FileName != "backup/photo.jpg" ||
+		result.TotalBytes != int64(len(notes)+len(photo)) {
+		t.Fatalf("stored %+v", result)
+	}
+	var skipped []string
+	for _, entry := range result.Skipped {
+		skipped = append(skipped, entry.Name)
+	}
+	if strings.Join(skipped, ",") != "docs/empty.txt,docs/link,../escape.txt" {
+		t.Errorf("skipped %+v", result.Skipped)
+	}
+	stored := result.Files[0]
+	if stored.FileHash != sha256Hex(notes) || stored.Tags["source"] != "tar" || stored.Attributes == nil || stored.Attributes.Mode != 0600 ||
+		!stored.Attributes.ModTime.Equal(modTime) || stored.Attributes.Xattrs["user.comment"] != "aGVsbG8=" {
+		t.Errorf("stored %+v", stored)
+	}
+	if !bytes.Equal(server.download(stored.ID), notes) || !bytes.Equal(server.download(result.Files[1].ID), photo) {
+		t.Error("downloaded content differs from the archive")
+	}
+
+	// An archive cut short keeps the files before the break.
+	cut := buffer.Bytes()[:buffer.Len()/2]
+	if status, code := server.do("POST", "/upload_tar?prefix=again", cut, nil, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+		t.Errorf("truncated archive: %d %s", status, code)
+	}
+	var files []FileMetadata
+	server.do("GET", "/files", nil, nil, &files)
+	var again []string
+	for _, file := range files {
+		if strings.HasPrefix(file.FileName, "again/") {
+			again = append(again, file.FileName)
+		}
+	}
+	if strings.Join(again, ",") != "again/docs/notes.txt" {
+		t.Errorf("stored from the truncated archive: %v", again)
+	}
+}
+
+func TestE2EProbe(t *testing.T) {
+	server := newTestServer(t, 14)
+	var result ProbeResult
+	if status, code := server.do("GET", "/probe?t=42", nil, nil, &result); status != http.StatusOK {
+		t.Fatalf("probing: %d %s", status, code)
+	}
+	if result.ClientTime != "42" || !result.ServerTime.Equal(testEpoch) || result.ReceivedBytes != 0 ||
+		result.MinChunkSize != minChunkSize || result.MaxChunkSize != maxChunkSize {
+		t.Errorf("probe %+v", result)
+	}
+
+	burst := testContent(14, 256<<10)
+	if status, code := server.do("POST", "/probe", burst, nil, &result); status != http.StatusOK {
+		t.Fatalf("sending burst: %d %s", status, code)
+	}
+	if result.ReceivedBytes != int64(len(burst)) || result.ReadSeconds < 0 {
+		t.Errorf("burst probe %+v", result)
+	}
+	if status, code := server.do("POST", "/probe", make([]byte, maxChunkSize+1), nil, nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized burst: %d %s", status, code)
+	}
+}
+
+func TestE2ECapabilities(t *testing.T) {
+	server := newTestServer(t, 15)
+	savedToken := adminToken
+	adminToken = "capabilities-token"
+	t.Cleanup(func() { adminToken = savedToken })
+
+	var capabilities Capabilities
+	if status, code := server.do("GET", "/capabilities", nil, nil, &capabilities); status != http.StatusOK {
+		t.Fatalf("reading capabilities: %d %s", status, code)
+	}
+	if strings.Join(capabilities.HashAlgorithms, ",") != hashSHA256+","+hashSHA256Tree ||
+		capabilities.MinChunkSize != minChunkSize || capabilities.MaxChunkSize != maxChunkSize ||
+		capabilities.MaxFileSize != maxFileSize || capabilities.SmallUploadLimit != smallUploadLimit {
+		t.Errorf("capabilities %+v", capabilities)
+	}
+	if len(capabilities.APIVersions) == 0 || capabilities.APIVersions[0] != "1" {
+		t.Errorf("API versions %v", capabilities.APIVersions)
+	}
+	if len(capabilities.ChunkEncodings) != 0 {
+		t.Errorf("chunk encodings %v without compression dictionaries", capabilities.ChunkEncodings)
+	}
+	if strings.Join(capabilities.AuthModes, ",") != "anonymous,admin-token,session-token,signed-link" {
+		t.Errorf("auth modes %v", capabilities.AuthModes)
+	}
+	if len(capabilities.Features) == 0 || capabilities.Features[0] != "small-upload" {
+		t.Errorf("features %v", capabilities.Features)
+	}
+	if status, code := server.do("POST", "/capabilities", nil, nil, nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST /capabilities: %d %s", status, code)
+	}
+}
+
+func TestE2EV2Problems(t *testing.T) {
+	server := newTestServer(t, 16)
+	resp, err := server.Client().Get(server.URL + "/v2/files/0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var problem Problem
+	if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != problem.Status || resp.Header.Get("Content-Type") != "application/problem+json" ||
+		problem.Code == "" || problem.Type != problemTypePrefix+problem.Code || problem.Instance != "/v2/files/0123456789abcdef" {
+		t.Errorf("%d %s: problem %+v", resp.StatusCode, resp.Header.Get("Content-Type"), problem)
+	}
+
+	// Version 1 endpoints answer the same under /v2/.
+	content := testContent(16, 2000)
+	var registration registrationResponse
+	if status, code := server.do("POST", "/v2/register_file", registrationBody("v1.bin", content, 0), nil, &registration); status != http.StatusOK {
+		t.Fatalf("registering under /v2/: %d %s", status, code)
+	}
+	if status, code := server.sendChunk(registration.FileMetadata, content, 1, strings.Repeat("0", 64)); status != http.StatusBadRequest || code != codeChunkHashMismatch {
+		t.Errorf("version 1 chunk with a wrong hash: %d %s", status, code)
+	}
+}
+
+func TestE2EV2ManifestUpload(t *testing.T) {
+	server := newTestServer(t, 17)
+	content := testContent(17, 2*minChunkSize+1000)
+	var hashes []string
+	for start := 0; start < len(content); start += minChunkSize {
+		end := start + minChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		hashes = append(hashes, sha256Hex(content[start:end]))
+	}
+	manifest, _ := json.Marshal(UploadManifest{
+		FileMetadata: FileMetadata{FileName: "manifest.bin", FileSize: int64(len(content)), FileHash: sha256Hex(content), ChunkSize: minChunkSize},
+		Chunks:       hashes,
+	})
+	var session UploadSession
+	if status, code := server.do("POST", "/v2/uploads", manifest, nil, &session); status != http.StatusCreated {
+		t.Fatalf("registering manifest: %d %s", status, code)
+	}
+	if session.TotalChunks != 3 || len(session.MissingChunks) != 3 || session.ResumptionToken == "" {
+		t.Fatalf("session %+v", session)
+	}
+	if status, code := server.do("POST", "/v2/uploads", registrationBody("no-manifest.bin", content, minChunkSize), nil, nil); status != http.StatusBadRequest {
+		t.Errorf("registration without chunks: %d %s", status, code)
+	}
+
+	chunk := func(n int) []byte {
+		end := n * minChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		return content[(n-1)*minChunkSize : end]
+	}
+	path := "/v2/uploads/" + session.ID
+	// The manifest supplies the chunk hash, whatever the request claims.
+	if status, code := server.do("PUT", path+"/chunks/1", chunk(1), http.Header{"Chunk-Hash": {strings.Repeat("0", 64)}}, nil); status != http.StatusOK {
+		t.Fatalf("sending chunk 1: %d %s", status, code)
+	}
+	if status, code := server.do("PUT", path+"/chunks/2", chunk(1), nil, nil); status != http.StatusBadRequest || code != codeChunkHashMismatch {
+		t.Errorf("sending the wrong data as chunk 2: %d %s", status, code)
+	}
+	if status, code := server.do("GET", path, nil, nil, &session); status != http.StatusOK || fmt.Sprint(session.MissingChunks) != "[2 3]" {
+		t.Errorf("upload state: %d %s %v", status, code, session.MissingChunks)
+	}
+	for _, n := range []int{2, 3} {
+		if status, code := server.do("PUT", fmt.Sprintf("%s/chunks/%d", path, n), chunk(n), nil, nil); status != http.StatusOK {
+			t.Fatalf("sending chunk %d: %d %s", n, status, code)
+		}
+	}
+	var report UploadReport
+	if status, code := server.do("POST", path+"/complete", nil, nil, &report); status != http.StatusOK {
+		t.Fatalf("completing: %d %s", status, code)
+	}
+	if !bytes.Equal(server.download(session.ID), content) {
+		t.Error("stored file differs")
+	}
+	var completed UploadSession
+	if status, code := server.do("GET", path, nil, nil, &completed); status != http.StatusOK || !completed.Complete || completed.File == nil || len(completed.MissingChunks) != 0 {
+		t.Errorf("completed upload state: %d %s %+v", status, code, completed)
+	}
+	if status, code := server.do("PUT", "/uploads/"+session.ID+"/chunks/1", chunk(1), nil, nil); status != http.StatusNotFound {
+		t.Errorf("version 2 path without the prefix: %d %s", status, code)
+	}
+}
+
+func TestE2EV2SessionTokens(t *testing.T) {
+	server := newTestServer(t, 18)
+	principalTokens["alice-secret"] = "alice"
+	t.Cleanup(func() { delete(principalTokens, "alice-secret") })
+
+	if status, code := server.do("POST", "/v2/session", nil, nil, nil); status != http.StatusUnauthorized || code != codeUnauthorized {
+		t.Errorf("anonymous session: %d %s", status, code)
+	}
+	var issued SessionToken
+	if status, code := server.do("POST", "/v2/session", nil, http.Header{"Authorization": {"Bearer alice-secret"}}, &issued); status != http.StatusOK {
+		t.Fatalf("issuing session token: %d %s", status, code)
+	}
+	if issued.Token == "" || issued.Principal != "alice" || issued.Role != roleUploader || !issued.ExpiresAt.After(testEpoch) {
+		t.Errorf("issued %+v", issued)
+	}
+	withToken := http.Header{"Authorization": {"Bearer " + issued.Token}}
+	var current SessionToken
+	if status, code := server.do("GET", "/v2/session", nil, withToken, &current); status != http.StatusOK || current.Principal != "alice" || current.Token != "" {
+		t.Errorf("session: %d %s %+v", status, code, current)
+	}
+
+	// Uploads made with the token belong to its principal, also in version 1.
+	content := testContent(18, 1000)
+	var registration registrationResponse
+	if status, code := server.do("POST", "/register_file", registrationBody("owned.bin", content, 0), withToken, &registration); status != http.StatusOK {
+		t.Fatalf("registering with session token: %d %s", status, code)
+	}
+	if registration.Owner != "alice" {
+		t.Errorf("owner %q", registration.Owner)
+	}
+
+	if status, code := server.do("DELETE", "/v2/session", nil, withToken, nil); status != http.StatusNoContent {
+		t.Errorf("revoking: %d %s", status, code)
+	}
+	if status, code := server.do("GET", "/v2/session", nil, withToken, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked session: %d %s", status, code)
+	}
+	server.clock.Advance(sessionLifetime)
+	var again SessionToken
+	server.do("POST", "/v2/session", nil, http.Header{"Authorization": {"Bearer alice-secret"}}, &again)
+	server.clock.Advance(sessionLifetime)
+	if status, code := server.do("GET", "/v2/session", nil, http.Header{"Authorization": {"Bearer " + again.Token}}, nil); status != http.StatusUnauthorized {
+		t.Errorf("expired session: %d %s", status, code)
+	}
+}
+
+// TestE2ELDAPLoginEscaping logs in with user names that would change the
+// bind DN or widen the search filter if they were substituted as they are,
+// against a fake LDAP server that records what it is sent.
+func TestE2ELDAPLoginEscaping(t *testing.T) {
+	server := newTestServer(t, 20)
+	const group = "cn=staff,dc=example,dc=com"
+	directoryURL, requests := startFakeLDAP(t, group)
+	savedURL, savedUserDN, savedBaseDN, savedFilter, savedAttribute, savedRoles := ldapURL, ldapUserDN, ldapBaseDN, ldapUserFilter, ldapGroupAttribute, ldapGroupRoles
+	t.Cleanup(func() {
+		ldapURL, ldapUserDN, ldapBaseDN, ldapUserFilter, ldapGroupAttribute, ldapGroupRoles = savedURL, savedUserDN, savedBaseDN, savedFilter, savedAttribute, savedRoles
+	})
+	ldapURL, ldapUserDN, ldapBaseDN = directoryURL, "uid=%s,ou=people,dc=example,dc=com", "dc=example,dc=com"
+	ldapUserFilter, ldapGroupAttribute = "(&(objectClass=person)(uid=%s))", "memberOf"
+	ldapGroupRoles = map[string]string{group: roleUploader}
+
+	for _, test := range []struct {
+		username string
+		bindDN   string
+	}{
+		{"alice", `uid=alice,ou=people,dc=example,dc=com`},
+		{"admin,ou=x", `uid=admin\,ou\=x,ou=people,dc=example,dc=com`},
+		{"*)(uid=*", `uid=*)(uid\=*,ou=people,dc=example,dc=com`},
+		{"# x+y;\\ ", `uid=\# x\+y\;\\\ ,ou=people,dc=example,dc=com`},
+		{"nul\x00", `uid=nul\00,ou=people,dc=example,dc=com`},
+	} {
+		if role, err := ldapLogin(test.username, "secret"); err != nil || role != roleUploader {
+			t.Errorf("%q: login as %q, %v", test.username, role, err)
+			continue
+		}
+		request := <-requests
+		if request.bindDN != test.bindDN {
+			t.Errorf("%q: bound as %q, want %q", test.username, request.bindDN, test.bindDN)
+		}
+		// The filter stays one equality match on the whole user name.
+		filter := berConstructed(ldapFilterAnd,
+			berConstructed(ldapFilterEquality, berString(berOctetString, "objectClass"), berString(berOctetString, "person")),
+			berConstructed(ldapFilterEquality, berString(berOctetString, "uid"), berString(berOctetString, test.username)))
+		if !bytes.Equal(request.filter, filter) {
+			t.Errorf("%q: searched with filter %x, want %x", test.username, request.filter, filter)
+		}
+	}
+	if got := escapeLDAPFilterValue("a*(b)\\\x00"); got != `a\2a\28b\29\5c\00` {
+		t.Errorf("escaped filter value: %s", got)
+	}
+
+	// The login endpoint turns such names away before they reach LDAP.
+	body, _ := json.Marshal(map[string]string{"username": "*)(uid=*", "password": "secret"})
+	if status, code := server.do("POST", "/login", body, http.Header{"Content-Type": {"application/json"}}, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with a filter in the user name: %d %s", status, code)
+	}
+	select {
+	case request := <-requests:
+		t.Errorf("login with a filter in the user name reached LDAP: %+v", request)
+	default:
+	}
+}
+
+type fakeLDAPRequest struct {
+	bindDN string
+	filter []byte
+}
+
+// startFakeLDAP serves binds and searches, finding every user in group, and
+// sends the bind DN and the encoded filter of every search to the channel.
+func startFakeLDAP(t *testing.T, group string) (string, <-chan fakeLDAPRequest) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan fakeLDAPRequest, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeLDAP(conn, group, requests)
+		}
+	}()
+	return "ldap://" + listener.Addr().String(), requests
+}
+
+func serveFakeLDAP(conn net.Conn, group string, requests chan<- fakeLDAPRequest) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var request fakeLDAPRequest
+	for {
+		message, err := berRead(reader)
+		if err != nil || len(message.children) < 2 {
+			return
+		}
+		messageID, operation := message.children[0].int(), message.children[1]
+		reply := func(operations ...[]byte) {
+			for _, response := range operations {
+				conn.Write(berConstructed(berSequence, berInt(berInteger, messageID), response))
+			}
+		}
+		success := func(tag byte) []byte {
+			return berConstructed(tag, berInt(berEnumerated, ldapResultSuccess), berString(berOctetString, ""), berString(berOctetString, ""))
+		}
+		switch {
+		case operation.tag == ldapBindRequest && len(operation.children) == 3:
+			request.bindDN = string(operation.children[1].data)
+			reply(success(ldapBindResponse))
+		case operation.tag == ldapSearchRequest && len(operation.children) == 8:
+			filter := operation.children[6]
+			request.filter = berEncode(filter.tag, filter.data)
+			requests <- request
+			values := berConstructed(0x31, berString(berOctetString, group))
+			attributes := berConstructed(berSequence, berConstructed(berSequence, berString(berOctetString, "memberOf"), values))
+			reply(berConstructed(ldapSearchResultEntry, berString(berOctetString, "uid=user,ou=people,dc=example,dc=com"), attributes), success(ldapSearchResultDone))
+		default:
+			return
+		}
+	}
+}
+
+func TestE2EConcurrentUploads(t *testing.T) {
+	const uploads = 16
+	server := newTestServer(t, 5)
+	contents := make([][]byte, uploads)
+	for i := range contents {
+		contents[i] = testContent(int64(100+i), 3*minChunkSize+i)
+	}
+
+	ids := make([]string, uploads)
+	var wg sync.WaitGroup
+	for i := range contents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var registration registrationResponse
+			body := registrationBody(fmt.Sprintf("concurrent/%02d.bin", i), contents[i], minChunkSize)
+			if status, code := server.do("POST", "/register_file", body, nil, &registration); status != http.StatusOK {
+				t.Errorf("registering file %d: %d %s", i, status, code)
+				return
+			}
+			// Each file's chunks are sent at once too.
+			var chunks sync.WaitGroup
+			for chunkNumber := 1; chunkNumber <= registration.TotalChunks; chunkNumber++ {
+				chunks.Add(1)
+				go func(chunkNumber int) {
+					defer chunks.Done()
+					if status, code := server.sendChunk(registration.FileMetadata, contents[i], chunkNumber, ""); status != http.StatusOK {
+						t.Errorf("chunk %d of file %d: %d %s", chunkNumber, i, status, code)
+					}
+				}(chunkNumber)
+			}
+			chunks.Wait()
+			if _, status, code := server.complete(registration.ID); status != http.StatusOK {
+				t.Errorf("completing file %d: %d %s", i, status, code)
+			}
+			ids[i] = registration.ID
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	var files []FileMetadata
+	server.do("GET", "/files", nil, nil, &files)
+	if len(files) != uploads {
+		t.Fatalf("listed %d files, want %d", len(files), uploads)
+	}
+	unique := append([]string{}, ids...)
+	sort.Strings(unique)
+	for i := 1; i < len(unique); i++ {
+		if unique[i] == unique[i-1] {
+			t.Fatalf("ID %s was assigned twice", unique[i])
+		}
+	}
+	for i, id := range ids {
+		if !bytes.Equal(server.download(id), contents[i]) {
+			t.Errorf("file %d downloaded differently", i)
+		}
+	}
+}
+
+// useErasureDirs stores the files of a test server as shards in dirs new
+// directories, parity of them parity shards.
+func useErasureDirs(t *testing.T, dirs, parity int) {
+	savedDirs, savedParity := erasureDirs, erasureParity
+	t.Cleanup(func() { erasureDirs, erasureParity = savedDirs, savedParity })
+	erasureDirs, erasureParity = nil, parity
+	for i := 0; i < dirs; i++ {
+		erasureDirs = append(erasureDirs, t.TempDir())
+	}
+	if err := checkErasureConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestE2EErasureCodedDownload(t *testing.T) {
+	server := newTestServer(t, 22)
+	useErasureDirs(t, 5, 2)
+	// Three stripes of three data blocks and a short one.
+	content := testContent(22, 3*3*erasureBlockSize+12345)
+	metadata := server.upload("sharded.bin", content)
+	waitFor(t, "the file to be erasure coded", func() bool { return erasureCoded(metadata) })
+
+	shards := make([][]byte, len(erasureDirs))
+	for i, dir := range erasureDirs {
+		var err error
+		if shards[i], err = ioutil.ReadFile(shardPath(dir, metadata.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Losing up to erasureParity shards, data or parity, loses nothing.
+	for _, lost := range [][]int{{}, {0}, {0, 1}, {1, 3}, {2, 4}, {3, 4}} {
+		for i, dir := range erasureDirs {
+			if err := ioutil.WriteFile(shardPath(dir, metadata.ID), shards[i], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, i := range lost {
+			os.Remove(shardPath(erasureDirs[i], metadata.ID))
+		}
+		if got := server.download(metadata.ID); !bytes.Equal(got, content) {
+			t.Errorf("without shards %v: downloaded %d bytes that differ from the upload", lost, len(got))
+		}
+	}
+
+	os.Remove(shardPath(erasureDirs[2], metadata.ID))
+	resp, err := server.Client().Get(server.URL + "/download/" + metadata.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && bytes.Equal(got, content) {
+		t.Error("downloaded a file missing more shards than it has parity")
+	}
+}
+
+func TestE2EErasureCorruptBlock(t *testing.T) {
+	server := newTestServer(t, 23)
+	useErasureDirs(t, 4, 1)
+	content := testContent(23, 2*3*erasureBlockSize)
+	metadata := server.upload("corrupt.bin", content)
+	waitFor(t, "the file to be erasure coded", func() bool { return erasureCoded(metadata) })
+
+	// A byte of the second block of data shard 1 flips; its CRC no longer
+	// matches, so the block is rebuilt from the parity shard.
+	path := shardPath(erasureDirs[1], metadata.ID)
+	shard, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard[shardHeaderSize+erasureBlockSize+blockCRCSize+100] ^= 0xff
+	if err := ioutil.WriteFile(path, shard, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.download(metadata.ID); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes that differ from the upload", len(got))
+	}
+
+	// Without the parity shard the corrupt block cannot be rebuilt, and it
+	// is not served either: the download stops before it.
+	os.Remove(shardPath(erasureDirs[3], metadata.ID))
+	resp, err := server.Client().Get(server.URL + "/download/" + metadata.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.HasPrefix(content, got) || (resp.StatusCode == http.StatusOK && len(got) == len(content)) {
+		t.Errorf("served the corrupt block: %s, %d bytes", resp.Status, len(got))
+	}
+}
+
+// useFetch turns on -fetch for a test, and -fetch-private when private is
+// set.
+func useFetch(t *testing.T, private bool) {
+	savedEnabled, savedPrivate := fetchEnabled, fetchPrivate
+	t.Cleanup(func() { fetchEnabled, fetchPrivate = savedEnabled, savedPrivate })
+	fetchEnabled, fetchPrivate = true, private
+}
+
+// fetch starts a fetch and returns the job once it finished.
+func (s *testServer) fetch(request FetchRequest, header http.Header) FetchJob {
+	s.t.Helper()
+	body, _ := json.Marshal(request)
+	var job FetchJob
+	if status, code := s.do("POST", "/fetch", body, header, &job); status != http.StatusAccepted {
+		s.t.Fatalf("starting fetch of %s: %d %s", request.URL, status, code)
+	}
+	waitFor(s.t, "fetch "+job.ID, func() bool {
+		s.do("GET", "/fetch/"+job.ID, nil, header, &job)
+		return job.State != fetchRunning
+	})
+	return job
+}
+
+func TestFetchDialControl(t *testing.T) {
+	useFetch(t, false)
+	for _, test := range []struct {
+		host    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"100.63.255.255", true},
+		{"100.128.0.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	} {
+		err := fetchDialControl("tcp", net.JoinHostPort(test.host, "80"), nil)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.host, err == nil, test.allowed)
+		}
+	}
+	fetchPrivate = true
+	if err := fetchDialControl("tcp", "127.0.0.1:80", nil); err != nil {
+		t.Errorf("with -fetch-private: %v", err)
+	}
+}
+
+func TestE2EFetchPrivateAddresses(t *testing.T) {
+	server := newTestServer(t, 24)
+	useFetch(t, false)
+	content := testContent(24, 5000)
+	var source *httptest.Server
+	source = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, source.URL+"/file.bin", http.StatusFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer source.Close()
+
+	// The source stands in for a public host: the address of "public.test"
+	// is dialed without the check, everything else goes through it.
+	savedTransport := fetchClient.Transport
+	t.Cleanup(func() { fetchClient.Transport = savedTransport })
+	dialer := &net.Dialer{Control: fetchDialControl}
+	fetchClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == "public.test:80" {
+				return net.Dial(network, source.Listener.Addr().String())
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	if job := server.fetch(FetchRequest{URL: "http://public.test/file.bin"}, nil); job.State != fetchCompleted {
+		t.Fatalf("fetch from a public host: %+v", job)
+	}
+	for _, url := range []string{source.URL + "/file.bin", "http://public.test/redirect"} {
+		job := server.fetch(FetchRequest{URL: url}, nil)
+		if job.State != fetchFailed || job.ErrorCode != codeFetchFailed || !strings.Contains(job.Error, "is not public") {
+			t.Errorf("fetch of %s: %+v", url, job)
+		}
+	}
+
+	fetchPrivate = true
+	for _, url := range []string{source.URL + "/file.bin", "http://public.test/redirect"} {
+		job := server.fetch(FetchRequest{URL: url}, nil)
+		if job.State != fetchCompleted || job.File == nil {
+			t.Errorf("fetch of %s with -fetch-private: %+v", url, job)
+			continue
+		}
+		if !bytes.Equal(server.download(job.File.ID), content) {
+			t.Errorf("fetched file of %s differs", url)
+		}
+	}
+}
+
+func TestE2EFetchJobs(t *testing.T) {
+	server := newTestServer(t, 25)
+	useFetch(t, true)
+	savedAdminToken := adminToken
+	t.Cleanup(func() { adminToken = savedAdminToken })
+	adminToken = "fetch-admin"
+	principalTokens["alice-secret"], principalTokens["bob-secret"] = "alice", "bob"
+	t.Cleanup(func() {
+		delete(principalTokens, "alice-secret")
+		delete(principalTokens, "bob-secret")
+	})
+	alice := http.Header{"Authorization": {"Bearer alice-secret"}}
+	bob := http.Header{"Authorization": {"Bearer bob-secret"}}
+	admin := http.Header{"Authorization": {"Bearer fetch-admin"}}
+
+	content := testContent(25, 3000)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer source.Close()
+
+	job := server.fetch(FetchRequest{URL: source.URL + "/report.txt"}, alice)
+	if job.State != fetchCompleted || job.File == nil || job.File.Owner != "alice" || job.File.FileHash != sha256Hex(content) {
+		t.Fatalf("fetch: %+v", job)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if status, code := server.do(method, "/fetch/"+job.ID, nil, bob, nil); status != http.StatusNotFound || code != codeNotFound {
+			t.Errorf("%s by another principal: %d %s", method, status, code)
+		}
+		if status, code := server.do(method, "/fetch/"+job.ID, nil, nil, nil); status != http.StatusNotFound || code != codeNotFound {
+			t.Errorf("%s without a token: %d %s", method, status, code)
+		}
+	}
+	for _, header := range []http.Header{alice, admin} {
+		var seen FetchJob
+		if status, code := server.do("GET", "/fetch/"+job.ID, nil, header, &seen); status != http.StatusOK || seen.State != fetchCompleted {
+			t.Errorf("GET by %s: %d %s %+v", header.Get("Authorization"), status, code, seen)
+		}
+	}
+
+	// A fileHash the content does not have fails the job, and nothing is
+	// stored.
+	metadataMutex.Lock()
+	files := len(filesMetadata)
+	metadataMutex.Unlock()
+	wrongHash := sha256Hex([]byte("something else"))
+	job = server.fetch(FetchRequest{URL: source.URL + "/report.txt", FileHash: strings.ToUpper(wrongHash)}, alice)
+	if job.State != fetchFailed || job.ErrorCode != codeFileHashMismatch || job.File != nil || !strings.Contains(job.Error, wrongHash) {
+		t.Errorf("fetch with the wrong hash: %+v", job)
+	}
+	metadataMutex.Lock()
+	stored := len(filesMetadata)
+	metadataMutex.Unlock()
+	if stored != files {
+		t.Errorf("%d files stored after a mismatch, %d before", stored, files)
+	}
+	job = server.fetch(FetchRequest{URL: source.URL + "/report.txt", FileName: "checked.txt", FileHash: sha256Hex(content)}, alice)
+	if job.State != fetchCompleted || job.File == nil || job.File.FileName != "checked.txt" {
+		t.Errorf("fetch with the right hash: %+v", job)
+	}
+}
+
+// useMasterKeys loads master keys from a key file of "<key id> <hex key>"
+// lines, the current key first, as -master-key-file does.
+func useMasterKeys(t *testing.T, lines ...string) {
+	saved, savedKeyID := masterKeys, currentKeyID
+	t.Cleanup(func() { masterKeys, currentKeyID = saved, savedKeyID })
+	path := filepath.Join(t.TempDir(), "master.keys")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadMasterKey(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rotateKeysTo starts a rotation to the current key and waits for it.
+func (s *testServer) rotateKeysTo(keyID string, admin http.Header) KeyRotationStatus {
+	s.t.Helper()
+	var status KeyStatus
+	if code, errorCode := s.do("POST", "/admin/keys/rotate", nil, admin, &status.Rotation); code != http.StatusAccepted || status.Rotation.KeyID != keyID {
+		s.t.Fatalf("starting rotation: %d %s %+v", code, errorCode, status.Rotation)
+	}
+	waitFor(s.t, "the key rotation", func() bool {
+		s.do("GET", "/admin/keys", nil, admin, &status)
+		return !status.Rotation.Running
+	})
+	return status.Rotation
+}
+
+// keyFiles returns how many stored files each master key protects.
+func (s *testServer) keyFiles(admin http.Header) map[string]int {
+	s.t.Helper()
+	var status KeyStatus
+	if code, errorCode := s.do("GET", "/admin/keys", nil, admin, &status); code != http.StatusOK {
+		s.t.Fatalf("key status: %d %s", code, errorCode)
+	}
+	files := make(map[string]int)
+	for _, key := range status.Keys {
+		files[key.ID] = key.Files
+	}
+	return files
+}
+
+func TestE2EKeyRotation(t *testing.T) {
+	server := newTestServer(t, 26)
+	savedAdminToken := adminToken
+	t.Cleanup(func() { adminToken = savedAdminToken })
+	adminToken = "keys-admin"
+	admin := http.Header{"Authorization": {"Bearer keys-admin"}}
+	oldKey := fmt.Sprintf("old %x", testContent(26, dataKeySize))
+	newKey := fmt.Sprintf("new %x", testContent(27, dataKeySize))
+
+	useMasterKeys(t, oldKey)
+	server.restart()
+	contents := [][]byte{testContent(28, 2*minChunkSize+777), testContent(29, 5000), testContent(30, minChunkSize)}
+	var files []FileMetadata
+	for i, content := range contents {
+		files = append(files, server.upload(fmt.Sprintf("secret%d.bin", i), content))
+	}
+	if keyFiles := server.keyFiles(admin); keyFiles["old"] != 3 {
+		t.Fatalf("files by key before the rotation: %v", keyFiles)
+	}
+
+	useMasterKeys(t, newKey, oldKey)
+	server.restart()
+	if rotation := server.rotateKeysTo("new", admin); rotation.Total != 3 || rotation.Rotated != 3 || rotation.Failed != 0 || rotation.Busy != 0 {
+		t.Fatalf("rotation: %+v", rotation)
+	}
+	if keyFiles := server.keyFiles(admin); keyFiles["new"] != 3 || keyFiles["old"] != 0 {
+		t.Errorf("files by key after the rotation: %v", keyFiles)
+	}
+
+	// Once every file is rotated, the old key can go.
+	useMasterKeys(t, newKey)
+	server.restart()
+	for i, metadata := range files {
+		if !bytes.Equal(server.download(metadata.ID), contents[i]) {
+			t.Errorf("%s differs after the rotation", metadata.FileName)
+		}
+	}
+}
+
+// TestE2EKeyRotationInterrupted stops a rotation half way, as a crash would:
+// one file is rotated, the next was being staged. Files under either key
+// stay readable with both keys, and a later rotation finishes the job.
+func TestE2EKeyRotationInterrupted(t *testing.T) {
+	server := newTestServer(t, 31)
+	savedAdminToken := adminToken
+	t.Cleanup(func() { adminToken = savedAdminToken })
+	adminToken = "keys-admin"
+	admin := http.Header{"Authorization": {"Bearer keys-admin"}}
+	oldKey := fmt.Sprintf("old %x", testContent(31, dataKeySize))
+	newKey := fmt.Sprintf("new %x", testContent(32, dataKeySize))
+
+	useMasterKeys(t, oldKey)
+	server.restart()
+	contents := [][]byte{testContent(33, minChunkSize+1), testContent(34, 3*minChunkSize)}
+	var files []FileMetadata
+	for i, content := range contents {
+		files = append(files, server.upload(fmt.Sprintf("secret%d.bin", i), content))
+	}
+	for i := range files {
+		stored, _, err := lookupFileInfo(files[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.Encrypted || wrappingKeyID(stored.WrappedKey) != "old" {
+			t.Fatalf("%s is stored without the old key: %+v", stored.FileName, stored)
+		}
+		files[i] = stored
+	}
+
+	useMasterKeys(t, newKey, oldKey)
+	if err := rotateFileKey(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	staged := finalFilePath(files[1]) + ".rotate"
+	if err := ioutil.WriteFile(staged, testContent(35, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server.restart()
+	if keyFiles := server.keyFiles(admin); keyFiles["new"] != 1 || keyFiles["old"] != 1 {
+		t.Errorf("files by key after the interruption: %v", keyFiles)
+	}
+	for i, metadata := range files {
+		if !bytes.Equal(server.download(metadata.ID), contents[i]) {
+			t.Errorf("%s differs after the interruption", metadata.FileName)
+		}
+	}
+
+	if rotation := server.rotateKeysTo("new", admin); rotation.Total != 1 || rotation.Rotated != 1 || rotation.Failed != 0 {
+		t.Fatalf("second rotation: %+v", rotation)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("staged file of the interrupted rotation is left: %v", err)
+	}
+	useMasterKeys(t, newKey)
+	server.restart()
+	for i, metadata := range files {
+		if !bytes.Equal(server.download(metadata.ID), contents[i]) {
+			t.Errorf("%s differs after the second rotation", metadata.FileName)
+		}
+	}
+}
+
+func TestE2EPatch(t *testing.T) {
+	server := newTestServer(t, 36)
+	content := testContent(36, 2*minChunkSize+5000)
+	metadata := server.upload("image.bin", content)
+
+	// expect patches the local copy of the file the way the server should.
+	expect := func(offset int, data []byte) {
+		if end := offset + len(data); end > len(content) {
+			content = append(content, make([]byte, end-len(content))...)
+		}
+		copy(content[offset:], data)
+	}
+	check := func(what string, patched FileMetadata) {
+		t.Helper()
+		if patched.ID != metadata.ID || patched.FileSize != int64(len(content)) || patched.FileHash != sha256Hex(content) {
+			t.Errorf("%s: stored %d bytes with hash %s, want %d with %s", what, patched.FileSize, patched.FileHash, len(content), sha256Hex(content))
+		}
+		if !bytes.Equal(server.download(metadata.ID), content) {
+			t.Errorf("%s: downloaded file differs", what)
+		}
+	}
+
+	block := testContent(37, 4096)
+	var patched FileMetadata
+	header := http.Header{"Content-Range": {"bytes 1000-5095/*"}, "If-Match": {`"` + metadata.FileHash + `"`}}
+	if status, code := server.do("PATCH", "/files/"+metadata.ID, block, header, &patched); status != http.StatusOK {
+		t.Fatalf("patching a range: %d %s", status, code)
+	}
+	expect(1000, block)
+	check("range", patched)
+
+	// Two ranges in one request, the second extending the file.
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	tail := testContent(38, 3000)
+	for _, patch := range []struct {
+		offset int
+		data   []byte
+	}{{minChunkSize - 10, block[:20]}, {len(content) - 1000, tail}} {
+		part, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/*", patch.offset, patch.offset+len(patch.data)-1)},
+		})
+		part.Write(patch.data)
+		expect(patch.offset, patch.data)
+	}
+	parts.Close()
+	header = http.Header{"Content-Type": {"multipart/byteranges; boundary=" + parts.Boundary()}}
+	if status, code := server.do("PATCH", "/files/"+metadata.ID, body.Bytes(), header, &patched); status != http.StatusOK {
+		t.Fatalf("patching two ranges: %d %s", status, code)
+	}
+	check("two ranges", patched)
+
+	size := minChunkSize + 123
+	if status, code := server.do("PATCH", "/files/"+metadata.ID, nil, http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}}, &patched); status != http.StatusOK {
+		t.Fatalf("truncating: %d %s", status, code)
+	}
+	content = content[:size]
+	check("truncation", patched)
+
+	// Ranges that start, or a total that leaves a gap, after the end of the
+	// file are not satisfiable.
+	for _, test := range []struct {
+		contentRange string
+		body         []byte
+	}{
+		{fmt.Sprintf("bytes %d-%d/*", size+1, size+10), block[:10]},
+		{fmt.Sprintf("bytes %d-%d/%d", size+100, size+109, size+110), block[:10]},
+		{fmt.Sprintf("bytes */%d", size+1), nil},
+		{fmt.Sprintf("bytes 0-9/%d", size+50), block[:10]},
+	} {
+		request, _ := http.NewRequest("PATCH", server.URL+"/files/"+metadata.ID, bytes.NewReader(test.body))
+		request.Header.Set("Content-Range", test.contentRange)
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || response.Code != codeRangeNotSatisfiable || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", size) {
+			t.Errorf("%s: %s %s, Content-Range %q", test.contentRange, resp.Status, response.Code, resp.Header.Get("Content-Range"))
+		}
+	}
+	for _, contentRange := range []string{"bytes 10-0/*", "bytes 0-9/5", "bytes 0-9", "*/*"} {
+		if status, code := server.do("PATCH", "/files/"+metadata.ID, block[:10], http.Header{"Content-Range": {contentRange}}, nil); status != http.StatusBadRequest || code != codeInvalidRequest {
+			t.Errorf("%s: %d %s", contentRange, status, code)
+		}
+	}
+	if status, code := server.do("PATCH", "/files/"+metadata.ID, block[:10], http.Header{"Content-Range": {"bytes 0-9/*"}, "If-Match": {`"` + metadata.FileHash + `"`}}, nil); status != http.StatusPreconditionFailed || code != codeFileChanged {
+		t.Errorf("patch with a stale If-Match: %d %s", status, code)
+	}
+	check("refused patches", patched)
+}
+
+func TestE2EAppend(t *testing.T) {
+	server := newTestServer(t, 39)
+	savedKeys, savedKeyID := masterKeys, currentKeyID
+	t.Cleanup(func() { masterKeys, currentKeyID = savedKeys, savedKeyID })
+
+	for _, encrypted := range []bool{false, true} {
+		masterKeys, currentKeyID = nil, ""
+		if encrypted {
+			masterKeys = map[string][]byte{"": testContent(40, dataKeySize)}
+		}
+		content := testContent(41, minChunkSize+100)
+		metadata := server.upload(fmt.Sprintf("log-%v.txt", encrypted), content)
+		// Appends are written in place or, for encrypted files, by writing
+		// the file again; both carry the hashes on.
+		for i, size := range []int{1, 5000, minChunkSize} {
+			tail := testContent(int64(42+i), size)
+			var appended FileMetadata
+			header := http.Header{"Append-Offset": {fmt.Sprint(len(content))}}
+			if status, code := server.do("POST", "/files/"+metadata.ID+"/append", tail, header, &appended); status != http.StatusOK {
+				t.Fatalf("encrypted %v, append %d: %d %s", encrypted, i, status, code)
+			}
+			content = append(content, tail...)
+			if appended.FileSize != int64(len(content)) || appended.FileHash != sha256Hex(content) || appended.Encrypted != encrypted {
+				t.Errorf("encrypted %v, append %d: stored %d bytes with hash %s, want %d with %s", encrypted, i, appended.FileSize, appended.FileHash, len(content), sha256Hex(content))
+			}
+			if !bytes.Equal(server.download(metadata.ID), content) {
+				t.Errorf("encrypted %v, append %d: downloaded file differs", encrypted, i)
+			}
+		}
+
+		// A retried append names an offset the file no longer has.
+		var refused ErrorResponse
+		request, _ := http.NewRequest("POST", server.URL+"/files/"+metadata.ID+"/append", bytes.NewReader([]byte("again")))
+		request.Header.Set("Append-Offset", fmt.Sprint(len(content)-1))
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&refused)
+		resp.Body.Close()
+		if details, _ := refused.Details.(map[string]interface{}); resp.StatusCode != http.StatusConflict || details["fileSize"] != float64(len(content)) {
+			t.Errorf("encrypted %v, append at a stale offset: %s %+v", encrypted, resp.Status, refused)
+		}
+		if !bytes.Equal(server.download(metadata.ID), content) {
+			t.Errorf("encrypted %v: refused append changed the file", encrypted)
+		}
+	}
+}
+
+// TestE2EAppendWhileCompleting appends to uploads while they are completed:
+// the append is sent again as long as the file is not found, so it lands as
+// soon as the completion records the file. It is added to the whole file
+// exactly once, never lost or written into the assembly.
+func TestE2EAppendWhileCompleting(t *testing.T) {
+	server := newTestServer(t, 45)
+	tail := testContent(46, 1000)
+	early := 0
+	for i := 0; i < 20; i++ {
+		content := testContent(int64(100+i), 3*minChunkSize+i)
+		registration := server.register(fmt.Sprintf("race%d.bin", i), content, minChunkSize)
+		for chunkNumber := 1; chunkNumber <= registration.TotalChunks; chunkNumber++ {
+			if status, code := server.sendChunk(registration.FileMetadata, content, chunkNumber, ""); status != http.StatusOK {
+				t.Fatalf("chunk %d: %d %s", chunkNumber, status, code)
+			}
+		}
+		var wg sync.WaitGroup
+		var completed int32
+		var completeStatus, appendStatus int
+		var completeCode, appendCode string
+		appendedEarly := false
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, completeStatus, completeCode = server.complete(registration.ID)
+			atomic.StoreInt32(&completed, 1)
+		}()
+		go func() {
+			defer wg.Done()
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				wasCompleted := atomic.LoadInt32(&completed) == 1
+				appendStatus, appendCode = server.do("POST", "/files/"+registration.ID+"/append", tail, nil, nil)
+				if appendStatus != http.StatusNotFound {
+					appendedEarly = !wasCompleted && appendStatus == http.StatusOK
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		if completeStatus != http.StatusOK {
+			t.Fatalf("upload %d: completion: %d %s", i, completeStatus, completeCode)
+		}
+		if appendStatus != http.StatusOK {
+			t.Fatalf("upload %d: append: %d %s", i, appendStatus, appendCode)
+		}
+		if appendedEarly {
+			early++
+		}
+		want := append(append([]byte{}, content...), tail...)
+		var stored FileMetadata
+		server.do("GET", "/files/"+registration.ID, nil, nil, &stored)
+		if stored.FileSize != int64(len(want)) || stored.FileHash != sha256Hex(want) {
+			t.Errorf("upload %d: stored %d bytes with hash %s, want %d with %s", i, stored.FileSize, stored.FileHash, len(want), sha256Hex(want))
+		}
+		if !bytes.Equal(server.download(registration.ID), want) {
+			t.Errorf("upload %d: downloaded file differs", i)
+		}
+	}
+	t.Logf("%d of 20 appends landed before the completion answered", early)
+}
+
+// usePostProcessing loads the steps of a -post-process file.
+func usePostProcessing(t *testing.T, steps string) {
+	saved := postProcessSteps
+	t.Cleanup(func() { postProcessSteps = saved })
+	path := filepath.Join(t.TempDir(), "steps")
+	if err := ioutil.WriteFile(path, []byte(steps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPostProcessSteps(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// processed waits for the post-processing of a file to finish and returns
+// its steps.
+func (s *testServer) processed(fileID string) []ProcessingStep {
+	s.t.Helper()
+	var metadata FileMetadata
+	waitFor(s.t, "the post-processing of "+fileID, func() bool {
+		s.do("GET", "/files/"+fileID, nil, nil, &metadata)
+		for _, step := range metadata.Processing {
+			if step.Status == stepPending || step.Status == stepRunning {
+				return false
+			}
+		}
+		return true
+	})
+	return metadata.Processing
+}
+
+func TestE2EPostProcessing(t *testing.T) {
+	if _, err := exec.LookPath("printenv"); err != nil {
+		t.Skip("needs printenv, true and false")
+	}
+	server := newTestServer(t, 47)
+	checksums := t.TempDir()
+	usePostProcessing(t, "# exported for the mirrors\n"+
+		"sums * checksums "+checksums+"\n"+
+		"info * metadata\n"+
+		"\n"+
+		"name * exec printenv FILE_NAME\n"+
+		"gate text/plain exec false\n"+
+		"publish * exec true\n")
+
+	text := []byte(strings.Repeat("a line of text\n", 1000))
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	notes, photo := server.upload("notes.txt", text), server.upload("photo.png", picture.Bytes())
+
+	// The text file fails the gate, which skips the step after it; the gate
+	// does not apply to the image.
+	for _, test := range []struct {
+		file     FileMetadata
+		statuses []string
+	}{
+		{notes, []string{stepSucceeded, stepSucceeded, stepSucceeded, stepFailed, stepSkipped}},
+		{photo, []string{stepSucceeded, stepSucceeded, stepSucceeded, stepSucceeded}},
+	} {
+		steps := server.processed(test.file.ID)
+		var statuses []string
+		for _, step := range steps {
+			statuses = append(statuses, step.Name+" "+step.Status)
+			if step.Status == stepSkipped && (step.StartedAt != nil || step.FinishedAt != nil) {
+				t.Errorf("%s: skipped step %s has times", test.file.FileName, step.Name)
+			}
+			if step.Status == stepSucceeded && (step.StartedAt == nil || step.FinishedAt == nil) {
+				t.Errorf("%s: step %s has no times", test.file.FileName, step.Name)
+			}
+		}
+		if len(steps) != len(test.statuses) {
+			t.Errorf("%s: steps %v", test.file.FileName, statuses)
+			continue
+		}
+		for i, step := range steps {
+			if step.Status != test.statuses[i] {
+				t.Errorf("%s: steps %v, want statuses %v", test.file.FileName, statuses, test.statuses)
+				break
+			}
+		}
+		if name := steps[2].Output["stdout"]; name != test.file.FileName {
+			t.Errorf("%s: exec step saw FILE_NAME %q", test.file.FileName, name)
+		}
+		sha256Line, err := ioutil.ReadFile(filepath.Join(checksums, test.file.ID+".sha256"))
+		if err != nil || string(sha256Line) != test.file.FileHash+"  "+test.file.FileName+"\n" || steps[0].Output["sha256"] != filepath.Join(checksums, test.file.ID+".sha256") {
+			t.Errorf("%s: checksum file %q, %v, output %v", test.file.FileName, sha256Line, err, steps[0].Output)
+		}
+	}
+	notesSteps, photoSteps := server.processed(notes.ID), server.processed(photo.ID)
+	if notesSteps[3].Error == "" || notesSteps[1].Output["contentType"] != "text/plain; charset=utf-8" {
+		t.Errorf("text file steps %+v", notesSteps)
+	}
+	if info := photoSteps[1].Output; info["imageFormat"] != "png" || info["width"] != "40" || info["height"] != "30" {
+		t.Errorf("image metadata %v", info)
+	}
+}
+
+// TestE2EPostProcessingResumed restarts the server while a file is being
+// processed: the pipeline runs again from the start.
+func TestE2EPostProcessingResumed(t *testing.T) {
+	server := newTestServer(t, 48)
+	checksums := t.TempDir()
+	usePostProcessing(t, "sums * checksums "+checksums+"\ninfo * metadata\n")
+	content := testContent(48, 5000)
+	metadata := server.upload("data.bin", content)
+	server.processed(metadata.ID)
+
+	// As if the server stopped in the middle of the second step.
+	started := testEpoch
+	if _, err := fileStore.Update(metadata.ID, func(stored *FileMetadata) (bool, error) {
+		stored.Processing = []ProcessingStep{
+			{Name: "sums", Processor: "checksums", Status: stepSucceeded, StartedAt: &started, FinishedAt: &started},
+			{Name: "info", Processor: "metadata", Status: stepRunning, StartedAt: &started},
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(checksums, metadata.ID+".sha256"))
+	server.clock.Advance(time.Minute)
+	server.restart()
+	resumePostProcessing()
+
+	steps := server.processed(metadata.ID)
+	if len(steps) != 2 {
+		t.Fatalf("steps after the restart: %+v", steps)
+	}
+	for _, step := range steps {
+		if step.Status != stepSucceeded || step.StartedAt == nil || !step.StartedAt.After(started) {
+			t.Errorf("step %s after the restart: %+v", step.Name, step)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(checksums, metadata.ID+".sha256")); err != nil {
+		t.Errorf("checksums were not exported again: %v", err)
+	}
+
+	// Files whose processing finished are left alone.
+	server.clock.Advance(time.Minute)
+	resumePostProcessing()
+	if again := server.processed(metadata.ID); !again[0].StartedAt.Equal(*steps[0].StartedAt) {
+		t.Errorf("finished pipeline ran again: %+v", again)
+	}
+}
+
+// testPDF returns a PDF file whose page content is the given content stream,
+// compressed with FlateDecode. The last cut bytes of the compressed stream
+// are left out.
+func testPDF(content string, cut int) []byte {
+	var stream bytes.Buffer
+	compressor := zlib.NewWriter(&stream)
+	compressor.Write([]byte(content))
+	compressor.Close()
+	compressed := stream.Bytes()
+	compressed = compressed[:len(compressed)-cut]
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", len(compressed))
+	pdf.Write(compressed)
+	pdf.WriteString("\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+// testDocx returns a Word document with a paragraph per argument.
+func testDocx(paragraphs ...string) []byte {
+	var document bytes.Buffer
+	document.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>`)
+	for _, paragraph := range paragraphs {
+		document.WriteString("<w:p>")
+		for i, run := range strings.Fields(paragraph) {
+			if i > 0 {
+				document.WriteString("<w:r><w:tab/></w:r>")
+			}
+			fmt.Fprintf(&document, "<w:r><w:rPr><w:b/></w:rPr><w:t>%s</w:t></w:r>", run)
+		}
+		document.WriteString("</w:p>")
+	}
+	document.WriteString("</w:body></w:document>")
+	var docx bytes.Buffer
+	archive := zip.NewWriter(&docx)
+	for name, data := range map[string][]byte{
+		"[Content_Types].xml": []byte(`<?xml version="1.0"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`),
+		"word/document.xml":   document.Bytes(),
+	} {
+		entry, _ := archive.Create(name)
+		entry.Write(data)
+	}
+	archive.Close()
+	return docx.Bytes()
+}
+
+// search returns the names of the files /search finds for query.
+func (s *testServer) search(query string) []string {
+	s.t.Helper()
+	var response SearchResponse
+	if status, code := s.do("GET", "/search?q="+url.QueryEscape(query), nil, nil, &response); status != http.StatusOK {
+		s.t.Fatalf("searching %q: %d %s", query, status, code)
+	}
+	names := []string{}
+	for _, result := range response.Results {
+		names = append(names, result.FileName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestE2EContentSearch(t *testing.T) {
+	server := newTestServer(t, 49)
+	savedIndexContent, savedIndex := indexContent, textIndex
+	t.Cleanup(func() {
+		textIndexMutex.Lock()
+		indexContent, textIndex = savedIndexContent, savedIndex
+		textIndexMutex.Unlock()
+		invalidateSearchIndex()
+	})
+	textIndexMutex.Lock()
+	indexContent, textIndex = true, make(map[string]indexedText)
+	textIndexMutex.Unlock()
+
+	var filler strings.Builder
+	for i := 0; i < 6000; i++ {
+		fmt.Fprintf(&filler, "(filler%d) Tj T* ", i*7919%100003)
+	}
+	files := map[string][]byte{
+		"notes.txt": []byte("The migration of herons\nalong the estuary.\n"),
+		"report.pdf": testPDF("BT /F1 12 Tf 72 712 Td (Quarterly) Tj [(revenue) -300 (forecast)] TJ 0 -14 Td <4361706578> Tj ET\n"+
+			"BT (Escaped \\(parenthesised\\) words) Tj ET", 0),
+		"letter.docx": testDocx("Tender submission", "Procurement deadline"),
+		// The compressed stream stops part way: the words before the damage
+		// are indexed, the rest are lost.
+		"damaged.pdf": testPDF("BT (Salvaged) Tj T* "+filler.String()+"(unreachable) Tj ET", 1000),
+		// Cut off in the middle of its only stream, the file has no text.
+		"truncated.pdf": testPDF("BT (Vanished) Tj ET", 0)[:60],
+	}
+	ids := make(map[string]string)
+	for name, content := range files {
+		ids[name] = server.upload(name, content).ID
+	}
+	waitFor(t, "the files to be indexed", func() bool {
+		textIndexMutex.Lock()
+		defer textIndexMutex.Unlock()
+		for _, id := range ids {
+			if _, ok := textIndex[id]; !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"herons", []string{"notes.txt"}},
+		{"estu", []string{"notes.txt"}},
+		{"quarterly forecast", []string{"report.pdf"}},
+		{"capex", []string{"report.pdf"}},
+		{"parenthesised", []string{"report.pdf"}},
+		{"tender deadline", []string{"letter.docx"}},
+		{"procurement", []string{"letter.docx"}},
+		{"salvaged", []string{"damaged.pdf"}},
+		{"unreachable", []string{}},
+		{"vanished", []string{}},
+		{"truncated", []string{"truncated.pdf"}},
+		{"herons revenue", []string{}},
+	} {
+		if got := server.search(test.query); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("search %q: %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	// Files that are not what their names say are not indexed.
+	for _, test := range []struct {
+		name    string
+		content []byte
+	}{
+		{"fake.pdf", []byte("plain text, not a PDF")},
+		{"fake.docx", []byte("PK\x03\x04 not a zip archive")},
+		{"empty.docx", testDocx()[:30]},
+	} {
+		if _, err := textExtractor(test.name)(bytes.NewReader(test.content), int64(len(test.content))); err == nil {
+			t.Errorf("%s: extracted text", test.name)
+		}
+	}
+}
+
+// TestClusterNeedsAdminToken keeps nodes from forwarding shared link
+// downloads without a credential the owner accepts.
+func TestClusterNeedsAdminToken(t *testing.T) {
+	savedAdminToken := adminToken
+	t.Cleanup(func() { adminToken = savedAdminToken })
+	adminToken = ""
+	err := setupCluster("http://10.0.0.1:8080", "http://10.0.0.1:8080,http://10.0.0.2:8080")
+	if err == nil || !strings.Contains(err.Error(), "-admin-token") {
+		t.Errorf("cluster without an admin token: %v", err)
+	}
+	if len(ring) != 0 || len(clusterNodes) != 0 {
+		t.Errorf("refused cluster configuration set up %d nodes", len(clusterNodes))
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// masterKeys wrap the per-upload data keys, by key ID; the legacy single
+// key file gives a key with the empty ID. At-rest encryption is enabled when
+// any is set. currentKeyID names the key new data keys are wrapped with; the
+// others only unwrap the data keys of files stored before a rotation.
+var (
+	masterKeys   map[string][]byte
+	currentKeyID string
+)
+
+const (
+	dataKeySize  = 32
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+// validKeyID matches the IDs of master keys, which prefix the wrapped data
+// keys they wrap, separated by a colon.
+var validKeyID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// loadMasterKey reads the master keys: either a single hex encoded key, or
+// one "<key id> <hex key>" per line, the current key first. Blank lines and
+// lines starting with # are ignored.
+func loadMasterKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string][]byte)
+	current := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		keyID := ""
+		switch len(fields) {
+		case 1:
+		case 2:
+			keyID = fields[0]
+			if !validKeyID.MatchString(keyID) {
+				return fmt.Errorf("line %d: invalid key ID %q", i+1, keyID)
+			}
+		default:
+			return fmt.Errorf("line %d: expected <key id> <hex key>", i+1)
+		}
+		if _, ok := keys[keyID]; ok {
+			return fmt.Errorf("line %d: duplicate key ID %q", i+1, keyID)
+		}
+		key, err := hex.DecodeString(fields[len(fields)-1])
+		if err != nil {
+			return fmt.Errorf("line %d: master key must be hex encoded: %v", i+1, err)
+		}
+		if len(key) != dataKeySize {
+			return fmt.Errorf("line %d: master key must be %d bytes, got %d", i+1, dataKeySize, len(key))
+		}
+		if len(keys) == 0 {
+			current = keyID
+		}
+		keys[keyID] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("no master key in file")
+	}
+	masterKeys, currentKeyID = keys, current
+	return nil
+}
+
+func encryptionEnabled() bool {
+	return masterKeys != nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newWrappedDataKey generates a random data key for a single upload and
+// returns it wrapped by the current master key, ready to be stored in
+// metadata. Keys wrapped by a key with an ID are prefixed with it.
+func newWrappedDataKey() (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(masterKeys[currentKeyID])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, nil))
+	if currentKeyID != "" {
+		wrapped = currentKeyID + ":" + wrapped
+	}
+	return wrapped, nil
+}
+
+// wrappingKeyID returns the ID of the master key that wrapped a data key, ""
+// for keys wrapped before key IDs were given.
+func wrappingKeyID(wrappedKey string) string {
+	if i := strings.IndexByte(wrappedKey, ':'); i >= 0 {
+		return wrappedKey[:i]
+	}
+	return ""
+}
+
+// unwrapDataKey unwraps a data key with the master key it names. Keys
+// without an ID may have been wrapped by a key that was given one since, so
+// every master key is tried: GCM tells the right one from the others.
+func unwrapDataKey(wrappedKey string) ([]byte, error) {
+	if !encryptionEnabled() {
+		return nil, errors.New("file is encrypted but no master key is configured")
+	}
+	keyID := wrappingKeyID(wrappedKey)
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(wrappedKey, keyID+":"))
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([][]byte, 0, len(masterKeys))
+	if key, ok := masterKeys[keyID]; ok {
+		candidates = append(candidates, key)
+	} else if keyID != "" {
+		return nil, fmt.Errorf("data key is wrapped by unknown master key %q", keyID)
+	}
+	if keyID == "" {
+		for id, key := range masterKeys {
+			if id != "" {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+	for _, key := range candidates {
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) < aead.NonceSize() {
+			return nil, errors.New("wrapped data key is too short")
+		}
+		if dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil); err == nil {
+			return dataKey, nil
+		}
+	}
+	return nil, errors.New("no master key unwraps the data key")
+}
+
+// chunkAEAD returns the cipher used for every chunk of an encrypted upload.
+func chunkAEAD(metadata FileMetadata) (cipher.AEAD, error) {
+	dataKey, err := unwrapDataKey(metadata.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+func chunkAdditionalData(fileID string, chunkNumber int) []byte {
+	return []byte(fmt.Sprintf("%s/%d", fileID, chunkNumber))
+}
+
+// Chunks are sealed independently, each under a random nonce stored in front
+// of its ciphertext, and the file ID and chunk number are bound as additional
+// data, so chunks can be encrypted and decrypted in any order and cannot be
+// swapped around. A nonce derived from the chunk number would be reused when
+// a chunk is sent again with different content, which GCM does not survive.
+func sealChunk(aead cipher.AEAD, fileID string, chunkNumber int, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating chunk nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, chunkAdditionalData(fileID, chunkNumber)), nil
+}
+
+func openChunk(aead cipher.AEAD, fileID string, chunkNumber int, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed chunk is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, chunkAdditionalData(fileID, chunkNumber))
+}
+
+// decryptingReader presents an assembled encrypted file as its plaintext.
+// Only the chunk containing the current offset is decrypted, which keeps
+// ranged reads cheap.
+type decryptingReader struct {
+	file     io.ReaderAt
+	aead     cipher.AEAD
+	metadata FileMetadata
+	pos      int64
+
+	chunkIndex int64
+	chunk      []byte
+}
+
+func newDecryptingReader(file io.ReaderAt, metadata FileMetadata) (*decryptingReader, error) {
+	aead, err := chunkAEAD(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{file: file, aead: aead, metadata: metadata, chunkIndex: -1}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.metadata.FileSize {
+		return 0, io.EOF
+	}
+	chunkSize := int64(d.metadata.ChunkSize)
+	index := d.pos / chunkSize
+	if index != d.chunkIndex {
+		if err := d.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk[d.pos-index*chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) loadChunk(index int64) error {
+	chunkSize := int64(d.metadata.ChunkSize)
+	plainSize := d.metadata.FileSize - index*chunkSize
+	if plainSize > chunkSize {
+		plainSize = chunkSize
+	}
+	overhead := chunkStorageOverhead(d.metadata)
+	sealed := make([]byte, plainSize+overhead)
+	if _, err := d.file.ReadAt(sealed, index*(chunkSize+overhead)); err != nil {
+		return err
+	}
+	plaintext, err := openChunk(d.aead, d.metadata.ID, int(index)+1, sealed)
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %v", index+1, err)
+	}
+	d.chunkIndex, d.chunk = index, plaintext
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.metadata.FileSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// storedFileReader returns a reader over the plaintext of an assembled file.
+// Plain files are read up to their recorded size, without the bytes of an
+// append still being written.
+func storedFileReader(file storedFile, metadata FileMetadata) (io.ReadSeeker, error) {
+	if !metadata.Encrypted {
+		return io.NewSectionReader(file, 0, metadata.FileSize), nil
+	}
+	return newDecryptingReader(file, metadata)
+}
+
+// storedFileSize is the size of the assembled file on disk.
+func storedFileSize(metadata FileMetadata) int64 {
+	if !metadata.Encrypted || metadata.ChunkSize <= 0 {
+		return metadata.FileSize
+	}
+	chunks := (metadata.FileSize + int64(metadata.ChunkSize) - 1) / int64(metadata.ChunkSize)
+	return metadata.FileSize + chunks*chunkStorageOverhead(metadata)
+}
+
+// chunkStorageOverhead is the number of bytes a stored chunk takes beyond its
+// plaintext: its GCM nonce and authentication tag.
+func chunkStorageOverhead(metadata FileMetadata) int64 {
+	if !metadata.Encrypted {
+		return 0
+	}
+	return gcmNonceSize + gcmTagSize
+}
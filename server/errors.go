@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes sent in ErrorResponse.Code. Clients branch on these rather
+// than on the status or the message, which is meant for people.
+const (
+	codeInvalidRequest       = "INVALID_REQUEST"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeAccessDenied         = "ACCESS_DENIED"
+	codeNotFound             = "NOT_FOUND"
+	codeUploadNotFound       = "UPLOAD_NOT_FOUND"
+	codeFileNotFound         = "FILE_NOT_FOUND"
+	codeGroupNotFound        = "GROUP_NOT_FOUND"
+	codeLinkNotFound         = "LINK_NOT_FOUND"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeConflict             = "CONFLICT"
+	codeCompletionInProgress = "COMPLETION_IN_PROGRESS"
+	codeFileChanged          = "FILE_CHANGED"
+	codeFileInUse            = "FILE_IN_USE"
+	codeUploadCancelled      = "UPLOAD_CANCELLED"
+	codeGroupClosed          = "GROUP_CLOSED"
+	codeLinkExpired          = "LINK_EXPIRED"
+	codeResumptionExpired    = "RESUMPTION_EXPIRED"
+	codeDeadlineExceeded     = "DEADLINE_EXCEEDED"
+	codeLengthRequired       = "LENGTH_REQUIRED"
+	codeRangeNotSatisfiable  = "RANGE_NOT_SATISFIABLE"
+	codeChunkSizeMismatch    = "CHUNK_SIZE_MISMATCH"
+	codeChunkTruncated       = "CHUNK_TRUNCATED"
+	codeChunkHashMismatch    = "CHUNK_HASH_MISMATCH"
+	codeDigestMismatch       = "DIGEST_MISMATCH"
+	codeFileHashMismatch     = "FILE_HASH_MISMATCH"
+	codeFileTooLarge         = "FILE_TOO_LARGE"
+	codeChunkTooLarge        = "CHUNK_TOO_LARGE"
+	codeBodyTooLarge         = "BODY_TOO_LARGE"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codeTransferCapExceeded  = "TRANSFER_CAP_EXCEEDED"
+	codeTooManyRequests      = "TOO_MANY_REQUESTS"
+	codeServerBusy           = "SERVER_BUSY"
+	codeNodeUnavailable      = "NODE_UNAVAILABLE"
+	codeInternalError        = "INTERNAL_ERROR"
+	codeFetchFailed          = "FETCH_FAILED"
+)
+
+// retryableCodes are the errors a client may resolve by sending the same
+// request again, after Retry-After when the response carries one. A chunk
+// that arrived damaged is resent; a file that assembled to the wrong hash
+// is not, as its chunks were already verified.
+var retryableCodes = map[string]bool{
+	codeChunkTruncated:    true,
+	codeChunkHashMismatch: true,
+	codeDigestMismatch:    true,
+	codeFileInUse:         true,
+	codeTooManyRequests:   true,
+	codeServerBusy:        true,
+	codeNodeUnavailable:   true,
+	codeInternalError:     true,
+}
+
+// ErrorResponse is the body of every error the API returns.
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	Retryable bool        `json:"retryable"`
+}
+
+// writeError answers a request with an ErrorResponse. It replaces
+// http.Error, so like it the response is never cached or sniffed.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with details that let a client act on the
+// error, such as the limits a rejected upload exceeded.
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		Retryable: retryableCodes[code],
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types of the activity feed.
+const (
+	eventUploadStarted   = "upload_started"
+	eventUploadCompleted = "upload_completed"
+	eventUploadFailed    = "upload_failed"
+	eventFileDeleted     = "file_deleted"
+)
+
+// Event is an entry of the activity feed served by GET /events. IDs grow by
+// one per event and start again at 1 when the server restarts. Actor is the
+// principal that caused the event, "server" for the server itself, and
+// empty for anonymous requests.
+type Event struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	FileID   string    `json:"fileId,omitempty"`
+	FileName string    `json:"fileName,omitempty"`
+	GroupID  string    `json:"groupId,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	// access holds the owner and ACL of the file, which decide who sees
+	// the event.
+	access FileMetadata
+}
+
+var (
+	// eventBufferSize is how many events the server keeps for GET /events;
+	// older ones are dropped. 0 disables the feed.
+	eventBufferSize = 1000
+	// eventKeepAlive is how often an idle event stream gets a comment, so
+	// that proxies do not close it.
+	eventKeepAlive = 15 * time.Second
+
+	events      []Event
+	lastEventID int64
+	// eventSubscribers are signalled when an event is published.
+	eventSubscribers = make(map[chan struct{}]bool)
+	eventsMutex      = &sync.Mutex{}
+)
+
+// publishEvent adds an event about a file to the feed. r is the request
+// that caused it, or nil when the server did.
+func publishEvent(r *http.Request, eventType string, metadata FileMetadata, detail string) {
+	if eventBufferSize <= 0 {
+		return
+	}
+	actor := "server"
+	if r != nil {
+		actor, _ = requestPrincipal(r)
+	}
+	event := Event{
+		Time: timeNow().UTC(), Type: eventType, FileID: metadata.ID, FileName: metadata.FileName, GroupID: metadata.GroupID,
+		Size: metadata.FileSize, Actor: actor, Detail: detail, access: FileMetadata{Owner: metadata.Owner, ACL: metadata.ACL},
+	}
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	lastEventID++
+	event.ID = lastEventID
+	events = append(events, event)
+	if len(events) > eventBufferSize {
+		events = events[len(events)-eventBufferSize:]
+	}
+	for subscriber := range eventSubscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// eventsAfter returns the kept events with an ID above afterID that r may
+// see and match. An ID above the last one was given before the server
+// restarted, so every kept event is newer.
+func eventsAfter(r *http.Request, afterID int64, match func(Event) bool) []Event {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if afterID > lastEventID {
+		afterID = 0
+	}
+	matched := []Event{}
+	for _, event := range events {
+		if event.ID > afterID && match(event) && canAccess(r, event.access, permissionRead) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+// eventsHandler serves GET /events, the recent uploads and deletions of
+// files the caller may read, oldest first. ?since= takes an event ID or an
+// RFC 3339 time and returns the events after it; ?type= keeps one type.
+// ?limit= (default 100) keeps the first matches after ?since=, or the most
+// recent ones without it. Requests accepting text/event-stream get the
+// events after ?since= or Last-Event-ID and then every new one as
+// server-sent events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	if eventBufferSize <= 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "Event feed is disabled")
+		return
+	}
+
+	query := r.URL.Query()
+	var afterID int64
+	var since time.Time
+	value := query.Get("since")
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		value = lastID
+	}
+	if value != "" {
+		var err error
+		if afterID, err = strconv.ParseInt(value, 10, 64); err != nil || afterID < 0 {
+			afterID = 0
+			if since, err = time.Parse(time.RFC3339, value); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid since, expected an event ID or RFC 3339")
+				return
+			}
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+			return
+		}
+	}
+	match := func(event Event) bool {
+		return event.Time.After(since) && (query.Get("type") == "" || event.Type == query.Get("type"))
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, r, afterID, value == "", match)
+		return
+	}
+	matched := eventsAfter(r, afterID, match)
+	if len(matched) > limit {
+		if value == "" {
+			matched = matched[len(matched)-limit:]
+		} else {
+			matched = matched[:limit]
+		}
+	}
+	writeJSON(w, matched)
+}
+
+// streamEvents sends the events after afterID, or only new ones if fromNow,
+// as server-sent events until the client goes away.
+func streamEvents(w http.ResponseWriter, r *http.Request, afterID int64, fromNow bool, match func(Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Streaming is not supported")
+		return
+	}
+	notify := make(chan struct{}, 1)
+	eventsMutex.Lock()
+	eventSubscribers[notify] = true
+	if fromNow || afterID > lastEventID {
+		afterID = lastEventID
+	}
+	eventsMutex.Unlock()
+	defer func() {
+		eventsMutex.Lock()
+		delete(eventSubscribers, notify)
+		eventsMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps proxies such as nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	flusher.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		for _, event := range eventsAfter(r, afterID, match) {
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			afterID = event.ID
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
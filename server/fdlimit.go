@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// maxOpenFiles caps the requests that work on files on disk at once
+	// (chunk writes, completions, downloads, delta uploads), so a burst of
+	// clients cannot run the process out of file descriptors. A completion
+	// holds one slot although assembly opens up to -assembly-workers chunk
+	// files. 0 derives the limit from the descriptor limit of the process; -1
+	// disables it.
+	maxOpenFiles int
+
+	fileSlots chan struct{}
+)
+
+// fileSlotWait is how long a request waits for a file slot before it is
+// turned away with 503; unlike the chunk limits, short bursts queue.
+const fileSlotWait = 10 * time.Second
+
+// maxBodyDrain is how much of an unread request body is read after a handler
+// returns so the connection can be reused; larger remainders are dropped
+// with the connection instead.
+const maxBodyDrain = 256 * 1024
+
+// initFileSlots sizes the file semaphore; call it after flags are parsed.
+func initFileSlots() {
+	limit := maxOpenFiles
+	if limit == 0 {
+		// Leave half of the descriptors to connections, the metadata store
+		// and logs.
+		limit = descriptorLimit() / 2
+	}
+	if limit > 0 {
+		fileSlots = make(chan struct{}, limit)
+		fmt.Printf("Handling at most %d file requests at once\n", limit)
+	}
+}
+
+// limitOpenFiles is a semaphore middleware for handlers that open files.
+func limitOpenFiles(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fileSlots != nil {
+			timer := time.NewTimer(fileSlotWait)
+			select {
+			case fileSlots <- struct{}{}:
+				timer.Stop()
+				defer func() { <-fileSlots }()
+			case <-timer.C:
+				fmt.Println("Rejecting request: too many open files")
+				w.Header().Set("Retry-After", strconv.Itoa(chunkRetryAfter))
+				writeError(w, http.StatusServiceUnavailable, codeServerBusy, "Server is handling too many files")
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// withBodyDrain reads what a handler left of the request body, up to
+// maxBodyDrain, and closes it, whichever way the handler returned.
+func withBodyDrain(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			io.CopyN(ioutil.Discard, r.Body, maxBodyDrain)
+			r.Body.Close()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// descriptorLimit is 0 on windows, where handles are not limited per process
+// the way descriptors are.
+func descriptorLimit() int {
+	return 0
+}
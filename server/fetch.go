@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -fetch, POST /fetch stores a file the server downloads itself from an
+// http, https or s3 URL, so data already on the internet does not have to be
+// relayed through the client's connection. The download runs as a job whose
+// progress GET /fetch/{id} reports. Unless -fetch-private is given, the
+// server refuses to connect to loopback, private, shared and link-local
+// addresses, checked after every DNS lookup and redirect, so the endpoint
+// cannot be used to reach the server's own network.
+var (
+	fetchEnabled bool
+	fetchPrivate bool
+)
+
+const (
+	fetchRunning   = "running"
+	fetchCompleted = "completed"
+	fetchFailed    = "failed"
+	fetchCancelled = "cancelled"
+
+	// maxRunningFetches bounds the jobs downloading at once.
+	maxRunningFetches = 8
+	// fetchRetention keeps finished jobs around so clients can still query
+	// their outcome.
+	fetchRetention = time.Hour
+	// maxFetchRedirects bounds the redirects a fetch follows.
+	maxFetchRedirects = 5
+)
+
+// FetchRequest is the body of POST /fetch. FileName defaults to the last
+// segment of the URL's path. When FileHash is set, the fetched content must
+// have that SHA-256 or the job fails.
+type FetchRequest struct {
+	URL       string            `json:"url"`
+	FileName  string            `json:"fileName,omitempty"`
+	FileHash  string            `json:"fileHash,omitempty"`
+	ChunkSize int               `json:"chunkSize,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// FetchJob is the state of a fetch. TotalBytes is the Content-Length of the
+// source, 0 while or when it is unknown; File is the stored file once the job
+// completed.
+type FetchJob struct {
+	ID           string        `json:"id"`
+	URL          string        `json:"url"`
+	State        string        `json:"state"`
+	BytesFetched int64         `json:"bytesFetched"`
+	TotalBytes   int64         `json:"totalBytes,omitempty"`
+	StartedAt    time.Time     `json:"startedAt"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+	ErrorCode    string        `json:"errorCode,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	File         *FileMetadata `json:"file,omitempty"`
+
+	owner  string
+	cancel context.CancelFunc
+}
+
+var (
+	fetchJobs      = make(map[string]*FetchJob)
+	fetchJobsMutex = &sync.Mutex{}
+)
+
+// fetchClient connects only to addresses allowed by fetchDialControl. It
+// ignores proxy settings, which would hide the address actually reached.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, Control: fetchDialControl}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+		}
+		if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", r.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// sharedAddressSpace is 100.64.0.0/10, which carrier-grade NAT and some
+// cloud providers use for internal addresses; net.IP.IsPrivate leaves it out.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// fetchDialControl refuses connections to the server's own networks unless
+// -fetch-private allows them.
+func fetchDialControl(network, address string, c syscall.RawConn) error {
+	if fetchPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+// fetchHandler serves POST /fetch, which starts a job, GET /fetch/{id}, its
+// state, and DELETE /fetch/{id}, which cancels it. Jobs are only visible to
+// the principal that started them and to admins.
+func fetchHandler(w http.ResponseWriter, r *http.Request) {
+	if !fetchEnabled {
+		writeError(w, http.StatusNotFound, codeNotFound, "Fetching is not enabled")
+		return
+	}
+	jobID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/fetch"), "/")
+	if jobID == "" {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+			return
+		}
+		startFetch(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and DELETE methods are allowed")
+		return
+	}
+
+	principal, admin := requestPrincipal(r)
+	fetchJobsMutex.Lock()
+	job, ok := fetchJobs[jobID]
+	if ok && !admin && job.owner != principal {
+		ok = false
+	}
+	var response FetchJob
+	if ok {
+		if r.Method == "DELETE" && job.State == fetchRunning {
+			job.cancel()
+		}
+		response = *job
+	}
+	fetchJobsMutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "Fetch job not found")
+		return
+	}
+	if r.Method == "DELETE" {
+		audit(r, AuditEntry{Action: "fetch_cancel", Detail: jobID})
+	}
+	writeJSON(w, response)
+}
+
+func startFetch(w http.ResponseWriter, r *http.Request) {
+	var request FetchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid fetch request: "+err.Error())
+		return
+	}
+	source, err := fetchSourceURL(request.URL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if request.FileName == "" {
+		request.FileName = path.Base(source.Path)
+	}
+	if !validFileName(request.FileName) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid file name; the URL has none, so fileName is needed")
+		return
+	}
+	if request.FileHash != "" {
+		if hash, err := hex.DecodeString(request.FileHash); err != nil || len(hash) != sha256.Size {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "File hash must be a hex SHA-256")
+			return
+		}
+		request.FileHash = strings.ToLower(request.FileHash)
+	}
+	if request.ChunkSize != 0 && request.ChunkSize < minChunkSize {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Chunk size must be at least %d bytes", minChunkSize))
+		return
+	}
+	if request.ChunkSize > maxChunkSize {
+		chunkTooLarge(w, maxChunkSize)
+		return
+	}
+	if err := checkTags(request.Tags); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	owner, _ := requestPrincipal(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &FetchJob{
+		ID:        generateLocalID(),
+		URL:       request.URL,
+		State:     fetchRunning,
+		StartedAt: timeNow().UTC(),
+		owner:     owner,
+		cancel:    cancel,
+	}
+	fetchJobsMutex.Lock()
+	running := 0
+	for _, other := range fetchJobs {
+		if other.State == fetchRunning {
+			running++
+		}
+	}
+	if running >= maxRunningFetches {
+		fetchJobsMutex.Unlock()
+		cancel()
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusTooManyRequests, codeTooManyRequests, fmt.Sprintf("%d fetches are already running", running))
+		return
+	}
+	fetchJobs[job.ID] = job
+	response := *job
+	fetchJobsMutex.Unlock()
+
+	audit(r, AuditEntry{Action: "fetch", FileName: request.FileName, Detail: job.ID + " " + request.URL})
+	fmt.Printf("Fetch %s started: %s\n", job.ID, request.URL)
+	go runFetch(ctx, job, source, request)
+
+	w.Header().Set("Location", "/fetch/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// fetchSourceURL checks a source URL. s3://<bucket>/<key> becomes the
+// virtual-hosted URL of the object on AWS, which serves public objects;
+// private objects need a presigned https URL.
+func fetchSourceURL(raw string) (*url.URL, error) {
+	source, err := url.Parse(raw)
+	if err != nil || source.Host == "" {
+		return nil, fmt.Errorf("URL must be an absolute http, https or s3 URL")
+	}
+	switch source.Scheme {
+	case "http", "https":
+	case "s3":
+		if source.Path == "" || source.Path == "/" {
+			return nil, fmt.Errorf("s3 URL must name an object: s3://<bucket>/<key>")
+		}
+		source = &url.URL{Scheme: "https", Host: source.Host + ".s3.amazonaws.com", Path: source.Path, RawPath: source.RawPath}
+	default:
+		return nil, fmt.Errorf("URL must be an absolute http, https or s3 URL")
+	}
+	if source.User != nil {
+		return nil, fmt.Errorf("URL must not carry credentials")
+	}
+	return source, nil
+}
+
+// runFetch downloads the source to a temporary file, then stores it like a
+// completed upload owned by the job's principal.
+func runFetch(ctx context.Context, job *FetchJob, source *url.URL, request FetchRequest) {
+	metadata, code, err := fetchFile(ctx, job, source, request)
+	fetchJobsMutex.Lock()
+	finished := timeNow().UTC()
+	job.FinishedAt = &finished
+	switch {
+	case err == nil:
+		public := metadata.public()
+		job.State, job.File = fetchCompleted, &public
+	case ctx.Err() != nil:
+		job.State, job.ErrorCode, job.Error = fetchCancelled, codeUploadCancelled, "Fetch was cancelled"
+	default:
+		job.State, job.ErrorCode, job.Error = fetchFailed, code, err.Error()
+	}
+	state := job.State
+	fetchJobsMutex.Unlock()
+	job.cancel()
+	if state == fetchFailed {
+		fmt.Printf("Fetch %s failed: %v\n", job.ID, err)
+	} else {
+		fmt.Printf("Fetch %s %s\n", job.ID, state)
+	}
+
+	time.AfterFunc(fetchRetention, func() {
+		fetchJobsMutex.Lock()
+		delete(fetchJobs, job.ID)
+		fetchJobsMutex.Unlock()
+	})
+}
+
+// fetchFile does the work of runFetch and returns the stored file, or the
+// error code and error the job fails with.
+func fetchFile(ctx context.Context, job *FetchJob, source *url.URL, request FetchRequest) (FileMetadata, string, error) {
+	metadata := FileMetadata{FileName: request.FileName, ChunkSize: request.ChunkSize, Tags: request.Tags}
+	fetchRequest, err := http.NewRequestWithContext(ctx, "GET", source.String(), nil)
+	if err != nil {
+		return metadata, codeInvalidRequest, err
+	}
+	resp, err := fetchClient.Do(fetchRequest)
+	if err != nil {
+		return metadata, codeFetchFailed, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return metadata, codeFetchFailed, fmt.Errorf("source answered %s", resp.Status)
+	}
+	if resp.ContentLength > 0 {
+		metadata.FileSize = resp.ContentLength
+		if status, code, hints := registrationLimit(metadata); status != 0 {
+			return metadata, code, errors.New(hints.Error)
+		}
+		fetchJobsMutex.Lock()
+		job.TotalBytes = resp.ContentLength
+		fetchJobsMutex.Unlock()
+	}
+
+	tmpDir := filepath.Join(dataDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return metadata, codeInternalError, err
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, "fetch_"+job.ID+"_")
+	if err != nil {
+		return metadata, codeInternalError, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	body := io.Reader(resp.Body)
+	if maxFileSize > 0 {
+		body = io.LimitReader(body, maxFileSize+1)
+	}
+	hasher, md5Hasher := sha256.New(), md5.New()
+	written, err := copyPooled(io.MultiWriter(tmpFile, hasher, md5Hasher, &fetchProgress{job: job}), body)
+	if err != nil {
+		return metadata, codeFetchFailed, fmt.Errorf("reading source: %v", err)
+	}
+	if resp.ContentLength > 0 && written != resp.ContentLength {
+		return metadata, codeFetchFailed, fmt.Errorf("source sent %d of %d bytes", written, resp.ContentLength)
+	}
+	if written == 0 {
+		return metadata, codeInvalidRequest, fmt.Errorf("source is empty")
+	}
+	metadata.FileSize = written
+	if status, code, hints := registrationLimit(metadata); status != 0 {
+		return metadata, code, errors.New(hints.Error)
+	}
+	metadata.FileHash = fmt.Sprintf("%x", hasher.Sum(nil))
+	if request.FileHash != "" && metadata.FileHash != request.FileHash {
+		return metadata, codeFileHashMismatch, fmt.Errorf("fetched content has SHA-256 %s, not %s", metadata.FileHash, request.FileHash)
+	}
+	metadata.FileMD5 = base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil))
+
+	metadata, err = prepareUpload(metadata, job.owner)
+	if err != nil {
+		return metadata, codeInternalError, err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return metadata, codeInternalError, err
+	}
+	if _, err := writeStoredFile(finalFilePath(metadata), metadata, tmpFile, metadata.FileHash); err != nil {
+		return metadata, codeInternalError, fmt.Errorf("storing file: %v", err)
+	}
+	if err := updateFileInfoDB(metadata); err != nil {
+		os.Remove(finalFilePath(metadata))
+		return metadata, codeInternalError, fmt.Errorf("recording file: %v", err)
+	}
+	indexStoredFile(metadata)
+	generateThumbnails(metadata)
+	extractMediaInfo(metadata)
+	indexFileText(metadata)
+	postProcess(metadata)
+	queueErasureCoding(metadata)
+	audit(nil, AuditEntry{Action: "complete", FileID: metadata.ID, FileName: metadata.FileName, Size: metadata.FileSize, Chunks: metadata.TotalChunks, Detail: "fetched by " + job.ID})
+	publishEvent(nil, eventUploadCompleted, metadata, "fetched by "+job.ID)
+	return metadata, "", nil
+}
+
+// fetchProgress counts the bytes of a job as they arrive.
+type fetchProgress struct {
+	job *FetchJob
+}
+
+func (p *fetchProgress) Write(data []byte) (int, error) {
+	fetchJobsMutex.Lock()
+	p.job.BytesFetched += int64(len(data))
+	fetchJobsMutex.Unlock()
+	return len(data), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listFilesHandler serves GET /files, optionally narrowed with ?prefix= to
+// the files whose name starts with the given prefix and with repeated
+// ?tag=key=value or ?tag=key to the files carrying every given tag.
+func listFilesHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received list files request for:", r.URL.String())
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	tags, err := parseTagFilter(r.URL.Query()["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	files := make([]FileMetadata, 0, len(fileInfos))
+	for _, metadata := range fileInfos {
+		if strings.HasPrefix(metadata.FileName, prefix) && tags.matches(metadata.Tags) && canAccess(r, metadata, permissionRead) {
+			files = append(files, metadata.public())
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].FileName != files[j].FileName {
+			return files[i].FileName < files[j].FileName
+		}
+		return files[i].ID < files[j].ID
+	})
+
+	response, err := json.Marshal(files)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	if notModified(w, r, responseETag(response), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// deleteFileHandler serves DELETE /files/{id}, which moves the file to the
+// trash unless -trash-retention is 0. A file being downloaded is refused
+// with 409, unless an admin passes ?force=true.
+func deleteFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	_, admin := requestPrincipal(r)
+	force := admin && r.URL.Query().Get("force") == "true"
+	var metadata FileMetadata
+	var readers int
+	found, err := fileStore.Update(fileID, func(stored *FileMetadata) (bool, error) {
+		metadata = *stored
+		if !canAccess(r, metadata, permissionDelete) {
+			return false, errAccessDenied
+		}
+		var endChange func()
+		if endChange, readers = beginChange(fileID, force); endChange == nil {
+			return false, errFileInUse
+		}
+		defer endChange()
+		if trashRetention > 0 {
+			if err := moveToTrash(r, metadata); err != nil {
+				fmt.Println("Error moving stored file to the trash:", err)
+				return false, errors.New("Error moving stored file to the trash")
+			}
+			return true, nil
+		}
+		if err := os.Remove(finalFilePath(metadata)); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error removing stored file:", err)
+			return false, errors.New("Error removing stored file")
+		}
+		removeShards(fileID)
+		removeThumbnails(fileID)
+		return true, nil
+	})
+	switch {
+	case err == errAccessDenied:
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Access denied")
+		return
+	case err == errFileInUse:
+		writeInUse(w, readers)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	case !found:
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	forgetIndexedFile(fileID)
+	forgetFileText(fileID)
+	fmt.Println("Deleted file:", fileID)
+	audit(r, AuditEntry{Action: "delete", FileID: fileID, FileName: metadata.FileName, Size: metadata.FileSize})
+	detail := ""
+	if trashRetention > 0 {
+		detail = "moved to the trash"
+	}
+	publishEvent(r, eventFileDeleted, metadata, detail)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validFileName accepts plain names and relative slash-separated paths such
+// as "photos/2023/a.jpg", which sync uses to keep directory structure.
+func validFileName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\x00\\") || strings.HasPrefix(name, "/") {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean == name && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
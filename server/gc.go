@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcGracePeriod keeps the garbage collector away from files changed
+// recently, which may belong to an upload, copy or delta still under way.
+const gcGracePeriod = time.Hour
+
+// What the garbage collector finds.
+const (
+	// gcOrphanFile is a stored file no metadata record refers to.
+	gcOrphanFile = "orphan_file"
+	// gcMisplacedFile is the data of a record kept under another name, as a
+	// rename interrupted by a crash leaves it.
+	gcMisplacedFile = "misplaced_file"
+	// gcStagedFile is a leftover of an assembly, delta, patch, append or key
+	// rotation that did not finish.
+	gcStagedFile = "staged_file"
+	// gcOrphanUpload is an upload directory of no upload in progress.
+	gcOrphanUpload = "orphan_upload"
+	// gcOrphanChunk is a chunk file beyond the last chunk of its upload.
+	gcOrphanChunk = "orphan_chunk"
+	// gcOrphanShard is an erasure coding shard of no stored or trashed file.
+	gcOrphanShard = "orphan_shard"
+	// gcOrphanThumbnail is a thumbnail of no stored or trashed file.
+	gcOrphanThumbnail = "orphan_thumbnail"
+	// gcOrphanTrash is data in the trash without its record.
+	gcOrphanTrash = "orphan_trash"
+	// gcMissingFile is a record whose data is gone. It is only reported:
+	// the scrubber flags such files, and an admin deletes them.
+	gcMissingFile = "missing_file"
+)
+
+// GCIssue is one inconsistency between the data directory and the metadata.
+type GCIssue struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	FileID string `json:"fileId,omitempty"`
+	Size   int64  `json:"size"`
+	// Repair is "delete", "rename" (to RenameTo) or "" for issues that are
+	// only reported. Repaired tells whether it was done, Error why not.
+	Repair   string `json:"repair"`
+	RenameTo string `json:"renameTo,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+// GCReport answers /admin/gc.
+type GCReport struct {
+	DryRun    bool      `json:"dryRun"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Issues    []GCIssue `json:"issues"`
+	// ReclaimableBytes is the size of what is to be deleted, FreedBytes of
+	// what was.
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+	FreedBytes       int64 `json:"freedBytes"`
+	// SkippedRecent counts entries left alone as they changed within the
+	// grace period.
+	SkippedRecent int `json:"skippedRecent"`
+}
+
+var gcMutex sync.Mutex
+
+// gcRun is one pass of the garbage collector.
+type gcRun struct {
+	report  GCReport
+	repair  bool
+	cutoff  time.Time
+	stored  map[string]FileMetadata
+	trashed map[string]bool
+}
+
+// gcHandler serves /admin/gc: GET reports what the garbage collector would
+// do, POST does it.
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and POST methods are allowed")
+		return
+	}
+	if !gcMutex.TryLock() {
+		writeError(w, http.StatusConflict, codeConflict, "A garbage collection is already running")
+		return
+	}
+	defer gcMutex.Unlock()
+	report, err := collectGarbage(r.Method == "POST")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error collecting garbage: "+err.Error())
+		return
+	}
+	if !report.DryRun {
+		audit(r, AuditEntry{Action: "gc", Size: report.FreedBytes, Detail: fmt.Sprintf("%d issue(s) found", len(report.Issues))})
+	}
+	writeJSON(w, report)
+}
+
+// collectGarbage compares the data directory, the erasure coding
+// directories and the metadata, and with repair deletes what nothing refers
+// to and puts misplaced files back.
+func collectGarbage(repair bool) (GCReport, error) {
+	run := &gcRun{
+		report:  GCReport{DryRun: !repair, CheckedAt: timeNow(), Issues: []GCIssue{}},
+		repair:  repair,
+		cutoff:  timeNow().Add(-gcGracePeriod),
+		trashed: make(map[string]bool),
+	}
+	var err error
+	if run.stored, err = fileStore.List(); err != nil {
+		return run.report, err
+	}
+	trashed, err := readTrash()
+	if err != nil {
+		return run.report, err
+	}
+	for _, file := range trashed {
+		run.trashed[file.ID] = true
+	}
+
+	misplaced, err := run.scanStoredFiles()
+	if err != nil {
+		return run.report, err
+	}
+	for _, scan := range []func() error{run.scanUploads, run.scanShards, run.scanThumbnails, run.scanTrash} {
+		if err := scan(); err != nil {
+			return run.report, err
+		}
+	}
+	run.findMissingFiles(misplaced)
+	return run.report, nil
+}
+
+// scanStoredFiles checks the final_<id>_<name> files of the data directory
+// and returns the IDs of records whose data it found under another name.
+func (g *gcRun) scanStoredFiles() (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	misplaced := make(map[string]bool)
+	for _, entry := range entries {
+		id, _, ok := strings.Cut(strings.TrimPrefix(entry.Name(), "final_"), "_")
+		if !strings.HasPrefix(entry.Name(), "final_") || !ok || !validFileID(id) || !entry.Mode().IsRegular() || g.busy(id) {
+			continue
+		}
+		path := filepath.Join(dataDir, entry.Name())
+		metadata, stored := g.stored[id]
+		if stored && path == finalFilePath(metadata) {
+			continue
+		}
+		if g.recent(entry) {
+			continue
+		}
+		issue := GCIssue{Kind: gcOrphanFile, Path: path, FileID: id, Size: entry.Size(), Repair: "delete"}
+		switch {
+		case stored && strings.HasPrefix(path, finalFilePath(metadata)+"."):
+			issue.Kind = gcStagedFile
+			if g.dataMissing(metadata) {
+				// Which of the staged versions the record describes is
+				// for an admin to tell.
+				issue.Repair = ""
+			}
+		case stored && !misplaced[id] && g.dataMissing(metadata):
+			issue.Kind, issue.Repair, issue.RenameTo = gcMisplacedFile, "rename", finalFilePath(metadata)
+			misplaced[id] = true
+		case !stored && g.trashed[id] && !fileExists(trashDataPath(id)):
+			// A restore from the trash stopped before the record was
+			// stored again; the file goes back to the trash.
+			issue.Kind, issue.Repair, issue.RenameTo = gcMisplacedFile, "rename", trashDataPath(id)
+		}
+		g.fix(issue)
+	}
+	return misplaced, nil
+}
+
+// scanUploads checks the upload directories under tmp/: those of no upload
+// in progress, and chunk files beyond the last chunk of the upload.
+func (g *gcRun) scanUploads() error {
+	entries, err := ioutil.ReadDir(filepath.Join(dataDir, "tmp"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validFileID(entry.Name()) {
+			continue
+		}
+		metadataMutex.Lock()
+		metadata, active := filesMetadata[entry.Name()]
+		completing := completingUploads[entry.Name()]
+		metadataMutex.Unlock()
+		// The metadata of completed uploads stays in filesMetadata too.
+		_, stored := g.stored[entry.Name()]
+		path := uploadTmpDir(entry.Name())
+		if !active || stored && !completing {
+			if !g.recent(entry) {
+				g.fix(GCIssue{Kind: gcOrphanUpload, Path: path, FileID: entry.Name(), Size: directorySize(path), Repair: "delete"})
+			}
+			continue
+		}
+		if completing {
+			continue
+		}
+		chunks, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, chunk := range chunks {
+			chunkNumber, err := strconv.Atoi(strings.TrimPrefix(chunk.Name(), "part_"))
+			if !strings.HasPrefix(chunk.Name(), "part_") || err != nil || chunkNumber >= 1 && chunkNumber <= metadata.TotalChunks || g.recent(chunk) {
+				continue
+			}
+			g.fix(GCIssue{Kind: gcOrphanChunk, Path: filepath.Join(path, chunk.Name()), FileID: metadata.ID, Size: chunk.Size(), Repair: "delete"})
+		}
+	}
+	return nil
+}
+
+// scanShards checks the shards in the erasure coding directories.
+func (g *gcRun) scanShards() error {
+	for _, dir := range erasureDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			id := strings.TrimSuffix(entry.Name(), ".shard")
+			if id == entry.Name() || !validFileID(id) || g.referenced(id) || g.recent(entry) {
+				continue
+			}
+			g.fix(GCIssue{Kind: gcOrphanShard, Path: filepath.Join(dir, entry.Name()), FileID: id, Size: entry.Size(), Repair: "delete"})
+		}
+	}
+	return nil
+}
+
+// scanThumbnails checks the <id>_<size><ext> files of the thumbnail
+// directory.
+func (g *gcRun) scanThumbnails() error {
+	entries, err := ioutil.ReadDir(thumbnailDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, _, ok := strings.Cut(entry.Name(), "_")
+		if !ok || !validFileID(id) || g.referenced(id) || g.recent(entry) {
+			continue
+		}
+		g.fix(GCIssue{Kind: gcOrphanThumbnail, Path: filepath.Join(thumbnailDir(), entry.Name()), FileID: id, Size: entry.Size(), Repair: "delete"})
+	}
+	return nil
+}
+
+// scanTrash checks for data in the trash whose record is gone.
+func (g *gcRun) scanTrash() error {
+	entries, err := ioutil.ReadDir(trashDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".data")
+		if id == entry.Name() || !validFileID(id) || g.trashed[id] || g.recent(entry) {
+			continue
+		}
+		g.fix(GCIssue{Kind: gcOrphanTrash, Path: filepath.Join(trashDir(), entry.Name()), FileID: id, Size: entry.Size(), Repair: "delete"})
+	}
+	return nil
+}
+
+// findMissingFiles reports the records of this node whose data is neither
+// in the data directory nor in shards, except those whose data was found
+// under another name.
+func (g *gcRun) findMissingFiles(misplaced map[string]bool) {
+	ids := make([]string, 0, len(g.stored))
+	for id := range g.stored {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		metadata := g.stored[id]
+		if !ownedLocally(id) || misplaced[id] || g.busy(id) || !g.dataMissing(metadata) {
+			continue
+		}
+		g.report.Issues = append(g.report.Issues, GCIssue{Kind: gcMissingFile, Path: finalFilePath(metadata), FileID: id, Size: metadata.FileSize})
+	}
+}
+
+// fix records an issue and, unless this is a dry run, repairs it.
+func (g *gcRun) fix(issue GCIssue) {
+	if issue.Repair == "delete" {
+		g.report.ReclaimableBytes += issue.Size
+	}
+	if g.repair && issue.Repair != "" {
+		var err error
+		switch {
+		case issue.Repair == "rename":
+			err = os.Rename(issue.Path, issue.RenameTo)
+		case issue.Kind == gcOrphanFile && g.recordStored(issue.FileID):
+			// A copy stored its record since the scan started.
+			err = fmt.Errorf("file was stored meanwhile")
+		default:
+			err = os.RemoveAll(issue.Path)
+		}
+		if err != nil {
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+			if issue.Repair == "delete" {
+				g.report.FreedBytes += issue.Size
+			}
+		}
+	}
+	g.report.Issues = append(g.report.Issues, issue)
+}
+
+// recent tells whether entry changed within the grace period, counting it as
+// skipped if so.
+func (g *gcRun) recent(entry os.FileInfo) bool {
+	if entry.ModTime().After(g.cutoff) {
+		g.report.SkippedRecent++
+		return true
+	}
+	return false
+}
+
+// busy tells whether id is an upload in progress or being completed.
+func (g *gcRun) busy(id string) bool {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+	_, active := filesMetadata[id]
+	_, stored := g.stored[id]
+	return active && !stored || completingUploads[id]
+}
+
+// referenced tells whether id is a stored or trashed file.
+func (g *gcRun) referenced(id string) bool {
+	_, stored := g.stored[id]
+	return stored || g.trashed[id]
+}
+
+func (g *gcRun) recordStored(id string) bool {
+	_, stored, err := lookupFileInfo(id)
+	return stored || err != nil
+}
+
+// dataMissing tells whether the stored file of a record is gone, from the
+// data directory and from the shards alike.
+func (g *gcRun) dataMissing(metadata FileMetadata) bool {
+	return !fileExists(finalFilePath(metadata)) && !shardsExist(metadata.ID)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
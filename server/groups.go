@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGroupTimeout = time.Hour
+	maxGroupTimeout     = 24 * time.Hour
+	maxGroupSize        = 1000
+	// groupRetention keeps finished groups around so clients can still query
+	// their final state.
+	groupRetention = time.Hour
+
+	groupPending    = "pending"
+	groupCommitted  = "committed"
+	groupRolledBack = "rolled_back"
+)
+
+// UploadGroup is a set of uploads that become visible together. Completed
+// members are staged until the last one arrives; a failed member, an abort or
+// the deadline rolls back every member.
+type UploadGroup struct {
+	ID        string    `json:"id"`
+	FileIDs   []string  `json:"fileIds"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	Staged    int       `json:"staged"`
+
+	staged map[string]FileMetadata
+	timer  *time.Timer
+}
+
+type GroupRegistration struct {
+	Files          []FileMetadata `json:"files"`
+	TimeoutSeconds int            `json:"timeoutSeconds,omitempty"`
+	// Compression "zstd" asks for the owner's compression dictionary.
+	Compression string `json:"compression,omitempty"`
+}
+
+type GroupResponse struct {
+	UploadGroup
+	Files []FileMetadata `json:"files,omitempty"`
+	// CompressionDictionary is the dictionary the members' chunks may be
+	// compressed with, offered at registration.
+	CompressionDictionary *CompressionDictionary `json:"compressionDictionary,omitempty"`
+}
+
+var (
+	uploadGroups = make(map[string]*UploadGroup)
+	groupsMutex  = &sync.Mutex{}
+)
+
+// registerGroupHandler serves POST /register_group.
+func registerGroupHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received group registration request for:", r.URL.Path)
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	var registration GroupRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if len(registration.Files) == 0 || len(registration.Files) > maxGroupSize {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("A group needs between 1 and %d files", maxGroupSize))
+		return
+	}
+	if registration.Compression != "" && registration.Compression != "zstd" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Compression must be zstd")
+		return
+	}
+	timeout := defaultGroupTimeout
+	if registration.TimeoutSeconds > 0 {
+		timeout = time.Duration(registration.TimeoutSeconds) * time.Second
+		if timeout > maxGroupTimeout {
+			timeout = maxGroupTimeout
+		}
+	}
+
+	for _, metadata := range registration.Files {
+		if !validateRegistration(w, metadata) {
+			return
+		}
+	}
+
+	group := &UploadGroup{
+		ID:        generateLocalID(),
+		ExpiresAt: timeNow().Add(timeout),
+		State:     groupPending,
+		staged:    make(map[string]FileMetadata),
+	}
+	owner, _ := requestPrincipal(r)
+	members := make([]FileMetadata, 0, len(registration.Files))
+	for _, metadata := range registration.Files {
+		metadata, err := prepareUpload(metadata, owner)
+		if err != nil {
+			fmt.Println("Error preparing upload:", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error preparing upload")
+			return
+		}
+		metadata.Client = requestClient(r)
+		members = append(members, metadata)
+	}
+
+	groupsMutex.Lock()
+	for uploadGroups[group.ID] != nil {
+		group.ID = generateLocalID()
+	}
+	for i := range members {
+		members[i].GroupID = group.ID
+	}
+	if err := storeUploads(members); err != nil {
+		groupsMutex.Unlock()
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info DB")
+		return
+	}
+	for _, metadata := range members {
+		group.FileIDs = append(group.FileIDs, metadata.ID)
+	}
+	uploadGroups[group.ID] = group
+	for _, metadata := range members {
+		audit(r, AuditEntry{Action: "register", FileID: metadata.ID, FileName: metadata.FileName, GroupID: group.ID, Size: metadata.FileSize, Chunks: metadata.TotalChunks})
+		publishEvent(r, eventUploadStarted, metadata, "")
+	}
+	group.timer = time.AfterFunc(timeout, func() {
+		rollbackGroup(group.ID, "group timed out")
+	})
+	response := groupResponse(group, members)
+	groupsMutex.Unlock()
+
+	if registration.Compression != "" {
+		response.CompressionDictionary = groupDictionary(owner)
+	}
+	writeGroupResponse(w, http.StatusOK, response)
+}
+
+// groupHandler serves GET /groups/{id} (status) and DELETE /groups/{id} (abort).
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received group request for:", r.URL.Path)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid URL")
+		return
+	}
+	groupID := parts[2]
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		audit(r, AuditEntry{Action: "group_abort", GroupID: groupID})
+		rollbackGroup(groupID, "aborted by client")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and DELETE methods are allowed")
+		return
+	}
+
+	groupsMutex.Lock()
+	group, ok := uploadGroups[groupID]
+	var response GroupResponse
+	if ok {
+		response = groupResponse(group, nil)
+	}
+	groupsMutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, codeGroupNotFound, "Group not found")
+		return
+	}
+	writeGroupResponse(w, http.StatusOK, response)
+}
+
+// groupResponse snapshots a group; the caller must hold groupsMutex.
+func groupResponse(group *UploadGroup, members []FileMetadata) GroupResponse {
+	response := GroupResponse{UploadGroup: *group}
+	response.Staged = len(group.staged)
+	for _, metadata := range members {
+		response.Files = append(response.Files, metadata.public())
+	}
+	return response
+}
+
+func writeGroupResponse(w http.ResponseWriter, status int, response GroupResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// groupAccepting reports whether members of the group may still upload.
+func groupAccepting(groupID string) bool {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+	group, ok := uploadGroups[groupID]
+	return ok && group.State == groupPending
+}
+
+// stageGroupMember records an assembled and verified member. When it is the
+// last one, all members are committed to the file info DB in one write.
+func stageGroupMember(w http.ResponseWriter, metadata FileMetadata) {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	group, ok := uploadGroups[metadata.GroupID]
+	if !ok || group.State != groupPending {
+		// The group was rolled back while this member was being assembled.
+		os.Remove(finalFilePath(metadata))
+		writeError(w, http.StatusGone, codeGroupClosed, "Upload group is no longer accepting files")
+		return
+	}
+	group.staged[metadata.ID] = metadata
+	if len(group.staged) < len(group.FileIDs) {
+		writeGroupResponse(w, http.StatusAccepted, groupResponse(group, nil))
+		return
+	}
+
+	members := make([]FileMetadata, 0, len(group.FileIDs))
+	for _, fileID := range group.FileIDs {
+		members = append(members, group.staged[fileID])
+	}
+	if err := updateFileInfoDB(members...); err != nil {
+		fmt.Println("Error committing upload group:", err)
+		group.timer.Stop()
+		rollbackGroupLocked(group, "commit failed: "+err.Error())
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	group.timer.Stop()
+	group.State = groupCommitted
+	for _, metadata := range members {
+		indexStoredFile(metadata)
+		generateThumbnails(metadata)
+		extractMediaInfo(metadata)
+		indexFileText(metadata)
+		postProcess(metadata)
+		queueErasureCoding(metadata)
+		audit(nil, AuditEntry{Action: "complete", FileID: metadata.ID, FileName: metadata.FileName, GroupID: group.ID, Size: metadata.FileSize, Chunks: metadata.TotalChunks, Detail: "committed with its group"})
+		publishEvent(nil, eventUploadCompleted, metadata, "committed with its group")
+	}
+	trainDictionaryLater(members[0].Owner)
+	forgetGroupLater(group.ID)
+	fmt.Println("Committed upload group:", group.ID)
+	writeGroupResponse(w, http.StatusOK, groupResponse(group, members))
+}
+
+func rollbackGroup(groupID, reason string) {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+	group, ok := uploadGroups[groupID]
+	if !ok || group.State != groupPending {
+		return
+	}
+	group.timer.Stop()
+	rollbackGroupLocked(group, reason)
+}
+
+// rollbackGroupLocked removes everything staged for the group's members:
+// assembled files, leftover chunks and in-progress metadata.
+func rollbackGroupLocked(group *UploadGroup, reason string) {
+	fmt.Printf("Rolling back upload group %s: %s\n", group.ID, reason)
+	group.State = groupRolledBack
+	group.Reason = reason
+	audit(nil, AuditEntry{Action: "group_rollback", GroupID: group.ID, Detail: reason})
+	forgetGroupLater(group.ID)
+
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+	for _, fileID := range group.FileIDs {
+		metadata, ok := filesMetadata[fileID]
+		if !ok {
+			continue
+		}
+		if _, staged := group.staged[fileID]; staged {
+			os.Remove(finalFilePath(metadata))
+		}
+		os.RemoveAll(uploadTmpDir(fileID))
+		delete(filesMetadata, fileID)
+		forgetTransfer(fileID)
+		publishEvent(nil, eventUploadFailed, metadata, "group rolled back: "+reason)
+	}
+	group.staged = make(map[string]FileMetadata)
+}
+
+func forgetGroupLater(groupID string) {
+	time.AfterFunc(groupRetention, func() {
+		groupsMutex.Lock()
+		delete(uploadGroups, groupID)
+		groupsMutex.Unlock()
+	})
+}
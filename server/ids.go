@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// generateUniqueID returns a UUIDv7 (RFC 9562): a 48 bit millisecond
+// timestamp followed by 74 random bits. IDs sort roughly by creation time,
+// and two registrations in the same instant still get different IDs.
+func generateUniqueID() string {
+	var uuid [16]byte
+	if _, err := io.ReadFull(idRandom, uuid[6:]); err != nil {
+		panic("reading random bytes: " + err.Error())
+	}
+	var millis [8]byte
+	binary.BigEndian.PutUint64(millis[:], uint64(timeNow().UnixMilli()))
+	copy(uuid[:6], millis[2:])
+	uuid[6] = 0x70 | uuid[6]&0x0f // version 7
+	uuid[8] = 0x80 | uuid[8]&0x3f // RFC 9562 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// storeUploads adds new upload sessions to filesMetadata. An ID that is
+// already used by another upload or a stored file is replaced with a fresh
+// one first, so a collision can never overwrite someone else's metadata or
+// chunks. The IDs are updated in place, and the transfer clock and the
+// deadline of every upload start here. Uploads outside a group are saved so that they survive
+// a restart.
+func storeUploads(metadatas []FileMetadata) error {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+	for i := range metadatas {
+		for {
+			_, inProgress := filesMetadata[metadatas[i].ID]
+			_, stored, err := fileStore.Lookup(metadatas[i].ID)
+			if err != nil {
+				return err
+			}
+			if !inProgress && !stored {
+				break
+			}
+			fmt.Println("File ID collision, generating a new ID for:", metadatas[i].ID)
+			metadatas[i].ID = generateLocalID()
+		}
+		metadatas[i].Deadline = uploadDeadline(metadatas[i].Deadline)
+		if inPlaceAssembly {
+			if err := createInPlaceFile(metadatas[i]); err != nil {
+				return err
+			}
+		}
+		if metadatas[i].GroupID == "" {
+			if err := saveSession(metadatas[i]); err != nil {
+				os.RemoveAll(uploadTmpDir(metadatas[i].ID))
+				return err
+			}
+		}
+		filesMetadata[metadatas[i].ID] = metadatas[i]
+		startTransfer(metadatas[i].ID)
+		scheduleDeadline(metadatas[i])
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inPlaceAssembly makes new uploads write every chunk straight into a file of
+// the final size at offset (n-1)*chunkSize, instead of into a chunk file of
+// its own. Completion then only reads the file once to check it and renames
+// it into place: no chunk files and no concatenation pass. Chunks that have
+// been written are listed in the chunk manifest, the one deferred
+// verification uses, with their hash.
+//
+// The mode of an upload is fixed at registration: it uses in-place assembly
+// if its data file exists.
+var inPlaceAssembly bool
+
+func inPlacePath(fileID string) string {
+	return filepath.Join(uploadTmpDir(fileID), "data")
+}
+
+func usesInPlace(fileID string) bool {
+	_, err := os.Stat(inPlacePath(fileID))
+	return err == nil
+}
+
+// createInPlaceFile creates the data file of a new upload at its stored size
+// with its blocks reserved, so chunks arriving in any order fill it without
+// fragmenting it. The data file of a sparse upload starts as one hole.
+func createInPlaceFile(metadata FileMetadata) error {
+	if err := os.MkdirAll(uploadTmpDir(metadata.ID), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(inPlacePath(metadata.ID))
+	if err != nil {
+		return err
+	}
+	if !metadata.Sparse {
+		preallocate(file, storedFileSize(metadata))
+	}
+	err = file.Truncate(storedFileSize(metadata))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(uploadTmpDir(metadata.ID))
+	}
+	return err
+}
+
+// storedChunkOffset is where chunk chunkNumber starts in the stored layout.
+func storedChunkOffset(metadata FileMetadata, chunkNumber int) int64 {
+	return int64(chunkNumber-1) * (int64(metadata.ChunkSize) + chunkStorageOverhead(metadata))
+}
+
+// saveChunkInPlace verifies a chunk in memory and writes it into the data
+// file of the upload.
+func saveChunkInPlace(w http.ResponseWriter, r *http.Request, metadata FileMetadata, chunkNumber int, chunkHash string) {
+	buffer, ok := readChunkBody(w, r, metadata)
+	if !ok {
+		return
+	}
+	defer putBuffer(buffer)
+	data := *buffer
+	n := len(data)
+
+	// With deferred verification the Chunk-Hash is only recorded, and checked
+	// against the written data at completion.
+	hashes := newTransferHashes(r.Header)
+	if deferChunkVerification {
+		if !validChunkHash(chunkHash) {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Chunk hash must be a hex encoded SHA-256")
+			return
+		}
+	} else {
+		hashes.writer().Write(data)
+		if !verifyChunk(w, r, metadata.ID, chunkNumber, chunkHash, hashes, int64(n), nil) {
+			return
+		}
+	}
+	err := writeChunkInPlace(metadata, chunkNumber, data, chunkHash)
+	if discardIfCancelled(w, metadata.ID) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error writing chunk %d in place: %v\n", chunkNumber, err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+		return
+	}
+	acknowledgeChunk(w, metadata, metadata.ID, chunkNumber, hashes, int64(n))
+}
+
+// writeChunkInPlace stores the plaintext of one chunk at its offset in the
+// data file, sealed for encrypted uploads, and only then records it as
+// received.
+func writeChunkInPlace(metadata FileMetadata, chunkNumber int, plain []byte, chunkHash string) error {
+	stored := plain
+	if metadata.Encrypted {
+		aead, err := chunkAEAD(metadata)
+		if err != nil {
+			return err
+		}
+		if stored, err = sealChunk(aead, metadata.ID, chunkNumber, plain); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(inPlacePath(metadata.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(stored, storedChunkOffset(metadata, chunkNumber))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return recordChunkHash(metadata.ID, chunkNumber, chunkHash)
+}
+
+// assembleInPlace checks an in-place upload and moves its data file to the
+// final path. Every chunk must be recorded as received; each is read back
+// once, authenticated for encrypted uploads and checked against its recorded
+// hash, which yields the SHA-256 and MD5 of the whole file on the way.
+func assembleInPlace(ctx context.Context, metadata FileMetadata) ([]byte, []byte, error) {
+	chunkHashes, err := readChunkManifest(metadata.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		if _, ok := chunkHashes[chunkNumber]; !ok {
+			return nil, nil, fmt.Errorf("chunk %d: %w", chunkNumber, errChunkMissing)
+		}
+	}
+	var aead cipher.AEAD
+	if metadata.Encrypted {
+		if aead, err = chunkAEAD(metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+	file, err := os.Open(inPlacePath(metadata.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	shaHash, md5Hash := newFileHasher(metadata), md5.New()
+	buffer := getBuffer(metadata.ChunkSize + int(chunkStorageOverhead(metadata)))
+	defer putBuffer(buffer)
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		stored := (*buffer)[:expectedChunkSize(metadata, chunkNumber)+chunkStorageOverhead(metadata)]
+		if _, err := io.ReadFull(file, stored); err != nil {
+			return nil, nil, fmt.Errorf("reading chunk %d: %w", chunkNumber, err)
+		}
+		plain := stored
+		if aead != nil {
+			if plain, err = openChunk(aead, metadata.ID, chunkNumber, stored); err != nil {
+				dropInPlaceChunk(metadata.ID, chunkNumber)
+				return nil, nil, fmt.Errorf("decrypting chunk %d: %w", chunkNumber, err)
+			}
+		}
+		if actualHash := fmt.Sprintf("%x", sha256.Sum256(plain)); actualHash != chunkHashes[chunkNumber] {
+			quarantineChunk(nil, QuarantineRecord{FileID: metadata.ID, ChunkNumber: chunkNumber, ExpectedHash: chunkHashes[chunkNumber], ActualHash: actualHash, Size: int64(len(plain)), Reason: "chunk hash mismatch at assembly"}, "")
+			dropInPlaceChunk(metadata.ID, chunkNumber)
+			return nil, nil, fmt.Errorf("chunk %d: %w", chunkNumber, errChunkHashMismatch)
+		}
+		shaHash.Write(plain)
+		md5Hash.Write(plain)
+	}
+	file.Close()
+	if err := os.Rename(inPlacePath(metadata.ID), finalFilePath(metadata)); err != nil {
+		return nil, nil, err
+	}
+	return shaHash.Sum(nil), md5Hash.Sum(nil), nil
+}
+
+// unassembleInPlace moves the final file of an in-place upload back, so a
+// completion that failed after assembly can be retried.
+func unassembleInPlace(metadata FileMetadata) {
+	if err := os.Rename(finalFilePath(metadata), inPlacePath(metadata.ID)); err != nil {
+		fmt.Println("Error restoring upload data:", err)
+	}
+}
+
+// dropInPlaceChunk removes a chunk from the manifest, so that it has to be
+// uploaded again.
+func dropInPlaceChunk(fileID string, chunkNumber int) {
+	data, err := ioutil.ReadFile(chunkManifestPath(fileID))
+	if err != nil {
+		return
+	}
+	prefix := fmt.Sprintf("%d ", chunkNumber)
+	var kept []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line != "" && !strings.HasPrefix(line, prefix) {
+			kept = append(kept, line)
+		}
+	}
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := ioutil.WriteFile(chunkManifestPath(fileID), []byte(content), 0644); err != nil {
+		fmt.Println("Error updating chunk manifest:", err)
+	}
+}
+
+// storePieceInPlace writes the chunks of a PUT piece into the data file of an
+// in-place upload. Chunks already received are not overwritten, and the new
+// ones are only recorded once the whole piece matches its digests, so a
+// rejected piece leaves them missing rather than half written.
+func storePieceInPlace(w http.ResponseWriter, r *http.Request, metadata FileMetadata, first, last int64) bool {
+	var aead cipher.AEAD
+	if metadata.Encrypted {
+		var err error
+		if aead, err = chunkAEAD(metadata); err != nil {
+			fmt.Println("Error loading data key:", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error loading data key")
+			return false
+		}
+	}
+	received, err := readChunkManifest(metadata.ID)
+	if err != nil {
+		fmt.Println("Error reading chunk manifest:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading upload state")
+		return false
+	}
+	file, err := os.OpenFile(inPlacePath(metadata.ID), os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Println("Error opening upload data:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+		return false
+	}
+	defer file.Close()
+
+	hashes := newTransferHashes(r.Header)
+	body := io.TeeReader(r.Body, hashes.writer())
+	buffer := getBuffer(metadata.ChunkSize)
+	defer putBuffer(buffer)
+	written := make(map[int]string)
+	chunkSize := int64(metadata.ChunkSize)
+	for offset := first; offset <= last; offset += chunkSize {
+		size := chunkSize
+		if last+1-offset < size {
+			size = last + 1 - offset
+		}
+		chunkNumber := int(offset/chunkSize) + 1
+		recordChunkAttempt(metadata.ID, chunkNumber)
+		data := (*buffer)[:size]
+		if _, err := io.ReadFull(body, data); err != nil {
+			writeError(w, http.StatusBadRequest, codeChunkTruncated, "Request body is shorter than Content-Range")
+			return false
+		}
+		if _, ok := received[chunkNumber]; ok {
+			continue
+		}
+		stored := data
+		var err error
+		if aead != nil {
+			stored, err = sealChunk(aead, metadata.ID, chunkNumber, data)
+		}
+		if err == nil {
+			_, err = file.WriteAt(stored, storedChunkOffset(metadata, chunkNumber))
+		}
+		if err != nil {
+			fmt.Printf("Error writing chunk %d in place: %v\n", chunkNumber, err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+			return false
+		}
+		written[chunkNumber] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Request body is longer than Content-Range")
+		return false
+	}
+	if err := verifyTransferDigests(r.Header, hashes.sums()); err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestMismatch, err.Error())
+		return false
+	}
+	if err := file.Sync(); err != nil {
+		fmt.Println("Error writing upload data:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+		return false
+	}
+	for chunkNumber, chunkHash := range written {
+		if err := recordChunkHash(metadata.ID, chunkNumber, chunkHash); err != nil {
+			fmt.Printf("Error recording chunk hash: %v\n", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+			return false
+		}
+	}
+	return true
+}
+
+// receivedInPlace counts the chunks of an in-place upload received without a
+// gap from the first.
+func receivedInPlace(fileID string, totalChunks int) int {
+	hashes, err := readChunkManifest(fileID)
+	if err != nil {
+		return 0
+	}
+	chunks := 0
+	for chunks < totalChunks {
+		if _, ok := hashes[chunks+1]; !ok {
+			break
+		}
+		chunks++
+	}
+	return chunks
+}
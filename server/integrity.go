@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// IntegrityStatus is the outcome of the latest check of a stored file, kept
+// in its metadata.
+type IntegrityStatus struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Passed    bool      `json:"passed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// IntegrityReport is the result of re-reading a stored file and hashing it
+// again. A file that cannot be read or decrypted fails with Error set.
+type IntegrityReport struct {
+	FileID         string    `json:"fileId"`
+	FileName       string    `json:"fileName"`
+	HashAlgorithm  string    `json:"hashAlgorithm"`
+	ExpectedHash   string    `json:"expectedHash"`
+	ActualHash     string    `json:"actualHash,omitempty"`
+	ExpectedSize   int64     `json:"expectedSize"`
+	CheckedBytes   int64     `json:"checkedBytes"`
+	Passed         bool      `json:"passed"`
+	Error          string    `json:"error,omitempty"`
+	CheckedAt      time.Time `json:"checkedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+	Throughput     float64   `json:"throughputBytesPerSecond"`
+}
+
+// checkIntegrity streams the stored file through the hash its FileHash was
+// computed with, decrypting it first if it is encrypted, so a check needs no
+// more memory than a download. rate caps the bytes read per second, 0 reads
+// as fast as the disk allows.
+func checkIntegrity(metadata FileMetadata, rate int64) IntegrityReport {
+	report := IntegrityReport{
+		FileID:        metadata.ID,
+		FileName:      metadata.FileName,
+		HashAlgorithm: metadata.HashAlgorithm,
+		ExpectedHash:  metadata.FileHash,
+		ExpectedSize:  metadata.FileSize,
+		CheckedAt:     timeNow().UTC(),
+	}
+	if report.HashAlgorithm == "" {
+		report.HashAlgorithm = hashSHA256
+	}
+	started := timeNow()
+	actualHash, checked, err := hashStoredFile(metadata, rate)
+	report.ActualHash, report.CheckedBytes = actualHash, checked
+	if report.ElapsedSeconds = timeNow().Sub(started).Seconds(); report.ElapsedSeconds > 0 {
+		report.Throughput = float64(checked) / report.ElapsedSeconds
+	}
+	switch {
+	case err != nil:
+		report.Error = err.Error()
+	case checked != metadata.FileSize:
+		report.Error = fmt.Sprintf("Stored file has %d bytes instead of %d", checked, metadata.FileSize)
+	case actualHash != metadata.FileHash:
+		report.Error = "Stored file hash mismatch"
+	default:
+		report.Passed = true
+	}
+	return report
+}
+
+func hashStoredFile(metadata FileMetadata, rate int64) (string, int64, error) {
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error opening stored file: %v", err)
+	}
+	defer file.Close()
+	content, err := storedFileReader(file, metadata)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error opening stored file: %v", err)
+	}
+	hasher := newFileHasher(metadata)
+	checked, err := copyPooled(hasher, throttle(content, rate))
+	if err != nil {
+		return "", checked, fmt.Errorf("Error reading stored file: %v", err)
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), checked, nil
+}
+
+// recordIntegrity saves the outcome of a check in the file's metadata, unless
+// the file was replaced or deleted while it was read. A file found corrupt
+// that was not already known to be is reported like the scrubber does.
+func recordIntegrity(report IntegrityReport) error {
+	var newlyFailed bool
+	_, err := fileStore.Update(report.FileID, func(stored *FileMetadata) (bool, error) {
+		if stored.FileHash != report.ExpectedHash {
+			return false, nil
+		}
+		newlyFailed = !report.Passed && (stored.Integrity == nil || stored.Integrity.Passed)
+		stored.Integrity = &IntegrityStatus{CheckedAt: report.CheckedAt, Passed: report.Passed, Error: report.Error}
+		return false, nil
+	})
+	if newlyFailed {
+		reportCorruption(report)
+	}
+	return err
+}
+
+// fileIntegrityHandler serves GET /files/{id}/integrity, which re-verifies
+// the stored file against its recorded hash for operators checking for bit
+// rot. The answer is 200 whether or not the check passed; only a file that is
+// not stored is an error. The outcome is recorded like a scrub's.
+func fileIntegrityHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+	report := checkIntegrity(metadata, 0)
+	if err := recordIntegrity(report); err != nil {
+		fmt.Println("Error recording integrity check:", err)
+	}
+	writeJSON(w, report)
+}
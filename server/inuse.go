@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Downloads hold a reference on the stored file they stream, and deletions
+// and delta updates are refused with 409 while a file has any, so that a
+// client never gets a file cut short or mixing two versions. A change in
+// turn marks the file while it runs, and downloads starting meanwhile are
+// refused until it is done. References are counted per server; in a cluster
+// the node owning a file serves all of them.
+var (
+	fileReaders      = make(map[string]int)
+	filesChanging    = make(map[string]bool)
+	fileReadersMutex = &sync.Mutex{}
+)
+
+var (
+	errFileChanging = errors.New("stored file is being changed")
+	errFileInUse    = errors.New("stored file is in use")
+)
+
+// InUseDetails are the details of FILE_IN_USE errors.
+type InUseDetails struct {
+	ActiveDownloads int `json:"activeDownloads"`
+}
+
+// openDownload opens a stored file for a download and holds a reference on
+// it until the file is closed.
+func openDownload(metadata FileMetadata) (storedFile, error) {
+	fileReadersMutex.Lock()
+	if filesChanging[metadata.ID] {
+		fileReadersMutex.Unlock()
+		return nil, errFileChanging
+	}
+	fileReaders[metadata.ID]++
+	fileReadersMutex.Unlock()
+
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		releaseReader(metadata.ID)
+		return nil, err
+	}
+	return &downloadedFile{storedFile: file, fileID: metadata.ID}, nil
+}
+
+func releaseReader(fileID string) {
+	fileReadersMutex.Lock()
+	if fileReaders[fileID]--; fileReaders[fileID] <= 0 {
+		delete(fileReaders, fileID)
+	}
+	fileReadersMutex.Unlock()
+}
+
+// downloadedFile drops its reference when it is closed.
+type downloadedFile struct {
+	storedFile
+	fileID string
+	once   sync.Once
+}
+
+func (d *downloadedFile) Close() error {
+	d.once.Do(func() { releaseReader(d.fileID) })
+	return d.storedFile.Close()
+}
+
+// beginChange marks a file as being changed, unless downloads are streaming
+// it; readers is their number then. force marks it regardless. The returned
+// function ends the change.
+func beginChange(fileID string, force bool) (end func(), readers int) {
+	fileReadersMutex.Lock()
+	defer fileReadersMutex.Unlock()
+	if readers = fileReaders[fileID]; (readers > 0 && !force) || filesChanging[fileID] {
+		return nil, readers
+	}
+	filesChanging[fileID] = true
+	return func() {
+		fileReadersMutex.Lock()
+		delete(filesChanging, fileID)
+		fileReadersMutex.Unlock()
+	}, readers
+}
+
+// writeInUse answers a change refused by beginChange.
+func writeInUse(w http.ResponseWriter, readers int) {
+	if readers == 0 {
+		writeError(w, http.StatusConflict, codeFileInUse, "File is being changed by another request")
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	writeErrorDetails(w, http.StatusConflict, codeFileInUse,
+		fmt.Sprintf("File is being downloaded by %d client(s)", readers), InUseDetails{ActiveDownloads: readers})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// allowedNetworks, when not empty, is the only set of client networks
+	// served; deniedNetworks are refused even if they are also allowed.
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+	// trustedProxies may set X-Forwarded-For; for anyone else the header is
+	// ignored, so clients cannot spoof their address.
+	trustedProxies []*net.IPNet
+)
+
+// parseNetworks parses a comma separated list of CIDRs; a bare address is
+// taken as a single host.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind a request. When the
+// direct peer is a trusted proxy, X-Forwarded-For is walked from the right,
+// skipping further trusted proxies, to the first address they vouch for.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inNetworks(ip, trustedProxies) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNetworks(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// withIPFilter refuses requests from networks that are denied or, with an
+// allow list, not allowed.
+func withIPFilter(next http.Handler) http.Handler {
+	if len(allowedNetworks) == 0 && len(deniedNetworks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip == nil || inNetworks(ip, deniedNetworks) || (len(allowedNetworks) > 0 && !inNetworks(ip, allowedNetworks)) {
+			fmt.Printf("Refusing request from %s for %s\n", ip, r.URL.Path)
+			writeError(w, http.StatusForbidden, codeAccessDenied, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
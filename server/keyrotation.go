@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyStatus answers GET /admin/keys: the master keys, how many files of this
+// node each one still protects, and the latest rotation.
+type KeyStatus struct {
+	Enabled      bool              `json:"enabled"`
+	CurrentKeyID string            `json:"currentKeyId"`
+	Keys         []MasterKeyUsage  `json:"keys"`
+	Rotation     KeyRotationStatus `json:"rotation"`
+}
+
+// MasterKeyUsage counts the stored and trashed files whose data key a
+// master key wraps. The empty ID counts keys wrapped before key IDs were
+// given, by whichever key unwraps them. Unknown is set for key IDs missing
+// from the key file, whose files cannot be read.
+type MasterKeyUsage struct {
+	ID           string `json:"id"`
+	Current      bool   `json:"current,omitempty"`
+	Unknown      bool   `json:"unknown,omitempty"`
+	Files        int    `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	TrashedFiles int    `json:"trashedFiles"`
+}
+
+// KeyRotationStatus reports the progress of a rotation, which re-encrypts
+// the stored files of this node not under the current key. Busy counts the
+// files skipped because they were being downloaded or changed; another
+// rotation picks them up.
+type KeyRotationStatus struct {
+	Running       bool       `json:"running"`
+	KeyID         string     `json:"keyId"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	CurrentFileID string     `json:"currentFileId,omitempty"`
+	Total         int        `json:"total"`
+	Rotated       int        `json:"rotated"`
+	Busy          int        `json:"busy"`
+	Failed        int        `json:"failed"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+var (
+	keyRotation      KeyRotationStatus
+	keyRotationMutex = &sync.Mutex{}
+)
+
+// errRotationBusy skips a file being downloaded, changed or deleted.
+var errRotationBusy = errors.New("file is in use")
+
+// keysHandler serves GET /admin/keys and POST /admin/keys/rotate, which
+// starts a rotation in the background and answers 202 with its status.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/admin/keys") {
+	case "", "/":
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+			return
+		}
+		status, err := keyStatus()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+			return
+		}
+		writeJSON(w, status)
+	case "/rotate":
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+			return
+		}
+		if !encryptionEnabled() {
+			writeError(w, http.StatusConflict, codeConflict, "At-rest encryption is not enabled")
+			return
+		}
+		status, started := startKeyRotation()
+		if !started {
+			writeError(w, http.StatusConflict, codeConflict, "A key rotation is already running")
+			return
+		}
+		audit(r, AuditEntry{Action: "key_rotation", Detail: "to key " + status.KeyID})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+	}
+}
+
+func keyStatus() (KeyStatus, error) {
+	keyRotationMutex.Lock()
+	status := KeyStatus{Enabled: encryptionEnabled(), CurrentKeyID: currentKeyID, Rotation: keyRotation}
+	keyRotationMutex.Unlock()
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		return status, err
+	}
+	trashed, err := readTrash()
+	if err != nil {
+		return status, err
+	}
+	usage := make(map[string]*MasterKeyUsage)
+	count := func(keyID string) *MasterKeyUsage {
+		if usage[keyID] == nil {
+			_, known := masterKeys[keyID]
+			usage[keyID] = &MasterKeyUsage{ID: keyID, Current: known && keyID == currentKeyID, Unknown: !known && keyID != ""}
+		}
+		return usage[keyID]
+	}
+	for keyID := range masterKeys {
+		count(keyID)
+	}
+	for _, metadata := range fileInfos {
+		if metadata.Encrypted && ownedLocally(metadata.ID) {
+			key := count(wrappingKeyID(metadata.WrappedKey))
+			key.Files++
+			key.Bytes += metadata.FileSize
+		}
+	}
+	for _, file := range trashed {
+		if file.Encrypted {
+			count(wrappingKeyID(file.WrappedKey)).TrashedFiles++
+		}
+	}
+	status.Keys = make([]MasterKeyUsage, 0, len(usage))
+	for _, key := range usage {
+		status.Keys = append(status.Keys, *key)
+	}
+	sort.Slice(status.Keys, func(i, j int) bool { return status.Keys[i].ID < status.Keys[j].ID })
+	return status, nil
+}
+
+// startKeyRotation starts rotating to the current key unless a rotation is
+// running.
+func startKeyRotation() (KeyRotationStatus, bool) {
+	keyRotationMutex.Lock()
+	defer keyRotationMutex.Unlock()
+	if keyRotation.Running {
+		return keyRotation, false
+	}
+	started := timeNow()
+	keyRotation = KeyRotationStatus{Running: true, KeyID: currentKeyID, StartedAt: &started}
+	go rotateKeys()
+	return keyRotation, true
+}
+
+// rotateKeys re-encrypts, one at a time, the encrypted files of this node
+// whose data key is not wrapped by the current master key.
+func rotateKeys() {
+	defer func() {
+		keyRotationMutex.Lock()
+		finished := timeNow()
+		keyRotation.Running, keyRotation.CurrentFileID, keyRotation.FinishedAt = false, "", &finished
+		status := keyRotation
+		keyRotationMutex.Unlock()
+		fmt.Printf("Key rotation finished: %d rotated, %d busy, %d failed\n", status.Rotated, status.Busy, status.Failed)
+	}()
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		fmt.Println("Error listing files to rotate:", err)
+		keyRotationMutex.Lock()
+		keyRotation.LastError = err.Error()
+		keyRotationMutex.Unlock()
+		return
+	}
+	var pending []FileMetadata
+	for _, metadata := range fileInfos {
+		if metadata.Encrypted && ownedLocally(metadata.ID) && wrappingKeyID(metadata.WrappedKey) != currentKeyID {
+			pending = append(pending, metadata)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	keyRotationMutex.Lock()
+	keyRotation.Total = len(pending)
+	keyRotationMutex.Unlock()
+
+	for _, metadata := range pending {
+		keyRotationMutex.Lock()
+		keyRotation.CurrentFileID = metadata.ID
+		keyRotationMutex.Unlock()
+		err := rotateFileKey(metadata)
+		keyRotationMutex.Lock()
+		switch {
+		case err == errRotationBusy:
+			keyRotation.Busy++
+		case err != nil:
+			fmt.Printf("Error rotating the key of %s: %v\n", metadata.ID, err)
+			keyRotation.Failed++
+			keyRotation.LastError = fmt.Sprintf("%s: %v", metadata.ID, err)
+		default:
+			keyRotation.Rotated++
+		}
+		keyRotationMutex.Unlock()
+	}
+}
+
+// rotateFileKey seals a stored file again under a new data key wrapped by
+// the current master key. Like a delta update, the new version is staged
+// next to the stored file and only replaces it once no download is
+// streaming it; the previous one is kept until the metadata names the new
+// key. Files changed in the meantime are left for the next rotation.
+func rotateFileKey(metadata FileMetadata) error {
+	rotated := metadata
+	var err error
+	if rotated.WrappedKey, err = newWrappedDataKey(); err != nil {
+		return fmt.Errorf("generating data key: %v", err)
+	}
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return err
+	}
+	stagedPath := finalFilePath(rotated) + ".rotate"
+	defer os.Remove(stagedPath)
+	_, err = writeStoredFile(stagedPath, rotated, content, metadata.FileHash)
+	closeFile()
+	if err != nil {
+		return err
+	}
+
+	endChange, _ := beginChange(metadata.ID, false)
+	if endChange == nil {
+		return errRotationBusy
+	}
+	defer endChange()
+	previousPath := finalFilePath(metadata) + ".prev"
+	replaced, kept := false, false
+	found, err := fileStore.Update(metadata.ID, func(stored *FileMetadata) (bool, error) {
+		if stored.WrappedKey != metadata.WrappedKey || stored.FileHash != metadata.FileHash || finalFilePath(*stored) != finalFilePath(metadata) {
+			return false, errRotationBusy
+		}
+		// Erasure coded files have no copy in the data directory to keep.
+		if err := os.Rename(finalFilePath(metadata), previousPath); err == nil {
+			kept = true
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := os.Rename(stagedPath, finalFilePath(metadata)); err != nil {
+			return false, err
+		}
+		replaced = true
+		stored.WrappedKey = rotated.WrappedKey
+		return false, nil
+	})
+	if err != nil {
+		if replaced {
+			os.Remove(finalFilePath(metadata))
+		}
+		if kept {
+			os.Rename(previousPath, finalFilePath(metadata))
+		}
+		return err
+	}
+	if !found {
+		return errRotationBusy
+	}
+	os.Remove(previousPath)
+	// The shards of an erasure coded file are still sealed with the old key;
+	// encoding the file again replaces them.
+	queueErasureCoding(rotated)
+	audit(nil, AuditEntry{Action: "key_rotated", FileID: metadata.ID, FileName: metadata.FileName, Size: metadata.FileSize,
+		Detail: fmt.Sprintf("key %q to %q", wrappingKeyID(metadata.WrappedKey), currentKeyID)})
+	return nil
+}
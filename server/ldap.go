@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is the part of LDAPv3 (RFC 4511) that logging in needs: a simple bind
+// as the user and a search for the user's own entry. Messages are BER
+// encoded; only definite lengths occur in LDAP.
+
+const (
+	ldapTimeout = 10 * time.Second
+
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest        = 0x60
+	ldapBindResponse       = 0x61
+	ldapSearchRequest      = 0x63
+	ldapSearchResultEntry  = 0x64
+	ldapSearchResultDone   = 0x65
+	ldapSearchResultRef    = 0x73
+	ldapSimpleAuth         = 0x80
+	ldapFilterAnd          = 0xa0
+	ldapFilterOr           = 0xa1
+	ldapFilterEquality     = 0xa3
+	ldapFilterPresent      = 0x87
+	ldapScopeWholeSubtree  = 2
+	ldapNeverDerefAliases  = 0
+	ldapResultSuccess      = 0
+	ldapResultInvalidCreds = 49
+)
+
+// berValue is a decoded BER element; constructed elements have children.
+type berValue struct {
+	tag      byte
+	data     []byte
+	children []berValue
+}
+
+func berEncode(tag byte, data []byte) []byte {
+	out := []byte{tag}
+	switch n := len(data); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, data...)
+}
+
+func berConstructed(tag byte, children ...[]byte) []byte {
+	var data []byte
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	return berEncode(tag, data)
+}
+
+func berInt(tag byte, value int) []byte {
+	// Values here are small and non-negative.
+	data := []byte{byte(value)}
+	for value > 0x7f {
+		value >>= 8
+		data = append([]byte{byte(value)}, data...)
+	}
+	if data[0]&0x80 != 0 {
+		data = append([]byte{0}, data...)
+	}
+	return berEncode(tag, data)
+}
+
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+// berRead reads one element, decoding constructed ones recursively.
+func berRead(r *bufio.Reader) (berValue, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return berValue{}, errors.New("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berValue{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 16<<20 {
+		return berValue{}, errors.New("LDAP message too large")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return berValue{}, err
+	}
+	return berParse(tag, data)
+}
+
+func berParse(tag byte, data []byte) (berValue, error) {
+	value := berValue{tag: tag, data: data}
+	if tag&0x20 == 0 {
+		return value, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		child, err := berRead(r)
+		if err == io.EOF {
+			return value, nil
+		}
+		if err != nil {
+			return value, err
+		}
+		value.children = append(value.children, child)
+	}
+}
+
+func (v berValue) int() int {
+	n := 0
+	for _, b := range v.data {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// ldapConn is a connection to an LDAP server, used for one login.
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL.
+func dialLDAP(rawURL string) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) Close() error {
+	return c.conn.Close()
+}
+
+// send writes a request and returns its message ID.
+func (c *ldapConn) send(operation []byte) (int, error) {
+	c.messageID++
+	_, err := c.conn.Write(berConstructed(berSequence, berInt(berInteger, c.messageID), operation))
+	return c.messageID, err
+}
+
+// receive reads the next message for messageID and returns its operation.
+func (c *ldapConn) receive(messageID int) (berValue, error) {
+	for {
+		message, err := berRead(c.reader)
+		if err != nil {
+			return berValue{}, err
+		}
+		if len(message.children) < 2 {
+			return berValue{}, errors.New("malformed LDAP message")
+		}
+		if message.children[0].int() == messageID {
+			return message.children[1], nil
+		}
+	}
+}
+
+// ldapError is a result code other than success.
+type ldapError struct {
+	code    int
+	message string
+}
+
+func (e ldapError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("LDAP result %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("LDAP result %d", e.code)
+}
+
+// ldapResult checks an LDAPResult: resultCode, matchedDN, diagnosticMessage.
+func ldapResult(operation berValue) error {
+	if len(operation.children) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	if code := operation.children[0].int(); code != ldapResultSuccess {
+		return ldapError{code: code, message: string(operation.children[2].data)}
+	}
+	return nil
+}
+
+// bind authenticates as dn with password. Servers treat a bind with an empty
+// password as anonymous, so that is refused here.
+func (c *ldapConn) bind(dn, password string) error {
+	if password == "" {
+		return ldapError{code: ldapResultInvalidCreds}
+	}
+	messageID, err := c.send(berConstructed(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if response.tag != ldapBindResponse {
+		return errors.New("unexpected response to bind")
+	}
+	return ldapResult(response)
+}
+
+// ldapEntry is a search result: a DN and its attribute values.
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// search returns the entries under baseDN matching filter, with the given
+// attributes, following no referrals.
+func (c *ldapConn) search(baseDN, filter string, attributes []string) ([]ldapEntry, error) {
+	encodedFilter, rest, err := parseLDAPFilter(filter)
+	if err != nil || rest != "" {
+		return nil, fmt.Errorf("invalid LDAP filter %q", filter)
+	}
+	var attributeList [][]byte
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, berString(berOctetString, attribute))
+	}
+	messageID, err := c.send(berConstructed(ldapSearchRequest,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, ldapScopeWholeSubtree),
+		berInt(berEnumerated, ldapNeverDerefAliases),
+		berInt(berInteger, 2), // size limit
+		berInt(berInteger, int(ldapTimeout/time.Second)),
+		berEncode(berBoolean, []byte{0}),
+		encodedFilter,
+		berConstructed(berSequence, attributeList...)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		response, err := c.receive(messageID)
+		if err != nil {
+			return nil, err
+		}
+		switch response.tag {
+		case ldapSearchResultEntry:
+			if len(response.children) < 2 {
+				return nil, errors.New("malformed search result")
+			}
+			entry := ldapEntry{DN: string(response.children[0].data), Attributes: make(map[string][]string)}
+			for _, attribute := range response.children[1].children {
+				if len(attribute.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(string(attribute.children[0].data))
+				for _, value := range attribute.children[1].children {
+					entry.Attributes[name] = append(entry.Attributes[name], string(value.data))
+				}
+			}
+			entries = append(entries, entry)
+		case ldapSearchResultRef:
+		case ldapSearchResultDone:
+			return entries, ldapResult(response)
+		default:
+			return nil, errors.New("unexpected response to search")
+		}
+	}
+}
+
+// parseLDAPFilter encodes the filters login uses: (attr=value), (attr=*),
+// and & and | of those. It returns what follows the filter.
+func parseLDAPFilter(filter string) ([]byte, string, error) {
+	if !strings.HasPrefix(filter, "(") {
+		return nil, "", errors.New("expected (")
+	}
+	filter = filter[1:]
+	if strings.HasPrefix(filter, "&") || strings.HasPrefix(filter, "|") {
+		tag := byte(ldapFilterAnd)
+		if filter[0] == '|' {
+			tag = ldapFilterOr
+		}
+		filter = filter[1:]
+		var children [][]byte
+		for strings.HasPrefix(filter, "(") {
+			child, rest, err := parseLDAPFilter(filter)
+			if err != nil {
+				return nil, "", err
+			}
+			children, filter = append(children, child), rest
+		}
+		if len(children) == 0 || !strings.HasPrefix(filter, ")") {
+			return nil, "", errors.New("expected )")
+		}
+		return berConstructed(tag, children...), filter[1:], nil
+	}
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", errors.New("expected )")
+	}
+	attribute, value, ok := strings.Cut(filter[:end], "=")
+	if !ok || attribute == "" {
+		return nil, "", errors.New("expected attr=value")
+	}
+	if value == "*" {
+		return berString(ldapFilterPresent, attribute), filter[end+1:], nil
+	}
+	value, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstructed(ldapFilterEquality, berString(berOctetString, attribute), berString(berOctetString, value)), filter[end+1:], nil
+}
+
+// escapeLDAPDNValue escapes a value for an attribute value of a DN as RFC
+// 4514 requires, so that it cannot add or change RDNs.
+func escapeLDAPDNValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeLDAPFilterValue escapes a value for an assertion value of a search
+// filter as RFC 4515 requires, so that it cannot add wildcards or filters.
+func escapeLDAPFilterValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeLDAPFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+3 > len(value) {
+				return "", errors.New("invalid escape")
+			}
+			c, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.New("invalid escape")
+			}
+			b.WriteByte(byte(c))
+			i += 2
+		case '*', '(':
+			return "", errors.New("substring filters are not supported")
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const minChunkSize = 100 * 1024
+
+var (
+	// maxFileSize is the largest file accepted at registration, 0 means no limit.
+	maxFileSize int64
+	// maxChunkSize bounds both the chunk size handed out at registration and
+	// the size of a single chunk request body.
+	maxChunkSize = 4 * 1024 * 1024
+)
+
+// storageRetryAfter is suggested to clients turned away for lack of disk space.
+const storageRetryAfter = 5 * time.Minute
+
+// LimitHints are the details of 413 and 507 error responses. They tell the
+// client what the server would have accepted so it can adjust the request or
+// tell the user exactly what went wrong. Error becomes the message.
+type LimitHints struct {
+	Error              string `json:"-"`
+	MaxFileSize        int64  `json:"maxFileSize,omitempty"`
+	MaxChunkSize       int    `json:"maxChunkSize,omitempty"`
+	SuggestedChunkSize int    `json:"suggestedChunkSize,omitempty"`
+	MaxBodySize        int64  `json:"maxBodySize,omitempty"`
+	RequiredBytes      int64  `json:"requiredBytes,omitempty"`
+	AvailableBytes     int64  `json:"availableBytes,omitempty"`
+	RetryAfter         int    `json:"retryAfter,omitempty"`
+}
+
+func writeLimitError(w http.ResponseWriter, status int, code string, hints LimitHints) {
+	fmt.Println("Rejecting request:", hints.Error)
+	if hints.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(hints.RetryAfter))
+	}
+	writeErrorDetails(w, status, code, hints.Error, hints)
+}
+
+// checkRegistrationLimits rejects registrations the server cannot accept and
+// reports whether the request may proceed.
+func checkRegistrationLimits(w http.ResponseWriter, metadata FileMetadata) bool {
+	if status, code, hints := registrationLimit(metadata); status != 0 {
+		writeLimitError(w, status, code, hints)
+		return false
+	}
+	return true
+}
+
+// registrationLimit returns the status, code and hints of the limit a file
+// of metadata exceeds, or a status of 0 when it can be stored.
+func registrationLimit(metadata FileMetadata) (int, string, LimitHints) {
+	if maxFileSize > 0 && metadata.FileSize > maxFileSize {
+		return http.StatusRequestEntityTooLarge, codeFileTooLarge, LimitHints{
+			Error:       fmt.Sprintf("file size %d exceeds the maximum of %d bytes", metadata.FileSize, maxFileSize),
+			MaxFileSize: maxFileSize,
+		}
+	}
+	if metadata.ChunkSize > maxChunkSize {
+		return http.StatusRequestEntityTooLarge, codeChunkTooLarge, LimitHints{
+			Error:              fmt.Sprintf("chunk size %d exceeds the maximum of %d bytes", metadata.ChunkSize, maxChunkSize),
+			MaxChunkSize:       maxChunkSize,
+			SuggestedChunkSize: maxChunkSize,
+		}
+	}
+
+	// The upload must leave minFreeSpace free; expired data is evicted to
+	// make room before turning it away.
+	required := metadata.FileSize + minFreeSpace
+	available, err := availableDiskSpace(dataDir)
+	if err == nil && required > available {
+		available, err = relieveDiskPressure(required)
+	}
+	if err != nil {
+		// Not every platform can report free space; don't block uploads on it.
+		return 0, "", LimitHints{}
+	}
+	if required > available {
+		message := fmt.Sprintf("not enough storage for %d bytes", metadata.FileSize)
+		if minFreeSpace > 0 {
+			message += fmt.Sprintf(" while keeping %d bytes free", minFreeSpace)
+		}
+		return http.StatusInsufficientStorage, codeQuotaExceeded, LimitHints{
+			Error:          message,
+			RequiredBytes:  required,
+			AvailableBytes: available,
+			RetryAfter:     int(storageRetryAfter.Seconds()),
+		}
+	}
+	return 0, "", LimitHints{}
+}
+
+// chunkTooLarge answers a chunk request whose body exceeds the registered
+// chunk size.
+func chunkTooLarge(w http.ResponseWriter, chunkSize int) {
+	writeLimitError(w, http.StatusRequestEntityTooLarge, codeChunkTooLarge, LimitHints{
+		Error:              fmt.Sprintf("chunk is larger than the chunk size of %d bytes", chunkSize),
+		MaxChunkSize:       chunkSize,
+		SuggestedChunkSize: chunkSize,
+	})
+}
+
+// expectedChunkSize is the plaintext size of chunk chunkNumber; only the
+// last chunk may be short.
+func expectedChunkSize(metadata FileMetadata, chunkNumber int) int64 {
+	size := metadata.FileSize - int64(chunkNumber-1)*int64(metadata.ChunkSize)
+	if size > int64(metadata.ChunkSize) {
+		size = int64(metadata.ChunkSize)
+	}
+	return size
+}
+
+// checkChunkLength requires a chunk number of the registered upload and a
+// Content-Length of exactly the size of the chunk, so truncated and oversized
+// bodies are refused before anything is read.
+func checkChunkLength(w http.ResponseWriter, r *http.Request, metadata FileMetadata, chunkNumber int) bool {
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, codeLengthRequired, "Content-Length is required for chunk uploads")
+		return false
+	}
+	if chunkNumber < 1 || chunkNumber > metadata.TotalChunks {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Chunk number must be between 1 and %d", metadata.TotalChunks))
+		return false
+	}
+	if r.ContentLength > int64(metadata.ChunkSize) {
+		chunkTooLarge(w, metadata.ChunkSize)
+		return false
+	}
+	if expected := expectedChunkSize(metadata, chunkNumber); r.ContentLength != expected {
+		writeError(w, http.StatusBadRequest, codeChunkSizeMismatch, fmt.Sprintf("Chunk %d must be %d bytes, Content-Length is %d", chunkNumber, expected, r.ContentLength))
+		return false
+	}
+	return true
+}
+
+// checkChunkBody rejects a chunk whose body ended before its Content-Length.
+func checkChunkBody(w http.ResponseWriter, r *http.Request, received int64) bool {
+	if received != r.ContentLength {
+		writeError(w, http.StatusBadRequest, codeChunkTruncated, fmt.Sprintf("Chunk body is truncated: received %d of %d bytes", received, r.ContentLength))
+		return false
+	}
+	return true
+}
+
+// checkAssemblySpace makes sure the final file can be written before assembly
+// starts. Chunks are removed as they are copied, so beyond the chunks already
+// on disk assembly needs room for about one more chunk.
+func checkAssemblySpace(w http.ResponseWriter, metadata FileMetadata) bool {
+	available, err := availableDiskSpace(dataDir)
+	if err != nil {
+		return true
+	}
+	required := int64(metadata.ChunkSize) + chunkStorageOverhead(metadata)
+	if available >= required {
+		return true
+	}
+	writeLimitError(w, http.StatusInsufficientStorage, codeQuotaExceeded, LimitHints{
+		Error:          fmt.Sprintf("not enough storage to assemble %s", metadata.ID),
+		RequiredBytes:  required,
+		AvailableBytes: available,
+		RetryAfter:     int(storageRetryAfter.Seconds()),
+	})
+	return false
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadLink lets anyone holding its signed URL download one stored file
+// until it expires, is revoked or has served MaxDownloads GET requests.
+type DownloadLink struct {
+	ID           string    `json:"id"`
+	FileID       string    `json:"fileId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	URL          string    `json:"url,omitempty"`
+}
+
+// LinkRequest is the body of POST /admin/links.
+type LinkRequest struct {
+	FileID           string `json:"fileId"`
+	ExpiresInSeconds int64  `json:"expiresInSeconds,omitempty"`
+	MaxDownloads     int    `json:"maxDownloads,omitempty"`
+}
+
+const (
+	linksDB            = "links.json"
+	linkKeyFile        = "link.key"
+	defaultLinkExpiry  = 24 * time.Hour
+	maxLinkExpiry      = 30 * 24 * time.Hour
+	linkKeySize        = 32
+	linkSignatureParam = "signature"
+)
+
+var (
+	// linkKey signs download links. It is kept in the data directory so
+	// links survive restarts; deleting the file invalidates all of them.
+	linkKey    []byte
+	linksMutex = &sync.Mutex{}
+)
+
+func loadLinkKey() error {
+	keyPath := filepath.Join(dataDir, linkKeyFile)
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != linkKeySize {
+			return fmt.Errorf("%s must hold %d hex encoded bytes", keyPath, linkKeySize)
+		}
+		linkKey = key
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	key := make([]byte, linkKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return err
+	}
+	linkKey = key
+	return nil
+}
+
+func linkSignature(link DownloadLink) string {
+	mac := hmac.New(sha256.New, linkKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d", link.ID, link.FileID, link.ExpiresAt.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedLinkURL(link DownloadLink) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(link.ExpiresAt.Unix(), 10))
+	query.Set(linkSignatureParam, linkSignature(link))
+	return "/shared/" + link.ID + "?" + query.Encode()
+}
+
+// readLinksDB and writeLinksDB must be called with linksMutex held.
+func readLinksDB() (map[string]DownloadLink, error) {
+	links := make(map[string]DownloadLink)
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, linksDB))
+	if os.IsNotExist(err) {
+		return links, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// writeLinksDB drops expired links before saving the rest.
+func writeLinksDB(links map[string]DownloadLink) error {
+	now := timeNow()
+	for id, link := range links {
+		if now.After(link.ExpiresAt) {
+			delete(links, id)
+		}
+	}
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dataDir, linksDB), data, 0600)
+}
+
+// linksHandler serves the /admin/links endpoints:
+//
+//	POST   /admin/links       mint a link for a stored file (LinkRequest)
+//	GET    /admin/links       all active links (?fileId= filters)
+//	DELETE /admin/links/{id}  revoke a link
+func linksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && r.Method == "POST":
+		createLink(w, r)
+	case len(parts) == 2 && r.Method == "GET":
+		linksMutex.Lock()
+		links, err := readLinksDB()
+		linksMutex.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading links: "+err.Error())
+			return
+		}
+		active := []DownloadLink{}
+		fileID := r.URL.Query().Get("fileId")
+		for _, link := range links {
+			if timeNow().Before(link.ExpiresAt) && (fileID == "" || link.FileID == fileID) {
+				link.URL = signedLinkURL(link)
+				active = append(active, link)
+			}
+		}
+		sort.Slice(active, func(i, j int) bool { return active[i].CreatedAt.Before(active[j].CreatedAt) })
+		writeJSON(w, active)
+	case len(parts) == 3 && r.Method == "DELETE":
+		revokeLink(w, r, parts[2])
+	case len(parts) <= 3:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, POST and DELETE methods are allowed")
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+	}
+}
+
+func createLink(w http.ResponseWriter, r *http.Request) {
+	var request LinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid link request: "+err.Error())
+		return
+	}
+	expiry := defaultLinkExpiry
+	if request.ExpiresInSeconds != 0 {
+		expiry = time.Duration(request.ExpiresInSeconds) * time.Second
+	}
+	if request.ExpiresInSeconds < 0 || expiry > maxLinkExpiry {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("expiresInSeconds must be between 1 and %d", int64(maxLinkExpiry/time.Second)))
+		return
+	}
+	if request.MaxDownloads < 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "maxDownloads must not be negative")
+		return
+	}
+	metadata, ok, err := lookupFileInfo(request.FileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+
+	now := timeNow().UTC()
+	link := DownloadLink{
+		ID:           generateLocalID(),
+		FileID:       metadata.ID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(expiry).Truncate(time.Second),
+		MaxDownloads: request.MaxDownloads,
+	}
+	linksMutex.Lock()
+	links, err := readLinksDB()
+	if err == nil {
+		links[link.ID] = link
+		err = writeLinksDB(links)
+	}
+	linksMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error saving link: "+err.Error())
+		return
+	}
+	audit(r, AuditEntry{Action: "link_create", FileID: metadata.ID, FileName: metadata.FileName, Detail: "link " + link.ID})
+
+	link.URL = signedLinkURL(link)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+func revokeLink(w http.ResponseWriter, r *http.Request, linkID string) {
+	linksMutex.Lock()
+	links, err := readLinksDB()
+	link, ok := links[linkID]
+	if err == nil && ok {
+		delete(links, linkID)
+		err = writeLinksDB(links)
+	}
+	linksMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error saving links: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeLinkNotFound, "Link not found")
+		return
+	}
+	audit(r, AuditEntry{Action: "link_revoke", FileID: link.FileID, Detail: "link " + linkID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedHandler serves GET and HEAD /shared/{id}?expires=&signature= without
+// credentials. Every GET, ranged or not, counts towards MaxDownloads.
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received shared download request for:", r.URL.Path)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and HEAD methods are allowed")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 || parts[2] == "" {
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+		return
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Invalid link")
+		return
+	}
+	if timeNow().After(time.Unix(expires, 0)) {
+		writeError(w, http.StatusGone, codeLinkExpired, "Link has expired")
+		return
+	}
+
+	linksMutex.Lock()
+	links, err := readLinksDB()
+	if err != nil {
+		linksMutex.Unlock()
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading links: "+err.Error())
+		return
+	}
+	// The signature is checked before the link is looked up, so responses
+	// never tell whether a guessed ID exists.
+	signed := DownloadLink{ID: parts[2], ExpiresAt: time.Unix(expires, 0)}
+	link, ok := links[parts[2]]
+	signed.FileID = link.FileID
+	if !hmac.Equal([]byte(linkSignature(signed)), []byte(query.Get(linkSignatureParam))) || !ok || link.ExpiresAt.Unix() != expires {
+		linksMutex.Unlock()
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Invalid or revoked link")
+		return
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		linksMutex.Unlock()
+		writeError(w, http.StatusGone, codeLinkExpired, "Link has reached its download limit")
+		return
+	}
+	if r.Method == "GET" {
+		link.Downloads++
+		links[link.ID] = link
+		err = writeLinksDB(links)
+	}
+	linksMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error saving links: "+err.Error())
+		return
+	}
+
+	metadata, ok, err := lookupFileInfo(link.FileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !ownedLocally(metadata.ID) {
+		// The link lives on the node that minted it, the file on its owner.
+		r.URL.Path, r.URL.RawQuery = "/download/"+metadata.ID, ""
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		forwardToOwner(w, r, metadata.ID)
+		return
+	}
+	serveStoredFile(w, r, metadata)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "fileupload_session"
+
+var (
+	// ldapURL enables POST /login; the ldap* settings come from -ldap-*.
+	ldapURL            string
+	ldapUserDN         string
+	ldapBaseDN         string
+	ldapUserFilter     = "(uid=%s)"
+	ldapGroupAttribute = "memberOf"
+	// ldapGroupRoles maps lower case group DNs to roles.
+	ldapGroupRoles  = make(map[string]string)
+	sessionLifetime = 12 * time.Hour
+
+	// loggedOut holds the sessions ended by POST /logout and DELETE
+	// /v2/session until they would have expired, as session cookies and
+	// tokens are only signed, not stored.
+	loggedOut      = make(map[string]time.Time)
+	loggedOutMutex = &sync.Mutex{}
+)
+
+// loginSession is the signed content of a session cookie.
+type loginSession struct {
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// loadLDAPRoles reads "<role> <group DN>" lines; blank lines and lines
+// starting with # are ignored.
+func loadLDAPRoles(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, group, ok := strings.Cut(text, " ")
+		role, known := parseRole(name)
+		if !ok || !known || role == roleNone {
+			return fmt.Errorf("line %d: expected \"<admin|uploader|reader> <group DN>\"", line)
+		}
+		ldapGroupRoles[strings.ToLower(strings.TrimSpace(group))] = role
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(ldapGroupRoles) == 0 {
+		return errors.New("no roles")
+	}
+	return nil
+}
+
+// validLoginName keeps user names to characters that are plain in DNs and
+// search filters; ldapLogin escapes them all the same.
+func validLoginName(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune(".-_@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// errLoginFailed covers wrong credentials and users without a role alike.
+var errLoginFailed = errors.New("invalid user name or password")
+
+// ldapLogin binds as the user and maps the groups of the user's entry to
+// the strongest role they grant. The user name is escaped for the bind DN
+// and the search filter, so that it cannot name another entry or widen the
+// search.
+func ldapLogin(username, password string) (string, error) {
+	conn, err := dialLDAP(ldapURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	var ldapErr ldapError
+	if err := conn.bind(strings.ReplaceAll(ldapUserDN, "%s", escapeLDAPDNValue(username)), password); errors.As(err, &ldapErr) && ldapErr.code == ldapResultInvalidCreds {
+		return "", errLoginFailed
+	} else if err != nil {
+		return "", err
+	}
+	entries, err := conn.search(ldapBaseDN, strings.ReplaceAll(ldapUserFilter, "%s", escapeLDAPFilterValue(username)), []string{ldapGroupAttribute})
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		return "", fmt.Errorf("%d entries match user %s", len(entries), username)
+	}
+	role := ""
+	for _, group := range entries[0].Attributes[strings.ToLower(ldapGroupAttribute)] {
+		if granted := ldapGroupRoles[strings.ToLower(group)]; roleRank[granted] > roleRank[role] {
+			role = granted
+		}
+	}
+	if role == "" {
+		return "", errLoginFailed
+	}
+	return role, nil
+}
+
+// sessionValue encodes and signs a session for its cookie.
+func sessionValue(session loginSession) string {
+	payload, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sessionSignature(encoded)
+}
+
+func sessionSignature(encoded string) string {
+	mac := hmac.New(sha256.New, linkKey)
+	fmt.Fprintf(mac, "session\n%s", encoded)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestSession returns the login session of r's cookie, if it is valid.
+func requestSession(r *http.Request) (loginSession, bool) {
+	var session loginSession
+	if ldapURL == "" {
+		return session, false
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session, false
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(sessionSignature(encoded))) {
+		return session, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &session) != nil || !timeNow().Before(session.ExpiresAt) {
+		return session, false
+	}
+	loggedOutMutex.Lock()
+	_, ended := loggedOut[cookie.Value]
+	loggedOutMutex.Unlock()
+	return session, !ended
+}
+
+// loginHandler serves the login session of browser front ends:
+//
+//	POST /login   {"username", "password"} checked against LDAP; sets the cookie
+//	GET  /login   the current session
+//
+// Sessions last -session-lifetime and are signed with the link key, so they
+// survive restarts and work on every server sharing the data directory.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if ldapURL == "" {
+		writeError(w, http.StatusNotFound, codeNotFound, "Login is disabled")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		session, ok := requestSession(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Not logged in")
+			return
+		}
+		writeJSON(w, session)
+	case "POST":
+		var credentials struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid login: "+err.Error())
+				return
+			}
+		} else {
+			credentials.Username, credentials.Password = r.PostFormValue("username"), r.PostFormValue("password")
+		}
+		granted, err := "", errLoginFailed
+		if validLoginName(credentials.Username) {
+			granted, err = ldapLogin(credentials.Username, credentials.Password)
+		}
+		if err != nil {
+			audit(r, AuditEntry{Action: "login_failed", Detail: credentials.Username})
+			if err != errLoginFailed {
+				fmt.Println("Error checking login against LDAP:", err)
+				writeError(w, http.StatusBadGateway, codeInternalError, "Directory server unavailable")
+				return
+			}
+			// Slows down password guessing.
+			time.Sleep(time.Second)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+			return
+		}
+		session := loginSession{Principal: credentials.Username, Role: granted, ExpiresAt: timeNow().Add(sessionLifetime).UTC().Truncate(time.Second)}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    sessionValue(session),
+			Path:     "/",
+			Expires:  session.ExpiresAt,
+			MaxAge:   int(sessionLifetime / time.Second),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		audit(r, AuditEntry{Action: "login", Detail: credentials.Username + " as " + granted})
+		writeJSON(w, session)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
+
+// endSession turns away a signed session value, of a cookie or a session
+// token, until it would have expired.
+func endSession(value string, expiresAt time.Time) {
+	now := timeNow()
+	loggedOutMutex.Lock()
+	defer loggedOutMutex.Unlock()
+	for ended, expires := range loggedOut {
+		if !now.Before(expires) {
+			delete(loggedOut, ended)
+		}
+	}
+	loggedOut[value] = expiresAt
+}
+
+// logoutHandler serves POST /logout, which ends the session of the cookie.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	if session, ok := requestSession(r); ok {
+		cookie, _ := r.Cookie(sessionCookie)
+		endSession(cookie.Value, session.ExpiresAt)
+		audit(r, AuditEntry{Action: "logout", Detail: session.Principal})
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
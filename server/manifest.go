@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// merkleTreeRFC6962 names the Merkle tree of a manifest: the tree of
+	// RFC 6962 section 2.1 with the binary SHA-256 of each chunk as leaf
+	// data, so leaves are SHA-256(0x00 || chunk hash) and nodes
+	// SHA-256(0x01 || left || right).
+	merkleTreeRFC6962 = "rfc6962-sha256"
+	// Manifests may cut files into chunks between these sizes.
+	minManifestChunkSize = 64 * 1024
+	maxManifestChunkSize = 1 << 30
+	// maxCachedChunkHashes bounds the chunk hash lists kept in memory.
+	maxCachedChunkHashes = 256
+)
+
+// ChunkManifest answers GET /files/{id}/manifest: the SHA-256 of every chunk
+// of a stored file and the root of their Merkle tree, for recipients that get
+// the file some other way, such as from a CDN, to check it piece by piece.
+type ChunkManifest struct {
+	FileID        string          `json:"fileId"`
+	FileName      string          `json:"fileName"`
+	FileSize      int64           `json:"fileSize"`
+	FileHash      string          `json:"fileHash"`
+	HashAlgorithm string          `json:"hashAlgorithm"`
+	ChunkSize     int             `json:"chunkSize"`
+	ChunkCount    int             `json:"chunkCount"`
+	MerkleTree    string          `json:"merkleTree"`
+	MerkleRoot    string          `json:"merkleRoot"`
+	Chunks        []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is bytes [Offset, Offset+Size) of the file and their SHA-256.
+type ManifestChunk struct {
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+type chunkHashList struct {
+	fileHash string
+	hashes   []string
+}
+
+var (
+	// chunkHashCache holds chunk hash lists by file ID and chunk size.
+	chunkHashCache      = make(map[string]map[int]chunkHashList)
+	chunkHashCacheMutex = &sync.Mutex{}
+)
+
+// fileManifestHandler serves GET /files/{id}/manifest, cut at the chunk size
+// of the upload unless ?chunkSize= asks for another.
+func fileManifestHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		forgetChunkHashes(fileID)
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+	chunkSize := metadata.ChunkSize
+	if value := r.URL.Query().Get("chunkSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minManifestChunkSize || size > maxManifestChunkSize {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf("Chunk size must be between %d and %d", minManifestChunkSize, maxManifestChunkSize))
+			return
+		}
+		chunkSize = size
+	}
+	if chunkSize <= 0 {
+		chunkSize = maxChunkSize
+	}
+
+	hashes, err := storedChunkHashes(metadata, chunkSize)
+	if err != nil {
+		fmt.Println("Error hashing chunks:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading stored file")
+		return
+	}
+	manifest := ChunkManifest{
+		FileID:        metadata.ID,
+		FileName:      metadata.FileName,
+		FileSize:      metadata.FileSize,
+		FileHash:      metadata.FileHash,
+		HashAlgorithm: metadata.HashAlgorithm,
+		ChunkSize:     chunkSize,
+		ChunkCount:    len(hashes),
+		MerkleTree:    merkleTreeRFC6962,
+		Chunks:        make([]ManifestChunk, len(hashes)),
+	}
+	if manifest.HashAlgorithm == "" {
+		manifest.HashAlgorithm = hashSHA256
+	}
+	leaves := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		chunk := ManifestChunk{Number: i + 1, Offset: int64(i) * int64(chunkSize), Size: chunkSize, Hash: hash}
+		if remaining := metadata.FileSize - chunk.Offset; remaining < int64(chunkSize) {
+			chunk.Size = int(remaining)
+		}
+		manifest.Chunks[i] = chunk
+		leaves[i], _ = hex.DecodeString(hash)
+	}
+	manifest.MerkleRoot = hex.EncodeToString(merkleRoot(leaves))
+
+	response, err := json.Marshal(manifest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	if notModified(w, r, responseETag(response), storedModTime(metadata)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// merkleRoot is the RFC 6962 Merkle tree hash of leaves.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	if len(leaves) == 1 {
+		leaf := sha256.Sum256(append([]byte{0}, leaves[0]...))
+		return leaf[:]
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	node := sha256.New()
+	node.Write([]byte{1})
+	node.Write(merkleRoot(leaves[:split]))
+	node.Write(merkleRoot(leaves[split:]))
+	return node.Sum(nil)
+}
+
+func chunkCount(fileSize int64, chunkSize int) int {
+	return int((fileSize + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// storedChunkHashes returns the hex SHA-256 of every chunkSize bytes of the
+// stored file's content, reading the file the first time they are asked for
+// since it was stored or changed.
+func storedChunkHashes(metadata FileMetadata, chunkSize int) ([]string, error) {
+	chunkHashCacheMutex.Lock()
+	cached, ok := chunkHashCache[metadata.ID][chunkSize]
+	chunkHashCacheMutex.Unlock()
+	if ok && cached.fileHash == metadata.FileHash {
+		return cached.hashes, nil
+	}
+
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content, err := storedFileReader(file, metadata)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, chunkCount(metadata.FileSize, chunkSize))
+	hasher := sha256.New()
+	for {
+		hasher.Reset()
+		n, err := copyPooled(hasher, io.LimitReader(content, int64(chunkSize)))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		hashes = append(hashes, fmt.Sprintf("%x", hasher.Sum(nil)))
+	}
+	if len(hashes) != chunkCount(metadata.FileSize, chunkSize) {
+		return nil, fmt.Errorf("stored file of %s is not %d bytes", metadata.ID, metadata.FileSize)
+	}
+
+	chunkHashCacheMutex.Lock()
+	defer chunkHashCacheMutex.Unlock()
+	if _, known := chunkHashCache[metadata.ID]; !known && len(chunkHashCache) >= maxCachedChunkHashes {
+		for fileID := range chunkHashCache {
+			delete(chunkHashCache, fileID)
+			break
+		}
+	}
+	if chunkHashCache[metadata.ID] == nil {
+		chunkHashCache[metadata.ID] = make(map[int]chunkHashList)
+	}
+	chunkHashCache[metadata.ID][chunkSize] = chunkHashList{fileHash: metadata.FileHash, hashes: hashes}
+	return hashes, nil
+}
+
+// forgetChunkHashes drops the cached chunk hashes of a file that is gone.
+func forgetChunkHashes(fileID string) {
+	chunkHashCacheMutex.Lock()
+	delete(chunkHashCache, fileID)
+	chunkHashCacheMutex.Unlock()
+}
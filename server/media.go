@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MediaInfo describes the content of a stored image, video or audio file.
+// TakenAt is when the picture or recording was taken, in RFC 3339 form, or
+// without an offset for cameras that do not record their time zone.
+type MediaInfo struct {
+	Format      string  `json:"format,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Orientation int     `json:"orientation,omitempty"`
+	TakenAt     string  `json:"takenAt,omitempty"`
+	CameraMake  string  `json:"cameraMake,omitempty"`
+	CameraModel string  `json:"cameraModel,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	VideoCodec  string  `json:"videoCodec,omitempty"`
+	AudioCodec  string  `json:"audioCodec,omitempty"`
+}
+
+var (
+	// mediaMetadata extracts the MediaInfo of stored files; -media-metadata
+	// sets it.
+	mediaMetadata bool
+	// ffprobePath is ffprobe on the PATH, which reads video and audio files
+	// when it is installed.
+	ffprobePath string
+	// mediaSlots bounds how many files are read at once.
+	mediaSlots = make(chan struct{}, 2)
+)
+
+// ffprobeTimeout bounds how long ffprobe may read a file.
+const ffprobeTimeout = time.Minute
+
+// setupMediaMetadata looks for ffprobe for -media-metadata.
+func setupMediaMetadata() {
+	if path, err := exec.LookPath("ffprobe"); err == nil {
+		ffprobePath = path
+		fmt.Println("Reading video and audio metadata with", path)
+	} else {
+		fmt.Println("ffprobe not found, reading image metadata only")
+	}
+}
+
+// extractMediaInfo records the MediaInfo of a newly stored file in the
+// background, for JPEG, PNG and GIF images and, with ffprobe, files whose
+// name suggests video or audio.
+func extractMediaInfo(metadata FileMetadata) {
+	if !mediaMetadata {
+		return
+	}
+	go func() {
+		mediaSlots <- struct{}{}
+		defer func() { <-mediaSlots }()
+		info, err := readMediaInfo(metadata)
+		if err != nil {
+			fmt.Printf("Error reading media metadata of %s: %v\n", metadata.ID, err)
+			return
+		}
+		if info == nil {
+			return
+		}
+		_, err = fileStore.Update(metadata.ID, func(stored *FileMetadata) (bool, error) {
+			if stored.FileHash == metadata.FileHash {
+				stored.Media = info
+			}
+			return false, nil
+		})
+		if err != nil {
+			fmt.Printf("Error recording media metadata of %s: %v\n", metadata.ID, err)
+		}
+	}()
+}
+
+// readMediaInfo returns the MediaInfo of a stored file, or nil if it is not
+// media the server can read.
+func readMediaInfo(metadata FileMetadata) (*MediaInfo, error) {
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+	if config, format, err := image.DecodeConfig(bufio.NewReader(content)); err == nil {
+		info := &MediaInfo{Format: format, Width: config.Width, Height: config.Height}
+		if format == "jpeg" {
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			// Images without Exif data, or with data this reader does not
+			// understand, only lack the fields it would have given.
+			if tiff, err := jpegExif(bufio.NewReader(content)); err == nil && tiff != nil {
+				if tags, err := parseExif(tiff); err == nil {
+					info.applyExif(tags)
+				}
+			}
+		}
+		return info, nil
+	}
+	contentType := fileContentType(metadata.FileName)
+	if ffprobePath == "" || !(strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/")) {
+		return nil, nil
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return probeMedia(metadata, content)
+}
+
+// probeMedia runs ffprobe on a stored file. Files kept whole and in the
+// clear are read from the data directory, as some containers keep their
+// index at the end; others are piped to ffprobe.
+func probeMedia(metadata FileMetadata, content io.Reader) (*MediaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffprobeTimeout)
+	defer cancel()
+	input := "pipe:0"
+	if _, err := os.Stat(finalFilePath(metadata)); err == nil && !metadata.Encrypted {
+		input = finalFilePath(metadata)
+	}
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", input)
+	if input == "pipe:0" {
+		cmd.Stdin = content
+	}
+	stderr := &tailBuffer{limit: postProcessTextLimit}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string            `json:"format_name"`
+			Duration   string            `json:"duration"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe: %v", err)
+	}
+	info := &MediaInfo{Format: probe.Format.FormatName}
+	if created, err := time.Parse(time.RFC3339Nano, probe.Format.Tags["creation_time"]); err == nil {
+		info.TakenAt = created.Format(time.RFC3339)
+	}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec, info.Width, info.Height = stream.CodecName, stream.Width, stream.Height
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+		}
+	}
+	return info, nil
+}
+
+// exifTags are the Exif fields MediaInfo records.
+type exifTags struct {
+	Make, Model        string
+	Orientation        int
+	DateTime           string
+	DateTimeOriginal   string
+	OffsetTimeOriginal string
+}
+
+func (m *MediaInfo) applyExif(tags exifTags) {
+	m.CameraMake, m.CameraModel, m.Orientation = tags.Make, tags.Model, tags.Orientation
+	taken := tags.DateTimeOriginal
+	if taken == "" {
+		taken = tags.DateTime
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05", taken); err == nil {
+		m.TakenAt = t.Format("2006-01-02T15:04:05")
+		if _, err := time.Parse("-07:00", tags.OffsetTimeOriginal); err == nil {
+			m.TakenAt += tags.OffsetTimeOriginal
+		}
+	}
+}
+
+var errNotJPEG = errors.New("not a JPEG file")
+
+// jpegExif returns the TIFF structure of the Exif APP1 segment of a JPEG
+// file, or nil if it has none. Only the segments before the image data are
+// read.
+func jpegExif(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errNotJPEG
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, errNotJPEG
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xD9 || marker == 0xDA:
+			// End of image or start of scan: no Exif segment.
+			return nil, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			continue
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errNotJPEG
+		}
+		if marker != 0xE1 {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length)-2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// Exif tags and types read by parseExif.
+const (
+	exifTagMake               = 0x010F
+	exifTagModel              = 0x0110
+	exifTagOrientation        = 0x0112
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+
+	exifTypeASCII = 2
+	exifTypeShort = 3
+	exifTypeLong  = 4
+)
+
+var errInvalidExif = errors.New("invalid Exif data")
+
+// parseExif reads the camera, orientation and dates from the TIFF structure
+// of Exif data: the first image file directory and the Exif one it points
+// to.
+func parseExif(tiff []byte) (exifTags, error) {
+	var tags exifTags
+	if len(tiff) < 8 {
+		return tags, errInvalidExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return tags, errInvalidExif
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return tags, errInvalidExif
+	}
+
+	// value returns the bytes of an entry's value, which are kept in the
+	// entry itself when they fit in 4 bytes.
+	value := func(entry []byte, size int) ([]byte, bool) {
+		count := int64(order.Uint32(entry[4:]))
+		total := count * int64(size)
+		if total <= 4 {
+			return entry[8 : 8+total], true
+		}
+		offset := int64(order.Uint32(entry[8:]))
+		if total > int64(len(tiff)) || offset > int64(len(tiff))-total {
+			return nil, false
+		}
+		return tiff[offset : offset+total], true
+	}
+	ascii := func(entry []byte) string {
+		data, ok := value(entry, 1)
+		if !ok {
+			return ""
+		}
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		return strings.TrimSpace(string(data))
+	}
+	readIFD := func(offset uint32, visit func(tag, typ uint16, entry []byte)) error {
+		if int64(offset)+2 > int64(len(tiff)) {
+			return errInvalidExif
+		}
+		count := int(order.Uint16(tiff[offset:]))
+		entries := tiff[offset+2:]
+		if len(entries) < count*12 {
+			return errInvalidExif
+		}
+		for i := 0; i < count; i++ {
+			entry := entries[i*12 : i*12+12]
+			visit(order.Uint16(entry), order.Uint16(entry[2:]), entry)
+		}
+		return nil
+	}
+
+	var exifIFD uint32
+	err := readIFD(order.Uint32(tiff[4:]), func(tag, typ uint16, entry []byte) {
+		switch {
+		case tag == exifTagMake && typ == exifTypeASCII:
+			tags.Make = ascii(entry)
+		case tag == exifTagModel && typ == exifTypeASCII:
+			tags.Model = ascii(entry)
+		case tag == exifTagOrientation && typ == exifTypeShort:
+			tags.Orientation = int(order.Uint16(entry[8:]))
+		case tag == exifTagDateTime && typ == exifTypeASCII:
+			tags.DateTime = ascii(entry)
+		case tag == exifTagExifIFD && typ == exifTypeLong:
+			exifIFD = order.Uint32(entry[8:])
+		}
+	})
+	if err != nil {
+		return tags, err
+	}
+	if exifIFD != 0 {
+		err = readIFD(exifIFD, func(tag, typ uint16, entry []byte) {
+			switch {
+			case tag == exifTagDateTimeOriginal && typ == exifTypeASCII:
+				tags.DateTimeOriginal = ascii(entry)
+			case tag == exifTagOffsetTimeOriginal && typ == exifTypeASCII:
+				tags.OffsetTimeOriginal = ascii(entry)
+			}
+		})
+	}
+	return tags, err
+}
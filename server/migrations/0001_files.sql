@@ -0,0 +1,20 @@
+-- Metadata of stored files, one row per FileMetadata.
+CREATE TABLE files (
+    id           text PRIMARY KEY,
+    file_name    text        NOT NULL,
+    file_size    bigint      NOT NULL,
+    file_hash    text        NOT NULL,
+    chunk_size   integer     NOT NULL,
+    total_chunks integer     NOT NULL,
+    encrypted    boolean     NOT NULL DEFAULT false,
+    wrapped_key  text        NOT NULL DEFAULT '',
+    group_id     text        NOT NULL DEFAULT '',
+    file_md5     text        NOT NULL DEFAULT '',
+    owner        text        NOT NULL DEFAULT '',
+    acl          jsonb       NOT NULL DEFAULT '[]',
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    updated_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX files_file_name_idx ON files (file_name text_pattern_ops);
+CREATE INDEX files_owner_idx ON files (owner) WHERE owner <> '';
@@ -0,0 +1,4 @@
+-- Free-form key/value tags of stored files (FileMetadata.Tags).
+ALTER TABLE files ADD COLUMN tags jsonb NOT NULL DEFAULT '{}';
+
+CREATE INDEX files_tags_idx ON files USING gin (tags);
@@ -0,0 +1,3 @@
+-- How file_hash was computed (FileMetadata.HashAlgorithm); '' is plain SHA-256.
+ALTER TABLE files ADD COLUMN hash_algorithm text NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN hash_segment_size bigint NOT NULL DEFAULT 0;
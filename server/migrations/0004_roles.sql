@@ -0,0 +1,6 @@
+-- Roles assigned to principals through /admin/roles.
+CREATE TABLE principal_roles (
+    principal  text        PRIMARY KEY,
+    role       text        NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
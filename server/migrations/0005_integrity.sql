@@ -0,0 +1,3 @@
+-- Result of the latest scrub of the stored file (FileMetadata.Integrity);
+-- NULL until it is first checked.
+ALTER TABLE files ADD COLUMN integrity jsonb;
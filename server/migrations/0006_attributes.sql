@@ -0,0 +1,3 @@
+-- Modification time, mode, owner and extended attributes of the client's
+-- file (FileMetadata.Attributes); NULL when the client sent none.
+ALTER TABLE files ADD COLUMN attributes jsonb;
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// deferChunkVerification moves chunk hashing off the upload hot path: chunk
+// requests only store the data and record the client's Chunk-Hash in the
+// upload's manifest, and the assembly workers check every chunk against it
+// when the upload is completed. Transfer digest headers (Content-Digest,
+// Content-MD5, Digest) are not checked per request in this mode.
+var deferChunkVerification bool
+
+var errChunkHashMismatch = errors.New("chunk hash mismatch")
+
+// chunkManifestPath holds one "<chunk number> <sha-256>" line per stored
+// chunk. Lines are appended, so concurrent chunk requests never rewrite each
+// other's entries; for a chunk uploaded twice the last line wins.
+func chunkManifestPath(fileID string) string {
+	return filepath.Join(uploadTmpDir(fileID), "manifest")
+}
+
+func validChunkHash(chunkHash string) bool {
+	decoded, err := hex.DecodeString(chunkHash)
+	return err == nil && len(decoded) == 32
+}
+
+func recordChunkHash(fileID string, chunkNumber int, chunkHash string) error {
+	if err := os.MkdirAll(uploadTmpDir(fileID), 0755); err != nil {
+		return err
+	}
+	manifest, err := os.OpenFile(chunkManifestPath(fileID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(manifest, "%d %s\n", chunkNumber, strings.ToLower(chunkHash)); err != nil {
+		manifest.Close()
+		return err
+	}
+	return manifest.Close()
+}
+
+// readChunkManifest returns the recorded chunk hashes of an upload; uploads
+// whose chunks were verified on arrival have no manifest.
+func readChunkManifest(fileID string) (map[int]string, error) {
+	hashes := make(map[int]string)
+	manifest, err := os.Open(chunkManifestPath(fileID))
+	if os.IsNotExist(err) {
+		return hashes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Close()
+
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		chunkNumber, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		hashes[chunkNumber] = fields[1]
+	}
+	return hashes, scanner.Err()
+}
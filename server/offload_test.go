@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// These benchmarks show the trade-off of -defer-chunk-verification: chunk
+// requests get cheaper, completion pays for the hashing instead.
+//
+//	go test ./server -run '^$' -bench . -benchmem
+
+const benchChunkSize = 4 << 20
+
+func setupBenchUpload(b *testing.B, chunks int) (FileMetadata, []byte) {
+	b.Helper()
+	dataDir = b.TempDir()
+	chunk := make([]byte, benchChunkSize)
+	rand.Read(chunk)
+	metadata := FileMetadata{
+		ID:          generateUniqueID(),
+		FileName:    "bench.bin",
+		FileSize:    int64(chunks) * benchChunkSize,
+		ChunkSize:   benchChunkSize,
+		TotalChunks: chunks,
+	}
+	metadataMutex.Lock()
+	filesMetadata[metadata.ID] = metadata
+	metadataMutex.Unlock()
+	return metadata, chunk
+}
+
+func uploadBenchChunk(b *testing.B, metadata FileMetadata, chunkNumber int, chunk []byte) {
+	request := httptest.NewRequest("POST", fmt.Sprintf("/upload_chunk/%s/%d", metadata.ID, chunkNumber), bytes.NewReader(chunk))
+	request.Header.Set("Chunk-Hash", fmt.Sprintf("%x", sha256.Sum256(chunk)))
+	recorder := httptest.NewRecorder()
+	uploadChunkHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		b.Fatalf("chunk upload failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func BenchmarkUploadChunk(b *testing.B) {
+	for _, deferred := range []bool{false, true} {
+		name := "verify"
+		if deferred {
+			name = "deferred"
+		}
+		b.Run(name, func(b *testing.B) {
+			deferChunkVerification = deferred
+			defer func() { deferChunkVerification = false }()
+			metadata, chunk := setupBenchUpload(b, 1)
+			b.SetBytes(benchChunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				uploadBenchChunk(b, metadata, 1, chunk)
+			}
+		})
+	}
+}
+
+func BenchmarkAssembleChunks(b *testing.B) {
+	const chunks = 8
+	for _, deferred := range []bool{false, true} {
+		name := "verified-on-upload"
+		if deferred {
+			name = "deferred"
+		}
+		b.Run(name, func(b *testing.B) {
+			deferChunkVerification = deferred
+			defer func() { deferChunkVerification = false }()
+			metadata, chunk := setupBenchUpload(b, chunks)
+			for n := 1; n <= chunks; n++ {
+				uploadBenchChunk(b, metadata, n, chunk)
+			}
+			b.SetBytes(chunks * benchChunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := assembleChunks(context.Background(), ioutil.Discard, metadata); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
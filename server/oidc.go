@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLeeway tolerates clock skew between the server and the issuer.
+	oidcLeeway = time.Minute
+	// oidcKeysMaxAge is how long fetched signing keys are used before the
+	// JWKS is fetched again; a token signed with an unknown key triggers a
+	// fetch earlier, at most every oidcRefetchInterval.
+	oidcKeysMaxAge      = time.Hour
+	oidcRefetchInterval = time.Minute
+	// oidcCacheSize bounds the tokens whose validation is remembered:
+	// valid ones until they expire, invalid ones for oidcRejectTTL, as a
+	// request may check its principal many times, e.g. once per search
+	// result.
+	oidcCacheSize = 10000
+	oidcRejectTTL = time.Minute
+)
+
+// oidcProvider validates bearer tokens issued by an OpenID Connect issuer:
+// JWTs signed with one of the issuer's published keys, for this server's
+// audience, and not expired.
+type oidcProvider struct {
+	issuer   string
+	audience string
+	// claim names the token claim used as the principal, such as "sub" or
+	// "email".
+	claim   string
+	jwksURL string
+	client  *http.Client
+
+	mutex     sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	validated map[string]oidcToken
+}
+
+type oidcToken struct {
+	principal string
+	err       error
+	expires   time.Time
+}
+
+// oidc is nil unless -oidc-issuer is set.
+var oidc *oidcProvider
+
+// setupOIDC reads the issuer's discovery document and signing keys, so a
+// misconfigured issuer is reported at startup rather than on every request.
+func setupOIDC(issuer, audience, claim string) error {
+	if audience == "" {
+		return errors.New("-oidc-audience is required with -oidc-issuer")
+	}
+	provider := &oidcProvider{
+		issuer:    strings.TrimSuffix(issuer, "/"),
+		audience:  audience,
+		claim:     claim,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		validated: make(map[string]oidcToken),
+	}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := provider.getJSON(provider.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return fmt.Errorf("reading discovery document: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != provider.issuer {
+		return fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return errors.New("discovery document has no jwks_uri")
+	}
+	provider.issuer = discovery.Issuer
+	provider.jwksURL = discovery.JWKSURI
+	keys, err := provider.fetchKeys()
+	if err != nil {
+		return fmt.Errorf("reading signing keys: %v", err)
+	}
+	provider.keys, provider.fetchedAt = keys, timeNow()
+	oidc = provider
+	return nil
+}
+
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchKeys reads the RSA and EC signing keys of the JWKS; others are
+// skipped.
+func (p *oidcProvider) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			public := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(public.X, public.Y) {
+				continue
+			}
+			keys[key.Kid] = public
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+// key returns the signing key kid, fetching the JWKS again when the keys are
+// old or, at most every oidcRefetchInterval, when kid is unknown, as issuers
+// rotate keys.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, bool) {
+	p.mutex.Lock()
+	key, ok := p.keys[kid]
+	age := timeNow().Sub(p.fetchedAt)
+	if (ok && age < oidcKeysMaxAge) || (!ok && age < oidcRefetchInterval) {
+		p.mutex.Unlock()
+		return key, ok
+	}
+	// Other requests keep using the known keys while this one fetches.
+	p.fetchedAt = timeNow()
+	p.mutex.Unlock()
+	keys, err := p.fetchKeys()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		// Keep the known keys until the issuer answers again.
+		fmt.Println("Error fetching OIDC signing keys:", err)
+	} else {
+		p.keys = keys
+	}
+	key, ok = p.keys[kid]
+	return key, ok
+}
+
+// principal returns the principal of a valid token. The outcome is
+// remembered, so fresh reports whether the token was validated by this call.
+func (p *oidcProvider) principal(token string) (principal string, fresh bool, err error) {
+	now := timeNow()
+	p.mutex.Lock()
+	cached, ok := p.validated[token]
+	p.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.principal, false, cached.err
+	}
+	principal, expires, err := p.validate(token, now)
+	if err != nil {
+		expires = now.Add(oidcRejectTTL)
+	}
+	p.mutex.Lock()
+	if len(p.validated) >= oidcCacheSize {
+		for cachedToken, entry := range p.validated {
+			if !now.Before(entry.expires) {
+				delete(p.validated, cachedToken)
+			}
+		}
+		if len(p.validated) >= oidcCacheSize {
+			p.validated = make(map[string]oidcToken)
+		}
+	}
+	p.validated[token] = oidcToken{principal: principal, err: err, expires: expires}
+	p.mutex.Unlock()
+	return principal, true, err
+}
+
+// validate checks the signature and the iss, aud, exp and nbf claims of a
+// JWT and returns its principal claim and expiry.
+func (p *oidcProvider) validate(token string, now time.Time) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", time.Time{}, errors.New("invalid signature encoding")
+	}
+	key, ok := p.key(header.Kid)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid claims: %v", err)
+	}
+	if claims["iss"] != p.issuer {
+		return "", time.Time{}, fmt.Errorf("issued by %v", claims["iss"])
+	}
+	if !audienceContains(claims["aud"], p.audience) {
+		return "", time.Time{}, errors.New("not issued for this audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", time.Time{}, errors.New("no expiry")
+	}
+	expires := time.Unix(int64(exp), 0)
+	if !now.Before(expires.Add(oidcLeeway)) {
+		return "", time.Time{}, errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", time.Time{}, errors.New("not valid yet")
+	}
+	principal, _ := claims[p.claim].(string)
+	if principal == "" || principal == everyone {
+		return "", time.Time{}, fmt.Errorf("no usable %s claim", p.claim)
+	}
+	return principal, expires.Add(oidcLeeway), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains checks an aud claim, a string or an array of them.
+func audienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var jwsHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifyJWTSignature checks a JWS signature. Only the asymmetric algorithms
+// issuers sign ID and access tokens with are accepted; "none" and the HMAC
+// algorithms never are.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash, ok := jwsHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are r and s as fixed size big-endian halves.
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*((key.Curve.Params().BitSize+7)/8) {
+			half := len(signature) / 2
+			r, s := new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match the signing key", alg)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// patchRange is one range of a PATCH request: bytes first to last of the
+// file are replaced with body. total is the size of the patched file, or -1
+// to keep the size unless the range extends the file. A range with first -1
+// only sets the size.
+type patchRange struct {
+	first, last, total int64
+	body               io.Reader
+}
+
+var errPatchRangeOrder = errors.New("ranges must be in ascending order and must not overlap")
+
+// errRangeNotSatisfiable marks ranges the stored file cannot take, because
+// they start or leave a gap after its end, which are answered with 416.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// patchFileHandler serves PATCH /files/{id}: byte ranges written over the
+// stored file, which keeps its ID. The body is either the bytes of a single
+// range given by "Content-Range: bytes first-last/total", or
+// multipart/byteranges with one range per part. A total of * keeps the size
+// of the file unless a range extends it from its end, and "bytes */total"
+// with an empty body only truncates it. If-Match with the file's ETag
+// refuses the patch if the file changed since it was read.
+func patchFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	fmt.Println("Received file patch request for:", r.URL.Path)
+	base, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, base, permissionWrite) {
+		return
+	}
+	if !ifMatch(r, base) {
+		writeError(w, http.StatusPreconditionFailed, codeFileChanged, "Stored file does not match If-Match")
+		return
+	}
+	nextRange, err := patchRanges(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	baseFile, err := openStoredFile(base)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+	defer baseFile.Close()
+	baseContent, err := storedFileReader(baseFile, base)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error opening stored file")
+		return
+	}
+
+	updated := base
+	updated.Integrity, updated.Processing, updated.Media, updated.AppendState = nil, nil, nil, ""
+	if updated.Encrypted {
+		// A rewritten file gets a data key of its own, so that no key
+		// protects more than one version of the file.
+		if updated.WrappedKey, err = newWrappedDataKey(); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error generating data key")
+			return
+		}
+	}
+
+	// Like a delta update, the patched version is staged next to the stored
+	// file and only replaces it once no download is streaming it.
+	stagedPath := finalFilePath(updated) + ".patch"
+	defer os.Remove(stagedPath)
+	var content storedContent
+	var fileSize int64
+	var ranges, patchedBytes int64
+	reader, writer := io.Pipe()
+	var g errgroup.Group
+	g.Go(func() error {
+		var err error
+		fileSize, ranges, patchedBytes, err = applyPatches(writer, baseContent, base.FileSize, nextRange)
+		writer.CloseWithError(err)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		content, err = writeStoredFile(stagedPath, updated, reader, "")
+		reader.CloseWithError(err)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		fmt.Println("Error applying patch:", err)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", base.FileSize))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, codeRangeNotSatisfiable, "Error applying patch: "+err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Error applying patch: "+err.Error())
+		return
+	}
+	if fileSize == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "A patch cannot empty the file")
+		return
+	}
+	updated.FileSize, updated.FileHash, updated.FileMD5 = fileSize, content.Hash, content.MD5
+	if updated.ChunkSize > 0 {
+		updated.TotalChunks = int(math.Ceil(float64(fileSize) / float64(updated.ChunkSize)))
+	}
+	if fileSize > base.FileSize && !checkRegistrationLimits(w, updated) {
+		return
+	}
+
+	endChange, readers := beginChange(fileID, false)
+	if endChange == nil {
+		writeInUse(w, readers)
+		return
+	}
+	defer endChange()
+	// Another update may have replaced the file while this one was staged.
+	if current, ok, err := lookupFileInfo(fileID); err != nil || !ok || current.FileHash != base.FileHash {
+		writeError(w, http.StatusConflict, codeFileChanged, "Stored file changed while the patch was applied")
+		return
+	}
+	if err := os.Rename(stagedPath, finalFilePath(updated)); err != nil {
+		fmt.Println("Error replacing stored file:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error replacing stored file")
+		return
+	}
+	if err := updateFileInfoDB(updated); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	indexStoredFile(updated)
+	generateThumbnails(updated)
+	extractMediaInfo(updated)
+	indexFileText(updated)
+	postProcess(updated)
+	queueErasureCoding(updated)
+	audit(r, AuditEntry{Action: "patch", FileID: updated.ID, FileName: updated.FileName, Size: updated.FileSize,
+		Detail: fmt.Sprintf("%d range(s), %d bytes written, size %d to %d", ranges, patchedBytes, base.FileSize, updated.FileSize)})
+
+	response, err := json.Marshal(updated.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf("%q", updated.FileHash))
+	w.Write(response)
+}
+
+// ifMatch reports whether the If-Match header, if any, lists the ETag of
+// the stored file, as served with downloads, or is "*".
+func ifMatch(r *http.Request, metadata FileMetadata) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == fmt.Sprintf("%q", metadata.FileHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// patchRanges returns a function yielding the ranges of a PATCH request in
+// order, and io.EOF after the last one.
+func patchRanges(r *http.Request) (func() (patchRange, error), error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		patch, err := parsePatchRange(r.Header.Get("Content-Range"), r.Body)
+		if err != nil {
+			return nil, err
+		}
+		done := false
+		return func() (patchRange, error) {
+			if done {
+				return patchRange{}, io.EOF
+			}
+			done = true
+			return patch, nil
+		}, nil
+	}
+	if params["boundary"] == "" {
+		return nil, errors.New("multipart/byteranges needs a boundary")
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	return func() (patchRange, error) {
+		part, err := parts.NextPart()
+		if err != nil {
+			return patchRange{}, err
+		}
+		return parsePatchRange(part.Header.Get("Content-Range"), part)
+	}, nil
+}
+
+// parsePatchRange parses the Content-Range of a range, which unlike that of
+// an upload may have a total of *.
+func parsePatchRange(value string, body io.Reader) (patchRange, error) {
+	patch := patchRange{body: body}
+	var err error
+	if strings.HasSuffix(value, "/*") {
+		patch.first, patch.last, _, err = parseContentRange(strings.TrimSuffix(value, "*") + "0")
+		patch.total = -1
+		if err == nil && patch.first < 0 {
+			err = errors.New("\"bytes */*\" changes nothing")
+		}
+	} else {
+		patch.first, patch.last, patch.total, err = parseContentRange(value)
+	}
+	if err != nil {
+		return patch, err
+	}
+	if patch.total >= 0 && patch.last >= patch.total {
+		return patch, errors.New("Content-Range ends beyond its total")
+	}
+	return patch, nil
+}
+
+// applyPatches writes to dst the content of base with the ranges from next
+// written over it, and returns the size of the result, the number of ranges
+// and the bytes they wrote. Ranges must come in ascending order and must
+// not leave a gap after the end of the file.
+func applyPatches(dst io.Writer, base io.ReadSeeker, baseSize int64, next func() (patchRange, error)) (int64, int64, int64, error) {
+	// copyBase writes base bytes from..to (exclusive), those that exist.
+	copyBase := func(from, to int64) error {
+		if to > baseSize {
+			to = baseSize
+		}
+		if from >= to {
+			return nil
+		}
+		if _, err := base.Seek(from, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(dst, base, to-from)
+		return err
+	}
+	var pos, ranges, written int64
+	total := int64(-1)
+	for {
+		patch, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if patch.total >= 0 {
+			if total >= 0 && patch.total != total {
+				return 0, 0, 0, errors.New("ranges disagree on the total size")
+			}
+			total = patch.total
+		}
+		if patch.first < 0 {
+			if _, err := io.CopyN(ioutil.Discard, patch.body, 1); err != io.EOF {
+				return 0, 0, 0, errors.New("\"bytes */total\" must have an empty body")
+			}
+			continue
+		}
+		if patch.first < pos {
+			return 0, 0, 0, errPatchRangeOrder
+		}
+		end := baseSize
+		if pos > end {
+			end = pos
+		}
+		if patch.first > end {
+			return 0, 0, 0, fmt.Errorf("%w: range starts at %d, beyond the end of the file at %d", errRangeNotSatisfiable, patch.first, end)
+		}
+		if err := copyBase(pos, patch.first); err != nil {
+			return 0, 0, 0, err
+		}
+		length := patch.last - patch.first + 1
+		if n, err := io.CopyN(dst, patch.body, length); err != nil {
+			if err == io.EOF {
+				return 0, 0, 0, fmt.Errorf("range %d-%d has only %d bytes", patch.first, patch.last, n)
+			}
+			return 0, 0, 0, err
+		}
+		if n, _ := io.CopyN(ioutil.Discard, patch.body, 1); n > 0 {
+			return 0, 0, 0, fmt.Errorf("range %d-%d has more than %d bytes", patch.first, patch.last, length)
+		}
+		pos = patch.last + 1
+		ranges++
+		written += length
+	}
+	if ranges == 0 && total < 0 {
+		return 0, 0, 0, errors.New("no range to patch")
+	}
+	size := total
+	if size < 0 {
+		size = baseSize
+		if pos > size {
+			size = pos
+		}
+	}
+	if pos > size {
+		return 0, 0, 0, fmt.Errorf("%w: Content-Range ends beyond its total", errRangeNotSatisfiable)
+	}
+	if end := baseSize; size > end && size > pos {
+		if pos > end {
+			end = pos
+		}
+		return 0, 0, 0, fmt.Errorf("%w: total of %d would leave a gap after the end of the file at %d", errRangeNotSatisfiable, size, end)
+	}
+	if err := copyBase(pos, size); err != nil {
+		return 0, 0, 0, err
+	}
+	return size, ranges, written, nil
+}
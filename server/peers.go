@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With -peer-assist the server tracks which clients hold which pieces of a
+// stored file, so downloaders can fetch popular files partly from each other.
+// The server never relays piece data: it hands out the SHA-256 of every
+// piece, computed from the stored file, and downloaders check what peers send
+// against them and fetch from the server whatever fails or has no peer.
+var peerAssist bool
+
+const (
+	// peerPieceSize is the unit peers exchange, independent of the chunk
+	// size the file was uploaded with.
+	peerPieceSize = 4 << 20
+	// peerAnnouncementTTL is how long an announcement is listed; seeders
+	// announce again before it runs out.
+	peerAnnouncementTTL = 5 * time.Minute
+	// maxPeersPerPiece bounds the peers listed for each piece.
+	maxPeersPerPiece = 8
+	// maxPeersPerFile bounds the announcements kept for one file.
+	maxPeersPerFile = 1000
+)
+
+// PeerAnnouncement is the body of POST /files/{id}/peers. URL is where the
+// peer serves GET <url>/pieces/<file id>/<piece number>; without it the
+// server builds http://<client address>:<port>. Pieces lists the piece
+// numbers the peer holds, all of them when it is omitted.
+type PeerAnnouncement struct {
+	URL    string `json:"url,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Pieces []int  `json:"pieces,omitempty"`
+}
+
+// PeerPiece is one piece of a file: bytes [Offset, Offset+Size), their
+// SHA-256, and the peers announcing it.
+type PeerPiece struct {
+	Number int      `json:"number"`
+	Offset int64    `json:"offset"`
+	Size   int      `json:"size"`
+	Hash   string   `json:"hash"`
+	Peers  []string `json:"peers"`
+}
+
+// PeerSwarm answers GET and POST /files/{id}/peers. PeerURL is the URL an
+// announcement was recorded under, which withdraws it.
+type PeerSwarm struct {
+	FileID                  string      `json:"fileId"`
+	PeerURL                 string      `json:"peerUrl,omitempty"`
+	FileHash                string      `json:"fileHash"`
+	FileSize                int64       `json:"fileSize"`
+	PieceSize               int         `json:"pieceSize"`
+	PeerCount               int         `json:"peerCount"`
+	AnnounceIntervalSeconds float64     `json:"announceIntervalSeconds"`
+	Pieces                  []PeerPiece `json:"pieces"`
+}
+
+// peerEntry is one peer's announcement; pieces is nil for a peer holding
+// the whole file.
+type peerEntry struct {
+	fileHash string
+	pieces   map[int]bool
+	expires  time.Time
+}
+
+var (
+	peerSwarms      = make(map[string]map[string]*peerEntry)
+	peerSwarmsMutex = &sync.Mutex{}
+)
+
+// filePeersHandler serves /files/{id}/peers:
+//
+//	GET    the piece hashes and the peers holding each piece
+//	POST   announce a PeerAnnouncement, answered like GET
+//	DELETE ?url=<peer url> withdraws an announcement
+//
+// Every method needs the read permission on the file.
+func filePeersHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if !peerAssist {
+		writeError(w, http.StatusNotFound, codeNotFound, "Peer assist is not enabled")
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, POST and DELETE methods are allowed")
+		return
+	}
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		forgetPeers(fileID)
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+
+	var peerURL string
+	switch r.Method {
+	case "DELETE":
+		peerSwarmsMutex.Lock()
+		delete(peerSwarms[fileID], r.URL.Query().Get("url"))
+		peerSwarmsMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "POST":
+		var announcement PeerAnnouncement
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&announcement); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid announcement: "+err.Error())
+			return
+		}
+		peerURL, err = announcedURL(r, announcement)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if err := announcePeer(metadata, peerURL, announcement.Pieces); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		fmt.Printf("Peer %s announced %s\n", peerURL, metadata.ID)
+	}
+
+	hashes, err := storedChunkHashes(metadata, peerPieceSize)
+	if err != nil {
+		fmt.Println("Error hashing pieces:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading stored file")
+		return
+	}
+	swarm := peerSwarm(metadata, hashes)
+	swarm.PeerURL = peerURL
+	writeJSON(w, swarm)
+}
+
+// announcedURL is the URL under which the announcing peer serves pieces.
+func announcedURL(r *http.Request, announcement PeerAnnouncement) (string, error) {
+	if announcement.URL == "" {
+		ip := clientIP(r)
+		if ip == nil || announcement.Port < 1 || announcement.Port > 65535 {
+			return "", fmt.Errorf("Announcement needs a url or a port between 1 and 65535")
+		}
+		return "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(announcement.Port)), nil
+	}
+	parsed, err := url.Parse(announcement.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+		parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("Peer URL must be an http or https URL without credentials or query")
+	}
+	return announcement.URL, nil
+}
+
+// announcePeer records that peerURL holds pieces of the file, or all of it
+// when pieces is empty, until peerAnnouncementTTL passes.
+func announcePeer(metadata FileMetadata, peerURL string, pieces []int) error {
+	count := pieceCount(metadata.FileSize)
+	entry := &peerEntry{fileHash: metadata.FileHash, expires: timeNow().Add(peerAnnouncementTTL)}
+	if len(pieces) > 0 {
+		entry.pieces = make(map[int]bool, len(pieces))
+		for _, number := range pieces {
+			if number < 1 || number > count {
+				return fmt.Errorf("Piece number must be between 1 and %d", count)
+			}
+			entry.pieces[number] = true
+		}
+	}
+
+	peerSwarmsMutex.Lock()
+	defer peerSwarmsMutex.Unlock()
+	swarm := peerSwarms[metadata.ID]
+	if swarm == nil {
+		swarm = make(map[string]*peerEntry)
+		peerSwarms[metadata.ID] = swarm
+	}
+	pruneSwarm(swarm, metadata.FileHash)
+	if _, known := swarm[peerURL]; !known && len(swarm) >= maxPeersPerFile {
+		return fmt.Errorf("File already has %d peers", maxPeersPerFile)
+	}
+	swarm[peerURL] = entry
+	return nil
+}
+
+// pruneSwarm drops expired announcements and those of an earlier version of
+// the file. It needs peerSwarmsMutex.
+func pruneSwarm(swarm map[string]*peerEntry, fileHash string) {
+	now := timeNow()
+	for peerURL, entry := range swarm {
+		if entry.fileHash != fileHash || !now.Before(entry.expires) {
+			delete(swarm, peerURL)
+		}
+	}
+}
+
+// forgetPeers drops the peers and piece hashes of a file that is gone.
+func forgetPeers(fileID string) {
+	peerSwarmsMutex.Lock()
+	delete(peerSwarms, fileID)
+	peerSwarmsMutex.Unlock()
+	forgetChunkHashes(fileID)
+}
+
+// peerSwarm lists every piece with up to maxPeersPerPiece of its peers. The
+// peers of each piece start at a different one, so that downloaders spread
+// over all of them.
+func peerSwarm(metadata FileMetadata, hashes []string) PeerSwarm {
+	peerSwarmsMutex.Lock()
+	swarm := peerSwarms[metadata.ID]
+	pruneSwarm(swarm, metadata.FileHash)
+	peerURLs := make([]string, 0, len(swarm))
+	for peerURL := range swarm {
+		peerURLs = append(peerURLs, peerURL)
+	}
+	sort.Strings(peerURLs)
+	entries := make([]*peerEntry, len(peerURLs))
+	for i, peerURL := range peerURLs {
+		entries[i] = swarm[peerURL]
+	}
+	peerSwarmsMutex.Unlock()
+
+	result := PeerSwarm{
+		FileID:                  metadata.ID,
+		FileHash:                metadata.FileHash,
+		FileSize:                metadata.FileSize,
+		PieceSize:               peerPieceSize,
+		PeerCount:               len(peerURLs),
+		AnnounceIntervalSeconds: (peerAnnouncementTTL / 2).Seconds(),
+		Pieces:                  make([]PeerPiece, len(hashes)),
+	}
+	for i, hash := range hashes {
+		number := i + 1
+		piece := PeerPiece{Number: number, Offset: int64(i) * peerPieceSize, Size: peerPieceSize, Hash: hash, Peers: make([]string, 0)}
+		if remaining := metadata.FileSize - piece.Offset; remaining < peerPieceSize {
+			piece.Size = int(remaining)
+		}
+		for j := range peerURLs {
+			k := (i + j) % len(peerURLs)
+			if entries[k].pieces == nil || entries[k].pieces[number] {
+				piece.Peers = append(piece.Peers, peerURLs[k])
+			}
+			if len(piece.Peers) == maxPeersPerPiece {
+				break
+			}
+		}
+		result.Pieces[i] = piece
+	}
+	return result
+}
+
+func pieceCount(fileSize int64) int {
+	return chunkCount(fileSize, peerPieceSize)
+}
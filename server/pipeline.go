@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// assemblyWorkers bounds how many chunks of one upload are loaded and verified
+// ahead of the writer during completion. It also bounds the memory used, to
+// assemblyWorkers chunks per completing upload.
+var assemblyWorkers = runtime.NumCPU()
+
+var errChunkMissing = errors.New("chunk file does not exist")
+
+// loadedChunk is one chunk as stored on disk and as plaintext; both are the
+// same slice for unencrypted uploads. stored lives in buffer, which goes back
+// to the pool once the chunk is written.
+type loadedChunk struct {
+	stored []byte
+	plain  []byte
+	buffer *[]byte
+}
+
+// assembleChunks concatenates the chunks of an upload into dst in order and
+// returns the SHA-256 and MD5 of the plaintext. Chunks are read (and, for
+// encrypted uploads, authenticated) by a bounded pool of workers while a
+// single writer appends them, so hashing does not need a second pass over
+// the assembled file. The first error cancels the remaining work; chunk files
+// are left untouched so that a failed completion can be retried.
+func assembleChunks(ctx context.Context, dst io.Writer, metadata FileMetadata) ([]byte, []byte, error) {
+	var aead cipher.AEAD
+	if metadata.Encrypted {
+		var err error
+		if aead, err = chunkAEAD(metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	chunkHashes, err := readChunkManifest(metadata.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	window := make(chan struct{}, assemblyWorkers)
+	loaded := make([]chan loadedChunk, metadata.TotalChunks)
+	for i := range loaded {
+		loaded[i] = make(chan loadedChunk, 1)
+	}
+
+	g.Go(func() error {
+		for i := 1; i <= metadata.TotalChunks; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			chunkNumber := i
+			g.Go(func() error {
+				chunk, err := loadChunk(aead, metadata, chunkNumber, chunkHashes[chunkNumber])
+				if err != nil {
+					return err
+				}
+				loaded[chunkNumber-1] <- chunk
+				return nil
+			})
+		}
+		return nil
+	})
+
+	shaHash, md5Hash := newFileHasher(metadata), md5.New()
+	g.Go(func() error {
+		for i := range loaded {
+			var chunk loadedChunk
+			select {
+			case chunk = <-loaded[i]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if _, err := dst.Write(chunk.stored); err != nil {
+				return fmt.Errorf("writing chunk %d: %w", i+1, err)
+			}
+			shaHash.Write(chunk.plain)
+			md5Hash.Write(chunk.plain)
+			putBuffer(chunk.buffer)
+			<-window
+		}
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return shaHash.Sum(nil), md5Hash.Sum(nil), nil
+}
+
+// loadChunk reads one chunk file into a pooled buffer and, when aead is set,
+// authenticates it. With an expected hash from the chunk manifest the
+// plaintext is checked too; a mismatching chunk is quarantined so that it can
+// be uploaded again.
+func loadChunk(aead cipher.AEAD, metadata FileMetadata, chunkNumber int, expectedHash string) (loadedChunk, error) {
+	buffer, err := readChunkFile(chunkFilePath(metadata.ID, chunkNumber))
+	if os.IsNotExist(err) {
+		return loadedChunk{}, fmt.Errorf("chunk %d: %w", chunkNumber, errChunkMissing)
+	}
+	if err != nil {
+		return loadedChunk{}, fmt.Errorf("reading chunk %d: %w", chunkNumber, err)
+	}
+	data := *buffer
+	plain := data
+	if aead != nil {
+		if plain, err = openChunk(aead, metadata.ID, chunkNumber, data); err != nil {
+			putBuffer(buffer)
+			return loadedChunk{}, fmt.Errorf("decrypting chunk %d: %w", chunkNumber, err)
+		}
+	}
+	if actualHash := fmt.Sprintf("%x", sha256.Sum256(plain)); expectedHash != "" && actualHash != expectedHash {
+		record := QuarantineRecord{FileID: metadata.ID, ChunkNumber: chunkNumber, ExpectedHash: expectedHash, ActualHash: actualHash, Size: int64(len(plain)), Reason: "chunk hash mismatch at assembly"}
+		if aead != nil {
+			quarantineChunk(nil, record, "")
+		} else {
+			quarantineChunk(nil, record, chunkFilePath(metadata.ID, chunkNumber))
+		}
+		os.Remove(chunkFilePath(metadata.ID, chunkNumber))
+		putBuffer(buffer)
+		return loadedChunk{}, fmt.Errorf("chunk %d: %w", chunkNumber, errChunkHashMismatch)
+	}
+	return loadedChunk{stored: data, plain: plain, buffer: buffer}, nil
+}
+
+func readChunkFile(path string) (*[]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buffer := getBuffer(int(stat.Size()))
+	if _, err := io.ReadFull(file, *buffer); err != nil {
+		putBuffer(buffer)
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// createChunkTemp creates the file a chunk is written to before it has been
+// verified. Only verified chunks are renamed to chunkFilePath, so assembly
+// never picks up a partial or corrupt upload, and retries of the same chunk
+// racing each other each get their own temporary file.
+func createChunkTemp(fileID string, chunkNumber int) (*os.File, error) {
+	if err := os.MkdirAll(uploadTmpDir(fileID), 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(uploadTmpDir(fileID), fmt.Sprintf("part_%d.*.tmp", chunkNumber))
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of a processing step.
+const (
+	stepPending   = "pending"
+	stepRunning   = "running"
+	stepSucceeded = "succeeded"
+	stepFailed    = "failed"
+	stepSkipped   = "skipped"
+)
+
+// ProcessingStep is the outcome of one step of the -post-process pipeline
+// for a stored file. Output holds what the step reported, such as the paths
+// it wrote or the properties it extracted.
+type ProcessingStep struct {
+	Name       string            `json:"name"`
+	Processor  string            `json:"processor"`
+	Status     string            `json:"status"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Output     map[string]string `json:"output,omitempty"`
+}
+
+// postProcessStep is a line of the -post-process file: files whose content
+// type, guessed from the name, matches Type are run through Processor with
+// Args.
+type postProcessStep struct {
+	Name      string
+	Type      string
+	Processor string
+	Args      []string
+}
+
+// postProcessor runs a step on a stored file and returns its output.
+type postProcessor func(ctx context.Context, step postProcessStep, metadata FileMetadata) (map[string]string, error)
+
+// postProcessors are the processors steps can name, with the number of
+// arguments they take; -1 is any number but at least one.
+var postProcessors = map[string]struct {
+	args int
+	run  postProcessor
+}{
+	"exec":      {-1, execProcessor},
+	"checksums": {1, checksumProcessor},
+	"metadata":  {0, metadataProcessor},
+}
+
+var (
+	// postProcessSteps is the pipeline every completed file runs through,
+	// in order; -post-process sets it.
+	postProcessSteps []postProcessStep
+	// postProcessTimeout bounds each step.
+	postProcessTimeout = 30 * time.Minute
+	// postProcessSlots bounds how many files are processed at once.
+	postProcessSlots = make(chan struct{}, 2)
+)
+
+const (
+	// postProcessStdoutLimit caps the output read from exec steps.
+	postProcessStdoutLimit = 16 << 10
+	// postProcessTextLimit caps text recorded in step outputs and errors.
+	postProcessTextLimit = 1 << 10
+)
+
+// loadPostProcessSteps reads a -post-process file: one "<name> <type>
+// <processor> [args...]" step per line, such as "scan * exec clamdscan -",
+// run in the order of the file. Types are matched as in -chunk-policy. Blank
+// lines and lines starting with # are ignored.
+func loadPostProcessSteps(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var steps []postProcessStep
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: expected <name> <type> <processor> [args...]", line)
+		}
+		step := postProcessStep{Name: fields[0], Type: strings.ToLower(fields[1]), Processor: fields[2], Args: fields[3:]}
+		if names[step.Name] {
+			return fmt.Errorf("line %d: duplicate step name %q", line, step.Name)
+		}
+		names[step.Name] = true
+		if step.Type != "*" && !strings.Contains(step.Type, "/") {
+			return fmt.Errorf("line %d: invalid content type %q", line, step.Type)
+		}
+		processor, ok := postProcessors[step.Processor]
+		switch {
+		case !ok:
+			return fmt.Errorf("line %d: unknown processor %q", line, step.Processor)
+		case processor.args < 0 && len(step.Args) == 0:
+			return fmt.Errorf("line %d: %s needs a command", line, step.Processor)
+		case processor.args >= 0 && len(step.Args) != processor.args:
+			return fmt.Errorf("line %d: %s takes %d arguments", line, step.Processor, processor.args)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	postProcessSteps = steps
+	return nil
+}
+
+// postProcess runs a newly stored file through the steps matching its type
+// in the background, recording each step's status in the file's metadata as
+// it goes. A failed step skips the ones after it, so that a scan can keep a
+// file from later steps such as publishing.
+func postProcess(metadata FileMetadata) {
+	var steps []postProcessStep
+	contentType := fileContentType(metadata.FileName)
+	for _, step := range postProcessSteps {
+		if contentTypeMatches(step.Type, contentType) {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		return
+	}
+	pending := make([]ProcessingStep, len(steps))
+	for i, step := range steps {
+		pending[i] = ProcessingStep{Name: step.Name, Processor: step.Processor, Status: stepPending}
+	}
+	if !recordProcessing(metadata, func(processing []ProcessingStep) []ProcessingStep { return pending }) {
+		return
+	}
+	go runPostProcessing(metadata, steps)
+}
+
+func runPostProcessing(metadata FileMetadata, steps []postProcessStep) {
+	postProcessSlots <- struct{}{}
+	defer func() { <-postProcessSlots }()
+	failed := false
+	for i, step := range steps {
+		result := ProcessingStep{Name: step.Name, Processor: step.Processor, Status: stepSkipped}
+		if !failed {
+			started := timeNow()
+			result.Status, result.StartedAt = stepRunning, &started
+			if !recordProcessing(metadata, setProcessingStep(i, result)) {
+				// The file was deleted or replaced.
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), postProcessTimeout)
+			output, err := postProcessors[step.Processor].run(ctx, step, metadata)
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %v", postProcessTimeout)
+			}
+			cancel()
+			finished := timeNow()
+			result.Status, result.FinishedAt, result.Output = stepSucceeded, &finished, output
+			if err != nil {
+				failed = true
+				result.Status, result.Error = stepFailed, truncateText(err.Error())
+				fmt.Printf("Post-processing step %s of %s failed: %v\n", step.Name, metadata.ID, err)
+				audit(nil, AuditEntry{Action: "process_failed", FileID: metadata.ID, FileName: metadata.FileName, Detail: step.Name + ": " + result.Error})
+			}
+		}
+		if !recordProcessing(metadata, setProcessingStep(i, result)) {
+			return
+		}
+	}
+}
+
+// resumePostProcessing runs the pipeline again for files whose processing
+// was cut short by a restart.
+func resumePostProcessing() {
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		fmt.Println("Error listing files to post-process:", err)
+		return
+	}
+	for _, metadata := range fileInfos {
+		if !ownedLocally(metadata.ID) {
+			continue
+		}
+		for _, step := range metadata.Processing {
+			if step.Status == stepPending || step.Status == stepRunning {
+				postProcess(metadata)
+				break
+			}
+		}
+	}
+}
+
+func setProcessingStep(i int, step ProcessingStep) func([]ProcessingStep) []ProcessingStep {
+	return func(processing []ProcessingStep) []ProcessingStep {
+		if i < len(processing) && processing[i].Name == step.Name {
+			processing[i] = step
+		}
+		return processing
+	}
+}
+
+// recordProcessing applies update to the processing steps recorded for a
+// file, unless it was deleted or replaced by another version since, and
+// reports whether it did.
+func recordProcessing(metadata FileMetadata, update func([]ProcessingStep) []ProcessingStep) bool {
+	recorded := false
+	_, err := fileStore.Update(metadata.ID, func(stored *FileMetadata) (bool, error) {
+		if stored.FileHash != metadata.FileHash {
+			return false, nil
+		}
+		stored.Processing = update(stored.Processing)
+		recorded = true
+		return false, nil
+	})
+	if err != nil {
+		fmt.Printf("Error recording post-processing of %s: %v\n", metadata.ID, err)
+		return false
+	}
+	return recorded
+}
+
+// openStoredContent opens the plaintext of a stored file.
+func openStoredContent(metadata FileMetadata) (io.ReadSeeker, func(), error) {
+	file, err := openStoredFile(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := storedFileReader(file, metadata)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return content, func() { file.Close() }, nil
+}
+
+// execProcessor runs a command with the content of the file on its standard
+// input and its properties in the environment. A non-zero exit fails the
+// step with the end of the command's standard error. Standard output that
+// is a JSON object of strings becomes the step's output; other output is
+// recorded as "stdout".
+func execProcessor(ctx context.Context, step postProcessStep, metadata FileMetadata) (map[string]string, error) {
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+	cmd := exec.CommandContext(ctx, step.Args[0], step.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FILE_ID="+metadata.ID,
+		"FILE_NAME="+metadata.FileName,
+		"FILE_SIZE="+strconv.FormatInt(metadata.FileSize, 10),
+		"FILE_HASH="+metadata.FileHash,
+		"HASH_ALGORITHM="+hashAlgorithmName(metadata),
+		"FILE_OWNER="+metadata.Owner,
+		"CONTENT_TYPE="+fileContentType(metadata.FileName),
+	)
+	stdout := &headBuffer{limit: postProcessStdoutLimit}
+	stderr := &tailBuffer{limit: postProcessTextLimit}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = content, stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	var output map[string]string
+	if json.Unmarshal(stdout.Bytes(), &output) == nil {
+		return output, nil
+	}
+	if text := strings.TrimSpace(stdout.String()); text != "" {
+		return map[string]string{"stdout": truncateText(text)}, nil
+	}
+	return nil, nil
+}
+
+// checksumProcessor exports the checksums of the file in the formats of
+// sha256sum and md5sum, as <id>.sha256 and <id>.md5 in the directory given
+// as its argument, for mirrors and archives that verify copies with those
+// tools. The SHA-256 is computed again for files stored with a tree hash.
+func checksumProcessor(ctx context.Context, step postProcessStep, metadata FileMetadata) (map[string]string, error) {
+	dir := step.Args[0]
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sha256Hex, md5Hex := metadata.FileHash, metadata.FileMD5
+	if !metadata.plainHash() || md5Hex == "" {
+		content, closeFile, err := openStoredContent(metadata)
+		if err != nil {
+			return nil, err
+		}
+		sha256Hash, md5Hash := sha256.New(), md5.New()
+		_, err = io.Copy(io.MultiWriter(sha256Hash, md5Hash), contextReader{ctx, content})
+		closeFile()
+		if err != nil {
+			return nil, err
+		}
+		sha256Hex, md5Hex = hex.EncodeToString(sha256Hash.Sum(nil)), hex.EncodeToString(md5Hash.Sum(nil))
+	}
+	output := make(map[string]string)
+	for _, checksum := range []struct{ ext, hash string }{{"sha256", sha256Hex}, {"md5", md5Hex}} {
+		target := filepath.Join(dir, metadata.ID+"."+checksum.ext)
+		line := fmt.Sprintf("%s  %s\n", checksum.hash, path.Base(metadata.FileName))
+		if err := ioutil.WriteFile(target+".tmp", []byte(line), 0644); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(target+".tmp", target); err != nil {
+			return nil, err
+		}
+		output[checksum.ext] = target
+	}
+	return output, nil
+}
+
+// metadataProcessor records the content type sniffed from the first bytes
+// of the file and, for JPEG, PNG and GIF images, their format and
+// dimensions.
+func metadataProcessor(ctx context.Context, step postProcessStep, metadata FileMetadata) (map[string]string, error) {
+	content, closeFile, err := openStoredContent(metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	output := map[string]string{"contentType": http.DetectContentType(head[:n])}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if config, format, err := image.DecodeConfig(bufio.NewReader(content)); err == nil {
+		output["imageFormat"] = format
+		output["width"] = strconv.Itoa(config.Width)
+		output["height"] = strconv.Itoa(config.Height)
+	}
+	return output, nil
+}
+
+func hashAlgorithmName(metadata FileMetadata) string {
+	if metadata.HashAlgorithm == "" {
+		return hashSHA256
+	}
+	return metadata.HashAlgorithm
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// headBuffer keeps the first limit bytes written to it and discards the
+// rest.
+type headBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string { return string(b.data) }
+
+func truncateText(text string) string {
+	if len(text) <= postProcessTextLimit {
+		return text
+	}
+	return text[:postProcessTextLimit] + "..."
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: reserve the blocks without changing
+// the file size, so a failed write never leaves a file that looks complete.
+const fallocKeepSize = 0x01
+
+// preallocate reserves size bytes for file in as few extents as the
+// filesystem can manage. It is only a hint: filesystems without fallocate
+// support simply allocate as the file is written.
+func preallocate(file *os.File, size int64) {
+	if size > 0 {
+		syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// preallocate is a no-op where fallocate is not available.
+func preallocate(file *os.File, size int64) {}
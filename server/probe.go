@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ProbeResult is the answer of /probe. A GET measures the round trip time;
+// a POST also reports how many bytes of its burst arrived and how long
+// reading them took. ClientTime echoes the t query parameter, so that a
+// client can match answers to requests without keeping state.
+type ProbeResult struct {
+	ClientTime    string    `json:"clientTime,omitempty"`
+	ServerTime    time.Time `json:"serverTime"`
+	ReceivedBytes int64     `json:"receivedBytes"`
+	ReadSeconds   float64   `json:"readSeconds"`
+	// The limits a client tuning its uploads has to stay within.
+	MinChunkSize     int   `json:"minChunkSize"`
+	MaxChunkSize     int   `json:"maxChunkSize"`
+	SmallUploadLimit int64 `json:"smallUploadLimit"`
+	// Compression tells whether chunks of upload groups may be sent
+	// compressed with dictionaries the server trains.
+	Compression bool `json:"compression"`
+}
+
+// probeHandler answers the probe a client runs before uploading to choose
+// its chunk size, parallelism and compression. Bursts are read and thrown
+// away; like chunks they may not exceed -max-chunk-size.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and POST methods are allowed")
+		return
+	}
+	result := ProbeResult{
+		ClientTime:       r.URL.Query().Get("t"),
+		MinChunkSize:     minChunkSize,
+		MaxChunkSize:     maxChunkSize,
+		SmallUploadLimit: smallUploadLimit,
+		Compression:      compressionDictionaries,
+	}
+	if r.Method == "POST" {
+		start := time.Now()
+		received, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error reading probe burst after %d bytes: %v", received, err))
+			return
+		}
+		result.ReceivedBytes, result.ReadSeconds = received, time.Since(start).Seconds()
+	}
+	result.ServerTime = timeNow()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, result)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuarantineRecord describes a chunk that failed verification. DataKept is
+// false when the bytes were not kept: for encrypted uploads (they would be
+// plaintext at rest) or once the quarantine is full.
+type QuarantineRecord struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	FileID       string    `json:"fileId"`
+	ChunkNumber  int       `json:"chunkNumber"`
+	ExpectedHash string    `json:"expectedHash"`
+	ActualHash   string    `json:"actualHash,omitempty"`
+	Size         int64     `json:"size"`
+	ClientIP     string    `json:"clientIp,omitempty"`
+	Reason       string    `json:"reason"`
+	DataKept     bool      `json:"dataKept"`
+}
+
+var (
+	// quarantineMaxSize caps the bytes kept in the quarantine directory;
+	// beyond it only the records are written. 0 disables the quarantine.
+	quarantineMaxSize int64 = 100 << 20
+	quarantineMutex         = &sync.Mutex{}
+)
+
+func quarantineDir() string {
+	return filepath.Join(dataDir, "quarantine")
+}
+
+// quarantineChunk records a rejected chunk and moves its bytes, if rejected
+// names a file holding them, into the quarantine directory. r is nil when the
+// chunk was rejected during assembly.
+func quarantineChunk(r *http.Request, record QuarantineRecord, rejected string) {
+	if quarantineMaxSize <= 0 {
+		return
+	}
+	record.ID = generateUniqueID()
+	record.Time = timeNow().UTC()
+	if r != nil {
+		record.ClientIP = requestActor(r)
+	}
+
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+	if err := os.MkdirAll(quarantineDir(), 0700); err != nil {
+		fmt.Println("Error creating quarantine directory:", err)
+		return
+	}
+	if rejected != "" && quarantineUsage()+record.Size <= quarantineMaxSize {
+		if err := os.Rename(rejected, filepath.Join(quarantineDir(), record.ID+".bin")); err == nil {
+			record.DataKept = true
+		} else {
+			fmt.Println("Error quarantining chunk data:", err)
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(quarantineDir(), record.ID+".json"), data, 0600); err != nil {
+		fmt.Println("Error writing quarantine record:", err)
+		return
+	}
+	fmt.Printf("Quarantined chunk %d of %s: %s\n", record.ChunkNumber, record.FileID, record.Reason)
+}
+
+// spillRejectedChunk writes a rejected chunk held in memory to a file in the
+// quarantine directory for quarantineChunk to keep, returning "" when the
+// quarantine is disabled or the file cannot be written.
+func spillRejectedChunk(data []byte) string {
+	if quarantineMaxSize <= 0 {
+		return ""
+	}
+	if err := os.MkdirAll(quarantineDir(), 0700); err != nil {
+		return ""
+	}
+	file, err := ioutil.TempFile(quarantineDir(), "rejected.*.tmp")
+	if err != nil {
+		return ""
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Println("Error spilling rejected chunk:", err)
+		os.Remove(file.Name())
+		return ""
+	}
+	return file.Name()
+}
+
+// quarantineUsage sums the kept chunk data; the caller must hold
+// quarantineMutex.
+func quarantineUsage() int64 {
+	entries, err := ioutil.ReadDir(quarantineDir())
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".bin") {
+			total += entry.Size()
+		}
+	}
+	return total
+}
+
+func readQuarantineRecords() ([]QuarantineRecord, error) {
+	entries, err := ioutil.ReadDir(quarantineDir())
+	if os.IsNotExist(err) {
+		return []QuarantineRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []QuarantineRecord{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(quarantineDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		var record QuarantineRecord
+		if json.Unmarshal(data, &record) == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// quarantineHandler serves the /admin/quarantine endpoints:
+//
+//	GET    /admin/quarantine            all records, oldest first (?fileId= filters)
+//	GET    /admin/quarantine/{id}       one record
+//	GET    /admin/quarantine/{id}/data  the rejected bytes
+//	DELETE /admin/quarantine/{id}       drop a record and its bytes
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+			return
+		}
+		quarantineMutex.Lock()
+		records, err := readQuarantineRecords()
+		quarantineMutex.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading quarantine: "+err.Error())
+			return
+		}
+		if fileID := r.URL.Query().Get("fileId"); fileID != "" {
+			filtered := []QuarantineRecord{}
+			for _, record := range records {
+				if record.FileID == fileID {
+					filtered = append(filtered, record)
+				}
+			}
+			records = filtered
+		}
+		writeJSON(w, records)
+		return
+	}
+
+	recordID := parts[2]
+	if !validFileID(recordID) || len(parts) > 4 || (len(parts) == 4 && parts[3] != "data") {
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+		return
+	}
+	recordPath := filepath.Join(quarantineDir(), recordID+".json")
+	dataPath := filepath.Join(quarantineDir(), recordID+".bin")
+
+	switch {
+	case r.Method == "DELETE" && len(parts) == 3:
+		quarantineMutex.Lock()
+		err := os.Remove(recordPath)
+		os.Remove(dataPath)
+		quarantineMutex.Unlock()
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Quarantine record not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && len(parts) == 4:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(w, r, dataPath)
+	case r.Method == "GET":
+		data, err := ioutil.ReadFile(recordPath)
+		if err != nil {
+			writeError(w, http.StatusNotFound, codeNotFound, "Quarantine record not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and DELETE methods are allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
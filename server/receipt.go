@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ChunkReceipt is the body of a successful chunk upload. Hash is the SHA-256
+// the server computed over the chunk, so the client can check that what was
+// stored is what it sent; with -defer-chunk-verification the chunk is not
+// hashed on upload, Hash is empty and Verified false. ChunksReceived counts
+// the chunks of the upload stored so far, this one included.
+type ChunkReceipt struct {
+	ChunkNumber    int    `json:"chunkNumber"`
+	Hash           string `json:"hash,omitempty"`
+	Size           int64  `json:"size"`
+	Verified       bool   `json:"verified"`
+	ChunksReceived int    `json:"chunksReceived"`
+	TotalChunks    int    `json:"totalChunks,omitempty"`
+}
+
+// acknowledgeChunk answers a stored chunk with its receipt. hashes must have
+// seen the chunk data unless verification is deferred.
+func acknowledgeChunk(w http.ResponseWriter, metadata FileMetadata, fileID string, chunkNumber int, hashes transferHashes, size int64) {
+	receipt := ChunkReceipt{
+		ChunkNumber:    chunkNumber,
+		Size:           size,
+		Verified:       !deferChunkVerification,
+		ChunksReceived: chunksReceived(fileID),
+		TotalChunks:    metadata.TotalChunks,
+	}
+	if receipt.Verified {
+		receipt.Hash = fmt.Sprintf("%x", hashes.sums()["sha-256"])
+	}
+	writeJSON(w, receipt)
+}
+
+// chunksReceived counts the stored chunks of an upload: chunk files, or the
+// chunks recorded in the manifest of an in-place upload.
+func chunksReceived(fileID string) int {
+	if usesInPlace(fileID) {
+		hashes, _ := readChunkManifest(fileID)
+		return len(hashes)
+	}
+	entries, err := ioutil.ReadDir(uploadTmpDir(fileID))
+	if err != nil {
+		return 0
+	}
+	received := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "part_") && !strings.HasSuffix(entry.Name(), ".tmp") {
+			received++
+		}
+	}
+	return received
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// UploadReport is the body of a successful completion, so that callers can
+// log how well the transfer went.
+type UploadReport struct {
+	ID               string      `json:"id"`
+	FileName         string      `json:"fileName"`
+	Path             string      `json:"path"`
+	URL              string      `json:"url"`
+	TotalBytes       int64       `json:"totalBytes"`
+	ElapsedSeconds   float64     `json:"elapsedSeconds"`
+	Throughput       float64     `json:"throughputBytesPerSecond"`
+	Retransmits      map[int]int `json:"retransmits"`
+	TotalRetransmits int         `json:"totalRetransmits"`
+}
+
+// transferStats tracks an upload from registration to completion: when it
+// started and how often each chunk was sent. Changes go through journal, so
+// that snapshots and the upload log carry them over a restart.
+type transferStats struct {
+	started  time.Time
+	attempts map[int]int
+}
+
+var (
+	transfers     = make(map[string]*transferStats)
+	transferMutex = &sync.Mutex{}
+)
+
+func startTransfer(fileID string) {
+	now := timeNow()
+	journal(walRecord{Event: walStart, FileID: fileID, At: now}, func() {
+		transferMutex.Lock()
+		transfers[fileID] = &transferStats{started: now, attempts: make(map[int]int)}
+		transferMutex.Unlock()
+	})
+}
+
+// recordChunkAttempt counts one received copy of a chunk, whether or not it
+// is accepted.
+func recordChunkAttempt(fileID string, chunkNumber int) {
+	now := timeNow()
+	journal(walRecord{Event: walChunk, FileID: fileID, Chunk: chunkNumber, At: now}, func() {
+		transferMutex.Lock()
+		defer transferMutex.Unlock()
+		stats, ok := transfers[fileID]
+		if !ok {
+			stats = &transferStats{started: now, attempts: make(map[int]int)}
+			transfers[fileID] = stats
+		}
+		stats.attempts[chunkNumber]++
+	})
+}
+
+// finishTransfer builds the report of a committed upload and forgets its
+// statistics.
+func finishTransfer(metadata FileMetadata) UploadReport {
+	var stats *transferStats
+	journal(walRecord{Event: walEnd, FileID: metadata.ID, At: timeNow()}, func() {
+		transferMutex.Lock()
+		stats = transfers[metadata.ID]
+		delete(transfers, metadata.ID)
+		transferMutex.Unlock()
+	})
+
+	report := newUploadReport(metadata)
+	if stats == nil {
+		return report
+	}
+	elapsed := timeNow().Sub(stats.started)
+	report.ElapsedSeconds = elapsed.Seconds()
+	if elapsed > 0 {
+		report.Throughput = float64(metadata.FileSize) / elapsed.Seconds()
+	}
+	for chunkNumber, attempts := range stats.attempts {
+		if attempts > 1 {
+			report.Retransmits[chunkNumber] = attempts - 1
+			report.TotalRetransmits += attempts - 1
+		}
+	}
+	return report
+}
+
+// newUploadReport is the report of a stored file without transfer statistics.
+func newUploadReport(metadata FileMetadata) UploadReport {
+	return UploadReport{
+		ID:          metadata.ID,
+		FileName:    metadata.FileName,
+		Path:        finalFilePath(metadata),
+		URL:         "/download/" + metadata.ID,
+		TotalBytes:  metadata.FileSize,
+		Retransmits: make(map[int]int),
+	}
+}
+
+func forgetTransfer(fileID string) {
+	journal(walRecord{Event: walEnd, FileID: fileID, At: timeNow()}, func() {
+		transferMutex.Lock()
+		delete(transfers, fileID)
+		transferMutex.Unlock()
+	})
+}
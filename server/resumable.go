@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// putFileHandler implements the resumable single-endpoint protocol,
+// PUT /files/{id}, for uploads registered with /register_file. Each request
+// carries one piece of the file with "Content-Range: bytes first-last/total";
+// a piece must start on a chunk boundary and end on one (or at the end of the
+// file), and is stored as the matching chunks. "Content-Range: bytes */total"
+// with an empty body only asks for the progress. Until every byte has arrived
+// the answer is 308 with "Range: bytes=0-<last contiguous byte>"; the piece
+// that completes the file assembles it and returns the file metadata.
+func putFileHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := strings.Split(r.URL.Path, "/")[2]
+	if !validFileID(fileID) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid file ID")
+		return
+	}
+
+	if stored, found, err := lookupFileInfo(fileID); err == nil && found {
+		if authorizeFile(w, r, stored, permissionRead) {
+			writeMetadataResponse(w, stored)
+		}
+		return
+	}
+	metadataMutex.Lock()
+	metadata, ok := filesMetadata[fileID]
+	metadataMutex.Unlock()
+	if !ok && rejectCancelled(w, fileID) {
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+		return
+	}
+	if metadata.GroupID != "" && !groupAccepting(metadata.GroupID) {
+		writeError(w, http.StatusGone, codeGroupClosed, "Upload group is no longer accepting files")
+		return
+	}
+
+	first, last, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if total != metadata.FileSize {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Content-Range total does not match the registered file size of %d bytes", metadata.FileSize))
+		return
+	}
+	if first >= 0 {
+		chunkSize := int64(metadata.ChunkSize)
+		if last >= total || first%chunkSize != 0 || (last+1 != total && (last+1)%chunkSize != 0) {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Pieces must start and end on chunk boundaries (chunk size %d bytes)", chunkSize))
+			return
+		}
+		if r.ContentLength >= 0 && r.ContentLength != last-first+1 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Content-Length does not match Content-Range")
+			return
+		}
+		if !storePiece(w, r, metadata, first, last) {
+			return
+		}
+	}
+
+	received := receivedBytes(metadata)
+	if received == metadata.FileSize {
+		if committed, ok := finishUpload(w, r, metadata); ok {
+			forgetTransfer(committed.ID)
+			writeMetadataResponse(w, committed)
+		}
+		return
+	}
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// parseContentRange parses "bytes first-last/total"; for "bytes */total"
+// first and last are -1.
+func parseContentRange(value string) (int64, int64, int64, error) {
+	errInvalid := errors.New("Content-Range must be \"bytes <first>-<last>/<total>\" or \"bytes */<total>\"")
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, errInvalid
+	}
+	spec := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(spec) != 2 {
+		return 0, 0, 0, errInvalid
+	}
+	total, err := strconv.ParseInt(spec[1], 10, 64)
+	if err != nil || total < 0 {
+		return 0, 0, 0, errInvalid
+	}
+	if spec[0] == "*" {
+		return -1, -1, total, nil
+	}
+	bounds := strings.SplitN(spec[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, errInvalid
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, 0, errInvalid
+	}
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, 0, errInvalid
+	}
+	return first, last, total, nil
+}
+
+// storePiece splits a piece into chunk files. Like a chunk upload, the piece
+// is only kept once it arrived completely and matches any Content-Digest,
+// Content-MD5 or Digest header sent with it.
+func storePiece(w http.ResponseWriter, r *http.Request, metadata FileMetadata, first, last int64) bool {
+	if usesInPlace(metadata.ID) {
+		return storePieceInPlace(w, r, metadata, first, last)
+	}
+	var aead cipher.AEAD
+	if metadata.Encrypted {
+		var err error
+		if aead, err = chunkAEAD(metadata); err != nil {
+			fmt.Println("Error loading data key:", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error loading data key")
+			return false
+		}
+	}
+
+	hashes := newTransferHashes(r.Header)
+	body := io.TeeReader(r.Body, hashes.writer())
+	chunkSize := int64(metadata.ChunkSize)
+	temps := make(map[int]string)
+	defer func() {
+		for _, name := range temps {
+			os.Remove(name)
+		}
+	}()
+
+	for offset := first; offset <= last; offset += chunkSize {
+		size := chunkSize
+		if last+1-offset < size {
+			size = last + 1 - offset
+		}
+		chunkNumber := int(offset/chunkSize) + 1
+		recordChunkAttempt(metadata.ID, chunkNumber)
+		chunkFile, err := createChunkTemp(metadata.ID, chunkNumber)
+		if err != nil {
+			fmt.Printf("Error creating chunk file: %v\n", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error creating file")
+			return false
+		}
+		temps[chunkNumber] = chunkFile.Name()
+
+		if aead != nil {
+			buffer := getBuffer(int(size))
+			data := *buffer
+			var sealed []byte
+			if _, err = io.ReadFull(body, data); err == nil {
+				sealed, err = sealChunk(aead, metadata.ID, chunkNumber, data)
+			}
+			if err == nil {
+				_, err = chunkFile.Write(sealed)
+			}
+			putBuffer(buffer)
+		} else {
+			_, err = io.CopyN(chunkFile, body, size)
+		}
+		if closeErr := chunkFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			writeError(w, http.StatusBadRequest, codeChunkTruncated, "Request body is shorter than Content-Range")
+			return false
+		}
+		if err != nil {
+			fmt.Printf("Error writing chunk file: %v\n", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+			return false
+		}
+	}
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Request body is longer than Content-Range")
+		return false
+	}
+	if err := verifyTransferDigests(r.Header, hashes.sums()); err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestMismatch, err.Error())
+		return false
+	}
+
+	for chunkNumber, name := range temps {
+		if err := os.Rename(name, chunkFilePath(metadata.ID, chunkNumber)); err != nil {
+			fmt.Printf("Error storing chunk file: %v\n", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+			return false
+		}
+		delete(temps, chunkNumber)
+	}
+	return true
+}
+
+// receivedBytes is the length of the contiguous prefix of an upload whose
+// chunks have been stored.
+func receivedBytes(metadata FileMetadata) int64 {
+	chunks := 0
+	if usesInPlace(metadata.ID) {
+		chunks = receivedInPlace(metadata.ID, metadata.TotalChunks)
+	}
+	for chunks < metadata.TotalChunks {
+		if _, err := os.Stat(chunkFilePath(metadata.ID, chunks+1)); err != nil {
+			break
+		}
+		chunks++
+	}
+	received := int64(chunks) * int64(metadata.ChunkSize)
+	if received > metadata.FileSize {
+		received = metadata.FileSize
+	}
+	return received
+}
+
+func writeMetadataResponse(w http.ResponseWriter, metadata FileMetadata) {
+	response, err := json.Marshal(metadata.public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
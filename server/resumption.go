@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resumptionLifetime is how long a resumption token is accepted; it is set
+// with -resumption-lifetime.
+var resumptionLifetime = 7 * 24 * time.Hour
+
+// resumption is the signed content of a resumption token: enough to continue
+// an upload without anything the registering client kept.
+type resumption struct {
+	FileID    string    `json:"fileId"`
+	FileSize  int64     `json:"fileSize"`
+	ChunkSize int       `json:"chunkSize"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// resumptionToken encodes and signs a resumption for an upload, like session
+// cookies with the link key, so every server sharing it accepts the token.
+func resumptionToken(metadata FileMetadata) (string, time.Time) {
+	expiresAt := timeNow().Add(resumptionLifetime).UTC().Truncate(time.Second)
+	payload, _ := json.Marshal(resumption{FileID: metadata.ID, FileSize: metadata.FileSize, ChunkSize: metadata.ChunkSize, ExpiresAt: expiresAt})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + resumptionSignature(encoded), expiresAt
+}
+
+func resumptionSignature(encoded string) string {
+	mac := hmac.New(sha256.New, linkKey)
+	fmt.Fprintf(mac, "resume\n%s", encoded)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseResumptionToken checks the signature of a token and decodes it; the
+// caller checks the expiry.
+func parseResumptionToken(token string) (resumption, bool) {
+	var decoded resumption
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(resumptionSignature(encoded))) {
+		return decoded, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &decoded) != nil || !validFileID(decoded.FileID) {
+		return decoded, false
+	}
+	return decoded, true
+}
+
+// ResumptionStatus answers POST /resume_upload. Complete uploads have no
+// ReceivedChunks; their metadata is in File.
+type ResumptionStatus struct {
+	FileID         string        `json:"fileId"`
+	FileName       string        `json:"fileName"`
+	FileSize       int64         `json:"fileSize"`
+	FileHash       string        `json:"fileHash"`
+	ChunkSize      int           `json:"chunkSize"`
+	TotalChunks    int           `json:"totalChunks"`
+	ReceivedChunks []int         `json:"receivedChunks"`
+	Complete       bool          `json:"complete"`
+	File           *FileMetadata `json:"file,omitempty"`
+	ExpiresAt      time.Time     `json:"expiresAt"`
+}
+
+// resumeUploadHandler serves POST /resume_upload with {"resumptionToken"}
+// from a registration: it tells a client that kept nothing but the token,
+// such as a CI job restarted on another machine, which chunks of the upload
+// the server already has, so it sends only the others and completes it.
+func resumeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	var request struct {
+		ResumptionToken string `json:"resumptionToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		return
+	}
+	token, ok := parseResumptionToken(request.ResumptionToken)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid resumption token")
+		return
+	}
+	if !timeNow().Before(token.ExpiresAt) {
+		writeError(w, http.StatusGone, codeResumptionExpired, "Resumption token expired at "+token.ExpiresAt.Format(time.RFC3339))
+		return
+	}
+
+	status := ResumptionStatus{FileID: token.FileID, FileSize: token.FileSize, ChunkSize: token.ChunkSize, ExpiresAt: token.ExpiresAt}
+	if stored, found, err := lookupFileInfo(token.FileID); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	} else if found {
+		if !authorizeFile(w, r, stored, permissionRead) {
+			return
+		}
+		public := stored.public()
+		status.FileName, status.FileHash, status.TotalChunks = stored.FileName, stored.FileHash, stored.TotalChunks
+		status.Complete, status.File = true, &public
+		writeJSON(w, status)
+		return
+	}
+	metadataMutex.Lock()
+	metadata, ok := filesMetadata[token.FileID]
+	metadataMutex.Unlock()
+	if !ok && rejectCancelled(w, token.FileID) {
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found; it may have been evicted")
+		return
+	}
+	status.FileName, status.FileHash, status.TotalChunks = metadata.FileName, metadata.FileHash, metadata.TotalChunks
+	status.ReceivedChunks = receivedChunks(metadata)
+	writeJSON(w, status)
+}
+
+// receivedChunks lists the chunks of an upload in progress the server has,
+// in order.
+func receivedChunks(metadata FileMetadata) []int {
+	received := []int{}
+	if usesInPlace(metadata.ID) {
+		hashes, err := readChunkManifest(metadata.ID)
+		if err != nil {
+			return received
+		}
+		for chunkNumber := range hashes {
+			if chunkNumber >= 1 && chunkNumber <= metadata.TotalChunks {
+				received = append(received, chunkNumber)
+			}
+		}
+		sort.Ints(received)
+		return received
+	}
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		if _, err := os.Stat(chunkFilePath(metadata.ID, chunkNumber)); err == nil {
+			received = append(received, chunkNumber)
+		}
+	}
+	return received
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles decide which endpoints a principal may use, before file ACLs decide
+// which files. Admins may use everything, including the /admin/ endpoints,
+// and pass every ACL check; uploaders may use everything else; readers may
+// list, search and download; principals with no role may only log in.
+const (
+	roleNone     = "none"
+	roleReader   = "reader"
+	roleUploader = "uploader"
+	roleAdmin    = "admin"
+)
+
+// roleRank orders roles; a role allows whatever a lower ranked one does.
+var roleRank = map[string]int{roleNone: 1, roleReader: 2, roleUploader: 3, roleAdmin: 4}
+
+// parseRole accepts the role names, and read-only, the name login sessions
+// used for readers before there were other ways to assign roles.
+func parseRole(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if name == "read-only" {
+		return roleReader, true
+	}
+	return name, roleRank[name] != 0
+}
+
+const (
+	rolesDB = "roles.json"
+	// rolesRefreshInterval bounds how long a role assigned through another
+	// server sharing the metadata store takes to apply here.
+	rolesRefreshInterval = 30 * time.Second
+)
+
+var (
+	// fileRoles holds the -roles-file assignments, storeRoles a cache of
+	// those made through /admin/roles, which take precedence.
+	fileRoles       = make(map[string]string)
+	storeRoles      map[string]string
+	storeRolesRead  time.Time
+	storeRolesMutex = &sync.Mutex{}
+	// jsonRolesMutex guards rolesDB of the JSON store.
+	jsonRolesMutex = &sync.Mutex{}
+)
+
+// loadRoles reads "<role> <principal>" lines; blank lines and lines starting
+// with # are ignored. The principal * sets the role of everyone without one
+// of their own, anonymous requests included.
+func loadRoles(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected \"<admin|uploader|reader|none> <principal>\"", line)
+		}
+		role, ok := parseRole(fields[0])
+		if err := checkRoleAssignment(fields[1], role, ok); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		fileRoles[fields[1]] = role
+	}
+	return scanner.Err()
+}
+
+func checkRoleAssignment(principal, role string, known bool) error {
+	if !known {
+		return errors.New("unknown role; expected admin, uploader, reader or none")
+	}
+	if principal == everyone && role == roleAdmin {
+		return errors.New("everyone cannot be admin")
+	}
+	return nil
+}
+
+// assignedRoles returns the roles assigned through the metadata store,
+// reading them again every rolesRefreshInterval.
+func assignedRoles() map[string]string {
+	storeRolesMutex.Lock()
+	defer storeRolesMutex.Unlock()
+	if storeRoles == nil || timeNow().Sub(storeRolesRead) >= rolesRefreshInterval {
+		roles, err := fileStore.Roles()
+		if err != nil {
+			// Keep the known roles until the store answers again.
+			fmt.Println("Error reading roles:", err)
+			if storeRoles == nil {
+				storeRoles = make(map[string]string)
+			}
+		} else {
+			storeRoles = roles
+		}
+		storeRolesRead = timeNow()
+	}
+	return storeRoles
+}
+
+// assignedRole returns the role assigned to principal itself, through the
+// store or the roles file.
+func assignedRole(principal string) (string, bool) {
+	if role, ok := assignedRoles()[principal]; ok {
+		return role, true
+	}
+	role, ok := fileRoles[principal]
+	return role, ok
+}
+
+// principalRole returns the role of principal, "" for anonymous requests:
+// its own, else the one of *, else uploader, which every request had before
+// roles existed.
+func principalRole(principal string) string {
+	if principal != "" {
+		if role, ok := assignedRole(principal); ok {
+			return role
+		}
+	}
+	if role, ok := assignedRole(everyone); ok {
+		return role
+	}
+	return roleUploader
+}
+
+// anyAdmin reports whether some principal is assigned the admin role.
+func anyAdmin() bool {
+	for _, roles := range []map[string]string{assignedRoles(), fileRoles} {
+		for _, role := range roles {
+			if role == roleAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// endpointRoles lists the role each endpoint requires, by path prefix: read
+// for GET and HEAD, change for other methods. Other endpoints require reader
+// to read and uploader to change. The /admin/ endpoints check for the admin
+// role themselves, as they are disabled when nobody can have it.
+var endpointRoles = []struct {
+	prefix       string
+	read, change string
+}{
+	{"/admin/", "", ""},
+	{"/login", "", ""},
+	{"/logout", "", ""},
+	// Session tokens are issued to whoever authenticated, whatever its role.
+	{"/v2/session", "", ""},
+	{"/openapi.json", "", ""},
+	{"/capabilities", "", ""},
+	// Signed download links carry their own authorization.
+	{"/shared/", "", ""},
+	// POST /download_archive only reads.
+	{"/download_archive", roleReader, roleReader},
+	{"/search", roleReader, roleReader},
+}
+
+func endpointRole(r *http.Request) string {
+	change := r.Method != "GET" && r.Method != "HEAD"
+	// Readers announce the files they downloaded to other peers.
+	if strings.HasPrefix(r.URL.Path, "/files/") && strings.HasSuffix(r.URL.Path, "/peers") {
+		return roleReader
+	}
+	for _, endpoint := range endpointRoles {
+		if strings.HasPrefix(r.URL.Path, endpoint.prefix) {
+			if change {
+				return endpoint.change
+			}
+			return endpoint.read
+		}
+	}
+	if change {
+		return roleUploader
+	}
+	return roleReader
+}
+
+// withRoles refuses requests whose principal's role is below the one the
+// endpoint requires.
+func withRoles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if required := endpointRole(r); required != "" {
+			principal, role := requestIdentity(r)
+			if roleRank[role] < roleRank[required] {
+				if principal == "" {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeError(w, http.StatusUnauthorized, codeUnauthorized, fmt.Sprintf("Requires the %s role; authenticate first", required))
+					return
+				}
+				writeError(w, http.StatusForbidden, codeAccessDenied, fmt.Sprintf("Requires the %s role; %s has the %s role", required, principal, role))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RoleAssignment is an entry of GET /admin/roles. Source is "store" for
+// roles assigned through /admin/roles and "file" for the -roles-file.
+type RoleAssignment struct {
+	Principal string `json:"principal"`
+	Role      string `json:"role"`
+	Source    string `json:"source"`
+}
+
+// rolesHandler serves the /admin/roles endpoints:
+//
+//	GET    /admin/roles              every assignment
+//	PUT    /admin/roles/{principal}  assign {"role": ...}, overriding the roles file
+//	DELETE /admin/roles/{principal}  remove the assignment made here
+//
+// Assignments are kept in the metadata store, so servers sharing it share
+// them.
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	principal := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/roles"), "/")
+	switch {
+	case principal == "" && r.Method == "GET":
+		stored, err := fileStore.Roles()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading roles: "+err.Error())
+			return
+		}
+		assignments := []RoleAssignment{}
+		for principal, role := range fileRoles {
+			if _, ok := stored[principal]; !ok {
+				assignments = append(assignments, RoleAssignment{Principal: principal, Role: role, Source: "file"})
+			}
+		}
+		for principal, role := range stored {
+			assignments = append(assignments, RoleAssignment{Principal: principal, Role: role, Source: "store"})
+		}
+		sort.Slice(assignments, func(i, j int) bool { return assignments[i].Principal < assignments[j].Principal })
+		writeJSON(w, assignments)
+	case principal != "" && r.Method == "PUT":
+		var request struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid role: "+err.Error())
+			return
+		}
+		role, ok := parseRole(request.Role)
+		if err := checkRoleAssignment(principal, role, ok); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if !setRole(w, principal, role) {
+			return
+		}
+		audit(r, AuditEntry{Action: "role_assigned", Detail: principal + " as " + role})
+		writeJSON(w, RoleAssignment{Principal: principal, Role: role, Source: "store"})
+	case principal != "" && r.Method == "DELETE":
+		if _, ok := assignedRoles()[principal]; !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "No role is assigned to "+principal+" through /admin/roles")
+			return
+		}
+		if !setRole(w, principal, "") {
+			return
+		}
+		audit(r, AuditEntry{Action: "role_removed", Detail: principal})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET on /admin/roles and PUT or DELETE on /admin/roles/{principal} are allowed")
+	}
+}
+
+// setRole saves an assignment and applies it here at once.
+func setRole(w http.ResponseWriter, principal, role string) bool {
+	if err := fileStore.SetRole(principal, role); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error saving role: "+err.Error())
+		return false
+	}
+	storeRolesMutex.Lock()
+	storeRoles = nil
+	storeRolesMutex.Unlock()
+	return true
+}
+
+func (jsonStore) Roles() (map[string]string, error) {
+	jsonRolesMutex.Lock()
+	defer jsonRolesMutex.Unlock()
+	return readRolesDB()
+}
+
+func (jsonStore) SetRole(principal, role string) error {
+	jsonRolesMutex.Lock()
+	defer jsonRolesMutex.Unlock()
+	roles, err := readRolesDB()
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		delete(roles, principal)
+	} else {
+		roles[principal] = role
+	}
+	data, err := json.MarshalIndent(roles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dataDir, rolesDB), data, 0644)
+}
+
+func readRolesDB() (map[string]string, error) {
+	roles := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, rolesDB))
+	if os.IsNotExist(err) {
+		return roles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// scrubInterval is how often every stored file is read again and
+	// checked against its hash, set with -scrub-interval; 0 disables the
+	// scrubber.
+	scrubInterval time.Duration
+	// scrubRate caps the bytes per second the scrubber reads, so that it
+	// does not compete with uploads and downloads for the disk.
+	scrubRate int64 = 50 << 20
+	// scrubWebhook is a URL that receives a JSON CorruptionEvent whenever a
+	// check finds a file corrupt that was not already known to be.
+	scrubWebhook string
+)
+
+// scrubPollInterval is how often the scrubber looks for files whose last
+// check is older than scrubInterval.
+const scrubPollInterval = time.Minute
+
+// throttleSlice is the most a throttled reader reads at once, so that the
+// rate is kept over short periods too.
+const throttleSlice = 64 * 1024
+
+// ScrubStatus answers GET /admin/scrub: the scrubber's counters since the
+// server started, and the stored files whose latest check failed.
+type ScrubStatus struct {
+	Enabled            bool           `json:"enabled"`
+	IntervalSeconds    float64        `json:"intervalSeconds"`
+	RateBytesPerSecond int64          `json:"rateBytesPerSecond"`
+	Running            bool           `json:"running"`
+	CurrentFileID      string         `json:"currentFileId,omitempty"`
+	FilesChecked       int64          `json:"filesChecked"`
+	BytesChecked       int64          `json:"bytesChecked"`
+	FailuresDetected   int64          `json:"failuresDetected"`
+	LastCheckAt        *time.Time     `json:"lastCheckAt,omitempty"`
+	CorruptFiles       []FileMetadata `json:"corruptFiles"`
+}
+
+// CorruptionEvent is posted to -scrub-webhook.
+type CorruptionEvent struct {
+	Event  string          `json:"event"`
+	Node   string          `json:"node,omitempty"`
+	Report IntegrityReport `json:"report"`
+}
+
+var (
+	scrubStats      ScrubStatus
+	scrubStatsMutex = &sync.Mutex{}
+	webhookClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+func startScrubber() {
+	go func() {
+		for {
+			scrubDueFiles()
+			time.Sleep(scrubPollInterval)
+		}
+	}()
+}
+
+// scrubDueFiles checks the stored files of this node not verified within
+// scrubInterval, those verified longest ago first, so that a restart carries
+// on where the scrubber stopped.
+func scrubDueFiles() {
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		fmt.Println("Error listing files to scrub:", err)
+		return
+	}
+	type dueFile struct {
+		metadata FileMetadata
+		verified time.Time
+	}
+	due := make([]dueFile, 0)
+	cutoff := timeNow().Add(-scrubInterval)
+	for _, metadata := range fileInfos {
+		if !ownedLocally(metadata.ID) {
+			continue
+		}
+		if verified := lastVerified(metadata); verified.Before(cutoff) {
+			due = append(due, dueFile{metadata, verified})
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].verified.Before(due[j].verified) })
+	for _, file := range due {
+		scrubFile(file.metadata)
+	}
+}
+
+// lastVerified is when the file was last checked, or else when it was
+// written, since its hash was checked then. A file missing on disk is due
+// right away.
+func lastVerified(metadata FileMetadata) time.Time {
+	if metadata.Integrity != nil {
+		return metadata.Integrity.CheckedAt
+	}
+	return storedModTime(metadata)
+}
+
+// scrubFile checks one file, unless another server sharing the metadata
+// store is checking it.
+func scrubFile(metadata FileMetadata) {
+	unlock, acquired, err := fileStore.TryLock("scrub:" + metadata.ID)
+	if err != nil || !acquired {
+		return
+	}
+	defer unlock()
+
+	scrubStatsMutex.Lock()
+	scrubStats.Running, scrubStats.CurrentFileID = true, metadata.ID
+	scrubStatsMutex.Unlock()
+	report := checkIntegrity(metadata, scrubRate)
+	scrubStatsMutex.Lock()
+	scrubStats.Running, scrubStats.CurrentFileID = false, ""
+	scrubStats.FilesChecked++
+	scrubStats.BytesChecked += report.CheckedBytes
+	if !report.Passed {
+		scrubStats.FailuresDetected++
+	}
+	checkedAt := report.CheckedAt
+	scrubStats.LastCheckAt = &checkedAt
+	scrubStatsMutex.Unlock()
+
+	if err := recordIntegrity(report); err != nil {
+		fmt.Println("Error recording integrity check:", err)
+	}
+}
+
+// reportCorruption logs, audits and posts to -scrub-webhook a file found
+// corrupt.
+func reportCorruption(report IntegrityReport) {
+	fmt.Printf("Integrity check of %s failed: %s\n", report.FileID, report.Error)
+	audit(nil, AuditEntry{Action: "corruption_detected", FileID: report.FileID, FileName: report.FileName, Size: report.ExpectedSize, Detail: report.Error})
+	if scrubWebhook == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(CorruptionEvent{Event: "corruption_detected", Node: selfNode, Report: report})
+		if err != nil {
+			fmt.Println("Error encoding corruption event:", err)
+			return
+		}
+		resp, err := webhookClient.Post(scrubWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("Error posting corruption event:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			fmt.Printf("Corruption event webhook answered %s\n", resp.Status)
+		}
+	}()
+}
+
+// scrubHandler serves GET /admin/scrub.
+func scrubHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	scrubStatsMutex.Lock()
+	status := scrubStats
+	scrubStatsMutex.Unlock()
+	status.Enabled = scrubInterval > 0
+	status.IntervalSeconds, status.RateBytesPerSecond = scrubInterval.Seconds(), scrubRate
+
+	fileInfos, err := fileStore.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	status.CorruptFiles = make([]FileMetadata, 0)
+	for _, metadata := range fileInfos {
+		if metadata.Integrity != nil && !metadata.Integrity.Passed {
+			status.CorruptFiles = append(status.CorruptFiles, metadata.public())
+		}
+	}
+	sort.Slice(status.CorruptFiles, func(i, j int) bool { return status.CorruptFiles[i].ID < status.CorruptFiles[j].ID })
+	writeJSON(w, status)
+}
+
+// throttledReader reads no faster than rate bytes per second.
+type throttledReader struct {
+	reader io.Reader
+	rate   int64
+	next   time.Time
+}
+
+// throttle wraps reader in a rate limit, if rate is positive.
+func throttle(reader io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return reader
+	}
+	return &throttledReader{reader: reader, rate: rate}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleSlice {
+		p = p[:throttleSlice]
+	}
+	n, err := t.reader.Read(p)
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / float64(t.rate) * float64(time.Second)))
+	time.Sleep(t.next.Sub(now))
+	return n, err
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+	// searchIndexMaxAge bounds how long the index may miss changes made by
+	// other servers sharing the metadata store; this server's own changes
+	// invalidate it right away.
+	searchIndexMaxAge = 30 * time.Second
+)
+
+// searchIndex is an inverted index over the metadata of every stored file.
+type searchIndex struct {
+	built time.Time
+	files map[string]FileMetadata
+	// tokens maps each lower case word of a file name to the files whose
+	// name contains it; vocabulary holds the same words sorted, for prefix
+	// lookups.
+	tokens     map[string][]string
+	vocabulary []string
+	// text and textVocabulary are the same for the words of file contents,
+	// as far as -index-content has extracted them.
+	text           map[string][]string
+	textVocabulary []string
+	// tags maps "key" and "key=value" to the files carrying that tag.
+	tags map[string][]string
+	// byHash and bySize list every file ID ordered by hash and by size.
+	byHash []string
+	bySize []string
+}
+
+var (
+	currentSearchIndex *searchIndex
+	// searchIndexGeneration counts invalidations, so that an index built
+	// from a listing taken before a change is not kept.
+	searchIndexGeneration int
+	searchIndexMutex      = &sync.Mutex{}
+)
+
+// invalidateSearchIndex makes the next search rebuild the index. The
+// metadata stores call it after every change, while holding their own
+// locks, so searchIndexMutex is never held while reading the store.
+func invalidateSearchIndex() {
+	searchIndexMutex.Lock()
+	currentSearchIndex = nil
+	searchIndexGeneration++
+	searchIndexMutex.Unlock()
+}
+
+func loadSearchIndex() (*searchIndex, error) {
+	searchIndexMutex.Lock()
+	index, generation := currentSearchIndex, searchIndexGeneration
+	searchIndexMutex.Unlock()
+	if index != nil && timeNow().Sub(index.built) < searchIndexMaxAge {
+		return index, nil
+	}
+	files, err := fileStore.List()
+	if err != nil {
+		return nil, err
+	}
+	index = buildSearchIndex(files)
+	searchIndexMutex.Lock()
+	if generation == searchIndexGeneration {
+		currentSearchIndex = index
+	}
+	searchIndexMutex.Unlock()
+	return index, nil
+}
+
+func buildSearchIndex(files map[string]FileMetadata) *searchIndex {
+	index := &searchIndex{
+		built:  timeNow(),
+		files:  files,
+		tokens: make(map[string][]string),
+		text:   make(map[string][]string),
+		tags:   make(map[string][]string),
+	}
+	for id, metadata := range files {
+		for _, token := range nameTokens(metadata.FileName) {
+			index.tokens[token] = append(index.tokens[token], id)
+		}
+		for key, value := range metadata.Tags {
+			index.tags[key] = append(index.tags[key], id)
+			index.tags[key+"="+value] = append(index.tags[key+"="+value], id)
+		}
+		index.byHash = append(index.byHash, id)
+		index.bySize = append(index.bySize, id)
+	}
+	textIndexMutex.Lock()
+	for id, indexed := range textIndex {
+		if metadata, ok := files[id]; ok && metadata.FileHash == indexed.FileHash {
+			for _, word := range indexed.Words {
+				index.text[word] = append(index.text[word], id)
+			}
+		}
+	}
+	textIndexMutex.Unlock()
+	for token := range index.tokens {
+		index.vocabulary = append(index.vocabulary, token)
+	}
+	sort.Strings(index.vocabulary)
+	for word := range index.text {
+		index.textVocabulary = append(index.textVocabulary, word)
+	}
+	sort.Strings(index.textVocabulary)
+	sort.Slice(index.byHash, func(i, j int) bool {
+		return strings.ToLower(files[index.byHash[i]].FileHash) < strings.ToLower(files[index.byHash[j]].FileHash)
+	})
+	sort.Slice(index.bySize, func(i, j int) bool {
+		return files[index.bySize[i]].FileSize < files[index.bySize[j]].FileSize
+	})
+	return index
+}
+
+// nameTokens splits a file name into distinct lower case words, so that
+// "reports/Q3-summary.pdf" is found by "q3", "summary" or "pdf".
+func nameTokens(name string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, token := range strings.FieldsFunc(strings.ToLower(name), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// searchTerm narrows the results to the files it matches, with a score per
+// file for terms that rank results.
+type searchTerm func(index *searchIndex) map[string]float64
+
+// parseSearchQuery parses space separated terms, all of which must match:
+//
+//	word               a word of the file name or content starts with word
+//	name:word          a word of the file name starts with word
+//	text:word          a word of the content starts with word
+//	tag:key            the file has the tag
+//	tag:key=value      the tag has this value
+//	hash:prefix        the SHA-256 of the file starts with prefix
+//	size:>10MB         also >=, <, <=, an exact size or a range 1MB..2GB
+func parseSearchQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, field := range strings.Fields(query) {
+		kind, value, qualified := strings.Cut(field, ":")
+		if !qualified {
+			kind, value = "", field
+		}
+		if value == "" {
+			return nil, fmt.Errorf("Empty %s term", kind)
+		}
+		switch kind {
+		case "", "name", "text":
+			for _, token := range nameTokens(value) {
+				terms = append(terms, wordTerm(token, kind != "text", kind != "name"))
+			}
+		case "tag":
+			key, _, _ := strings.Cut(value, "=")
+			if !validTagKey(key) {
+				return nil, fmt.Errorf("Invalid tag key %q", key)
+			}
+			terms = append(terms, tagTerm(value))
+		case "hash":
+			if len(value) > 64 || strings.Trim(strings.ToLower(value), "0123456789abcdef") != "" {
+				return nil, fmt.Errorf("Invalid hash prefix %q", value)
+			}
+			terms = append(terms, hashTerm(strings.ToLower(value)))
+		case "size":
+			low, high, err := parseSizeRange(value)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, sizeTerm(low, high))
+		default:
+			return nil, fmt.Errorf("Unknown search term %q", kind+":")
+		}
+	}
+	return terms, nil
+}
+
+// wordTerm matches the words of file names, contents or both. It scores a
+// file 2 when a word of its name is token and 1 when one only starts with
+// it, and half that for words of its content, whichever is highest.
+func wordTerm(token string, names, contents bool) searchTerm {
+	return func(index *searchIndex) map[string]float64 {
+		matches := make(map[string]float64)
+		if names {
+			matchWords(index.vocabulary, index.tokens, token, 2, matches)
+		}
+		if contents {
+			matchWords(index.textVocabulary, index.text, token, 1, matches)
+		}
+		return matches
+	}
+}
+
+// matchWords scores the files listed under words starting with token,
+// exact for the word token itself and half that for longer words, keeping
+// the highest score of every file in matches.
+func matchWords(vocabulary []string, files map[string][]string, token string, exact float64, matches map[string]float64) {
+	for i := sort.SearchStrings(vocabulary, token); i < len(vocabulary) && strings.HasPrefix(vocabulary[i], token); i++ {
+		score := exact / 2
+		if vocabulary[i] == token {
+			score = exact
+		}
+		for _, id := range files[vocabulary[i]] {
+			if score > matches[id] {
+				matches[id] = score
+			}
+		}
+	}
+}
+
+func tagTerm(tag string) searchTerm {
+	return func(index *searchIndex) map[string]float64 {
+		matches := make(map[string]float64)
+		for _, id := range index.tags[tag] {
+			matches[id] = 0
+		}
+		return matches
+	}
+}
+
+func hashTerm(prefix string) searchTerm {
+	return func(index *searchIndex) map[string]float64 {
+		hashOf := func(i int) string { return strings.ToLower(index.files[index.byHash[i]].FileHash) }
+		matches := make(map[string]float64)
+		for i := sort.Search(len(index.byHash), func(i int) bool { return hashOf(i) >= prefix }); i < len(index.byHash) && strings.HasPrefix(hashOf(i), prefix); i++ {
+			matches[index.byHash[i]] = 0
+		}
+		return matches
+	}
+}
+
+// sizeTerm matches sizes from low to high, both included.
+func sizeTerm(low, high int64) searchTerm {
+	return func(index *searchIndex) map[string]float64 {
+		sizeOf := func(i int) int64 { return index.files[index.bySize[i]].FileSize }
+		matches := make(map[string]float64)
+		for i := sort.Search(len(index.bySize), func(i int) bool { return sizeOf(i) >= low }); i < len(index.bySize) && sizeOf(i) <= high; i++ {
+			matches[index.bySize[i]] = 0
+		}
+		return matches
+	}
+}
+
+// parseSizeRange parses the value of a size: term into inclusive bounds.
+func parseSizeRange(value string) (int64, int64, error) {
+	var low, high int64 = 0, 1<<63 - 1
+	var err error
+	switch {
+	case strings.Contains(value, ".."):
+		from, to, _ := strings.Cut(value, "..")
+		if from != "" {
+			low, err = parseByteSize(from)
+		}
+		if err == nil && to != "" {
+			high, err = parseByteSize(to)
+		}
+	case strings.HasPrefix(value, ">="):
+		low, err = parseByteSize(value[2:])
+	case strings.HasPrefix(value, "<="):
+		high, err = parseByteSize(value[2:])
+	case strings.HasPrefix(value, ">"):
+		low, err = parseByteSize(value[1:])
+		low++
+	case strings.HasPrefix(value, "<"):
+		high, err = parseByteSize(value[1:])
+		high--
+	default:
+		low, err = parseByteSize(value)
+		high = low
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return low, high, nil
+}
+
+// parseByteSize parses sizes such as "512", "64KB" or "1.5G"; units are
+// powers of 1024.
+func parseByteSize(size string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(size), "B")
+	multiplier := 1.0
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 || value*multiplier >= 1<<62 {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	return int64(value * multiplier), nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// SearchResult is a file matching a search, with its rank score: 2 for
+// every name word matched exactly and 1 for every one matched by prefix, and
+// half that for words matched in the content.
+type SearchResult struct {
+	FileMetadata
+	Score float64 `json:"score"`
+}
+
+// SearchResponse is one page of search results, best first.
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchHandler serves GET /search?q=...&offset=...&limit=..., listing the
+// readable files that match every term of q, highest score first and then
+// by name.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received search request for:", r.URL.String())
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	query := r.URL.Query()
+	terms, err := parseSearchQuery(query.Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	offset, limit := 0, defaultSearchLimit
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxSearchLimit {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+	}
+
+	index, err := loadSearchIndex()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	var scores map[string]float64
+	for _, term := range terms {
+		matches := term(index)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if match, ok := matches[id]; ok {
+				scores[id] = score + match
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	if scores == nil {
+		scores = make(map[string]float64, len(index.files))
+		for id := range index.files {
+			scores[id] = 0
+		}
+	}
+
+	results := []SearchResult{}
+	for id, score := range scores {
+		if metadata := index.files[id]; canAccess(r, metadata, permissionRead) {
+			results = append(results, SearchResult{FileMetadata: metadata.public(), Score: score})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].FileName != results[j].FileName {
+			return results[i].FileName < results[j].FileName
+		}
+		return results[i].ID < results[j].ID
+	})
+	response := SearchResponse{Query: query.Get("q"), Total: len(results), Offset: offset, Limit: limit}
+	if offset < len(results) {
+		response.Results = results[offset:min(offset+limit, len(results))]
+	} else {
+		response.Results = []SearchResult{}
+	}
+	writeJSON(w, response)
+}
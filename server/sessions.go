@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An upload session survives a restart: its metadata is kept in session.json
+// next to its chunks, and what was received is the chunk files themselves,
+// which are only renamed into place once verified (or, for in-place uploads,
+// the chunk manifest written after each chunk is synced). Group members are
+// not kept, as their group only lives in memory.
+const sessionFileName = "session.json"
+
+func sessionPath(fileID string) string {
+	return filepath.Join(uploadTmpDir(fileID), sessionFileName)
+}
+
+// saveSession writes the metadata of an upload in progress. It holds the
+// wrapped data key of encrypted uploads, so only the server may read it.
+func saveSession(metadata FileMetadata) error {
+	if err := os.MkdirAll(uploadTmpDir(metadata.ID), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	tmp := sessionPath(metadata.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sessionPath(metadata.ID))
+}
+
+// restoreSessions brings back the uploads in progress found under tmp/ at
+// startup. Chunk files that were cut short by a crash are dropped so that
+// the client sends them again; directories without a session are left to
+// the expired uploads eviction hook.
+func restoreSessions() (int, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dataDir, "tmp"))
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !validFileID(entry.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(sessionPath(entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return restored, err
+		}
+		var metadata FileMetadata
+		if err := json.Unmarshal(data, &metadata); err != nil || metadata.ID != entry.Name() {
+			fmt.Println("Ignoring invalid upload session in", entry.Name())
+			continue
+		}
+		_, stored, err := lookupFileInfo(metadata.ID)
+		if err != nil {
+			return restored, err
+		}
+		if stored {
+			// Completed, but the chunks were not cleaned up before the restart.
+			os.RemoveAll(uploadTmpDir(metadata.ID))
+			continue
+		}
+		if !usesInPlace(metadata.ID) {
+			dropPartialChunks(metadata)
+		}
+		metadataMutex.Lock()
+		filesMetadata[metadata.ID] = metadata
+		metadataMutex.Unlock()
+		startTransfer(metadata.ID)
+		scheduleDeadline(metadata)
+		restored++
+	}
+	return restored, nil
+}
+
+// dropPartialChunks removes leftover temporary chunk files and chunk files
+// whose size does not match their chunk.
+func dropPartialChunks(metadata FileMetadata) {
+	entries, err := ioutil.ReadDir(uploadTmpDir(metadata.ID))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "part_") {
+			continue
+		}
+		path := filepath.Join(uploadTmpDir(metadata.ID), name)
+		chunkNumber, err := strconv.Atoi(strings.TrimPrefix(name, "part_"))
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		expected := expectedChunkSize(metadata, chunkNumber) + chunkStorageOverhead(metadata)
+		if chunkNumber < 1 || chunkNumber > metadata.TotalChunks || entry.Size() != expected {
+			fmt.Printf("Dropping incomplete chunk %d of %s\n", chunkNumber, metadata.ID)
+			os.Remove(path)
+		}
+	}
+}
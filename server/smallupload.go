@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// smallUploadLimit is the largest file POST /upload_small accepts, set with
+// -small-upload-limit; 0 disables the endpoint. It may not exceed
+// maxChunkSize, as the file is stored as a single chunk.
+var smallUploadLimit int64 = 1 << 20
+
+// smallUploadHandler stores a file sent whole in one request, saving small
+// files the registration and completion round trips. The name and tags are
+// query parameters (?name=notes.txt&tag=key=value), the SHA-256 of the
+// content is the File-Hash header and File-Attributes may carry the file's
+// attributes as JSON. The answer is the report /complete_upload gives.
+func smallUploadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received single request upload for:", r.URL.Query().Get("name"))
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	if smallUploadLimit <= 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "Single request uploads are disabled")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, codeLengthRequired, "Content-Length is required for single request uploads")
+		return
+	}
+	if r.ContentLength > smallUploadLimit {
+		writeLimitError(w, http.StatusRequestEntityTooLarge, codeFileTooLarge, LimitHints{
+			Error:       fmt.Sprintf("file size %d exceeds the single request upload maximum of %d bytes", r.ContentLength, smallUploadLimit),
+			MaxFileSize: smallUploadLimit,
+		})
+		return
+	}
+
+	metadata, err := smallUploadMetadata(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if !validateRegistration(w, metadata) {
+		return
+	}
+	metadata.ChunkSize = int(metadata.FileSize)
+	owner, _ := requestPrincipal(r)
+	if metadata, err = prepareUpload(metadata, owner); err != nil {
+		fmt.Println("Error preparing upload:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error preparing upload")
+		return
+	}
+	metadata.Client = requestClient(r)
+	annotateSpan(r, attribute.String("upload.id", metadata.ID), attribute.Int64("file.size", metadata.FileSize))
+
+	hashes := newTransferHashes(r.Header)
+	content, err := writeStoredFile(finalFilePath(metadata), metadata, io.TeeReader(r.Body, hashes.writer()), metadata.FileHash)
+	if err == io.ErrUnexpectedEOF {
+		writeError(w, http.StatusBadRequest, codeChunkTruncated, "Body is shorter than its Content-Length")
+		return
+	}
+	if err == errStoredHashMismatch {
+		fmt.Println("Single request upload hash mismatch for:", metadata.FileName)
+		writeError(w, http.StatusBadRequest, codeFileHashMismatch, "File hash mismatch")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error storing single request upload:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing to file")
+		return
+	}
+	if err := verifyTransferDigests(r.Header, hashes.sums()); err != nil {
+		os.Remove(finalFilePath(metadata))
+		writeError(w, http.StatusBadRequest, codeDigestMismatch, err.Error())
+		return
+	}
+
+	metadata.FileMD5 = content.MD5
+	metadata.Deadline = nil
+	if err := updateFileInfoDB(metadata); err != nil {
+		fmt.Println("Error updating fileInfoDB:", err)
+		os.Remove(finalFilePath(metadata))
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	indexStoredFile(metadata)
+	generateThumbnails(metadata)
+	extractMediaInfo(metadata)
+	indexFileText(metadata)
+	postProcess(metadata)
+	queueErasureCoding(metadata)
+	audit(r, AuditEntry{Action: "complete", FileID: metadata.ID, FileName: metadata.FileName, Size: metadata.FileSize, Chunks: metadata.TotalChunks, Detail: "single request upload"})
+	publishEvent(r, eventUploadCompleted, metadata, "")
+	fmt.Printf("Stored single request upload %s from %q\n", metadata.ID, requestUserAgent(r))
+	writeJSON(w, newUploadReport(metadata))
+}
+
+// smallUploadMetadata reads the registration of a single request upload
+// from its query and headers.
+func smallUploadMetadata(r *http.Request) (FileMetadata, error) {
+	query := r.URL.Query()
+	metadata := FileMetadata{
+		FileName: query.Get("name"),
+		FileSize: r.ContentLength,
+		FileHash: strings.ToLower(r.Header.Get("File-Hash")),
+	}
+	if !validChunkHash(metadata.FileHash) {
+		return metadata, fmt.Errorf("File-Hash header must be the hex encoded SHA-256 of the file")
+	}
+	for _, tag := range query["tag"] {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			return metadata, fmt.Errorf("Tag %q must be key=value", tag)
+		}
+		if metadata.Tags == nil {
+			metadata.Tags = make(map[string]string)
+		}
+		metadata.Tags[key] = value
+	}
+	if header := r.Header.Get("File-Attributes"); header != "" {
+		metadata.Attributes = &FileAttributes{}
+		if err := json.Unmarshal([]byte(header), metadata.Attributes); err != nil {
+			return metadata, fmt.Errorf("Invalid File-Attributes header: %v", err)
+		}
+	}
+	return metadata, nil
+}
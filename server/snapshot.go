@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The bookkeeping of uploads in progress is written to uploadsSnapshot every
+// snapshotInterval and on shutdown. Chunk receipts in between are appended
+// to uploadsWAL, which is synced every walSyncInterval, so a crash loses at
+// most that much of it. A snapshot empties the log.
+const (
+	uploadsSnapshot = "uploads.snapshot.json"
+	uploadsWAL      = "uploads.wal"
+	walSyncInterval = time.Second
+)
+
+// snapshotInterval is set with -snapshot-interval; 0 keeps the bookkeeping
+// in memory only, as before.
+var snapshotInterval = 30 * time.Second
+
+const (
+	walStart = "start"
+	walChunk = "chunk"
+	walEnd   = "end"
+)
+
+// walRecord is one line of the write-ahead log.
+type walRecord struct {
+	Event  string    `json:"event"`
+	FileID string    `json:"fileId"`
+	Chunk  int       `json:"chunk,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// uploadSnapshot is the state of the uploads in progress at one moment. It
+// holds their metadata too, so that an upload whose session.json was lost
+// still comes back.
+type uploadSnapshot struct {
+	TakenAt time.Time        `json:"takenAt"`
+	Uploads []snapshotUpload `json:"uploads"`
+}
+
+type snapshotUpload struct {
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+	FileID   string        `json:"fileId"`
+	Started  time.Time     `json:"started"`
+	Attempts map[int]int   `json:"attempts"`
+}
+
+var (
+	// walMutex orders changes to the transfer statistics with their log
+	// records and with snapshots, so that replaying the log over a snapshot
+	// neither misses nor repeats a change. It is taken before transferMutex.
+	walMutex = &sync.Mutex{}
+	walFile  *os.File
+	walDirty bool
+
+	snapshotMutex = &sync.Mutex{}
+)
+
+// journal applies a change to the transfer statistics and logs it.
+func journal(record walRecord, apply func()) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	apply()
+	if walFile == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = walFile.Write(append(data, '\n'))
+	}
+	if err != nil {
+		fmt.Println("Error writing upload log:", err)
+		return
+	}
+	walDirty = true
+}
+
+// recoverUploads brings back the bookkeeping of the uploads in progress from
+// the last snapshot and the log written since, after restoreSessions read
+// their sessions. It then takes a new snapshot and starts logging and
+// taking snapshots every snapshotInterval.
+func recoverUploads() (int, error) {
+	recovered, err := loadSnapshot()
+	if err != nil {
+		return recovered, err
+	}
+	if err := replayWAL(); err != nil {
+		return recovered, err
+	}
+	walFile, err = os.OpenFile(filepath.Join(dataDir, uploadsWAL), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return recovered, err
+	}
+	if err := takeSnapshot(); err != nil {
+		return recovered, err
+	}
+	go func() {
+		for {
+			time.Sleep(walSyncInterval)
+			syncWAL()
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(snapshotInterval)
+			if err := takeSnapshot(); err != nil {
+				fmt.Println("Error taking upload snapshot:", err)
+			}
+		}
+	}()
+	return recovered, nil
+}
+
+// loadSnapshot restores the statistics of the uploads restoreSessions
+// found, and the uploads whose session is missing but whose chunks are
+// still there.
+func loadSnapshot() (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, uploadsSnapshot))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snapshot uploadSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("%s: %v", uploadsSnapshot, err)
+	}
+
+	recovered := 0
+	for _, upload := range snapshot.Uploads {
+		metadataMutex.Lock()
+		_, active := filesMetadata[upload.FileID]
+		metadataMutex.Unlock()
+		if !active {
+			ok, err := recoverSession(upload)
+			if err != nil {
+				return recovered, err
+			}
+			if !ok {
+				continue
+			}
+			recovered++
+		}
+		attempts := upload.Attempts
+		if attempts == nil {
+			attempts = make(map[int]int)
+		}
+		transferMutex.Lock()
+		transfers[upload.FileID] = &transferStats{started: upload.Started, attempts: attempts}
+		transferMutex.Unlock()
+	}
+	return recovered, nil
+}
+
+// recoverSession writes the session of an upload in the snapshot again, if
+// its chunks are still there and it was not completed.
+func recoverSession(upload snapshotUpload) (bool, error) {
+	metadata := upload.Metadata
+	if metadata == nil || metadata.ID != upload.FileID || !validFileID(metadata.ID) {
+		return false, nil
+	}
+	if info, err := os.Stat(uploadTmpDir(metadata.ID)); err != nil || !info.IsDir() {
+		return false, nil
+	}
+	_, stored, err := lookupFileInfo(metadata.ID)
+	if err != nil || stored {
+		return false, err
+	}
+	if err := saveSession(*metadata); err != nil {
+		return false, err
+	}
+	if !usesInPlace(metadata.ID) {
+		dropPartialChunks(*metadata)
+	}
+	metadataMutex.Lock()
+	filesMetadata[metadata.ID] = *metadata
+	metadataMutex.Unlock()
+	scheduleDeadline(*metadata)
+	return true, nil
+}
+
+// replayWAL applies the log written since the snapshot to the restored
+// statistics. A line cut short by the crash ends the replay.
+func replayWAL() error {
+	file, err := os.Open(filepath.Join(dataDir, uploadsWAL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	active := make(map[string]bool)
+	metadataMutex.Lock()
+	for id := range filesMetadata {
+		active[id] = true
+	}
+	metadataMutex.Unlock()
+
+	transferMutex.Lock()
+	defer transferMutex.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			fmt.Println("Ignoring the end of the upload log:", err)
+			break
+		}
+		switch record.Event {
+		case walStart:
+			if active[record.FileID] {
+				transfers[record.FileID] = &transferStats{started: record.At, attempts: make(map[int]int)}
+			}
+		case walChunk:
+			if stats, ok := transfers[record.FileID]; ok {
+				stats.attempts[record.Chunk]++
+			}
+		case walEnd:
+			delete(transfers, record.FileID)
+		}
+	}
+	return scanner.Err()
+}
+
+// takeSnapshot writes the bookkeeping of the uploads in progress and empties
+// the log. Metadata is read first, as metadataMutex is held by callers of
+// journal; uploads registered in between only miss it in this snapshot.
+func takeSnapshot() error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	metadata := make(map[string]FileMetadata)
+	metadataMutex.Lock()
+	for id, m := range filesMetadata {
+		if m.GroupID == "" {
+			metadata[id] = m
+		}
+	}
+	metadataMutex.Unlock()
+
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	snapshot := uploadSnapshot{TakenAt: timeNow(), Uploads: []snapshotUpload{}}
+	transferMutex.Lock()
+	for id, stats := range transfers {
+		upload := snapshotUpload{FileID: id, Started: stats.started, Attempts: make(map[int]int, len(stats.attempts))}
+		for chunkNumber, attempts := range stats.attempts {
+			upload.Attempts[chunkNumber] = attempts
+		}
+		if m, ok := metadata[id]; ok {
+			upload.Metadata = &m
+		}
+		snapshot.Uploads = append(snapshot.Uploads, upload)
+	}
+	transferMutex.Unlock()
+	sort.Slice(snapshot.Uploads, func(i, j int) bool { return snapshot.Uploads[i].FileID < snapshot.Uploads[j].FileID })
+
+	// Like sessions, the snapshot holds the wrapped data keys of encrypted
+	// uploads.
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, uploadsSnapshot)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if walFile == nil {
+		return nil
+	}
+	walDirty = false
+	return walFile.Truncate(0)
+}
+
+// syncWAL makes the log written so far durable. The sync itself runs
+// without walMutex, so that chunks are not held up by the disk.
+func syncWAL() {
+	walMutex.Lock()
+	file, dirty := walFile, walDirty
+	walDirty = false
+	walMutex.Unlock()
+	if file == nil || !dirty {
+		return
+	}
+	if err := file.Sync(); err != nil {
+		fmt.Println("Error syncing upload log:", err)
+	}
+}
+
+// handleShutdown takes a last snapshot and saves usage on SIGINT and
+// SIGTERM before exiting, so that a clean stop loses nothing.
+func handleShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Println("Shutting down on", sig)
+		code := 0
+		if walFile != nil {
+			if err := takeSnapshot(); err != nil {
+				fmt.Println("Error taking upload snapshot:", err)
+				code = 1
+			}
+			walMutex.Lock()
+			walFile.Sync()
+			walFile.Close()
+			walFile = nil
+			walMutex.Unlock()
+		}
+		if usageAccounting {
+			if err := saveUsage(); err != nil {
+				fmt.Println("Error saving usage:", err)
+				code = 1
+			}
+		}
+		os.Exit(code)
+	}()
+}
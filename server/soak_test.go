@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// soakFiles is kept small by default because every completion rewrites the
+// JSON metadata file; soak for longer with
+//
+//	go test ./server -run Soak -v -soak-files 5000
+var soakFiles = flag.Int("soak-files", 500, "files uploaded by TestSoakConcurrentUploads")
+
+// TestSoakConcurrentUploads uploads many small files from many clients at
+// once, with a file limit well below the number of clients, and checks that
+// neither file descriptors nor the heap grow with the number of uploads.
+// Skipped with -short.
+func TestSoakConcurrentUploads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test skipped in short mode")
+	}
+	const (
+		clients  = 64
+		fileSize = 4096
+	)
+	files := *soakFiles
+	dataDir = t.TempDir()
+	maxOpenFiles = 16
+	initFileSlots()
+	defer func() { maxOpenFiles, fileSlots = 0, nil }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register_file", registerFileHandler)
+	mux.HandleFunc("/upload_chunk/", limitOpenFiles(uploadChunkHandler))
+	mux.HandleFunc("/complete_upload/", limitOpenFiles(completeUploadHandler))
+	server := httptest.NewServer(withBodyDrain(mux))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: clients}}
+
+	// A first round warms up pools and connections before the baseline.
+	upload := func(n int) error {
+		content := bytes.Repeat([]byte{byte(n)}, fileSize)
+		copy(content, fmt.Sprintf("soak file %d", n))
+		return soakUpload(client, server.URL, fmt.Sprintf("soak/%d.bin", n), content)
+	}
+	for n := 0; n < clients; n++ {
+		if err := upload(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fdsBefore := openDescriptors()
+	heapBefore := heapInUse()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	next := make(chan int)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				if err := upload(n); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	started := time.Now()
+	go func() {
+		defer close(next)
+		for n := clients; n < clients+files; n++ {
+			select {
+			case next <- n:
+			case err := <-errs:
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	t.Logf("uploaded %d files in %v", files, time.Since(started))
+
+	client.CloseIdleConnections()
+	server.CloseClientConnections()
+	fdsAfter := openDescriptors()
+	heapAfter := heapInUse()
+	t.Logf("descriptors %d -> %d, heap in use %d -> %d bytes", fdsBefore, fdsAfter, heapBefore, heapAfter)
+	if fdsBefore >= 0 && fdsAfter > fdsBefore+8 {
+		t.Errorf("file descriptors grew from %d to %d", fdsBefore, fdsAfter)
+	}
+	// The metadata of the stored files is the only state that should grow.
+	if heapAfter > heapBefore+32<<20 {
+		t.Errorf("heap grew from %d to %d bytes", heapBefore, heapAfter)
+	}
+}
+
+// soakUpload registers, uploads and completes one single chunk file.
+func soakUpload(client *http.Client, url, name string, content []byte) error {
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	registration, _ := json.Marshal(FileMetadata{FileName: name, FileSize: int64(len(content)), FileHash: hash})
+	var metadata FileMetadata
+	if err := soakRequest(client, "POST", url+"/register_file", registration, "", &metadata); err != nil {
+		return fmt.Errorf("registering %s: %w", name, err)
+	}
+	if err := soakRequest(client, "POST", fmt.Sprintf("%s/upload_chunk/%s/1", url, metadata.ID), content, hash, nil); err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	if err := soakRequest(client, "POST", url+"/complete_upload/"+metadata.ID, nil, "", nil); err != nil {
+		return fmt.Errorf("completing %s: %w", name, err)
+	}
+	return nil
+}
+
+func soakRequest(client *http.Client, method, url string, body []byte, chunkHash string, response interface{}) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if chunkHash != "" {
+		request.Header.Set("Chunk-Hash", chunkHash)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// openDescriptors counts the descriptors of the process, or returns -1 where
+// /proc is not available.
+func openDescriptors() int {
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// sparseBlockSize is the unit in which assembly looks for zeros to leave as
+// holes, the block size of common file systems.
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// FileHole is a range of a file that reads as zeros without being stored,
+// as SEEK_HOLE and SEEK_DATA report it.
+type FileHole struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// checkHoles refuses holes that overlap, are out of order or reach past the
+// end of the file.
+func checkHoles(w http.ResponseWriter, metadata FileMetadata, holes []FileHole) bool {
+	var end int64
+	for i, hole := range holes {
+		if hole.Length <= 0 || hole.Offset < end || hole.Offset+hole.Length > metadata.FileSize {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Hole %d must have a positive length, follow the previous hole and end within the file", i+1))
+			return false
+		}
+		end = hole.Offset + hole.Length
+	}
+	return true
+}
+
+// holeChunks returns the chunks of an upload that lie entirely in holes.
+func holeChunks(metadata FileMetadata, holes []FileHole) []int {
+	var chunks []int
+	h := 0
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		start := int64(chunkNumber-1) * int64(metadata.ChunkSize)
+		end := start + expectedChunkSize(metadata, chunkNumber)
+		for h < len(holes) && holes[h].Offset+holes[h].Length <= start {
+			h++
+		}
+		if h < len(holes) && holes[h].Offset <= start && holes[h].Offset+holes[h].Length >= end {
+			chunks = append(chunks, chunkNumber)
+		}
+	}
+	return chunks
+}
+
+// storeHoleChunks stores the zeros of chunks that lie in holes of the file as
+// if the client had sent them, and returns the chunks it stored. Sparse
+// uploads keep them as holes: chunk files that are only truncated to their
+// size, or nothing at all in the data file of in-place uploads. Encrypted
+// uploads store them sealed like any other chunk.
+func storeHoleChunks(metadata FileMetadata, chunks []int) []int {
+	zeros := make([]byte, metadata.ChunkSize)
+	var stored []int
+	for _, chunkNumber := range chunks {
+		plain := zeros[:expectedChunkSize(metadata, chunkNumber)]
+		hash := fmt.Sprintf("%x", sha256.Sum256(plain))
+		var err error
+		switch {
+		case !metadata.Sparse:
+			err = storeReusedChunk(metadata, chunkNumber, plain, hash)
+		case usesInPlace(metadata.ID):
+			err = recordChunkHash(metadata.ID, chunkNumber, hash)
+		default:
+			err = storeSparseChunk(metadata, chunkNumber, int64(len(plain)), hash)
+		}
+		if err != nil {
+			fmt.Printf("Error storing hole chunk %d of %s: %v\n", chunkNumber, metadata.ID, err)
+			continue
+		}
+		stored = append(stored, chunkNumber)
+	}
+	return stored
+}
+
+// storeSparseChunk stores a chunk of zeros as a chunk file without data.
+func storeSparseChunk(metadata FileMetadata, chunkNumber int, size int64, hash string) error {
+	chunkFile, err := createChunkTemp(metadata.ID, chunkNumber)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(chunkFile.Name())
+	err = chunkFile.Truncate(size)
+	if closeErr := chunkFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if deferChunkVerification {
+		if err := recordChunkHash(metadata.ID, chunkNumber, hash); err != nil {
+			return err
+		}
+	}
+	return os.Rename(chunkFile.Name(), chunkFilePath(metadata.ID, chunkNumber))
+}
+
+// sparseWriter writes to a file, seeking over blocks of zeros instead of
+// writing them so that they stay holes. As a hole at the end is never
+// written, the file has to be truncated to its size afterwards.
+type sparseWriter struct {
+	file *os.File
+}
+
+func (s sparseWriter) Write(p []byte) (int, error) {
+	start := 0
+	for offset := 0; offset < len(p); offset += sparseBlockSize {
+		end := offset + sparseBlockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if !bytes.Equal(p[offset:end], zeroBlock[:end-offset]) {
+			continue
+		}
+		if start < offset {
+			if n, err := s.file.Write(p[start:offset]); err != nil {
+				return start + n, err
+			}
+		}
+		if _, err := s.file.Seek(int64(end-offset), io.SeekCurrent); err != nil {
+			return offset, err
+		}
+		start = end
+	}
+	if start < len(p) {
+		if n, err := s.file.Write(p[start:]); err != nil {
+			return start + n, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errStoredHashMismatch = errors.New("stored file hash mismatch")
+
+// storedContent describes the plaintext written by writeStoredFile.
+type storedContent struct {
+	Hash string
+	MD5  string
+	Size int64
+}
+
+// writeStoredFile writes the plaintext from src to path in the on-disk layout
+// described by metadata (sealed chunk by chunk when the file is encrypted) and
+// returns its size and digests. The file is written to a temporary name first
+// and only renamed into place once src has been fully consumed and, if
+// expectedHash is set, the content matched it.
+func writeStoredFile(path string, metadata FileMetadata, src io.Reader, expectedHash string) (storedContent, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return storedContent{}, err
+	}
+
+	preallocate(file, storedFileSize(metadata))
+	hasher, md5Hasher := newFileHasher(metadata), md5.New()
+	written, err := writeChunks(file, metadata, io.TeeReader(src, io.MultiWriter(hasher, md5Hasher)))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	hash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err == nil && expectedHash != "" && hash != expectedHash {
+		err = errStoredHashMismatch
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return storedContent{}, err
+	}
+	return storedContent{
+		Hash: hash,
+		MD5:  base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil)),
+		Size: written,
+	}, nil
+}
+
+func writeChunks(dst io.Writer, metadata FileMetadata, src io.Reader) (int64, error) {
+	if !metadata.Encrypted {
+		return copyPooled(dst, src)
+	}
+
+	aead, err := chunkAEAD(metadata)
+	if err != nil {
+		return 0, err
+	}
+	pooled := getBuffer(metadata.ChunkSize)
+	defer putBuffer(pooled)
+	buffer := *pooled
+	var written int64
+	for chunkNumber := 1; ; chunkNumber++ {
+		n, err := io.ReadFull(src, buffer)
+		if n > 0 {
+			sealed, err := sealChunk(aead, metadata.ID, chunkNumber, buffer[:n])
+			if err != nil {
+				return written, err
+			}
+			if _, err := dst.Write(sealed); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
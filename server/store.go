@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// metadataStore keeps the metadata of stored files. The default keeps it in
+// fileInfoDB in the data directory; -metadata-db switches to PostgreSQL so
+// that several replicas can share it.
+type metadataStore interface {
+	Lookup(fileID string) (FileMetadata, bool, error)
+	List() (map[string]FileMetadata, error)
+	// Put records files in a single transaction, so either all of them
+	// become visible or none do.
+	Put(metadatas ...FileMetadata) error
+	// Update runs fn on the record of fileID while holding it exclusively
+	// and saves the result: the changed record, or none when fn asks for
+	// removal. Nothing is saved when fn fails; its error is returned.
+	Update(fileID string, fn func(metadata *FileMetadata) (remove bool, err error)) (found bool, err error)
+	// TryLock takes an exclusive lock on key across every server sharing the
+	// store, without waiting. The lock is held until unlock is called or
+	// this server goes away.
+	TryLock(key string) (unlock func(), acquired bool, err error)
+	// Roles returns the roles assigned through /admin/roles by principal;
+	// SetRole assigns one, or removes the assignment when role is "".
+	Roles() (map[string]string, error)
+	SetRole(principal, role string) error
+	Close() error
+}
+
+var fileStore metadataStore = jsonStore{}
+
+func lookupFileInfo(fileID string) (FileMetadata, bool, error) {
+	return fileStore.Lookup(fileID)
+}
+
+// updateFileInfoDB records one or more completed files in a single write, so
+// either all of them become visible or none do.
+func updateFileInfoDB(metadatas ...FileMetadata) error {
+	return fileStore.Put(metadatas...)
+}
+
+// jsonStore is the single-server store: one JSON document rewritten on every
+// change under fileInfoMutex.
+type jsonStore struct{}
+
+func (jsonStore) Lookup(fileID string) (FileMetadata, bool, error) {
+	fileInfoMutex.Lock()
+	defer fileInfoMutex.Unlock()
+	fileInfos, err := readFileInfoDB()
+	if err != nil {
+		return FileMetadata{}, false, err
+	}
+	metadata, ok := fileInfos[fileID]
+	return metadata, ok, nil
+}
+
+func (jsonStore) List() (map[string]FileMetadata, error) {
+	fileInfoMutex.Lock()
+	defer fileInfoMutex.Unlock()
+	return readFileInfoDB()
+}
+
+func (jsonStore) Put(metadatas ...FileMetadata) error {
+	fileInfoMutex.Lock()
+	defer fileInfoMutex.Unlock()
+	fileInfos, err := readFileInfoDB()
+	if err != nil {
+		return err
+	}
+	for _, metadata := range metadatas {
+		fileInfos[metadata.ID] = metadata
+	}
+	return writeFileInfoDB(fileInfos)
+}
+
+func (jsonStore) Update(fileID string, fn func(metadata *FileMetadata) (bool, error)) (bool, error) {
+	fileInfoMutex.Lock()
+	defer fileInfoMutex.Unlock()
+	fileInfos, err := readFileInfoDB()
+	if err != nil {
+		return false, err
+	}
+	metadata, ok := fileInfos[fileID]
+	if !ok {
+		return false, nil
+	}
+	remove, err := fn(&metadata)
+	if err != nil {
+		return true, err
+	}
+	if remove {
+		delete(fileInfos, fileID)
+	} else {
+		fileInfos[fileID] = metadata
+	}
+	return true, writeFileInfoDB(fileInfos)
+}
+
+// TryLock has nothing to do: a JSON store is never shared, and the server
+// serializes its own completions with completingUploads.
+func (jsonStore) TryLock(key string) (func(), bool, error) {
+	return func() {}, true, nil
+}
+
+func (jsonStore) Close() error {
+	return nil
+}
+
+func readFileInfoDB() (map[string]FileMetadata, error) {
+	fileInfos := make(map[string]FileMetadata)
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, fileInfoDB))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileInfos, nil
+		}
+		fmt.Println("Error reading file info DB:", err)
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fileInfos); err != nil {
+		fmt.Println("Error unmarshalling file info:", err)
+		return nil, err
+	}
+	return fileInfos, nil
+}
+
+func writeFileInfoDB(fileInfos map[string]FileMetadata) error {
+	newData, err := json.MarshalIndent(fileInfos, "", "  ")
+	if err != nil {
+		fmt.Println("Error marshaling file info:", err)
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dataDir, fileInfoDB), newData, 0644)
+	invalidateSearchIndex()
+	if err != nil {
+		fmt.Println("Error writing to file info DB:", err)
+		return err
+	}
+
+	return nil
+}
+
+// errAccessDenied is returned from Update callbacks that refuse the request.
+var errAccessDenied = errors.New("access denied")
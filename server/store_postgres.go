@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the advisory lock key held while migrating, so replicas
+// starting together apply each migration once.
+const migrationLock = 0x66696c65
+
+const fileColumns = `id, file_name, file_size, file_hash, chunk_size, total_chunks,
+	encrypted, wrapped_key, group_id, file_md5, owner, acl, tags,
+	hash_algorithm, hash_segment_size, integrity, attributes`
+
+// postgresStore keeps file metadata in PostgreSQL. Every replica pointed at
+// the same database sees the same files, and changes are transactional.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating: %w", err)
+	}
+	return &postgresStore{db: db}, nil
+}
+
+// migratePostgres applies migrations/NNNN_name.sql in order, each in its own
+// transaction together with its row in schema_migrations.
+func migratePostgres(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+	names, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Name() < names[j].Name() })
+	for _, entry := range names {
+		version, err := strconv.Atoi(strings.SplitN(entry.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s has no version prefix", entry.Name())
+		}
+		script, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(db, version, string(script)); err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, script string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	fmt.Printf("Applied metadata migration %d\n", version)
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row rowScanner) (FileMetadata, error) {
+	var metadata FileMetadata
+	var acl, tags, integrity, attributes []byte
+	err := row.Scan(&metadata.ID, &metadata.FileName, &metadata.FileSize, &metadata.FileHash,
+		&metadata.ChunkSize, &metadata.TotalChunks, &metadata.Encrypted, &metadata.WrappedKey,
+		&metadata.GroupID, &metadata.FileMD5, &metadata.Owner, &acl, &tags,
+		&metadata.HashAlgorithm, &metadata.HashSegmentSize, &integrity, &attributes)
+	if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(acl, &metadata.ACL); err != nil {
+		return metadata, fmt.Errorf("decoding ACL of %s: %w", metadata.ID, err)
+	}
+	if len(metadata.ACL) == 0 {
+		metadata.ACL = nil
+	}
+	if err := json.Unmarshal(tags, &metadata.Tags); err != nil {
+		return metadata, fmt.Errorf("decoding tags of %s: %w", metadata.ID, err)
+	}
+	if len(metadata.Tags) == 0 {
+		metadata.Tags = nil
+	}
+	if integrity != nil {
+		if err := json.Unmarshal(integrity, &metadata.Integrity); err != nil {
+			return metadata, fmt.Errorf("decoding integrity of %s: %w", metadata.ID, err)
+		}
+	}
+	if attributes != nil {
+		if err := json.Unmarshal(attributes, &metadata.Attributes); err != nil {
+			return metadata, fmt.Errorf("decoding attributes of %s: %w", metadata.ID, err)
+		}
+	}
+	return metadata, nil
+}
+
+func fileRow(metadata FileMetadata) ([]interface{}, error) {
+	acl := []byte("[]")
+	if len(metadata.ACL) > 0 {
+		var err error
+		if acl, err = json.Marshal(metadata.ACL); err != nil {
+			return nil, err
+		}
+	}
+	tags := []byte("{}")
+	if len(metadata.Tags) > 0 {
+		var err error
+		if tags, err = json.Marshal(metadata.Tags); err != nil {
+			return nil, err
+		}
+	}
+	var integrity interface{}
+	if metadata.Integrity != nil {
+		encoded, err := json.Marshal(metadata.Integrity)
+		if err != nil {
+			return nil, err
+		}
+		integrity = string(encoded)
+	}
+	var attributes interface{}
+	if metadata.Attributes != nil {
+		encoded, err := json.Marshal(metadata.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		attributes = string(encoded)
+	}
+	return []interface{}{metadata.ID, metadata.FileName, metadata.FileSize, metadata.FileHash,
+		metadata.ChunkSize, metadata.TotalChunks, metadata.Encrypted, metadata.WrappedKey,
+		metadata.GroupID, metadata.FileMD5, metadata.Owner, string(acl), string(tags),
+		metadata.HashAlgorithm, metadata.HashSegmentSize, integrity, attributes}, nil
+}
+
+func (s *postgresStore) Lookup(fileID string) (FileMetadata, bool, error) {
+	metadata, err := scanFile(s.db.QueryRow(`SELECT `+fileColumns+` FROM files WHERE id = $1`, fileID))
+	if err == sql.ErrNoRows {
+		return FileMetadata{}, false, nil
+	}
+	return metadata, err == nil, err
+}
+
+func (s *postgresStore) List() (map[string]FileMetadata, error) {
+	rows, err := s.db.Query(`SELECT ` + fileColumns + ` FROM files`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fileInfos := make(map[string]FileMetadata)
+	for rows.Next() {
+		metadata, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		fileInfos[metadata.ID] = metadata
+	}
+	return fileInfos, rows.Err()
+}
+
+func (s *postgresStore) Put(metadatas ...FileMetadata) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, metadata := range metadatas {
+		if err := upsertFile(tx, metadata); err != nil {
+			return err
+		}
+	}
+	defer invalidateSearchIndex()
+	return tx.Commit()
+}
+
+func upsertFile(tx *sql.Tx, metadata FileMetadata) error {
+	row, err := fileRow(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO files (`+fileColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (id) DO UPDATE SET
+			file_name = EXCLUDED.file_name, file_size = EXCLUDED.file_size,
+			file_hash = EXCLUDED.file_hash, chunk_size = EXCLUDED.chunk_size,
+			total_chunks = EXCLUDED.total_chunks, encrypted = EXCLUDED.encrypted,
+			wrapped_key = EXCLUDED.wrapped_key, group_id = EXCLUDED.group_id,
+			file_md5 = EXCLUDED.file_md5, owner = EXCLUDED.owner, acl = EXCLUDED.acl,
+			tags = EXCLUDED.tags, hash_algorithm = EXCLUDED.hash_algorithm,
+			hash_segment_size = EXCLUDED.hash_segment_size,
+			integrity = EXCLUDED.integrity, attributes = EXCLUDED.attributes,
+			updated_at = now()`, row...)
+	return err
+}
+
+func (s *postgresStore) Update(fileID string, fn func(metadata *FileMetadata) (bool, error)) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	metadata, err := scanFile(tx.QueryRow(`SELECT `+fileColumns+` FROM files WHERE id = $1 FOR UPDATE`, fileID))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	remove, err := fn(&metadata)
+	if err != nil {
+		return true, err
+	}
+	if remove {
+		_, err = tx.Exec(`DELETE FROM files WHERE id = $1`, fileID)
+	} else {
+		err = upsertFile(tx, metadata)
+	}
+	if err != nil {
+		return true, err
+	}
+	defer invalidateSearchIndex()
+	return true, tx.Commit()
+}
+
+// TryLock uses a session advisory lock on a connection of its own, so a
+// server that dies releases its locks together with the connection.
+func (s *postgresStore) TryLock(key string) (func(), bool, error) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	lockID := int64(ringHash("lock:" + key))
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, lockID).Scan(&acquired); err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockID); err != nil {
+			fmt.Println("Error releasing lock:", err)
+		}
+		conn.Close()
+	}, true, nil
+}
+
+func (s *postgresStore) Roles() (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT principal, role FROM principal_roles`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make(map[string]string)
+	for rows.Next() {
+		var principal, role string
+		if err := rows.Scan(&principal, &role); err != nil {
+			return nil, err
+		}
+		roles[principal] = role
+	}
+	return roles, rows.Err()
+}
+
+func (s *postgresStore) SetRole(principal, role string) error {
+	if role == "" {
+		_, err := s.db.Exec(`DELETE FROM principal_roles WHERE principal = $1`, principal)
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO principal_roles (principal, role) VALUES ($1, $2)
+		ON CONFLICT (principal) DO UPDATE SET role = EXCLUDED.role, updated_at = now()`, principal, role)
+	return err
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
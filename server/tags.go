@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	maxTags        = 64
+	maxTagKeyLen   = 128
+	maxTagValueLen = 1024
+)
+
+// validTagKey accepts keys such as "job-id", "team.owner" or "class:pii":
+// letters, digits and -_.:/ only, so a key never needs escaping in the
+// ?tag=key=value filter.
+func validTagKey(key string) bool {
+	if key == "" || len(key) > maxTagKeyLen {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func checkTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("At most %d tags are allowed", maxTags)
+	}
+	for key, value := range tags {
+		if !validTagKey(key) {
+			return fmt.Errorf("Invalid tag key %q", key)
+		}
+		if len(value) > maxTagValueLen {
+			return fmt.Errorf("Value of tag %s is longer than %d bytes", key, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// tagFilter is the ?tag= filter of GET /files: every "key=value" must be
+// set to that value and every bare "key" must be set at all.
+type tagFilter map[string]*string
+
+func parseTagFilter(values []string) (tagFilter, error) {
+	filter := make(tagFilter)
+	for _, value := range values {
+		key, tagValue, hasValue := strings.Cut(value, "=")
+		if !validTagKey(key) {
+			return nil, fmt.Errorf("Invalid tag key %q", key)
+		}
+		if hasValue {
+			filter[key] = &tagValue
+		} else {
+			filter[key] = nil
+		}
+	}
+	return filter, nil
+}
+
+func (f tagFilter) matches(tags map[string]string) bool {
+	for key, want := range f {
+		value, ok := tags[key]
+		if !ok || (want != nil && value != *want) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileTagsHandler serves the tags of a stored file:
+//
+//	GET   /files/{id}/tags  the tags
+//	PUT   /files/{id}/tags  replace them with the object in the body
+//	PATCH /files/{id}/tags  merge the object in the body; null removes a tag
+//
+// Reading needs the read permission, changing them the write permission.
+func fileTagsHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	var update map[string]*string
+	permission := permissionWrite
+	switch r.Method {
+	case "GET":
+		permission = permissionRead
+	case "PUT", "PATCH":
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid tags: "+err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, PUT and PATCH methods are allowed")
+		return
+	}
+
+	var metadata FileMetadata
+	var found bool
+	var err error
+	if r.Method == "GET" {
+		metadata, found, err = fileStore.Lookup(fileID)
+		if err == nil && found && !canAccess(r, metadata, permission) {
+			err = errAccessDenied
+		}
+	} else {
+		found, err = fileStore.Update(fileID, func(stored *FileMetadata) (bool, error) {
+			if !canAccess(r, *stored, permission) {
+				return false, errAccessDenied
+			}
+			tags := make(map[string]string)
+			if r.Method == "PATCH" {
+				for key, value := range stored.Tags {
+					tags[key] = value
+				}
+			}
+			for key, value := range update {
+				if value == nil {
+					delete(tags, key)
+				} else {
+					tags[key] = *value
+				}
+			}
+			if err := checkTags(tags); err != nil {
+				return false, invalidTagsError{err}
+			}
+			if len(tags) == 0 {
+				tags = nil
+			}
+			stored.Tags = tags
+			metadata = *stored
+			return false, nil
+		})
+	}
+	var invalid invalidTagsError
+	switch {
+	case err == errAccessDenied:
+		writeError(w, http.StatusForbidden, codeAccessDenied, "Access denied")
+		return
+	case errors.As(err, &invalid):
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, invalid.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	case !found:
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if r.Method != "GET" {
+		keys := make([]string, 0, len(update))
+		for key := range update {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		audit(r, AuditEntry{Action: "tags_" + strings.ToLower(r.Method), FileID: fileID, FileName: metadata.FileName, Detail: "keys " + strings.Join(keys, ",")})
+	}
+	tags := metadata.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	writeJSON(w, tags)
+}
+
+// invalidTagsError is a validation failure returned from a store update.
+type invalidTagsError struct{ err error }
+
+func (e invalidTagsError) Error() string { return e.err.Error() }
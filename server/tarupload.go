@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// TarUpload is the answer of POST /upload_tar: the files stored from the
+// archive in its order, and the entries that were not stored.
+type TarUpload struct {
+	Files      []FileMetadata `json:"files"`
+	Skipped    []SkippedEntry `json:"skipped,omitempty"`
+	TotalBytes int64          `json:"totalBytes"`
+}
+
+// SkippedEntry is an archive entry that was not stored, with the error code
+// and error a registration of it would have been refused with.
+type SkippedEntry struct {
+	Name  string `json:"name"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// tarUploadHandler stores every regular file of a tar archive streamed in
+// the request body, optionally gzip compressed, as a file of its own named
+// by its path in the archive under the prefix query parameter. Tags given
+// as tag=key=value query parameters go to every file, and the modification
+// time, mode, owner and extended attributes of the entries become the
+// files' attributes. Directories need no entry of their own; links, devices
+// and entries that cannot be stored are reported as skipped. Files are
+// committed as their entry ends, so an archive that breaks off halfway
+// leaves the files before the break stored, listed in the error details.
+func tarUploadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received tar upload request for:", r.URL.String())
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if prefix != "" && !validFileName(strings.TrimSuffix(prefix, "/")) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid prefix")
+		return
+	}
+	var tags map[string]string
+	for _, tag := range query["tag"] {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Tag %q must be key=value", tag))
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value
+	}
+	if err := checkTags(tags); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	archive, err := tarStream(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Error reading archive: "+err.Error())
+		return
+	}
+	owner, _ := requestPrincipal(r)
+	result := TarUpload{Files: []FileMetadata{}}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, codeInvalidRequest, "Error reading archive: "+err.Error(), result)
+			return
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			result.Skipped = append(result.Skipped, SkippedEntry{Name: name, Code: codeInvalidRequest, Error: "Only regular files are stored"})
+			continue
+		}
+
+		if !validFileName(name) {
+			result.Skipped = append(result.Skipped, SkippedEntry{Name: name, Code: codeInvalidRequest, Error: "Invalid file name"})
+			continue
+		}
+		metadata := FileMetadata{
+			FileName:   path.Join(prefix, name),
+			FileSize:   header.Size,
+			Tags:       tags,
+			Attributes: tarAttributes(header),
+		}
+		if code, err := checkTarEntry(metadata); err != nil {
+			result.Skipped = append(result.Skipped, SkippedEntry{Name: name, Code: code, Error: err.Error()})
+			continue
+		}
+		metadata, err = storeTarEntry(r, archive, metadata, owner)
+		if err != nil {
+			fmt.Println("Error storing archive entry:", err)
+			writeErrorDetails(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error storing %s: %v", name, err), result)
+			return
+		}
+		result.Files = append(result.Files, metadata.public())
+		result.TotalBytes += metadata.FileSize
+	}
+	fmt.Printf("Stored %d files from a tar upload, skipped %d entries\n", len(result.Files), len(result.Skipped))
+	writeJSON(w, result)
+}
+
+// tarStream reads a tar archive from body, gunzipping it first if it starts
+// like a gzip stream.
+func tarStream(body io.Reader) (*tar.Reader, error) {
+	buffered := bufio.NewReader(body)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return tar.NewReader(buffered), nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	return tar.NewReader(gz), nil
+}
+
+// checkTarEntry checks what validateRegistration checks of a registration
+// of the entry, returning the error code instead of answering the request.
+func checkTarEntry(metadata FileMetadata) (string, error) {
+	if !validFileName(metadata.FileName) {
+		return codeInvalidRequest, errors.New("Invalid file name")
+	}
+	if metadata.FileSize <= 0 {
+		return codeInvalidRequest, errors.New("File size must be positive")
+	}
+	if err := checkAttributes(metadata.Attributes); err != nil {
+		return codeInvalidRequest, err
+	}
+	if status, code, hints := registrationLimit(metadata); status != 0 {
+		return code, errors.New(hints.Error)
+	}
+	return "", nil
+}
+
+// storeTarEntry stores the entry the archive is at and commits it.
+func storeTarEntry(r *http.Request, archive *tar.Reader, metadata FileMetadata, owner string) (FileMetadata, error) {
+	metadata, err := prepareUpload(metadata, owner)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.Client = requestClient(r)
+	content, err := writeStoredFile(finalFilePath(metadata), metadata, archive, "")
+	if err != nil {
+		return metadata, err
+	}
+	metadata.FileHash, metadata.FileMD5 = content.Hash, content.MD5
+	if err := updateFileInfoDB(metadata); err != nil {
+		os.Remove(finalFilePath(metadata))
+		return metadata, fmt.Errorf("recording file: %v", err)
+	}
+	indexStoredFile(metadata)
+	generateThumbnails(metadata)
+	extractMediaInfo(metadata)
+	indexFileText(metadata)
+	postProcess(metadata)
+	queueErasureCoding(metadata)
+	audit(r, AuditEntry{Action: "complete", FileID: metadata.ID, FileName: metadata.FileName, Size: metadata.FileSize, Chunks: metadata.TotalChunks, Detail: "extracted from tar upload"})
+	publishEvent(r, eventUploadCompleted, metadata, "extracted from tar upload")
+	return metadata, nil
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Content indexing extracts the text of stored documents so that /search
+// can match the words in them. Each node indexes the files it stores and
+// keeps their words in textIndexFile in the data directory.
+
+const (
+	textIndexFile = "textIndex.json"
+	// maxTextSourceSize is the largest PDF or DOCX file indexed, as they are
+	// parsed in memory.
+	maxTextSourceSize = 64 << 20
+	// maxTextBytes caps the text extracted from a file.
+	maxTextBytes = 4 << 20
+	// maxTextWords caps the distinct words indexed per file.
+	maxTextWords = 20000
+	// maxWordLength leaves out longer words, which are usually encoded data.
+	maxWordLength = 64
+)
+
+// indexedText is what the content index keeps of a stored file: the
+// distinct words of the version whose hash is FileHash.
+type indexedText struct {
+	FileHash string   `json:"fileHash"`
+	Words    []string `json:"words"`
+}
+
+var (
+	// indexContent extracts the text of stored files for /search;
+	// -index-content sets it.
+	indexContent   bool
+	textIndex      = make(map[string]indexedText)
+	textIndexMutex = &sync.Mutex{}
+	// textSlots bounds how many files are read at once.
+	textSlots = make(chan struct{}, 2)
+)
+
+var errTextTooLarge = errors.New("file too large to extract text from")
+
+// loadTextIndex reads the content index and, in the background, indexes
+// stored files it misses, such as those stored before -index-content was
+// given, and drops files that are no longer stored.
+func loadTextIndex() error {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, textIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &textIndex); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		stored, err := fileStore.List()
+		if err != nil {
+			fmt.Println("Error listing files to index:", err)
+			return
+		}
+		textIndexMutex.Lock()
+		for id := range textIndex {
+			if _, ok := stored[id]; !ok {
+				delete(textIndex, id)
+			}
+		}
+		textIndexMutex.Unlock()
+		for _, metadata := range stored {
+			textIndexMutex.Lock()
+			indexed, ok := textIndex[metadata.ID]
+			textIndexMutex.Unlock()
+			if ownedLocally(metadata.ID) && textExtractor(metadata.FileName) != nil && (!ok || indexed.FileHash != metadata.FileHash) {
+				indexFileText(metadata)
+			}
+		}
+	}()
+	return nil
+}
+
+func saveTextIndexLocked() error {
+	data, err := json.Marshal(textIndex)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, textIndexFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// indexFileText extracts the words of a newly stored txt, pdf or docx file
+// in the background and adds them to the content index, replacing those of
+// an earlier version.
+func indexFileText(metadata FileMetadata) {
+	if !indexContent {
+		return
+	}
+	extract := textExtractor(metadata.FileName)
+	if extract == nil {
+		forgetFileText(metadata.ID)
+		return
+	}
+	go func() {
+		textSlots <- struct{}{}
+		defer func() { <-textSlots }()
+		content, closeFile, err := openStoredContent(metadata)
+		if err != nil {
+			fmt.Printf("Error extracting text of %s: %v\n", metadata.ID, err)
+			return
+		}
+		text, err := extract(content, metadata.FileSize)
+		closeFile()
+		if err != nil {
+			fmt.Printf("Error extracting text of %s: %v\n", metadata.ID, err)
+			forgetFileText(metadata.ID)
+			return
+		}
+		words := textWords(text)
+		textIndexMutex.Lock()
+		textIndex[metadata.ID] = indexedText{FileHash: metadata.FileHash, Words: words}
+		err = saveTextIndexLocked()
+		textIndexMutex.Unlock()
+		if err != nil {
+			fmt.Println("Error saving text index:", err)
+		}
+		invalidateSearchIndex()
+		fmt.Printf("Indexed %d words of %s\n", len(words), metadata.ID)
+	}()
+}
+
+// forgetFileText drops a file from the content index.
+func forgetFileText(fileID string) {
+	if !indexContent {
+		return
+	}
+	textIndexMutex.Lock()
+	_, ok := textIndex[fileID]
+	var err error
+	if ok {
+		delete(textIndex, fileID)
+		err = saveTextIndexLocked()
+	}
+	textIndexMutex.Unlock()
+	if err != nil {
+		fmt.Println("Error saving text index:", err)
+	}
+	if ok {
+		invalidateSearchIndex()
+	}
+}
+
+// textWords returns the distinct words of text as the search index splits
+// names, leaving out single characters and overly long words.
+func textWords(text string) []string {
+	var words []string
+	for _, word := range nameTokens(text) {
+		if len(word) < 2 || len(word) > maxWordLength {
+			continue
+		}
+		if words = append(words, word); len(words) == maxTextWords {
+			break
+		}
+	}
+	return words
+}
+
+// textExtractor returns how to extract the text of a file, chosen by its
+// name, or nil for files whose text is not indexed.
+func textExtractor(fileName string) func(content io.ReadSeeker, size int64) (string, error) {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".pdf":
+		return pdfText
+	case ".docx":
+		return docxText
+	}
+	contentType := fileContentType(fileName)
+	if strings.HasPrefix(contentType, "text/") || contentType == "application/json" || contentType == "application/xml" {
+		return plainText
+	}
+	return nil
+}
+
+func plainText(content io.ReadSeeker, size int64) (string, error) {
+	text, err := ioutil.ReadAll(io.LimitReader(content, maxTextBytes))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(string(text), " "), nil
+}
+
+// docxText returns the text of the paragraphs of a Word document.
+func docxText(content io.ReadSeeker, size int64) (string, error) {
+	if size > maxTextSourceSize {
+		return "", errTextTooLarge
+	}
+	archive, err := zip.NewReader(seekerAt{content}, size)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range archive.File {
+		if entry.Name != "word/document.xml" {
+			continue
+		}
+		document, err := entry.Open()
+		if err != nil {
+			return "", err
+		}
+		defer document.Close()
+		var text strings.Builder
+		inText := false
+		decoder := xml.NewDecoder(io.LimitReader(document, maxTextSourceSize))
+		for text.Len() < maxTextBytes {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			switch token := token.(type) {
+			case xml.StartElement:
+				inText = token.Name.Local == "t"
+				if token.Name.Local == "tab" || token.Name.Local == "br" {
+					text.WriteByte(' ')
+				}
+			case xml.EndElement:
+				inText = false
+				if token.Name.Local == "p" {
+					text.WriteByte('\n')
+				}
+			case xml.CharData:
+				if inText {
+					text.Write(token)
+				}
+			}
+		}
+		return text.String(), nil
+	}
+	return "", errors.New("not a Word document")
+}
+
+// seekerAt reads a ReadSeeker at offsets, for a single reader at a time.
+type seekerAt struct {
+	r io.ReadSeeker
+}
+
+func (s seekerAt) ReadAt(p []byte, offset int64) (int, error) {
+	if _, err := s.r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// pdfText returns the text shown by the content streams of a PDF file.
+// Streams are read uncompressed or with FlateDecode, which covers most
+// documents written by office software; text in fonts with custom encodings
+// comes out as it is stored.
+func pdfText(content io.ReadSeeker, size int64) (string, error) {
+	if size > maxTextSourceSize {
+		return "", errTextTooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(content, maxTextSourceSize))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", errors.New("not a PDF file")
+	}
+	var text bytes.Buffer
+	for rest := data; text.Len() < maxTextBytes; {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		dictionary := rest[:start]
+		if obj := bytes.LastIndex(dictionary, []byte("obj")); obj >= 0 {
+			dictionary = dictionary[obj:]
+		}
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(bytes.TrimPrefix(body, []byte("\r")), []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := body[:end]
+		rest = body[end+len("endstream"):]
+		if !pdfTextStream(dictionary) {
+			continue
+		}
+		if bytes.Contains(dictionary, []byte("/FlateDecode")) {
+			inflater, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// Streams cut short still give the text before the damage.
+			stream, _ = ioutil.ReadAll(io.LimitReader(inflater, maxTextSourceSize))
+		}
+		pdfContentText(stream, &text)
+	}
+	return text.String(), nil
+}
+
+// pdfTextStream reports whether a stream with this dictionary may hold
+// page content: images, fonts, object streams and streams with filters
+// other than FlateDecode do not.
+func pdfTextStream(dictionary []byte) bool {
+	compact := bytes.ReplaceAll(dictionary, []byte(" "), nil)
+	for _, skip := range []string{"/Subtype/Image", "/Type/ObjStm", "/Type/XRef", "/Length1", "/Length2", "/Length3", "/Subtype/Type1C", "/Subtype/CIDFontType0C", "/Subtype/OpenType", "/Type/Metadata",
+		"/DCTDecode", "/JPXDecode", "/CCITTFaxDecode", "/JBIG2Decode", "/LZWDecode", "/ASCII85Decode", "/ASCIIHexDecode", "/RunLengthDecode"} {
+		if pdfHasName(compact, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfHasName reports whether data has name followed by a delimiter, so that
+// "/Length1" is not found in "/Length123".
+func pdfHasName(data []byte, name string) bool {
+	for {
+		i := bytes.Index(data, []byte(name))
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(name):]
+		if len(data) == 0 || pdfDelimiter(data[0]) {
+			return true
+		}
+	}
+}
+
+// pdfContentText writes the strings shown by the text operators of a
+// content stream to text, a line per text object. Large negative kerning in
+// TJ arrays, which some writers use instead of spaces, becomes a space.
+func pdfContentText(content []byte, text *bytes.Buffer) {
+	type operand struct {
+		str    []byte
+		number float64
+		isStr  bool
+	}
+	var operands []operand
+	inText := false
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			str, n := pdfLiteralString(content[i:])
+			operands = append(operands, operand{str: str, isStr: true})
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			str, n := pdfHexString(content[i:])
+			operands = append(operands, operand{str: str, isStr: true})
+			i += n
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(content) && (content[j] == '.' || (content[j] >= '0' && content[j] <= '9')) {
+				j++
+			}
+			number, _ := strconv.ParseFloat(string(content[i:j]), 64)
+			operands = append(operands, operand{number: number})
+			i = j
+		case c == '/':
+			// A name, such as a font resource.
+			i++
+			for i < len(content) && !pdfDelimiter(content[i]) {
+				i++
+			}
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '\'' || c == '"' || c == '*':
+			j := i + 1
+			for j < len(content) && !pdfDelimiter(content[j]) {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteByte('\n')
+			case "Td", "TD", "T*", "Tm", "'", "\"":
+				text.WriteByte(' ')
+			}
+			if op := string(content[i:j]); inText && (op == "Tj" || op == "TJ" || op == "'" || op == "\"") {
+				for _, operand := range operands {
+					switch {
+					case operand.isStr:
+						text.WriteString(pdfStringText(operand.str))
+					case op == "TJ" && operand.number < -200:
+						text.WriteByte(' ')
+					}
+				}
+			}
+			operands = operands[:0]
+			i = j
+		default:
+			i++
+		}
+	}
+}
+
+func pdfDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f\x00()<>[]{}/%", c) >= 0
+}
+
+// pdfLiteralString decodes the literal string at the start of data and
+// returns it with the number of bytes it took.
+func pdfLiteralString(data []byte) ([]byte, int) {
+	var str []byte
+	depth := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch e := data[i]; e {
+			case 'n':
+				str = append(str, '\n')
+			case 'r':
+				str = append(str, '\r')
+			case 't':
+				str = append(str, '\t')
+			case 'b', 'f':
+				str = append(str, ' ')
+			case '\r', '\n':
+				// A line continuation.
+			default:
+				if e >= '0' && e <= '7' {
+					value := 0
+					for n := 0; n < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; n++ {
+						value = value*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					str = append(str, byte(value))
+				} else {
+					str = append(str, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				str = append(str, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return str, i + 1
+			}
+			str = append(str, c)
+		default:
+			str = append(str, c)
+		}
+	}
+	return str, len(data)
+}
+
+// pdfHexString decodes the hexadecimal string at the start of data and
+// returns it with the number of bytes it took.
+func pdfHexString(data []byte) ([]byte, int) {
+	var digits []byte
+	end := bytes.IndexByte(data, '>')
+	if end < 0 {
+		end = len(data) - 1
+	}
+	for _, c := range data[1:end] {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	str, _ := hex.DecodeString(string(digits))
+	return str, end + 1
+}
+
+// pdfStringText decodes a PDF text string: UTF-16 with a byte order mark,
+// or else a single byte encoding, read as Latin-1.
+func pdfStringText(str []byte) string {
+	if len(str) >= 2 && str[0] == 0xFE && str[1] == 0xFF {
+		units := make([]uint16, 0, len(str)/2)
+		for i := 2; i+1 < len(str); i += 2 {
+			units = append(units, uint16(str[i])<<8|uint16(str[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	if utf8.Valid(str) {
+		return string(str)
+	}
+	runes := make([]rune, len(str))
+	for i, b := range str {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
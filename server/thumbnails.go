@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers GIF with image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// thumbnailMaxPixels keeps images that would take too much memory to
+	// decode, such as decompression bombs, from being thumbnailed.
+	thumbnailMaxPixels = 100 << 20
+	thumbnailQuality   = 85
+)
+
+var (
+	// thumbnailSizes are the longest edges, in pixels, of the thumbnails
+	// generated for stored images. Empty disables thumbnails.
+	thumbnailSizes []int
+	// thumbnailSlots bounds how many images are decoded at once.
+	thumbnailSlots = make(chan struct{}, 2)
+)
+
+func thumbnailDir() string {
+	return filepath.Join(dataDir, "thumbnails")
+}
+
+// thumbnailPath is where the thumbnail of a file with the given longest edge
+// is kept; ext is ".jpg", or ".png" for images with transparency.
+func thumbnailPath(fileID string, size int, ext string) string {
+	return filepath.Join(thumbnailDir(), fmt.Sprintf("%s_%d%s", fileID, size, ext))
+}
+
+// parseThumbnailSizes parses the -thumbnail-sizes flag.
+func parseThumbnailSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, field := range splitList(value) {
+		size, err := strconv.Atoi(field)
+		if err != nil || size < 16 || size > 4096 {
+			return nil, fmt.Errorf("thumbnail size %q must be between 16 and 4096", field)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	return sizes, nil
+}
+
+// generateThumbnails renders the thumbnails of a newly stored file in the
+// background when it is a JPEG, PNG or GIF image, replacing those of an
+// earlier version. Encrypted files get none, as thumbnails are kept in the
+// clear.
+func generateThumbnails(metadata FileMetadata) {
+	if len(thumbnailSizes) == 0 {
+		return
+	}
+	removeThumbnails(metadata.ID)
+	if metadata.Encrypted {
+		return
+	}
+	go func() {
+		thumbnailSlots <- struct{}{}
+		defer func() { <-thumbnailSlots }()
+		if err := renderThumbnails(metadata); err != nil {
+			fmt.Printf("Error generating thumbnails of %s: %v\n", metadata.ID, err)
+		}
+	}()
+}
+
+func renderThumbnails(metadata FileMetadata) error {
+	open := func() (io.Reader, func(), error) {
+		file, err := openStoredFile(metadata)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, err := storedFileReader(file, metadata)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return bufio.NewReader(reader), func() { file.Close() }, nil
+	}
+
+	reader, closeFile, err := open()
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(reader)
+	closeFile()
+	if err != nil {
+		// Not an image in a supported format.
+		return nil
+	}
+	if int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		fmt.Printf("Not generating thumbnails of %s: %dx%d is too large\n", metadata.ID, config.Width, config.Height)
+		return nil
+	}
+
+	reader, closeFile, err = open()
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(reader)
+	closeFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(thumbnailDir(), 0755); err != nil {
+		return err
+	}
+	ext := ".jpg"
+	if !opaque(src) {
+		ext = ".png"
+	}
+	// Sizes are largest first, so each thumbnail is scaled from the one
+	// before it rather than from the full image.
+	for _, size := range thumbnailSizes {
+		src = scaleDown(src, size)
+		if err := writeThumbnail(thumbnailPath(metadata.ID, size, ext), src); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Generated %d thumbnails of %s\n", len(thumbnailSizes), metadata.ID)
+	return nil
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func writeThumbnail(path string, img image.Image) error {
+	tmp, err := ioutil.TempFile(thumbnailDir(), ".thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if strings.HasSuffix(path, ".png") {
+		err = png.Encode(tmp, img)
+	} else {
+		err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: thumbnailQuality})
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// scaleDown shrinks img so that its longest edge is at most maxEdge,
+// averaging the source pixels that fall into each destination pixel. Smaller
+// images are returned as they are.
+func scaleDown(img image.Image, maxEdge int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxEdge && height <= maxEdge {
+		return img
+	}
+	dstWidth, dstHeight := maxEdge, maxEdge
+	if width > height {
+		dstHeight = max(1, height*maxEdge/width)
+	} else {
+		dstWidth = max(1, width*maxEdge/height)
+	}
+	// Converting once makes the inner loop cheap for every source format.
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(bounds)
+		draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := y*height/dstHeight, max((y+1)*height/dstHeight, y*height/dstHeight+1)
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := x*width/dstWidth, max((x+1)*width/dstWidth, x*width/dstWidth+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += uint64(pixel[0])
+					g += uint64(pixel[1])
+					b += uint64(pixel[2])
+					a += uint64(pixel[3])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// removeThumbnails drops every thumbnail of a file.
+func removeThumbnails(fileID string) {
+	matches, _ := filepath.Glob(filepath.Join(thumbnailDir(), fileID+"_*"))
+	for _, path := range matches {
+		os.Remove(path)
+	}
+}
+
+// thumbnailHandler serves GET /files/{id}/thumbnail?size=N: the smallest
+// thumbnail whose longest edge is at least N pixels, or the largest one.
+// Without size the smallest thumbnail is served. Files that are not images,
+// or whose thumbnails are still being generated, get 404.
+func thumbnailHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and HEAD methods are allowed")
+		return
+	}
+	requested := 0
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid size")
+			return
+		}
+		requested = size
+	}
+	metadata, ok, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found")
+		return
+	}
+	if !authorizeFile(w, r, metadata, permissionRead) {
+		return
+	}
+
+	var path string
+	for i := len(thumbnailSizes) - 1; i >= 0; i-- {
+		for _, ext := range []string{".jpg", ".png"} {
+			if _, err := os.Stat(thumbnailPath(fileID, thumbnailSizes[i], ext)); err == nil {
+				path = thumbnailPath(fileID, thumbnailSizes[i], ext)
+			}
+		}
+		if path != "" && thumbnailSizes[i] >= requested {
+			break
+		}
+	}
+	file, err := os.Open(path)
+	if path == "" || err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "No thumbnail for this file")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, err.Error())
+		return
+	}
+	contentType := "image/jpeg"
+	if strings.HasSuffix(path, ".png") {
+		contentType = "image/png"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// otlpEndpoint is the URL of an OTLP/HTTP collector, such as
+	// http://localhost:4318, spans are exported to; empty disables tracing.
+	otlpEndpoint string
+
+	tracer = otel.Tracer("fileUpload/server")
+)
+
+// setupTracing exports spans to otlpEndpoint and accepts the trace context
+// clients send in traceparent headers.
+func setupTracing() error {
+	if otlpEndpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(otlpEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("invalid OTLP endpoint %q, expected a URL such as http://localhost:4318", otlpEndpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "file-upload-server"))),
+	))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+// withTracing gives every request a span, a child of the client's span if
+// the request carries one.
+func withTracing(next http.Handler) http.Handler {
+	if otlpEndpoint == "" {
+		return next
+	}
+	return otelhttp.NewHandler(next, "request", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + spanRoute(r.URL.Path)
+	}))
+}
+
+// spanRoute names the endpoint of a path without the IDs in it, so that
+// requests to the same endpoint share a span name.
+func spanRoute(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case parts[0] == "files" && len(parts) > 2:
+		return "/files/{id}/" + parts[2]
+	case parts[0] == "admin" && len(parts) > 1:
+		return "/admin/" + parts[1]
+	case len(parts) > 1:
+		return "/" + parts[0] + "/{id}"
+	}
+	return "/" + parts[0]
+}
+
+// annotateSpan adds attributes to the span of a request.
+func annotateSpan(r *http.Request, attributes ...attribute.KeyValue) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attributes...)
+}
+
+// endSpan ends a span, recording err if there was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trashRetention is how long a deleted file stays in the trash, where
+// POST /files/{id}/restore brings it back, before it is purged. 0 removes
+// deleted files right away.
+var trashRetention = 7 * 24 * time.Hour
+
+// trashPurgeInterval is how often expired files are purged from the trash.
+const trashPurgeInterval = time.Hour
+
+// TrashedFile is the record of a deleted file. It keeps the full metadata,
+// wrapped key included, so that a restored file reads as before.
+type TrashedFile struct {
+	FileMetadata
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+var (
+	trashMutex = &sync.Mutex{}
+	// restoringFiles are trashed files being restored, which the purge
+	// leaves alone. Restoring works on the metadata store without holding
+	// trashMutex, as deletions take the two the other way around.
+	restoringFiles = make(map[string]bool)
+)
+
+func trashDir() string {
+	return filepath.Join(dataDir, "trash")
+}
+
+func trashRecordPath(fileID string) string {
+	return filepath.Join(trashDir(), fileID+".json")
+}
+
+func trashDataPath(fileID string) string {
+	return filepath.Join(trashDir(), fileID+".data")
+}
+
+// moveToTrash moves a stored file and its metadata into the trash. The record
+// is written first, so a crash in between leaves a record whose data is
+// missing rather than data nothing refers to.
+func moveToTrash(r *http.Request, metadata FileMetadata) error {
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	if err := os.MkdirAll(trashDir(), 0700); err != nil {
+		return err
+	}
+	now := timeNow().UTC()
+	data, err := json.Marshal(TrashedFile{
+		FileMetadata: metadata,
+		DeletedAt:    now,
+		DeletedBy:    requestActor(r),
+		PurgeAt:      now.Add(trashRetention),
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(trashRecordPath(metadata.ID), data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(finalFilePath(metadata), trashDataPath(metadata.ID)); err != nil && !os.IsNotExist(err) {
+		os.Remove(trashRecordPath(metadata.ID))
+		return err
+	}
+	return nil
+}
+
+// readTrashRecord reads the record of a trashed file; the caller must hold
+// trashMutex.
+func readTrashRecord(fileID string) (TrashedFile, bool, error) {
+	var trashed TrashedFile
+	data, err := ioutil.ReadFile(trashRecordPath(fileID))
+	if os.IsNotExist(err) {
+		return trashed, false, nil
+	}
+	if err != nil {
+		return trashed, false, err
+	}
+	return trashed, true, json.Unmarshal(data, &trashed)
+}
+
+// readTrash lists the trashed files, oldest deletion first; the caller must
+// hold trashMutex.
+func readTrash() ([]TrashedFile, error) {
+	entries, err := ioutil.ReadDir(trashDir())
+	if os.IsNotExist(err) {
+		return []TrashedFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := []TrashedFile{}
+	for _, entry := range entries {
+		fileID := strings.TrimSuffix(entry.Name(), ".json")
+		if fileID == entry.Name() || !validFileID(fileID) {
+			continue
+		}
+		if trashed, ok, err := readTrashRecord(fileID); err == nil && ok {
+			files = append(files, trashed)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].DeletedAt.Before(files[j].DeletedAt) })
+	return files, nil
+}
+
+// claimTrashedFile reads the record of a trashed file and marks it as being
+// restored. ok is false when the file is not in the trash or is already
+// being restored.
+func claimTrashedFile(fileID string) (trashed TrashedFile, ok bool, err error) {
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	trashed, ok, err = readTrashRecord(fileID)
+	if err != nil || !ok || restoringFiles[fileID] {
+		return trashed, false, err
+	}
+	restoringFiles[fileID] = true
+	return trashed, true, nil
+}
+
+func releaseTrashedFile(fileID string) {
+	trashMutex.Lock()
+	delete(restoringFiles, fileID)
+	trashMutex.Unlock()
+}
+
+// purgeTrashLocked removes a trashed file for good and returns the bytes it
+// freed; the caller must hold trashMutex.
+func purgeTrashLocked(trashed TrashedFile, reason string) int64 {
+	var freed int64
+	if info, err := os.Stat(trashDataPath(trashed.ID)); err == nil {
+		freed = info.Size()
+	}
+	os.Remove(trashDataPath(trashed.ID))
+	os.Remove(trashRecordPath(trashed.ID))
+	removeShards(trashed.ID)
+	removeThumbnails(trashed.ID)
+	audit(nil, AuditEntry{Action: "purge", FileID: trashed.ID, FileName: trashed.FileName, Size: trashed.FileSize, Detail: reason})
+	return freed
+}
+
+// purgeExpiredTrash removes the trashed files whose retention has passed. It
+// runs every trashPurgeInterval and as an eviction hook when space runs short.
+func purgeExpiredTrash(needed int64) int64 {
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	files, err := readTrash()
+	if err != nil {
+		fmt.Println("Error reading trash:", err)
+		return 0
+	}
+	now := timeNow()
+	var freed int64
+	for _, trashed := range files {
+		if trashed.PurgeAt.Before(now) && !restoringFiles[trashed.ID] {
+			freed += purgeTrashLocked(trashed, "retention expired")
+		}
+	}
+	return freed
+}
+
+func startTrashPurge() {
+	registerEvictionHook("trash", purgeExpiredTrash)
+	go func() {
+		for {
+			if freed := purgeExpiredTrash(0); freed > 0 {
+				fmt.Printf("Purged %d bytes from the trash\n", freed)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// restoreFileHandler serves POST /files/{id}/restore, which brings a file
+// back from the trash under its ID. Whoever may delete a file may restore it.
+func restoreFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	if !validFileID(fileID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+		return
+	}
+	trashed, ok, err := claimTrashedFile(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading trash: "+err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeFileNotFound, "File not found in the trash")
+		return
+	}
+	defer releaseTrashedFile(fileID)
+	metadata := trashed.FileMetadata
+	if !authorizeFile(w, r, metadata, permissionDelete) {
+		return
+	}
+	_, stored, err := lookupFileInfo(fileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	}
+	if stored {
+		writeError(w, http.StatusConflict, codeConflict, "A file with this ID is stored")
+		return
+	}
+	// Erasure coded files keep their shards while in the trash.
+	if err := os.Rename(trashDataPath(fileID), finalFilePath(metadata)); err != nil && !(os.IsNotExist(err) && shardsExist(fileID)) {
+		fmt.Println("Error restoring file from the trash:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error restoring file")
+		return
+	}
+	if err := updateFileInfoDB(metadata); err != nil {
+		os.Rename(finalFilePath(metadata), trashDataPath(fileID))
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error updating fileInfoDB: "+err.Error())
+		return
+	}
+	os.Remove(trashRecordPath(fileID))
+	indexStoredFile(metadata)
+	indexFileText(metadata)
+	fmt.Println("Restored file:", fileID)
+	audit(r, AuditEntry{Action: "restore", FileID: fileID, FileName: metadata.FileName, Size: metadata.FileSize})
+	writeJSON(w, metadata.public())
+}
+
+// trashHandler serves the /admin/trash endpoints:
+//
+//	GET    /admin/trash       every trashed file, oldest deletion first
+//	DELETE /admin/trash/{id}  purge a trashed file now
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	switch {
+	case len(parts) == 2 && r.Method == "GET":
+		files, err := readTrash()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading trash: "+err.Error())
+			return
+		}
+		for i := range files {
+			files[i].FileMetadata = files[i].public()
+		}
+		writeJSON(w, files)
+	case len(parts) == 3 && r.Method == "DELETE":
+		if !validFileID(parts[2]) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+			return
+		}
+		trashed, ok, err := readTrashRecord(parts[2])
+		if err != nil || !ok || restoringFiles[parts[2]] {
+			writeError(w, http.StatusNotFound, codeFileNotFound, "File not found in the trash")
+			return
+		}
+		purgeTrashLocked(trashed, "purged by admin")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) > 3:
+		writeError(w, http.StatusNotFound, codeNotFound, "Invalid URL")
+	case len(parts) == 2:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only DELETE method is allowed")
+	}
+}
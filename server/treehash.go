@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+const (
+	hashSHA256     = "sha256"
+	hashSHA256Tree = "sha256-tree"
+	// Tree hash segments are a power of two between these sizes.
+	minHashSegmentSize = 1 << 20
+	maxHashSegmentSize = 1 << 30
+)
+
+// plainHash reports whether FileHash is the SHA-256 of the whole file, as
+// opposed to a tree hash that only clients knowing the mode can check.
+func (m FileMetadata) plainHash() bool {
+	return m.HashAlgorithm == "" || m.HashAlgorithm == hashSHA256
+}
+
+func checkHashAlgorithm(metadata FileMetadata) error {
+	switch metadata.HashAlgorithm {
+	case "", hashSHA256:
+		if metadata.HashSegmentSize != 0 {
+			return fmt.Errorf("hashSegmentSize is only allowed with %s", hashSHA256Tree)
+		}
+	case hashSHA256Tree:
+		size := metadata.HashSegmentSize
+		if size < minHashSegmentSize || size > maxHashSegmentSize || size&(size-1) != 0 {
+			return fmt.Errorf("hashSegmentSize must be a power of two between %d and %d", minHashSegmentSize, maxHashSegmentSize)
+		}
+	default:
+		return fmt.Errorf("Unknown hash algorithm %q", metadata.HashAlgorithm)
+	}
+	return nil
+}
+
+// newFileHasher returns the hash FileHash is checked against: SHA-256, or for
+// sha256-tree the SHA-256 of the concatenated SHA-256 of every
+// HashSegmentSize byte segment of the file.
+func newFileHasher(metadata FileMetadata) hash.Hash {
+	if metadata.plainHash() {
+		return sha256.New()
+	}
+	return &treeHasher{segmentSize: metadata.HashSegmentSize, segment: sha256.New(), root: sha256.New()}
+}
+
+// treeHasher computes a sha256-tree hash from the file written in order.
+type treeHasher struct {
+	segmentSize int64
+	// written counts the bytes of the current segment.
+	written int64
+	segment hash.Hash
+	root    hash.Hash
+}
+
+func (t *treeHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		part := p
+		if remaining := t.segmentSize - t.written; int64(len(part)) > remaining {
+			part = part[:remaining]
+		}
+		t.segment.Write(part)
+		t.written += int64(len(part))
+		p = p[len(part):]
+		if t.written == t.segmentSize {
+			t.root.Write(t.segment.Sum(nil))
+			t.segment.Reset()
+			t.written = 0
+		}
+	}
+	return n, nil
+}
+
+// Sum appends the hash of what was written so far, the final segment
+// included, without changing the state.
+func (t *treeHasher) Sum(b []byte) []byte {
+	if t.written == 0 {
+		return t.root.Sum(b)
+	}
+	// The final, partial segment is folded into a copy of the root state.
+	state, _ := t.root.(encoding.BinaryMarshaler).MarshalBinary()
+	root := sha256.New()
+	root.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	root.Write(t.segment.Sum(nil))
+	return root.Sum(b)
+}
+
+func (t *treeHasher) Reset() {
+	t.segment.Reset()
+	t.root.Reset()
+	t.written = 0
+}
+
+// MarshalBinary saves the state of the hash, so that appends to a file can
+// carry on hashing it.
+func (t *treeHasher) MarshalBinary() ([]byte, error) {
+	segment, err := t.segment.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	root, err := t.root.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	state := make([]byte, 12, 12+len(segment)+len(root))
+	binary.BigEndian.PutUint64(state, uint64(t.written))
+	binary.BigEndian.PutUint32(state[8:], uint32(len(segment)))
+	return append(append(state, segment...), root...), nil
+}
+
+func (t *treeHasher) UnmarshalBinary(state []byte) error {
+	if len(state) < 12 {
+		return errors.New("invalid tree hash state")
+	}
+	written := int64(binary.BigEndian.Uint64(state))
+	segmentLength := int(binary.BigEndian.Uint32(state[8:]))
+	if written < 0 || written >= t.segmentSize || segmentLength > len(state)-12 {
+		return errors.New("invalid tree hash state")
+	}
+	if err := t.segment.(encoding.BinaryUnmarshaler).UnmarshalBinary(state[12 : 12+segmentLength]); err != nil {
+		return err
+	}
+	t.written = written
+	return t.root.(encoding.BinaryUnmarshaler).UnmarshalBinary(state[12+segmentLength:])
+}
+
+func (t *treeHasher) Size() int      { return sha256.Size }
+func (t *treeHasher) BlockSize() int { return sha256.BlockSize }
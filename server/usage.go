@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage accounting counts the bytes every principal sends and receives, in
+// daily buckets kept in <data-dir>/usage.json, and enforces monthly transfer
+// caps. Bytes are counted where a request is served, so in a cluster each
+// node accounts the requests proxied to it.
+var (
+	// usageAccounting is set with -usage-accounting or -transfer-caps.
+	usageAccounting bool
+	// transferCaps are the monthly caps of -transfer-caps by principal; the
+	// cap of everyone applies to principals without one.
+	transferCaps = make(map[string]int64)
+)
+
+const (
+	usageDB = "usage.json"
+	// usageFlushInterval is how often counted bytes are saved; a crash loses
+	// at most this much accounting.
+	usageFlushInterval = time.Minute
+	// usageRetention is how long daily buckets are kept.
+	usageRetention  = 400 * 24 * time.Hour
+	usageDateFormat = "2006-01-02"
+)
+
+// Requests without a principal are accounted under these names, which no
+// principal can have.
+const (
+	usageAnonymous  = "(anonymous)"
+	usageAdminToken = "(admin token)"
+)
+
+// cappedPrefixes are the endpoints that transfer file contents, refused to
+// principals over their cap. Other requests are counted but always served.
+var cappedPrefixes = []string{
+	"/upload_chunk/", "/upload_small", "/upload_tar", "/delta_upload/", "/download/", "/download_archive", "/shared/",
+}
+
+// UsageDay is the traffic of one principal on one UTC day.
+type UsageDay struct {
+	Date         string `json:"date"`
+	IngressBytes int64  `json:"ingressBytes"`
+	EgressBytes  int64  `json:"egressBytes"`
+	Requests     int64  `json:"requests"`
+}
+
+// PrincipalUsage is one principal's entry of GET /admin/usage: the totals
+// and days of the requested window, and where it stands against its cap in
+// the current month.
+type PrincipalUsage struct {
+	Principal        string     `json:"principal"`
+	IngressBytes     int64      `json:"ingressBytes"`
+	EgressBytes      int64      `json:"egressBytes"`
+	Requests         int64      `json:"requests"`
+	MonthToDateBytes int64      `json:"monthToDateBytes"`
+	MonthlyCapBytes  int64      `json:"monthlyCapBytes,omitempty"`
+	CapExceeded      bool       `json:"capExceeded"`
+	Days             []UsageDay `json:"days"`
+}
+
+// UsageReport answers GET /admin/usage.
+type UsageReport struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Principals []PrincipalUsage `json:"principals"`
+}
+
+// TransferCapHints are the details of TRANSFER_CAP_EXCEEDED errors.
+type TransferCapHints struct {
+	MonthlyCapBytes  int64     `json:"monthlyCapBytes"`
+	MonthToDateBytes int64     `json:"monthToDateBytes"`
+	ResetsAt         time.Time `json:"resetsAt"`
+}
+
+var (
+	// usageDays holds the buckets by principal and date.
+	usageDays  = make(map[string]map[string]*UsageDay)
+	usageDirty bool
+	usageMutex = &sync.Mutex{}
+)
+
+// loadTransferCaps reads "<principal> <bytes per month>" lines such as
+// "alice 500GB"; blank lines and lines starting with # are ignored.
+func loadTransferCaps(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected \"<principal> <bytes per month>\"", line)
+		}
+		limit, err := parseByteSize(fields[1])
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("line %d: invalid cap %q", line, fields[1])
+		}
+		transferCaps[fields[0]] = limit
+	}
+	return scanner.Err()
+}
+
+// loadUsage reads the saved buckets and starts saving them every
+// usageFlushInterval.
+func loadUsage() error {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, usageDB))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var saved map[string][]UsageDay
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("%s: %v", usageDB, err)
+		}
+		for principal, days := range saved {
+			usageDays[principal] = make(map[string]*UsageDay, len(days))
+			for i := range days {
+				usageDays[principal][days[i].Date] = &days[i]
+			}
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(usageFlushInterval)
+			if err := saveUsage(); err != nil {
+				fmt.Println("Error saving usage:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// saveUsage writes the buckets if they changed, dropping those older than
+// usageRetention.
+func saveUsage() error {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	if !usageDirty {
+		return nil
+	}
+	oldest := timeNow().UTC().Add(-usageRetention).Format(usageDateFormat)
+	saved := make(map[string][]UsageDay, len(usageDays))
+	for principal, days := range usageDays {
+		for date, day := range days {
+			if date < oldest {
+				delete(days, date)
+				continue
+			}
+			saved[principal] = append(saved[principal], *day)
+		}
+		if len(days) == 0 {
+			delete(usageDays, principal)
+		}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, usageDB)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	usageDirty = false
+	return nil
+}
+
+// usagePrincipal is the name r is accounted under, and whether it is exempt
+// from caps.
+func usagePrincipal(r *http.Request) (string, bool) {
+	principal, role := requestIdentity(r)
+	switch {
+	case principal != "":
+		return principal, role == roleAdmin
+	case role == roleAdmin:
+		return usageAdminToken, true
+	}
+	return usageAnonymous, false
+}
+
+// monthlyCap is the cap of principal, 0 for none.
+func monthlyCap(principal string) int64 {
+	if limit, ok := transferCaps[principal]; ok {
+		return limit
+	}
+	return transferCaps[everyone]
+}
+
+// monthStart is the start of the UTC month of t.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// monthToDateLocked sums principal's traffic this month. It needs
+// usageMutex.
+func monthToDateLocked(principal string) int64 {
+	now := timeNow().UTC()
+	first, today := monthStart(now).Format(usageDateFormat), now.Format(usageDateFormat)
+	var total int64
+	for date, day := range usageDays[principal] {
+		if date >= first && date <= today {
+			total += day.IngressBytes + day.EgressBytes
+		}
+	}
+	return total
+}
+
+// addUsage counts a request's bytes in today's bucket of principal.
+func addUsage(principal string, ingress, egress int64) {
+	date := timeNow().UTC().Format(usageDateFormat)
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	days := usageDays[principal]
+	if days == nil {
+		days = make(map[string]*UsageDay)
+		usageDays[principal] = days
+	}
+	day := days[date]
+	if day == nil {
+		day = &UsageDay{Date: date}
+		days[date] = day
+	}
+	day.IngressBytes += ingress
+	day.EgressBytes += egress
+	day.Requests++
+	usageDirty = true
+}
+
+// withUsage counts the request and response bodies of every request, and
+// refuses transfers to principals that have used up their monthly cap. A
+// transfer that starts below the cap is served in full, so a cap can be
+// overrun by the requests in flight when it is reached.
+func withUsage(next http.Handler) http.Handler {
+	if !usageAccounting {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, exempt := usagePrincipal(r)
+		if !exempt && cappedRequest(r) {
+			if limit := monthlyCap(principal); limit > 0 {
+				usageMutex.Lock()
+				used := monthToDateLocked(principal)
+				usageMutex.Unlock()
+				if used >= limit {
+					resets := monthStart(timeNow()).AddDate(0, 1, 0)
+					w.Header().Set("Retry-After", strconv.Itoa(int(resets.Sub(timeNow()).Seconds())+1))
+					writeErrorDetails(w, http.StatusForbidden, codeTransferCapExceeded,
+						fmt.Sprintf("Monthly transfer cap of %d bytes reached", limit),
+						TransferCapHints{MonthlyCapBytes: limit, MonthToDateBytes: used, ResetsAt: resets})
+					addUsage(principal, 0, 0)
+					return
+				}
+			}
+		}
+		body := &countingReader{reader: r.Body}
+		r.Body = body
+		counter := &countingResponseWriter{ResponseWriter: w}
+		defer func() { addUsage(principal, body.count, counter.count) }()
+		next.ServeHTTP(counter, r)
+	})
+}
+
+func cappedRequest(r *http.Request) bool {
+	if (r.Method == "PUT" || r.Method == "PATCH") && strings.HasPrefix(r.URL.Path, "/files/") {
+		return true
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/files/") && strings.HasSuffix(r.URL.Path, "/append") {
+		return true
+	}
+	for _, prefix := range cappedPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type countingReader struct {
+	reader io.ReadCloser
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.reader.Close()
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// usageHandler serves GET /admin/usage, the traffic of every principal
+// between ?from= and ?to= (dates like 2026-10-01, by default the current
+// month), limited to ?principal= if given.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	if !usageAccounting {
+		writeError(w, http.StatusNotFound, codeNotFound, "Usage accounting is not enabled")
+		return
+	}
+	query := r.URL.Query()
+	now := timeNow().UTC()
+	report := UsageReport{From: monthStart(now).Format(usageDateFormat), To: now.Format(usageDateFormat), Principals: make([]PrincipalUsage, 0)}
+	for _, bound := range []struct {
+		name string
+		dst  *string
+	}{{"from", &report.From}, {"to", &report.To}} {
+		if value := query.Get(bound.name); value != "" {
+			if _, err := time.Parse(usageDateFormat, value); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid %s date, expected YYYY-MM-DD", bound.name))
+				return
+			}
+			*bound.dst = value
+		}
+	}
+
+	usageMutex.Lock()
+	for principal, days := range usageDays {
+		if only := query.Get("principal"); only != "" && principal != only {
+			continue
+		}
+		entry := PrincipalUsage{Principal: principal, MonthToDateBytes: monthToDateLocked(principal), Days: make([]UsageDay, 0)}
+		for date, day := range days {
+			if date < report.From || date > report.To {
+				continue
+			}
+			entry.IngressBytes += day.IngressBytes
+			entry.EgressBytes += day.EgressBytes
+			entry.Requests += day.Requests
+			entry.Days = append(entry.Days, *day)
+		}
+		if principal != usageAdminToken {
+			entry.MonthlyCapBytes = monthlyCap(principal)
+		}
+		entry.CapExceeded = entry.MonthlyCapBytes > 0 && entry.MonthToDateBytes >= entry.MonthlyCapBytes
+		sort.Slice(entry.Days, func(i, j int) bool { return entry.Days[i].Date < entry.Days[j].Date })
+		report.Principals = append(report.Principals, entry)
+	}
+	usageMutex.Unlock()
+	sort.Slice(report.Principals, func(i, j int) bool { return report.Principals[i].Principal < report.Principals[j].Principal })
+	writeJSON(w, report)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxUserAgent is how much of a User-Agent is kept; the rest is dropped.
+const maxUserAgent = 256
+
+// ClientInfo identifies the program that registered an upload, from the
+// User-Agent of the registration. The client sends
+// "file-upload-client/<version> (<os>/<arch>; <go version>)"; other agents
+// are parsed as far as they follow the same "<name>/<version> (<os>; ...)"
+// form, as browsers and curl do.
+type ClientInfo struct {
+	UserAgent string `json:"userAgent"`
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	OS        string `json:"os,omitempty"`
+}
+
+// requestUserAgent is the User-Agent of r, cut to maxUserAgent bytes.
+func requestUserAgent(r *http.Request) string {
+	agent := r.Header.Get("User-Agent")
+	if len(agent) > maxUserAgent {
+		agent = agent[:maxUserAgent]
+	}
+	return agent
+}
+
+// requestClient describes the program that sent r, nil if it did not say.
+func requestClient(r *http.Request) *ClientInfo {
+	agent := requestUserAgent(r)
+	if agent == "" {
+		return nil
+	}
+	client := &ClientInfo{UserAgent: agent}
+	product := agent
+	if end := strings.IndexAny(agent, " ("); end >= 0 {
+		product = agent[:end]
+	}
+	client.Name, client.Version, _ = strings.Cut(product, "/")
+	if start := strings.Index(agent, "("); start >= 0 {
+		if end := strings.Index(agent[start:], ")"); end > 0 {
+			comment, _, _ := strings.Cut(agent[start+1:start+end], ";")
+			client.OS = strings.TrimSpace(comment)
+		}
+	}
+	return client
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version 2 of the API is served under /v2/. Every endpoint of version 1 is
+// available there under the same path, answering errors as RFC 9457 problem
+// details instead of ErrorResponse. Version 2 adds uploads registered with a
+// manifest of their chunk hashes (/v2/uploads) and session tokens
+// (/v2/session); version 1 endpoints keep working unchanged.
+const v2Prefix = "/v2"
+
+// problemTypePrefix starts the type URI of problem details; the error code
+// completes it.
+const problemTypePrefix = "urn:fileupload:error:"
+
+// Problem is the body of every error of version 2, an RFC 9457 problem
+// details object carrying the code, details and retryable flag of
+// ErrorResponse as extension members.
+type Problem struct {
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Status    int             `json:"status"`
+	Detail    string          `json:"detail"`
+	Instance  string          `json:"instance,omitempty"`
+	Code      string          `json:"code"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Retryable bool            `json:"retryable"`
+}
+
+// withAPIVersion serves /v2/ requests with the handlers of version 1, under
+// the path they have there, and rewrites their error responses as problem
+// details. The endpoints only version 2 has keep their path, so that they
+// cannot be reached without the prefix.
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, v2Prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		instance := r.URL.Path
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = v2Route(r), ""
+		problems := &problemWriter{ResponseWriter: w, instance: instance}
+		next.ServeHTTP(problems, r)
+		problems.finish()
+	})
+}
+
+// v2Route maps the path of a /v2/ request to the one it is served under:
+// the version 1 path, except for the upload endpoints of version 2 that
+// version 1 has equivalents of and the endpoints only version 2 has.
+//
+//	PUT    /v2/uploads/{id}/chunks/{n}  POST /upload_chunk/{id}/{n}
+//	POST   /v2/uploads/{id}/complete    /complete_upload/{id}
+//	DELETE /v2/uploads/{id}             /upload/{id}
+//
+// Chunks sent to a manifest upload are checked against the manifest, which
+// replaces any Chunk-Hash header.
+func v2Route(r *http.Request) string {
+	rest := strings.TrimPrefix(r.URL.Path, v2Prefix)
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 || parts[1] == "session" {
+		return r.URL.Path
+	}
+	if parts[1] != "uploads" {
+		return rest
+	}
+	switch {
+	case len(parts) == 5 && parts[3] == "chunks" && r.Method == "PUT":
+		if chunkNumber, err := parseChunkNumber(parts[4]); err == nil && validFileID(parts[2]) {
+			if hash, ok := manifestChunkHash(parts[2], chunkNumber); ok {
+				r.Header.Set("Chunk-Hash", hash)
+			}
+		}
+		r.Method = "POST"
+		return "/upload_chunk/" + parts[2] + "/" + parts[4]
+	case len(parts) == 4 && parts[3] == "complete" && r.Method == "POST":
+		return "/complete_upload/" + parts[2]
+	case len(parts) == 3 && parts[2] != "" && r.Method == "DELETE":
+		return "/upload/" + parts[2]
+	}
+	return r.URL.Path
+}
+
+// problemWriter holds back error responses, which handlers write as
+// ErrorResponse, and sends them as problem details once the handler is done.
+// Other responses pass through.
+type problemWriter struct {
+	http.ResponseWriter
+	instance string
+
+	status  int
+	holding bool
+	buffer  bytes.Buffer
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if p.status != 0 {
+		return
+	}
+	p.status = status
+	if status >= 400 {
+		p.holding = true
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *problemWriter) Write(data []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.holding {
+		return p.buffer.Write(data)
+	}
+	return p.ResponseWriter.Write(data)
+}
+
+func (p *problemWriter) Flush() {
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok && !p.holding {
+		flusher.Flush()
+	}
+}
+
+// finish sends a held back error as problem details. Error bodies that are
+// not an ErrorResponse, such as the plain text of http.NotFound, become the
+// detail of a problem with a code matching the status.
+func (p *problemWriter) finish() {
+	if !p.holding {
+		return
+	}
+	problem := Problem{Title: http.StatusText(p.status), Status: p.status, Instance: p.instance}
+	var envelope struct {
+		ErrorResponse
+		Details json.RawMessage `json:"details"`
+	}
+	if strings.HasPrefix(p.Header().Get("Content-Type"), "application/json") &&
+		json.Unmarshal(p.buffer.Bytes(), &envelope) == nil && envelope.Code != "" {
+		problem.Code, problem.Detail, problem.Details, problem.Retryable = envelope.Code, envelope.Message, envelope.Details, envelope.Retryable
+	} else {
+		problem.Code, problem.Detail = statusErrorCode(p.status), strings.TrimSpace(p.buffer.String())
+		problem.Retryable = retryableCodes[problem.Code]
+	}
+	problem.Type = problemTypePrefix + problem.Code
+
+	header := p.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", "application/problem+json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	p.ResponseWriter.WriteHeader(p.status)
+	json.NewEncoder(p.ResponseWriter).Encode(problem)
+}
+
+// statusErrorCode is the error code of an error response without one.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeAccessDenied
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return codeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return codeTooManyRequests
+	}
+	if status >= 500 {
+		return codeInternalError
+	}
+	return codeInvalidRequest
+}
+
+// UploadManifest is the body of POST /v2/uploads: a registration that lists
+// the SHA-256 of every chunk of ChunkSize bytes up front, so that the server
+// checks each chunk against it and, with -dedup-chunks, copies the chunks it
+// already stores instead of receiving them.
+type UploadManifest struct {
+	FileMetadata
+	Chunks []string `json:"chunks"`
+}
+
+// UploadSession is the state of an upload of version 2: the chunks still to
+// send with PUT /v2/uploads/{id}/chunks/{n} before POST
+// /v2/uploads/{id}/complete, or the stored file once it is complete.
+type UploadSession struct {
+	ID                  string        `json:"id"`
+	FileName            string        `json:"fileName"`
+	FileSize            int64         `json:"fileSize"`
+	ChunkSize           int           `json:"chunkSize"`
+	TotalChunks         int           `json:"totalChunks"`
+	MissingChunks       []int         `json:"missingChunks"`
+	Complete            bool          `json:"complete"`
+	File                *FileMetadata `json:"file,omitempty"`
+	ResumptionToken     string        `json:"resumptionToken,omitempty"`
+	ResumptionExpiresAt *time.Time    `json:"resumptionExpiresAt,omitempty"`
+}
+
+// uploadManifestPath holds the chunk hashes of a manifest upload, one per
+// line in chunk order, so that the hash of a chunk is read at its offset.
+func uploadManifestPath(fileID string) string {
+	return filepath.Join(uploadTmpDir(fileID), "chunks.sha256")
+}
+
+func writeUploadManifest(fileID string, hashes []string) error {
+	if err := os.MkdirAll(uploadTmpDir(fileID), 0755); err != nil {
+		return err
+	}
+	var content strings.Builder
+	for _, hash := range hashes {
+		content.WriteString(strings.ToLower(hash))
+		content.WriteByte('\n')
+	}
+	return ioutil.WriteFile(uploadManifestPath(fileID), []byte(content.String()), 0644)
+}
+
+// manifestChunkHash returns the hash the manifest of an upload lists for a
+// chunk; uploads registered without a manifest have none.
+func manifestChunkHash(fileID string, chunkNumber int) (string, bool) {
+	manifest, err := os.Open(uploadManifestPath(fileID))
+	if err != nil {
+		return "", false
+	}
+	defer manifest.Close()
+	line := make([]byte, 2*sha256.Size+1)
+	if _, err := manifest.ReadAt(line, int64(chunkNumber-1)*int64(len(line))); err != nil && err != io.EOF {
+		return "", false
+	}
+	hash := string(line[:2*sha256.Size])
+	return hash, validChunkHash(hash)
+}
+
+// uploadsV2Handler serves POST /v2/uploads, which registers an upload from
+// its manifest.
+func uploadsV2Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	var manifest UploadManifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid manifest: "+err.Error())
+		return
+	}
+	if len(manifest.Chunks) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "A manifest lists the hash of every chunk")
+		return
+	}
+	result, ok := registerUpload(w, r, registration{FileMetadata: manifest.FileMetadata, ChunkHashes: manifest.Chunks})
+	if !ok {
+		return
+	}
+	if err := writeUploadManifest(result.ID, manifest.Chunks); err != nil {
+		fmt.Println("Error writing upload manifest:", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error writing upload manifest")
+		return
+	}
+
+	existing := make(map[int]bool, len(result.ExistingChunks))
+	for _, chunkNumber := range result.ExistingChunks {
+		existing[chunkNumber] = true
+	}
+	session := newUploadSession(result.FileMetadata, existing)
+	session.ResumptionToken, session.ResumptionExpiresAt = result.ResumptionToken, &result.ResumptionExpiresAt
+	w.Header().Set("Location", v2Prefix+"/uploads/"+result.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// uploadV2Handler serves GET /v2/uploads/{id}, the state of an upload.
+// DELETE, the chunks and the completion are served by the handlers of
+// version 1, see v2Route.
+func uploadV2Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	fileID := strings.TrimPrefix(r.URL.Path, v2Prefix+"/uploads/")
+	if !validFileID(fileID) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid URL")
+		return
+	}
+
+	if stored, found, err := lookupFileInfo(fileID); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Error reading file info: "+err.Error())
+		return
+	} else if found {
+		if !authorizeFile(w, r, stored, permissionRead) {
+			return
+		}
+		public := stored.public()
+		session := newUploadSession(public, nil)
+		session.MissingChunks, session.Complete, session.File = []int{}, true, &public
+		writeJSON(w, session)
+		return
+	}
+	metadataMutex.Lock()
+	metadata, ok := filesMetadata[fileID]
+	metadataMutex.Unlock()
+	if !ok && rejectCancelled(w, fileID) {
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found; it may have been evicted")
+		return
+	}
+	received := make(map[int]bool)
+	for _, chunkNumber := range receivedChunks(metadata) {
+		received[chunkNumber] = true
+	}
+	writeJSON(w, newUploadSession(metadata.public(), received))
+}
+
+// newUploadSession describes an upload of which the chunks in have arrived.
+func newUploadSession(metadata FileMetadata, have map[int]bool) UploadSession {
+	session := UploadSession{
+		ID:            metadata.ID,
+		FileName:      metadata.FileName,
+		FileSize:      metadata.FileSize,
+		ChunkSize:     metadata.ChunkSize,
+		TotalChunks:   metadata.TotalChunks,
+		MissingChunks: []int{},
+	}
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		if !have[chunkNumber] {
+			session.MissingChunks = append(session.MissingChunks, chunkNumber)
+		}
+	}
+	return session
+}
+
+// SessionToken is the answer of POST and GET /v2/session.
+type SessionToken struct {
+	Token     string    `json:"token,omitempty"`
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// sessionHandler serves the session tokens of version 2, which stand in for
+// the credentials they were issued for as bearer tokens until they expire
+// after -session-lifetime, so that long running clients need not send a
+// long lived token with every request:
+//
+//	POST   /v2/session  a token for the principal of the request
+//	GET    /v2/session  the session of the request's token
+//	DELETE /v2/session  revokes the request's token
+//
+// Like login sessions they are signed with the link key rather than stored.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		principal, role := requestIdentity(r)
+		if principal == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Session tokens are issued to authenticated principals")
+			return
+		}
+		session := loginSession{Principal: principal, Role: role, ExpiresAt: timeNow().Add(sessionLifetime).UTC().Truncate(time.Second)}
+		audit(r, AuditEntry{Action: "login", Detail: principal + " as " + role + " with a session token"})
+		writeJSON(w, SessionToken{Token: sessionTokenValue(session), Principal: session.Principal, Role: session.Role, ExpiresAt: session.ExpiresAt})
+	case "GET":
+		session, ok := requestSessionToken(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "No valid session token")
+			return
+		}
+		writeJSON(w, SessionToken{Principal: session.Principal, Role: session.Role, ExpiresAt: session.ExpiresAt})
+	case "DELETE":
+		if session, ok := requestSessionToken(r); ok {
+			endSession(bearerToken(r), session.ExpiresAt)
+			audit(r, AuditEntry{Action: "logout", Detail: session.Principal + " session token"})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, POST and DELETE methods are allowed")
+	}
+}
+
+// sessionTokenValue encodes and signs a session as a bearer token. The
+// signature differs from that of session cookies, so neither passes for the
+// other.
+func sessionTokenValue(session loginSession) string {
+	payload, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sessionTokenSignature(encoded)
+}
+
+func sessionTokenSignature(encoded string) string {
+	mac := hmac.New(sha256.New, linkKey)
+	fmt.Fprintf(mac, "token\n%s", encoded)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestSessionToken returns the session of r's bearer token, if it is a
+// valid session token.
+func requestSessionToken(r *http.Request) (loginSession, bool) {
+	return parseSessionToken(bearerToken(r))
+}
+
+func parseSessionToken(token string) (loginSession, bool) {
+	var session loginSession
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(sessionTokenSignature(encoded))) {
+		return session, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &session) != nil || !timeNow().Before(session.ExpiresAt) {
+		return session, false
+	}
+	loggedOutMutex.Lock()
+	_, ended := loggedOut[token]
+	loggedOutMutex.Unlock()
+	return session, !ended
+}
@@ -0,0 +1,31 @@
+package upload
+
+import "crypto/sha256"
+
+// MerkleTreeRFC6962 is the Merkle tree of chunk manifests: the tree of RFC
+// 6962 section 2.1 over the binary SHA-256 of every chunk.
+const MerkleTreeRFC6962 = "rfc6962-sha256"
+
+// MerkleRoot returns the RFC 6962 Merkle tree hash of leaves: a leaf hashes
+// to SHA-256(0x00 || leaf), a node to SHA-256(0x01 || left || right), and the
+// left subtree holds the largest power of two of leaves smaller than their
+// number.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	if len(leaves) == 1 {
+		leaf := sha256.Sum256(append([]byte{0}, leaves[0]...))
+		return leaf[:]
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	node := sha256.New()
+	node.Write([]byte{1})
+	node.Write(MerkleRoot(leaves[:split]))
+	node.Write(MerkleRoot(leaves[split:]))
+	return node.Sum(nil)
+}
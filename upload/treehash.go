@@ -0,0 +1,78 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Hash algorithms a registration may name in hashAlgorithm.
+const (
+	// HashSHA256 is the SHA-256 of the whole file, the default.
+	HashSHA256 = "sha256"
+	// HashSHA256Tree cuts the file into segments of hashSegmentSize bytes
+	// (the last one may be shorter) and is the SHA-256 of the concatenated
+	// binary SHA-256 of every segment. Segments are independent, so they can
+	// be hashed on every core at once.
+	HashSHA256Tree = "sha256-tree"
+)
+
+// DefaultSegmentSize is the segment size TreeHash callers use unless they
+// have a reason not to: large enough that reads stay sequential on spinning
+// disks, small enough to spread a few GB over many cores.
+const DefaultSegmentSize = 64 << 20
+
+// TreeHash returns the HashSHA256Tree hash of the size bytes of src, hashing
+// up to workers segments at once (0 for one per CPU).
+func TreeHash(src io.ReaderAt, size, segmentSize int64, workers int) ([]byte, error) {
+	if segmentSize <= 0 {
+		return nil, errors.New("segment size must be positive")
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	segments := int((size + segmentSize - 1) / segmentSize)
+	leaves := make([][sha256.Size]byte, segments)
+	next := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < workers && i < segments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, hashBufferSize)
+			for segment := range next {
+				offset := int64(segment) * segmentSize
+				length := segmentSize
+				if offset+length > size {
+					length = size - offset
+				}
+				hasher := sha256.New()
+				_, err := io.CopyBuffer(hasher, io.NewSectionReader(src, offset, length), buffer)
+				if err != nil {
+					once.Do(func() { firstErr = err })
+					continue
+				}
+				hasher.Sum(leaves[segment][:0])
+			}
+		}()
+	}
+	for segment := 0; segment < segments; segment++ {
+		next <- segment
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	root := sha256.New()
+	for _, leaf := range leaves {
+		root.Write(leaf[:])
+	}
+	return root.Sum(nil), nil
+}
@@ -0,0 +1,187 @@
+// Package upload implements the chunked upload protocol of the file upload
+// server on top of apiclient: hashing a file, splitting it into the chunks
+// the server asks for, sending them in parallel while retrying chunks the
+// server is too busy for, and completing the upload. It uses nothing beyond
+// io and net/http, so it also compiles for browsers with GOOS=js GOARCH=wasm,
+// where ../wasm exposes it to JavaScript.
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileUpload/apiclient"
+)
+
+// Options tune an upload; the zero value is usable.
+type Options struct {
+	// ChunkSize is the requested chunk size; 0 lets the server choose.
+	ChunkSize int
+	// Tags are stored with the file.
+	Tags map[string]string
+	// TreeHash registers a HashSHA256Tree hash of DefaultSegmentSize
+	// segments, hashed on every CPU, instead of a single SHA-256.
+	TreeHash bool
+	// Parallel is how many chunks are in flight at once (default 4).
+	Parallel int
+	// BusyRetries is how often a chunk turned away with a retryable error is
+	// sent again (default 5).
+	BusyRetries int
+	// Progress, if set, is called after every stored chunk with the bytes
+	// stored so far. It may be called from several goroutines.
+	Progress func(sent, total int64)
+}
+
+const hashBufferSize = 1 << 20
+
+// Hash returns the SHA-256 of everything r yields, which the server expects
+// as the fileHash of a registration.
+func Hash(r io.Reader) ([]byte, error) {
+	hasher := sha256.New()
+	// Large reads keep the number of reads low where each one is expensive,
+	// such as slices of a browser Blob.
+	if _, err := io.CopyBuffer(hasher, r, make([]byte, hashBufferSize)); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// ChunkRange returns where chunk chunkNumber (1-based) starts in a file of
+// fileSize bytes split into chunkSize chunks, and how long it is.
+func ChunkRange(chunkNumber, chunkSize int, fileSize int64) (offset, length int64) {
+	offset = int64(chunkNumber-1) * int64(chunkSize)
+	length = int64(chunkSize)
+	if offset+length > fileSize {
+		length = fileSize - offset
+	}
+	return offset, length
+}
+
+// Upload registers src as name, sends its chunks and completes the upload.
+func Upload(ctx context.Context, client *apiclient.Client, name string, src io.ReaderAt, size int64, options Options) (*apiclient.UploadReport, error) {
+	if size <= 0 {
+		return nil, errors.New("file is empty")
+	}
+	if options.Parallel <= 0 {
+		options.Parallel = 4
+	}
+	if options.BusyRetries <= 0 {
+		options.BusyRetries = 5
+	}
+	info := apiclient.FileInfo{
+		FileName:  name,
+		FileSize:  size,
+		ChunkSize: options.ChunkSize,
+		Tags:      options.Tags,
+	}
+	var fileHash []byte
+	var err error
+	if options.TreeHash {
+		info.HashAlgorithm, info.HashSegmentSize = HashSHA256Tree, DefaultSegmentSize
+		fileHash, err = TreeHash(src, size, DefaultSegmentSize, 0)
+	} else {
+		fileHash, err = Hash(io.NewSectionReader(src, 0, size))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+	info.FileHash = fmt.Sprintf("%x", fileHash)
+	metadata, err := client.RegisterFile(ctx, info)
+	if err != nil {
+		return nil, fmt.Errorf("registering file: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		sent     int64
+	)
+	for i := 0; i < options.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, metadata.ChunkSize)
+			for chunkNumber := range chunks {
+				offset, length := ChunkRange(chunkNumber, metadata.ChunkSize, size)
+				data := buffer[:length]
+				err := readChunk(src, data, offset)
+				if err == nil {
+					err = sendChunk(ctx, client, metadata.ID, chunkNumber, data, options.BusyRetries)
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("chunk %d: %w", chunkNumber, err)
+						cancel()
+					})
+					continue
+				}
+				if options.Progress != nil {
+					options.Progress(atomic.AddInt64(&sent, length), size)
+				}
+			}
+		}()
+	}
+	for chunkNumber := 1; chunkNumber <= metadata.TotalChunks; chunkNumber++ {
+		select {
+		case chunks <- chunkNumber:
+		case <-ctx.Done():
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report, _, err := client.CompleteUpload(ctx, metadata.ID)
+	if err != nil {
+		return nil, fmt.Errorf("completing upload: %w", err)
+	}
+	return report, nil
+}
+
+func readChunk(src io.ReaderAt, data []byte, offset int64) error {
+	n, err := src.ReadAt(data, offset)
+	if n == len(data) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("reading chunk: %w", err)
+}
+
+// sendChunk uploads a chunk, sending it again after Retry-After (at least a
+// second) while the server answers with a retryable error: 429, or a chunk
+// that arrived damaged.
+func sendChunk(ctx context.Context, client *apiclient.Client, fileID string, chunkNumber int, data []byte, busyRetries int) error {
+	for attempt := 1; ; attempt++ {
+		_, err := client.UploadChunk(ctx, fileID, chunkNumber, data)
+		var apiErr *apiclient.Error
+		if err == nil || attempt > busyRetries || !errors.As(err, &apiErr) || !apiErr.Retryable {
+			return err
+		}
+		wait := time.Duration(apiErr.RetryAfter) * time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+//go:build js && wasm
+
+// Command wasm exposes package upload to JavaScript. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o upload.wasm ./wasm
+//
+// and load it next to wasm_exec.js from the Go distribution (see index.html).
+// It defines a global fileUpload.upload(options) returning a promise of the
+// upload report, with options
+//
+//	server      base URL of the server, e.g. "https://files.example.com"
+//	file        a File, Blob or Uint8Array
+//	name        remote file name (default: the File's name)
+//	token       bearer token, if the server requires one
+//	chunkSize   requested chunk size, 0 lets the server choose
+//	parallel    chunks in flight at once (default 4)
+//	tags        object of string tags stored with the file
+//	onProgress  called with (sentBytes, totalBytes) after every chunk
+//
+// A failed upload rejects with an Error whose status, code and retryable
+// properties come from the server's error response, when there was one.
+//
+// The server must allow the page's origin with -cors-origins.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"syscall/js"
+
+	"fileUpload/apiclient"
+	"fileUpload/upload"
+)
+
+func main() {
+	api := js.Global().Get("Object").New()
+	api.Set("upload", js.FuncOf(uploadFunc))
+	js.Global().Set("fileUpload", api)
+	select {}
+}
+
+func uploadFunc(this js.Value, args []js.Value) interface{} {
+	var options js.Value
+	if len(args) > 0 {
+		options = args[0]
+	}
+	executor := js.FuncOf(func(this js.Value, handlers []js.Value) interface{} {
+		resolve, reject := handlers[0], handlers[1]
+		// The upload blocks on the network and on Blob reads, which need the
+		// event loop, so it must not run in the JavaScript callback.
+		go func() {
+			report, err := runUpload(options)
+			if err != nil {
+				reject.Invoke(jsError(err))
+				return
+			}
+			resolve.Invoke(report)
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+// jsError turns err into a JavaScript Error; server errors also carry their
+// code and whether they are retryable, so callers can branch on them.
+func jsError(err error) js.Value {
+	value := js.Global().Get("Error").New(err.Error())
+	var apiErr *apiclient.Error
+	if errors.As(err, &apiErr) {
+		value.Set("status", apiErr.StatusCode)
+		value.Set("code", apiErr.Code)
+		value.Set("retryable", apiErr.Retryable)
+	}
+	return value
+}
+
+func runUpload(options js.Value) (js.Value, error) {
+	if options.Type() != js.TypeObject {
+		return js.Undefined(), errors.New("upload expects an options object")
+	}
+	server, file := stringOption(options, "server"), options.Get("file")
+	if server == "" || file.IsUndefined() || file.IsNull() {
+		return js.Undefined(), errors.New("options.server and options.file are required")
+	}
+	name := stringOption(options, "name")
+	if name == "" {
+		name = stringOption(file, "name")
+	}
+	if name == "" {
+		return js.Undefined(), errors.New("options.name is required for data without a file name")
+	}
+
+	var src io.ReaderAt
+	var size int64
+	if file.InstanceOf(js.Global().Get("Uint8Array")) {
+		data := make([]byte, file.Get("length").Int())
+		js.CopyBytesToGo(data, file)
+		src, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		src, size = blobReader{file}, int64(file.Get("size").Float())
+	}
+
+	client := apiclient.New(server)
+	client.Token = stringOption(options, "token")
+	uploadOptions := upload.Options{
+		ChunkSize: intOption(options, "chunkSize"),
+		Parallel:  intOption(options, "parallel"),
+		Tags:      tagsOption(options, "tags"),
+	}
+	if progress := options.Get("onProgress"); progress.Type() == js.TypeFunction {
+		uploadOptions.Progress = func(sent, total int64) {
+			progress.Invoke(float64(sent), float64(total))
+		}
+	}
+	report, err := upload.Upload(context.Background(), client, name, src, size, uploadOptions)
+	if err != nil {
+		return js.Undefined(), err
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return js.Undefined(), err
+	}
+	return js.Global().Get("JSON").Call("parse", string(data)), nil
+}
+
+func stringOption(object js.Value, key string) string {
+	if value := object.Get(key); value.Type() == js.TypeString {
+		return value.String()
+	}
+	return ""
+}
+
+// tagsOption reads an object of string values; other values are skipped.
+func tagsOption(object js.Value, key string) map[string]string {
+	value := object.Get(key)
+	if value.Type() != js.TypeObject {
+		return nil
+	}
+	tags := make(map[string]string)
+	keys := js.Global().Get("Object").Call("keys", value)
+	for i := 0; i < keys.Length(); i++ {
+		tagKey := keys.Index(i).String()
+		if tagValue := value.Get(tagKey); tagValue.Type() == js.TypeString {
+			tags[tagKey] = tagValue.String()
+		}
+	}
+	return tags
+}
+
+func intOption(object js.Value, key string) int {
+	if value := object.Get(key); value.Type() == js.TypeNumber {
+		return value.Int()
+	}
+	return 0
+}
+
+// blobReader reads a Blob (or File) in slices, so large files are never held
+// in memory as a whole.
+type blobReader struct {
+	blob js.Value
+}
+
+func (b blobReader) ReadAt(p []byte, offset int64) (int, error) {
+	buffer, err := await(b.blob.Call("slice", float64(offset), float64(offset+int64(len(p)))).Call("arrayBuffer"))
+	if err != nil {
+		return 0, err
+	}
+	n := js.CopyBytesToGo(p, js.Global().Get("Uint8Array").New(buffer))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// await blocks the calling goroutine until promise settles.
+func await(promise js.Value) (js.Value, error) {
+	done := make(chan struct{})
+	var result js.Value
+	var err error
+	onFulfilled := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		result = args[0]
+		close(done)
+		return nil
+	})
+	defer onFulfilled.Release()
+	onRejected := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		err = errors.New(js.Global().Get("String").Invoke(args[0]).String())
+		close(done)
+		return nil
+	})
+	defer onRejected.Release()
+	promise.Call("then", onFulfilled, onRejected)
+	<-done
+	return result, err
+}